@@ -60,3 +60,11 @@ func WaitForBusMessage(topic string) interface{} {
 func BusChannel(topic string) chan interface{} {
 	return getInstance().getBusGroup(topic).Join().In
 }
+
+// BufferedBusChannel returns a channel associated with the topic that holds up to size
+// messages while its receiver is busy, where those sent to a BusChannel would be dropped
+func BufferedBusChannel(topic string, size int) chan interface{} {
+	in := make(chan interface{}, size)
+	getInstance().getBusGroup(topic).Add(in)
+	return in
+}
@@ -161,6 +161,22 @@ func TestWaitForBusMessage(t *testing.T) {
 	}
 }
 
+func TestBufferedBusChannel(t *testing.T) {
+	t.Parallel()
+	channel := "TestBufferedBusChannel"
+	messages := BufferedBusChannel(channel, 2)
+
+	// messages are held while the receiver is busy, up to the size of the buffer
+	SendBusMessage(channel, 1)
+	SendBusMessage(channel, 2)
+	SendBusMessage(channel, 3)
+	sleepMillis(10)
+	if len(messages) != 2 || <-messages != 1 || <-messages != 2 {
+		fmt.Println("expected the first 2 messages to be held")
+		t.Fail()
+	}
+}
+
 // this doesn't work, bcast doesn't store messages if no listeners are there
 func NOTestSendBeforeWait(t *testing.T) {
 	channel := "sendBeforeWait"
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/nimbleindustry/device/define"
+)
+
+// Deadband suppresses insignificant changes of a numeric tag value when reporting by
+// exception. Absolute is the change, in engineering units, and Percent the change relative to
+// the last reported value, that must be exceeded for a new value to be reported. When both
+// are set both must be exceeded. It is intended to be embedded in tag definitions (such as
+// ModbusEntry) so that its settings appear alongside the tag's, where, if set, they override
+// the default deadband.
+type Deadband struct {
+	Absolute float64 `json:"deadband,omitempty"`
+	Percent  float64 `json:"deadbandPercent,omitempty"`
+}
+
+// IsSet returns true if either deadband is defined
+func (d Deadband) IsSet() bool {
+	return d.Absolute > 0 || d.Percent > 0
+}
+
+// Exceeded returns true if the change from the last reported value is significant
+func (d Deadband) Exceeded(last, value float64) bool {
+	delta := math.Abs(value - last)
+	if delta == 0 {
+		return false
+	}
+	if d.Absolute > 0 && delta <= d.Absolute {
+		return false
+	}
+	if d.Percent > 0 && delta <= math.Abs(last)*d.Percent/100 {
+		return false
+	}
+	return true
+}
+
+// ReportByException defines the defaults of the change detection stage: the deadband of tags
+// that do not define their own, and Heartbeat, the maximum time (e.g. "15m") for which an
+// unchanged tag goes unreported
+type ReportByException struct {
+	Deadband
+	Heartbeat string `json:"heartbeat,omitempty"`
+}
+
+type reportedValue struct {
+	TagValue
+	at time.Time
+}
+
+// ChangeDetector reduces ops reports to the tags whose value or quality changed
+// significantly since they were last reported, resending unchanged tags once their heartbeat
+// interval has passed. Tags no longer received are resent once as stale and then forgotten.
+// The tags of each source are tracked apart, so that connections sharing tag names do not
+// mask one another's changes.
+type ChangeDetector struct {
+	defaults  Deadband
+	deadbands map[string]Deadband
+	heartbeat time.Duration
+	reported  map[sourcedTag]reportedValue
+	latest    map[sourcedTag]reportedValue // last value received, and when
+}
+
+// sourcedTag identifies a tag by its name and the source of its values
+type sourcedTag struct {
+	source string
+	tag    string
+}
+
+// NewChangeDetector returns a ChangeDetector applying the passed deadbands, keyed by tag,
+// and the defaults to every other tag. A zero heartbeat disables heartbeats.
+func NewChangeDetector(defaults Deadband, deadbands map[string]Deadband, heartbeat time.Duration) *ChangeDetector {
+	return &ChangeDetector{
+		defaults:  defaults,
+		deadbands: deadbands,
+		heartbeat: heartbeat,
+		reported:  make(map[sourcedTag]reportedValue),
+		latest:    make(map[sourcedTag]reportedValue),
+	}
+}
+
+// Filter returns the tags of the report that are to be reported at the passed time, which
+// may be none
+func (d *ChangeDetector) Filter(report OpsReport, now time.Time) OpsReport {
+	changes := make(OpsReport)
+	for tag, v := range report {
+		key := sourcedTag{source: v.Source, tag: tag}
+		d.latest[key] = reportedValue{TagValue: v, at: now}
+		last, found := d.reported[key]
+		if !found || d.overdue(last, now) || d.changed(tag, last.TagValue, v) {
+			changes[tag] = v
+			d.reported[key] = reportedValue{TagValue: v, at: now}
+		}
+	}
+	return changes
+}
+
+// Heartbeats returns the latest value of every tag whose heartbeat interval has passed at
+// the passed time without it being reported, in a report for each source. Tags not received
+// since they were last reported are returned stale and forgotten, as their source has
+// stopped reporting them.
+func (d *ChangeDetector) Heartbeats(now time.Time) []OpsReport {
+	var heartbeats []OpsReport
+	sources := make(map[string]OpsReport)
+	for key, last := range d.reported {
+		if !d.overdue(last, now) {
+			continue
+		}
+		latest := d.latest[key]
+		v := latest.TagValue
+		if latest.at.After(last.at) {
+			d.reported[key] = reportedValue{TagValue: v, at: now}
+		} else {
+			v.Quality = define.QualityStale
+			v.Error = "no longer reported"
+			delete(d.reported, key)
+			delete(d.latest, key)
+		}
+		report, found := sources[key.source]
+		if !found {
+			report = make(OpsReport)
+			sources[key.source] = report
+			heartbeats = append(heartbeats, report)
+		}
+		report[key.tag] = v
+	}
+	return heartbeats
+}
+
+// NextHeartbeat returns the time at which the next heartbeat falls due, or the zero time if
+// none will
+func (d *ChangeDetector) NextHeartbeat() (next time.Time) {
+	if d.heartbeat <= 0 {
+		return
+	}
+	for _, v := range d.reported {
+		if due := v.at.Add(d.heartbeat); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return
+}
+
+func (d *ChangeDetector) overdue(last reportedValue, now time.Time) bool {
+	return d.heartbeat > 0 && !now.Before(last.at.Add(d.heartbeat))
+}
+
+// changed returns true if the value differs significantly from the one last reported. Any
+// change of quality is significant, as is any change of a non-numeric value.
+func (d *ChangeDetector) changed(tag string, last, value TagValue) bool {
+	if last.Quality != value.Quality || last.Error != value.Error {
+		return true
+	}
+	l, lastNumeric := numericValue(last.Value)
+	v, numeric := numericValue(value.Value)
+	if !lastNumeric || !numeric {
+		return !reflect.DeepEqual(last.Value, value.Value)
+	}
+	deadband, found := d.deadbands[tag]
+	if !found {
+		deadband = d.defaults
+	}
+	return deadband.Exceeded(l, v)
+}
+
+// numericValue returns the value as a float64, if it is a number
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func good(value interface{}) TagValue {
+	return TagValue{Value: value, Quality: define.QualityGood}
+}
+
+func TestDeadband(t *testing.T) {
+	assert.False(t, Deadband{}.IsSet())
+	assert.True(t, Deadband{}.Exceeded(10, 10.001), "expected any change to exceed no deadband")
+	assert.False(t, Deadband{}.Exceeded(10, 10))
+
+	absolute := Deadband{Absolute: 0.5}
+	assert.True(t, absolute.IsSet())
+	assert.False(t, absolute.Exceeded(10, 10.5))
+	assert.True(t, absolute.Exceeded(10, 9.4))
+
+	percent := Deadband{Percent: 10}
+	assert.False(t, percent.Exceeded(200, 219))
+	assert.True(t, percent.Exceeded(200, 179))
+	assert.True(t, percent.Exceeded(0, 0.1), "expected any change from zero to exceed a percent deadband")
+
+	both := Deadband{Absolute: 1, Percent: 10}
+	assert.False(t, both.Exceeded(0, 0.5), "expected absolute deadband to hold near zero")
+	assert.False(t, both.Exceeded(200, 210), "expected percent deadband to hold at large values")
+	assert.True(t, both.Exceeded(200, 230))
+}
+
+func TestChangeDetector(t *testing.T) {
+	start := time.Now()
+	detector := NewChangeDetector(Deadband{Absolute: 1}, map[string]Deadband{"Pressure": {Percent: 5}}, time.Minute)
+
+	report := OpsReport{"Pressure": good(100.0), "Level": good(int16(40)), "Running": good(true), "Recipe": good("A")}
+	assert.Equal(t, report, detector.Filter(report, start), "expected every tag to be reported at first")
+	assert.Equal(t, start.Add(time.Minute), detector.NextHeartbeat())
+
+	changes := detector.Filter(OpsReport{"Pressure": good(104.0), "Level": good(int16(41)), "Running": good(true),
+		"Recipe": good("A")}, start.Add(time.Second))
+	assert.Equal(t, 0, len(changes), "expected changes within deadbands to be suppressed")
+
+	changes = detector.Filter(OpsReport{"Pressure": good(106.0), "Level": good(int16(42)), "Running": good(false),
+		"Recipe": good("B")}, start.Add(2*time.Second))
+	assert.Equal(t, OpsReport{"Pressure": good(106.0), "Level": good(int16(42)), "Running": good(false), "Recipe": good("B")}, changes)
+
+	// drift is measured from the last reported value, not the last received one
+	detector.Filter(OpsReport{"Level": good(int16(43))}, start.Add(3*time.Second))
+	changes = detector.Filter(OpsReport{"Level": good(int16(44))}, start.Add(4*time.Second))
+	assert.Equal(t, OpsReport{"Level": good(int16(44))}, changes)
+
+	stale := TagValue{Value: 106.0, Quality: define.QualityStale, Error: "timeout"}
+	changes = detector.Filter(OpsReport{"Pressure": stale}, start.Add(5*time.Second))
+	assert.Equal(t, OpsReport{"Pressure": stale}, changes, "expected a change of quality to be reported")
+}
+
+func TestChangeDetectorHeartbeats(t *testing.T) {
+	start := time.Now()
+	detector := NewChangeDetector(Deadband{Absolute: 1}, nil, time.Minute)
+	detector.Filter(OpsReport{"Level": good(40.0), "Speed": good(1450.0)}, start)
+	detector.Filter(OpsReport{"Speed": good(1500.0)}, start.Add(30*time.Second))
+	detector.Filter(OpsReport{"Level": good(40.5)}, start.Add(40*time.Second))
+
+	assert.Equal(t, 0, len(detector.Heartbeats(start.Add(59*time.Second))))
+	assert.Equal(t, []OpsReport{{"Level": good(40.5)}}, detector.Heartbeats(start.Add(time.Minute)),
+		"expected the latest value of the silent tag")
+	assert.Equal(t, start.Add(90*time.Second), detector.NextHeartbeat())
+
+	changes := detector.Filter(OpsReport{"Speed": good(1500.0)}, start.Add(95*time.Second))
+	assert.Equal(t, OpsReport{"Speed": good(1500.0)}, changes, "expected an overdue tag to be reported with its poll")
+
+	// a tag no longer received is reported stale once, then forgotten
+	lost := TagValue{Value: 40.5, Quality: define.QualityStale, Error: "no longer reported"}
+	assert.Equal(t, []OpsReport{{"Level": lost}}, detector.Heartbeats(start.Add(2*time.Minute)))
+	assert.Equal(t, start.Add(155*time.Second), detector.NextHeartbeat())
+	assert.Equal(t, OpsReport{"Level": good(40.5)}, detector.Filter(OpsReport{"Level": good(40.5)}, start.Add(3*time.Minute)),
+		"expected a tag received again to be reported")
+
+	disabled := NewChangeDetector(Deadband{}, nil, 0)
+	disabled.Filter(OpsReport{"Level": good(40.0)}, start)
+	assert.True(t, disabled.NextHeartbeat().IsZero())
+	assert.Equal(t, 0, len(disabled.Heartbeats(start.Add(time.Hour))))
+}
+
+func TestChangeDetectorSources(t *testing.T) {
+	start := time.Now()
+	detector := NewChangeDetector(Deadband{Absolute: 1}, nil, time.Minute)
+	plc1 := TagValue{Value: 40.0, Quality: define.QualityGood, Source: "plc1"}
+	plc2 := TagValue{Value: 80.0, Quality: define.QualityGood, Source: "plc2"}
+	detector.Filter(OpsReport{"Level": plc1}, start)
+	assert.Equal(t, OpsReport{"Level": plc2}, detector.Filter(OpsReport{"Level": plc2}, start),
+		"expected the tags of sources to be tracked apart")
+	plc1.Value = 40.5
+	assert.Equal(t, 0, len(detector.Filter(OpsReport{"Level": plc1}, start.Add(time.Second))),
+		"expected a change within the deadband of the source's last value to be suppressed")
+
+	heartbeats := detector.Heartbeats(start.Add(time.Minute))
+	assert.Equal(t, 2, len(heartbeats), "expected a heartbeat report for each source")
+	for _, v := range heartbeats {
+		assert.Len(t, v, 1)
+	}
+}
+
+func TestDeadbandConfig(t *testing.T) {
+	var integration MachineIntegration
+	err := json.Unmarshal([]byte(`{
+		"reportByException": {"deadbandPercent": 2, "heartbeat": "10m"},
+		"modbus": [{"registerName": "Pressure", "functions": [3], "multiplier": 0.1, "deadband": 0.5}]
+	}`), &integration)
+	assert.Nil(t, err, "unmarshall failed")
+	assert.Equal(t, "10m", integration.ReportByException.Heartbeat)
+	assert.Equal(t, 2.0, integration.ReportByException.Percent)
+	assert.Equal(t, Deadband{Absolute: 0.5}, integration.ModbusEntries[0].Deadband)
+	assert.Equal(t, 0.1, integration.ModbusEntries[0].Multiplier)
+}
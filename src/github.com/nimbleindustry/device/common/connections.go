@@ -1,31 +1,113 @@
 package common
 
+import "time"
+
 // Protocol/Fieldbus Definitions
 const (
-	Modbus    = "modbus"
-	ModbusTCP = "modbusTCP"
-	ModbusRTU = "modbusRTU"
-	OPCUA     = "OPCUA"
+	Modbus     = "modbus"
+	ModbusTCP  = "modbusTCP"
+	ModbusRTU  = "modbusRTU"
+	OPCUA      = "OPCUA"
+	CAN        = "CAN"
+	EtherNetIP = "etherNetIP"
+	S7         = "S7"
+	MTConnect  = "MTConnect"
 )
 
-// ConnectionRecord defines fieldbus and IIoT integration specifics
+// ConnectionRecord defines fieldbus and IIoT integration specifics. Ops integrations with
+// ReportByException set receive only the tags that changed significantly, as detected by the
+// change detection service, rather than every poll's values. Username and Password, if set,
+// authenticate sessions with the device (OPC UA), anonymous sessions being used otherwise.
+// Slot is the chassis slot of an EtherNet/IP controller, reached through the backplane, or
+// with Rack locates the CPU of an S7 PLC.
 type ConnectionRecord struct {
-	Provider    string `json:"provider"`
-	Type        string `json:"type"`
-	Endpoint    string `json:"endpoint"`
-	Port        int    `json:"port"`
-	Protocol    string `json:"protocol"`
-	ProviderKey string `json:"providerKey, omitempty"`
-	Baudrate    int    `json:"baudRate, omitempty"`
+	Name              string `json:"name,omitempty"`
+	Provider          string `json:"provider"`
+	Type              string `json:"type"`
+	Endpoint          string `json:"endpoint"`
+	Port              int    `json:"port"`
+	Protocol          string `json:"protocol"`
+	ProviderKey       string `json:"providerKey,omitempty"`
+	Baudrate          int    `json:"baudRate,omitempty"`
+	DataBits          int    `json:"dataBits,omitempty"`
+	Parity            string `json:"parity,omitempty"`
+	StopBits          int    `json:"stopBits,omitempty"`
+	UnitID            int    `json:"unitId,omitempty"`
+	MaxReadGap        int    `json:"maxReadGap,omitempty"`
+	KeepAlive         string `json:"keepAlive,omitempty"`
+	IdleTimeout       string `json:"idleTimeout,omitempty"`
+	ReportByException bool   `json:"reportByException,omitempty"`
+	Username          string `json:"username,omitempty"`
+	Password          string `json:"password,omitempty"`
+	Slot              int    `json:"slot,omitempty"`
+	Rack              int    `json:"rack,omitempty"`
+}
+
+// ConnectionStatus is sent by fieldbus services on the TopicConnectionState topic whenever
+// the state of their connection to a device changes
+type ConnectionStatus struct {
+	Timestamp time.Time     `json:"timeStamp"`
+	Service   string        `json:"service"`
+	Endpoint  string        `json:"endpoint"`
+	State     string        `json:"state"`
+	Error     string        `json:"error,omitempty"`
+	Failures  int           `json:"failures,omitempty"`
+	RetryIn   time.Duration `json:"retryIn,omitempty"`
+}
+
+// ModbusServerConfig defines the embedded modbus tcp server, which serves the latest tag
+// values reported by every fieldbus service. Endpoint and Port select the listening address
+// and UnitID, if non-zero, the only unit ID answered. Each register entry places the tag
+// named by its registerName in the table read by its (first) read function; entries that
+// also declare a write function accept writes, which are forwarded to the source tag when
+// ForwardWrites is set.
+type ModbusServerConfig struct {
+	ConnectionRecord
+	ForwardWrites bool          `json:"forwardWrites,omitempty"`
+	Registers     []ModbusEntry `json:"modbus"`
+}
+
+// ModbusBridgeConfig defines a modbus tcp to rtu bridge, which forwards the requests of modbus
+// tcp clients to the slaves of a serial line. Endpoint and the serial fields select the line,
+// and should match those of any modbusRTU record polling it, with which the bridge shares the
+// port. UnitID, if non-zero, is the slave addressed by requests for unit 255. Listen is the
+// address on which clients are accepted, e.g. ":5020".
+type ModbusBridgeConfig struct {
+	ConnectionRecord
+	Listen string `json:"listen"`
+}
+
+// OPCUAServerConfig defines the embedded OPC UA server, which exposes the asset hierarchy and
+// every tag of the equipment config as an address space, the tags' values being updated as
+// they are reported by the fieldbus services. Endpoint and Port select the listening address.
+// Sessions must authenticate as Username with Password if set, and may be anonymous otherwise.
+// Locale selects the language of the descriptions served, "en" if unset.
+type OPCUAServerConfig struct {
+	ConnectionRecord
+	Locale string `json:"locale,omitempty"`
+}
+
+// MTConnectAgentConfig defines the embedded MTConnect agent, which serves the probe, current
+// and sample documents of the asset, whose data items are the tags of the equipment config
+// and whose observations are the values reported by the fieldbus services. Endpoint and Port
+// select the listening address. BufferSize is the number of observations held for sample
+// requests, 131072 if unset.
+type MTConnectAgentConfig struct {
+	ConnectionRecord
+	BufferSize int `json:"bufferSize,omitempty"`
 }
 
 // Connections defines the arrays of ConnectionRecords defined for the system
 type Connections struct {
-	DeviceID                          string             `json:"deviceId"`
-	DeviceStateConnections            []ConnectionRecord `json:"deviceState"`
-	HistorianConnections              []ConnectionRecord `json:"historian"`
-	MachineConnections                []ConnectionRecord `json:"machineIntegration"`
-	OperationsAndTelemetryConnections []ConnectionRecord `json:"machineOperationsAndTelemetry"`
+	DeviceID                          string                `json:"deviceId"`
+	DeviceStateConnections            []ConnectionRecord    `json:"deviceState"`
+	HistorianConnections              []ConnectionRecord    `json:"historian"`
+	MachineConnections                []ConnectionRecord    `json:"machineIntegration"`
+	OperationsAndTelemetryConnections []ConnectionRecord    `json:"machineOperationsAndTelemetry"`
+	ModbusServer                      *ModbusServerConfig   `json:"modbusServer,omitempty"`
+	ModbusBridges                     []ModbusBridgeConfig  `json:"modbusBridge,omitempty"`
+	OPCUAServer                       *OPCUAServerConfig    `json:"opcuaServer,omitempty"`
+	MTConnectAgent                    *MTConnectAgentConfig `json:"mtconnectAgent,omitempty"`
 }
 
 // GetMachineConnection returns a ConnectionRecord from the stored MachineConnections
@@ -41,3 +123,14 @@ func (conn Connections) GetMachineConnection(class string) (record ConnectionRec
 	}
 	return
 }
+
+// GetMachineConnections returns every ConnectionRecord from the stored MachineConnections
+// that matches the supplied class, in the order in which they were defined
+func (conn Connections) GetMachineConnections(class string) (records []ConnectionRecord) {
+	for _, v := range conn.MachineConnections {
+		if v.Type == class {
+			records = append(records, v)
+		}
+	}
+	return
+}
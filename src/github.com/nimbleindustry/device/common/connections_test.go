@@ -15,6 +15,18 @@ func TestLoadModbusTCPDefinitions(t *testing.T) {
 	assert.NotEmpty(t, record.Type, "Expected to find non-empty modbusTCP entry")
 }
 
+func TestLoadAllModbusTCPDefinitions(t *testing.T) {
+	var connections Connections
+	err := json.Unmarshal([]byte(connectionFixture1), &connections)
+	assert.Nil(t, err, "unmarshall failed")
+	records := connections.GetMachineConnections(ModbusTCP)
+	assert.Equal(t, 2, len(records), "Expected to find two modbusTCP entries")
+	assert.Equal(t, "10.0.1.30", records[0].Endpoint)
+	assert.Equal(t, "10.0.1.31", records[1].Endpoint)
+	records = connections.GetMachineConnections("WillNotFind")
+	assert.Empty(t, records, "Expected to find no entries")
+}
+
 func TestUnfoundConnectionDefinitions(t *testing.T) {
 	var connections Connections
 	err := json.Unmarshal([]byte(connectionFixture1), &connections)
@@ -0,0 +1,91 @@
+package common
+
+import "time"
+
+// DiagnosticsInterval is the interval at which fieldbus services publish their diagnostics
+const DiagnosticsInterval = time.Minute
+
+// LatencyBuckets are the upper bounds of the buckets of a LatencyHistogram
+var LatencyBuckets = []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond}
+
+// LatencyHistogram counts the latencies of requests, from the request being sent to its
+// response arriving or its failure, in buckets bounded by Bounds. Counts has a final bucket
+// for latencies beyond the last bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []int           `json:"counts"`
+	Total  time.Duration   `json:"total"`
+	Max    time.Duration   `json:"max"`
+}
+
+// Add counts a latency
+func (h *LatencyHistogram) Add(latency time.Duration) {
+	if h.Counts == nil {
+		h.Bounds = LatencyBuckets
+		h.Counts = make([]int, len(LatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(h.Bounds) && latency > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Total += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+}
+
+// FieldbusCounters count the requests made to a fieldbus device and their outcomes. Responses
+// include exception responses, which are also counted by exception code. Requests that went
+// unanswered count as Timeouts, those answered by a corrupted frame as CRCErrors, and any other
+// communication failure (e.g. a dropped connection) as Errors.
+type FieldbusCounters struct {
+	Requests   int         `json:"requests"`
+	Responses  int         `json:"responses"`
+	Timeouts   int         `json:"timeouts"`
+	CRCErrors  int         `json:"crcErrors"`
+	Errors     int         `json:"errors"`
+	Exceptions map[int]int `json:"exceptions,omitempty"`
+}
+
+func (c FieldbusCounters) copy() *FieldbusCounters {
+	if c.Exceptions != nil {
+		exceptions := make(map[int]int, len(c.Exceptions))
+		for k, v := range c.Exceptions {
+			exceptions[k] = v
+		}
+		c.Exceptions = exceptions
+	}
+	return &c
+}
+
+// FieldbusDiagnostics is sent periodically by fieldbus services on the TopicDiagnostics topic,
+// counting the requests made to their connection, and to each tag, since the service was
+// created. Reconnects counts the connections established after the first.
+type FieldbusDiagnostics struct {
+	FieldbusCounters
+
+	Timestamp  time.Time                    `json:"timeStamp"`
+	Service    string                       `json:"service"`
+	Endpoint   string                       `json:"endpoint"`
+	Reconnects int                          `json:"reconnects"`
+	Latency    LatencyHistogram             `json:"latency"`
+	Tags       map[string]*FieldbusCounters `json:"tags,omitempty"`
+}
+
+// Copy returns a deep copy of the diagnostics, which may be sent on the bus while the original
+// continues counting
+func (d *FieldbusDiagnostics) Copy() *FieldbusDiagnostics {
+	c := *d
+	c.FieldbusCounters = *d.FieldbusCounters.copy()
+	c.Latency.Counts = append([]int(nil), d.Latency.Counts...)
+	if d.Tags != nil {
+		c.Tags = make(map[string]*FieldbusCounters, len(d.Tags))
+		for k, v := range d.Tags {
+			c.Tags[k] = v.copy()
+		}
+	}
+	return &c
+}
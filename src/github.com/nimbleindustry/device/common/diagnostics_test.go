@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	for _, v := range []time.Duration{time.Millisecond, 5 * time.Millisecond, 6 * time.Millisecond, 3 * time.Second} {
+		h.Add(v)
+	}
+	assert.Equal(t, len(LatencyBuckets)+1, len(h.Counts))
+	assert.Equal(t, 2, h.Counts[0], "expected latencies up to the bound to be counted in its bucket")
+	assert.Equal(t, 1, h.Counts[1])
+	assert.Equal(t, 1, h.Counts[len(LatencyBuckets)], "expected the last bucket to count longer latencies")
+	assert.Equal(t, 3*time.Second, h.Max)
+	assert.Equal(t, 3012*time.Millisecond, h.Total)
+}
+
+func TestFieldbusDiagnosticsCopy(t *testing.T) {
+	d := &FieldbusDiagnostics{Service: "plc", Tags: map[string]*FieldbusCounters{"Speed": {Requests: 1}}}
+	d.Requests = 1
+	d.Exceptions = map[int]int{2: 1}
+	d.Latency.Add(time.Millisecond)
+
+	c := d.Copy()
+	d.Requests++
+	d.Exceptions[2]++
+	d.Tags["Speed"].Requests++
+	d.Latency.Add(time.Millisecond)
+	assert.Equal(t, 1, c.Requests)
+	assert.Equal(t, 1, c.Exceptions[2])
+	assert.Equal(t, 1, c.Tags["Speed"].Requests)
+	assert.Equal(t, 1, c.Latency.Counts[0])
+
+	b, err := json.Marshal(c)
+	assert.Nil(t, err)
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &m))
+	assert.Equal(t, 1.0, m["requests"], "expected the connection's counters at the top level")
+	assert.Equal(t, map[string]interface{}{"2": 1.0}, m["exceptions"])
+}
@@ -1,20 +1,298 @@
 package common
 
+import "fmt"
+
 // MLMap provides i18n support
 type MLMap map[string]string
 
 // MachineIntegration houses fieldbus integration configuration information
 type MachineIntegration struct {
-	ModbusEntries []ModbusEntry `json:"modbus,omitempty"`
+	PollGroups        []PollGroup           `json:"pollGroups,omitempty"`
+	ModbusDevices     []ModbusDevice        `json:"modbusDevices,omitempty"`
+	ModbusEntries     []ModbusEntry         `json:"modbus,omitempty"`
+	OPCUAEntries      []OPCUAEntry          `json:"opcua,omitempty"`
+	CAN               *CANIntegration       `json:"can,omitempty"`
+	Serial            []SerialIntegration   `json:"serial,omitempty"`
+	EtherNetIPEntries []EtherNetIPEntry     `json:"etherNetIP,omitempty"`
+	S7Entries         []S7Entry             `json:"s7,omitempty"`
+	MTConnect         *MTConnectIntegration `json:"mtconnect,omitempty"`
+	ReportByException *ReportByException    `json:"reportByException,omitempty"`
+}
+
+// ModbusDevice is one of several modbus slaves reached through a single connection, such as
+// the serial devices behind a modbus tcp to rtu gateway. The device is polled for every entry
+// of its TagGroup using its UnitID, and its values are reported as <name>.<registerName>.
+// Several devices may share a tag group, e.g. a number of identical drives.
+type ModbusDevice struct {
+	Name     string `json:"name"`
+	UnitID   int    `json:"unitId"`
+	TagGroup string `json:"tagGroup"`
+}
+
+// PollGroup defines a named polling rate which tags may be assigned to. Interval is a
+// duration string such as "250ms", "5s" or "10m". A group named "default" overrides the
+// rate of tags that are not otherwise assigned.
+type PollGroup struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
 }
 
+// Modbus register data types
+const (
+	DataTypeInt16   = "int16"
+	DataTypeUint16  = "uint16"
+	DataTypeInt32   = "int32"
+	DataTypeUint32  = "uint32"
+	DataTypeFloat32 = "float32"
+	DataTypeFloat64 = "float64"
+	DataTypeString  = "string"
+	DataTypeBit     = "bit"
+	DataTypeBits    = "bits"
+)
+
 // ModbusEntry defines a single modbus port's configuration information
+//
+// Register values are decoded according to DataType (int16 if unspecified). Multi-register
+// values are big-endian (ABCD) by default; ByteSwap swaps the bytes within each register and
+// WordSwap reverses the order of the registers. Count overrides the number of registers
+// occupied, which is required for strings (two ASCII characters per register). The bit
+// data type extracts the single bit at BitIndex, bits returns every bit of the register(s).
+// An entry is polled at the rate of its PollGroup, or at its own PollInterval (e.g. "500ms").
+//
+// Entries are read from the unit ID of their connection unless UnitID is set. Entries with a
+// TagGroup are templates that are read only on behalf of the ModbusDevices using the group.
+//
+// Besides the table functions (1-6, 15 and 16), bit entries declaring mask write register (22)
+// are written without disturbing the other bits of their register, and entries declaring
+// read/write multiple registers (23) are written at WriteAddress (Address if unset) and read
+// back from Address in a single transaction, as handshakes require. Entries declaring read
+// FIFO queue (24) report the values queued at the FIFO pointer Address, each of the entry's
+// data type. Entries declaring read and/or write file record (20, 21) occupy the records of
+// File starting at record number Address.
+//
+// In the register map of the modbus server, Source, if set, names the fieldbus service whose
+// values of the tag are served and to which client writes are forwarded.
 type ModbusEntry struct {
+	Scaling
+	Deadband
+
 	RegisterName string `json:"registerName"`
 	Address      int    `json:"address"`
 	Class        string `json:"class"`
 	Desc         MLMap  `json:"desc"`
 	Functions    []int  `json:"functions"`
+	DataType     string `json:"dataType,omitempty"`
+	Count        int    `json:"count,omitempty"`
+	ByteSwap     bool   `json:"byteSwap,omitempty"`
+	WordSwap     bool   `json:"wordSwap,omitempty"`
+	BitIndex     int    `json:"bitIndex,omitempty"`
+	PollGroup    string `json:"pollGroup,omitempty"`
+	PollInterval string `json:"pollInterval,omitempty"`
+	UnitID       int    `json:"unitId,omitempty"`
+	TagGroup     string `json:"tagGroup,omitempty"`
+	WriteAddress *int   `json:"writeAddress,omitempty"`
+	File         int    `json:"file,omitempty"`
+	Source       string `json:"source,omitempty"`
+}
+
+// RegisterCount returns the number of 16bit registers occupied by the entry's value
+func (entry ModbusEntry) RegisterCount() int {
+	if entry.Count > 0 {
+		return entry.Count
+	}
+	switch entry.DataType {
+	case DataTypeInt32, DataTypeUint32, DataTypeFloat32:
+		return 2
+	case DataTypeFloat64:
+		return 4
+	}
+	return 1
+}
+
+// OPCUAEntry defines a single OPC UA variable, selected by NodeID or BrowsePath
+type OPCUAEntry struct {
+	Scaling
+	Deadband
+
+	TagName      string `json:"tagName"`
+	NodeID       string `json:"nodeId,omitempty"`
+	BrowsePath   string `json:"browsePath,omitempty"`
+	Class        string `json:"class"`
+	Desc         MLMap  `json:"desc"`
+	PollGroup    string `json:"pollGroup,omitempty"`
+	PollInterval string `json:"pollInterval,omitempty"`
+}
+
+// EtherNetIPEntry defines a single tag of a Logix controller
+type EtherNetIPEntry struct {
+	Scaling
+	Deadband
+
+	TagName      string `json:"tagName"`
+	Address      string `json:"address"`
+	Elements     int    `json:"elements,omitempty"`
+	Writable     bool   `json:"writable,omitempty"`
+	Class        string `json:"class"`
+	Desc         MLMap  `json:"desc"`
+	PollGroup    string `json:"pollGroup,omitempty"`
+	PollInterval string `json:"pollInterval,omitempty"`
+}
+
+// ElementNames returns the names the entry's values are reported as
+func (e EtherNetIPEntry) ElementNames() []string {
+	if e.Elements <= 1 {
+		return []string{e.TagName}
+	}
+	names := make([]string, e.Elements)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s[%d]", e.TagName, i)
+	}
+	return names
+}
+
+// S7Entry defines a single value of a Siemens S7 PLC, addressed in STEP 7 notation
+type S7Entry struct {
+	Scaling
+	Deadband
+
+	TagName      string `json:"tagName"`
+	Address      string `json:"address"`
+	DataType     string `json:"dataType,omitempty"`
+	Writable     bool   `json:"writable,omitempty"`
+	Class        string `json:"class"`
+	Desc         MLMap  `json:"desc"`
+	PollGroup    string `json:"pollGroup,omitempty"`
+	PollInterval string `json:"pollInterval,omitempty"`
+}
+
+// MTConnectIntegration defines the data items read from the SHDR streams of MTConnect
+// adapters. The latest value of each data item is reported at the rate of the PollGroup, or
+// at PollInterval.
+type MTConnectIntegration struct {
+	PollGroup    string              `json:"pollGroup,omitempty"`
+	PollInterval string              `json:"pollInterval,omitempty"`
+	DataItems    []MTConnectDataItem `json:"dataItems"`
+}
+
+// MTConnectDataItem selects a single data item of an MTConnect adapter
+type MTConnectDataItem struct {
+	Scaling
+	Deadband
+
+	TagName  string `json:"tagName,omitempty"`
+	Key      string `json:"key"`
+	Category string `json:"category"`
+	Type     string `json:"type"`
+	Class    string `json:"class"`
+	Desc     MLMap  `json:"desc"`
+}
+
+// ReportedName returns the name of the tag reporting the data item
+func (d MTConnectDataItem) ReportedName() string {
+	if d.TagName != "" {
+		return d.TagName
+	}
+	return d.Key
+}
+
+// CANIntegration defines the signals read from a CAN bus, as described by the DBC file
+// DBCFile (a path relative to the configuration directory unless absolute). Every signal of
+// the file is reported, named <message>.<signal>, unless Signals selects those reported. The
+// latest value of each signal is reported at the rate of the PollGroup, or at PollInterval.
+type CANIntegration struct {
+	DBCFile      string      `json:"dbcFile"`
+	PollGroup    string      `json:"pollGroup,omitempty"`
+	PollInterval string      `json:"pollInterval,omitempty"`
+	Signals      []CANSignal `json:"signals,omitempty"`
+}
+
+// CANSignal selects a single signal of the DBC file
+type CANSignal struct {
+	Deadband
+
+	TagName string `json:"tagName,omitempty"`
+	Message string `json:"message,omitempty"`
+	Signal  string `json:"signal"`
+	Class   string `json:"class"`
+	Desc    MLMap  `json:"desc"`
+}
+
+// Serial record framings
+const (
+	SerialFramingDelimiter      = "delimiter"      // records end with a delimiter, "\r\n" by default
+	SerialFramingFixed          = "fixed"          // records of a fixed length
+	SerialFramingSTXETX         = "stxEtx"         // records between STX (0x02) and ETX (0x03)
+	SerialFramingLengthPrefixed = "lengthPrefixed" // records preceded by their big-endian length
+)
+
+// Serial record checksums
+const (
+	SerialChecksumSum8  = "sum8"  // sum of the bytes, modulo 256
+	SerialChecksumXOR8  = "xor8"  // exclusive or of the bytes
+	SerialChecksumLRC   = "lrc"   // two's complement of the sum of the bytes
+	SerialChecksumCRC16 = "crc16" // CRC-16/MODBUS, least significant byte first
+)
+
+// SerialIntegration defines a device emitting records over a serial port, such as a scale, a
+// barcode reader or a legacy controller. Endpoint and the serial fields of the embedded record
+// select the port (9600 baud, 8 data bits, no parity and 1 stop bit unless set). Devices that
+// must be asked for each record are sent Command (or the bytes of CommandHex) at the rate of
+// the PollGroup, or at PollInterval, and must respond within Timeout (one second by default);
+// other devices are read as they emit records, their fields being reported stale should none
+// arrive within Timeout, if set. The fields of every record are reported as it is received.
+type SerialIntegration struct {
+	ConnectionRecord
+	Framing      SerialFraming   `json:"framing"`
+	Checksum     *SerialChecksum `json:"checksum,omitempty"`
+	Command      string          `json:"command,omitempty"`
+	CommandHex   string          `json:"commandHex,omitempty"`
+	PollGroup    string          `json:"pollGroup,omitempty"`
+	PollInterval string          `json:"pollInterval,omitempty"`
+	Timeout      string          `json:"timeout,omitempty"`
+	Fields       []SerialField   `json:"fields"`
+}
+
+// SerialFraming defines how records are delimited in the bytes received, by Type: the
+// Delimiter ending each record, the Length of fixed length records, or the size of the length
+// prefix (LengthBytes, 1 or 2) and the LengthAdjust added to the prefix's value to give the
+// number of bytes following it. The framing bytes are not part of the record. Records longer
+// than MaxLength (1024 by default) are discarded.
+type SerialFraming struct {
+	Type         string `json:"type"`
+	Delimiter    string `json:"delimiter,omitempty"`
+	Length       int    `json:"length,omitempty"`
+	LengthBytes  int    `json:"lengthBytes,omitempty"`
+	LengthAdjust int    `json:"lengthAdjust,omitempty"`
+	MaxLength    int    `json:"maxLength,omitempty"`
+}
+
+// SerialChecksum defines the checksum ending each record, computed over the bytes of the
+// record from Start. The checksum is binary, or its hexadecimal text if Hex is set. Records
+// failing their checksum are discarded.
+type SerialChecksum struct {
+	Type  string `json:"type"`
+	Hex   bool   `json:"hex,omitempty"`
+	Start int    `json:"start,omitempty"`
+}
+
+// SerialField extracts a tag from each record: the first submatch (or the match) of the
+// regular expression Pattern, or else the Length bytes (the rest of the record if 0) at
+// Offset. The value is a number in text unless DataType is string, or, for fields extracted by
+// offset, one of the binary modbus data types other than bit and bits, in big-endian byte
+// order unless LittleEndian is set. A record not matching the Pattern does not report the
+// field.
+type SerialField struct {
+	Scaling
+	Deadband
+
+	TagName      string `json:"tagName"`
+	Pattern      string `json:"pattern,omitempty"`
+	Offset       int    `json:"offset,omitempty"`
+	Length       int    `json:"length,omitempty"`
+	DataType     string `json:"dataType,omitempty"`
+	LittleEndian bool   `json:"littleEndian,omitempty"`
+	Class        string `json:"class"`
+	Desc         MLMap  `json:"desc"`
 }
 
 // ErrorCode maps codes to (i18n) descriptions
@@ -70,3 +348,101 @@ func (machineIntegration MachineIntegration) FindModbusEntriesByClass(class stri
 	}
 	return
 }
+
+// ModbusMaxUnitID is the highest addressable modbus unit (slave) ID, 0 being broadcast
+const ModbusMaxUnitID = 247
+
+// ExpandModbusDevices replaces the template entries of each tag group with one copy per device
+// using the group. Copies are named <device>.<registerName> and read from the device's unit
+// ID. Entries without a tag group are returned unchanged.
+func ExpandModbusDevices(entries []ModbusEntry, devices []ModbusDevice) ([]ModbusEntry, error) {
+	groups := make(map[string][]ModbusEntry)
+	var expanded []ModbusEntry
+	for _, v := range entries {
+		if v.TagGroup == "" {
+			expanded = append(expanded, v)
+			continue
+		}
+		groups[v.TagGroup] = append(groups[v.TagGroup], v)
+	}
+	names := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if device.Name == "" {
+			return nil, fmt.Errorf("modbus device with unit ID %d has no name", device.UnitID)
+		}
+		if names[device.Name] {
+			return nil, fmt.Errorf("modbus device %s defined more than once", device.Name)
+		}
+		names[device.Name] = true
+		if device.UnitID < 1 || device.UnitID > ModbusMaxUnitID {
+			return nil, fmt.Errorf("modbus device %s has invalid unit ID %d", device.Name, device.UnitID)
+		}
+		group, found := groups[device.TagGroup]
+		if !found {
+			return nil, fmt.Errorf("modbus device %s uses undefined tag group %s", device.Name, device.TagGroup)
+		}
+		for _, v := range group {
+			v.RegisterName = device.Name + "." + v.RegisterName
+			v.UnitID = device.UnitID
+			v.TagGroup = ""
+			expanded = append(expanded, v)
+		}
+	}
+	return expanded, nil
+}
+
+// TagDefinition is a tag defined by the machine integration, named as it is reported
+type TagDefinition struct {
+	Deadband
+
+	Name string
+	Unit string
+	Desc MLMap
+}
+
+// TagDefinitions returns the definitions of every tag of the machine integration: those of the
+// modbus entries, with the modbus devices expanded, the OPC UA entries, the serial fields, the
+// elements of EtherNet/IP arrays, the S7 entries, the CAN signals selected and the MTConnect
+// data items. Should the modbus devices be invalid the error is returned along with the
+// definitions, those of the modbus entries being unexpanded.
+func (machineIntegration MachineIntegration) TagDefinitions() ([]TagDefinition, error) {
+	entries, err := ExpandModbusDevices(machineIntegration.ModbusEntries, machineIntegration.ModbusDevices)
+	if err != nil {
+		entries = machineIntegration.ModbusEntries
+	}
+	var tags []TagDefinition
+	for _, v := range entries {
+		tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: v.RegisterName, Unit: v.Unit, Desc: v.Desc})
+	}
+	for _, v := range machineIntegration.OPCUAEntries {
+		tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: v.TagName, Unit: v.Unit, Desc: v.Desc})
+	}
+	for _, device := range machineIntegration.Serial {
+		for _, v := range device.Fields {
+			tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: v.TagName, Unit: v.Unit, Desc: v.Desc})
+		}
+	}
+	for _, v := range machineIntegration.EtherNetIPEntries {
+		for _, name := range v.ElementNames() {
+			tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: name, Unit: v.Unit, Desc: v.Desc})
+		}
+	}
+	for _, v := range machineIntegration.S7Entries {
+		tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: v.TagName, Unit: v.Unit, Desc: v.Desc})
+	}
+	if machineIntegration.CAN != nil {
+		for _, v := range machineIntegration.CAN.Signals {
+			name := v.TagName
+			if name == "" {
+				name = v.Signal
+			}
+			tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: name, Desc: v.Desc})
+		}
+	}
+	if machineIntegration.MTConnect != nil {
+		for _, v := range machineIntegration.MTConnect.DataItems {
+			tags = append(tags, TagDefinition{Deadband: v.Deadband, Name: v.ReportedName(), Unit: v.Unit, Desc: v.Desc})
+		}
+	}
+	return tags, err
+}
@@ -39,6 +39,15 @@ func TestFindModbusReadDefinitions(t *testing.T) {
 
 }
 
+func TestModbusEntryRegisterCount(t *testing.T) {
+	assert.Equal(t, 1, ModbusEntry{}.RegisterCount(), "expected int16 default to occupy 1 register")
+	assert.Equal(t, 1, ModbusEntry{DataType: DataTypeUint16}.RegisterCount())
+	assert.Equal(t, 2, ModbusEntry{DataType: DataTypeFloat32}.RegisterCount())
+	assert.Equal(t, 2, ModbusEntry{DataType: DataTypeInt32}.RegisterCount())
+	assert.Equal(t, 4, ModbusEntry{DataType: DataTypeFloat64}.RegisterCount())
+	assert.Equal(t, 10, ModbusEntry{DataType: DataTypeString, Count: 10}.RegisterCount())
+}
+
 const equipmentFixture1 = `{
   "ref": "http://machineconfig.com/nimbleindustry.com/test-equipment-a-1.json",
   "entity": "nimbleindustry.com",
@@ -132,3 +141,70 @@ const equipmentFixture1 = `{
     }
   ]
 }`
+
+const modbusDevicesFixture = `{
+  "modbusDevices": [
+    {"name": "drive1", "unitId": 2, "tagGroup": "drive"},
+    {"name": "drive2", "unitId": 3, "tagGroup": "drive"}
+  ],
+  "modbus": [
+    {"registerName": "Speed", "functions": [3, 6], "address": 0, "tagGroup": "drive", "deadband": 5},
+    {"registerName": "Current", "functions": [4], "address": 1, "tagGroup": "drive", "multiplier": 0.1, "unit": "A"},
+    {"registerName": "LiquidTemp", "functions": [4], "address": 0}
+  ],
+  "etherNetIP": [
+    {"tagName": "Zone", "address": "Temperatures[1]", "elements": 2, "unit": "°C", "deadbandPercent": 1}
+  ],
+  "can": {"dbcFile": "line.dbc", "signals": [{"signal": "EngineSpeed", "deadband": 10}]},
+  "mtconnect": {"dataItems": [{"key": "Srpm", "category": "SAMPLE", "type": "SPINDLE_SPEED"}]}
+}`
+
+func TestExpandModbusDevices(t *testing.T) {
+	var integration MachineIntegration
+	assert.Nil(t, json.Unmarshal([]byte(modbusDevicesFixture), &integration), "unmarshall failed")
+	entries, err := ExpandModbusDevices(integration.ModbusEntries, integration.ModbusDevices)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, v := range entries {
+		names = append(names, v.RegisterName)
+	}
+	assert.Equal(t, []string{"LiquidTemp", "drive1.Speed", "drive1.Current", "drive2.Speed", "drive2.Current"}, names)
+	assert.Equal(t, 0, entries[0].UnitID)
+	assert.Equal(t, 2, entries[1].UnitID)
+	assert.Equal(t, 3, entries[4].UnitID)
+	assert.Equal(t, "A", entries[4].Unit, "expected template settings to be copied")
+	assert.Empty(t, entries[4].TagGroup)
+
+	again, err := ExpandModbusDevices(entries, integration.ModbusDevices[:0])
+	assert.Nil(t, err)
+	assert.Equal(t, entries, again, "expected expansion to be idempotent")
+
+	_, err = ExpandModbusDevices(integration.ModbusEntries, []ModbusDevice{{Name: "pump", UnitID: 4, TagGroup: "pump"}})
+	assert.NotNil(t, err, "expected undefined tag group to be rejected")
+	_, err = ExpandModbusDevices(integration.ModbusEntries, []ModbusDevice{{Name: "drive1", UnitID: 248, TagGroup: "drive"}})
+	assert.NotNil(t, err, "expected invalid unit ID to be rejected")
+	_, err = ExpandModbusDevices(integration.ModbusEntries, append(integration.ModbusDevices, integration.ModbusDevices[0]))
+	assert.NotNil(t, err, "expected duplicate device to be rejected")
+}
+
+func TestTagDefinitions(t *testing.T) {
+	var integration MachineIntegration
+	assert.Nil(t, json.Unmarshal([]byte(modbusDevicesFixture), &integration), "unmarshall failed")
+	tags, err := integration.TagDefinitions()
+	assert.Nil(t, err)
+	names := []string{}
+	for _, v := range tags {
+		names = append(names, v.Name)
+	}
+	assert.Equal(t, []string{"LiquidTemp", "drive1.Speed", "drive1.Current", "drive2.Speed", "drive2.Current",
+		"Zone[0]", "Zone[1]", "EngineSpeed", "Srpm"}, names)
+	assert.Equal(t, 5.0, tags[3].Absolute, "expected device tags to carry their template's deadband")
+	assert.Equal(t, "A", tags[4].Unit)
+	assert.Equal(t, 1.0, tags[6].Percent)
+	assert.Equal(t, 10.0, tags[7].Absolute)
+
+	integration.ModbusDevices = append(integration.ModbusDevices, integration.ModbusDevices[0])
+	tags, err = integration.TagDefinitions()
+	assert.NotNil(t, err, "expected invalid devices to be reported")
+	assert.Equal(t, "Speed", tags[0].Name, "expected the modbus entries to be left unexpanded")
+}
@@ -0,0 +1,55 @@
+package common
+
+import "time"
+
+// TagValue is a single tag's value, in engineering units where scaling is defined, along
+// with the unit of that value and its quality. Quality is one of the define.Quality* values;
+// for anything other than good, Error gives the reason. A bad value is nil, while a stale
+// value is the last value read before communication with the device failed. Source names the
+// fieldbus service that read the value, telling apart the tags of connections that share names.
+type TagValue struct {
+	Value   interface{} `json:"value"`
+	Unit    string      `json:"unit,omitempty"`
+	Quality string      `json:"quality"`
+	Error   string      `json:"error,omitempty"`
+	Source  string      `json:"source,omitempty"`
+}
+
+// OpsReport is the message sent by fieldbus services on the TopicOpsReport topic. It maps
+// tag (register) names to their values, every value of a report having the same source.
+type OpsReport map[string]TagValue
+
+// PollOverrun is sent by fieldbus services on the TopicPollOverrun topic when a poll group's
+// cycle does not complete within its interval
+type PollOverrun struct {
+	Timestamp time.Time     `json:"timeStamp"`
+	Service   string        `json:"service"`
+	Group     string        `json:"group"`
+	Interval  time.Duration `json:"interval"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Missed    int           `json:"missed"`
+}
+
+// WriteCommand is sent on the TopicWriteCommand topic to request that a value be written to a
+// control tag. Values are in engineering units where the tag defines scaling. Service, when
+// set, names the fieldbus service that executes the command; otherwise it is executed by the
+// fieldbus service writing the tag, and fails should there be none or several.
+type WriteCommand struct {
+	ID      string      `json:"id"`
+	Service string      `json:"service,omitempty"`
+	Tag     string      `json:"tag"`
+	Value   interface{} `json:"value"`
+}
+
+// WriteAck is sent by fieldbus services on the TopicWriteAck topic once a WriteCommand has
+// been executed, successfully or otherwise. Value is the tag's value read back in the same
+// transaction, for tags written with read/write multiple registers (function 23).
+type WriteAck struct {
+	Timestamp time.Time   `json:"timeStamp"`
+	ID        string      `json:"id"`
+	Service   string      `json:"service"`
+	Tag       string      `json:"tag"`
+	Success   bool        `json:"success"`
+	Error     string      `json:"error,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+}
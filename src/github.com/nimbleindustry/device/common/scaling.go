@@ -0,0 +1,100 @@
+package common
+
+import "sort"
+
+// ScalePoint maps a single raw value to its engineering value
+type ScalePoint struct {
+	Raw   float64 `json:"raw"`
+	Value float64 `json:"value"`
+}
+
+// Scaling converts raw fieldbus values to engineering units. It is intended to be embedded
+// in tag definitions (such as ModbusEntry) so that its settings appear alongside the tag's,
+// converting the tag's numeric values.
+//
+// When a lookup table is defined, values are interpolated linearly between its points (and
+// held at the first/last point outside of them); otherwise value = raw * multiplier + offset.
+// A multiplier of zero is treated as one. The result is then clamped to min and/or max.
+type Scaling struct {
+	Multiplier float64      `json:"multiplier,omitempty"`
+	Offset     float64      `json:"offset,omitempty"`
+	Table      []ScalePoint `json:"table,omitempty"`
+	Min        *float64     `json:"min,omitempty"`
+	Max        *float64     `json:"max,omitempty"`
+	Unit       string       `json:"unit,omitempty"`
+}
+
+// IsScaled returns true if any conversion of the raw value is defined
+func (s Scaling) IsScaled() bool {
+	return (s.Multiplier != 0 && s.Multiplier != 1) || s.Offset != 0 || len(s.Table) > 0 || s.Min != nil || s.Max != nil
+}
+
+// Apply converts the raw value to engineering units
+func (s Scaling) Apply(raw float64) float64 {
+	value, _ := s.Convert(raw)
+	return value
+}
+
+// Convert converts the raw value to engineering units as Apply does, also reporting whether
+// the value was clamped to min or max
+func (s Scaling) Convert(raw float64) (value float64, clamped bool) {
+	if len(s.Table) > 0 {
+		value = s.lookup(raw)
+	} else {
+		multiplier := s.Multiplier
+		if multiplier == 0 {
+			multiplier = 1
+		}
+		value = raw*multiplier + s.Offset
+	}
+	if s.Min != nil && value < *s.Min {
+		value, clamped = *s.Min, true
+	}
+	if s.Max != nil && value > *s.Max {
+		value, clamped = *s.Max, true
+	}
+	return
+}
+
+type scalePointsByRaw []ScalePoint
+
+func (p scalePointsByRaw) Len() int           { return len(p) }
+func (p scalePointsByRaw) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p scalePointsByRaw) Less(i, j int) bool { return p[i].Raw < p[j].Raw }
+
+func (s Scaling) lookup(raw float64) float64 {
+	points := s.Table
+	if !sort.IsSorted(scalePointsByRaw(points)) {
+		points = make([]ScalePoint, len(s.Table))
+		copy(points, s.Table)
+		sort.Sort(scalePointsByRaw(points))
+	}
+	if raw <= points[0].Raw {
+		return points[0].Value
+	}
+	for i := 1; i < len(points); i++ {
+		if raw <= points[i].Raw {
+			low, high := points[i-1], points[i]
+			return low.Value + (raw-low.Raw)*(high.Value-low.Value)/(high.Raw-low.Raw)
+		}
+	}
+	return points[len(points)-1].Value
+}
+
+// Raw converts a value in engineering units back to its raw value, the inverse of Apply.
+// Lookup tables are assumed to be monotonic; values outside of the table are held at the
+// first/last point. Min and max are not applied.
+func (s Scaling) Raw(value float64) float64 {
+	if len(s.Table) > 0 {
+		inverted := make([]ScalePoint, len(s.Table))
+		for i, v := range s.Table {
+			inverted[i] = ScalePoint{Raw: v.Value, Value: v.Raw}
+		}
+		return Scaling{Table: inverted}.lookup(value)
+	}
+	multiplier := s.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return (value - s.Offset) / multiplier
+}
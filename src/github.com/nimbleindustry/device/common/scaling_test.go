@@ -0,0 +1,74 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinearScaling(t *testing.T) {
+	assert.False(t, Scaling{}.IsScaled(), "expected no scaling by default")
+	assert.False(t, Scaling{Multiplier: 1, Unit: "rpm"}.IsScaled(), "expected a unit alone not to scale")
+	assert.Equal(t, 42.0, Scaling{}.Apply(42))
+
+	tenths := Scaling{Multiplier: 0.1, Offset: -40, Unit: "°C"}
+	assert.True(t, tenths.IsScaled())
+	assert.InDelta(t, 21.5, tenths.Apply(615), 1e-9)
+	assert.InDelta(t, -41, tenths.Apply(-10), 1e-9)
+
+	offsetOnly := Scaling{Offset: 273.15}
+	assert.InDelta(t, 293.15, offsetOnly.Apply(20), 1e-9)
+}
+
+func TestClampedScaling(t *testing.T) {
+	min, max := 0.0, 100.0
+	percent := Scaling{Multiplier: 100.0 / 4095, Min: &min, Max: &max, Unit: "%"}
+	assert.InDelta(t, 50, percent.Apply(2047.5), 1e-9)
+	assert.Equal(t, 100.0, percent.Apply(5000))
+	assert.Equal(t, 0.0, percent.Apply(-3))
+
+	_, clamped := percent.Convert(2047.5)
+	assert.False(t, clamped)
+	value, clamped := percent.Convert(5000)
+	assert.Equal(t, 100.0, value)
+	assert.True(t, clamped, "expected value beyond max to be reported as clamped")
+}
+
+func TestTableScaling(t *testing.T) {
+	// 4-20mA loop (in raw counts) onto a non-linear tank level
+	tank := Scaling{Table: []ScalePoint{{Raw: 4000, Value: 0}, {Raw: 20000, Value: 1000}, {Raw: 12000, Value: 300}}}
+	assert.True(t, tank.IsScaled())
+	assert.Equal(t, 0.0, tank.Apply(3000), "expected values below the table to hold at the first point")
+	assert.Equal(t, 300.0, tank.Apply(12000))
+	assert.InDelta(t, 150, tank.Apply(8000), 1e-9)
+	assert.InDelta(t, 650, tank.Apply(16000), 1e-9)
+	assert.Equal(t, 1000.0, tank.Apply(25000), "expected values above the table to hold at the last point")
+
+	// discrete lookup of state codes
+	states := Scaling{Table: []ScalePoint{{0, 0}, {1, 10}, {2, 20}}}
+	assert.Equal(t, 10.0, states.Apply(1))
+}
+
+func TestInverseScaling(t *testing.T) {
+	tenths := Scaling{Multiplier: 0.1, Offset: -40}
+	assert.InDelta(t, 615, tenths.Raw(21.5), 1e-9)
+	assert.InDelta(t, 42, Scaling{}.Raw(42), 1e-9)
+
+	tank := Scaling{Table: []ScalePoint{{Raw: 4000, Value: 0}, {Raw: 12000, Value: 300}, {Raw: 20000, Value: 1000}}}
+	assert.InDelta(t, 8000, tank.Raw(150), 1e-9)
+	assert.InDelta(t, 16000, tank.Raw(650), 1e-9)
+	assert.Equal(t, 20000.0, tank.Raw(2000), "expected values above the table to hold at the last point")
+}
+
+func TestScalingEmbeddedInModbusEntry(t *testing.T) {
+	var entry ModbusEntry
+	err := json.Unmarshal([]byte(`{"registerName": "LiquidTemp", "functions": [4], "address": 0,
+		"multiplier": 0.1, "offset": -40, "max": 150, "unit": "°C"}`), &entry)
+	assert.Nil(t, err, "unmarshall failed")
+	assert.Equal(t, "°C", entry.Unit)
+	assert.Equal(t, 0.1, entry.Multiplier)
+	assert.NotNil(t, entry.Max)
+	assert.Nil(t, entry.Min)
+	assert.Equal(t, 150.0, entry.Apply(3000))
+}
@@ -14,6 +14,9 @@ type SystemState struct {
 	MemoryConsumed float64   `json:"memoryConsumed"`
 	DiskConsumed   float64   `json:"diskConsumed"`
 	LoadAverage    float64   `json:"loadAverage"`
+
+	// the latest diagnostics of each fieldbus service, attached by the state service
+	Fieldbus []*FieldbusDiagnostics `json:"fieldbus,omitempty"`
 }
 
 func systemDiskConsumed() float64 {
@@ -39,10 +42,10 @@ func systemLoadAverage() float64 {
 // GetSystemState returns consumed system resources in time
 func GetSystemState() (state *SystemState) {
 	state = &SystemState{
-		time.Now().UTC(),
-		systemMemoryConsumed(),
-		systemDiskConsumed(),
-		systemLoadAverage(),
+		Timestamp:      time.Now().UTC(),
+		MemoryConsumed: systemMemoryConsumed(),
+		DiskConsumed:   systemDiskConsumed(),
+		LoadAverage:    systemLoadAverage(),
 	}
 	return
 }
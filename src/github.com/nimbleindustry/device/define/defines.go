@@ -7,28 +7,49 @@ const (
 
 // Protocol/Fieldbus Definitions
 const (
-	Modbus    = "modbus"
-	ModbusTCP = "modbusTCP"
-	ModbusRTU = "modbusRTU"
-	OPCUA     = "OPCUA"
+	Modbus     = "modbus"
+	ModbusTCP  = "modbusTCP"
+	ModbusRTU  = "modbusRTU"
+	OPCUA      = "OPCUA"
+	CAN        = "CAN"
+	EtherNetIP = "etherNetIP"
+	S7         = "S7"
+	MTConnect  = "MTConnect"
+)
+
+// Modbus TCP connection protocols, selected by a connection record's protocol field
+const (
+	ModbusProtocolTCP        = "tcp"        // MBAP framing over tcp, the default
+	ModbusProtocolRTUOverTCP = "rtuOverTcp" // rtu framing over tcp, as tunneled by serial device servers
+	ModbusProtocolUDP        = "udp"        // MBAP framing over udp
 )
 
 // Supervisor and Service identifiers
 const (
-	MasterSupervisorName    = "MasterSupervisor"
-	ConfigServiceName       = "ConfigService"
-	IntegrationsServiceName = "IntegrationsService"
-	StateServiceName        = "StateService"
-	FieldbusSupervisorName  = "FieldbusSupervisor"
-	ModbusRTUServiceName    = "ModbusRTUService"
-	ModbusTCPServiceName    = "ModbusTCPService"
-	OPCUAServiceName        = "OPCUAService"
-	SerialServiceName       = "SerialService"
-	GatewaySupervisorName   = "GatewaySupervisor"
-	MQTTServiceName         = "MQTTService"
-	RESTGatewayServiceName  = "RESTGatewayService"
-	PredictionServiceName   = "PredictionService"
-	RESTServiceName         = "RESTService"
+	MasterSupervisorName       = "MasterSupervisor"
+	ConfigServiceName          = "ConfigService"
+	IntegrationsServiceName    = "IntegrationsService"
+	StateServiceName           = "StateService"
+	ChangeDetectionServiceName = "ChangeDetectionService"
+	FieldbusSupervisorName     = "FieldbusSupervisor"
+	FieldbusManagerServiceName = "FieldbusManagerService"
+	ModbusRTUServiceName       = "ModbusRTUService"
+	ModbusTCPServiceName       = "ModbusTCPService"
+	ModbusServerServiceName    = "ModbusServerService"
+	ModbusBridgeServiceName    = "ModbusBridgeService"
+	OPCUAServiceName           = "OPCUAService"
+	OPCUAServerServiceName     = "OPCUAServerService"
+	CANServiceName             = "CANService"
+	SerialServiceName          = "SerialService"
+	EtherNetIPServiceName      = "EtherNetIPService"
+	S7ServiceName              = "S7Service"
+	MTConnectServiceName       = "MTConnectService"
+	MTConnectAgentServiceName  = "MTConnectAgentService"
+	GatewaySupervisorName      = "GatewaySupervisor"
+	MQTTServiceName            = "MQTTService"
+	RESTGatewayServiceName     = "RESTGatewayService"
+	PredictionServiceName      = "PredictionService"
+	RESTServiceName            = "RESTService"
 )
 
 // Internal messaging topics
@@ -42,7 +63,35 @@ const (
 	TopicStateReport = "TopicStateReport"
 
 	// Messages from field bus integrations
-	TopicOpsReport = "TopicOpsReport"
+	TopicOpsReport   = "TopicOpsReport"
+	TopicPollOverrun = "TopicPollOverrun"
+	TopicWriteAck    = "TopicWriteAck"
+
+	// Ops reports reduced to significant changes by the change detection service
+	TopicOpsChanges = "TopicOpsChanges"
+
+	// Connection state changes and periodic diagnostics counters from field bus integrations
+	TopicConnectionState = "TopicConnectionState"
+	TopicDiagnostics     = "TopicDiagnostics"
+
+	// Messages to field bus integrations
+	TopicWriteCommand = "TopicWriteCommand"
+)
+
+// Connection states
+const (
+	ConnectionConnected    = "connected"
+	ConnectionDisconnected = "disconnected"
+	ConnectionIdle         = "idle"
+	ConnectionFailed       = "failed"
+)
+
+// Tag value qualities
+const (
+	QualityGood      = "good"      // read successfully
+	QualityUncertain = "uncertain" // read successfully, but the value is questionable (e.g. out of range)
+	QualityBad       = "bad"       // could not be read or decoded
+	QualityStale     = "stale"     // last good value, the device could not be reached
 )
 
 // Service Providers
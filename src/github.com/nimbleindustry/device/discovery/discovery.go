@@ -0,0 +1,234 @@
+// Package discovery identifies an unknown modbus slave and probes its address space, drafting
+// the equipment config of a new machine for an engineer to name and classify. It backs the
+// `device discover` mode.
+package discovery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/services/fieldbus"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	defaultBlockSize = 32
+	// maxFailures is the number of consecutive requests going unanswered after which probing
+	// is abandoned
+	maxFailures = 3
+)
+
+// ReadFunctions are the function codes probed by default, one for each modbus table
+var ReadFunctions = []int{modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs,
+	modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters}
+
+// Range is a run of consecutive addresses of one table that were answered alike: with their
+// values, with the same exception code, or not at all
+type Range struct {
+	Function  int      `json:"function"`
+	Start     int      `json:"start"`
+	End       int      `json:"end"` // inclusive
+	Exception byte     `json:"exception,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Values    []uint16 `json:"values,omitempty"` // bits are 0 or 1
+}
+
+// Responded returns true if the addresses of the range were read successfully
+func (r Range) Responded() bool {
+	return r.Exception == 0 && r.Error == ""
+}
+
+func (r Range) String() string {
+	outcome := "respond"
+	if r.Exception != 0 {
+		outcome = fmt.Sprintf("return exception %d", r.Exception)
+	} else if r.Error != "" {
+		outcome = fmt.Sprintf("fail, %s", r.Error)
+	}
+	return fmt.Sprintf("function %d addresses %d-%d %s", r.Function, r.Start, r.End, outcome)
+}
+
+// Prober identifies and probes the modbus slave addressed by its packager
+type Prober struct {
+	BlockSize int // addresses read per request, 32 if unset
+
+	packager    modbus.Packager
+	transporter modbus.Transporter
+	client      modbus.Client
+}
+
+// NewProber returns a prober using the passed packager and transporter, typically both a
+// modbus.TCPClientHandler or modbus.RTUClientHandler
+func NewProber(packager modbus.Packager, transporter modbus.Transporter) *Prober {
+	return &Prober{packager: packager, transporter: transporter, client: modbus.NewClient2(packager, transporter)}
+}
+
+// Identify reads the slave's device identification (43/14)
+func (p *Prober) Identify() (fieldbus.DeviceIdentification, error) {
+	return fieldbus.ReadDeviceIdentification(p.packager, p.transporter)
+}
+
+// Probe reads the addresses from start to end (inclusive) of the table of the passed read
+// function, block by block, reading the addresses of a rejected block one at a time. A slave
+// rejecting the function altogether yields a single range. An error is returned only if the
+// slave stops answering.
+func (p *Prober) Probe(function int, start int, end int) ([]Range, error) {
+	size := p.BlockSize
+	if size <= 0 {
+		size = defaultBlockSize
+	}
+	var ranges []Range
+	failures := 0
+	// record adds the outcome of a read to the ranges
+	record := func(address int, quantity int, values []uint16, err error) error {
+		switch e := err.(type) {
+		case nil:
+			failures = 0
+			for i, v := range values {
+				ranges = appendAddress(ranges, Range{Function: function, Start: address + i, End: address + i, Values: []uint16{v}})
+			}
+		case *modbus.ModbusError:
+			failures = 0
+			ranges = appendAddress(ranges, Range{Function: function, Start: address, End: address + quantity - 1, Exception: e.ExceptionCode})
+		default:
+			if failures++; failures >= maxFailures {
+				return fmt.Errorf("slave stops answering function %d at address %d, %s", function, address, err)
+			}
+			ranges = appendAddress(ranges, Range{Function: function, Start: address, End: address + quantity - 1, Error: err.Error()})
+		}
+		return nil
+	}
+	for address := start; address <= end; address += size {
+		quantity := size
+		if address+quantity > end+1 {
+			quantity = end + 1 - address
+		}
+		values, err := p.read(function, address, quantity)
+		e, exception := err.(*modbus.ModbusError)
+		if exception && e.ExceptionCode == modbus.ExceptionCodeIllegalFunction {
+			return []Range{{Function: function, Start: start, End: end, Exception: e.ExceptionCode}}, nil
+		}
+		if !exception || quantity == 1 {
+			if err = record(address, quantity, values, err); err != nil {
+				return ranges, err
+			}
+			continue
+		}
+		// some address of the block was rejected, find out which
+		for a := address; a < address+quantity; a++ {
+			values, err = p.read(function, a, 1)
+			if err = record(a, 1, values, err); err != nil {
+				return ranges, err
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// appendAddress adds the outcome of a read to the ranges, extending the last range should
+// the outcome match
+func appendAddress(ranges []Range, r Range) []Range {
+	if n := len(ranges); n > 0 {
+		last := &ranges[n-1]
+		if last.End+1 == r.Start && last.Exception == r.Exception && last.Error == r.Error {
+			last.End = r.End
+			last.Values = append(last.Values, r.Values...)
+			return ranges
+		}
+	}
+	return append(ranges, r)
+}
+
+// read returns the values of quantity bits or registers of the table of the passed function
+func (p *Prober) read(function int, address int, quantity int) ([]uint16, error) {
+	values := make([]uint16, quantity)
+	switch function {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		var b []byte
+		var err error
+		if function == modbus.FuncCodeReadCoils {
+			b, err = p.client.ReadCoils(uint16(address), uint16(quantity))
+		} else {
+			b, err = p.client.ReadDiscreteInputs(uint16(address), uint16(quantity))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < (quantity+7)/8 {
+			return nil, fmt.Errorf("short response of %d bytes", len(b))
+		}
+		for i := range values {
+			values[i] = uint16(b[i/8]>>uint(i%8)) & 1
+		}
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+		var b []byte
+		var err error
+		if function == modbus.FuncCodeReadHoldingRegisters {
+			b, err = p.client.ReadHoldingRegisters(uint16(address), uint16(quantity))
+		} else {
+			b, err = p.client.ReadInputRegisters(uint16(address), uint16(quantity))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 2*quantity {
+			return nil, fmt.Errorf("short response of %d bytes", len(b))
+		}
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+	default:
+		return nil, fmt.Errorf("function %d is not a read function", function)
+	}
+	return values, nil
+}
+
+// entryPrefixes name the entries drafted for each table
+var entryPrefixes = map[int]string{
+	modbus.FuncCodeReadCoils:            "coil",
+	modbus.FuncCodeReadDiscreteInputs:   "discreteInput",
+	modbus.FuncCodeReadHoldingRegisters: "holdingRegister",
+	modbus.FuncCodeReadInputRegisters:   "inputRegister",
+}
+
+// Draft returns an equipment config describing the identified slave, with a ModbusEntry stub
+// for every address that responded. Each stub is named for its table and address, e.g.
+// holdingRegister40, and described with the value read when it was discovered.
+func Draft(id fieldbus.DeviceIdentification, ranges []Range) common.Equipment {
+	named := id.Named()
+	equipment := common.Equipment{Entity: named["vendorUrl"], Desc: common.MLMap{}}
+	if v := named["productCode"]; v != "" {
+		equipment.Models = []string{v}
+	}
+	if v := named["majorMinorRevision"]; v != "" {
+		equipment.Versions = []string{v}
+	}
+	desc := named["productName"]
+	if desc == "" {
+		desc = named["modelName"]
+	}
+	if v := named["vendorName"]; v != "" {
+		desc = strings.TrimSpace(v + " " + desc)
+	}
+	if desc != "" {
+		equipment.Desc["en"] = desc
+	}
+	for _, r := range ranges {
+		if !r.Responded() {
+			continue
+		}
+		for i, v := range r.Values {
+			address := r.Start + i
+			equipment.MachineIntegrations.ModbusEntries = append(equipment.MachineIntegrations.ModbusEntries, common.ModbusEntry{
+				RegisterName: fmt.Sprintf("%s%d", entryPrefixes[r.Function], address),
+				Address:      address,
+				Functions:    []int{r.Function},
+				Desc:         common.MLMap{"en": fmt.Sprintf("discovered with value %d", v)},
+			})
+		}
+	}
+	return equipment
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/services/fieldbus"
+	"github.com/nimbleindustry/device/simulator"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+const unknownEquipmentFixture = `{
+  "machineIntegration": {
+    "modbus": [
+      {"registerName": "Running", "functions": [1], "address": 1},
+      {"registerName": "Speed", "functions": [3], "address": 0},
+      {"registerName": "Setpoint", "functions": [3], "address": 10},
+      {"registerName": "Recipe", "functions": [3], "address": 40}
+    ]
+  }
+}`
+
+// noDiscreteInputs rejects the read discrete inputs function, as some slaves do
+type noDiscreteInputs struct {
+	*simulator.Simulator
+}
+
+func (h noDiscreteInputs) Handle(unitID byte, function byte, data []byte) (byte, []byte) {
+	if function == modbus.FuncCodeReadDiscreteInputs {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalFunction}
+	}
+	return h.Simulator.Handle(unitID, function, data)
+}
+
+func TestDiscover(t *testing.T) {
+	var equipment common.Equipment
+	assert.Nil(t, json.Unmarshal([]byte(unknownEquipmentFixture), &equipment), "unmarshall failed")
+	sim, err := simulator.New(equipment, simulator.Script{
+		Tags: map[string]simulator.Pattern{"Running": {Value: 1.0}, "Speed": {Value: 1450.0}, "Setpoint": {Value: 1500.0}},
+		Identification: map[string]string{"vendorName": "Nimble", "productCode": "ND-100", "majorMinorRevision": "1.2",
+			"productName": "Tank controller", "vendorUrl": "nimbleindustry.com"},
+		Exceptions: map[string]byte{"Recipe": modbus.ExceptionCodeServerDeviceFailure},
+	})
+	assert.Nil(t, err)
+	server, err := fieldbus.ListenModbusTCP("127.0.0.1:0", noDiscreteInputs{sim})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	handler := modbus.NewTCPClientHandler(server.Addr().String())
+	handler.SlaveId = 1
+	handler.Timeout = time.Second
+	defer handler.Close()
+	prober := NewProber(handler, handler)
+	prober.BlockSize = 8
+
+	id, err := prober.Identify()
+	assert.Nil(t, err)
+	assert.Equal(t, "Nimble", id.Named()["vendorName"])
+
+	ranges, err := prober.Probe(modbus.FuncCodeReadHoldingRegisters, 0, 49)
+	assert.Nil(t, err)
+	assert.Equal(t, []Range{
+		{Function: 3, Start: 0, End: 39, Values: append(append([]uint16{1450}, make([]uint16, 9)...),
+			append([]uint16{1500}, make([]uint16, 29)...)...)},
+		{Function: 3, Start: 40, End: 40, Exception: modbus.ExceptionCodeServerDeviceFailure},
+		{Function: 3, Start: 41, End: 49, Exception: modbus.ExceptionCodeIllegalDataAddress},
+	}, ranges)
+
+	coils, err := prober.Probe(modbus.FuncCodeReadCoils, 0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []Range{
+		{Function: 1, Start: 0, End: 1, Values: []uint16{0, 1}},
+		{Function: 1, Start: 2, End: 3, Exception: modbus.ExceptionCodeIllegalDataAddress},
+	}, coils)
+	inputs, err := prober.Probe(modbus.FuncCodeReadDiscreteInputs, 0, 99)
+	assert.Nil(t, err)
+	assert.Equal(t, []Range{{Function: 2, Start: 0, End: 99, Exception: modbus.ExceptionCodeIllegalFunction}}, inputs)
+
+	draft := Draft(id, append(coils, ranges...))
+	assert.Equal(t, "nimbleindustry.com", draft.Entity)
+	assert.Equal(t, []string{"ND-100"}, draft.Models)
+	assert.Equal(t, []string{"1.2"}, draft.Versions)
+	assert.Equal(t, "Nimble Tank controller", draft.Desc["en"])
+	entries := draft.MachineIntegrations.ModbusEntries
+	assert.Equal(t, 42, len(entries))
+	assert.Equal(t, common.ModbusEntry{RegisterName: "coil1", Address: 1, Functions: []int{1},
+		Desc: common.MLMap{"en": "discovered with value 1"}}, entries[1])
+	assert.Equal(t, "holdingRegister10", entries[12].RegisterName)
+	assert.Equal(t, "discovered with value 1500", entries[12].Desc["en"])
+
+	// a slave that goes quiet ends the probe
+	server.Close()
+	_, err = prober.Probe(modbus.FuncCodeReadHoldingRegisters, 0, 49)
+	assert.NotNil(t, err)
+}
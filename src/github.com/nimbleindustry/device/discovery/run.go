@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// Run implements the `device discover` mode: it identifies and probes a modbus slave, logging
+// what it finds, and writes a draft equipment config. The passed arguments follow the
+// discover keyword, e.g.
+//
+//	device discover -tcp 10.0.1.230:502 -end 199 -out conf/draft.json
+//	device discover -serial /dev/ttyUSB0 -baud 9600 -unit 3 -functions 3,4
+func Run(args []string, logFunc func(string)) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	tcpAddress := flags.String("tcp", "", "Address (host:port) of a modbus tcp slave")
+	serialPort := flags.String("serial", "", "Serial port of a modbus rtu slave")
+	baudRate := flags.Int("baud", 19200, "Serial port baud rate")
+	parity := flags.String("parity", "E", "Serial port parity: N, E or O")
+	unitID := flags.Int("unit", 1, "Unit ID of the slave")
+	functions := flags.String("functions", "1,2,3,4", "Read function codes to probe")
+	start := flags.Int("start", 0, "First address probed")
+	end := flags.Int("end", 999, "Last address probed")
+	blockSize := flags.Int("block", defaultBlockSize, "Addresses read per request")
+	timeout := flags.Duration("timeout", time.Second, "Response timeout")
+	out := flags.String("out", "", "File to which the draft equipment config is written, stdout if unset")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*tcpAddress == "") == (*serialPort == "") {
+		return errors.New("discover requires either -tcp or -serial")
+	}
+	if *start < 0 || *end > 0xFFFF || *end < *start {
+		return fmt.Errorf("invalid address range %d-%d", *start, *end)
+	}
+	codes, err := parseFunctions(*functions)
+	if err != nil {
+		return err
+	}
+
+	var handler modbus.ClientHandler
+	if *tcpAddress != "" {
+		h := modbus.NewTCPClientHandler(*tcpAddress)
+		h.SlaveId = byte(*unitID)
+		h.Timeout = *timeout
+		if err := h.Connect(); err != nil {
+			return err
+		}
+		defer h.Close()
+		handler = h
+	} else {
+		h := modbus.NewRTUClientHandler(*serialPort)
+		h.BaudRate = *baudRate
+		h.DataBits = 8
+		h.Parity = *parity
+		h.StopBits = 1
+		h.SlaveId = byte(*unitID)
+		h.Timeout = *timeout
+		if err := h.Connect(); err != nil {
+			return err
+		}
+		defer h.Close()
+		handler = h
+	}
+
+	prober := NewProber(handler, handler)
+	prober.BlockSize = *blockSize
+	id, err := prober.Identify()
+	if err != nil {
+		logFunc(fmt.Sprintf("discover warns: device identification unavailable, %s", err))
+	}
+	named := id.Named()
+	var names []string
+	for k := range named {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		logFunc(fmt.Sprintf("discover identifies %s: %s", v, named[v]))
+	}
+	var ranges []Range
+	for _, function := range codes {
+		found, err := prober.Probe(function, *start, *end)
+		for _, v := range found {
+			logFunc(fmt.Sprintf("discover finds %s", v))
+		}
+		ranges = append(ranges, found...)
+		if err != nil {
+			logFunc(fmt.Sprintf("discover warns: %s", err))
+		}
+	}
+
+	draft, err := json.MarshalIndent(Draft(id, ranges), "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = fmt.Fprintln(os.Stdout, string(draft))
+		return err
+	}
+	return ioutil.WriteFile(*out, append(draft, '\n'), 0644)
+}
+
+// parseFunctions parses a comma separated list of read function codes
+func parseFunctions(s string) ([]int, error) {
+	var codes []int
+	for _, v := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || code < modbus.FuncCodeReadCoils || code > modbus.FuncCodeReadInputRegisters {
+			return nil, fmt.Errorf("%q is not a read function code", v)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
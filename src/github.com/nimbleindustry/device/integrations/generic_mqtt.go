@@ -3,6 +3,7 @@ package integrations
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -38,6 +39,21 @@ func (i *GenericMQTT) Connect() (err error) {
 	i.client = MQTT.NewClient(opts)
 	if token := i.client.Connect(); token.Wait() && token.Error() != nil {
 		err = token.Error()
+		return
+	}
+	topic, err := deviceTopic("command")
+	if err != nil {
+		// data is still sent, but commands cannot be told from those of other devices
+		fmt.Println("Warning, not accepting commands from", i.record.Endpoint, err)
+		return nil
+	}
+	token := i.client.Subscribe(topic, 1, func(client MQTT.Client, msg MQTT.Message) {
+		if err := i.ReceiveData(msg.Payload()); err != nil {
+			fmt.Println("Warning, unable to accept command received from", i.record.Endpoint, err)
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		err = token.Error()
 	}
 	return
 }
@@ -54,8 +70,9 @@ type mqttDataMessage struct {
 	Body      interface{}   `json:"body"`
 }
 
-// SendData transmits telemetry and operations data to the MQTT broker
-func (i *GenericMQTT) SendData(data map[string]interface{}) error {
+// SendData transmits telemetry and operations data to the MQTT broker. Each tag in the
+// body carries its value and, where defined, its engineering unit.
+func (i *GenericMQTT) SendData(data common.OpsReport) error {
 	msg := &mqttDataMessage{}
 	msg.Timestamp = time.Now()
 	msg.Tags = &common.AssetConfig
@@ -94,7 +111,37 @@ func (i *GenericMQTT) SendState(data *common.SystemState) error {
 	return nil
 }
 
-// ReceiveData is not implemented
-func (i *GenericMQTT) ReceiveData(data interface{}) error {
+// SendAck transmits the acknowledgement of a write command to the MQTT broker
+func (i *GenericMQTT) SendAck(ack *common.WriteAck) error {
+	msg := &mqttDataMessage{}
+	msg.Timestamp = time.Now()
+	msg.Tags = &common.AssetConfig
+	msg.Body = ack
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	topic, err := deviceTopic("ack")
+	if err != nil {
+		return err
+	}
+	if token := i.client.Publish(topic, 1, false, bytes); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
 	return nil
 }
+
+// deviceTopic returns the named topic scoped to this device, e.g. /gw1/command, so that the
+// devices sharing a broker exchange commands and acknowledgements only with their own clients
+func deviceTopic(name string) (string, error) {
+	if common.ConnectionConfig.DeviceID == "" {
+		return "", fmt.Errorf("no deviceId to scope the %s topic", name)
+	}
+	return "/" + common.ConnectionConfig.DeviceID + "/" + name, nil
+}
+
+// ReceiveData accepts a JSON write command, as published on the /<deviceId>/command topic,
+// e.g. {"id": "42", "tag": "CommandPump", "value": true}, and passes it to the fieldbus services
+func (i *GenericMQTT) ReceiveData(data interface{}) error {
+	return receiveWriteCommand(data)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
 )
 
 const (
@@ -29,13 +30,18 @@ const (
 // Bucket keys:
 // -- for Device state: state|<entity>/<location>/<machineId>
 //    The value pairs in this bucket are fixed to memory and disk consumption along with
-//    system load status
+//    system load status, and the connection counters of each fieldbus service keyed as
+//    <service> requests, <service> timeouts, etc.
 // -- for Device telemetry and ops: ops|<entity>/<location>/<machineId>
 //    The value pairs in this bucket are dependent on the registerName entries for each
 //    field bus entry in the machineIntegration section of the equipment configuration object.
+//    As Initial State events have no unit attribute, the engineering unit of an entry, if any,
+//    is sent as <registerName> unit, and its quality as <registerName> quality, each only when
+//    it changes so as to spare the event quota. Bad and stale values are not sent.
 type InitialState struct {
-	client *http.Client
-	record common.ConnectionRecord
+	client     *http.Client
+	record     common.ConnectionRecord
+	attributes map[string]string // the unit and quality events last sent, by key
 }
 
 // SetRecord sets the passed connection record
@@ -75,7 +81,7 @@ func (i *InitialState) Close() error {
 }
 
 // SendData transmits telemetry and operations data to the Initial State service
-func (i *InitialState) SendData(data map[string]interface{}) error {
+func (i *InitialState) SendData(data common.OpsReport) error {
 	timestamp := time.Now()
 	body := i.transformOpsData(timestamp, data)
 	if false {
@@ -83,6 +89,10 @@ func (i *InitialState) SendData(data map[string]interface{}) error {
 		return nil
 	}
 	_, err := i.sendRequest("POST", events, i.getOpsAndTelemetryBucketName(), body)
+	if err != nil {
+		// the events may not have been received, send every attribute again
+		i.attributes = nil
+	}
 	return err
 }
 
@@ -97,7 +107,12 @@ func (i *InitialState) SendState(data *common.SystemState) error {
 	return err
 }
 
-// ReceiveData is not implemented
+// SendAck is not implemented, Initial State is used for visualization only
+func (i *InitialState) SendAck(ack *common.WriteAck) error {
+	return nil
+}
+
+// ReceiveData is not implemented, Initial State does not send commands
 func (i *InitialState) ReceiveData(data interface{}) error {
 	return nil
 }
@@ -153,19 +168,34 @@ func (i *InitialState) sendRequest(verb string, resource string, bucket string,
 
 func (i *InitialState) transformStateData(record *common.SystemState) interface{} {
 	timestamp := record.Timestamp.Format(iso8601)
-	state := []struct {
+	type stateValue struct {
 		Iso8601 string  `json:"iso8601"`
 		Key     string  `json:"key"`
 		Value   float64 `json:"value"`
-	}{
+	}
+	state := []stateValue{
 		{timestamp, "memoryConsumed", record.MemoryConsumed},
 		{timestamp, "diskConsumed", record.DiskConsumed},
 		{timestamp, "loadAverage", record.LoadAverage},
 	}
+	// fieldbus diagnostics are reduced to their connection counters
+	for _, v := range record.Fieldbus {
+		exceptions := 0
+		for _, count := range v.Exceptions {
+			exceptions += count
+		}
+		state = append(state,
+			stateValue{timestamp, v.Service + " requests", float64(v.Requests)},
+			stateValue{timestamp, v.Service + " timeouts", float64(v.Timeouts)},
+			stateValue{timestamp, v.Service + " crcErrors", float64(v.CRCErrors)},
+			stateValue{timestamp, v.Service + " errors", float64(v.Errors)},
+			stateValue{timestamp, v.Service + " exceptions", float64(exceptions)},
+			stateValue{timestamp, v.Service + " reconnects", float64(v.Reconnects)})
+	}
 	return state
 }
 
-func (i *InitialState) transformOpsData(timestamp time.Time, data map[string]interface{}) interface{} {
+func (i *InitialState) transformOpsData(timestamp time.Time, data common.OpsReport) interface{} {
 	ts := timestamp.Format(iso8601)
 	type telemetry struct {
 		Iso8601 string      `json:"iso8601"`
@@ -173,11 +203,27 @@ func (i *InitialState) transformOpsData(timestamp time.Time, data map[string]int
 		Value   interface{} `json:"value"`
 	}
 	var telemetryArray []telemetry
+	if i.attributes == nil {
+		i.attributes = make(map[string]string)
+	}
 	for k, v := range data {
+		attributes := []telemetry{{ts, k + " quality", v.Quality}}
+		if v.Unit != "" {
+			attributes = append(attributes, telemetry{ts, k + " unit", v.Unit})
+		}
+		for _, a := range attributes {
+			if value := a.Value.(string); i.attributes[a.Key] != value {
+				i.attributes[a.Key] = value
+				telemetryArray = append(telemetryArray, a)
+			}
+		}
+		if v.Quality == define.QualityBad || v.Quality == define.QualityStale {
+			continue
+		}
 		record := telemetry{}
 		record.Iso8601 = ts
 		record.Key = k
-		record.Value = v
+		record.Value = v.Value
 		telemetryArray = append(telemetryArray, record)
 	}
 	return telemetryArray
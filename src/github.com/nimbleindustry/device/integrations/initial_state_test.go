@@ -0,0 +1,65 @@
+package integrations
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initialStateEvents transforms the passed report and returns its events keyed by name
+func initialStateEvents(t *testing.T, i *InitialState, data common.OpsReport) map[string]interface{} {
+	body, err := json.Marshal(i.transformOpsData(time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC), data))
+	assert.Nil(t, err, "marshal failed")
+	var events []struct {
+		Iso8601 string      `json:"iso8601"`
+		Key     string      `json:"key"`
+		Value   interface{} `json:"value"`
+	}
+	assert.Nil(t, json.Unmarshal(body, &events), "unmarshal failed")
+	keys := make(map[string]interface{})
+	for _, event := range events {
+		assert.Equal(t, "2016-11-01T12:00:00Z", event.Iso8601)
+		keys[event.Key] = event.Value
+	}
+	return keys
+}
+
+func TestInitialStateOpsDataCarriesUnits(t *testing.T) {
+	i := &InitialState{}
+	report := common.OpsReport{
+		"LiquidTemp": {Value: 21.5, Unit: "°C", Quality: define.QualityGood},
+		"TankFull":   {Value: byte(1), Quality: define.QualityGood},
+	}
+	keys := initialStateEvents(t, i, report)
+	assert.Equal(t, 5, len(keys))
+	assert.Equal(t, 21.5, keys["LiquidTemp"])
+	assert.Equal(t, "°C", keys["LiquidTemp unit"])
+	assert.Equal(t, 1.0, keys["TankFull"])
+
+	keys = initialStateEvents(t, i, report)
+	assert.Equal(t, map[string]interface{}{"LiquidTemp": 21.5, "TankFull": 1.0}, keys,
+		"expected unchanged units and qualities not to be sent again")
+}
+
+func TestInitialStateOpsDataCarriesQuality(t *testing.T) {
+	i := &InitialState{}
+	initialStateEvents(t, i, common.OpsReport{
+		"LiquidTemp": {Value: 21.5, Unit: "°C", Quality: define.QualityGood},
+		"TankFull":   {Value: byte(1), Quality: define.QualityGood},
+	})
+	keys := initialStateEvents(t, i, common.OpsReport{
+		"LiquidTemp": {Value: 150.0, Unit: "°C", Quality: define.QualityUncertain, Error: "out of range"},
+		"Pressure":   {Unit: "bar", Quality: define.QualityBad, Error: "illegal data address"},
+		"TankFull":   {Value: byte(1), Quality: define.QualityStale, Error: "connection reset"},
+	})
+	assert.Equal(t, 5, len(keys), "expected bad and stale values, and unchanged units, to be withheld")
+	assert.Equal(t, 150.0, keys["LiquidTemp"])
+	assert.Equal(t, define.QualityUncertain, keys["LiquidTemp quality"])
+	assert.Equal(t, define.QualityBad, keys["Pressure quality"])
+	assert.Equal(t, define.QualityStale, keys["TankFull quality"])
+}
@@ -1,6 +1,8 @@
 package integrations
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/nimbleindustry/device/common"
@@ -14,7 +16,8 @@ type Integration interface {
 	Connect() error
 	Close() error
 	SendState(*common.SystemState) error
-	SendData(map[string]interface{}) error
+	SendData(common.OpsReport) error
+	SendAck(*common.WriteAck) error
 	ReceiveData(interface{}) error
 }
 
@@ -57,3 +60,25 @@ func GetDeviceOperationsAndTelemetryIntegrations() []Integration {
 	}
 	return integrations
 }
+
+// receiveWriteCommand decodes a JSON write command received from an integration and passes
+// it to the fieldbus services on the TopicWriteCommand topic. Execution of the command is
+// acknowledged on TopicWriteAck.
+func receiveWriteCommand(data interface{}) error {
+	payload, ok := data.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected command payload type %T", data)
+	}
+	cmd := &common.WriteCommand{}
+	if err := json.Unmarshal(payload, cmd); err != nil {
+		return err
+	}
+	if cmd.Tag == "" {
+		return errors.New("command does not name a tag")
+	}
+	if cmd.Value == nil {
+		return fmt.Errorf("command for %s has no value", cmd.Tag)
+	}
+	common.SendBusMessage(define.TopicWriteCommand, cmd)
+	return nil
+}
@@ -0,0 +1,43 @@
+package integrations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveWriteCommand(t *testing.T) {
+	received := make(chan interface{}, 1)
+	go func() { received <- common.WaitForBusMessage(define.TopicWriteCommand) }()
+	time.Sleep(20 * time.Millisecond)
+
+	i := &GenericMQTT{}
+	err := i.ReceiveData([]byte(`{"id": "42", "tag": "CommandPump", "value": true}`))
+	assert.Nil(t, err, "expected command to be accepted")
+	cmd := (<-received).(*common.WriteCommand)
+	assert.Equal(t, "42", cmd.ID)
+	assert.Equal(t, "CommandPump", cmd.Tag)
+	assert.Equal(t, true, cmd.Value)
+
+	assert.NotNil(t, i.ReceiveData([]byte(`{"id": "43", "value": true}`)), "expected command without tag to be rejected")
+	assert.NotNil(t, i.ReceiveData([]byte(`{"id": "44", "tag": "CommandPump"}`)), "expected command without value to be rejected")
+	assert.NotNil(t, i.ReceiveData([]byte(`not json`)))
+	assert.NotNil(t, i.ReceiveData("CommandPump"))
+}
+
+func TestDeviceTopic(t *testing.T) {
+	deviceID := common.ConnectionConfig.DeviceID
+	defer func() { common.ConnectionConfig.DeviceID = deviceID }()
+
+	common.ConnectionConfig.DeviceID = "gw1"
+	topic, err := deviceTopic("command")
+	assert.Nil(t, err)
+	assert.Equal(t, "/gw1/command", topic)
+	common.ConnectionConfig.DeviceID = ""
+	_, err = deviceTopic("ack")
+	assert.NotNil(t, err, "expected topics not to be shared by devices without an id")
+}
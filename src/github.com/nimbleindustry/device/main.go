@@ -27,8 +27,10 @@ import (
 	"time"
 
 	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/discovery"
 	"github.com/nimbleindustry/device/services"
 	"github.com/nimbleindustry/device/services/fieldbus"
+	"github.com/nimbleindustry/device/simulator"
 	"github.com/nimbleindustry/suture"
 )
 
@@ -50,6 +52,20 @@ func main() {
 			log.SetOutput(logWriter)
 		}
 	}
+	if flag.Arg(0) == "simulate" {
+		// simulate the equipment's modbus slaves in place of running the device
+		if err := simulator.Run(flag.Args()[1:], localLog); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "discover" {
+		// identify and probe a modbus slave, drafting its equipment config
+		if err := discovery.Run(flag.Args()[1:], localLog); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *profileFlag {
 		go func() {
 			// Run the Profiler on port 6789
@@ -97,13 +113,23 @@ func localLog(s string) {
 	- Config [1]                Manages asset, device and connectivity configuration
 	- State [1]                 Responsible for sending state of the (computing) device
 	- Integration [1]			Responsible for managing integrations to IIoT services
+	- ChangeDetection [1]       Reduces ops reports to significant changes (report-by-exception)
 	- FieldbusSupervisor        Supervisor for all fieldbus integration services
-		- ModbusTCP [0-1]       Service to manage I/O to Modbus TCP
-        - ModbusRTU [0-1]       Service to manage I/O to Modbus RTU (serial) (PLANNED)
-		- OPCUA [0-1]           Service to manage I/O to OPC/UA (PLANNED)
-        - Serial [0-*]          Service to broker I/O to serial controllers (PLANNED)
+		- FieldbusManager [1]   Spawns one fieldbus service per machineIntegration connection record
+		- ModbusTCP [0-*]       Service to manage I/O to Modbus TCP
+		- ModbusRTU [0-*]       Service to manage I/O to Modbus RTU (serial)
+		- ModbusServer [1]      Serves gathered tag values to local HMI/SCADA as a Modbus TCP slave
+		- ModbusBridge [1]      Forwards Modbus TCP requests to the slaves of RTU serial lines
+		- OPCUA [0-*]           Service to manage I/O to OPC/UA servers
+		- OPCUAServer [1]       Serves the asset hierarchy and gathered tag values to OPC/UA clients (MES)
+		- CAN [0-*]             Service to decode DBC signals from SocketCAN interfaces
+		- EtherNetIP [0-*]      Service to read/write Logix tags over EtherNet/IP
+		- S7 [0-*]              Service to read/write Siemens S7 PLCs over ISO-on-TCP
+		- MTConnect [0-*]       Service to read samples, events and conditions from MTConnect adapters (SHDR)
+		- MTConnectAgent [1]    Serves the asset and gathered tag values as MTConnect documents (analytics)
+		- Serial [1]            Reads records from scales, barcode readers and serial controllers
 	- Prediction [1]            Service for on-machine predictive analytics (PLANNED)
-    - REST [1]                  Service for REST access to device (PLANNED)
+	- REST [1]                  Service for REST access to device (PLANNED)
 */
 
 func startServices(supervisor *suture.Supervisor, logFunc func(string)) {
@@ -122,16 +148,53 @@ func startServices(supervisor *suture.Supervisor, logFunc func(string)) {
 	stateService.Name = define.StateServiceName
 	stateService.AddServiceDependentUpon(define.IntegrationsServiceName)
 
+	changeDetectionService := &services.ChangeDetectionService{LogFunc: logFunc,
+		StartDelay: time.Duration(100 * time.Millisecond)}
+	changeDetectionService.Name = define.ChangeDetectionServiceName
+	changeDetectionService.AddServiceDependentUpon(define.ConfigServiceName)
+
 	fieldBusSupervisor := suture.New(define.FieldbusSupervisorName, defaultServiceSpec)
 	supervisor.Add(fieldBusSupervisor)
 
-	modbusTCPService := &fieldbus.ModbusTCPService{LogFunc: logFunc,
+	fieldbusManagerService := &fieldbus.FieldbusManagerService{LogFunc: logFunc,
+		Supervisor: fieldBusSupervisor, Spec: defaultServiceSpec,
+		ServiceDelay: time.Duration(1000 * time.Millisecond)}
+	fieldbusManagerService.Name = define.FieldbusManagerServiceName
+	fieldbusManagerService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(fieldbusManagerService)
+
+	modbusServerService := &fieldbus.ModbusServerService{LogFunc: logFunc,
+		StartDelay: time.Duration(1000 * time.Millisecond)}
+	modbusServerService.Name = define.ModbusServerServiceName
+	modbusServerService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(modbusServerService)
+
+	modbusBridgeService := &fieldbus.ModbusBridgeService{LogFunc: logFunc,
+		StartDelay: time.Duration(1000 * time.Millisecond)}
+	modbusBridgeService.Name = define.ModbusBridgeServiceName
+	modbusBridgeService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(modbusBridgeService)
+
+	opcuaServerService := &fieldbus.OPCUAServerService{LogFunc: logFunc,
+		StartDelay: time.Duration(1000 * time.Millisecond)}
+	opcuaServerService.Name = define.OPCUAServerServiceName
+	opcuaServerService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(opcuaServerService)
+
+	mtconnectAgentService := &fieldbus.MTConnectAgentService{LogFunc: logFunc,
+		StartDelay: time.Duration(1000 * time.Millisecond)}
+	mtconnectAgentService.Name = define.MTConnectAgentServiceName
+	mtconnectAgentService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(mtconnectAgentService)
+
+	serialService := &fieldbus.SerialService{LogFunc: logFunc,
 		StartDelay: time.Duration(1000 * time.Millisecond)}
-	modbusTCPService.Name = define.ModbusTCPServiceName
-	modbusTCPService.AddServiceDependentUpon(define.ConfigServiceName)
-	fieldBusSupervisor.Add(modbusTCPService)
+	serialService.Name = define.SerialServiceName
+	serialService.AddServiceDependentUpon(define.ConfigServiceName)
+	fieldBusSupervisor.Add(serialService)
 
 	supervisor.Add(configService)
 	supervisor.Add(stateService)
 	supervisor.Add(integrationsService)
+	supervisor.Add(changeDetectionService)
 }
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/nimbleindustry/suture"
+)
+
+// defaultHeartbeat is the maximum time for which an unchanged tag goes unreported, unless the
+// equipment config specifies otherwise
+const defaultHeartbeat = 15 * time.Minute
+
+// changeDetectionReportQueue is the number of ops reports held while changes are being
+// detected, fieldbus services polling at the same instant
+const changeDetectionReportQueue = 64
+
+// ChangeDetectionService sits between the fieldbus services and the IntegrationsService,
+// reducing the ops reports of every poll to the tags whose value or quality changed
+// significantly (beyond their deadband) and sending these on TopicOpsChanges. Unchanged tags
+// are resent at the heartbeat interval so that integrations can tell a quiet tag from a lost
+// one, which is resent stale. Integrations opt into receiving these reports with reportByException.
+type ChangeDetectionService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	detector *common.ChangeDetector
+	stop     chan bool
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *ChangeDetectionService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	reports := common.BufferedBusChannel(define.TopicOpsReport, changeDetectionReportQueue)
+	equipment := common.BusChannel(define.EquipmentConfigUpdated)
+	svc.loadDeadbands()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			return
+		case <-equipment:
+			svc.LogFunc(fmt.Sprintf("%s advises that the equipment config file was updated, reloading deadbands", svc.Name))
+			svc.loadDeadbands()
+		case msg := <-reports:
+			if report, ok := msg.(common.OpsReport); ok {
+				svc.send(svc.detector.Filter(report, time.Now()))
+			}
+		case <-time.After(svc.untilHeartbeat(time.Now())):
+			for _, v := range svc.detector.Heartbeats(time.Now()) {
+				svc.send(v)
+			}
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *ChangeDetectionService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *ChangeDetectionService) State() int {
+	return svc.ServiceState
+}
+
+// loadDeadbands (re)creates the change detector from the equipment config, after which every
+// tag is reported once more
+func (svc *ChangeDetectionService) loadDeadbands() {
+	integration := common.EquipmentConfig.MachineIntegrations
+	var defaults common.Deadband
+	heartbeat := defaultHeartbeat
+	if rbe := integration.ReportByException; rbe != nil {
+		defaults = rbe.Deadband
+		if rbe.Heartbeat != "" {
+			if d, err := time.ParseDuration(rbe.Heartbeat); err != nil || d < 0 {
+				svc.LogFunc(fmt.Sprintf("%s warns: invalid heartbeat %q, using %s", svc.Name, rbe.Heartbeat, heartbeat))
+			} else {
+				heartbeat = d
+			}
+		}
+	}
+	tags, err := integration.TagDefinitions()
+	if err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, err))
+	}
+	deadbands := make(map[string]common.Deadband)
+	for _, v := range tags {
+		if v.IsSet() {
+			deadbands[v.Name] = v.Deadband
+		}
+	}
+	svc.detector = common.NewChangeDetector(defaults, deadbands, heartbeat)
+}
+
+// untilHeartbeat returns the time until the next heartbeat is due
+func (svc *ChangeDetectionService) untilHeartbeat(now time.Time) time.Duration {
+	next := svc.detector.NextHeartbeat()
+	if next.IsZero() {
+		return time.Minute
+	}
+	if next.Before(now) {
+		return 0
+	}
+	return next.Sub(now)
+}
+
+func (svc *ChangeDetectionService) send(changes common.OpsReport) {
+	if len(changes) > 0 {
+		common.SendBusMessage(define.TopicOpsChanges, changes)
+	}
+}
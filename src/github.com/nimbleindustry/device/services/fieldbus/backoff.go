@@ -0,0 +1,61 @@
+package fieldbus
+
+import "time"
+
+const (
+	fieldbusReconnectMinDelay = time.Second
+	fieldbusReconnectMaxDelay = time.Minute
+	fieldbusReconnectAttempts = 10
+)
+
+// reconnectBackoff tracks consecutive connection failures. The delay before the next attempt
+// doubles with each failure, from min up to max.
+type reconnectBackoff struct {
+	min      time.Duration
+	max      time.Duration
+	failures int
+	next     time.Time // the earliest time at which the next attempt may be made
+}
+
+// failed records a failed attempt at the passed time and returns the delay before the next
+func (b *reconnectBackoff) failed(now time.Time) time.Duration {
+	delay := b.min
+	for i := 0; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.failures++
+	b.next = now.Add(delay)
+	return delay
+}
+
+// succeeded resets the backoff following a successful attempt
+func (b *reconnectBackoff) succeeded() {
+	b.failures = 0
+	b.next = time.Time{}
+}
+
+// ready returns true if an attempt may be made at the passed time
+func (b *reconnectBackoff) ready(now time.Time) bool {
+	return !now.Before(b.next)
+}
+
+// exhausted returns true once the passed number of consecutive attempts have failed
+func (b *reconnectBackoff) exhausted(attempts int) bool {
+	return b.failures >= attempts
+}
+
+// resetTimer stops the timer, dropping an expiry not yet received, and resets it to fire after
+// the passed duration. Services waiting to reconnect hold one timer, reset as the connection
+// state changes, rather than creating one on every pass through their select loop.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,233 @@
+package fieldbus
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+	"github.com/nimbleindustry/suture"
+)
+
+// modbusBridgeUnitSelf is the unit ID modbus tcp clients use to address the device behind a
+// gateway without knowing its unit ID
+const modbusBridgeUnitSelf = 0xFF
+
+// ModbusBridgeService runs the modbus tcp to rtu bridges of the connections config, which
+// give tcp clients (e.g. commissioning tools on an engineering laptop) access to slaves on
+// the gateway's serial lines. Requests are forwarded as rtu frames over the serial line
+// shared with any ModbusRTUService polling it, one transaction at a time, and the responses
+// returned under the transaction ID of the request.
+type ModbusBridgeService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop    chan bool
+	configs []common.ModbusBridgeConfig
+	bridges []*modbusBridge
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *ModbusBridgeService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	svc.reload()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	configs := common.BusChannel(define.ConnectivityConfigUpdated)
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.closeBridges()
+			return
+		case <-configs:
+			svc.reload()
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *ModbusBridgeService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *ModbusBridgeService) State() int {
+	return svc.ServiceState
+}
+
+// reload (re)starts the bridges if their configuration has changed
+func (svc *ModbusBridgeService) reload() {
+	configs := common.ConnectionConfig.ModbusBridges
+	if reflect.DeepEqual(configs, svc.configs) {
+		return
+	}
+	svc.closeBridges()
+	svc.configs = configs
+	if len(configs) == 0 {
+		svc.LogFunc(fmt.Sprintf("%s idles, no modbus bridge is configured", svc.Name))
+		return
+	}
+	for _, config := range configs {
+		bridge := &modbusBridge{config: config, warn: svc.warn}
+		server, err := ListenModbusTCP(config.Listen, bridge)
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s warns: unable to bridge serial port %s, %s", svc.Name, config.Endpoint, err))
+			continue
+		}
+		bridge.server = server
+		if _, err := bridge.serialLine(); err != nil {
+			svc.LogFunc(fmt.Sprintf("%s warns: unable to open serial port %s, %s", svc.Name, config.Endpoint, err))
+		}
+		svc.bridges = append(svc.bridges, bridge)
+		svc.LogFunc(fmt.Sprintf("%s bridges %s to serial port %s", svc.Name, server.Addr(), config.Endpoint))
+	}
+}
+
+func (svc *ModbusBridgeService) closeBridges() {
+	for _, bridge := range svc.bridges {
+		bridge.close()
+	}
+	svc.bridges = nil
+}
+
+func (svc *ModbusBridgeService) warn(err error) {
+	svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, err))
+}
+
+// modbusBridge is the ModbusHandler of a bridge's tcp server, forwarding each request to the
+// addressed slave on the serial line. The server echoes the transaction ID of the request in
+// the response, and serves each client on its own goroutine, the serial line serializing
+// their transactions. The bridge holds the serial line open until it closes, opening it anew
+// only should the port fail, so that the port is not set up again, nor input lost, between
+// requests.
+type modbusBridge struct {
+	config common.ModbusBridgeConfig
+	server *ModbusTCPServer
+	warn   func(error)
+
+	mutex sync.Mutex
+	line  *serialLine // nil until opened, guarded by mutex
+}
+
+// serialLine returns the bridge's serial line, opening it unless it is open and has not
+// failed
+func (b *modbusBridge) serialLine() (*serialLine, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.line != nil && b.line.Err() == nil {
+		return b.line, nil
+	}
+	if b.line != nil {
+		b.line.release()
+		b.line = nil
+	}
+	line, err := openSerialLine(b.config.ConnectionRecord)
+	if err != nil {
+		return nil, err
+	}
+	b.line = line
+	return line, nil
+}
+
+// close stops the bridge's tcp server and releases its serial line
+func (b *modbusBridge) close() {
+	b.server.Close()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.line != nil {
+		b.line.release()
+		b.line = nil
+	}
+}
+
+// Handle forwards a request to the serial line, returning the slave's response or exception
+// response. Requests that cannot be forwarded, or go unanswered, are answered with the
+// gateway exceptions.
+func (b *modbusBridge) Handle(unitID byte, function byte, data []byte) (byte, []byte) {
+	// broadcasts go unanswered on a serial line, a tcp client would wait in vain
+	if unitID == 0 {
+		return function | 0x80, []byte{modbus.ExceptionCodeGatewayPathUnavailable}
+	}
+	record := b.config.ConnectionRecord
+	if unitID != modbusBridgeUnitSelf {
+		record.UnitID = int(unitID)
+	}
+	line, err := b.serialLine()
+	if err != nil {
+		b.warn(fmt.Errorf("unable to open serial port %s, %s", record.Endpoint, err))
+		return function | 0x80, []byte{modbus.ExceptionCodeGatewayPathUnavailable}
+	}
+	packager := newRTUClientHandler(record)
+	response, err := forwardPDU(packager, line, &modbus.ProtocolDataUnit{FunctionCode: function, Data: data})
+	if err != nil {
+		if isTimeout(err) {
+			return function | 0x80, []byte{modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond}
+		}
+		b.warn(fmt.Errorf("unable to forward function %d to slave %d on %s, %s", function, packager.SlaveId, record.Endpoint, err))
+		return function | 0x80, []byte{modbus.ExceptionCodeGatewayPathUnavailable}
+	}
+	return response.FunctionCode, response.Data
+}
+
+// forwardPDU exchanges a request PDU for the slave's response PDU, which is either the
+// response to the request or an exception response
+func forwardPDU(packager modbus.Packager, transporter modbus.Transporter, request *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	aduRequest, err := packager.Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := transporter.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err = packager.Verify(aduRequest, aduResponse); err != nil {
+		return nil, err
+	}
+	response, err := packager.Decode(aduResponse)
+	if err != nil {
+		return nil, err
+	}
+	if response.FunctionCode&0x7F != request.FunctionCode {
+		return nil, fmt.Errorf("response function code %d does not match request %d", response.FunctionCode, request.FunctionCode)
+	}
+	return response, nil
+}
+
+// isTimeout returns true if the error is a serial port or network timeout
+func isTimeout(err error) bool {
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout()
+	}
+	return err == serial.ErrTimeout
+}
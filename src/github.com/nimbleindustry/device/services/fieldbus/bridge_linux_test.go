@@ -0,0 +1,131 @@
+package fieldbus
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModbusBridge(t *testing.T) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer master.Close()
+	// hold the slave side open so the master does not see a hangup between transactions
+	keepAlive, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	assert.Nil(t, err, "unable to open pty slave")
+	defer keepAlive.Close()
+
+	slave := NewModbusSlave(3, 0, 0, 10, 0)
+	slave.SetRegisters(modbus.FuncCodeReadHoldingRegisters, 0, []byte{0, 42})
+	go ServeModbusRTU(master, slave)
+
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: slavePath, Baudrate: 115200, UnitID: 3}
+	var warnings []error
+	bridge := &modbusBridge{config: common.ModbusBridgeConfig{ConnectionRecord: record},
+		warn: func(err error) { warnings = append(warnings, err) }}
+	server, err := ListenModbusTCP("127.0.0.1:0", bridge)
+	assert.Nil(t, err, "unable to listen")
+	bridge.server = server
+
+	handler := modbus.NewTCPClientHandler(server.Addr().String())
+	handler.SlaveId = 3
+	handler.Timeout = 2 * time.Second
+	defer handler.Close()
+	client := modbus.NewClient(handler)
+
+	// polling the line while the bridge forwards requests to it, as a ModbusRTUService would
+	line, err := openSerialLine(record)
+	assert.Nil(t, err, "expected serial port to open")
+	poller := modbus.NewClient2(newRTUClientHandler(record), line)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			b, err := poller.ReadHoldingRegisters(0, 1)
+			if err != nil || b[1] != 42 {
+				t.Errorf("poll %d failed: % x, %v", i, b, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err = client.WriteSingleRegister(uint16(1+i%9), uint16(i))
+		assert.Nil(t, err, "expected write through the bridge to succeed")
+	}
+	wg.Wait()
+	b, err := client.ReadHoldingRegisters(0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 42, 0, 18}, b)
+
+	// the bridge holds the line between its transactions, after the poller releases it
+	assert.Equal(t, 2, serialLines.open[slavePath].users)
+	assert.Nil(t, line.release())
+	assert.True(t, serialLines.open[slavePath] == bridge.line, "expected the bridge to hold the serial port open")
+
+	// exception responses are returned as the slave sent them
+	_, err = client.ReadHoldingRegisters(8, 4)
+	assert.Equal(t, byte(modbus.ExceptionCodeIllegalDataAddress), err.(*modbus.ModbusError).ExceptionCode)
+	// unit 255 addresses the bridge's unit, broadcasts are not forwarded
+	handler.SlaveId = modbusBridgeUnitSelf
+	b, err = client.ReadHoldingRegisters(0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 42}, b)
+	handler.SlaveId = 0
+	_, err = client.ReadHoldingRegisters(0, 1)
+	assert.Equal(t, byte(modbus.ExceptionCodeGatewayPathUnavailable), err.(*modbus.ModbusError).ExceptionCode)
+	assert.Equal(t, 0, len(warnings))
+
+	bridge.close()
+	assert.Equal(t, 0, len(serialLines.open), "expected the serial port to close with the bridge")
+}
+
+func TestModbusBridgeFramesPiecemealResponses(t *testing.T) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer master.Close()
+	keepAlive, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	assert.Nil(t, err, "unable to open pty slave")
+	defer keepAlive.Close()
+
+	slave := NewModbusSlave(3, 0, 0, 10, 0)
+	slave.Identification = DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2", 4: "Tank controller"}
+	slave.SetFIFO(4, []uint16{7, 8, 9})
+	go servePiecemeal(master, slave)
+
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: slavePath, Baudrate: 115200, UnitID: 3}
+	var warnings []error
+	bridge := &modbusBridge{config: common.ModbusBridgeConfig{ConnectionRecord: record},
+		warn: func(err error) { warnings = append(warnings, err) }}
+	server, err := ListenModbusTCP("127.0.0.1:0", bridge)
+	assert.Nil(t, err, "unable to listen")
+	bridge.server = server
+	defer bridge.close()
+	handler := modbus.NewTCPClientHandler(server.Addr().String())
+	handler.SlaveId = 3
+	handler.Timeout = 2 * time.Second
+	defer handler.Close()
+
+	// responses goburrow's rtu transporter would cut short at 4 bytes, leaving the rest to
+	// corrupt the next transaction
+	for i := 0; i < 3; i++ {
+		id, err := ReadDeviceIdentification(handler, handler)
+		assert.Nil(t, err)
+		assert.Equal(t, slave.Identification, id)
+		fifo, err := newPDUClient(handler, handler).readFIFOQueue(4)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0, 7, 0, 8, 0, 9}, fifo)
+	}
+	assert.Equal(t, 0, len(warnings))
+}
@@ -0,0 +1,448 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/can"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	canFrames         = 64 // frames buffered between the socket and the service
+	canStaleIntervals = 5  // report intervals without a frame after which a signal is stale
+)
+
+// CANService decodes the signals of the frames received on a SocketCAN interface, named by
+// the connection record's endpoint (can0), as described by the DBC file of the equipment
+// config's can section. The latest value of each signal is reported at the section's
+// interval; signals not received for several intervals are reported stale. The interface is
+// reopened with exponential backoff should it fail, the service exiting (to be restarted by
+// its supervisor) only after repeated failures.
+type CANService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop        chan bool
+	connection  common.ConnectionRecord
+	integration *common.CANIntegration
+	pollGroups  []common.PollGroup
+	tags        []canTag
+	bySignal    map[*can.Signal]*canTag
+	database    *can.Database
+	interval    time.Duration // the interval at which values are reported
+	open        func(iface string) (can.FrameSource, error)
+
+	source     can.FrameSource
+	frames     chan can.Frame
+	failed     chan error                 // the error that ended reception from the source
+	closed     chan struct{}              // closed with the source, ending its reception
+	pending    common.OpsReport           // values decoded since the last report
+	received   map[string]time.Time       // when each tag was last received
+	stale      map[string]bool            // tags reported stale or bad since last received
+	lastValues map[string]common.TagValue // last value of each tag, for stale reporting
+	fieldbusMonitor
+}
+
+// canTag is a signal reported as a tag
+type canTag struct {
+	name    string
+	message *can.Message
+	signal  *can.Signal
+	desc    common.MLMap
+}
+
+// NewCANService returns a service for the CAN interface of the passed connection record,
+// named for the record
+func NewCANService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *CANService {
+	svc := &CANService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	svc.open = func(iface string) (can.FrameSource, error) {
+		return can.Open(iface)
+	}
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *CANService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for can, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	report := time.NewTicker(svc.interval)
+	defer report.Stop()
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	reconnect := time.NewTimer(svc.untilReconnect(time.Now()))
+	defer reconnect.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case f := <-svc.frames:
+			svc.decode(f, time.Now())
+		case err := <-svc.failed:
+			svc.lose(err)
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		case now := <-report.C:
+			svc.report(now)
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.connection.Endpoint)
+		case <-reconnect.C:
+			if err := svc.connect(); err != nil && svc.backoff.exhausted(fieldbusReconnectAttempts) {
+				// reopening in place has not worked, force supervisor recovery
+				svc.publishState(svc.Name, svc.connection.Endpoint, define.ConnectionFailed, err)
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *CANService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *CANService) State() int {
+	return svc.ServiceState
+}
+
+func (svc *CANService) clean() {
+	svc.closeConnection()
+}
+
+func (svc *CANService) initConfigurations() error {
+	if common.ConnectionConfig.DeviceID == "" {
+		return errors.New("Connection config object not initialized")
+	}
+	if common.EquipmentConfig.Ref == "" {
+		return errors.New("Equipment config object not initialized")
+	}
+	svc.integration = common.EquipmentConfig.MachineIntegrations.CAN
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
+	return nil
+}
+
+// initBusIntegration loads the DBC file and selects the signals reported
+func (svc *CANService) initBusIntegration() error {
+	if svc.connection.Type == "" {
+		return errors.New("No CAN connection records")
+	}
+	if svc.connection.Endpoint == "" {
+		return errors.New("CAN connection record has no interface")
+	}
+	if svc.integration == nil {
+		return errors.New("No can section")
+	}
+	interval, err := sectionInterval("can section", svc.integration.PollGroup, svc.integration.PollInterval,
+		svc.pollGroups, modbusSampleFrequency)
+	if err != nil {
+		return err
+	}
+	svc.interval = interval
+	if svc.database, err = loadCANDatabase(svc.integration.DBCFile); err != nil {
+		return err
+	}
+	if svc.tags, err = canTags(svc.integration, svc.database); err != nil {
+		return err
+	}
+	svc.bySignal = make(map[*can.Signal]*canTag, len(svc.tags))
+	for i, v := range svc.tags {
+		if svc.bySignal[v.signal] != nil {
+			return fmt.Errorf("signal %s of message %s is selected more than once", v.signal.Name, v.message.Name)
+		}
+		svc.bySignal[v.signal] = &svc.tags[i]
+	}
+	svc.frames = make(chan can.Frame, canFrames)
+	svc.pending = make(common.OpsReport)
+	svc.received = make(map[string]time.Time, len(svc.tags))
+	svc.stale = make(map[string]bool, len(svc.tags))
+	svc.backoff = reconnectBackoff{min: fieldbusReconnectMinDelay, max: fieldbusReconnectMaxDelay}
+	return nil
+}
+
+// loadCANDatabase loads a DBC file, whose path is relative to the configuration directory
+// unless absolute
+func loadCANDatabase(path string) (*can.Database, error) {
+	if path == "" {
+		return nil, errors.New("can section has no dbcFile")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(define.ConfigPath, path)
+	}
+	return can.LoadDBC(path)
+}
+
+// canTags returns the signals reported: those selected by the integration, or else every
+// signal of the database named <message>.<signal>
+func canTags(integration *common.CANIntegration, database *can.Database) ([]canTag, error) {
+	var tags []canTag
+	if len(integration.Signals) == 0 {
+		for _, m := range database.Messages {
+			for _, s := range m.Signals {
+				tags = append(tags, canTag{name: m.Name + "." + s.Name, message: m, signal: s})
+			}
+		}
+		return tags, nil
+	}
+	names := make(map[string]bool, len(integration.Signals))
+	for i, v := range integration.Signals {
+		if v.Signal == "" {
+			return nil, fmt.Errorf("can signal %d has no signal", i)
+		}
+		tag := canTag{name: v.TagName, desc: v.Desc}
+		if tag.name == "" {
+			tag.name = v.Signal
+		}
+		if names[tag.name] {
+			return nil, fmt.Errorf("%s is defined more than once", tag.name)
+		}
+		names[tag.name] = true
+		for _, m := range database.Messages {
+			if v.Message != "" && m.Name != v.Message {
+				continue
+			}
+			for _, s := range m.Signals {
+				if s.Name != v.Signal {
+					continue
+				}
+				if tag.signal != nil {
+					return nil, fmt.Errorf("%s signal %s is carried by messages %s and %s, select one by message",
+						tag.name, v.Signal, tag.message.Name, m.Name)
+				}
+				tag.message, tag.signal = m, s
+			}
+		}
+		if tag.signal == nil {
+			return nil, fmt.Errorf("%s signal %s not found in DBC file", tag.name, v.Signal)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// untilReconnect returns how long until the interface may be (re-)opened, an hour while it
+// is open
+func (svc *CANService) untilReconnect(now time.Time) time.Duration {
+	if svc.source != nil {
+		return time.Hour
+	}
+	if wait := svc.backoff.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// connect opens the interface and starts receiving its frames. A failure to open is
+// reported, and every tag reported stale.
+func (svc *CANService) connect() error {
+	if svc.source != nil {
+		return nil
+	}
+	now := time.Now()
+	if !svc.backoff.ready(now) {
+		return fmt.Errorf("reopen of %s deferred for %s", svc.connection.Endpoint, svc.backoff.next.Sub(now))
+	}
+	source, err := svc.open(svc.connection.Endpoint)
+	if err != nil {
+		countOutcome(&svc.diagnostics.FieldbusCounters, err)
+		delay := svc.backoff.failed(now)
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to open CAN interface %s, retrying in %s: %s", svc.Name, svc.connection.Endpoint, delay, err))
+		svc.publishState(svc.Name, svc.connection.Endpoint, define.ConnectionDisconnected, err)
+		sendOpsReport(svc.Name, svc.staleReport(err))
+		return err
+	}
+	svc.source = source
+	svc.failed = make(chan error, 1)
+	svc.closed = make(chan struct{})
+	go receiveFrames(source, svc.frames, svc.failed, svc.closed)
+	// signals are given the report intervals of the connection to arrive before becoming stale
+	for _, v := range svc.tags {
+		svc.received[v.name] = now
+	}
+	svc.backoff.succeeded()
+	svc.countConnect()
+	svc.LogFunc(fmt.Sprintf("%s opens CAN interface %s", svc.Name, svc.connection.Endpoint))
+	svc.publishState(svc.Name, svc.connection.Endpoint, define.ConnectionConnected, nil)
+	return nil
+}
+
+// receiveFrames passes the frames read from a source to the service until the source fails,
+// which is passed on failed, or is closed
+func receiveFrames(source can.FrameSource, frames chan<- can.Frame, failed chan<- error, closed <-chan struct{}) {
+	for {
+		f, err := source.ReadFrame()
+		if err != nil {
+			failed <- err
+			return
+		}
+		select {
+		case frames <- f:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// decode decodes the signals of a frame received at the passed time, holding their values
+// until the next report. Frames of messages not described by the DBC file are ignored.
+func (svc *CANService) decode(f can.Frame, now time.Time) {
+	message := svc.database.Message(f.ID, f.Extended)
+	if message == nil || f.Remote {
+		return
+	}
+	countOutcome(&svc.diagnostics.FieldbusCounters, nil)
+	for _, v := range message.Decode(f.Data) {
+		tag := svc.bySignal[v.Signal]
+		if tag == nil {
+			continue
+		}
+		svc.count(tag.name, v.Err)
+		value := svc.tagValue(tag, v)
+		svc.pending[tag.name] = value
+		svc.received[tag.name] = now
+		delete(svc.stale, tag.name)
+		if value.Quality != define.QualityBad {
+			if svc.lastValues == nil {
+				svc.lastValues = make(map[string]common.TagValue)
+			}
+			svc.lastValues[tag.name] = value
+		}
+	}
+}
+
+// tagValue converts a decoded signal to a tag value. Single bit signals without scaling are
+// reported as booleans; values outside the signal's range are uncertain.
+func (svc *CANService) tagValue(tag *canTag, v can.Value) common.TagValue {
+	s := v.Signal
+	if v.Err != nil {
+		return common.TagValue{Unit: s.Unit, Quality: define.QualityBad, Error: fmt.Sprintf("%s %s", tag.name, v.Err)}
+	}
+	value := common.TagValue{Value: v.Value, Unit: s.Unit, Quality: define.QualityGood}
+	if s.Length == 1 && s.Factor == 1 && s.Offset == 0 {
+		value.Value = v.Value != 0
+	}
+	if !s.InRange(v.Value) {
+		value.Quality = define.QualityUncertain
+		value.Error = fmt.Sprintf("%s %g outside range [%g, %g]", tag.name, v.Value, s.Min, s.Max)
+	}
+	return value
+}
+
+// report sends the values decoded since the last report on TopicOpsReport, along with the
+// tags that have not been received for canStaleIntervals intervals: stale with their last
+// value, or bad if they have none
+func (svc *CANService) report(now time.Time) {
+	report := svc.pending
+	svc.pending = make(common.OpsReport)
+	if svc.source != nil {
+		staleAfter := canStaleIntervals * svc.interval
+		for _, v := range svc.tags {
+			if svc.stale[v.name] || now.Sub(svc.received[v.name]) < staleAfter {
+				continue
+			}
+			svc.stale[v.name] = true
+			report[v.name] = svc.staleValue(v, fmt.Errorf("no %s frame received in %s", v.message.Name, staleAfter))
+		}
+	}
+	if len(report) > 0 {
+		sendOpsReport(svc.Name, report)
+	}
+}
+
+// lose closes the failed interface, reporting every tag stale; the interface is reopened once
+// the backoff allows
+func (svc *CANService) lose(err error) {
+	if svc.source == nil {
+		return
+	}
+	svc.source.Close()
+	svc.source = nil
+	close(svc.closed)
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	svc.backoff.failed(time.Now())
+	svc.LogFunc(fmt.Sprintf("%s loses CAN interface %s: %s", svc.Name, svc.connection.Endpoint, err))
+	svc.publishState(svc.Name, svc.connection.Endpoint, define.ConnectionDisconnected, err)
+	sendOpsReport(svc.Name, svc.staleReport(err))
+}
+
+// staleValue reports a tag that is no longer received, carrying its last value forward, or
+// bad if it has none
+func (svc *CANService) staleValue(tag canTag, reason error) common.TagValue {
+	last, found := svc.lastValues[tag.name]
+	if !found {
+		return common.TagValue{Unit: tag.signal.Unit, Quality: define.QualityBad, Error: reason.Error()}
+	}
+	return common.TagValue{Value: last.Value, Unit: tag.signal.Unit, Quality: define.QualityStale, Error: reason.Error()}
+}
+
+// staleReport reports every tag as stale, values decoded but not yet reported being dropped
+func (svc *CANService) staleReport(reason error) common.OpsReport {
+	svc.pending = make(common.OpsReport)
+	m := make(common.OpsReport, len(svc.tags))
+	for _, v := range svc.tags {
+		m[v.name] = svc.staleValue(v, reason)
+		svc.stale[v.name] = true
+	}
+	return m
+}
+
+func (svc *CANService) closeConnection() (err error) {
+	if svc.source != nil {
+		err = svc.source.Close()
+		svc.source = nil
+		close(svc.closed)
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s reports error closing CAN interface %s, %s", svc.Name, svc.connection.Endpoint, err))
+		} else {
+			svc.LogFunc(fmt.Sprintf("%s closes CAN interface %s", svc.Name, svc.connection.Endpoint))
+		}
+		svc.publishState(svc.Name, svc.connection.Endpoint, define.ConnectionDisconnected, nil)
+	}
+	return
+}
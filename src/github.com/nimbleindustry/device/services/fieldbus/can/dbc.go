@@ -0,0 +1,215 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// independentMessage is the pseudo message holding the signals of a DBC file that are not
+// assigned to any message
+const independentMessage = "VECTOR__INDEPENDENT_SIG_MSG"
+
+// Database holds the messages of a DBC file
+type Database struct {
+	Messages []*Message
+
+	byID map[uint64]*Message
+}
+
+// Message is a frame described by a DBC file, and the signals it carries
+type Message struct {
+	ID       uint32
+	Extended bool
+	Name     string
+	Length   int // the data length, in bytes
+	Signals  []*Signal
+
+	multiplexor *Signal
+}
+
+// Signal is a value carried by the frames of a message. Its raw value occupies Length bits
+// starting at bit Start, numbered from the least significant bit of the first byte. Signals
+// in little-endian (Intel) byte order start at their least significant bit, those in
+// big-endian (Motorola) byte order at their most significant bit. The raw value is signed
+// (two's complement) or unsigned, or an IEEE float if Float is set, and converted to its
+// physical value as raw * Factor + Offset.
+//
+// A message may carry a Multiplexor signal selecting which of its Multiplexed signals a frame
+// carries: those whose MultiplexValue equals the multiplexor's raw value.
+type Signal struct {
+	Name           string
+	Start          int
+	Length         int
+	BigEndian      bool
+	Signed         bool
+	Float          bool
+	Factor         float64
+	Offset         float64
+	Min            float64
+	Max            float64
+	Unit           string
+	Multiplexor    bool
+	Multiplexed    bool
+	MultiplexValue uint64
+}
+
+var (
+	messagePattern = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)`)
+	signalPattern  = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+M?)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*` +
+		`\(\s*([^,\s]+)\s*,\s*([^)\s]+)\s*\)\s*\[\s*([^|\s]+)\s*\|\s*([^\]\s]+)\s*\]\s*"([^"]*)"`)
+	valueTypePattern = regexp.MustCompile(`^SIG_VALTYPE_\s+(\d+)\s+(\w+)\s*:?\s*([0-3])\s*;`)
+)
+
+// LoadDBC parses the DBC file at the passed path
+func LoadDBC(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := ParseDBC(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", path, err)
+	}
+	return db, nil
+}
+
+// ParseDBC parses the messages (BO_) and signals (SG_) of a DBC file, along with the signals'
+// value types (SIG_VALTYPE_). Other sections, such as comments and value tables, are ignored.
+// A signal that is both multiplexed and a multiplexor (extended multiplexing) is decoded as a
+// multiplexed signal only.
+func ParseDBC(r io.Reader) (*Database, error) {
+	db := &Database{byID: make(map[uint64]*Message)}
+	var message *Message
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			m := messagePattern.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d, invalid message %q", n, line)
+			}
+			id, _ := strconv.ParseUint(m[1], 10, 32)
+			length, _ := strconv.Atoi(m[3])
+			message = &Message{ID: uint32(id) & extendedIDMask, Extended: id&extendedFlag != 0, Name: m[2], Length: length}
+			if message.Name == independentMessage {
+				continue
+			}
+			key := messageKey(message.ID, message.Extended)
+			if _, found := db.byID[key]; found {
+				return nil, fmt.Errorf("line %d, message %s has the ID of another message", n, message.Name)
+			}
+			db.Messages = append(db.Messages, message)
+			db.byID[key] = message
+		case strings.HasPrefix(line, "SG_ "):
+			if message == nil {
+				return nil, fmt.Errorf("line %d, signal outside of a message", n)
+			}
+			s, err := parseSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d, %s", n, err)
+			}
+			if message.Name == independentMessage {
+				continue
+			}
+			if s.Multiplexor {
+				if message.multiplexor != nil {
+					return nil, fmt.Errorf("line %d, message %s has more than one multiplexor", n, message.Name)
+				}
+				message.multiplexor = s
+			}
+			message.Signals = append(message.Signals, s)
+		case strings.HasPrefix(line, "SIG_VALTYPE_ "):
+			m := valueTypePattern.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d, invalid signal value type %q", n, line)
+			}
+			id, _ := strconv.ParseUint(m[1], 10, 32)
+			s := db.signal(uint32(id)&extendedIDMask, id&extendedFlag != 0, m[2])
+			if s == nil {
+				return nil, fmt.Errorf("line %d, value type of unknown signal %s", n, m[2])
+			}
+			if m[3] == "1" || m[3] == "2" {
+				if length := map[string]int{"1": 32, "2": 64}[m[3]]; s.Length != length {
+					return nil, fmt.Errorf("line %d, float signal %s is not %d bits", n, s.Name, length)
+				}
+				s.Float = true
+			}
+		default:
+			message = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, m := range db.Messages {
+		for _, s := range m.Signals {
+			if s.Multiplexed && m.multiplexor == nil {
+				return nil, fmt.Errorf("multiplexed signal %s of message %s has no multiplexor", s.Name, m.Name)
+			}
+		}
+	}
+	return db, nil
+}
+
+// parseSignal parses a signal (SG_) line
+func parseSignal(line string) (*Signal, error) {
+	m := signalPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("invalid signal %q", line)
+	}
+	s := &Signal{Name: m[1], BigEndian: m[5] == "0", Signed: m[6] == "-", Unit: m[11]}
+	switch {
+	case m[2] == "M":
+		s.Multiplexor = true
+	case m[2] != "":
+		s.Multiplexed = true
+		s.MultiplexValue, _ = strconv.ParseUint(strings.TrimSuffix(m[2][1:], "M"), 10, 64)
+	}
+	s.Start, _ = strconv.Atoi(m[3])
+	s.Length, _ = strconv.Atoi(m[4])
+	var err error
+	for i, v := range []*float64{&s.Factor, &s.Offset, &s.Min, &s.Max} {
+		if *v, err = strconv.ParseFloat(m[7+i], 64); err != nil {
+			return nil, fmt.Errorf("signal %s, invalid number %s", s.Name, m[7+i])
+		}
+	}
+	end := s.Start + s.Length
+	if s.BigEndian {
+		end = s.Start/8*8 + 7 - s.Start%8 + s.Length
+	}
+	if s.Length < 1 || s.Length > 64 || s.Start > 63 || end > MaxDataLength*8 {
+		return nil, fmt.Errorf("signal %s of %d bits at bit %d does not fit a frame", s.Name, s.Length, s.Start)
+	}
+	return s, nil
+}
+
+func messageKey(id uint32, extended bool) uint64 {
+	if extended {
+		return uint64(id) | 1<<32
+	}
+	return uint64(id)
+}
+
+// Message returns the message of the passed frame ID, nil if the database has none
+func (db *Database) Message(id uint32, extended bool) *Message {
+	return db.byID[messageKey(id, extended)]
+}
+
+// signal returns the named signal of the message of the passed ID, nil if there is none
+func (db *Database) signal(id uint32, extended bool, name string) *Signal {
+	if m := db.Message(id, extended); m != nil {
+		for _, s := range m.Signals {
+			if s.Name == name {
+				return s
+			}
+		}
+	}
+	return nil
+}
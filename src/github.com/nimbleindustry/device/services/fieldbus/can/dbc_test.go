@@ -0,0 +1,109 @@
+package can
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dbcFixture describes an engine message of intel signals, an extended hydraulics message of
+// motorola and float signals, and a multiplexed diagnostics message
+const dbcFixture = `VERSION ""
+
+NS_ :
+	CM_
+	SIG_VALTYPE_
+
+BS_:
+
+BU_: ECU HMI
+
+BO_ 256 EngineData: 8 ECU
+ SG_ EngineSpeed : 0|16@1+ (0.25,0) [0|16383.75] "rpm" HMI
+ SG_ CoolantTemp : 16|8@1+ (1,-40) [-40|150] "°C" HMI
+ SG_ Torque : 24|12@1- (0.5,0) [-1000|1000] "Nm" HMI
+ SG_ Running : 36|1@1+ (1,0) [0|1] "" HMI
+
+BO_ 2566844158 Hydraulics: 8 ECU
+ SG_ Pressure : 7|16@0+ (0.1,0) [0|6553.5] "bar" HMI
+ SG_ OilLevel : 23|12@0- (1,0) [0|0] "mm" HMI
+ SG_ FlowRate : 32|32@1+ (1,0) [0|0] "l/min" HMI
+
+BO_ 512 Diagnostics: 8 ECU
+ SG_ Page M : 0|8@1+ (1,0) [0|255] "" HMI
+ SG_ BatteryVoltage m0 : 8|16@1+ (0.01,0) [0|655.35] "V" HMI
+ SG_ OperatingHours m1 : 8|32@1+ (0.05,0) [0|0] "h" HMI
+
+BO_ 3221225472 VECTOR__INDEPENDENT_SIG_MSG: 0 Vector__XXX
+ SG_ Unused : 0|8@1+ (1,0) [0|0] "" Vector__XXX
+
+CM_ SG_ 256 EngineSpeed "Engine speed";
+SIG_VALTYPE_ 2566844158 FlowRate : 1;
+`
+
+// decoded returns the decoded values of a frame's data by signal name
+func decoded(t *testing.T, m *Message, data []byte) map[string]float64 {
+	values := make(map[string]float64)
+	for _, v := range m.Decode(data) {
+		assert.Nil(t, v.Err, v.Signal.Name)
+		values[v.Signal.Name] = v.Value
+	}
+	return values
+}
+
+func TestParseDBC(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(dbcFixture))
+	assert.Nil(t, err)
+	assert.Len(t, db.Messages, 3)
+	hydraulics := db.Message(0x18FEEEFE, true)
+	assert.NotNil(t, hydraulics)
+	assert.Equal(t, "Hydraulics", hydraulics.Name)
+	assert.Nil(t, db.Message(0x18FEEEFE, false))
+	assert.Equal(t, &Signal{Name: "Pressure", Start: 7, Length: 16, BigEndian: true, Factor: 0.1, Max: 6553.5, Unit: "bar"},
+		hydraulics.Signals[0])
+	assert.True(t, hydraulics.Signals[2].Float)
+	diagnostics := db.Message(512, false)
+	assert.True(t, diagnostics.Signals[0].Multiplexor)
+	assert.Equal(t, uint64(1), diagnostics.Signals[2].MultiplexValue)
+
+	for _, dbc := range []string{
+		"BO_ 256 Engine: 8 ECU\n SG_ Speed : 0|16@1+ (0.25) [0|0] \"\" HMI\n",
+		"BO_ 256 Engine: 8 ECU\n SG_ Speed : 56|16@1+ (1,0) [0|0] \"\" HMI\n",
+		"BO_ 256 Engine: 8 ECU\n SG_ Speed : 7|16@0+ (1,0) [0|0] \"\" HMI\n SG_ Load : 59|8@0+ (1,0) [0|0] \"\" HMI\n",
+		"BO_ 256 Engine: 8 ECU\n SG_ Speed m1 : 0|16@1+ (1,0) [0|0] \"\" HMI\n",
+		"BO_ 256 Engine: 8 ECU\nBO_ 256 Other: 8 ECU\n",
+		" SG_ Speed : 0|16@1+ (1,0) [0|0] \"\" HMI\n",
+		"BO_ 256 Engine: 8 ECU\n SG_ Speed : 0|16@1+ (1,0) [0|0] \"\" HMI\n\nSIG_VALTYPE_ 256 Speed : 1;\n",
+	} {
+		_, err := ParseDBC(strings.NewReader(dbc))
+		assert.NotNil(t, err, dbc)
+	}
+}
+
+func TestDecodeSignals(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(dbcFixture))
+	assert.Nil(t, err)
+
+	// little-endian signals, unsigned with an offset, signed and a single bit
+	assert.Equal(t, map[string]float64{"EngineSpeed": 2000, "CoolantTemp": 90, "Torque": -100, "Running": 1},
+		decoded(t, db.Message(256, false), []byte{0x40, 0x1F, 0x82, 0x38, 0x1F, 0, 0, 0}))
+
+	// big-endian signals, unsigned and signed, and a float
+	assert.Equal(t, map[string]float64{"Pressure": 123.4, "OilLevel": -5, "FlowRate": 12.5},
+		decoded(t, db.Message(0x18FEEEFE, true), []byte{0x04, 0xD2, 0xFF, 0xB0, 0x00, 0x00, 0x48, 0x41}))
+
+	// the multiplexor selects the signals carried
+	diagnostics := db.Message(512, false)
+	assert.Equal(t, map[string]float64{"Page": 0, "BatteryVoltage": 12.5}, decoded(t, diagnostics, []byte{0x00, 0xE2, 0x04}))
+	assert.Equal(t, map[string]float64{"Page": 1, "OperatingHours": 100}, decoded(t, diagnostics, []byte{0x01, 0xD0, 0x07, 0, 0}))
+	values := diagnostics.Decode([]byte{0x01, 0xD0, 0x07})
+	assert.Len(t, values, 2)
+	assert.NotNil(t, values[1].Err, "expected a signal beyond the data to fail")
+	assert.Len(t, diagnostics.Decode(nil), 1)
+
+	pressure := db.Message(0x18FEEEFE, true).Signals[0]
+	assert.True(t, pressure.InRange(6553.5))
+	assert.False(t, pressure.InRange(-1))
+	assert.True(t, db.Message(0x18FEEEFE, true).Signals[1].InRange(-5))
+}
@@ -0,0 +1,88 @@
+package can
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Value is the physical value of a signal decoded from a frame, or the reason it could not be
+// decoded
+type Value struct {
+	Signal *Signal
+	Value  float64
+	Err    error
+}
+
+// Decode returns the values of the signals carried by a frame's data: every signal of the
+// message unless it is multiplexed, in which case only those selected by the multiplexor.
+// Signals that do not fit the data are returned with an error, and multiplexed signals
+// omitted should the multiplexor not fit.
+func (m *Message) Decode(data []byte) []Value {
+	var selector uint64
+	var selected bool
+	if m.multiplexor != nil {
+		raw, err := m.multiplexor.Raw(data)
+		selector, selected = raw, err == nil
+	}
+	values := make([]Value, 0, len(m.Signals))
+	for _, s := range m.Signals {
+		if s.Multiplexed && (!selected || s.MultiplexValue != selector) {
+			continue
+		}
+		v, err := s.Decode(data)
+		values = append(values, Value{Signal: s, Value: v, Err: err})
+	}
+	return values
+}
+
+// Raw returns the raw value of the signal, its bits as they are found in the frame's data
+func (s *Signal) Raw(data []byte) (uint64, error) {
+	var b [MaxDataLength]byte
+	copy(b[:], data)
+	var raw uint64
+	var end int
+	if s.BigEndian {
+		// counting from the most significant bit of the first byte, the signal ends (at its
+		// least significant bit) Length bits after its most significant bit
+		end = s.Start/8*8 + 7 - s.Start%8 + s.Length
+		raw = binary.BigEndian.Uint64(b[:]) >> uint(64-end)
+	} else {
+		end = s.Start + s.Length
+		raw = binary.LittleEndian.Uint64(b[:]) >> uint(s.Start)
+	}
+	if end > len(data)*8 {
+		return 0, fmt.Errorf("signal %s does not fit %d bytes of data", s.Name, len(data))
+	}
+	if s.Length < 64 {
+		raw &= 1<<uint(s.Length) - 1
+	}
+	return raw, nil
+}
+
+// Decode returns the physical value of the signal
+func (s *Signal) Decode(data []byte) (float64, error) {
+	raw, err := s.Raw(data)
+	if err != nil {
+		return 0, err
+	}
+	var v float64
+	switch {
+	case s.Float && s.Length == 32:
+		v = float64(math.Float32frombits(uint32(raw)))
+	case s.Float:
+		v = math.Float64frombits(raw)
+	case s.Signed:
+		shift := uint(64 - s.Length)
+		v = float64(int64(raw<<shift) >> shift)
+	default:
+		v = float64(raw)
+	}
+	return v*s.Factor + s.Offset, nil
+}
+
+// InRange returns true if the physical value lies within the signal's minimum and maximum,
+// which are ignored if equal (as they are when not specified)
+func (s *Signal) InRange(v float64) bool {
+	return s.Min >= s.Max || (v >= s.Min && v <= s.Max)
+}
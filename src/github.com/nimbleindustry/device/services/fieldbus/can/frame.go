@@ -0,0 +1,46 @@
+// Package can reads CAN bus frames, from a Linux SocketCAN interface or any other FrameSource,
+// and decodes the signals they carry as described by a DBC file.
+package can
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Frame identifier masks and flags, as used by SocketCAN
+const (
+	standardIDMask = 0x000007FF
+	extendedIDMask = 0x1FFFFFFF
+	extendedFlag   = 0x80000000
+	remoteFlag     = 0x40000000
+	errorFlag      = 0x20000000
+)
+
+// MaxDataLength is the length of the data of a classic CAN frame
+const MaxDataLength = 8
+
+// Frame is a classic CAN frame. Extended frames have a 29 bit ID, standard frames an 11 bit
+// ID. Remote (RTR) frames request a frame and carry no data.
+type Frame struct {
+	ID       uint32
+	Extended bool
+	Remote   bool
+	Data     []byte
+}
+
+func (f Frame) String() string {
+	if f.Extended {
+		return fmt.Sprintf("%08X [%d] % X", f.ID, len(f.Data), f.Data)
+	}
+	return fmt.Sprintf("%03X [%d] % X", f.ID, len(f.Data), f.Data)
+}
+
+// FrameSource is a source of CAN frames, such as a SocketCAN socket
+type FrameSource interface {
+	// ReadFrame blocks until a frame is received, returning ErrClosed once the source is closed
+	ReadFrame() (Frame, error)
+	Close() error
+}
+
+// ErrClosed is returned when reading from a closed FrameSource
+var ErrClosed = errors.New("can: frame source closed")
@@ -0,0 +1,139 @@
+package can
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	frameSize   = 16 // the size of struct can_frame
+	readTimeout = 250 * time.Millisecond
+)
+
+// nativeEndian is the byte order of the can_id of the frames read and written by the kernel
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// Socket is a raw SocketCAN socket bound to a CAN interface such as can0, or a virtual
+// interface such as vcan0. It receives the (classic) frames of every other socket bound to
+// the interface, error frames excepted.
+type Socket struct {
+	iface  string
+	mutex  sync.RWMutex // held to read or write, and exclusively to close
+	fd     int
+	closed bool
+}
+
+// Open opens a raw socket bound to the named CAN interface
+func Open(iface string) (*Socket, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("can: opening socket, %s", err)
+	}
+	// reads time out so that closing the socket need not wait for a frame
+	tv := unix.NsecToTimeval(readTimeout.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err == nil {
+		err = unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index})
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("can: binding to %s, %s", iface, err)
+	}
+	return &Socket{iface: iface, fd: fd}, nil
+}
+
+// ReadFrame blocks until a frame is received. A read in progress when the socket is closed
+// returns ErrClosed within the socket's read timeout.
+func (s *Socket) ReadFrame() (Frame, error) {
+	b := make([]byte, frameSize)
+	for {
+		s.mutex.RLock()
+		if s.closed {
+			s.mutex.RUnlock()
+			return Frame{}, ErrClosed
+		}
+		n, err := unix.Read(s.fd, b)
+		s.mutex.RUnlock()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return Frame{}, fmt.Errorf("can: reading from %s, %s", s.iface, err)
+		}
+		if n != frameSize {
+			return Frame{}, fmt.Errorf("can: short frame of %d bytes from %s", n, s.iface)
+		}
+		id := nativeEndian.Uint32(b[0:4])
+		if id&errorFlag != 0 {
+			continue
+		}
+		length := int(b[4])
+		if length > MaxDataLength {
+			length = MaxDataLength
+		}
+		f := Frame{Extended: id&extendedFlag != 0, Remote: id&remoteFlag != 0}
+		if f.Extended {
+			f.ID = id & extendedIDMask
+		} else {
+			f.ID = id & standardIDMask
+		}
+		if !f.Remote {
+			f.Data = append([]byte{}, b[8:8+length]...)
+		}
+		return f, nil
+	}
+}
+
+// WriteFrame sends a frame on the interface
+func (s *Socket) WriteFrame(f Frame) error {
+	if len(f.Data) > MaxDataLength {
+		return fmt.Errorf("can: frame data of %d bytes exceeds %d", len(f.Data), MaxDataLength)
+	}
+	b := make([]byte, frameSize)
+	id := f.ID & standardIDMask
+	if f.Extended {
+		id = f.ID&extendedIDMask | extendedFlag
+	}
+	if f.Remote {
+		id |= remoteFlag
+	}
+	nativeEndian.PutUint32(b[0:4], id)
+	b[4] = byte(len(f.Data))
+	copy(b[8:], f.Data)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := unix.Write(s.fd, b); err != nil {
+		return fmt.Errorf("can: writing to %s, %s", s.iface, err)
+	}
+	return nil
+}
+
+// Close closes the socket, waiting for a read in progress to time out
+func (s *Socket) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,55 @@
+package can
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testInterface is the virtual CAN interface used by the socket tests, which are skipped if
+// it does not exist. It is created with:
+//
+//	ip link add dev vcan0 type vcan && ip link set up vcan0
+const testInterface = "vcan0"
+
+func TestSocketOnVirtualInterface(t *testing.T) {
+	if _, err := net.InterfaceByName(testInterface); err != nil {
+		t.Skipf("no %s interface", testInterface)
+	}
+	receiver, err := Open(testInterface)
+	assert.Nil(t, err)
+	sender, err := Open(testInterface)
+	assert.Nil(t, err)
+	defer sender.Close()
+
+	frames := []Frame{{ID: 0x100, Data: []byte{0x40, 0x1F}}, {ID: 0x18FEEEFE, Extended: true, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{ID: 0x200, Remote: true}}
+	for _, v := range frames {
+		assert.Nil(t, sender.WriteFrame(v))
+	}
+	for _, v := range frames {
+		f, err := receiver.ReadFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, v, f)
+	}
+
+	// closing the socket ends a read in progress
+	read := make(chan error)
+	go func() {
+		_, err := receiver.ReadFrame()
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, receiver.Close())
+	select {
+	case err := <-read:
+		assert.Equal(t, ErrClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("read not ended by close")
+	}
+	assert.Equal(t, ErrClosed, receiver.WriteFrame(frames[0]))
+	_, err = Open("nonexistent0")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package can
+
+import "errors"
+
+// Socket is a SocketCAN socket, which is only available on Linux
+type Socket struct{}
+
+// Open returns an error, SocketCAN being only available on Linux
+func Open(iface string) (*Socket, error) {
+	return nil, errors.New("can: SocketCAN is only supported on linux")
+}
+
+// ReadFrame returns ErrClosed
+func (s *Socket) ReadFrame() (Frame, error) {
+	return Frame{}, ErrClosed
+}
+
+// WriteFrame returns ErrClosed
+func (s *Socket) WriteFrame(f Frame) error {
+	return ErrClosed
+}
+
+// Close does nothing
+func (s *Socket) Close() error {
+	return nil
+}
@@ -0,0 +1,197 @@
+package fieldbus
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/can"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// canDBCFixture describes an engine message and a hydraulics message, both carrying a
+// pressure signal
+const canDBCFixture = `VERSION ""
+
+BO_ 256 Engine: 8 ECU
+ SG_ Speed : 0|16@1+ (0.25,0) [0|3000] "rpm" HMI
+ SG_ Running : 16|1@1+ (1,0) [0|1] "" HMI
+ SG_ Pressure : 24|8@1+ (1,0) [0|0] "bar" HMI
+
+BO_ 2566844158 Hydraulics: 8 ECU
+ SG_ Pressure : 7|16@0+ (0.1,0) [0|0] "bar" HMI
+`
+
+// fakeFrameSource passes the frames sent on its channel, failing once the channel is closed
+type fakeFrameSource struct {
+	frames chan can.Frame
+	closed chan struct{}
+}
+
+func newFakeFrameSource() *fakeFrameSource {
+	return &fakeFrameSource{frames: make(chan can.Frame), closed: make(chan struct{})}
+}
+
+func (s *fakeFrameSource) ReadFrame() (can.Frame, error) {
+	select {
+	case f, ok := <-s.frames:
+		if !ok {
+			return can.Frame{}, errors.New("network is down")
+		}
+		return f, nil
+	case <-s.closed:
+		return can.Frame{}, can.ErrClosed
+	}
+}
+
+func (s *fakeFrameSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+// writeCANDBCFixture writes the DBC fixture to a temporary directory, returning its path and
+// a function removing it
+func writeCANDBCFixture(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "can")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "fixture.dbc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(canDBCFixture), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// receiveCANFrames decodes the next n frames received by the service, at the passed time
+func receiveCANFrames(t *testing.T, svc *CANService, n int, now time.Time) {
+	for i := 0; i < n; i++ {
+		select {
+		case f := <-svc.frames:
+			svc.decode(f, now)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of %d frames received", i, n)
+		}
+	}
+}
+
+func TestCANTags(t *testing.T) {
+	path, remove := writeCANDBCFixture(t)
+	defer remove()
+	database, err := loadCANDatabase(path)
+	assert.Nil(t, err)
+
+	tags, err := canTags(&common.CANIntegration{}, database)
+	assert.Nil(t, err)
+	var names []string
+	for _, v := range tags {
+		names = append(names, v.name)
+	}
+	assert.Equal(t, []string{"Engine.Speed", "Engine.Running", "Engine.Pressure", "Hydraulics.Pressure"}, names)
+
+	tags, err = canTags(&common.CANIntegration{Signals: []common.CANSignal{
+		{Signal: "Speed"}, {TagName: "OilPressure", Message: "Hydraulics", Signal: "Pressure"}}}, database)
+	assert.Nil(t, err)
+	assert.Equal(t, "Speed", tags[0].name)
+	assert.Equal(t, "OilPressure", tags[1].name)
+	assert.Equal(t, "Hydraulics", tags[1].message.Name)
+
+	for _, signals := range [][]common.CANSignal{
+		{{Signal: "Pressure"}},
+		{{Signal: "Torque"}},
+		{{Message: "Hydraulics", Signal: "Speed"}},
+		{{}},
+		{{Signal: "Speed"}, {TagName: "Speed", Signal: "Running"}},
+	} {
+		_, err := canTags(&common.CANIntegration{Signals: signals}, database)
+		assert.NotNil(t, err, "%v", signals)
+	}
+
+	groups := []common.PollGroup{{Name: "fast", Interval: "100ms"}}
+	for _, v := range []struct {
+		integration common.CANIntegration
+		interval    time.Duration
+	}{
+		{common.CANIntegration{}, time.Second},
+		{common.CANIntegration{PollGroup: "fast"}, 100 * time.Millisecond},
+		{common.CANIntegration{PollInterval: "250ms"}, 250 * time.Millisecond},
+	} {
+		interval, err := sectionInterval("can section", v.integration.PollGroup, v.integration.PollInterval, groups, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, v.interval, interval)
+	}
+	_, err = sectionInterval("can section", "slow", "", groups, time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestCANServiceReportsSignals(t *testing.T) {
+	path, remove := writeCANDBCFixture(t)
+	defer remove()
+	svc := NewCANService(common.ConnectionRecord{Type: define.CAN, Endpoint: "vcan0"}, func(s string) { t.Log(s) }, 0)
+	assert.Equal(t, "CANService[vcan0]", svc.Name)
+	source := newFakeFrameSource()
+	var opened []string
+	svc.open = func(iface string) (can.FrameSource, error) {
+		opened = append(opened, iface)
+		if len(opened) > 1 {
+			return nil, errors.New("no such device")
+		}
+		return source, nil
+	}
+	svc.integration = &common.CANIntegration{DBCFile: path, PollInterval: "100ms", Signals: []common.CANSignal{
+		{Signal: "Speed"}, {Signal: "Running"}, {TagName: "OilPressure", Message: "Hydraulics", Signal: "Pressure"}}}
+	assert.Nil(t, svc.initBusIntegration())
+	reports := watchOpsReports()
+
+	now := time.Now()
+	assert.Nil(t, svc.connect())
+	assert.Equal(t, []string{"vcan0"}, opened)
+	go func() {
+		source.frames <- can.Frame{ID: 256, Data: []byte{0x40, 0x1F, 0x01, 0x07}}
+		source.frames <- can.Frame{ID: 0x18FEEEFE, Extended: true, Data: []byte{0x04, 0xD2}}
+		source.frames <- can.Frame{ID: 0x300, Data: []byte{0xFF}}
+	}()
+	receiveCANFrames(t, svc, 3, now)
+	svc.report(now)
+	report := nextOpsReport(t, reports, "OilPressure", nil)
+	assert.Equal(t, common.TagValue{Value: 2000.0, Unit: "rpm", Quality: define.QualityGood, Source: svc.Name}, report["Speed"])
+	assert.Equal(t, common.TagValue{Value: true, Quality: define.QualityGood, Source: svc.Name}, report["Running"])
+	assert.Equal(t, common.TagValue{Value: 123.4, Unit: "bar", Quality: define.QualityGood, Source: svc.Name}, report["OilPressure"])
+
+	// out of range values are uncertain, and signals not received become stale
+	go func() {
+		source.frames <- can.Frame{ID: 256, Data: []byte{0xFF, 0xFF, 0x00, 0x07}}
+	}()
+	receiveCANFrames(t, svc, 1, now.Add(svc.interval))
+	svc.report(now.Add(svc.interval))
+	report = nextOpsReport(t, reports, "Speed", nil)
+	assert.Equal(t, define.QualityUncertain, report["Speed"].Quality)
+	assert.Equal(t, false, report["Running"].Value)
+	svc.report(now.Add(canStaleIntervals * svc.interval))
+	report = nextOpsReport(t, reports, "OilPressure", nil)
+	assert.Equal(t, define.QualityStale, report["OilPressure"].Quality)
+	assert.Equal(t, 123.4, report["OilPressure"].Value)
+	assert.NotContains(t, report, "Speed")
+
+	// a failed interface is reported stale and reopened after a delay
+	close(source.frames)
+	select {
+	case err := <-svc.failed:
+		svc.lose(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("failure not received")
+	}
+	svc.report(now)
+	report = nextOpsReport(t, reports, "Speed", nil)
+	assert.Equal(t, define.QualityStale, report["Speed"].Quality)
+	assert.Equal(t, "network is down", report["Speed"].Error)
+	assert.Nil(t, svc.source)
+	assert.True(t, svc.untilReconnect(time.Now()) > 0)
+	svc.backoff.next = time.Time{}
+	assert.NotNil(t, svc.connect())
+	assert.Equal(t, 2, len(opened))
+	assert.Equal(t, &common.FieldbusCounters{Requests: 2, Responses: 2}, svc.diagnostics.Tags["Speed"])
+	assert.Nil(t, svc.closeConnection())
+}
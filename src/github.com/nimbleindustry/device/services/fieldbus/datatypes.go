@@ -0,0 +1,240 @@
+package fieldbus
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+)
+
+// validateModbusEntry checks that an entry's data type settings can be decoded
+func validateModbusEntry(entry common.ModbusEntry) error {
+	if entry.UnitID < 0 || entry.UnitID > common.ModbusMaxUnitID {
+		return fmt.Errorf("%s has invalid unit ID %d", entry.RegisterName, entry.UnitID)
+	}
+	registers := entry.RegisterCount()
+	if registers > modbusMaxReadRegisters {
+		return fmt.Errorf("%s occupies %d registers, more than can be read in one request", entry.RegisterName, registers)
+	}
+	var minimum int
+	switch entry.DataType {
+	case "", common.DataTypeInt16, common.DataTypeUint16, common.DataTypeString, common.DataTypeBits:
+		minimum = 1
+	case common.DataTypeInt32, common.DataTypeUint32, common.DataTypeFloat32:
+		minimum = 2
+	case common.DataTypeFloat64:
+		minimum = 4
+	case common.DataTypeBit:
+		minimum = 1
+		if entry.BitIndex < 0 || entry.BitIndex >= 16*registers {
+			return fmt.Errorf("%s bit index %d out of range", entry.RegisterName, entry.BitIndex)
+		}
+	default:
+		return fmt.Errorf("%s has unknown data type %s", entry.RegisterName, entry.DataType)
+	}
+	if registers < minimum {
+		return fmt.Errorf("%s of type %s requires at least %d registers", entry.RegisterName, entry.DataType, minimum)
+	}
+	return validateEntryFunctions(entry)
+}
+
+// validateEntryFunctions checks that an entry declaring the functions that do not address a
+// table (20-24) defines what those functions require
+func validateEntryFunctions(entry common.ModbusEntry) error {
+	if hasFunction(entry, modbus.FuncCodeMaskWriteRegister) && entry.DataType != common.DataTypeBit {
+		return fmt.Errorf("%s must be of type %s to be written by mask write", entry.RegisterName, common.DataTypeBit)
+	}
+	if hasFunction(entry, modbus.FuncCodeReadWriteMultipleRegisters) {
+		if entry.RegisterCount() > modbusMaxReadWriteRegisters {
+			return fmt.Errorf("%s occupies %d registers, more than can be written in one request", entry.RegisterName, entry.RegisterCount())
+		}
+		if address := entryWriteAddress(entry); address < 0 || address > 0xFFFF {
+			return fmt.Errorf("%s has invalid write address %d", entry.RegisterName, address)
+		}
+	}
+	if hasFunction(entry, modbus.FuncCodeReadFIFOQueue) && entry.RegisterCount() > modbusMaxFIFOCount {
+		return fmt.Errorf("%s occupies %d registers, more than a FIFO queue holds", entry.RegisterName, entry.RegisterCount())
+	}
+	if hasFunction(entry, modbusFuncCodeReadFileRecord) || hasFunction(entry, modbusFuncCodeWriteFileRecord) {
+		if entry.File < 1 || entry.File > 0xFFFF {
+			return fmt.Errorf("%s has invalid file number %d", entry.RegisterName, entry.File)
+		}
+		if entry.Address < 0 || entry.Address+entry.RegisterCount()-1 > modbusMaxFileRecord {
+			return fmt.Errorf("%s records %d-%d exceed the %d records of a file", entry.RegisterName,
+				entry.Address, entry.Address+entry.RegisterCount()-1, modbusMaxFileRecord+1)
+		}
+		if hasFunction(entry, modbusFuncCodeWriteFileRecord) && entry.RegisterCount() > modbusMaxWriteFileRegisters {
+			return fmt.Errorf("%s occupies %d registers, more than can be written in one request", entry.RegisterName, entry.RegisterCount())
+		}
+	}
+	return nil
+}
+
+// orderRegisters applies the entry's byte and word swap settings, converting between
+// the device's ordering and big-endian. The operation is its own inverse.
+func orderRegisters(entry common.ModbusEntry, b []byte) []byte {
+	if entry.WordSwap {
+		b = SwapWords(b)
+	}
+	if entry.ByteSwap {
+		b = SwapBytes(b)
+	}
+	return b
+}
+
+// DecodeRegisters converts the raw bytes of the entry's registers into a value typed
+// according to the entry's data type
+func DecodeRegisters(entry common.ModbusEntry, b []byte) (interface{}, error) {
+	if len(b) < 2*entry.RegisterCount() {
+		return nil, fmt.Errorf("%s expects %d registers, got %d bytes", entry.RegisterName, entry.RegisterCount(), len(b))
+	}
+	b = orderRegisters(entry, b[:2*entry.RegisterCount()])
+	switch entry.DataType {
+	case "", common.DataTypeInt16:
+		return BytesToInt16(b), nil
+	case common.DataTypeUint16:
+		return BytesToUint16(b), nil
+	case common.DataTypeInt32:
+		return BytesToInt32(b), nil
+	case common.DataTypeUint32:
+		return BytesToUint32(b), nil
+	case common.DataTypeFloat32:
+		return BytesToFloat32(b), nil
+	case common.DataTypeFloat64:
+		return BytesToFloat64(b), nil
+	case common.DataTypeString:
+		return BytesToString(b), nil
+	case common.DataTypeBit:
+		return RegisterBitAt(b, entry.BitIndex), nil
+	case common.DataTypeBits:
+		return BytesToBits(b), nil
+	}
+	return nil, fmt.Errorf("%s has unknown data type %s", entry.RegisterName, entry.DataType)
+}
+
+// EncodeRegisters converts a value into the raw bytes of the entry's registers, the inverse
+// of DecodeRegisters. Numeric values of any Go numeric type (such as the float64 produced by
+// encoding/json) are accepted provided they fit the entry's data type. A single bit cannot
+// be encoded without the register's other bits, so the bit data type is rejected.
+func EncodeRegisters(entry common.ModbusEntry, value interface{}) ([]byte, error) {
+	var b []byte
+	switch entry.DataType {
+	case common.DataTypeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string value, got %T", entry.RegisterName, value)
+		}
+		b = StringToBytes(s, entry.RegisterCount())
+	case common.DataTypeBits:
+		bits, ok := value.([]bool)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a []bool value, got %T", entry.RegisterName, value)
+		}
+		b = make([]byte, 2*entry.RegisterCount())
+		copy(b, BitsToBytes(bits))
+	case common.DataTypeBit:
+		return nil, fmt.Errorf("%s is a single bit and cannot be written as a register", entry.RegisterName)
+	default:
+		f, err := toFloat64(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", entry.RegisterName, err)
+		}
+		if b, err = encodeNumber(entry, f); err != nil {
+			return nil, err
+		}
+	}
+	return orderRegisters(entry, b), nil
+}
+
+// EncodeValue converts a value in engineering units into the raw bytes of the entry's
+// registers, reversing the entry's scaling
+func EncodeValue(entry common.ModbusEntry, value interface{}) ([]byte, error) {
+	return EncodeRegisters(entry, rawValue(entry, value))
+}
+
+// DecodeValue converts the raw bytes of the entry's registers into a value in engineering
+// units, applying the entry's scaling
+func DecodeValue(entry common.ModbusEntry, b []byte) (interface{}, error) {
+	decoded, err := DecodeRegisters(entry, b)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err := toFloat64(decoded); err == nil && entry.IsScaled() {
+		return entry.Apply(raw), nil
+	}
+	return decoded, nil
+}
+
+func encodeNumber(entry common.ModbusEntry, f float64) ([]byte, error) {
+	inRange := func(min, max float64) error {
+		if f != math.Trunc(f) || f < min || f > max {
+			return fmt.Errorf("%s value %v does not fit data type %s", entry.RegisterName, f, entry.DataType)
+		}
+		return nil
+	}
+	switch entry.DataType {
+	case "", common.DataTypeInt16:
+		if err := inRange(math.MinInt16, math.MaxInt16); err != nil {
+			return nil, err
+		}
+		return Int16ToBytes(int16(f)), nil
+	case common.DataTypeUint16:
+		if err := inRange(0, math.MaxUint16); err != nil {
+			return nil, err
+		}
+		return Uint16ToBytes(uint16(f)), nil
+	case common.DataTypeInt32:
+		if err := inRange(math.MinInt32, math.MaxInt32); err != nil {
+			return nil, err
+		}
+		return Int32ToBytes(int32(f)), nil
+	case common.DataTypeUint32:
+		if err := inRange(0, math.MaxUint32); err != nil {
+			return nil, err
+		}
+		return Uint32ToBytes(uint32(f)), nil
+	case common.DataTypeFloat32:
+		return Float32ToBytes(float32(f)), nil
+	case common.DataTypeFloat64:
+		return Float64ToBytes(f), nil
+	}
+	return nil, fmt.Errorf("%s has unknown data type %s", entry.RegisterName, entry.DataType)
+}
+
+// toFloat64 converts any Go numeric (or boolean) value to a float64
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("expects a numeric value, got %T", value)
+}
@@ -0,0 +1,146 @@
+package fieldbus
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodingHelpers(t *testing.T) {
+	assert.Equal(t, uint16(0xBEEF), BytesToUint16(Uint16ToBytes(0xBEEF)))
+	assert.Equal(t, int16(-2), BytesToInt16(Int16ToBytes(-2)))
+	assert.Equal(t, uint32(0xDEADBEEF), BytesToUint32(Uint32ToBytes(0xDEADBEEF)))
+	assert.Equal(t, int32(-70000), BytesToInt32(Int32ToBytes(-70000)))
+	assert.Equal(t, float32(21.5), BytesToFloat32(Float32ToBytes(21.5)))
+	assert.Equal(t, []byte{0x41, 0xAC, 0x00, 0x00}, Float32ToBytes(21.5))
+	assert.Equal(t, -1234.5678, BytesToFloat64(Float64ToBytes(-1234.5678)))
+	assert.Equal(t, "PUMP-7", BytesToString(StringToBytes("PUMP-7", 4)))
+	assert.Equal(t, []byte{'A', 'B', 'C', 0}, StringToBytes("ABC", 2))
+	assert.Equal(t, []byte{'A', 'B'}, StringToBytes("ABC", 1))
+
+	bits := make([]bool, 16)
+	bits[0], bits[9] = true, true
+	assert.Equal(t, []byte{0x02, 0x01}, BitsToBytes(bits))
+	assert.Equal(t, bits, BytesToBits(BitsToBytes(bits)))
+	assert.True(t, RegisterBitAt([]byte{0x02, 0x01}, 9))
+	assert.False(t, RegisterBitAt([]byte{0x02, 0x01}, 8))
+
+	assert.Equal(t, []byte{2, 1, 4, 3}, SwapBytes([]byte{1, 2, 3, 4}))
+	assert.Equal(t, []byte{3, 4, 1, 2}, SwapWords([]byte{1, 2, 3, 4}))
+	assert.Equal(t, []byte{7, 8, 5, 6, 3, 4, 1, 2}, SwapWords([]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+}
+
+func TestDecodeRegisters(t *testing.T) {
+	tests := []struct {
+		entry    common.ModbusEntry
+		raw      []byte
+		expected interface{}
+	}{
+		{common.ModbusEntry{}, []byte{0xFF, 0xF6}, int16(-10)},
+		{common.ModbusEntry{DataType: common.DataTypeUint16}, []byte{0xFF, 0xF6}, uint16(65526)},
+		{common.ModbusEntry{DataType: common.DataTypeInt32}, []byte{0xFF, 0xFE, 0xEE, 0x90}, int32(-70000)},
+		{common.ModbusEntry{DataType: common.DataTypeUint32, WordSwap: true}, []byte{0xBE, 0xEF, 0xDE, 0xAD}, uint32(0xDEADBEEF)},
+		{common.ModbusEntry{DataType: common.DataTypeFloat32}, []byte{0x41, 0xAC, 0x00, 0x00}, float32(21.5)},
+		{common.ModbusEntry{DataType: common.DataTypeFloat32, WordSwap: true}, []byte{0x00, 0x00, 0x41, 0xAC}, float32(21.5)},
+		{common.ModbusEntry{DataType: common.DataTypeFloat32, ByteSwap: true}, []byte{0xAC, 0x41, 0x00, 0x00}, float32(21.5)},
+		{common.ModbusEntry{DataType: common.DataTypeFloat32, ByteSwap: true, WordSwap: true}, []byte{0x00, 0x00, 0xAC, 0x41}, float32(21.5)},
+		{common.ModbusEntry{DataType: common.DataTypeFloat64}, Float64ToBytes(3.25), 3.25},
+		{common.ModbusEntry{DataType: common.DataTypeString, Count: 3}, []byte("AB12\x00\x00"), "AB12"},
+		{common.ModbusEntry{DataType: common.DataTypeString, Count: 2, ByteSwap: true}, []byte("BA21"), "AB12"},
+		{common.ModbusEntry{DataType: common.DataTypeBit, BitIndex: 3}, []byte{0x00, 0x08}, true},
+		{common.ModbusEntry{DataType: common.DataTypeBit, BitIndex: 4}, []byte{0x00, 0x08}, false},
+		{common.ModbusEntry{DataType: common.DataTypeBit, BitIndex: 17, Count: 2}, []byte{0, 0, 0, 0x02}, true},
+	}
+	for _, test := range tests {
+		value, err := DecodeRegisters(test.entry, test.raw)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, value, "decoding "+test.entry.DataType)
+		if test.entry.DataType == common.DataTypeBit {
+			continue
+		}
+		encoded, err := EncodeRegisters(test.entry, value)
+		assert.Nil(t, err)
+		decoded, _ := DecodeRegisters(test.entry, encoded)
+		assert.Equal(t, test.expected, decoded, "round trip of "+test.entry.DataType)
+	}
+}
+
+func TestEncodeRegistersRejectsInvalidValues(t *testing.T) {
+	_, err := EncodeRegisters(common.ModbusEntry{}, 40000.0)
+	assert.NotNil(t, err, "expected int16 overflow to be rejected")
+	_, err = EncodeRegisters(common.ModbusEntry{DataType: common.DataTypeUint16}, -1)
+	assert.NotNil(t, err, "expected negative uint16 to be rejected")
+	_, err = EncodeRegisters(common.ModbusEntry{DataType: common.DataTypeInt32}, 1.5)
+	assert.NotNil(t, err, "expected fractional int32 to be rejected")
+	_, err = EncodeRegisters(common.ModbusEntry{DataType: common.DataTypeString}, 12)
+	assert.NotNil(t, err, "expected non-string value to be rejected")
+	_, err = EncodeRegisters(common.ModbusEntry{DataType: common.DataTypeBit}, true)
+	assert.NotNil(t, err, "expected single bit to be rejected")
+	b, err := EncodeRegisters(common.ModbusEntry{DataType: common.DataTypeInt32, WordSwap: true}, float64(-70000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xEE, 0x90, 0xFF, 0xFE}, b)
+}
+
+func TestValidateModbusEntry(t *testing.T) {
+	assert.Nil(t, validateModbusEntry(common.ModbusEntry{}))
+	assert.Nil(t, validateModbusEntry(common.ModbusEntry{DataType: common.DataTypeFloat64}))
+	assert.NotNil(t, validateModbusEntry(common.ModbusEntry{DataType: "decimal"}))
+	assert.NotNil(t, validateModbusEntry(common.ModbusEntry{DataType: common.DataTypeFloat32, Count: 1}))
+	assert.NotNil(t, validateModbusEntry(common.ModbusEntry{DataType: common.DataTypeBit, BitIndex: 16}))
+	assert.NotNil(t, validateModbusEntry(common.ModbusEntry{DataType: common.DataTypeString, Count: 126}))
+}
+
+const typedEquipmentFixture = `{
+  "ref": "typed",
+  "machineIntegration": {
+    "modbus": [
+      {"registerName": "Speed", "functions": [3], "address": 0, "dataType": "float32"},
+      {"registerName": "Counter", "functions": [3], "address": 2, "dataType": "uint32", "wordSwap": true},
+      {"registerName": "Recipe", "functions": [3], "address": 4, "dataType": "string", "count": 2},
+      {"registerName": "Faulted", "functions": [3], "address": 6, "dataType": "bit", "bitIndex": 2},
+      {"registerName": "Setpoint", "functions": [3], "address": 7, "dataType": "uint16"}
+    ]
+  }
+}`
+
+func TestReadTypedRegisters(t *testing.T) {
+	common.EquipmentConfig = common.Equipment{}
+	err := json.Unmarshal([]byte(typedEquipmentFixture), &common.EquipmentConfig)
+	assert.Nil(t, err, "unmarshall failed")
+
+	slave := newStandinSlave(1)
+	copy(slave.holdingRegisters, []uint16{0x41AC, 0x0000, 0x0002, 0x0001, 0x4142, 0x4300, 0x0004, 0xFFFF})
+	svc := &GenericModbusService{client: modbusClient(slave)}
+	svc.machineIntegrations = common.EquipmentConfig.MachineIntegrations.ModbusEntries
+	assert.Nil(t, svc.initBusIntegration())
+
+	m := make(common.OpsReport)
+	assert.Nil(t, svc.readTags(m, modbus.FuncCodeReadHoldingRegisters, svc.machineIntegrations))
+	assert.Equal(t, float32(21.5), m["Speed"].Value)
+	assert.Equal(t, uint32(0x00010002), m["Counter"].Value)
+	assert.Equal(t, "ABC", m["Recipe"].Value)
+	assert.Equal(t, true, m["Faulted"].Value)
+	assert.Equal(t, uint16(65535), m["Setpoint"].Value)
+	assert.Equal(t, 1, slave.Requests(), "expected typed registers to be read in one request")
+}
+
+func TestTagValueScaling(t *testing.T) {
+	entry := common.ModbusEntry{RegisterName: "LiquidTemp"}
+	assert.Equal(t, common.TagValue{Value: int16(615), Quality: define.QualityGood}, tagValue(entry, int16(615)), "expected unscaled raw value")
+
+	entry.Multiplier = 0.1
+	entry.Offset = -40
+	entry.Unit = "°C"
+	value := tagValue(entry, int16(615))
+	assert.Equal(t, "°C", value.Unit)
+	assert.InDelta(t, 21.5, value.Value, 1e-9)
+
+	entry = common.ModbusEntry{RegisterName: "Recipe", DataType: common.DataTypeString}
+	entry.Multiplier = 2
+	assert.Equal(t, "ABC", tagValue(entry, "ABC").Value, "expected strings to pass through unscaled")
+}
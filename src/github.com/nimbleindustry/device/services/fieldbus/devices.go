@@ -0,0 +1,22 @@
+package fieldbus
+
+import (
+	"sort"
+
+	"github.com/nimbleindustry/device/common"
+)
+
+// entriesByUnit splits the passed entries by the unit ID they are read from, returning the
+// unit IDs in ascending order
+func entriesByUnit(entries []common.ModbusEntry) ([]int, map[int][]common.ModbusEntry) {
+	byUnit := make(map[int][]common.ModbusEntry)
+	var units []int
+	for _, v := range entries {
+		if _, found := byUnit[v.UnitID]; !found {
+			units = append(units, v.UnitID)
+		}
+		byUnit[v.UnitID] = append(byUnit[v.UnitID], v)
+	}
+	sort.Ints(units)
+	return units, byUnit
+}
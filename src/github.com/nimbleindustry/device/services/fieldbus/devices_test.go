@@ -0,0 +1,79 @@
+package fieldbus
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gatewayEquipmentFixture = `{
+  "modbusDevices": [
+    {"name": "drive1", "unitId": 2, "tagGroup": "drive"},
+    {"name": "drive2", "unitId": 3, "tagGroup": "drive"}
+  ],
+  "modbus": [
+    {"registerName": "Speed", "functions": [3, 6], "address": 0, "tagGroup": "drive"},
+    {"registerName": "Current", "functions": [4], "address": 1, "tagGroup": "drive", "multiplier": 0.1, "unit": "A"},
+    {"registerName": "LiquidTemp", "functions": [4], "address": 0}
+  ]
+}`
+
+func TestGatewayFanOut(t *testing.T) {
+	plc, drive1, drive2 := newStandinSlave(1), newStandinSlave(2), newStandinSlave(3)
+	plc.inputRegisters[0] = 215
+	drive1.holdingRegisters[0] = 1450
+	drive1.inputRegisters[1] = 52
+	drive2.holdingRegisters[0] = 900
+	drive2.inputRegisters[1] = 31
+	server, err := listenStandin(plc, drive1, drive2)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	var integration common.MachineIntegration
+	assert.Nil(t, json.Unmarshal([]byte(gatewayEquipmentFixture), &integration), "unmarshall failed")
+	svc.machineIntegrations = integration.ModbusEntries
+	svc.devices = integration.ModbusDevices
+	assert.Nil(t, svc.initBusIntegration())
+
+	assert.Nil(t, svc.connect())
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, int16(215), m["LiquidTemp"].Value)
+	assert.Equal(t, int16(1450), m["drive1.Speed"].Value)
+	assert.InDelta(t, 5.2, m["drive1.Current"].Value, 1e-9)
+	assert.Equal(t, int16(900), m["drive2.Speed"].Value)
+	assert.InDelta(t, 3.1, m["drive2.Current"].Value, 1e-9)
+	assert.Equal(t, 1, waitForAccepts(server, 1), "expected every unit to share one connection")
+
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "drive2.Speed", Value: 1200}).Error)
+	assert.Equal(t, uint16(1200), drive2.holdingRegisters[0])
+	assert.Equal(t, uint16(1450), drive1.holdingRegisters[0], "expected write to reach only its unit")
+}
+
+func TestGatewayUnitWithoutResponse(t *testing.T) {
+	server, err := listenStandin(newStandinSlave(1), newStandinSlave(2))
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	var integration common.MachineIntegration
+	assert.Nil(t, json.Unmarshal([]byte(gatewayEquipmentFixture), &integration), "unmarshall failed")
+	svc.machineIntegrations = integration.ModbusEntries
+	svc.devices = integration.ModbusDevices
+	assert.Nil(t, svc.initBusIntegration())
+
+	assert.Nil(t, svc.connect())
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err, "expected a silent unit not to fail the poll")
+	assert.Equal(t, define.QualityGood, m["drive1.Speed"].Quality)
+	assert.Equal(t, define.QualityBad, m["drive2.Speed"].Quality)
+	assert.Contains(t, m["drive2.Speed"].Error, "of unit 3")
+	assert.True(t, svc.transport.connected(), "expected connection to the gateway to remain open")
+}
@@ -0,0 +1,124 @@
+package fieldbus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+)
+
+// fieldbusMonitor counts the requests made over a fieldbus connection and publishes the
+// connection's diagnostics and state, for the services embedding it
+type fieldbusMonitor struct {
+	backoff     reconnectBackoff
+	diagnostics common.FieldbusDiagnostics // counted since the service was created
+	connected   bool                       // a connection was established, later ones being reconnects
+}
+
+// request performs a single modbus request on behalf of the passed entries, counting the
+// request, its latency and its outcome against the connection and each entry's tag
+func (svc *GenericModbusService) request(entries []common.ModbusEntry, send func() error) error {
+	start := time.Now()
+	err := send()
+	svc.diagnostics.Latency.Add(time.Since(start))
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	for _, v := range entries {
+		svc.count(v.RegisterName, err)
+	}
+	return err
+}
+
+// count counts a request made on behalf of the named tag
+func (m *fieldbusMonitor) count(tagName string, err error) {
+	if m.diagnostics.Tags == nil {
+		m.diagnostics.Tags = make(map[string]*common.FieldbusCounters)
+	}
+	tag := m.diagnostics.Tags[tagName]
+	if tag == nil {
+		tag = &common.FieldbusCounters{}
+		m.diagnostics.Tags[tagName] = tag
+	}
+	countOutcome(tag, err)
+}
+
+// exceptionError is the error of a response by which the device rejected a request, such as a
+// CIP status or an S7 return code. Its exception code keys the count of such responses.
+type exceptionError interface {
+	error
+	ExceptionCode() int
+}
+
+// countOutcome counts a request, and its response or failure
+func countOutcome(c *common.FieldbusCounters, err error) {
+	c.Requests++
+	switch e := err.(type) {
+	case nil:
+		c.Responses++
+	case *modbus.ModbusError:
+		c.Responses++
+		if c.Exceptions == nil {
+			c.Exceptions = make(map[int]int)
+		}
+		c.Exceptions[int(e.ExceptionCode)]++
+	case exceptionError:
+		c.Responses++
+		if c.Exceptions == nil {
+			c.Exceptions = make(map[int]int)
+		}
+		c.Exceptions[e.ExceptionCode()]++
+	case *checksumError:
+		c.CRCErrors++
+	default:
+		switch {
+		case isTimeout(err):
+			c.Timeouts++
+		default:
+			c.Errors++
+		}
+	}
+}
+
+// checksumError is a response frame failing its CRC check, or a serial record failing its
+// checksum
+type checksumError struct {
+	what     string // that failed the check, e.g. response crc
+	received string
+	expected string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%s %s, expected %s", e.what, e.received, e.expected)
+}
+
+// countConnect counts the establishment of the connection, those after the first being
+// reconnects
+func (m *fieldbusMonitor) countConnect() {
+	if m.connected {
+		m.diagnostics.Reconnects++
+	}
+	m.connected = true
+}
+
+// publishDiagnostics sends a copy of the diagnostics counted so far on TopicDiagnostics
+func (m *fieldbusMonitor) publishDiagnostics(name string, endpoint string) {
+	m.diagnostics.Timestamp = time.Now()
+	m.diagnostics.Service = name
+	m.diagnostics.Endpoint = endpoint
+	common.SendBusMessage(define.TopicDiagnostics, m.diagnostics.Copy())
+}
+
+// publishState sends the connection's state on TopicConnectionState
+func (m *fieldbusMonitor) publishState(name string, endpoint string, state string, err error) {
+	status := &common.ConnectionStatus{Timestamp: time.Now(), Service: name, Endpoint: endpoint,
+		State: state, Failures: m.backoff.failures}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if state == define.ConnectionDisconnected && m.backoff.failures > 0 {
+		status.RetryIn = m.backoff.next.Sub(status.Timestamp)
+	}
+	common.SendBusMessage(define.TopicConnectionState, status)
+}
@@ -0,0 +1,70 @@
+package fieldbus
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/s7"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnosticsCounters(t *testing.T) {
+	slave := newStandinSlave(1)
+	svc := newStandinService(slave)
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "Speed", Functions: []int{3, 6}, Address: 1},
+		{RegisterName: "Missing", Functions: []int{3}, Address: 100},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+	_, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Speed", Value: 5}).Error)
+
+	d := svc.diagnostics
+	assert.Equal(t, 3, d.Requests)
+	assert.Equal(t, 3, d.Responses)
+	assert.Equal(t, map[int]int{modbus.ExceptionCodeIllegalDataAddress: 1}, d.Exceptions)
+	assert.Equal(t, 3, d.Latency.Counts[0])
+	assert.Equal(t, 2, d.Tags["Speed"].Requests, "expected the tag's read and write to be counted")
+	assert.Equal(t, 0, len(d.Tags["Speed"].Exceptions))
+	assert.Equal(t, 1, d.Tags["Missing"].Exceptions[modbus.ExceptionCodeIllegalDataAddress])
+
+	// the subscription holds the diagnostics until they are received
+	messages := common.BufferedBusChannel(define.TopicDiagnostics, 1)
+	svc.countConnect()
+	svc.countConnect()
+	svc.publishDiagnostics("plc", "10.0.0.5:502")
+	var published *common.FieldbusDiagnostics
+	select {
+	case msg := <-messages:
+		published = msg.(*common.FieldbusDiagnostics)
+	case <-time.After(time.Second):
+		t.Fatal("expected diagnostics to be published")
+	}
+	assert.Equal(t, "plc", published.Service)
+	assert.Equal(t, 1, published.Reconnects)
+	assert.Equal(t, 3, published.Requests)
+}
+
+func TestCountOutcome(t *testing.T) {
+	var c common.FieldbusCounters
+	countOutcome(&c, &net.OpError{Op: "read", Err: timeoutError{}})
+	_, err := rtuPackager{modbus.NewRTUClientHandler("")}.Decode([]byte{0x01, 0x03, 0x02, 0x00, 0x07, 0xF9, 0x87})
+	countOutcome(&c, err)
+	countOutcome(&c, errors.New("EOF"))
+	countOutcome(&c, &s7.JobError{Class: 0x85, Code: 0x01})
+	assert.Equal(t, common.FieldbusCounters{Requests: 4, Responses: 1, Timeouts: 1, CRCErrors: 1, Errors: 1,
+		Exceptions: map[int]int{0x8501: 1}}, c)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,222 @@
+package enip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CIP services
+const (
+	serviceMultiple          = 0x0A
+	serviceReadTag           = 0x4C
+	serviceWriteTag          = 0x4D
+	serviceReadTagFragmented = 0x52
+	serviceUnconnectedSend   = 0x52 // of the connection manager
+	replyFlag                = 0x80
+)
+
+// CIP general status codes
+const (
+	StatusSuccess              = 0x00
+	StatusConnectionFailure    = 0x01
+	StatusPathSegmentError     = 0x04
+	StatusPathUnknown          = 0x05
+	StatusPartialTransfer      = 0x06
+	StatusServiceNotSupported  = 0x08
+	StatusReplyTooLarge        = 0x11
+	StatusNotEnoughData        = 0x13
+	StatusTooMuchData          = 0x15
+	StatusEmbeddedServiceError = 0x1E
+	StatusPathSizeInvalid      = 0x26
+	StatusGeneralError         = 0xFF
+)
+
+// Extended status of the Logix tag services, following StatusGeneralError
+const (
+	ExtendedBeyondEnd    = 0x2105
+	ExtendedTypeMismatch = 0x2107
+)
+
+// Classes addressed by logical segments
+const (
+	classMessageRouter     = 0x02
+	classConnectionManager = 0x06
+)
+
+// maxMessageSize is the largest unconnected message, request or reply, sent or expected
+const maxMessageSize = 504
+
+var statusText = map[byte]string{
+	0x01: "connection failure",
+	0x02: "resource unavailable",
+	0x03: "invalid parameter value",
+	0x04: "path segment error",
+	0x05: "path destination unknown",
+	0x06: "partial transfer",
+	0x08: "service not supported",
+	0x09: "invalid attribute value",
+	0x0C: "object state conflict",
+	0x0F: "privilege violation",
+	0x10: "device state conflict",
+	0x11: "reply data too large",
+	0x13: "not enough data",
+	0x15: "too much data",
+	0x1E: "embedded service error",
+	0x1F: "vendor specific error",
+	0x20: "invalid parameter",
+	0x26: "invalid path size",
+	0xFF: "general error",
+}
+
+var extendedText = map[uint16]string{
+	0x0204: "unconnected send timed out",
+	0x0311: "port not available",
+	0x0312: "link address not valid",
+	0x0315: "invalid segment in connection path",
+	0x2104: "offset out of range",
+	0x2105: "access beyond end of object",
+	0x2107: "data type mismatch",
+}
+
+// StatusError is a CIP reply whose general status is not success, such as that to a request
+// naming a tag the controller does not have
+type StatusError struct {
+	Status   byte
+	Extended []uint16
+}
+
+func (e *StatusError) Error() string {
+	text, found := statusText[e.Status]
+	if !found {
+		text = "unknown"
+	}
+	s := fmt.Sprintf("CIP status 0x%02X (%s)", e.Status, text)
+	for _, v := range e.Extended {
+		if text, found = extendedText[v]; found {
+			s += fmt.Sprintf(", extended 0x%04X (%s)", v, text)
+		} else {
+			s += fmt.Sprintf(", extended 0x%04X", v)
+		}
+	}
+	return s
+}
+
+// ExceptionCode returns the general status, by which fieldbus diagnostics count the reply
+func (e *StatusError) ExceptionCode() int {
+	return int(e.Status)
+}
+
+// reply is a decoded CIP reply
+type reply struct {
+	service  byte
+	status   byte
+	extended []uint16
+	data     []byte
+}
+
+// err returns the reply's status as an error, nil if the service succeeded
+func (r reply) err() error {
+	if r.status == StatusSuccess {
+		return nil
+	}
+	return &StatusError{Status: r.status, Extended: r.extended}
+}
+
+// encodeRequest returns a CIP request of the passed service to the object of the passed path
+func encodeRequest(service byte, path []byte, data []byte) []byte {
+	b := make([]byte, 0, 2+len(path)+len(data))
+	b = append(b, service, byte(len(path)/2))
+	b = append(b, path...)
+	return append(b, data...)
+}
+
+// decodeRequest returns the service, path and data of a CIP request
+func decodeRequest(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 || len(b) < 2+2*int(b[1]) {
+		return 0, nil, nil, errors.New("CIP request truncated")
+	}
+	end := 2 + 2*int(b[1])
+	return b[0], b[2:end], b[end:], nil
+}
+
+// encodeReply returns a CIP reply to the passed service
+func encodeReply(service byte, status byte, extended []uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+2*len(extended)+len(data))
+	b[0], b[2], b[3] = service|replyFlag, status, byte(len(extended))
+	for _, v := range extended {
+		b = append(b, byte(v), byte(v>>8))
+	}
+	return append(b, data...)
+}
+
+// decodeReply decodes a CIP reply
+func decodeReply(b []byte) (reply, error) {
+	if len(b) < 4 || len(b) < 4+2*int(b[3]) {
+		return reply{}, errors.New("CIP reply truncated")
+	}
+	r := reply{service: b[0], status: b[2]}
+	for i := 0; i < int(b[3]); i++ {
+		r.extended = append(r.extended, binary.LittleEndian.Uint16(b[4+2*i:]))
+	}
+	r.data = b[4+2*int(b[3]):]
+	return r, nil
+}
+
+// logicalPath returns the path of an instance of a class
+func logicalPath(class byte, instance byte) []byte {
+	return []byte{0x20, class, 0x24, instance}
+}
+
+// unconnectedSend returns the request of the connection manager that routes the passed message
+// through the backplane port to the controller in the passed slot
+func unconnectedSend(message []byte, slot byte) []byte {
+	// a time tick of 1024ms and 5 ticks to complete
+	data := []byte{0x0A, 0x05, byte(len(message)), byte(len(message) >> 8)}
+	data = append(data, message...)
+	if len(message)%2 == 1 {
+		data = append(data, 0)
+	}
+	data = append(data, 1, 0, 0x01, slot)
+	return encodeRequest(serviceUnconnectedSend, logicalPath(classConnectionManager, 1), data)
+}
+
+// encodeMultiple returns a Multiple Service Packet request of the message router carrying
+// the passed requests
+func encodeMultiple(requests [][]byte) []byte {
+	offset := 2 + 2*len(requests)
+	data := make([]byte, offset)
+	binary.LittleEndian.PutUint16(data, uint16(len(requests)))
+	for i, v := range requests {
+		binary.LittleEndian.PutUint16(data[2+2*i:], uint16(offset))
+		offset += len(v)
+	}
+	for _, v := range requests {
+		data = append(data, v...)
+	}
+	return encodeRequest(serviceMultiple, logicalPath(classMessageRouter, 1), data)
+}
+
+// splitMultiple returns the messages, requests or replies, of the data of a Multiple Service
+// Packet
+func splitMultiple(data []byte) ([][]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("multiple service packet truncated")
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+2*count {
+		return nil, errors.New("multiple service packet truncated")
+	}
+	messages := make([][]byte, count)
+	for i := range messages {
+		start, end := int(binary.LittleEndian.Uint16(data[2+2*i:])), len(data)
+		if i+1 < count {
+			end = int(binary.LittleEndian.Uint16(data[4+2*i:]))
+		}
+		if start < 2+2*count || end < start || end > len(data) {
+			return nil, errors.New("multiple service packet has invalid offsets")
+		}
+		messages[i] = data[start:end]
+	}
+	return messages, nil
+}
@@ -0,0 +1,306 @@
+package enip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// the bytes a Multiple Service Packet adds to a request or reply, less those of each offset
+	multipleOverhead = 8
+	// the reply size assumed for each element of a tag not yet read, when packing requests
+	estimatedElementSize = 4
+)
+
+// ErrClosed is returned by the requests of a client that has been closed
+var ErrClosed = errors.New("client closed")
+
+// ClientConfig configures a client's session
+type ClientConfig struct {
+	Timeout time.Duration // of connecting and of each request, 10 seconds if zero
+	Slot    int           // the chassis slot of the controller, reached through the backplane
+}
+
+// ReadRequest requests the value of a tag or, if Elements is greater than one, the values of
+// that many consecutive elements of an array starting with the element the tag selects
+type ReadRequest struct {
+	Tag      Tag
+	Elements int
+}
+
+// ReadResult is the outcome of a read request: the type and values of the elements read, or
+// the error (typically a *StatusError) that prevented them being read
+type ReadResult struct {
+	Type   DataType
+	Values []interface{}
+	Err    error
+}
+
+// Client is a session with a Logix controller, over which tags are read and written by
+// unconnected messages routed through the backplane to the controller's slot. A client is
+// not safe for concurrent use. Should the connection fail every later request returns the
+// error that failed it.
+type Client struct {
+	conn    net.Conn
+	config  ClientConfig
+	session uint32
+	context uint64
+	err     error
+	sizes   map[string]int // the size of the reply to the last read of each tag, for packing
+}
+
+// Dial connects to the EtherNet/IP adapter at the passed address (host:port) and registers a
+// session
+func Dial(address string, config ClientConfig) (*Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Slot < 0 || config.Slot > 0xFF {
+		return nil, fmt.Errorf("invalid slot %d", config.Slot)
+	}
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, config: config, sizes: make(map[string]int)}
+	h, _, err := c.exchange(header{Command: commandRegisterSession}, []byte{protocolVersion, 0, 0, 0})
+	if err != nil {
+		return nil, fmt.Errorf("unable to register session, %s", err)
+	}
+	c.session = h.Session
+	return c, nil
+}
+
+// Err returns the error that failed the connection, nil while it is open
+func (c *Client) Err() error {
+	if c.err == ErrClosed {
+		return nil
+	}
+	return c.err
+}
+
+// Close unregisters the session and closes the connection
+func (c *Client) Close() error {
+	if c.err != nil {
+		return nil
+	}
+	c.err = ErrClosed
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	c.conn.Write(encodePacket(header{Command: commandUnregisterSession, Session: c.session}, nil))
+	return c.conn.Close()
+}
+
+// Read reads the passed tags, packing as many requests into each Multiple Service Packet as
+// will fit an unconnected message and completing replies too large for a message with
+// fragmented reads. A result is returned for every request; an error is returned only if
+// communication with the controller failed.
+func (c *Client) Read(requests []ReadRequest) ([]ReadResult, error) {
+	messages := make([][]byte, len(requests))
+	for i, v := range requests {
+		messages[i] = encodeRequest(serviceReadTag, v.Tag.path, elementCount(v.Elements))
+	}
+	results := make([]ReadResult, len(requests))
+	for start := 0; start < len(requests); {
+		end := start + 1
+		requestSize := multipleOverhead + 2 + len(messages[start])
+		replySize := multipleOverhead + 2 + c.replySize(requests[start])
+		for ; end < len(requests); end++ {
+			requestSize += 2 + len(messages[end])
+			replySize += 2 + c.replySize(requests[end])
+			if requestSize > maxMessageSize || replySize > maxMessageSize {
+				break
+			}
+		}
+		replies, err := c.requestAll(messages[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range replies {
+			if r.status == StatusReplyTooLarge && len(replies) > 1 {
+				// the reply did not fit alongside the others, it is read alone
+				if r, err = c.request(messages[start+i]); err != nil {
+					return nil, err
+				}
+			}
+			if results[start+i], err = c.readResult(requests[start+i], r); err != nil {
+				return nil, err
+			}
+		}
+		start = end
+	}
+	return results, nil
+}
+
+// replySize returns the expected size of the reply to a read request
+func (c *Client) replySize(request ReadRequest) int {
+	if size, found := c.sizes[request.Tag.name]; found {
+		return size
+	}
+	elements := request.Elements
+	if elements < 1 {
+		elements = 1
+	}
+	return 8 + elements*estimatedElementSize
+}
+
+// readResult decodes the reply to a read request, first reading the rest of a partial reply
+func (c *Client) readResult(request ReadRequest, r reply) (ReadResult, error) {
+	if r.status != StatusSuccess && r.status != StatusPartialTransfer {
+		return ReadResult{Err: r.err()}, nil
+	}
+	t, data, err := decodeDataType(r.data)
+	if err != nil {
+		return ReadResult{Err: err}, nil
+	}
+	collected := append([]byte(nil), data...)
+	for r.status == StatusPartialTransfer {
+		offset := make([]byte, 4)
+		binary.LittleEndian.PutUint32(offset, uint32(len(collected)))
+		r, err = c.request(encodeRequest(serviceReadTagFragmented, request.Tag.path,
+			append(elementCount(request.Elements), offset...)))
+		if err != nil {
+			return ReadResult{}, err
+		}
+		if r.status != StatusSuccess && r.status != StatusPartialTransfer {
+			return ReadResult{Err: r.err()}, nil
+		}
+		if _, data, err = decodeDataType(r.data); err != nil {
+			return ReadResult{Err: err}, nil
+		}
+		if len(data) == 0 && r.status == StatusPartialTransfer {
+			return ReadResult{Err: errors.New("fragmented read returned no data")}, nil
+		}
+		collected = append(collected, data...)
+	}
+	c.sizes[request.Tag.name] = 4 + len(t.encode()) + len(collected)
+	elements := request.Elements
+	if elements < 1 {
+		elements = 1
+	}
+	values, err := Decode(t, collected, elements)
+	return ReadResult{Type: t, Values: values, Err: err}, nil
+}
+
+// Write writes the passed values, as the passed type, to a tag or, should there be several,
+// to the consecutive elements of an array starting with the element the tag selects. The
+// type must be that of the tag, as reported when it is read.
+func (c *Client) Write(tag Tag, t DataType, values ...interface{}) error {
+	if len(values) == 0 {
+		return errors.New("no values to write")
+	}
+	data, err := Encode(t, values)
+	if err != nil {
+		return err
+	}
+	data = append(append(t.encode(), elementCount(len(values))...), data...)
+	message := encodeRequest(serviceWriteTag, tag.path, data)
+	if len(message) > maxMessageSize {
+		return fmt.Errorf("write of %d bytes exceeds %d", len(message), maxMessageSize)
+	}
+	r, err := c.request(message)
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+// elementCount returns the element count of the Read Tag and Write Tag services
+func elementCount(elements int) []byte {
+	if elements < 1 {
+		elements = 1
+	}
+	return []byte{byte(elements), byte(elements >> 8)}
+}
+
+// requestAll sends the passed requests, as a Multiple Service Packet if there are several,
+// returning the reply to each
+func (c *Client) requestAll(messages [][]byte) ([]reply, error) {
+	if len(messages) == 1 {
+		r, err := c.request(messages[0])
+		return []reply{r}, err
+	}
+	r, err := c.request(encodeMultiple(messages))
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]reply, len(messages))
+	if r.status != StatusSuccess && r.status != StatusEmbeddedServiceError {
+		// the packet itself failed, and with it every request
+		for i := range replies {
+			replies[i] = r
+		}
+		return replies, nil
+	}
+	embedded, err := splitMultiple(r.data)
+	if err == nil && len(embedded) != len(messages) {
+		err = fmt.Errorf("%d replies to %d requests", len(embedded), len(messages))
+	}
+	for i := 0; err == nil && i < len(embedded); i++ {
+		replies[i], err = decodeReply(embedded[i])
+	}
+	if err != nil {
+		return nil, c.fail(fmt.Errorf("invalid multiple service packet reply, %s", err))
+	}
+	return replies, nil
+}
+
+// request sends a CIP request routed to the controller and returns its reply, whose status
+// may be that of the routing should the controller not have been reached. An error is
+// returned only if communication failed.
+func (c *Client) request(message []byte) (reply, error) {
+	_, data, err := c.exchange(header{Command: commandSendRRData}, encodeRRData(unconnectedSend(message, byte(c.config.Slot))))
+	if err != nil {
+		return reply{}, err
+	}
+	b, err := decodeRRData(data)
+	if err != nil {
+		return reply{}, c.fail(err)
+	}
+	r, err := decodeReply(b)
+	if err != nil {
+		return reply{}, c.fail(err)
+	}
+	if r.service != message[0]|replyFlag && (r.service != serviceUnconnectedSend|replyFlag || r.status == StatusSuccess) {
+		return reply{}, c.fail(fmt.Errorf("reply to service 0x%02X, expected 0x%02X", r.service, message[0]|replyFlag))
+	}
+	return r, nil
+}
+
+// exchange sends an encapsulated command and returns the reply, failing the connection should
+// either not succeed
+func (c *Client) exchange(h header, data []byte) (header, []byte, error) {
+	if c.err != nil {
+		return header{}, nil, c.err
+	}
+	c.context++
+	h.Session, h.Context = c.session, c.context
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if _, err := c.conn.Write(encodePacket(h, data)); err != nil {
+		return header{}, nil, c.fail(err)
+	}
+	r, data, err := readPacket(c.conn)
+	switch {
+	case err != nil:
+	case r.Command != h.Command:
+		err = fmt.Errorf("reply to command 0x%04X, expected 0x%04X", r.Command, h.Command)
+	case r.Context != h.Context:
+		err = fmt.Errorf("reply with context %d, expected %d", r.Context, h.Context)
+	case r.Status != 0:
+		err = encapsulationStatus(r.Status)
+	}
+	if err != nil {
+		return header{}, nil, c.fail(err)
+	}
+	return r, data, nil
+}
+
+// fail closes the connection, following which every request returns the passed error
+func (c *Client) fail(err error) error {
+	c.err = err
+	c.conn.Close()
+	return err
+}
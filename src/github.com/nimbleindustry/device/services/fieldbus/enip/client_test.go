@@ -0,0 +1,108 @@
+package enip
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serverFixture returns the stand-in server listening on a local port
+func serverFixture(t *testing.T) *Server {
+	server, err := ListenStandin("127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	return server
+}
+
+func parseTags(t *testing.T, elements map[string]int, names ...string) []ReadRequest {
+	requests := make([]ReadRequest, len(names))
+	for i, name := range names {
+		tag, err := ParseTag(name)
+		assert.Nil(t, err)
+		requests[i] = ReadRequest{Tag: tag, Elements: elements[name]}
+	}
+	return requests
+}
+
+func TestClientReadsTags(t *testing.T) {
+	server := serverFixture(t)
+	defer server.Close()
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second, Slot: 2})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	requests := parseTags(t, map[string]int{"Temperatures[1]": 3},
+		"Running", "Line_Speed", "Program:Main.Batch", "Motors[1].Rpm", "Temperatures[1]", "Recipe", "Missing")
+	results, err := client.Read(requests)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.Requests(), "expected the reads to share a multiple service packet")
+	assert.Equal(t, []interface{}{true}, results[0].Values)
+	assert.Equal(t, []interface{}{float32(12.5)}, results[1].Values)
+	assert.Equal(t, DataType{Code: TypeREAL}, results[1].Type)
+	assert.Equal(t, []interface{}{int32(-42)}, results[2].Values)
+	assert.Equal(t, []interface{}{int16(1450)}, results[3].Values)
+	assert.Equal(t, []interface{}{int16(210), int16(220), int16(230)}, results[4].Values)
+	assert.Equal(t, []interface{}{"PVC-12"}, results[5].Values)
+	assert.Equal(t, STRING, results[5].Type)
+	assert.Equal(t, &StatusError{Status: StatusPathUnknown}, results[6].Err)
+	for _, v := range results[:6] {
+		assert.Nil(t, v.Err)
+	}
+
+	// an array too large for a message is completed by fragmented reads, and a read beyond
+	// its end fails
+	results, err = client.Read(parseTags(t, map[string]int{"Counts": 300, "Temperatures[2]": 3}, "Counts", "Temperatures[2]"))
+	assert.Nil(t, err)
+	assert.Len(t, results[0].Values, 300)
+	assert.Equal(t, int32(299000), results[0].Values[299])
+	assert.Equal(t, &StatusError{Status: StatusGeneralError, Extended: []uint16{ExtendedBeyondEnd}}, results[1].Err)
+	assert.True(t, strings.Contains(results[1].Err.Error(), "access beyond end of object"), results[1].Err.Error())
+}
+
+func TestClientWritesTags(t *testing.T) {
+	server := serverFixture(t)
+	defer server.Close()
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	tag, _ := ParseTag("Motors[1].Rpm")
+	assert.Nil(t, client.Write(tag, DataType{Code: TypeINT}, float64(1500)))
+	tag, _ = ParseTag("Temperatures[2]")
+	assert.Nil(t, client.Write(tag, DataType{Code: TypeINT}, 1, 2))
+	tag, _ = ParseTag("Recipe")
+	assert.Nil(t, client.Write(tag, STRING, "ABS-7"))
+	values, _ := server.Tag("Motors[1].Rpm")
+	assert.Equal(t, []interface{}{int16(1500)}, values)
+	values, _ = server.Tag("Temperatures")
+	assert.Equal(t, []interface{}{int16(200), int16(210), int16(1), int16(2)}, values)
+	values, _ = server.Tag("Recipe")
+	assert.Equal(t, []interface{}{"ABS-7"}, values)
+
+	// values are checked against the type, which must be that of the tag
+	tag, _ = ParseTag("Line_Speed")
+	assert.Equal(t, &StatusError{Status: StatusGeneralError, Extended: []uint16{ExtendedTypeMismatch}},
+		client.Write(tag, DataType{Code: TypeDINT}, 3))
+	for _, v := range []interface{}{1.5, 40000, "x", true} {
+		assert.NotNil(t, client.Write(tag, DataType{Code: TypeINT}, v), "%v", v)
+	}
+	assert.Nil(t, client.Err())
+}
+
+func TestClientConnectionFailure(t *testing.T) {
+	server := serverFixture(t)
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	server.Close()
+	_, err = client.Read(parseTags(t, nil, "Running"))
+	assert.NotNil(t, err)
+	assert.Equal(t, err, client.Err())
+	_, err = client.Read(parseTags(t, nil, "Running"))
+	assert.Equal(t, client.Err(), err, "expected later requests to fail as the connection did")
+
+	_, err = Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.NotNil(t, err)
+}
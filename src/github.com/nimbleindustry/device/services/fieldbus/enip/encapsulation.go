@@ -0,0 +1,135 @@
+// Package enip implements the parts of EtherNet/IP needed to read and write the tags of
+// Allen-Bradley Logix controllers (ControlLogix, CompactLogix): the encapsulation protocol's
+// sessions and unconnected messages, and the CIP symbolic tag services carried by them.
+package enip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultPort is the tcp port of the encapsulation protocol
+const DefaultPort = 44818
+
+// Encapsulation commands
+const (
+	commandRegisterSession   = 0x0065
+	commandUnregisterSession = 0x0066
+	commandSendRRData        = 0x006F
+)
+
+// Common packet format item types
+const (
+	itemNullAddress     = 0x0000
+	itemUnconnectedData = 0x00B2
+)
+
+const (
+	headerSize      = 24
+	protocolVersion = 1
+	maxPacketData   = 65511
+)
+
+// header is the encapsulation header preceding every command and reply
+type header struct {
+	Command uint16
+	Length  uint16
+	Session uint32
+	Status  uint32
+	Context uint64
+	Options uint32
+}
+
+// encodePacket returns the passed command data, preceded by its header
+func encodePacket(h header, data []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(data))
+	binary.LittleEndian.PutUint16(b[0:], h.Command)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(b[4:], h.Session)
+	binary.LittleEndian.PutUint32(b[8:], h.Status)
+	binary.LittleEndian.PutUint64(b[12:], h.Context)
+	binary.LittleEndian.PutUint32(b[20:], h.Options)
+	return append(b, data...)
+}
+
+// readPacket reads a single encapsulation packet, returning its header and command data
+func readPacket(r io.Reader) (header, []byte, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return header{}, nil, err
+	}
+	h := header{
+		Command: binary.LittleEndian.Uint16(b[0:]),
+		Length:  binary.LittleEndian.Uint16(b[2:]),
+		Session: binary.LittleEndian.Uint32(b[4:]),
+		Status:  binary.LittleEndian.Uint32(b[8:]),
+		Context: binary.LittleEndian.Uint64(b[12:]),
+		Options: binary.LittleEndian.Uint32(b[20:]),
+	}
+	if h.Length > maxPacketData {
+		return h, nil, fmt.Errorf("encapsulation length %d exceeds %d", h.Length, maxPacketData)
+	}
+	data := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return h, nil, err
+	}
+	return h, data, nil
+}
+
+// encapsulationStatus describes a non-zero status of an encapsulation reply
+func encapsulationStatus(status uint32) error {
+	var text string
+	switch status {
+	case 0x0001:
+		text = "invalid or unsupported command"
+	case 0x0002:
+		text = "insufficient memory"
+	case 0x0003:
+		text = "incorrect data"
+	case 0x0064:
+		text = "invalid session handle"
+	case 0x0065:
+		text = "invalid length"
+	case 0x0069:
+		text = "unsupported protocol revision"
+	default:
+		text = "unknown"
+	}
+	return fmt.Errorf("encapsulation status 0x%04X (%s)", status, text)
+}
+
+// encodeRRData returns the command data of SendRRData carrying an unconnected message
+func encodeRRData(message []byte) []byte {
+	b := make([]byte, 16, 16+len(message))
+	// interface handle and timeout are zero, items are a null address and the message
+	binary.LittleEndian.PutUint16(b[6:], 2)
+	binary.LittleEndian.PutUint16(b[8:], itemNullAddress)
+	binary.LittleEndian.PutUint16(b[12:], itemUnconnectedData)
+	binary.LittleEndian.PutUint16(b[14:], uint16(len(message)))
+	return append(b, message...)
+}
+
+// decodeRRData returns the unconnected message carried by the command data of SendRRData
+func decodeRRData(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errors.New("SendRRData too short")
+	}
+	count := int(binary.LittleEndian.Uint16(data[6:]))
+	data = data[8:]
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("SendRRData item truncated")
+		}
+		itemType, length := binary.LittleEndian.Uint16(data), int(binary.LittleEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, errors.New("SendRRData item truncated")
+		}
+		if itemType == itemUnconnectedData {
+			return data[4 : 4+length], nil
+		}
+		data = data[4+length:]
+	}
+	return nil, errors.New("SendRRData has no unconnected data item")
+}
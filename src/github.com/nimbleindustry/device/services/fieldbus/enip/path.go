@@ -0,0 +1,187 @@
+package enip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Segments of the symbolic paths of tags
+const (
+	segmentSymbol    = 0x91 // ANSI extended symbol
+	segmentElement8  = 0x28
+	segmentElement16 = 0x29
+	segmentElement32 = 0x2A
+)
+
+const maxSymbolLength = 255
+
+// Tag is the symbolic path of a tag, a member of a structured (UDT) tag or an element of an
+// array tag, as addressed by the tag services
+type Tag struct {
+	name string
+	path []byte
+}
+
+// ParseTag parses a tag name such as "Line_Speed", "Program:MainProgram.Recipe",
+// "Motors[2].Speed" or "Matrix[1,3]". The names of members follow a "."; the indexes of the
+// (up to three) dimensions of an array element are enclosed by "[]". Only the first name may
+// hold a ":", which qualifies program scoped and module defined tags.
+func ParseTag(name string) (Tag, error) {
+	tag := Tag{name: name}
+	if name == "" {
+		return tag, errors.New("tag name is empty")
+	}
+	rest := name
+	for first := true; ; first = false {
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		symbol := rest[:end]
+		if err := validSymbol(symbol, first); err != nil {
+			return tag, fmt.Errorf("tag %s %s", name, err)
+		}
+		tag.path = append(tag.path, segmentSymbol, byte(len(symbol)))
+		tag.path = append(tag.path, symbol...)
+		if len(symbol)%2 == 1 {
+			tag.path = append(tag.path, 0)
+		}
+		rest = rest[end:]
+		if strings.HasPrefix(rest, "[") {
+			closing := strings.IndexByte(rest, ']')
+			if closing < 0 {
+				return tag, fmt.Errorf("tag %s has unterminated index", name)
+			}
+			indexes := strings.Split(rest[1:closing], ",")
+			if len(indexes) > 3 {
+				return tag, fmt.Errorf("tag %s has more than 3 dimensions", name)
+			}
+			for _, v := range indexes {
+				index, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+				if err != nil {
+					return tag, fmt.Errorf("tag %s has invalid index %q", name, v)
+				}
+				tag.path = append(tag.path, elementSegment(uint32(index))...)
+			}
+			rest = rest[closing+1:]
+		}
+		switch {
+		case rest == "":
+			return tag, nil
+		case rest[0] != '.':
+			return tag, fmt.Errorf("tag %s has unexpected %q", name, rest[0])
+		}
+		rest = rest[1:]
+	}
+}
+
+// validSymbol checks the name of a tag or member
+func validSymbol(symbol string, first bool) error {
+	if symbol == "" {
+		return errors.New("has an empty name")
+	}
+	if len(symbol) > maxSymbolLength {
+		return fmt.Errorf("has a name longer than %d characters", maxSymbolLength)
+	}
+	for i, c := range symbol {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9', c == ':' && first:
+			if i == 0 {
+				return fmt.Errorf("has a name starting with %q", c)
+			}
+		default:
+			return fmt.Errorf("has a name containing %q", c)
+		}
+	}
+	return nil
+}
+
+// elementSegment returns the segment selecting an element of an array by its index
+func elementSegment(index uint32) []byte {
+	switch {
+	case index <= 0xFF:
+		return []byte{segmentElement8, byte(index)}
+	case index <= 0xFFFF:
+		return []byte{segmentElement16, 0, byte(index), byte(index >> 8)}
+	}
+	b := []byte{segmentElement32, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[2:], index)
+	return b
+}
+
+// String returns the name of the tag
+func (t Tag) String() string {
+	return t.name
+}
+
+// IsZero returns true if the tag has not been parsed
+func (t Tag) IsZero() bool {
+	return len(t.path) == 0
+}
+
+// decodePath returns the name of the tag a symbolic path selects, less the indexes of any
+// element selected by its final segments, and those indexes
+func decodePath(path []byte) (string, []uint32, error) {
+	var name string
+	var indexes []uint32
+	for len(path) > 0 {
+		if len(path) < 2 {
+			return "", nil, errors.New("path truncated")
+		}
+		switch path[0] {
+		case segmentSymbol:
+			length := int(path[1])
+			size := 2 + length + length%2
+			if len(path) < size || length == 0 {
+				return "", nil, errors.New("symbol segment truncated")
+			}
+			name += formatIndexes(indexes)
+			if name != "" {
+				name += "."
+			}
+			name += string(path[2 : 2+length])
+			indexes = nil
+			path = path[size:]
+		case segmentElement8:
+			indexes = append(indexes, uint32(path[1]))
+			path = path[2:]
+		case segmentElement16:
+			if len(path) < 4 {
+				return "", nil, errors.New("element segment truncated")
+			}
+			indexes = append(indexes, uint32(binary.LittleEndian.Uint16(path[2:])))
+			path = path[4:]
+		case segmentElement32:
+			if len(path) < 6 {
+				return "", nil, errors.New("element segment truncated")
+			}
+			indexes = append(indexes, binary.LittleEndian.Uint32(path[2:]))
+			path = path[6:]
+		default:
+			return "", nil, fmt.Errorf("unsupported segment 0x%02X", path[0])
+		}
+		if name == "" {
+			return "", nil, errors.New("path does not start with a symbol")
+		}
+	}
+	if name == "" {
+		return "", nil, errors.New("path is empty")
+	}
+	return name, indexes, nil
+}
+
+// formatIndexes returns the indexes of an array element as they appear in a tag name
+func formatIndexes(indexes []uint32) string {
+	if len(indexes) == 0 {
+		return ""
+	}
+	s := make([]string, len(indexes))
+	for i, v := range indexes {
+		s[i] = strconv.FormatUint(uint64(v), 10)
+	}
+	return "[" + strings.Join(s, ",") + "]"
+}
@@ -0,0 +1,54 @@
+package enip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTag(t *testing.T) {
+	tag, err := ParseTag("Speed")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x91, 5, 'S', 'p', 'e', 'e', 'd', 0}, tag.path)
+	assert.Equal(t, "Speed", tag.String())
+
+	tag, err = ParseTag("Program:Main.Motors[2].Rpm")
+	assert.Nil(t, err)
+	assert.Equal(t, append(append([]byte{0x91, 12}, "Program:Main"...), append(append([]byte{0x91, 6}, "Motors"...),
+		0x28, 2, 0x91, 3, 'R', 'p', 'm', 0)...), tag.path)
+
+	tag, err = ParseTag("Matrix[1, 300,70000]")
+	assert.Nil(t, err)
+	assert.Equal(t, append(append([]byte{0x91, 6}, "Matrix"...), 0x28, 1, 0x29, 0, 0x2C, 0x01,
+		0x2A, 0, 0x70, 0x11, 0x01, 0x00), tag.path)
+
+	for _, name := range []string{"", "Motors[2", "Motors[a]", "Motors[1,2,3,4]", "Motors.", ".Speed",
+		"2Motors", "Motors.Speed:1", "Motors[1]x", "Mo-tors", "Motors[-1]"} {
+		_, err := ParseTag(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDecodePath(t *testing.T) {
+	for _, v := range []struct {
+		tag     string
+		name    string
+		indexes []uint32
+	}{
+		{"Speed", "Speed", nil},
+		{"Program:Main.Motors[2].Rpm", "Program:Main.Motors[2].Rpm", nil},
+		{"Temperatures[300]", "Temperatures", []uint32{300}},
+		{"Line.Matrix[1,70000]", "Line.Matrix", []uint32{1, 70000}},
+	} {
+		tag, err := ParseTag(v.tag)
+		assert.Nil(t, err)
+		name, indexes, err := decodePath(tag.path)
+		assert.Nil(t, err, v.tag)
+		assert.Equal(t, v.name, name)
+		assert.Equal(t, v.indexes, indexes)
+	}
+	for _, path := range [][]byte{{}, {0x28, 1}, {0x91, 4, 'a'}, {0x20, 0x02}} {
+		_, _, err := decodePath(path)
+		assert.NotNil(t, err, "%v", path)
+	}
+}
@@ -0,0 +1,314 @@
+package enip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Server answers the symbolic tag services of a Logix controller from a table of tags held
+// in memory, standing in for a controller when testing and commissioning integrations.
+// Sessions are registered and unconnected messages answered, whether or not they are routed
+// through the connection manager, including Multiple Service Packets and fragmented reads.
+// The members of structures are tags in their own right, named by their path.
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	tags     map[string]*serverTag
+	conns    map[net.Conn]bool
+	sessions uint32
+	requests int
+	closed   bool
+}
+
+// serverTag is a tag of the server, an array if it has several elements
+type serverTag struct {
+	dataType DataType
+	elements int
+	data     []byte
+}
+
+// Listen returns a server accepting connections on the passed address, e.g. ":44818"
+func Listen(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, tags: make(map[string]*serverTag), conns: make(map[net.Conn]bool)}
+	go s.accept()
+	return s, nil
+}
+
+// ListenStandin returns a server accepting connections on the passed address that holds the
+// tags of a demonstration line: Running (BOOL), Line_Speed (REAL), Program:Main.Batch (DINT),
+// Motors[1].Rpm (INT), Temperatures (4 INTs), Recipe (STRING) and Counts (300 DINTs, too
+// large for a single message)
+func ListenStandin(address string) (*Server, error) {
+	s, err := Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]interface{}, 300)
+	for i := range counts {
+		counts[i] = i * 1000
+	}
+	for _, v := range []struct {
+		name     string
+		dataType DataType
+		values   []interface{}
+	}{
+		{"Running", DataType{Code: TypeBOOL}, []interface{}{true}},
+		{"Line_Speed", DataType{Code: TypeREAL}, []interface{}{12.5}},
+		{"Program:Main.Batch", DataType{Code: TypeDINT}, []interface{}{-42}},
+		{"Motors[1].Rpm", DataType{Code: TypeINT}, []interface{}{1450}},
+		{"Temperatures", DataType{Code: TypeINT}, []interface{}{200, 210, 220, 230}},
+		{"Recipe", STRING, []interface{}{"PVC-12"}},
+		{"Counts", DataType{Code: TypeDINT}, counts},
+	} {
+		if err := s.SetTag(v.name, v.dataType, v.values...); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s %s", v.name, err)
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the address on which the server accepts connections
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// SetTag creates or replaces a tag, an array if it is passed several values. Members of
+// structures, and the elements of arrays of structures, are named by their path, e.g.
+// "Motors[2].Speed".
+func (s *Server) SetTag(name string, t DataType, values ...interface{}) error {
+	if len(values) == 0 {
+		return errors.New("tag has no values")
+	}
+	data, err := Encode(t, values)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[name] = &serverTag{dataType: t, elements: len(values), data: data}
+	return nil
+}
+
+// Tag returns the values of a tag
+func (s *Server) Tag(name string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tag, found := s.tags[name]
+	if !found {
+		return nil, fmt.Errorf("no tag %s", name)
+	}
+	return Decode(tag.dataType, tag.data, tag.elements)
+}
+
+// Requests returns the number of unconnected messages answered
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// DropConnections closes the connection of every client
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Close stops accepting connections and closes those of every client
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.DropConnections()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve answers the commands of a client until it unregisters its session or disconnects
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	var session uint32
+	for {
+		h, data, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply []byte
+		switch h.Command {
+		case commandRegisterSession:
+			if len(data) < 4 || binary.LittleEndian.Uint16(data) != protocolVersion {
+				h.Status = 0x0069
+				break
+			}
+			s.mu.Lock()
+			s.sessions++
+			session = s.sessions
+			s.mu.Unlock()
+			h.Session, reply = session, data
+		case commandUnregisterSession:
+			return
+		case commandSendRRData:
+			if session == 0 || h.Session != session {
+				h.Status = 0x0064
+				break
+			}
+			message, err := decodeRRData(data)
+			if err != nil {
+				h.Status = 0x0003
+				break
+			}
+			s.mu.Lock()
+			s.requests++
+			reply = encodeRRData(s.handle(message))
+			s.mu.Unlock()
+		default:
+			h.Status = 0x0001
+		}
+		if _, err := conn.Write(encodePacket(h, reply)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a CIP request, unwrapping those routed by the connection manager
+func (s *Server) handle(message []byte) []byte {
+	service, path, data, err := decodeRequest(message)
+	if err != nil {
+		return encodeReply(0, StatusPathSizeInvalid, nil, nil)
+	}
+	switch {
+	case service == serviceUnconnectedSend && bytes.Equal(path, logicalPath(classConnectionManager, 1)):
+		if len(data) < 4 || len(data) < 4+int(binary.LittleEndian.Uint16(data[2:])) {
+			return encodeReply(service, StatusNotEnoughData, nil, nil)
+		}
+		return s.handle(data[4 : 4+int(binary.LittleEndian.Uint16(data[2:]))])
+	case service == serviceMultiple:
+		if !bytes.Equal(path, logicalPath(classMessageRouter, 1)) {
+			return encodeReply(service, StatusPathUnknown, nil, nil)
+		}
+		requests, err := splitMultiple(data)
+		if err != nil {
+			return encodeReply(service, StatusNotEnoughData, nil, nil)
+		}
+		// each reply has the space left by those before it
+		space := maxMessageSize - multipleOverhead - 2*len(requests)
+		status := byte(StatusSuccess)
+		replies := make([][]byte, len(requests))
+		for i, v := range requests {
+			if replies[i] = s.execute(v, space); replies[i][2] != StatusSuccess {
+				status = StatusEmbeddedServiceError
+			}
+			space -= len(replies[i])
+		}
+		return encodeReply(service, status, nil, joinMultiple(replies))
+	}
+	return s.execute(message, maxMessageSize)
+}
+
+// joinMultiple returns the data of a Multiple Service Packet holding the passed messages
+func joinMultiple(messages [][]byte) []byte {
+	b := encodeMultiple(messages)
+	return b[2+len(logicalPath(classMessageRouter, 1)):]
+}
+
+// execute answers a tag service request with a reply of at most space bytes
+func (s *Server) execute(message []byte, space int) []byte {
+	service, path, data, err := decodeRequest(message)
+	if err != nil {
+		return encodeReply(0, StatusPathSizeInvalid, nil, nil)
+	}
+	name, indexes, err := decodePath(path)
+	if err != nil {
+		return encodeReply(service, StatusPathSegmentError, nil, nil)
+	}
+	tag, start := s.tags[name+formatIndexes(indexes)], 0
+	if tag == nil && len(indexes) == 1 {
+		tag, start = s.tags[name], int(indexes[0])
+	}
+	if tag == nil {
+		return encodeReply(service, StatusPathUnknown, nil, nil)
+	}
+	size := tag.dataType.Size()
+	switch service {
+	case serviceReadTag, serviceReadTagFragmented:
+		if len(data) < 2 || (service == serviceReadTagFragmented && len(data) < 6) {
+			return encodeReply(service, StatusNotEnoughData, nil, nil)
+		}
+		count := int(binary.LittleEndian.Uint16(data))
+		if start+count > tag.elements {
+			return encodeReply(service, StatusGeneralError, []uint16{ExtendedBeyondEnd}, nil)
+		}
+		values := tag.data[start*size : (start+count)*size]
+		if service == serviceReadTagFragmented {
+			offset := int(binary.LittleEndian.Uint32(data[2:]))
+			if offset > len(values) {
+				return encodeReply(service, StatusGeneralError, []uint16{0x2104}, nil)
+			}
+			values = values[offset:]
+		}
+		t := tag.dataType.encode()
+		status := byte(StatusSuccess)
+		if room := space - 4 - len(t); len(values) > room {
+			// as much as fits, in whole elements
+			if room -= room % size; room <= 0 {
+				return encodeReply(service, StatusReplyTooLarge, nil, nil)
+			}
+			values, status = values[:room], StatusPartialTransfer
+		}
+		return encodeReply(service, status, nil, append(t, values...))
+	case serviceWriteTag:
+		t, rest, err := decodeDataType(data)
+		if err != nil || len(rest) < 2 {
+			return encodeReply(service, StatusNotEnoughData, nil, nil)
+		}
+		if t != tag.dataType {
+			return encodeReply(service, StatusGeneralError, []uint16{ExtendedTypeMismatch}, nil)
+		}
+		count := int(binary.LittleEndian.Uint16(rest))
+		if start+count > tag.elements {
+			return encodeReply(service, StatusGeneralError, []uint16{ExtendedBeyondEnd}, nil)
+		}
+		if len(rest) < 2+count*size {
+			return encodeReply(service, StatusNotEnoughData, nil, nil)
+		}
+		copy(tag.data[start*size:], rest[2:2+count*size])
+		return encodeReply(service, StatusSuccess, nil, nil)
+	}
+	return encodeReply(service, StatusServiceNotSupported, nil, nil)
+}
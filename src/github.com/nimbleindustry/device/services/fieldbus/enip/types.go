@@ -0,0 +1,273 @@
+package enip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Codes of the atomic data types, and of structures
+const (
+	TypeBOOL      = 0xC1
+	TypeSINT      = 0xC2
+	TypeINT       = 0xC3
+	TypeDINT      = 0xC4
+	TypeLINT      = 0xC5
+	TypeUSINT     = 0xC6
+	TypeUINT      = 0xC7
+	TypeUDINT     = 0xC8
+	TypeULINT     = 0xC9
+	TypeREAL      = 0xCA
+	TypeLREAL     = 0xCB
+	TypeDWORD     = 0xD3 // the 32 bit words of BOOL arrays
+	TypeStructure = 0x02A0
+)
+
+// HandleSTRING is the structure handle of the predefined Logix STRING type
+const HandleSTRING = 0x0FCE
+
+// maxStringLength is the capacity of the Logix STRING type
+const maxStringLength = 82
+
+// DataType is the type of a tag's value as reported by the Read Tag service: an atomic type
+// or a structure identified by its handle
+type DataType struct {
+	Code   uint16
+	Handle uint16 // of a structure
+}
+
+// STRING is the predefined Logix STRING type, a DINT length and 82 SINT characters
+var STRING = DataType{Code: TypeStructure, Handle: HandleSTRING}
+
+var typeNames = map[uint16]string{
+	TypeBOOL: "BOOL", TypeSINT: "SINT", TypeINT: "INT", TypeDINT: "DINT", TypeLINT: "LINT",
+	TypeUSINT: "USINT", TypeUINT: "UINT", TypeUDINT: "UDINT", TypeULINT: "ULINT",
+	TypeREAL: "REAL", TypeLREAL: "LREAL", TypeDWORD: "DWORD",
+}
+
+func (t DataType) String() string {
+	if t == STRING {
+		return "STRING"
+	}
+	if t.Code == TypeStructure {
+		return fmt.Sprintf("structure 0x%04X", t.Handle)
+	}
+	if name, found := typeNames[t.Code]; found {
+		return name
+	}
+	return fmt.Sprintf("type 0x%04X", t.Code)
+}
+
+// Size returns the size in bytes of a single value of the type, 0 for structures other than
+// STRING whose size is not known
+func (t DataType) Size() int {
+	switch t.Code {
+	case TypeBOOL, TypeSINT, TypeUSINT:
+		return 1
+	case TypeINT, TypeUINT:
+		return 2
+	case TypeDINT, TypeUDINT, TypeREAL, TypeDWORD:
+		return 4
+	case TypeLINT, TypeULINT, TypeLREAL:
+		return 8
+	}
+	if t == STRING {
+		return 88 // the length, characters and padding to a 4 byte boundary
+	}
+	return 0
+}
+
+// encode returns the type as it precedes the data of Read Tag replies and Write Tag requests
+func (t DataType) encode() []byte {
+	if t.Code == TypeStructure {
+		return []byte{byte(t.Code), byte(t.Code >> 8), byte(t.Handle), byte(t.Handle >> 8)}
+	}
+	return []byte{byte(t.Code), byte(t.Code >> 8)}
+}
+
+// decodeDataType returns the type preceding data, and the data that follows it
+func decodeDataType(b []byte) (DataType, []byte, error) {
+	if len(b) < 2 {
+		return DataType{}, nil, errors.New("data type truncated")
+	}
+	t := DataType{Code: binary.LittleEndian.Uint16(b)}
+	if t.Code != TypeStructure {
+		return t, b[2:], nil
+	}
+	if len(b) < 4 {
+		return DataType{}, nil, errors.New("structure handle truncated")
+	}
+	t.Handle = binary.LittleEndian.Uint16(b[2:])
+	return t, b[4:], nil
+}
+
+// Decode returns the values of the passed number of elements of the type. BOOL values are
+// returned as bool, STRING values as string and integers and floats as the Go type of their
+// size; other structures cannot be decoded and must be read by member.
+func Decode(t DataType, data []byte, count int) ([]interface{}, error) {
+	size := t.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("%s cannot be decoded, read its members", t)
+	}
+	if len(data) < size*count {
+		return nil, fmt.Errorf("%d bytes of %s data, expected %d", len(data), t, size*count)
+	}
+	values := make([]interface{}, count)
+	for i := range values {
+		b := data[i*size : (i+1)*size]
+		switch t.Code {
+		case TypeBOOL:
+			values[i] = b[0] != 0
+		case TypeSINT:
+			values[i] = int8(b[0])
+		case TypeUSINT:
+			values[i] = b[0]
+		case TypeINT:
+			values[i] = int16(binary.LittleEndian.Uint16(b))
+		case TypeUINT:
+			values[i] = binary.LittleEndian.Uint16(b)
+		case TypeDINT:
+			values[i] = int32(binary.LittleEndian.Uint32(b))
+		case TypeUDINT, TypeDWORD:
+			values[i] = binary.LittleEndian.Uint32(b)
+		case TypeLINT:
+			values[i] = int64(binary.LittleEndian.Uint64(b))
+		case TypeULINT:
+			values[i] = binary.LittleEndian.Uint64(b)
+		case TypeREAL:
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b))
+		case TypeLREAL:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		default:
+			length := int(int32(binary.LittleEndian.Uint32(b)))
+			if length < 0 || length > maxStringLength {
+				return nil, fmt.Errorf("STRING has invalid length %d", length)
+			}
+			values[i] = string(b[4 : 4+length])
+		}
+	}
+	return values, nil
+}
+
+// Encode returns the data of the passed values as the type. Integer types accept any Go
+// number (or bool) that is a whole number within their range, REAL and LREAL any number and
+// STRING a string of up to 82 characters.
+func Encode(t DataType, values []interface{}) ([]byte, error) {
+	size := t.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("%s cannot be encoded, write its members", t)
+	}
+	data := make([]byte, size*len(values))
+	for i, v := range values {
+		b := data[i*size : (i+1)*size]
+		if t == STRING {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("STRING expects a string, got %v", v)
+			}
+			if len(s) > maxStringLength {
+				return nil, fmt.Errorf("string of %d characters exceeds STRING capacity of %d", len(s), maxStringLength)
+			}
+			binary.LittleEndian.PutUint32(b, uint32(len(s)))
+			copy(b[4:], s)
+			continue
+		}
+		f, err := toFloat64(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a number, got %v", t, v)
+		}
+		switch t.Code {
+		case TypeREAL:
+			binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f)))
+			continue
+		case TypeLREAL:
+			binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+			continue
+		case TypeBOOL:
+			if f != 0 && f != 1 {
+				return nil, fmt.Errorf("BOOL expects a boolean (or 0/1), got %v", v)
+			}
+			b[0] = byte(f)
+			continue
+		}
+		// integers, whose values are written from their exact Go values where possible
+		var lo, hi float64
+		switch t.Code {
+		case TypeSINT:
+			lo, hi = math.MinInt8, math.MaxInt8
+		case TypeINT:
+			lo, hi = math.MinInt16, math.MaxInt16
+		case TypeDINT:
+			lo, hi = math.MinInt32, math.MaxInt32
+		case TypeLINT:
+			lo, hi = math.MinInt64, math.MaxInt64
+		case TypeUSINT:
+			hi = math.MaxUint8
+		case TypeUINT:
+			hi = math.MaxUint16
+		case TypeUDINT, TypeDWORD:
+			hi = math.MaxUint32
+		case TypeULINT:
+			hi = math.MaxUint64
+		}
+		if f != math.Trunc(f) || f < lo || f > hi {
+			return nil, fmt.Errorf("%v is not a %s value", v, t)
+		}
+		var raw uint64
+		switch n := v.(type) {
+		case int64:
+			raw = uint64(n)
+		case uint64:
+			raw = n
+		case int:
+			raw = uint64(n)
+		default:
+			if f < 0 {
+				raw = uint64(int64(f))
+			} else {
+				raw = uint64(f)
+			}
+		}
+		for j := range b {
+			b[j] = byte(raw >> uint(8*j))
+		}
+	}
+	return data, nil
+}
+
+// toFloat64 converts a Go number or bool to a float64
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
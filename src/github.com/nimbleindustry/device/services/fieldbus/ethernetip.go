@@ -0,0 +1,309 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/enip"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	enipTimeout     = 5 * time.Second
+	enipMaxElements = 0xFFFF
+)
+
+// EtherNetIPService provides access to the tags of an Allen-Bradley Logix controller
+// (ControlLogix, CompactLogix), as defined by the etherNetIP entries of the equipment config,
+// using the CIP symbolic tag services over an EtherNet/IP session. The tags of each poll group
+// are read together, packed into as few Multiple Service Packets as will fit. The connection
+// record's endpoint is the host of the controller's Ethernet module, the port defaulting to
+// 44818, and its slot that of the controller in the chassis. The session is held open between
+// polls; when it is lost it is re-established with exponential backoff, the service exiting
+// (to be restarted by its supervisor) only after repeated failures.
+type EtherNetIPService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop       chan bool
+	connection common.ConnectionRecord
+	entries    []common.EtherNetIPEntry
+	pollGroups []common.PollGroup
+	tags       []enip.Tag               // the parsed address of each entry
+	types      map[string]enip.DataType // the type of each entry's tag, as last read
+	poller
+}
+
+// NewEtherNetIPService returns a service for the controller of the passed connection record,
+// named for the record
+func NewEtherNetIPService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *EtherNetIPService {
+	svc := &EtherNetIPService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *EtherNetIPService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for ethernet/ip, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	writes := writeRoutes.register(svc.Name, svc.writableTags())
+	defer writeRoutes.unregister(svc.Name, writes)
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case cmd := <-writes:
+			svc.write(cmd)
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.address)
+		case <-time.After(svc.schedule.untilNext(time.Now())):
+			// read the tags of each poll group that is due
+			if err := svc.poll(); err != nil {
+				// reconnecting in place has not worked, force supervisor recovery
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *EtherNetIPService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *EtherNetIPService) State() int {
+	return svc.ServiceState
+}
+
+func (svc *EtherNetIPService) clean() {
+	svc.closeConnection()
+}
+
+func (svc *EtherNetIPService) initConfigurations() error {
+	if common.ConnectionConfig.DeviceID == "" {
+		return errors.New("Connection config object not initialized")
+	}
+	if common.EquipmentConfig.Ref == "" {
+		return errors.New("Equipment config object not initialized")
+	}
+	svc.entries = common.EquipmentConfig.MachineIntegrations.EtherNetIPEntries
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
+	return nil
+}
+
+// initBusIntegration validates the entries, parsing their addresses and assigning them to
+// poll groups
+func (svc *EtherNetIPService) initBusIntegration() error {
+	if svc.connection.Type == "" {
+		return errors.New("No etherNetIP connection records")
+	}
+	if len(svc.entries) == 0 {
+		return errors.New("No etherNetIP entries")
+	}
+	port := svc.connection.Port
+	if port == 0 {
+		port = enip.DefaultPort
+	}
+	svc.address = net.JoinHostPort(svc.connection.Endpoint, strconv.Itoa(port))
+	svc.tags = make([]enip.Tag, len(svc.entries))
+	scheduled := make([]scheduledTag, len(svc.entries))
+	names := make(map[string]bool, len(svc.entries))
+	for i, v := range svc.entries {
+		switch {
+		case v.TagName == "":
+			return fmt.Errorf("etherNetIP entry %d has no tagName", i)
+		case v.Elements < 0 || v.Elements > enipMaxElements:
+			return fmt.Errorf("%s has invalid elements %d", v.TagName, v.Elements)
+		case v.Writable && v.Elements > 1:
+			return fmt.Errorf("%s of %d elements cannot be writable", v.TagName, v.Elements)
+		}
+		for _, name := range v.ElementNames() {
+			if names[name] {
+				return fmt.Errorf("%s is defined more than once", name)
+			}
+			names[name] = true
+		}
+		tag, err := enip.ParseTag(v.Address)
+		if err != nil {
+			return fmt.Errorf("%s %s", v.TagName, err)
+		}
+		svc.tags[i] = tag
+		scheduled[i] = scheduledTag{name: v.TagName, pollGroup: v.PollGroup, pollInterval: v.PollInterval}
+	}
+	schedule, err := newTagSchedule(scheduled, svc.pollGroups, modbusSampleFrequency, time.Now())
+	if err != nil {
+		return err
+	}
+	svc.schedule = schedule
+	svc.types = make(map[string]enip.DataType, len(svc.entries))
+	svc.setup(svc.Name, "EtherNet/IP controller", svc.LogFunc, svc)
+	return nil
+}
+
+// dial opens a session with the controller at the passed address
+func (svc *EtherNetIPService) dial(address string) (pollConnection, error) {
+	client, err := enip.Dial(address, enip.ClientConfig{Timeout: enipTimeout, Slot: svc.connection.Slot})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// read reads the entries of the passed indexes. Every entry appears in the returned report,
+// those the controller could not read with a bad quality. An error is returned only if
+// communication with the controller failed.
+func (svc *EtherNetIPService) read(members []int) (common.OpsReport, error) {
+	requests := make([]enip.ReadRequest, len(members))
+	for j, i := range members {
+		requests[j] = enip.ReadRequest{Tag: svc.tags[i], Elements: svc.entries[i].Elements}
+	}
+	start := time.Now()
+	results, err := svc.conn.(*enip.Client).Read(requests)
+	svc.diagnostics.Latency.Add(time.Since(start))
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	if err != nil {
+		for _, i := range members {
+			svc.count(svc.entries[i].TagName, err)
+		}
+		return nil, err
+	}
+	m := make(common.OpsReport)
+	for j, i := range members {
+		entry := svc.entries[i]
+		svc.count(entry.TagName, results[j].Err)
+		names := entry.ElementNames()
+		if results[j].Err != nil {
+			for _, name := range names {
+				m[name] = common.TagValue{Unit: entry.Unit, Quality: define.QualityBad,
+					Error: fmt.Sprintf("%s %s", entry.Address, results[j].Err)}
+			}
+			continue
+		}
+		svc.types[entry.TagName] = results[j].Type
+		for k, name := range names {
+			m[name] = svc.tagValue(name, entry.Scaling, results[j].Values[k])
+		}
+	}
+	return m, nil
+}
+
+// tagsOf returns the tags reported for the entry of the passed index, those of its elements
+// should it read an array, and their unit
+func (svc *EtherNetIPService) tagsOf(i int) ([]string, string) {
+	return svc.entries[i].ElementNames(), svc.entries[i].Unit
+}
+
+// writableTags returns the names of the service's writable tags
+func (svc *EtherNetIPService) writableTags() []string {
+	var tags []string
+	for _, v := range svc.entries {
+		if v.Writable {
+			tags = append(tags, v.TagName)
+		}
+	}
+	return tags
+}
+
+// exchangeTag writes the command's value, nothing being read back
+func (svc *EtherNetIPService) exchangeTag(cmd common.WriteCommand) (interface{}, error) {
+	return nil, svc.writeTag(cmd)
+}
+
+// writeTag writes the command's value, converted from engineering units, to the entry's tag.
+// A tag not yet read is read first, to learn its type.
+func (svc *EtherNetIPService) writeTag(cmd common.WriteCommand) error {
+	i := -1
+	for j, v := range svc.entries {
+		if v.TagName == cmd.Tag {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("%s is not a configured tag", cmd.Tag)
+	}
+	entry := svc.entries[i]
+	if !entry.Writable {
+		return fmt.Errorf("%s is not writable", cmd.Tag)
+	}
+	t, found := svc.types[entry.TagName]
+	if !found {
+		if _, err := svc.read([]int{i}); err != nil {
+			return err
+		}
+		if t, found = svc.types[entry.TagName]; !found {
+			return fmt.Errorf("unable to read %s to learn its type", entry.Address)
+		}
+	}
+	value := cmd.Value
+	if entry.IsScaled() {
+		f, err := toFloat64(value)
+		if err != nil {
+			return fmt.Errorf("%s expects a number, got %v", cmd.Tag, value)
+		}
+		raw := entry.Raw(f)
+		if t.Code != enip.TypeREAL && t.Code != enip.TypeLREAL {
+			raw = math.Floor(raw + 0.5)
+		}
+		value = raw
+	}
+	start := time.Now()
+	err := svc.conn.(*enip.Client).Write(svc.tags[i], t, value)
+	svc.diagnostics.Latency.Add(time.Since(start))
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	svc.count(entry.TagName, err)
+	if err != nil {
+		return fmt.Errorf("Error writing tag %s, %s", entry.Address, err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package fieldbus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/enip"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtherNetIPEntryValidation(t *testing.T) {
+	svc := &EtherNetIPService{connection: common.ConnectionRecord{Type: define.EtherNetIP, Endpoint: "plc"}}
+	for _, entries := range [][]common.EtherNetIPEntry{
+		nil,
+		{{Address: "Speed"}},
+		{{TagName: "Speed"}},
+		{{TagName: "Speed", Address: "Motors[1"}},
+		{{TagName: "Speed", Address: "Speed"}, {TagName: "Speed", Address: "Rpm"}},
+		{{TagName: "Zone", Address: "Zones", Elements: 2}, {TagName: "Zone[1]", Address: "Zone1"}},
+		{{TagName: "Zone", Address: "Zones", Elements: 2, Writable: true}},
+		{{TagName: "Zone", Address: "Zones", Elements: -1}},
+		{{TagName: "Speed", Address: "Speed", PollGroup: "fast"}},
+	} {
+		svc.entries = entries
+		assert.NotNil(t, svc.initBusIntegration(), "%v", entries)
+	}
+	svc.entries = []common.EtherNetIPEntry{{TagName: "Speed", Address: "Speed"}}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Equal(t, "plc:44818", svc.address)
+	assert.Equal(t, "EtherNetIPService[plc:44818]", connectionKey(common.ConnectionRecord{Type: define.EtherNetIP, Endpoint: "plc", Port: 44818}))
+}
+
+func TestEtherNetIPReadsAndWritesTags(t *testing.T) {
+	svc, server := newTestEtherNetIPService(t)
+	defer server.Close()
+	states := watchConnectionState(svc.Name)
+	assert.Nil(t, svc.connect())
+	defer svc.closeConnection()
+	assert.Equal(t, define.ConnectionConnected, (<-states).State)
+
+	// the tags of the default group are read together, the array's elements reported singly
+	report, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.Requests())
+	assert.Equal(t, common.TagValue{Value: float32(12.5), Unit: "m/min", Quality: define.QualityGood}, report["LineSpeed"])
+	assert.Equal(t, int32(-42), report["Batch"].Value)
+	assert.InDelta(t, 145.0, report["Motor1Speed"].Value, 1e-9)
+	assert.InDelta(t, 21.0, report["Zone[0]"].Value, 1e-9)
+	assert.InDelta(t, 23.0, report["Zone[2]"].Value, 1e-9)
+	assert.Equal(t, "PVC-12", report["Recipe"].Value)
+	assert.Equal(t, true, report["Running"].Value)
+	assert.NotContains(t, report, "Missing")
+
+	// a tag the controller does not have is reported bad, and counted
+	report, err = svc.read(svc.schedule.groups[1].members)
+	assert.Nil(t, err)
+	assert.Equal(t, define.QualityBad, report["Missing"].Quality)
+	assert.True(t, strings.Contains(report["Missing"].Error, "path destination unknown"), report["Missing"].Error)
+	assert.Equal(t, map[int]int{enip.StatusPathUnknown: 1}, svc.diagnostics.Tags["Missing"].Exceptions)
+
+	// writes are converted from engineering units to the type of the tag
+	ack := svc.executeWrite(common.WriteCommand{ID: "1", Tag: "Motor1Speed", Value: 150.04})
+	assert.True(t, ack.Success, ack.Error)
+	values, _ := server.Tag("Motors[1].Rpm")
+	assert.Equal(t, []interface{}{int16(1500)}, values)
+	ack = svc.executeWrite(common.WriteCommand{ID: "2", Tag: "Recipe", Value: "ABS-7"})
+	assert.True(t, ack.Success, ack.Error)
+	values, _ = server.Tag("Recipe")
+	assert.Equal(t, []interface{}{"ABS-7"}, values)
+	for _, cmd := range []common.WriteCommand{
+		{Tag: "LineSpeed", Value: 100},
+		{Tag: "Batch", Value: 1.5},
+		{Tag: "Unknown", Value: 1},
+	} {
+		ack = svc.executeWrite(cmd)
+		assert.False(t, ack.Success, cmd.Tag)
+	}
+	assert.Equal(t, []string{"Batch", "Motor1Speed", "Recipe"}, svc.writableTags())
+}
+
+func TestEtherNetIPWriteLearnsTagType(t *testing.T) {
+	svc, server := newTestEtherNetIPService(t)
+	defer server.Close()
+	defer svc.closeConnection()
+
+	// a tag not yet read is read first, the session being established on demand
+	ack := svc.executeWrite(common.WriteCommand{ID: "1", Tag: "Batch", Value: 7.0})
+	assert.True(t, ack.Success, ack.Error)
+	values, _ := server.Tag("Program:Main.Batch")
+	assert.Equal(t, []interface{}{int32(7)}, values)
+	assert.Equal(t, 2, server.Requests())
+}
+
+func TestEtherNetIPReconnectsAfterConnectionLoss(t *testing.T) {
+	svc, server := newTestEtherNetIPService(t)
+	assert.Nil(t, svc.connect())
+	_, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+
+	// losing the connection reports the tags last read as stale
+	server.DropConnections()
+	states := watchConnectionState(svc.Name)
+	reports := watchOpsReports()
+	svc.schedule.groups[0].next = time.Now()
+	err = svc.pollDueGroups()
+	assert.NotNil(t, err)
+	report := nextOpsReport(t, reports, "LineSpeed", nil)
+	assert.Equal(t, define.QualityStale, report["LineSpeed"].Quality)
+	assert.Equal(t, float32(12.5), report["LineSpeed"].Value)
+	assert.Equal(t, define.QualityBad, svc.staleReport(svc.schedule.groups[1].members, err)["Missing"].Quality)
+	svc.checkConnection(err)
+	assert.Equal(t, define.ConnectionDisconnected, (<-states).State)
+	assert.Nil(t, svc.conn)
+
+	// the session is re-established, and failed attempts back off
+	assert.Nil(t, svc.connect())
+	assert.Equal(t, 1, svc.diagnostics.Reconnects)
+	svc.closeConnection()
+	server.Close()
+	assert.NotNil(t, svc.connect())
+	assert.Equal(t, 1, svc.backoff.failures)
+	err = svc.connect()
+	assert.True(t, strings.Contains(err.Error(), "deferred"), err.Error())
+}
@@ -0,0 +1,160 @@
+package fieldbus
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/enip"
+	"github.com/nimbleindustry/device/services/fieldbus/opcua"
+	"github.com/nimbleindustry/device/services/fieldbus/s7"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// standinRecord returns a connection record of the passed type for the stand-in listening on
+// the passed address
+func standinRecord(recordType string, addr net.Addr) common.ConnectionRecord {
+	host, port, _ := net.SplitHostPort(addr.String())
+	record := common.ConnectionRecord{Type: recordType, Endpoint: host}
+	record.Port, _ = strconv.Atoi(port)
+	return record
+}
+
+// newTestEtherNetIPService returns an EtherNetIPService configured to read a stand-in
+// controller, and the controller
+func newTestEtherNetIPService(t *testing.T) (*EtherNetIPService, *enip.Server) {
+	server, err := enip.ListenStandin("127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	svc := NewEtherNetIPService(standinRecord(define.EtherNetIP, server.Addr()), func(s string) { t.Log(s) }, 0)
+	svc.entries = []common.EtherNetIPEntry{
+		{TagName: "LineSpeed", Address: "Line_Speed", Scaling: common.Scaling{Unit: "m/min"}},
+		{TagName: "Batch", Address: "Program:Main.Batch", Writable: true},
+		{TagName: "Motor1Speed", Address: "Motors[1].Rpm", Writable: true, Scaling: common.Scaling{Multiplier: 0.1, Unit: "%"}},
+		{TagName: "Zone", Address: "Temperatures[1]", Elements: 3, Scaling: common.Scaling{Multiplier: 0.1, Unit: "°C"}},
+		{TagName: "Recipe", Address: "Recipe", Writable: true},
+		{TagName: "Running", Address: "Running"},
+		{TagName: "Missing", Address: "Missing_Tag", PollGroup: "slow"},
+	}
+	svc.pollGroups = []common.PollGroup{{Name: "slow", Interval: "1m"}}
+	assert.Nil(t, svc.initBusIntegration())
+	return svc, server
+}
+
+// newTestS7Service returns an S7Service configured to read a stand-in PLC, and the PLC
+func newTestS7Service(t *testing.T) (*S7Service, *s7.Server) {
+	server, err := s7.ListenStandin("127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	record := standinRecord(define.S7, server.Addr())
+	record.Slot = 2
+	svc := NewS7Service(record, func(s string) { t.Log(s) }, 0)
+	svc.entries = []common.S7Entry{
+		{TagName: "LineSpeed", Address: "DB10.DBD4", DataType: "REAL", Scaling: common.Scaling{Unit: "m/min"}},
+		{TagName: "Motor1Speed", Address: "DB10.DBW8", DataType: "INT", Writable: true, Scaling: common.Scaling{Multiplier: 0.1, Unit: "%"}},
+		{TagName: "Running", Address: "DB10.DBX10.3", Writable: true},
+		{TagName: "Batch", Address: "ID4", DataType: "DINT"},
+		{TagName: "Missing", Address: "DB11.DBW0", PollGroup: "slow"},
+	}
+	svc.pollGroups = []common.PollGroup{{Name: "slow", Interval: "1m"}}
+	assert.Nil(t, svc.initBusIntegration())
+	return svc, server
+}
+
+// newStandinOPCUAServer serves a line with a speed and a state variable in namespace 1
+func newStandinOPCUAServer(t *testing.T, config opcua.ServerConfig) (*opcua.Server, *opcua.AddressSpace) {
+	space := opcua.NewAddressSpace()
+	ns := space.AddNamespace("urn:nimble:standin")
+	line := opcua.NewStringNodeID(ns, "Line1")
+	space.AddNode(opcua.NewNumericNodeID(0, opcua.ObjectObjectsFolder), opcua.NewNumericNodeID(0, opcua.ReferenceTypeOrganizes),
+		opcua.Node{ID: line, Class: opcua.NodeClassObject, BrowseName: opcua.QualifiedName{NamespaceIndex: ns, Name: "Line1"}})
+	space.AddNode(line, opcua.NewNumericNodeID(0, opcua.ReferenceTypeHasComponent), opcua.Node{
+		ID: opcua.NewStringNodeID(ns, "Line1.Speed"), Class: opcua.NodeClassVariable,
+		BrowseName: opcua.QualifiedName{NamespaceIndex: ns, Name: "Speed"}, Value: opcua.DataValue{Value: opcua.Variant{Value: int32(1200)}}})
+	space.AddNode(line, opcua.NewNumericNodeID(0, opcua.ReferenceTypeHasComponent), opcua.Node{
+		ID: opcua.NewNumericNodeID(ns, 1001), Class: opcua.NodeClassVariable,
+		BrowseName: opcua.QualifiedName{NamespaceIndex: ns, Name: "State"}, Value: opcua.DataValue{Value: opcua.Variant{Value: opcua.LocalizedText{Text: "Running"}}}})
+	server, err := opcua.Listen("127.0.0.1:0", space, config)
+	assert.Nil(t, err, "unable to listen")
+	return server, space
+}
+
+// newTestOPCUAService returns an OPCUAService for the passed server's variables
+func newTestOPCUAService(t *testing.T, server *opcua.Server, username string, password string) *OPCUAService {
+	record := standinRecord(define.OPCUA, server.Addr())
+	record.Username, record.Password = username, password
+	svc := NewOPCUAService(record, func(s string) { t.Log(s) }, 0)
+	svc.entries = []common.OPCUAEntry{
+		{TagName: "LineSpeed", NodeID: "ns=1;s=Line1.Speed", Scaling: common.Scaling{Multiplier: 0.1, Unit: "m/min"},
+			PollInterval: "50ms"},
+		{TagName: "LineState", BrowsePath: "1:Line1/State", PollInterval: "100ms"},
+		{TagName: "LineCount", BrowsePath: "Line1/Count"},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+	return svc
+}
+
+// routeWrite sends the command through the write router to the named service, as the fieldbus
+// manager does, and executes it as the service does between polls
+func routeWrite(svc interface {
+	writableTags() []string
+	executeWrite(cmd common.WriteCommand) *common.WriteAck
+}, name string, cmd common.WriteCommand) *common.WriteAck {
+	queue := writeRoutes.register(name, svc.writableTags())
+	defer writeRoutes.unregister(name, queue)
+	if ack := writeRoutes.route(cmd); ack != nil {
+		return ack
+	}
+	return svc.executeWrite(<-queue)
+}
+
+// watchOpsReports returns a channel that holds the ops reports sent from now on
+func watchOpsReports() chan interface{} {
+	return common.BufferedBusChannel(define.TopicOpsReport, 64)
+}
+
+// nextOpsReport returns the next report holding the named tag, meanwhile running the work
+// received, such as that of the service under test producing reports
+func nextOpsReport(t *testing.T, reports chan interface{}, tag string, work <-chan func()) common.OpsReport {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f := <-work:
+			f()
+		case msg := <-reports:
+			if report, ok := msg.(common.OpsReport); ok {
+				if _, found := report[tag]; found {
+					return report
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no report of %s", tag)
+			return nil
+		}
+	}
+}
+
+// watchConnectionState returns a channel that receives the next connection state published
+// by the named service
+func watchConnectionState(name string) chan *common.ConnectionStatus {
+	states := make(chan *common.ConnectionStatus, 1)
+	messages := common.BufferedBusChannel(define.TopicConnectionState, 16)
+	go func() {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case msg := <-messages:
+				if status := msg.(*common.ConnectionStatus); status.Service == name {
+					states <- status
+					return
+				}
+			case <-timeout:
+				states <- &common.ConnectionStatus{}
+				return
+			}
+		}
+	}()
+	return states
+}
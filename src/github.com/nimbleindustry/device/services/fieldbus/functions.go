@@ -0,0 +1,152 @@
+package fieldbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	modbusFuncCodeReadFileRecord  = 0x14
+	modbusFuncCodeWriteFileRecord = 0x15
+
+	// fileRecordReferenceType is the reference type of every file record sub-request
+	fileRecordReferenceType = 6
+	// modbusMaxFileRecord is the highest record number of a file
+	modbusMaxFileRecord = 9999
+	// modbusMaxWriteFileRegisters is the largest number of registers a write file record
+	// request carries, its byte count being at most 0xF5
+	modbusMaxWriteFileRegisters = 119
+	// modbusMaxFIFOCount is the largest number of registers queued in a FIFO
+	modbusMaxFIFOCount = 31
+	// modbusMaxReadWriteRegisters is the largest quantity written by read/write multiple
+	// registers
+	modbusMaxReadWriteRegisters = 121
+)
+
+// pduClient is a modbus.Client that also exchanges the function codes for which modbus.Client
+// has no method: read and write file record. It also reads FIFO queues, the method of
+// modbus.Client miscounting the bytes of a well formed response.
+type pduClient struct {
+	modbus.Client
+	packager    modbus.Packager
+	transporter modbus.Transporter
+}
+
+// newPDUClient returns a client using the passed packager and transporter, typically both a
+// modbus.TCPClientHandler or modbus.RTUClientHandler
+func newPDUClient(packager modbus.Packager, transporter modbus.Transporter) *pduClient {
+	return &pduClient{Client: modbus.NewClient2(packager, transporter), packager: packager, transporter: transporter}
+}
+
+func (c *pduClient) send(function byte, data []byte) ([]byte, error) {
+	return sendPDU(c.packager, c.transporter, &modbus.ProtocolDataUnit{FunctionCode: function, Data: data})
+}
+
+// readFIFOQueue returns the registers queued at the FIFO pointer address
+func (c *pduClient) readFIFOQueue(address uint16) ([]byte, error) {
+	data, err := c.send(modbus.FuncCodeReadFIFOQueue, Uint16ToBytes(address))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("FIFO queue response of %d bytes is too short", len(data))
+	}
+	// the byte count covers the FIFO count and the queued registers
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if int(binary.BigEndian.Uint16(data)) != len(data)-2 || len(data) != 4+2*count {
+		return nil, fmt.Errorf("FIFO queue response of %d bytes does not match its counts", len(data))
+	}
+	if count > modbusMaxFIFOCount {
+		return nil, fmt.Errorf("FIFO count %d exceeds %d", count, modbusMaxFIFOCount)
+	}
+	return data[4:], nil
+}
+
+// readFileRecord returns length registers of the passed file, starting at the passed record
+// number
+func (c *pduClient) readFileRecord(file uint16, record uint16, length uint16) ([]byte, error) {
+	request := []byte{7, fileRecordReferenceType}
+	request = append(request, Uint16ToBytes(file)...)
+	request = append(request, Uint16ToBytes(record)...)
+	request = append(request, Uint16ToBytes(length)...)
+	data, err := c.send(modbusFuncCodeReadFileRecord, request)
+	if err != nil {
+		return nil, err
+	}
+	// response data length, then the sub-response's length, reference type and registers
+	if len(data) < 2 || int(data[0]) != len(data)-1 || int(data[1]) != len(data)-2 {
+		return nil, fmt.Errorf("file record response of %d bytes does not match its lengths", len(data))
+	}
+	if len(data) != 3+2*int(length) || data[2] != fileRecordReferenceType {
+		return nil, fmt.Errorf("file record response does not carry the %d registers requested", length)
+	}
+	return data[3:], nil
+}
+
+// writeFileRecord writes the passed register bytes to the passed file, starting at the passed
+// record number
+func (c *pduClient) writeFileRecord(file uint16, record uint16, value []byte) error {
+	request := []byte{byte(7 + len(value)), fileRecordReferenceType}
+	request = append(request, Uint16ToBytes(file)...)
+	request = append(request, Uint16ToBytes(record)...)
+	request = append(request, Uint16ToBytes(uint16(len(value)/2))...)
+	request = append(request, value...)
+	data, err := c.send(modbusFuncCodeWriteFileRecord, request)
+	if err != nil {
+		return err
+	}
+	// the response echoes the request
+	if string(data) != string(request) {
+		return errors.New("file record write response does not echo the request")
+	}
+	return nil
+}
+
+// decodeFIFO converts the registers of a FIFO queue into a slice of values of the entry's
+// data type, each occupying the entry's register count
+func decodeFIFO(entry common.ModbusEntry, b []byte) (interface{}, error) {
+	size := 2 * entry.RegisterCount()
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("%s FIFO queue of %d registers does not hold whole values", entry.RegisterName, len(b)/2)
+	}
+	values := make([]interface{}, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		v, err := DecodeRegisters(entry, b[i:i+size])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// maskWriteBit returns the device register holding a bit entry's bit, and the AND and OR masks
+// of a mask write setting the bit to on, leaving the register's other bits as they were
+func maskWriteBit(entry common.ModbusEntry, on bool) (uint16, uint16, uint16) {
+	register := entry.BitIndex / 16
+	if entry.WordSwap {
+		register = entry.RegisterCount() - 1 - register
+	}
+	offset := uint(entry.BitIndex % 16)
+	if entry.ByteSwap {
+		offset ^= 8
+	}
+	orMask := uint16(0)
+	if on {
+		orMask = 1 << offset
+	}
+	return uint16(entry.Address + register), ^uint16(1 << offset), orMask
+}
+
+// entryWriteAddress returns the address written by the read/write multiple registers function
+func entryWriteAddress(entry common.ModbusEntry) int {
+	if entry.WriteAddress != nil {
+		return *entry.WriteAddress
+	}
+	return entry.Address
+}
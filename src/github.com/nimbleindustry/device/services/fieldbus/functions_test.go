@@ -0,0 +1,94 @@
+package fieldbus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedFunctions(t *testing.T) {
+	slave := newStandinSlave(1)
+	slave.holdingRegisters[5] = 0x00F0
+	slave.holdingRegisters[20] = 7
+	slave.SetFIFO(30, []uint16{1, 0xFFFE, 3})
+	slave.SetFile(4, make([]uint16, 10))
+	handshake := 21
+	svc := newStandinService(slave)
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "Alarm", Functions: []int{3, 22}, Address: 5, DataType: common.DataTypeBit, BitIndex: 3},
+		{RegisterName: "Handshake", Functions: []int{23}, Address: 20, WriteAddress: &handshake},
+		{RegisterName: "Events", Functions: []int{24}, Address: 30},
+		{RegisterName: "Recipe", Functions: []int{20, 21}, File: 4, Address: 2, DataType: common.DataTypeString, Count: 4},
+		{RegisterName: "Journal", Functions: []int{24}, Address: 40},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+
+	// mask writes leave the register's other bits as they were
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Alarm", Value: true}).Error)
+	assert.Equal(t, uint16(0x00F8), slave.holdingRegisters[5])
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Alarm", Value: 0}).Error)
+	assert.Equal(t, uint16(0x00F0), slave.holdingRegisters[5])
+
+	ack := routeWrite(svc, svc.name, common.WriteCommand{ID: "1", Tag: "Handshake", Value: 5})
+	assert.Empty(t, ack.Error)
+	assert.Equal(t, uint16(5), slave.holdingRegisters[21])
+	assert.Equal(t, int16(7), ack.Value, "expected the handshake's read back value to be acknowledged")
+
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Recipe", Value: "MIX-A"}).Error)
+	assert.Equal(t, []uint16{0, 0, 0x4D49, 0x582D, 0x4100, 0, 0, 0}, slave.File(4)[:8])
+
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, false, m["Alarm"].Value)
+	_, polled := m["Handshake"]
+	assert.False(t, polled, "expected the handshake to be read only when written")
+	assert.Equal(t, []interface{}{int16(1), int16(-2), int16(3)}, m["Events"].Value)
+	assert.Equal(t, "MIX-A", m["Recipe"].Value)
+	assert.Equal(t, define.QualityBad, m["Journal"].Quality, "expected the missing FIFO queue to be reported bad")
+	assert.Contains(t, m["Journal"].Error, "Error reading FIFO queue 40-40")
+}
+
+func TestValidateExtendedFunctionEntries(t *testing.T) {
+	tests := []common.ModbusEntry{
+		{RegisterName: "a", Functions: []int{3, 22}, DataType: common.DataTypeUint16},
+		{RegisterName: "b", Functions: []int{24}, DataType: common.DataTypeString, Count: 32},
+		{RegisterName: "c", Functions: []int{20}, Address: 2},
+		{RegisterName: "d", Functions: []int{20, 21}, File: 1, Address: 9999, DataType: common.DataTypeInt32},
+		{RegisterName: "e", Functions: []int{21}, File: 1, DataType: common.DataTypeString, Count: 120},
+	}
+	for _, v := range tests {
+		assert.NotNil(t, validateModbusEntry(v), "expected entry %s to be rejected", v.RegisterName)
+	}
+	entry := common.ModbusEntry{RegisterName: "f", Functions: []int{3, 22}, Address: 8, DataType: common.DataTypeBit,
+		Count: 2, BitIndex: 17, WordSwap: true, ByteSwap: true}
+	register, andMask, orMask := maskWriteBit(entry, true)
+	assert.Equal(t, uint16(8), register, "expected the second register to come first when word swapped")
+	assert.Equal(t, uint16(0xFDFF), andMask)
+	assert.Equal(t, uint16(0x0200), orMask)
+}
+
+func TestReadRTUFrameExtendedFunctions(t *testing.T) {
+	frames := [][]byte{
+		{1, modbus.FuncCodeMaskWriteRegister, 0, 5, 0xFF, 0xF7, 0, 8, 0xAA, 0xBB},
+		{1, modbus.FuncCodeReadWriteMultipleRegisters, 2, 0, 7, 0xAA, 0xBB},
+		{1, modbus.FuncCodeReadFIFOQueue, 0, 6, 0, 2, 0, 1, 0, 2, 0xAA, 0xBB},
+		{1, modbusFuncCodeReadFileRecord, 4, 3, 6, 0, 1, 0xAA, 0xBB},
+		{1, modbusFuncCodeWriteFileRecord, 9, 6, 0, 4, 0, 2, 0, 1, 0, 1, 0xAA, 0xBB},
+		// the serial line functions a bridge forwards
+		{1, modbusFuncCodeReadExceptionStatus, 0x6D, 0xAA, 0xBB},
+		{1, modbusFuncCodeDiagnostics, 0, 0x0B, 0, 3, 0xAA, 0xBB},
+		{1, modbusFuncCodeCommEventCounter, 0xFF, 0xFF, 1, 8, 0xAA, 0xBB},
+		{1, modbusFuncCodeReportServerID, 3, 0x11, 0xFF, 'N', 0xAA, 0xBB},
+	}
+	for _, frame := range frames {
+		// a subsequent frame follows on the stream
+		read, err := readRTUFrame(bytes.NewReader(append(append([]byte{}, frame...), 1, 3, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, frame, read, "unexpected frame of function %d", frame[1])
+	}
+}
@@ -0,0 +1,215 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// modbusFuncCodeEncapsulatedInterface is the function code of the MEI transport, of which
+	// read device identification is MEI type 14
+	modbusFuncCodeEncapsulatedInterface = 0x2B
+	modbusMEIReadDeviceIdentification   = 0x0E
+
+	// read device identification codes: stream access to the basic, regular and extended
+	// objects, and access to a single object
+	readDeviceIDBasic    = 1
+	readDeviceIDRegular  = 2
+	readDeviceIDExtended = 3
+	readDeviceIDObject   = 4
+
+	// modbusMaxPDUData is the largest number of data bytes following the function code of a PDU
+	modbusMaxPDUData = 252
+	// readDeviceIDMaxResponses bounds the number of 'more follows' requests of a stream read
+	readDeviceIDMaxResponses = 64
+)
+
+// deviceIdentificationNames names the basic and regular device identification objects, by
+// object ID
+var deviceIdentificationNames = []string{"vendorName", "productCode", "majorMinorRevision", "vendorUrl",
+	"productName", "modelName", "userApplicationName"}
+
+// DeviceIdentification maps the object IDs of the read device identification function (43/14)
+// to their values: 0-2 are the basic objects (vendor name, product code and revision), 3-6 the
+// regular ones, 0x80-0xFF are private to the device.
+type DeviceIdentification map[byte]string
+
+// Named returns the identification keyed by object name, e.g. "vendorName", private and
+// reserved objects being named for their ID, e.g. "object128"
+func (id DeviceIdentification) Named() map[string]string {
+	named := make(map[string]string, len(id))
+	for k, v := range id {
+		named[deviceIdentificationName(k)] = v
+	}
+	return named
+}
+
+func deviceIdentificationName(objectID byte) string {
+	if int(objectID) < len(deviceIdentificationNames) {
+		return deviceIdentificationNames[objectID]
+	}
+	return fmt.Sprintf("object%d", objectID)
+}
+
+// ParseDeviceIdentification is the inverse of Named
+func ParseDeviceIdentification(named map[string]string) (DeviceIdentification, error) {
+	id := make(DeviceIdentification, len(named))
+	for k, v := range named {
+		objectID, err := deviceIdentificationObjectID(k)
+		if err != nil {
+			return nil, err
+		}
+		id[objectID] = v
+	}
+	return id, nil
+}
+
+func deviceIdentificationObjectID(name string) (byte, error) {
+	for i, v := range deviceIdentificationNames {
+		if v == name {
+			return byte(i), nil
+		}
+	}
+	if strings.HasPrefix(name, "object") {
+		if n, err := strconv.ParseUint(strings.TrimPrefix(name, "object"), 10, 8); err == nil {
+			return byte(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown device identification object %s", name)
+}
+
+// ReadDeviceIdentification reads every device identification object the slave will disclose,
+// trying extended, then regular, then basic stream access. The passed packager determines the
+// unit ID addressed.
+func ReadDeviceIdentification(packager modbus.Packager, transporter modbus.Transporter) (DeviceIdentification, error) {
+	var err error
+	for _, readCode := range []byte{readDeviceIDExtended, readDeviceIDRegular, readDeviceIDBasic} {
+		var id DeviceIdentification
+		if id, err = readDeviceIdentification(packager, transporter, readCode); err == nil {
+			return id, nil
+		}
+		// a slave that does not conform to the level requested rejects the read code
+		if e, ok := err.(*modbus.ModbusError); !ok || e.ExceptionCode != modbus.ExceptionCodeIllegalDataValue {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// readDeviceIdentification streams the objects of the passed read code, following the
+// slave's 'more follows' indications
+func readDeviceIdentification(packager modbus.Packager, transporter modbus.Transporter, readCode byte) (DeviceIdentification, error) {
+	id := make(DeviceIdentification)
+	objectID := byte(0)
+	for i := 0; i < readDeviceIDMaxResponses; i++ {
+		data, err := sendPDU(packager, transporter, &modbus.ProtocolDataUnit{
+			FunctionCode: modbusFuncCodeEncapsulatedInterface,
+			Data:         []byte{modbusMEIReadDeviceIdentification, readCode, objectID},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 6 || data[0] != modbusMEIReadDeviceIdentification {
+			return nil, errors.New("malformed device identification response")
+		}
+		moreFollows, next, count := data[3], data[4], int(data[5])
+		objects := data[6:]
+		for j := 0; j < count; j++ {
+			if len(objects) < 2 || len(objects) < 2+int(objects[1]) {
+				return nil, errors.New("truncated device identification object")
+			}
+			id[objects[0]] = string(objects[2 : 2+int(objects[1])])
+			objects = objects[2+int(objects[1]):]
+		}
+		if moreFollows != 0xFF {
+			return id, nil
+		}
+		objectID = next
+	}
+	return nil, errors.New("device identification response does not end")
+}
+
+// sendPDU exchanges a request PDU for a response PDU, returning the response data or the
+// exception response as a *modbus.ModbusError. It serves function codes for which
+// modbus.Client has no method.
+func sendPDU(packager modbus.Packager, transporter modbus.Transporter, request *modbus.ProtocolDataUnit) ([]byte, error) {
+	response, err := forwardPDU(packager, transporter, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.FunctionCode != request.FunctionCode {
+		if len(response.Data) == 0 {
+			return nil, fmt.Errorf("exception response to function %d carries no exception code", request.FunctionCode)
+		}
+		return nil, &modbus.ModbusError{FunctionCode: response.FunctionCode, ExceptionCode: response.Data[0]}
+	}
+	return response.Data, nil
+}
+
+// identify answers a read device identification request, data being the request PDU's data
+// following the function code
+func (id DeviceIdentification) identify(data []byte) (byte, []byte) {
+	function := byte(modbusFuncCodeEncapsulatedInterface)
+	if len(id) == 0 || len(data) < 1 || data[0] != modbusMEIReadDeviceIdentification {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalFunction}
+	}
+	if len(data) != 3 || data[1] < readDeviceIDBasic || data[1] > readDeviceIDObject {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	readCode, objectID := data[1], data[2]
+	conformity := byte(0x81)
+	for k := range id {
+		if k >= 0x80 {
+			conformity = 0x83
+		} else if k > 2 && conformity < 0x82 {
+			conformity = 0x82
+		}
+	}
+	if readCode == readDeviceIDObject {
+		value, found := id[objectID]
+		if !found {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+		}
+		response := []byte{modbusMEIReadDeviceIdentification, readCode, conformity, 0, 0, 1}
+		return function, append(response, identificationObject(objectID, value)...)
+	}
+	if readCode&0x03 > conformity&0x03 {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	last := byte(0x02)
+	if readCode == readDeviceIDRegular {
+		last = 0x7F
+	} else if readCode == readDeviceIDExtended {
+		last = 0xFF
+	}
+	// an unknown starting object restarts the stream at the first
+	if _, found := id[objectID]; !found || objectID > last {
+		objectID = 0
+	}
+	response := []byte{modbusMEIReadDeviceIdentification, readCode, conformity, 0, 0, 0}
+	for k := int(objectID); k <= int(last); k++ {
+		value, found := id[byte(k)]
+		if !found {
+			continue
+		}
+		object := identificationObject(byte(k), value)
+		if len(response)+len(object) > modbusMaxPDUData {
+			response[3], response[4] = 0xFF, byte(k)
+			break
+		}
+		response = append(response, object...)
+		response[5]++
+	}
+	return function, response
+}
+
+func identificationObject(objectID byte, value string) []byte {
+	if len(value) > modbusMaxPDUData-8 {
+		value = value[:modbusMaxPDUData-8]
+	}
+	return append([]byte{objectID, byte(len(value))}, value...)
+}
@@ -0,0 +1,115 @@
+package fieldbus
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceIdentificationNames(t *testing.T) {
+	id := DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2", 0x80: "serial 42"}
+	named := id.Named()
+	assert.Equal(t, map[string]string{"vendorName": "Nimble", "productCode": "ND-100", "majorMinorRevision": "1.2",
+		"object128": "serial 42"}, named)
+	parsed, err := ParseDeviceIdentification(named)
+	assert.Nil(t, err)
+	assert.Equal(t, id, parsed)
+	_, err = ParseDeviceIdentification(map[string]string{"vendor": "Nimble"})
+	assert.NotNil(t, err)
+}
+
+func TestReadDeviceIdentification(t *testing.T) {
+	slave := NewModbusSlave(1, 0, 0, 1, 0)
+	server, err := ListenModbusTCP("127.0.0.1:0", slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	handler := modbus.NewTCPClientHandler(server.Addr().String())
+	handler.SlaveId = 1
+	handler.Timeout = time.Second
+	defer handler.Close()
+
+	_, err = ReadDeviceIdentification(handler, handler)
+	assert.Equal(t, byte(modbus.ExceptionCodeIllegalFunction), err.(*modbus.ModbusError).ExceptionCode,
+		"expected a slave without identification to reject the function")
+
+	// objects too long for a single response are streamed
+	slave.Identification = DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2", 4: "Tank controller",
+		0x80: strings.Repeat("a", 200), 0x81: strings.Repeat("b", 200)}
+	id, err := ReadDeviceIdentification(handler, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, slave.Identification, id)
+
+	// a slave of regular conformity rejects extended access
+	slave.Identification = DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2", 5: "ND"}
+	id, err = ReadDeviceIdentification(handler, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, slave.Identification, id)
+
+	function, data := slave.Identification.identify([]byte{modbusMEIReadDeviceIdentification, readDeviceIDObject, 5})
+	assert.Equal(t, byte(modbusFuncCodeEncapsulatedInterface), function)
+	assert.Equal(t, []byte{modbusMEIReadDeviceIdentification, readDeviceIDObject, 0x82, 0, 0, 1, 5, 2, 'N', 'D'}, data)
+	_, data = slave.Identification.identify([]byte{modbusMEIReadDeviceIdentification, readDeviceIDObject, 6})
+	assert.Equal(t, []byte{modbus.ExceptionCodeIllegalDataAddress}, data)
+	_, data = slave.Identification.identify([]byte{modbusMEIReadDeviceIdentification, readDeviceIDBasic, 0})
+	assert.Equal(t, []byte{modbusMEIReadDeviceIdentification, readDeviceIDBasic, 0x82, 0, 0, 3}, data[:6],
+		"expected basic access to return only the basic objects")
+}
+
+// rtuPipe exchanges rtu frames over a net.Pipe, on which each response arrives in a single
+// read
+type rtuPipe struct {
+	conn net.Conn
+}
+
+func (p rtuPipe) Send(aduRequest []byte) ([]byte, error) {
+	p.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := p.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	response := make([]byte, modbusRTUMaxRequest)
+	n, err := p.conn.Read(response)
+	return response[:n], err
+}
+
+func TestServeModbusRTU(t *testing.T) {
+	slave := NewModbusSlave(3, 8, 0, 4, 0)
+	slave.Identification = DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2"}
+	master, port := net.Pipe()
+	defer master.Close()
+	go ServeModbusRTU(port, slave)
+
+	handler := modbus.NewRTUClientHandler("")
+	handler.SlaveId = 3
+	id, err := ReadDeviceIdentification(handler, rtuPipe{master})
+	assert.Nil(t, err)
+	assert.Equal(t, slave.Identification, id)
+
+	client := modbus.NewClient2(handler, rtuPipe{master})
+	_, err = client.WriteMultipleRegisters(1, 2, []byte{0, 7, 0, 8})
+	assert.Nil(t, err)
+	b, err := client.ReadHoldingRegisters(0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 7, 0, 8}, b)
+
+	// requests of every length are framed
+	_, err = client.MaskWriteRegister(1, 0x00F0, 0x0001)
+	assert.Nil(t, err)
+	b, err = client.ReadWriteMultipleRegisters(0, 2, 3, 1, []byte{0, 9})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 1}, b)
+	assert.Equal(t, []byte{0, 9}, slave.Registers(modbus.FuncCodeReadHoldingRegisters, 3, 1))
+	slave.SetFIFO(2, []uint16{4, 5})
+	slave.SetFile(1, make([]uint16, 4))
+	pdu := newPDUClient(handler, rtuPipe{master})
+	b, err = pdu.readFIFOQueue(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 4, 0, 5}, b)
+	assert.Nil(t, pdu.writeFileRecord(1, 1, []byte{0, 6, 0, 7}))
+	b, err = pdu.readFileRecord(1, 0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 6, 0, 7}, b)
+}
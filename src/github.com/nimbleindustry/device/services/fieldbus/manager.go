@@ -0,0 +1,258 @@
+package fieldbus
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/nimbleindustry/suture"
+)
+
+// FieldbusManagerService spawns one fieldbus service per machineIntegration connection record
+// into the fieldbus supervisor. Each instance runs under its own supervisor so that failures,
+// and the resulting backoff, of one connection do not affect the others. Instances are added
+// or removed as the connections config file changes, and all are restarted when the equipment
+// config file, holding their register maps, changes. Write commands are routed to the instance
+// that writes the command's tag.
+type FieldbusManagerService struct {
+	common.Service
+
+	StartDelay   time.Duration      // Duration to delay prior to starting the service
+	LogFunc      func(string)       // Destination for logging
+	Supervisor   *suture.Supervisor // Supervisor into which fieldbus instances are added
+	Spec         suture.Spec        // Spec used for each instance's supervisor
+	ServiceDelay time.Duration      // Duration each fieldbus instance delays prior to starting
+
+	instances map[string]fieldbusInstance
+	stop      chan bool
+}
+
+// fieldbusInstance tracks a running fieldbus service and the record it was created from
+type fieldbusInstance struct {
+	record common.ConnectionRecord
+	token  suture.ServiceToken
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *FieldbusManagerService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	// instances survive a restart of this service, reconcile against whatever is running
+	if svc.instances == nil {
+		svc.instances = make(map[string]fieldbusInstance)
+	}
+	svc.reconcile()
+
+	configUpdates := common.BusChannel(define.ConnectivityConfigUpdated)
+	equipmentUpdates := common.BusChannel(define.EquipmentConfigUpdated)
+	writes := common.BufferedBusChannel(define.TopicWriteCommand, fieldbusWriteQueue)
+	timeout := time.Duration(math.MaxInt32 * time.Second)
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			return
+		case <-configUpdates:
+			svc.LogFunc(fmt.Sprintf("%s advises that the connections config file was updated, reconciling fieldbus services", svc.Name))
+			svc.reconcile()
+		case <-equipmentUpdates:
+			svc.LogFunc(fmt.Sprintf("%s advises that the equipment config file was updated, restarting fieldbus services", svc.Name))
+			for key := range svc.instances {
+				svc.remove(key)
+			}
+			svc.reconcile()
+		case msg := <-writes:
+			if cmd, ok := msg.(*common.WriteCommand); ok {
+				svc.routeWrite(*cmd)
+			}
+		case <-time.After(timeout):
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *FieldbusManagerService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *FieldbusManagerService) State() int {
+	return svc.ServiceState
+}
+
+// routeWrite passes a write command to the fieldbus service that executes it, acknowledging
+// its failure if there is none
+func (svc *FieldbusManagerService) routeWrite(cmd common.WriteCommand) {
+	if ack := writeRoutes.route(cmd); ack != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: write of %v to %s failed, %s", svc.Name, cmd.Value, cmd.Tag, ack.Error))
+		common.SendBusMessage(define.TopicWriteAck, ack)
+	}
+}
+
+// reconcile brings the running fieldbus instances in line with the machineIntegration records
+func (svc *FieldbusManagerService) reconcile() {
+	running := make(map[string]common.ConnectionRecord, len(svc.instances))
+	for k, v := range svc.instances {
+		running[k] = v.record
+	}
+	added, removed := diffConnections(running, common.ConnectionConfig.MachineConnections)
+	for _, key := range removed {
+		svc.remove(key)
+	}
+	for _, record := range added {
+		key := connectionKey(record)
+		service := svc.newFieldbusService(record)
+		if service == nil {
+			svc.LogFunc(fmt.Sprintf("%s warns: no fieldbus service for connection type %s", svc.Name, record.Type))
+			continue
+		}
+		supervisor := suture.New(key, svc.Spec)
+		supervisor.Add(service)
+		svc.instances[key] = fieldbusInstance{record: record, token: svc.Supervisor.Add(supervisor)}
+		svc.LogFunc(fmt.Sprintf("%s adds fieldbus service %s", svc.Name, key))
+	}
+}
+
+// remove stops the fieldbus instance of the supplied key and removes it from the supervisor
+func (svc *FieldbusManagerService) remove(key string) {
+	instance := svc.instances[key]
+	if err := svc.Supervisor.Remove(instance.token); err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: error removing fieldbus service %s, %s", svc.Name, key, err))
+	}
+	delete(svc.instances, key)
+	svc.LogFunc(fmt.Sprintf("%s removes fieldbus service %s", svc.Name, key))
+}
+
+// newFieldbusService instantiates the fieldbus service that handles the supplied connection
+// record, returning nil if the record's type is not supported
+func (svc *FieldbusManagerService) newFieldbusService(record common.ConnectionRecord) suture.Service {
+	switch record.Type {
+	case define.ModbusTCP:
+		service := NewModbusTCPService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.ModbusRTU:
+		service := NewModbusRTUService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.OPCUA:
+		service := NewOPCUAService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.CAN:
+		service := NewCANService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.EtherNetIP:
+		service := NewEtherNetIPService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.S7:
+		service := NewS7Service(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	case define.MTConnect:
+		service := NewMTConnectService(record, svc.LogFunc, svc.ServiceDelay)
+		service.AddServiceDependentUpon(define.ConfigServiceName)
+		return service
+	}
+	return nil
+}
+
+// connectionKey returns a unique name for the fieldbus service handling the supplied record
+// such as ModbusTCPService[10.0.1.30:502], ModbusRTUService[/dev/ttyS0],
+// OPCUAService[opc.tcp://10.0.1.40:4840], CANService[can0],
+// EtherNetIPService[10.0.1.50:44818], S7Service[10.0.1.60:102] or
+// MTConnectService[10.0.1.70:7878]. Records that are explicitly named use that name in place of
+// the endpoint.
+func connectionKey(record common.ConnectionRecord) string {
+	var serviceName string
+	switch record.Type {
+	case define.ModbusTCP:
+		serviceName = define.ModbusTCPServiceName
+	case define.ModbusRTU:
+		serviceName = define.ModbusRTUServiceName
+	case define.OPCUA:
+		serviceName = define.OPCUAServiceName
+	case define.CAN:
+		serviceName = define.CANServiceName
+	case define.EtherNetIP:
+		serviceName = define.EtherNetIPServiceName
+	case define.S7:
+		serviceName = define.S7ServiceName
+	case define.MTConnect:
+		serviceName = define.MTConnectServiceName
+	default:
+		serviceName = record.Type
+	}
+	if record.Name != "" {
+		return fmt.Sprintf("%s[%s]", serviceName, record.Name)
+	}
+	if record.Port != 0 {
+		return fmt.Sprintf("%s[%s:%d]", serviceName, record.Endpoint, record.Port)
+	}
+	return fmt.Sprintf("%s[%s]", serviceName, record.Endpoint)
+}
+
+// sendOpsReport sends a report on TopicOpsReport, its values identified as read by the named
+// fieldbus service
+func sendOpsReport(source string, report common.OpsReport) {
+	for k, v := range report {
+		v.Source = source
+		report[k] = v
+	}
+	common.SendBusMessage(define.TopicOpsReport, report)
+}
+
+// diffConnections compares the running records (keyed by connectionKey) with the configured
+// records. It returns the records needing a new instance and the keys of instances that should
+// be removed. A record whose settings have changed appears in both lists.
+func diffConnections(running map[string]common.ConnectionRecord, configured []common.ConnectionRecord) (added []common.ConnectionRecord, removed []string) {
+	wanted := make(map[string]common.ConnectionRecord, len(configured))
+	for _, record := range configured {
+		key := connectionKey(record)
+		if _, found := wanted[key]; found {
+			// duplicate records would fight over the same device
+			continue
+		}
+		wanted[key] = record
+		current, found := running[key]
+		if !found {
+			added = append(added, record)
+		} else if current != record {
+			removed = append(removed, key)
+			added = append(added, record)
+		}
+	}
+	for key := range running {
+		if _, found := wanted[key]; !found {
+			removed = append(removed, key)
+		}
+	}
+	return
+}
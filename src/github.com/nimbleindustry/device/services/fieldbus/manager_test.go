@@ -0,0 +1,51 @@
+package fieldbus
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionKey(t *testing.T) {
+	assert.Equal(t, "ModbusTCPService[10.0.1.30:502]",
+		connectionKey(common.ConnectionRecord{Type: define.ModbusTCP, Endpoint: "10.0.1.30", Port: 502}))
+	assert.Equal(t, "ModbusRTUService[/dev/ttyS0]",
+		connectionKey(common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: "/dev/ttyS0"}))
+	assert.Equal(t, "ModbusTCPService[press-4]",
+		connectionKey(common.ConnectionRecord{Name: "press-4", Type: define.ModbusTCP, Endpoint: "10.0.1.30", Port: 502}))
+	assert.Equal(t, "OPCUAService[opc.tcp://10.0.1.40:4840]",
+		connectionKey(common.ConnectionRecord{Type: define.OPCUA, Endpoint: "opc.tcp://10.0.1.40:4840"}))
+}
+
+func TestDiffConnections(t *testing.T) {
+	plc1 := common.ConnectionRecord{Type: define.ModbusTCP, Endpoint: "10.0.1.30", Port: 502}
+	plc2 := common.ConnectionRecord{Type: define.ModbusTCP, Endpoint: "10.0.1.31", Port: 502}
+	drive := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: "/dev/ttyS0", Baudrate: 9600}
+
+	// nothing running, every record is added once
+	added, removed := diffConnections(map[string]common.ConnectionRecord{},
+		[]common.ConnectionRecord{plc1, plc2, drive, plc1})
+	assert.Equal(t, []common.ConnectionRecord{plc1, plc2, drive}, added)
+	assert.Empty(t, removed)
+
+	running := map[string]common.ConnectionRecord{
+		connectionKey(plc1):  plc1,
+		connectionKey(plc2):  plc2,
+		connectionKey(drive): drive,
+	}
+	added, removed = diffConnections(running, []common.ConnectionRecord{plc1, plc2, drive})
+	assert.Empty(t, added, "expected no change for identical records")
+	assert.Empty(t, removed, "expected no change for identical records")
+
+	// plc2 dropped from config, drive changes baud rate
+	faster := drive
+	faster.Baudrate = 38400
+	added, removed = diffConnections(running, []common.ConnectionRecord{plc1, faster})
+	sort.Strings(removed)
+	assert.Equal(t, []common.ConnectionRecord{faster}, added)
+	assert.Equal(t, []string{connectionKey(drive), connectionKey(plc2)}, removed)
+}
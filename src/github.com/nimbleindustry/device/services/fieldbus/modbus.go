@@ -1,9 +1,12 @@
 package fieldbus
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/nimbleindustry/device/common"
 	"github.com/nimbleindustry/device/define"
@@ -15,108 +18,290 @@ import (
 // by both TCP and RTU implementations
 type GenericModbusService struct {
 	connection          common.ConnectionRecord
-	client              modbus.Client
+	client              *pduClient                  // client for the connection's unit ID
+	unitClient          func(unitID int) *pduClient // creates clients for other unit IDs on the same connection
+	unitClients         map[int]*pduClient
 	machineIntegrations []common.ModbusEntry
+	devices             []common.ModbusDevice
+	pollGroups          []common.PollGroup
+	poller
 }
 
 func (svc *GenericModbusService) initConfigurations() error {
 	if common.ConnectionConfig.DeviceID == "" {
 		return errors.New("Connection config object not initialized")
 	}
-	svc.connection = common.ConnectionConfig.GetMachineConnection(define.ModbusTCP)
 	if common.EquipmentConfig.Ref == "" {
 		return errors.New("Equipment config object not initialized")
 	}
 	svc.machineIntegrations = common.EquipmentConfig.MachineIntegrations.ModbusEntries
+	svc.devices = common.EquipmentConfig.MachineIntegrations.ModbusDevices
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
 	return nil
 }
 
 func (svc *GenericModbusService) initBusIntegration() error {
+	entries, err := common.ExpandModbusDevices(svc.machineIntegrations, svc.devices)
+	if err != nil {
+		return err
+	}
+	svc.machineIntegrations = entries
 	if len(svc.machineIntegrations) == 0 {
 		return errors.New("No modbus entries")
 	}
-	return nil
-}
-
-func (svc *GenericModbusService) readAllInputs() (map[string]interface{}, error) {
-	m := make(map[string]interface{}, 1)
-	err := svc.readAllDiscreteInputs(m)
-	if err != nil {
-		return nil, err
+	for _, v := range svc.machineIntegrations {
+		if err := validateModbusEntry(v); err != nil {
+			return err
+		}
 	}
-	err = svc.readAllCoils(m)
+	svc.unitClients = nil
+	schedule, err := newPollSchedule(svc.machineIntegrations, svc.pollGroups, modbusSampleFrequency, time.Now())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = svc.readAllHoldingRegisters(m)
-	if err != nil {
-		return nil, err
+	svc.schedule = schedule
+	return nil
+}
+
+// read reads the entries of the passed indexes. Every entry read appears in the returned report,
+// those the device could not read with a bad quality. An error is returned only if communication
+// with the device failed, the entries it left unread being reported stale by the poller.
+func (svc *GenericModbusService) read(members []int) (common.OpsReport, error) {
+	entries := make([]common.ModbusEntry, len(members))
+	for j, i := range members {
+		entries[j] = svc.machineIntegrations[i]
 	}
-	err = svc.readAllInputRegisters(m)
-	if err != nil {
-		return nil, err
+	return svc.readInputs(entries)
+}
+
+// tagsOf returns the tag reported for the entry of the passed index, and its unit
+func (svc *GenericModbusService) tagsOf(i int) ([]string, string) {
+	return []string{svc.machineIntegrations[i].RegisterName}, svc.machineIntegrations[i].Unit
+}
+
+// readInputs reads the passed subset of the service's modbus entries. Every entry read appears
+// in the returned report, those the device could not read with a bad quality. An error is
+// returned only if communication with the device failed.
+func (svc *GenericModbusService) readInputs(entries []common.ModbusEntry) (common.OpsReport, error) {
+	m := make(common.OpsReport, len(entries))
+	subset := common.MachineIntegration{ModbusEntries: entries}
+	var failure error
+	for _, function := range []int{modbus.FuncCodeReadDiscreteInputs, modbus.FuncCodeReadCoils,
+		modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters,
+		modbus.FuncCodeReadFIFOQueue, modbusFuncCodeReadFileRecord} {
+		if err := svc.readTags(m, function, subset.FindModbusEntriesByFunction([]int{function})); err != nil && failure == nil {
+			failure = err
+		}
 	}
-	return m, nil
+	return m, failure
 }
 
-func (svc *GenericModbusService) readAllDiscreteInputs(m map[string]interface{}) error {
+// readTags reads the passed entries with a single read function, as few requests (per unit
+// ID) as possible
+func (svc *GenericModbusService) readTags(m common.OpsReport, function int, entries []common.ModbusEntry) error {
 	if svc.client == nil {
 		return errors.New("client nil")
 	}
-	entries := common.EquipmentConfig.MachineIntegrations.FindModbusEntriesByFunction([]int{modbus.FuncCodeReadDiscreteInputs})
-	for _, v := range entries {
-		value, err := svc.client.ReadDiscreteInputs(uint16(v.Address), 1)
-		if err != nil {
-			return fmt.Errorf("Error reading discrete input %s, %s", v.Desc["en"], err)
+	var failure error
+	units, byUnit := entriesByUnit(entries)
+	for _, unit := range units {
+		for _, block := range planReads(function, byUnit[unit], svc.connection.MaxReadGap) {
+			block.unitID = unit
+			if err := svc.readBlock(m, block); err != nil && failure == nil {
+				failure = err
+			}
 		}
-		m[v.RegisterName] = value[0]
 	}
-	return nil
+	return failure
 }
 
-func (svc *GenericModbusService) readAllHoldingRegisters(m map[string]interface{}) error {
-	if svc.client == nil {
-		return errors.New("client nil")
+// clientFor returns the client used to reach the passed unit ID, zero being the unit ID of
+// the connection
+func (svc *GenericModbusService) clientFor(unitID int) (*pduClient, error) {
+	if unitID == 0 {
+		return svc.client, nil
 	}
-	entries := common.EquipmentConfig.MachineIntegrations.FindModbusEntriesByFunction([]int{modbus.FuncCodeReadHoldingRegisters})
-	for _, v := range entries {
-		value, err := svc.client.ReadHoldingRegisters(uint16(v.Address), 1)
-		if err != nil {
-			return fmt.Errorf("Error reading holding register %s, %s", v.Desc["en"], err)
-		}
-		m[v.RegisterName] = BytesToInt16(value)
+	if client, found := svc.unitClients[unitID]; found {
+		return client, nil
 	}
-	return nil
+	if svc.unitClient == nil {
+		return nil, fmt.Errorf("unit ID %d cannot be addressed on this connection", unitID)
+	}
+	if svc.unitClients == nil {
+		svc.unitClients = make(map[int]*pduClient)
+	}
+	client := svc.unitClient(unitID)
+	svc.unitClients[unitID] = client
+	return client, nil
 }
 
-func (svc *GenericModbusService) readAllCoils(m map[string]interface{}) error {
-	if svc.client == nil {
-		return errors.New("client nil")
+// readBlock reads a single block, setting the value and quality of each of its entries. Should
+// the device reject a block of several entries (e.g. as one of its addresses does not exist)
+// each entry is read on its own, so that a bad address does not fail its neighbours. An error
+// is returned only if communication with the device failed, the block's entries being left out.
+func (svc *GenericModbusService) readBlock(m common.OpsReport, block readBlock) error {
+	value, err := svc.readRequest(block)
+	if err != nil {
+		readErr := fmt.Errorf("Error reading %s %d-%d%s, %s", functionName(block.function),
+			block.address, block.address+block.quantity-1, unitSuffix(block.unitID), err)
+		if _, exception := err.(*modbus.ModbusError); !exception {
+			return readErr
+		}
+		if len(block.entries) == 1 {
+			m[block.entries[0].RegisterName] = badValue(block.entries[0], readErr)
+			return nil
+		}
+		for _, v := range block.entries {
+			single := readBlock{function: block.function, unitID: block.unitID, address: v.Address,
+				quantity: entryQuantity(block.function, v), entries: []common.ModbusEntry{v}}
+			if err := svc.readBlock(m, single); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	entries := common.EquipmentConfig.MachineIntegrations.FindModbusEntriesByFunction([]int{modbus.FuncCodeReadCoils})
-	for _, v := range entries {
-		value, err := svc.client.ReadCoils(uint16(v.Address), 1)
-		if err != nil {
-			return fmt.Errorf("Error reading coils %s, %s", v.Desc["en"], err)
+	for _, v := range block.entries {
+		var tag common.TagValue
+		switch block.function {
+		case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+			bit, err := bitAt(value, block.offset(v))
+			if err != nil {
+				tag = badValue(v, err)
+			} else {
+				tag = svc.tagValue(v.RegisterName, v.Scaling, bit)
+			}
+		case modbus.FuncCodeReadFIFOQueue:
+			decoded, err := decodeFIFO(v, value)
+			if err != nil {
+				tag = badValue(v, err)
+			} else {
+				tag = svc.tagValue(v.RegisterName, v.Scaling, decoded)
+			}
+		default:
+			b, err := registersAt(value, block.offset(v), v.RegisterCount())
+			var decoded interface{}
+			if err == nil {
+				decoded, err = DecodeRegisters(v, b)
+			}
+			if err != nil {
+				tag = badValue(v, err)
+			} else {
+				tag = svc.tagValue(v.RegisterName, v.Scaling, decoded)
+			}
 		}
-		m[v.RegisterName] = value[0]
+		m[v.RegisterName] = tag
 	}
 	return nil
 }
 
-func (svc *GenericModbusService) readAllInputRegisters(m map[string]interface{}) error {
-	if svc.client == nil {
-		return errors.New("client nil")
+// readRequest performs the single modbus read request of the passed block
+func (svc *GenericModbusService) readRequest(block readBlock) ([]byte, error) {
+	client, err := svc.clientFor(block.unitID)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = svc.request(block.entries, func() error {
+		var err error
+		value, err = readFunction(client, block)
+		return err
+	})
+	return value, err
+}
+
+func readFunction(client *pduClient, block readBlock) ([]byte, error) {
+	address, quantity := uint16(block.address), uint16(block.quantity)
+	switch block.function {
+	case modbus.FuncCodeReadDiscreteInputs:
+		return client.ReadDiscreteInputs(address, quantity)
+	case modbus.FuncCodeReadCoils:
+		return client.ReadCoils(address, quantity)
+	case modbus.FuncCodeReadHoldingRegisters:
+		return client.ReadHoldingRegisters(address, quantity)
+	case modbus.FuncCodeReadInputRegisters:
+		return client.ReadInputRegisters(address, quantity)
+	case modbus.FuncCodeReadFIFOQueue:
+		return client.readFIFOQueue(address)
+	case modbusFuncCodeReadFileRecord:
+		return client.readFileRecord(uint16(block.entries[0].File), address, quantity)
+	}
+	return nil, fmt.Errorf("unsupported read function %d", block.function)
+}
+
+// unitSuffix describes the unit ID of a request for error messages, empty for the
+// connection's own unit ID
+func unitSuffix(unitID int) string {
+	if unitID == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" of unit %d", unitID)
+}
+
+// functionName returns the name of the data table accessed by a read function
+func functionName(function int) string {
+	switch function {
+	case modbus.FuncCodeReadDiscreteInputs:
+		return "discrete inputs"
+	case modbus.FuncCodeReadCoils:
+		return "coils"
+	case modbus.FuncCodeReadHoldingRegisters:
+		return "holding registers"
+	case modbus.FuncCodeReadInputRegisters:
+		return "input registers"
+	case modbus.FuncCodeReadFIFOQueue:
+		return "FIFO queue"
+	case modbusFuncCodeReadFileRecord:
+		return "file records"
+	}
+	return fmt.Sprintf("function %d", function)
+}
+
+// tagValue converts a decoded value to engineering units as defined by the entry's scaling.
+// Values that are not numeric (strings and bit arrays) are passed through unscaled. Values
+// clamped by the scaling are uncertain, and values that are not finite numbers bad.
+func tagValue(entry common.ModbusEntry, value interface{}) common.TagValue {
+	return scaledValue(entry.RegisterName, entry.Scaling, value)
+}
+
+// scaledValue converts the value of the named tag to engineering units as tagValue does
+func scaledValue(name string, scaling common.Scaling, value interface{}) common.TagValue {
+	tag := common.TagValue{Unit: scaling.Unit, Quality: define.QualityGood}
+	raw, err := toFloat64(value)
+	if err == nil && (math.IsNaN(raw) || math.IsInf(raw, 0)) {
+		return common.TagValue{Unit: scaling.Unit, Quality: define.QualityBad, Error: fmt.Sprintf("%s is not a finite number", name)}
 	}
-	entries := common.EquipmentConfig.MachineIntegrations.FindModbusEntriesByFunction([]int{modbus.FuncCodeReadInputRegisters})
-	for _, v := range entries {
-		value, err := svc.client.ReadInputRegisters(uint16(v.Address), 1)
-		if err != nil {
-			return fmt.Errorf("Error reading input register %s, %s", v.Desc["en"], err)
+	if err == nil && scaling.IsScaled() {
+		var clamped bool
+		if value, clamped = scaling.Convert(raw); clamped {
+			tag.Quality = define.QualityUncertain
+			tag.Error = fmt.Sprintf("%s raw value %v out of range", name, raw)
 		}
-		m[v.RegisterName] = BytesToInt16(value)
 	}
-	return nil
+	tag.Value = value
+	return tag
+}
+
+// badValue reports an entry that could not be read or decoded
+func badValue(entry common.ModbusEntry, reason error) common.TagValue {
+	return common.TagValue{Unit: entry.Unit, Quality: define.QualityBad, Error: reason.Error()}
+}
+
+// bitAt returns the bit (as 0 or 1) at the passed offset within a packed coil/discrete input
+// response, or an error should the response be too short to hold it
+func bitAt(b []byte, offset int) (byte, error) {
+	if offset < 0 || offset/8 >= len(b) {
+		return 0, fmt.Errorf("response of %d bytes holds no bit %d", len(b), offset)
+	}
+	return (b[offset/8] >> uint(offset%8)) & 1, nil
+}
+
+// registersAt returns the bytes of count registers starting at the passed register offset
+// within a register response, or an error should the response be too short to hold them
+func registersAt(b []byte, offset int, count int) ([]byte, error) {
+	if offset < 0 || count < 0 || 2*(offset+count) > len(b) {
+		return nil, fmt.Errorf("response of %d bytes holds no registers %d-%d", len(b), offset, offset+count-1)
+	}
+	return b[2*offset : 2*(offset+count)], nil
 }
 
 // BytesToUint16 converts the passed byte slice to an unsigned 16bit integer
@@ -142,3 +327,113 @@ func Int16ToBytes(u int16) []byte {
 	binary.BigEndian.PutUint16(buf, uint16(u))
 	return buf
 }
+
+// BytesToUint32 converts the passed byte slice to an unsigned 32bit integer
+func BytesToUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+// Uint32ToBytes converts an unsigned 32bit integer to a byte slice
+func Uint32ToBytes(u uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, u)
+	return buf
+}
+
+// BytesToInt32 converts the passed byte slice to a signed 32bit integer
+func BytesToInt32(b []byte) int32 {
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+// Int32ToBytes converts a signed 32bit integer to a byte slice
+func Int32ToBytes(i int32) []byte {
+	return Uint32ToBytes(uint32(i))
+}
+
+// BytesToFloat32 converts the passed byte slice to an IEEE 754 single precision float
+func BytesToFloat32(b []byte) float32 {
+	return math.Float32frombits(binary.BigEndian.Uint32(b))
+}
+
+// Float32ToBytes converts a single precision float to a byte slice
+func Float32ToBytes(f float32) []byte {
+	return Uint32ToBytes(math.Float32bits(f))
+}
+
+// BytesToFloat64 converts the passed byte slice to an IEEE 754 double precision float
+func BytesToFloat64(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// Float64ToBytes converts a double precision float to a byte slice
+func Float64ToBytes(f float64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(f))
+	return buf
+}
+
+// BytesToString converts the passed byte slice to an ASCII string, dropping trailing
+// NUL and space padding
+func BytesToString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00 "))
+}
+
+// StringToBytes converts a string to a byte slice of the passed number of registers,
+// padding with NULs or truncating as required
+func StringToBytes(s string, registers int) []byte {
+	buf := make([]byte, 2*registers)
+	copy(buf, s)
+	return buf
+}
+
+// BytesToBits unpacks the passed register bytes into bits, least significant bit of the
+// last byte of each register first
+func BytesToBits(b []byte) []bool {
+	bits := make([]bool, 8*len(b))
+	for i := range bits {
+		bits[i] = RegisterBitAt(b, i)
+	}
+	return bits
+}
+
+// BitsToBytes packs bits into register bytes, the inverse of BytesToBits
+func BitsToBytes(bits []bool) []byte {
+	buf := make([]byte, 2*((len(bits)+15)/16))
+	for i, bit := range bits {
+		if bit {
+			register := i / 16
+			offset := uint(i % 16)
+			buf[2*register+1-int(offset/8)] |= 1 << (offset % 8)
+		}
+	}
+	return buf
+}
+
+// RegisterBitAt returns the bit at the passed index within register bytes, bit 0 being the
+// least significant bit of the first register
+func RegisterBitAt(b []byte, index int) bool {
+	register := index / 16
+	offset := uint(index % 16)
+	return b[2*register+1-int(offset/8)]&(1<<(offset%8)) != 0
+}
+
+// SwapBytes returns a copy of the passed register bytes with the two bytes of each
+// register exchanged
+func SwapBytes(b []byte) []byte {
+	buf := make([]byte, len(b))
+	for i := 0; i+1 < len(b); i += 2 {
+		buf[i], buf[i+1] = b[i+1], b[i]
+	}
+	return buf
+}
+
+// SwapWords returns a copy of the passed register bytes with the order of the registers
+// reversed, e.g. ABCD becomes CDAB for a 32bit value
+func SwapWords(b []byte) []byte {
+	buf := make([]byte, len(b))
+	registers := len(b) / 2
+	for i := 0; i < registers; i++ {
+		copy(buf[2*i:2*i+2], b[2*(registers-1-i):2*(registers-i)])
+	}
+	return buf
+}
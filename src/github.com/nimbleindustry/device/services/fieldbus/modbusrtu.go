@@ -0,0 +1,199 @@
+package fieldbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	modbusDefaultBaudrate = 19200
+	modbusDefaultDataBits = 8
+	modbusDefaultParity   = "E"
+	modbusDefaultStopBits = 1
+	modbusDefaultUnitID   = 1
+)
+
+// ModbusRTUService provides access to configured modbus rtu (serial) interfaces. The serial
+// port is held open between polls; should it fail to open it is retried with exponential
+// backoff, the service exiting (to be restarted by its supervisor) only after repeated failures.
+type ModbusRTUService struct {
+	common.Service
+	GenericModbusService
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop chan bool
+}
+
+// NewModbusRTUService returns a service for the modbus rtu slave(s) of the passed connection
+// record, named for the record
+func NewModbusRTUService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *ModbusRTUService {
+	svc := &ModbusRTUService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *ModbusRTUService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	// initialize the modbus connection and mappings
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr == nil {
+		fieldBusErr = svc.initLine()
+	}
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for modbus, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	writes := writeRoutes.register(svc.Name, svc.writableTags())
+	defer writeRoutes.unregister(svc.Name, writes)
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case cmd := <-writes:
+			svc.write(cmd)
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.address)
+		case <-time.After(svc.schedule.untilNext(time.Now())):
+			// collect the modbus input values of each poll group that is due
+			if err := svc.poll(); err != nil {
+				// reopening the serial port in place has not worked, force supervisor recovery
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed attempts to open serial port: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *ModbusRTUService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *ModbusRTUService) State() int {
+	return svc.ServiceState
+}
+
+func (svc *ModbusRTUService) clean() {
+	svc.closeConnection()
+}
+
+// newRTUClientHandler builds a serial handler from the supplied connection record, substituting
+// the modbus serial line defaults (19200 baud, 8 data bits, even parity, 1 stop bit) for unset fields.
+// The handler frames requests and supplies the port's settings; it never opens the port, which
+// the serialLine does, holding it open however slowly the line is polled.
+func newRTUClientHandler(record common.ConnectionRecord) *modbus.RTUClientHandler {
+	handler := modbus.NewRTUClientHandler(record.Endpoint)
+	handler.BaudRate = record.Baudrate
+	if handler.BaudRate == 0 {
+		handler.BaudRate = modbusDefaultBaudrate
+	}
+	handler.DataBits = record.DataBits
+	if handler.DataBits == 0 {
+		handler.DataBits = modbusDefaultDataBits
+	}
+	handler.Parity = record.Parity
+	if handler.Parity == "" {
+		handler.Parity = modbusDefaultParity
+	}
+	handler.StopBits = record.StopBits
+	if handler.StopBits == 0 {
+		handler.StopBits = modbusDefaultStopBits
+	}
+	handler.SlaveId = byte(record.UnitID)
+	if record.UnitID == 0 {
+		handler.SlaveId = modbusDefaultUnitID
+	}
+	handler.Timeout = modbusConnectionTimeout
+	return handler
+}
+
+// rtuPackager frames requests as the RTU packager it wraps does, verifying the CRC of responses
+// itself so that a failed check is counted as such
+type rtuPackager struct {
+	modbus.Packager
+}
+
+// Decode extracts the PDU of an RTU response frame once its CRC is verified
+func (p rtuPackager) Decode(adu []byte) (*modbus.ProtocolDataUnit, error) {
+	if len(adu) > 2 {
+		received := binary.LittleEndian.Uint16(adu[len(adu)-2:])
+		if expected := rtuChecksum(adu[:len(adu)-2]); received != expected {
+			return nil, &checksumError{what: "response crc", received: fmt.Sprintf("%04X", received),
+				expected: fmt.Sprintf("%04X", expected)}
+		}
+	}
+	return p.Packager.Decode(adu)
+}
+
+// initLine prepares the service to open the serial port of its connection
+func (svc *ModbusRTUService) initLine() error {
+	if svc.connection.Type == "" {
+		return errors.New("No modbusRTU connection records")
+	}
+	svc.address = svc.connection.Endpoint
+	svc.setup(svc.Name, "modbus serial line", svc.LogFunc, svc)
+	return nil
+}
+
+// dial opens the serial port, which other slaves on the line share
+func (svc *ModbusRTUService) dial(address string) (pollConnection, error) {
+	line, err := openSerialLine(svc.connection)
+	if err != nil {
+		return nil, err
+	}
+	handler := newRTUClientHandler(svc.connection)
+	svc.client = newPDUClient(rtuPackager{handler}, line)
+	svc.unitClient = func(unitID int) *pduClient {
+		record := svc.connection
+		record.UnitID = unitID
+		return newPDUClient(rtuPackager{newRTUClientHandler(record)}, line)
+	}
+	svc.unitClients = nil
+	return line, nil
+}
@@ -0,0 +1,121 @@
+package fieldbus
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModbusRTUPollDriverRead(t *testing.T) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer master.Close()
+	// hold the slave side open so the master does not see a hangup between polls
+	keepAlive, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	assert.Nil(t, err, "unable to open pty slave")
+	defer keepAlive.Close()
+
+	slave := newStandinSlave(7)
+	slave.discreteInputs[0] = true
+	slave.coils[0] = true
+	slave.holdingRegisters[0] = 1
+	slave.inputRegisters[0] = 0xFFF6
+	go ServeModbusRTU(master, slave)
+
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: slavePath, Baudrate: 115200, UnitID: 7}
+	common.ConnectionConfig = common.Connections{DeviceID: "test", MachineConnections: []common.ConnectionRecord{record}}
+	common.EquipmentConfig = common.Equipment{}
+	err = json.Unmarshal([]byte(modbusEquipmentFixture), &common.EquipmentConfig)
+	assert.Nil(t, err, "unmarshall failed")
+
+	svc := &ModbusRTUService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	assert.Nil(t, svc.initConfigurations())
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Nil(t, svc.initLine())
+	assert.Nil(t, svc.connect(), "expected serial port to open")
+	defer svc.closeConnection()
+
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err, "expected the poll group read to succeed")
+	assert.Equal(t, byte(1), m["TankFull"].Value)
+	assert.Equal(t, byte(0), m["TankEmpty"].Value)
+	assert.Equal(t, byte(1), m["CommandPump"].Value)
+	assert.Equal(t, int16(1), m["SystemRun"].Value)
+	assert.Equal(t, int16(-10), m["LiquidTemp"].Value)
+	assert.Equal(t, 4, slave.Requests(), "expected both discrete inputs to be read in one request")
+
+	line := svc.conn
+	assert.Nil(t, svc.connect())
+	assert.True(t, line == svc.conn, "expected the serial port to be held open between polls")
+}
+
+func TestSerialLineFailsWithItsPort(t *testing.T) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: slavePath, Baudrate: 115200, UnitID: 1}
+	line, err := openSerialLine(record)
+	assert.Nil(t, err, "expected serial port to open")
+	defer line.release()
+	client := modbus.NewClient2(rtuPackager{newRTUClientHandler(record)}, line)
+
+	// the terminal hanging up fails the line, which the next user opens anew
+	master.Close()
+	_, err = client.ReadHoldingRegisters(0, 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, err, line.Err())
+	serialLines.Lock()
+	_, open := serialLines.open[record.Endpoint]
+	serialLines.Unlock()
+	assert.False(t, open, "expected a failed line to be opened anew")
+}
+
+func TestModbusRTUExtendedFunctions(t *testing.T) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer master.Close()
+	keepAlive, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	assert.Nil(t, err, "unable to open pty slave")
+	defer keepAlive.Close()
+
+	// the slave's responses arrive in pieces, as from a slow line or a buffering converter
+	slave := newStandinSlave(7)
+	slave.SetFIFO(30, []uint16{1, 0xFFFE, 3})
+	slave.SetFile(4, []uint16{0, 0, 0x4D49, 0x582D, 0x4100, 0})
+	go servePiecemeal(master, slave)
+
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: slavePath, Baudrate: 115200, UnitID: 7}
+	svc := &ModbusRTUService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "Events", Functions: []int{24}, Address: 30},
+		{RegisterName: "Recipe", Functions: []int{20, 21}, File: 4, Address: 2, DataType: common.DataTypeString, Count: 4},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Nil(t, svc.initLine())
+	assert.Nil(t, svc.connect(), "expected serial port to open")
+	defer svc.closeConnection()
+
+	// goburrow's rtu transporter reads 4 bytes of these responses, leaving the rest to
+	// corrupt the next transaction
+	for i := 0; i < 3; i++ {
+		m, err := svc.read(svc.schedule.groups[0].members)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{int16(1), int16(-2), int16(3)}, m["Events"].Value)
+		assert.Equal(t, "MIX-A", m["Recipe"].Value)
+	}
+}
@@ -0,0 +1,43 @@
+package fieldbus
+
+import (
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTUClientHandlerDefaults(t *testing.T) {
+	handler := newRTUClientHandler(common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: "/dev/ttyS0"})
+	assert.Equal(t, "/dev/ttyS0", handler.Address)
+	assert.Equal(t, 19200, handler.BaudRate, "expected modbus default baud rate")
+	assert.Equal(t, 8, handler.DataBits)
+	assert.Equal(t, "E", handler.Parity, "expected modbus default even parity")
+	assert.Equal(t, 1, handler.StopBits)
+	assert.Equal(t, byte(1), handler.SlaveId)
+
+	handler = newRTUClientHandler(common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: "/dev/ttyS1",
+		Baudrate: 9600, Parity: "N", StopBits: 2, UnitID: 17})
+	assert.Equal(t, 9600, handler.BaudRate)
+	assert.Equal(t, "N", handler.Parity)
+	assert.Equal(t, 2, handler.StopBits)
+	assert.Equal(t, byte(17), handler.SlaveId)
+}
+
+func TestRTUOpenBacksOff(t *testing.T) {
+	record := common.ConnectionRecord{Type: define.ModbusRTU, Endpoint: "/nonexistent/ttyS0"}
+	svc := NewModbusRTUService(record, func(s string) { t.Log(s) }, 0)
+	assert.Nil(t, svc.initLine())
+
+	states := watchConnectionState(svc.Name)
+	assert.NotNil(t, svc.connect())
+	status := <-states
+	assert.Equal(t, define.ConnectionDisconnected, status.State)
+	assert.Equal(t, 1, status.Failures)
+
+	err := svc.connect()
+	assert.Contains(t, err.Error(), "deferred", "expected immediate reopen to be deferred")
+	assert.Equal(t, 1, svc.backoff.failures)
+}
@@ -0,0 +1,195 @@
+package fieldbus
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	modbusServerDefaultPort = 502
+	modbusServerWriteQueue  = 64
+	modbusServerReportQueue = 64
+)
+
+// ModbusServerService runs an embedded modbus tcp server (slave) serving the latest tag values
+// reported by every fieldbus service, laid out per the modbusServer register map of the
+// connections config. This allows local HMIs and SCADA that only speak modbus to read the
+// values gathered from several devices through a single map. Client writes to writable
+// entries are optionally forwarded to the source tags as write commands.
+type ModbusServerService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop      chan bool
+	config    *common.ModbusServerConfig
+	registers *serverMap
+	server    *ModbusTCPServer
+	forwarded chan common.WriteCommand // writes decoded by server connections, see clientWrote
+	sequence  int
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *ModbusServerService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+	svc.forwarded = make(chan common.WriteCommand, modbusServerWriteQueue)
+
+	svc.reload()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	configs := common.BusChannel(define.ConnectivityConfigUpdated)
+	// reports are held while a client is answered, fieldbus services polling at the same instant
+	reports := common.BufferedBusChannel(define.TopicOpsReport, modbusServerReportQueue)
+	// acknowledgements are held while the register map is updated, so that none goes unlogged
+	acks := common.BufferedBusChannel(define.TopicWriteAck, modbusServerWriteQueue)
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.closeServer()
+			return
+		case <-configs:
+			svc.reload()
+		case msg := <-reports:
+			svc.update(msg.(common.OpsReport))
+		case cmd := <-svc.forwarded:
+			svc.forward(cmd)
+		case msg := <-acks:
+			svc.acknowledged(msg.(*common.WriteAck))
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *ModbusServerService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *ModbusServerService) State() int {
+	return svc.ServiceState
+}
+
+// reload (re)starts the server if its configuration has changed, stopping it if the
+// configuration has been removed
+func (svc *ModbusServerService) reload() {
+	config := common.ConnectionConfig.ModbusServer
+	if svc.server != nil && reflect.DeepEqual(config, svc.config) {
+		return
+	}
+	svc.closeServer()
+	svc.config = config
+	if config == nil {
+		svc.LogFunc(fmt.Sprintf("%s idles, no modbus server is configured", svc.Name))
+		return
+	}
+	if err := svc.start(*config); err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to start modbus server, %s", svc.Name, err))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s serves %d tags on %s", svc.Name, len(config.Registers), svc.server.Addr()))
+}
+
+// start builds the register map and begins listening for modbus tcp clients
+func (svc *ModbusServerService) start(config common.ModbusServerConfig) error {
+	registers, err := newServerMap(config.Registers, config.UnitID)
+	if err != nil {
+		return err
+	}
+	port := config.Port
+	if port == 0 {
+		port = modbusServerDefaultPort
+	}
+	// the hook is set before clients can connect, as their connections call it
+	if config.ForwardWrites {
+		registers.slave.Written = svc.clientWrote(registers)
+	}
+	server, err := ListenModbusTCP(net.JoinHostPort(config.Endpoint, strconv.Itoa(port)), registers.slave)
+	if err != nil {
+		return err
+	}
+	svc.registers, svc.server = registers, server
+	return nil
+}
+
+func (svc *ModbusServerService) closeServer() {
+	if svc.server != nil {
+		svc.server.Close()
+		svc.server, svc.registers = nil, nil
+	}
+}
+
+// clientWrote returns the slave's Written hook. Writes are decoded on the client connection's
+// goroutine, before a subsequent report can overwrite them, and queued for forwarding.
+func (svc *ModbusServerService) clientWrote(registers *serverMap) func(int, int, int) {
+	return func(table int, address int, quantity int) {
+		commands, errs := registers.written(table, address, quantity)
+		for _, err := range errs {
+			svc.LogFunc(fmt.Sprintf("%s warns: unable to decode client write, %s", svc.Name, err))
+		}
+		for _, cmd := range commands {
+			select {
+			case svc.forwarded <- cmd:
+			default:
+				svc.LogFunc(fmt.Sprintf("%s warns: write queue full, %s not forwarded", svc.Name, cmd.Tag))
+			}
+		}
+	}
+}
+
+// update stores the values of an ops report in the register map
+func (svc *ModbusServerService) update(report common.OpsReport) {
+	if svc.registers == nil {
+		return
+	}
+	for _, err := range svc.registers.update(report) {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, err))
+	}
+}
+
+// forward sends a client write to the fieldbus services, identified as originating here
+func (svc *ModbusServerService) forward(cmd common.WriteCommand) {
+	svc.sequence++
+	cmd.ID = fmt.Sprintf("%s-%d", svc.Name, svc.sequence)
+	svc.LogFunc(fmt.Sprintf("%s forwards client write of %v to %s", svc.Name, cmd.Value, cmd.Tag))
+	common.SendBusMessage(define.TopicWriteCommand, &cmd)
+}
+
+// acknowledged logs the outcome of a forwarded write, ignoring acknowledgements of writes
+// that originated elsewhere
+func (svc *ModbusServerService) acknowledged(ack *common.WriteAck) {
+	if strings.HasPrefix(ack.ID, svc.Name+"-") && !ack.Success {
+		svc.LogFunc(fmt.Sprintf("%s warns: forwarded write to %s failed, %s", svc.Name, ack.Tag, ack.Error))
+	}
+}
@@ -0,0 +1,194 @@
+package fieldbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+// serverMapFixture aggregates the tags of two devices into a single register map
+var serverMapFixture = []common.ModbusEntry{
+	{RegisterName: "drive1.Speed", Functions: []int{4}, Address: 0, Scaling: common.Scaling{Multiplier: 0.1}},
+	{RegisterName: "drive2.Speed", Functions: []int{4}, Address: 1, Scaling: common.Scaling{Multiplier: 0.1}},
+	{RegisterName: "LiquidTemp", Functions: []int{4}, Address: 2, DataType: common.DataTypeFloat32},
+	{RegisterName: "TankFull", Functions: []int{2}, Address: 0},
+	{RegisterName: "CommandPump", Functions: []int{1, 5}, Address: 0},
+	{RegisterName: "Setpoint", Functions: []int{3, 16}, Address: 0, DataType: common.DataTypeFloat32, WordSwap: true},
+	{RegisterName: "Alarm", Functions: []int{3}, Address: 2, DataType: common.DataTypeBit, BitIndex: 0},
+	{RegisterName: "Mode", Functions: []int{3, 6}, Address: 3},
+}
+
+func TestModbusSlaveOverTCP(t *testing.T) {
+	slave := NewModbusSlave(1, 8, 8, 4, 4)
+	slave.SetRegisters(modbus.FuncCodeReadInputRegisters, 1, []byte{0x12, 0x34})
+	slave.SetBits(modbus.FuncCodeReadDiscreteInputs, 2, []bool{true})
+	server, err := ListenModbusTCP("127.0.0.1:0", slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	handler := modbus.NewTCPClientHandler(server.Addr().String())
+	handler.SlaveId = 1
+	handler.Timeout = time.Second
+	defer handler.Close()
+	client := modbus.NewClient(handler)
+
+	b, err := client.ReadInputRegisters(0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0x12, 0x34}, b)
+	b, err = client.ReadDiscreteInputs(0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x04}, b)
+
+	_, err = client.WriteMultipleRegisters(1, 2, []byte{0, 7, 0, 8})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 7, 0, 8}, slave.Registers(modbus.FuncCodeReadHoldingRegisters, 1, 2))
+	_, err = client.WriteSingleCoil(5, 0xFF00)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true}, slave.Bits(modbus.FuncCodeReadCoils, 5, 1))
+
+	_, err = client.ReadHoldingRegisters(3, 2)
+	assert.Equal(t, byte(modbus.ExceptionCodeIllegalDataAddress), err.(*modbus.ModbusError).ExceptionCode)
+	// goburrow's FIFO queue read miscounts the response, the service's own is used
+	slave.SetFIFO(0, []uint16{9, 10})
+	b, err = newPDUClient(handler, handler).readFIFOQueue(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 9, 0, 10}, b)
+	_, err = newPDUClient(handler, handler).readFIFOQueue(1)
+	assert.Equal(t, byte(modbus.ExceptionCodeIllegalDataAddress), err.(*modbus.ModbusError).ExceptionCode)
+
+	slave.Writable = func(table int, address int, quantity int) bool { return address != 0 }
+	_, err = client.WriteSingleRegister(0, 1)
+	assert.Equal(t, byte(modbus.ExceptionCodeIllegalDataAddress), err.(*modbus.ModbusError).ExceptionCode)
+
+	handler.SlaveId = 2
+	_, err = client.ReadInputRegisters(0, 1)
+	assert.Equal(t, byte(modbusExceptionGatewayTargetFailed), err.(*modbus.ModbusError).ExceptionCode)
+}
+
+func TestServerMapValidation(t *testing.T) {
+	m, err := newServerMap(serverMapFixture, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(m.slave.inputRegisters))
+	assert.Equal(t, 4, len(m.slave.holdingRegisters))
+	assert.Equal(t, 1, len(m.slave.coils))
+	assert.Equal(t, 1, len(m.slave.discreteInputs))
+
+	overlapping := append([]common.ModbusEntry{}, serverMapFixture...)
+	overlapping = append(overlapping, common.ModbusEntry{RegisterName: "Other", Functions: []int{4}, Address: 3})
+	_, err = newServerMap(overlapping, 1)
+	assert.Contains(t, err.Error(), "overlaps LiquidTemp")
+
+	sharing := []common.ModbusEntry{
+		{RegisterName: "Alarm", Functions: []int{3}, DataType: common.DataTypeBit, BitIndex: 0},
+		{RegisterName: "Warning", Functions: []int{3}, DataType: common.DataTypeBit, BitIndex: 1},
+	}
+	_, err = newServerMap(sharing, 1)
+	assert.Nil(t, err, "expected bit entries to share a register")
+
+	_, err = newServerMap([]common.ModbusEntry{{RegisterName: "Run", Functions: []int{6}}}, 1)
+	assert.NotNil(t, err, "expected entry without read function to be rejected")
+	_, err = newServerMap(serverMapFixture, 248)
+	assert.NotNil(t, err, "expected invalid unit ID to be rejected")
+}
+
+func TestServerMapUpdate(t *testing.T) {
+	m, err := newServerMap(serverMapFixture, 1)
+	assert.Nil(t, err)
+	errs := m.update(common.OpsReport{
+		"drive1.Speed": {Value: 152.3, Quality: define.QualityGood},
+		"drive2.Speed": {Value: 98.0, Quality: define.QualityStale},
+		"LiquidTemp":   {Value: float32(21.5), Quality: define.QualityGood},
+		"TankFull":     {Value: byte(1), Quality: define.QualityGood},
+		"Alarm":        {Value: true, Quality: define.QualityGood},
+		"Mode":         {Value: "auto", Quality: define.QualityGood},
+	})
+	assert.Equal(t, 1, len(errs), "expected string value of numeric entry to be reported")
+	assert.Equal(t, []byte{0x05, 0xF3, 0x03, 0xD4}, m.slave.Registers(modbus.FuncCodeReadInputRegisters, 0, 2))
+	assert.Equal(t, Float32ToBytes(21.5), m.slave.Registers(modbus.FuncCodeReadInputRegisters, 2, 2))
+	assert.Equal(t, []bool{true}, m.slave.Bits(modbus.FuncCodeReadDiscreteInputs, 0, 1))
+	assert.Equal(t, []byte{0, 1}, m.slave.Registers(modbus.FuncCodeReadHoldingRegisters, 2, 1))
+
+	// bad values leave the last served value in place
+	m.update(common.OpsReport{"drive1.Speed": {Quality: define.QualityBad, Error: "timeout"}})
+	assert.Equal(t, []byte{0x05, 0xF3}, m.slave.Registers(modbus.FuncCodeReadInputRegisters, 0, 1))
+
+	// an entry naming its source serves only that source's values, and forwards writes to it
+	entries := []common.ModbusEntry{{RegisterName: "Mode", Functions: []int{3, 6}, Address: 0, Source: "plc2"}}
+	m, err = newServerMap(entries, 1)
+	assert.Nil(t, err)
+	m.update(common.OpsReport{"Mode": {Value: 1, Quality: define.QualityGood, Source: "plc1"}})
+	m.update(common.OpsReport{"Mode": {Value: 2, Quality: define.QualityGood, Source: "plc2"}})
+	m.update(common.OpsReport{"Mode": {Value: 3, Quality: define.QualityGood, Source: "plc1"}})
+	assert.Equal(t, []byte{0, 2}, m.slave.Registers(modbus.FuncCodeReadHoldingRegisters, 0, 1))
+	m.slave.SetRegisters(modbus.FuncCodeReadHoldingRegisters, 0, []byte{0, 4})
+	commands, _ := m.written(modbus.FuncCodeReadHoldingRegisters, 0, 1)
+	assert.Equal(t, []common.WriteCommand{{Service: "plc2", Tag: "Mode", Value: int16(4)}}, commands)
+}
+
+func TestServerMapWrites(t *testing.T) {
+	m, err := newServerMap(serverMapFixture, 1)
+	assert.Nil(t, err)
+	holding := modbus.FuncCodeReadHoldingRegisters
+	assert.True(t, m.writable(holding, 0, 2))
+	assert.False(t, m.writable(holding, 0, 1), "expected partial write of float to be rejected")
+	assert.False(t, m.writable(holding, 2, 1), "expected read-only entry to be rejected")
+	assert.False(t, m.writable(holding, 0, 4))
+	assert.True(t, m.writable(holding, 3, 1))
+	assert.True(t, m.writable(modbus.FuncCodeReadCoils, 0, 1))
+
+	m.slave.SetRegisters(holding, 0, SwapWords(Float32ToBytes(2.5)))
+	commands, errs := m.written(holding, 0, 2)
+	assert.Empty(t, errs)
+	assert.Equal(t, []common.WriteCommand{{Tag: "Setpoint", Value: float32(2.5)}}, commands)
+	m.slave.SetBits(modbus.FuncCodeReadCoils, 0, []bool{true})
+	commands, _ = m.written(modbus.FuncCodeReadCoils, 0, 1)
+	assert.Equal(t, []common.WriteCommand{{Tag: "CommandPump", Value: true}}, commands)
+}
+
+func TestModbusServerForwardsWrites(t *testing.T) {
+	svc := &ModbusServerService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = define.ModbusServerServiceName
+	svc.forwarded = make(chan common.WriteCommand, modbusServerWriteQueue)
+	// borrow a free port for the server
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	config := common.ModbusServerConfig{Registers: serverMapFixture, ForwardWrites: true}
+	config.Endpoint, config.Port = "127.0.0.1", probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	assert.Nil(t, svc.start(config))
+	defer svc.closeServer()
+
+	svc.update(common.OpsReport{"drive1.Speed": {Value: 152.3, Quality: define.QualityGood}})
+	handler := modbus.NewTCPClientHandler(svc.server.Addr().String())
+	handler.Timeout = time.Second
+	defer handler.Close()
+	client := modbus.NewClient(handler)
+	b, err := client.ReadInputRegisters(0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0xF3}, b)
+
+	_, err = client.WriteSingleRegister(3, 2)
+	assert.Nil(t, err)
+	select {
+	case cmd := <-svc.forwarded:
+		assert.Equal(t, "Mode", cmd.Tag)
+		assert.Equal(t, int16(2), cmd.Value)
+	case <-time.After(time.Second):
+		t.Error("expected client write to be forwarded")
+	}
+	_, err = client.WriteSingleRegister(2, 1)
+	assert.NotNil(t, err, "expected write to read-only entry to be rejected")
+	assert.Equal(t, 0, len(svc.forwarded))
+
+	writes := common.BufferedBusChannel(define.TopicWriteCommand, 1)
+	svc.forward(common.WriteCommand{Tag: "Mode", Value: 2})
+	cmd := (<-writes).(*common.WriteCommand)
+	assert.Equal(t, define.ModbusServerServiceName+"-1", cmd.ID)
+	assert.Equal(t, "", cmd.Service, "expected write to be routed by tag")
+}
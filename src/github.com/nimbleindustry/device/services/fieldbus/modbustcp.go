@@ -7,7 +7,6 @@ import (
 
 	"github.com/nimbleindustry/device/common"
 	"github.com/nimbleindustry/device/define"
-	"github.com/nimbleindustry/device/integrations"
 
 	"github.com/goburrow/modbus"
 	"github.com/nimbleindustry/suture"
@@ -16,9 +15,15 @@ import (
 const (
 	modbusConnectionTimeout = 5 * time.Second
 	modbusSampleFrequency   = 5 * time.Second
+	modbusKeepAlive         = 30 * time.Second
+	modbusIdleTimeout       = 2 * time.Minute
 )
 
-// ModbusTCPService provides access to configured modbus tcp interfaces.
+// ModbusTCPService provides access to configured modbus tcp interfaces. The connection to the
+// slave is held open between polls; when it is lost it is re-established with exponential
+// backoff, the service exiting (to be restarted by its supervisor) only after repeated failures.
+// The connection's protocol selects MBAP framing over tcp (the default), rtu framing over tcp
+// (serial device servers) or MBAP framing over udp.
 type ModbusTCPService struct {
 	common.Service
 	GenericModbusService
@@ -26,10 +31,17 @@ type ModbusTCPService struct {
 	StartDelay time.Duration // Duration to delay prior to starting the service
 	LogFunc    func(string)  // Destination for logging
 
-	stop         chan bool
-	integrations []integrations.Integration
+	stop      chan bool
+	transport *tcpTransporter
+}
 
-	handler *modbus.TCPClientHandler
+// NewModbusTCPService returns a service for the modbus tcp slave of the passed connection
+// record, named for the record
+func NewModbusTCPService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *ModbusTCPService {
+	svc := &ModbusTCPService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	return svc
 }
 
 // Serve is called by this service's supervisor—it should not be called directly.
@@ -55,15 +67,22 @@ func (svc *ModbusTCPService) Serve() {
 	// initialize the modbus connection and mappings
 	configErr := svc.initConfigurations()
 	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr == nil {
+		fieldBusErr = svc.initTransport()
+	}
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
 	if configErr != nil || fieldBusErr != nil {
 		// configurations not set for modbus, we should wait for config update messages
 		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
 		return
 	}
-	if configErr == nil && fieldBusErr == nil {
-		svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
-	}
-	timeout := time.Duration(modbusSampleFrequency)
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	writes := writeRoutes.register(svc.Name, svc.writableTags())
+	defer writeRoutes.unregister(svc.Name, writes)
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
 	for {
 		// important to set the state here for dependent services
 		svc.ServiceState = suture.ServiceNormal
@@ -73,23 +92,19 @@ func (svc *ModbusTCPService) Serve() {
 			// Clean up resources here, know that Serve will get called again
 			svc.clean()
 			return
-		case <-time.After(timeout):
-			// collect all modbus input values
-			err := svc.initConnection()
-			if err != nil {
-				// there was a problem connecting to modbus, force backoff recovery
-				svc.LogFunc(fmt.Sprintf("%s exits due to connection error: %s", svc.Name, err))
-				return
-			}
-			m, err := svc.readAllInputs()
-			if err != nil {
-				svc.closeConnection()
-				svc.LogFunc(fmt.Sprintf("%s exits, error reading input data: %s", svc.Name, err))
+		case cmd := <-writes:
+			svc.write(cmd)
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.address)
+		case <-time.After(svc.untilNextEvent(time.Now())):
+			svc.closeIdleConnection(time.Now())
+			// collect the modbus input values of each poll group that is due
+			if err := svc.poll(); err != nil {
+				// reconnecting in place has not worked, force supervisor recovery
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
 				svc.ServiceState = suture.ServiceNotRunning
 				return
 			}
-			svc.closeConnection()
-			common.SendBusMessage(define.TopicOpsReport, m)
 		}
 	}
 }
@@ -111,33 +126,101 @@ func (svc *ModbusTCPService) clean() {
 	svc.closeConnection()
 }
 
-func (svc *ModbusTCPService) initConnection() error {
+// initTransport prepares the (unconnected) transport and client for the service's connection
+func (svc *ModbusTCPService) initTransport() error {
 	if svc.connection.Type == "" {
 		return errors.New("No modbusTCP connection records")
 	}
-	addr := svc.connection.Endpoint
-	port := svc.connection.Port
-	handler := modbus.NewTCPClientHandler(fmt.Sprintf("%s:%d", addr, port))
-	handler.Timeout = modbusConnectionTimeout
-	handler.SlaveId = 1
-	err := handler.Connect()
+	keepAlive, err := connectionDuration(svc.connection.KeepAlive, modbusKeepAlive)
+	if err != nil {
+		return fmt.Errorf("keepAlive %s", err)
+	}
+	idleTimeout, err := connectionDuration(svc.connection.IdleTimeout, modbusIdleTimeout)
 	if err != nil {
-		return err
+		return fmt.Errorf("idleTimeout %s", err)
+	}
+	address := fmt.Sprintf("%s:%d", svc.connection.Endpoint, svc.connection.Port)
+	svc.transport = &tcpTransporter{address: address, timeout: modbusConnectionTimeout,
+		keepAlive: keepAlive, idleTimeout: idleTimeout}
+	// the packager of a unit ID frames its requests for the transport
+	var packager func(unitID int) modbus.Packager
+	switch svc.connection.Protocol {
+	case "", define.ModbusProtocolTCP, define.ModbusProtocolUDP:
+		if svc.connection.Protocol == define.ModbusProtocolUDP {
+			svc.transport.network = "udp"
+			svc.transport.readFrame = readDatagram
+		}
+		packager = func(unitID int) modbus.Packager {
+			handler := modbus.NewTCPClientHandler(address)
+			handler.SlaveId = byte(unitID)
+			return handler
+		}
+	case define.ModbusProtocolRTUOverTCP:
+		svc.transport.readFrame = readRTUFrame
+		packager = func(unitID int) modbus.Packager {
+			handler := modbus.NewRTUClientHandler(address)
+			handler.SlaveId = byte(unitID)
+			return rtuPackager{handler}
+		}
+	default:
+		return fmt.Errorf("unknown modbus protocol %s", svc.connection.Protocol)
+	}
+	svc.address = address
+	svc.setup(svc.Name, "modbus slave", svc.LogFunc, svc)
+	unitID := svc.connection.UnitID
+	if unitID == 0 {
+		unitID = modbusDefaultUnitID
+	}
+	// every unit ID shares the one connection, as is the case with a tcp to rtu gateway
+	svc.unitClient = func(unitID int) *pduClient {
+		return newPDUClient(packager(unitID), svc.transport)
 	}
-	svc.LogFunc(fmt.Sprintf("%s establishes connection to modbus slave %s", svc.Name, handler.Address))
-	svc.handler = handler
-	svc.client = modbus.NewClient(handler)
+	svc.unitClients = nil
+	svc.client = svc.unitClient(unitID)
 	return nil
 }
 
-func (svc *ModbusTCPService) closeConnection() (err error) {
-	if svc.handler != nil {
-		err = svc.handler.Close()
-		if err != nil {
-			svc.LogFunc(fmt.Sprintf("%s reports error disconnecting from modbus slave %s, %s", svc.Name, svc.connection.Endpoint, err))
-		} else {
-			svc.LogFunc(fmt.Sprintf("%s disconnects from modbus slave %s", svc.Name, svc.connection.Endpoint))
-		}
+// connectionDuration parses an optional duration setting of a connection record, "0" disabling
+// the feature it controls
+func connectionDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("has invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// dial connects to the slave at the passed address, over the service's transport
+func (svc *ModbusTCPService) dial(address string) (pollConnection, error) {
+	if err := svc.transport.connect(); err != nil {
+		return nil, err
+	}
+	return svc.transport, nil
+}
+
+// closeIdleConnection closes the connection once it has been unused for its idle timeout
+func (svc *ModbusTCPService) closeIdleConnection(now time.Time) {
+	idleAt := svc.transport.idleAt()
+	if idleAt.IsZero() || now.Before(idleAt) {
+		return
+	}
+	svc.transport.close()
+	svc.conn = nil
+	svc.LogFunc(fmt.Sprintf("%s closes idle connection to modbus slave %s", svc.Name, svc.address))
+	svc.publishState(svc.Name, svc.address, define.ConnectionIdle, nil)
+}
+
+// untilNextEvent returns how long until the next poll group is due or the connection becomes idle
+func (svc *ModbusTCPService) untilNextEvent(now time.Time) time.Duration {
+	wait := svc.schedule.untilNext(now)
+	if idleAt := svc.transport.idleAt(); !idleAt.IsZero() && idleAt.Sub(now) < wait {
+		wait = idleAt.Sub(now)
+	}
+	if wait < 0 {
+		return 0
 	}
-	return
+	return wait
 }
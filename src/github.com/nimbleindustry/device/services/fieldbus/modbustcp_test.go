@@ -0,0 +1,250 @@
+package fieldbus
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTCPService returns a ModbusTCPService configured to poll the passed server
+func newTestTCPService(t *testing.T, server *ModbusTCPServer, idleTimeout string) *ModbusTCPService {
+	svc := &ModbusTCPService{LogFunc: func(s string) { t.Log(s) }}
+	svc.connection = standinRecord(define.ModbusTCP, server.Addr())
+	svc.connection.IdleTimeout = idleTimeout
+	svc.Name = connectionKey(svc.connection)
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "SystemRun", Functions: []int{3, 6}, Address: 0},
+		{RegisterName: "LiquidTemp", Functions: []int{4}, Address: 0},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Nil(t, svc.initTransport())
+	return svc
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	b := reconnectBackoff{min: time.Second, max: 10 * time.Second}
+	now := scheduleEpoch
+	assert.True(t, b.ready(now))
+	delays := []time.Duration{}
+	for i := 0; i < 6; i++ {
+		delays = append(delays, b.failed(now))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, delays)
+	assert.False(t, b.ready(now.Add(9*time.Second)))
+	assert.True(t, b.ready(now.Add(10*time.Second)))
+	assert.True(t, b.exhausted(6))
+	assert.False(t, b.exhausted(7))
+	b.succeeded()
+	assert.True(t, b.ready(now))
+	assert.Equal(t, time.Second, b.failed(now), "expected backoff to restart after success")
+}
+
+func TestConnectionDuration(t *testing.T) {
+	d, err := connectionDuration("", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, d)
+	d, err = connectionDuration("0", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	_, err = connectionDuration("-1s", time.Minute)
+	assert.NotNil(t, err)
+	_, err = connectionDuration("soon", time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestTCPConnectionPersistsAcrossPolls(t *testing.T) {
+	slave := newStandinSlave(1)
+	slave.inputRegisters[0] = 215
+	server, err := listenStandin(slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, svc.connect())
+		m, err := svc.read(svc.schedule.groups[0].members)
+		assert.Nil(t, err)
+		assert.Equal(t, int16(215), m["LiquidTemp"].Value)
+	}
+	assert.Equal(t, 1, waitForAccepts(server, 1), "expected a single connection to serve every poll")
+}
+
+func TestTCPReconnectsAfterConnectionLoss(t *testing.T) {
+	slave := newStandinSlave(1)
+	server, err := listenStandin(slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	states := watchConnectionState(svc.Name)
+	assert.Nil(t, svc.connect())
+	assert.Equal(t, define.ConnectionConnected, (<-states).State)
+
+	waitForAccepts(server, 1)
+	server.DropConnections()
+	states = watchConnectionState(svc.Name)
+	_, err = svc.read(svc.schedule.groups[0].members)
+	assert.NotNil(t, err, "expected read over dropped connection to fail")
+	svc.checkConnection(err)
+	assert.False(t, svc.transport.connected())
+	status := <-states
+	assert.Equal(t, define.ConnectionDisconnected, status.State)
+	assert.NotEmpty(t, status.Error)
+
+	assert.Nil(t, svc.connect(), "expected reconnect in place")
+	_, err = svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, waitForAccepts(server, 2))
+}
+
+func TestTCPConnectBacksOff(t *testing.T) {
+	server, err := listenStandin(newStandinSlave(1))
+	assert.Nil(t, err, "unable to listen")
+	svc := newTestTCPService(t, server, "")
+	// nothing listens on the port once the server is closed
+	server.Close()
+
+	states := watchConnectionState(svc.Name)
+	assert.NotNil(t, svc.connect())
+	status := <-states
+	assert.Equal(t, define.ConnectionDisconnected, status.State)
+	assert.Equal(t, 1, status.Failures)
+	assert.True(t, status.RetryIn > 0 && status.RetryIn <= fieldbusReconnectMinDelay)
+
+	err = svc.connect()
+	assert.Contains(t, err.Error(), "deferred", "expected immediate retry to be deferred")
+	assert.Equal(t, 1, svc.backoff.failures)
+}
+
+func TestTCPClosesIdleConnection(t *testing.T) {
+	server, err := listenStandin(newStandinSlave(1))
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "50ms")
+	assert.Nil(t, svc.connect())
+	now := time.Now()
+	assert.True(t, svc.untilNextEvent(now) <= 50*time.Millisecond, "expected to wake for the idle timeout")
+	svc.closeIdleConnection(now)
+	assert.True(t, svc.transport.connected(), "expected connection to remain open until idle")
+
+	svc.closeIdleConnection(now.Add(60 * time.Millisecond))
+	assert.False(t, svc.transport.connected(), "expected idle connection to be closed")
+	assert.Nil(t, svc.connect(), "expected idle connection to reopen on demand")
+	assert.Equal(t, 2, waitForAccepts(server, 2))
+	svc.closeConnection()
+}
+
+// newProtocolTestService returns a ModbusTCPService using the passed protocol to poll the
+// slave at the passed address
+func newProtocolTestService(t *testing.T, protocol string, addr net.Addr) *ModbusTCPService {
+	host, port, _ := net.SplitHostPort(addr.String())
+	record := common.ConnectionRecord{Type: define.ModbusTCP, Protocol: protocol, Endpoint: host}
+	record.Port, _ = strconv.Atoi(port)
+	svc := NewModbusTCPService(record, func(s string) { t.Log(s) }, 0)
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "SystemRun", Functions: []int{3, 6}, Address: 0},
+		{RegisterName: "LiquidTemp", Functions: []int{4}, Address: 0, DataType: common.DataTypeFloat32},
+		{RegisterName: "TankFull", Functions: []int{2}, Address: 1},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Nil(t, svc.initTransport())
+	return svc
+}
+
+func protocolTestSlave() *ModbusSlave {
+	slave := NewModbusSlave(1, 0, 8, 1, 2)
+	slave.SetRegisters(modbus.FuncCodeReadInputRegisters, 0, []byte{0x41, 0xAC, 0, 0})
+	slave.SetBits(modbus.FuncCodeReadDiscreteInputs, 1, []bool{true})
+	slave.Identification = DeviceIdentification{0: "Nimble", 1: "ND-100", 2: "1.2"}
+	return slave
+}
+
+func TestRTUOverTCPTransport(t *testing.T) {
+	slave := protocolTestSlave()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ServeModbusRTU(conn, slave)
+		}
+	}()
+
+	svc := newProtocolTestService(t, define.ModbusProtocolRTUOverTCP, listener.Addr())
+	defer svc.closeConnection()
+	assert.Nil(t, svc.connect())
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, float32(21.5), m["LiquidTemp"].Value)
+	assert.Equal(t, byte(1), m["TankFull"].Value)
+	assert.Equal(t, define.QualityGood, m["SystemRun"].Quality)
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "SystemRun", Value: 7}).Error)
+	assert.Equal(t, []byte{0, 7}, slave.Registers(modbus.FuncCodeReadHoldingRegisters, 0, 1))
+
+	handler := modbus.NewRTUClientHandler("")
+	handler.SlaveId = 1
+	id, err := ReadDeviceIdentification(handler, svc.transport)
+	assert.Nil(t, err)
+	assert.Equal(t, slave.Identification, id)
+
+	svc.transport.timeout = 100 * time.Millisecond
+	client, _ := svc.clientFor(2)
+	_, err = client.ReadInputRegisters(0, 1)
+	assert.NotNil(t, err, "expected request to another unit to go unanswered")
+	assert.False(t, svc.transport.connected(), "expected timed out connection to be closed")
+}
+
+func TestUDPTransport(t *testing.T) {
+	slave := protocolTestSlave()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	defer conn.Close()
+	go func() {
+		var frame [modbusTCPMaxLength]byte
+		for {
+			n, addr, err := conn.ReadFrom(frame[:])
+			if err != nil {
+				return
+			}
+			if n <= modbusTCPHeaderSize {
+				continue
+			}
+			function, data := slave.Handle(frame[6], frame[modbusTCPHeaderSize], frame[modbusTCPHeaderSize+1:n])
+			response := append(append([]byte{}, frame[:modbusTCPHeaderSize]...), function)
+			binary.BigEndian.PutUint16(response[4:], uint16(2+len(data)))
+			conn.WriteTo(append(response, data...), addr)
+		}
+	}()
+
+	svc := newProtocolTestService(t, define.ModbusProtocolUDP, conn.LocalAddr())
+	defer svc.closeConnection()
+	assert.Nil(t, svc.connect())
+	for i := 0; i < 2; i++ {
+		m, err := svc.read(svc.schedule.groups[0].members)
+		assert.Nil(t, err)
+		assert.Equal(t, float32(21.5), m["LiquidTemp"].Value)
+		assert.Equal(t, byte(1), m["TankFull"].Value)
+	}
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "SystemRun", Value: 9}).Error)
+	assert.Equal(t, []byte{0, 9}, slave.Registers(modbus.FuncCodeReadHoldingRegisters, 0, 1))
+
+	record := svc.connection
+	record.Protocol = "modbusASCII"
+	svc = NewModbusTCPService(record, func(s string) { t.Log(s) }, 0)
+	assert.NotNil(t, svc.initTransport(), "expected unknown protocol to be rejected")
+}
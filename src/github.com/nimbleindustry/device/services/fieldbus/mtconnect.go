@@ -0,0 +1,446 @@
+package fieldbus
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/mtconnect"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	mtconnectLines       = 256 // lines buffered between the connection and the service
+	mtconnectDialTimeout = 10 * time.Second
+	// heartbeats that may pass without a line before the adapter is deemed lost
+	mtconnectMissedHeartbeats = 2
+)
+
+// MTConnectService reads the SHDR stream of an MTConnect adapter, at the connection record's
+// endpoint (a host, the port defaulting to 7878), reporting the data items of the equipment
+// config's mtconnect section. Adapters send each data item as it changes, and all of them on
+// connecting; the latest value of each is reported at the section's interval. Adapters that
+// answer pings are pinged at the heartbeat they give, and are deemed lost should they fall
+// silent. The connection is reestablished with exponential backoff should it fail, the
+// service exiting (to be restarted by its supervisor) only after repeated failures.
+type MTConnectService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop        chan bool
+	connection  common.ConnectionRecord
+	integration *common.MTConnectIntegration
+	pollGroups  []common.PollGroup
+	items       []mtconnectItem
+	byKey       map[string]*mtconnectItem
+	fields      map[string]int // of the keys of data items not of a single value
+	interval    time.Duration  // the interval at which values are reported
+	dial        func(address string) (net.Conn, error)
+
+	conn       net.Conn
+	lines      chan string
+	failed     chan error    // the error that ended reception from the adapter
+	closed     chan struct{} // closed with the connection, ending its reception
+	heartbeat  time.Duration // given by the adapter's PONG, zero if it does not answer pings
+	pinged     time.Time     // when the adapter was last pinged
+	received   time.Time     // when a line was last received
+	pending    common.OpsReport
+	lastValues map[string]common.TagValue // last value of each tag, for stale reporting
+	fieldbusMonitor
+}
+
+// mtconnectItem is a data item reported as a tag, along with its active conditions
+type mtconnectItem struct {
+	common.MTConnectDataItem
+	name       string
+	conditions mtconnect.Conditions
+}
+
+// NewMTConnectService returns a service for the adapter of the passed connection record,
+// named for the record
+func NewMTConnectService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *MTConnectService {
+	svc := &MTConnectService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	svc.dial = func(address string) (net.Conn, error) {
+		return net.DialTimeout("tcp", address, mtconnectDialTimeout)
+	}
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *MTConnectService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for mtconnect, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	report := time.NewTicker(svc.interval)
+	defer report.Stop()
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	reconnect := time.NewTimer(svc.untilReconnect(time.Now()))
+	defer reconnect.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case line := <-svc.lines:
+			svc.receive(line, time.Now())
+		case err := <-svc.failed:
+			svc.lose(err)
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		case now := <-report.C:
+			connected := svc.conn != nil
+			svc.keepAlive(now)
+			svc.report()
+			if connected && svc.conn == nil {
+				// a missed heartbeat lost the connection
+				resetTimer(reconnect, svc.untilReconnect(time.Now()))
+			}
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.address())
+		case <-reconnect.C:
+			if err := svc.connect(); err != nil && svc.backoff.exhausted(fieldbusReconnectAttempts) {
+				// reconnecting in place has not worked, force supervisor recovery
+				svc.publishState(svc.Name, svc.address(), define.ConnectionFailed, err)
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *MTConnectService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *MTConnectService) State() int {
+	return svc.ServiceState
+}
+
+func (svc *MTConnectService) clean() {
+	svc.closeConnection()
+}
+
+func (svc *MTConnectService) initConfigurations() error {
+	if common.ConnectionConfig.DeviceID == "" {
+		return errors.New("Connection config object not initialized")
+	}
+	if common.EquipmentConfig.Ref == "" {
+		return errors.New("Equipment config object not initialized")
+	}
+	svc.integration = common.EquipmentConfig.MachineIntegrations.MTConnect
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
+	return nil
+}
+
+// initBusIntegration validates the data items reported
+func (svc *MTConnectService) initBusIntegration() error {
+	if svc.connection.Type == "" {
+		return errors.New("No MTConnect connection records")
+	}
+	if svc.connection.Endpoint == "" {
+		return errors.New("MTConnect connection record has no endpoint")
+	}
+	if svc.integration == nil || len(svc.integration.DataItems) == 0 {
+		return errors.New("No mtconnect data items")
+	}
+	interval, err := sectionInterval("mtconnect section", svc.integration.PollGroup, svc.integration.PollInterval,
+		svc.pollGroups, modbusSampleFrequency)
+	if err != nil {
+		return err
+	}
+	svc.interval = interval
+	svc.items = make([]mtconnectItem, len(svc.integration.DataItems))
+	svc.byKey = make(map[string]*mtconnectItem, len(svc.items))
+	svc.fields = make(map[string]int)
+	names := make(map[string]bool, len(svc.items))
+	for i, v := range svc.integration.DataItems {
+		if v.Key == "" {
+			return fmt.Errorf("mtconnect data item %d has no key", i)
+		}
+		name := v.ReportedName()
+		switch v.Category {
+		case mtconnect.Sample, mtconnect.Event, mtconnect.Condition:
+		default:
+			return fmt.Errorf("%s has unknown category %q, expected SAMPLE, EVENT or CONDITION", name, v.Category)
+		}
+		if names[name] {
+			return fmt.Errorf("%s is defined more than once", name)
+		}
+		if svc.byKey[v.Key] != nil {
+			return fmt.Errorf("mtconnect key %s is selected more than once", v.Key)
+		}
+		names[name] = true
+		svc.items[i] = mtconnectItem{MTConnectDataItem: v, name: name}
+		svc.byKey[v.Key] = &svc.items[i]
+		if n := mtconnect.Fields(v.Category, v.Type); n != 1 {
+			svc.fields[v.Key] = n
+		}
+	}
+	svc.lines = make(chan string, mtconnectLines)
+	svc.pending = make(common.OpsReport)
+	svc.backoff = reconnectBackoff{min: fieldbusReconnectMinDelay, max: fieldbusReconnectMaxDelay}
+	return nil
+}
+
+// address returns the host:port of the adapter
+func (svc *MTConnectService) address() string {
+	port := svc.connection.Port
+	if port == 0 {
+		port = mtconnect.DefaultAdapterPort
+	}
+	return net.JoinHostPort(svc.connection.Endpoint, strconv.Itoa(port))
+}
+
+// untilReconnect returns how long until the adapter may be (re-)connected, an hour while it
+// is connected
+func (svc *MTConnectService) untilReconnect(now time.Time) time.Duration {
+	if svc.conn != nil {
+		return time.Hour
+	}
+	if wait := svc.backoff.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// connect connects to the adapter, asks it for heartbeats and starts receiving its lines. A
+// failure to connect is reported, and every tag reported stale.
+func (svc *MTConnectService) connect() error {
+	if svc.conn != nil {
+		return nil
+	}
+	now := time.Now()
+	if !svc.backoff.ready(now) {
+		return fmt.Errorf("reconnect to %s deferred for %s", svc.address(), svc.backoff.next.Sub(now))
+	}
+	conn, err := svc.dial(svc.address())
+	if err == nil {
+		if _, err = fmt.Fprintf(conn, "%s\n", mtconnect.PingCommand); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		countOutcome(&svc.diagnostics.FieldbusCounters, err)
+		delay := svc.backoff.failed(now)
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to connect to MTConnect adapter %s, retrying in %s: %s", svc.Name, svc.address(), delay, err))
+		svc.publishState(svc.Name, svc.address(), define.ConnectionDisconnected, err)
+		sendOpsReport(svc.Name, svc.staleReport(err))
+		return err
+	}
+	svc.conn = conn
+	svc.failed = make(chan error, 1)
+	svc.closed = make(chan struct{})
+	svc.heartbeat, svc.pinged, svc.received = 0, now, now
+	go receiveLines(conn, svc.lines, svc.failed, svc.closed)
+	svc.backoff.succeeded()
+	svc.countConnect()
+	svc.LogFunc(fmt.Sprintf("%s connects to MTConnect adapter %s", svc.Name, svc.address()))
+	svc.publishState(svc.Name, svc.address(), define.ConnectionConnected, nil)
+	return nil
+}
+
+// receiveLines passes the lines read from a connection to the service until the connection
+// fails, which is passed on failed, or is closed
+func receiveLines(conn net.Conn, lines chan<- string, failed chan<- error, closed <-chan struct{}) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			failed <- err
+			return
+		}
+		select {
+		case lines <- line:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// receive handles a line received at the passed time: a command, or the observations of data
+// items, whose values are held until the next report. Keys of data items not selected by the
+// mtconnect section are ignored.
+func (svc *MTConnectService) receive(line string, now time.Time) {
+	svc.received = now
+	if name, value, ok := mtconnect.ParseCommand(line); ok {
+		if name == "PONG" {
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				svc.LogFunc(fmt.Sprintf("%s warns: invalid heartbeat %q from MTConnect adapter %s", svc.Name, value, svc.address()))
+				return
+			}
+			svc.heartbeat = time.Duration(ms) * time.Millisecond
+		}
+		return
+	}
+	observations, err := mtconnect.ParseLine(line, svc.fields, now)
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	if err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: malformed SHDR line from %s, %s", svc.Name, svc.address(), err))
+	}
+	for _, o := range observations {
+		item := svc.byKey[o.Key]
+		if item == nil {
+			continue
+		}
+		value, err := svc.tagValue(item, o)
+		svc.count(item.name, err)
+		svc.pending[item.name] = value
+		if value.Quality != define.QualityBad {
+			if svc.lastValues == nil {
+				svc.lastValues = make(map[string]common.TagValue)
+			}
+			svc.lastValues[item.name] = value
+		}
+	}
+}
+
+// tagValue converts an observation to a tag value: a number of samples, the text of events
+// and the level of the most severe active condition. Unavailable data items are bad, as are
+// malformed values, whose error is returned.
+func (svc *MTConnectService) tagValue(item *mtconnectItem, o mtconnect.Observation) (common.TagValue, error) {
+	value := o.Value
+	if item.Category == mtconnect.Condition {
+		if err := item.conditions.Apply(o); err != nil {
+			err = fmt.Errorf("%s %s", item.name, err)
+			return common.TagValue{Unit: item.Unit, Quality: define.QualityBad, Error: err.Error()}, err
+		}
+		value = item.conditions.Level()
+	}
+	if value == mtconnect.Unavailable {
+		return common.TagValue{Unit: item.Unit, Quality: define.QualityBad, Error: fmt.Sprintf("%s is unavailable", item.name)}, nil
+	}
+	if item.Category != mtconnect.Sample {
+		return common.TagValue{Value: value, Unit: item.Unit, Quality: define.QualityGood}, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		err = fmt.Errorf("%s sample %q is not a number", item.name, value)
+		return common.TagValue{Unit: item.Unit, Quality: define.QualityBad, Error: err.Error()}, err
+	}
+	return scaledValue(item.name, item.Scaling, f), nil
+}
+
+// keepAlive pings an adapter that answers pings once its heartbeat has passed, losing it
+// should no line have been received for several heartbeats
+func (svc *MTConnectService) keepAlive(now time.Time) {
+	if svc.conn == nil || svc.heartbeat == 0 {
+		return
+	}
+	if silence := now.Sub(svc.received); silence > mtconnectMissedHeartbeats*svc.heartbeat {
+		svc.lose(fmt.Errorf("no heartbeat received in %s", silence))
+		return
+	}
+	if now.Sub(svc.pinged) >= svc.heartbeat {
+		svc.pinged = now
+		if _, err := fmt.Fprintf(svc.conn, "%s\n", mtconnect.PingCommand); err != nil {
+			svc.lose(err)
+		}
+	}
+}
+
+// report sends the values received since the last report on TopicOpsReport
+func (svc *MTConnectService) report() {
+	if len(svc.pending) == 0 {
+		return
+	}
+	report := svc.pending
+	svc.pending = make(common.OpsReport)
+	sendOpsReport(svc.Name, report)
+}
+
+// lose closes the failed connection, reporting every tag stale; the adapter is reconnected
+// once the backoff allows
+func (svc *MTConnectService) lose(err error) {
+	if svc.conn == nil {
+		return
+	}
+	svc.conn.Close()
+	svc.conn = nil
+	close(svc.closed)
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	svc.backoff.failed(time.Now())
+	svc.LogFunc(fmt.Sprintf("%s loses MTConnect adapter %s: %s", svc.Name, svc.address(), err))
+	svc.publishState(svc.Name, svc.address(), define.ConnectionDisconnected, err)
+	sendOpsReport(svc.Name, svc.staleReport(err))
+}
+
+// staleReport reports every tag as stale, carrying its last value forward (or bad if it has
+// none); values received but not yet reported are dropped and the active conditions cleared,
+// the adapter sending every data item again once reconnected
+func (svc *MTConnectService) staleReport(reason error) common.OpsReport {
+	svc.pending = make(common.OpsReport)
+	m := make(common.OpsReport, len(svc.items))
+	for i, v := range svc.items {
+		svc.items[i].conditions = mtconnect.Conditions{}
+		last, found := svc.lastValues[v.name]
+		if !found {
+			m[v.name] = common.TagValue{Unit: v.Unit, Quality: define.QualityBad, Error: reason.Error()}
+			continue
+		}
+		m[v.name] = common.TagValue{Value: last.Value, Unit: v.Unit, Quality: define.QualityStale, Error: reason.Error()}
+	}
+	return m
+}
+
+func (svc *MTConnectService) closeConnection() (err error) {
+	if svc.conn != nil {
+		err = svc.conn.Close()
+		svc.conn = nil
+		close(svc.closed)
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s reports error closing connection to MTConnect adapter %s, %s", svc.Name, svc.address(), err))
+		} else {
+			svc.LogFunc(fmt.Sprintf("%s closes connection to MTConnect adapter %s", svc.Name, svc.address()))
+		}
+		svc.publishState(svc.Name, svc.address(), define.ConnectionDisconnected, nil)
+	}
+	return
+}
@@ -0,0 +1,419 @@
+package mtconnect
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the version of MTConnect of the documents served
+const Version = "1.3.0"
+
+// DefaultAgentPort is the tcp port on which agents serve HTTP
+const DefaultAgentPort = 5000
+
+// DefaultBufferSize is the number of observations held by an agent for sample requests
+const DefaultBufferSize = 131072
+
+const (
+	// defaultCount is the number of observations returned by sample requests without a count
+	defaultCount    = 100
+	devicesURN      = "urn:mtconnect.org:MTConnectDevices:1.3"
+	streamsURN      = "urn:mtconnect.org:MTConnectStreams:1.3"
+	errorURN        = "urn:mtconnect.org:MTConnectError:1.3"
+	creationLayout  = "2006-01-02T15:04:05Z"
+	timestampLayout = "2006-01-02T15:04:05.000000Z"
+)
+
+// Error codes of MTConnectError documents
+const (
+	ErrorInvalidURI  = "INVALID_URI"
+	ErrorNoDevice    = "NO_DEVICE"
+	ErrorOutOfRange  = "OUT_OF_RANGE"
+	ErrorQuery       = "QUERY_ERROR"
+	ErrorTooMany     = "TOO_MANY"
+	ErrorUnsupported = "UNSUPPORTED"
+)
+
+// DataItem describes a data item of a device. Its type is one defined by MTConnect (e.g.
+// SPINDLE_SPEED or EXECUTION) or, if prefixed x:, by the extension namespace of the agent.
+type DataItem struct {
+	ID          string
+	Name        string
+	Category    string // SAMPLE, EVENT or CONDITION
+	Type        string
+	SubType     string
+	Units       string // of samples, e.g. MILLIMETER or REVOLUTION/MINUTE
+	NativeUnits string
+}
+
+// Device describes the device served by an agent, and its data items
+type Device struct {
+	ID           string
+	Name         string
+	UUID         string
+	Manufacturer string
+	SerialNumber string
+	Description  string
+	DataItems    []DataItem
+}
+
+// AgentConfig configures an agent
+type AgentConfig struct {
+	Sender       string // the name of the agent's host, given in the header of each document
+	BufferSize   int    // of the observations held for sample requests, DefaultBufferSize if zero
+	ExtensionURN string // the namespace of the x: prefixed types of data items
+}
+
+// observation is a value of a data item held by the agent
+type observation struct {
+	sequence  uint64
+	timestamp time.Time
+	item      int // the index of the data item
+	value     string
+}
+
+// Agent serves the probe, current and sample documents of a device over HTTP, as requested by
+// the paths /probe (or /), /current and /sample, each optionally preceded by the name or uuid
+// of the device. Observations are numbered by sequence, and the latest BufferSize are held
+// for sample requests, which select them by from and count. An Agent is safe for concurrent
+// use.
+type Agent struct {
+	device     Device
+	config     AgentConfig
+	instanceID int64
+	items      map[string]int // data item ids to their indices
+
+	mu     sync.Mutex
+	buffer []observation // a ring of the latest observations, indexed by sequence
+	next   uint64        // the sequence of the next observation
+	latest []observation // of each data item
+}
+
+// NewAgent returns an agent serving the passed device, each of whose data items is unavailable
+// until observed
+func NewAgent(device Device, config AgentConfig) (*Agent, error) {
+	if device.Name == "" || device.ID == "" {
+		return nil, fmt.Errorf("device must have an id and a name")
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultBufferSize
+	}
+	now := time.Now()
+	a := &Agent{device: device, config: config, instanceID: now.Unix(), items: make(map[string]int),
+		next: 1, latest: make([]observation, len(device.DataItems))}
+	for i, v := range device.DataItems {
+		if v.ID == "" || v.ID == device.ID {
+			return nil, fmt.Errorf("data item %d has no id, or that of the device", i)
+		}
+		if _, found := a.items[v.ID]; found {
+			return nil, fmt.Errorf("data item id %s is not unique", v.ID)
+		}
+		switch v.Category {
+		case Sample, Event, Condition:
+		default:
+			return nil, fmt.Errorf("data item %s of unknown category %q", v.ID, v.Category)
+		}
+		if v.Type == "" {
+			return nil, fmt.Errorf("data item %s has no type", v.ID)
+		}
+		a.items[v.ID] = i
+		a.add(i, now, Unavailable)
+	}
+	return a, nil
+}
+
+// Observe records the value of the data item of the passed id at the passed time, unless it is
+// the data item's current value. The value of a condition is its level.
+func (a *Agent) Observe(id string, timestamp time.Time, value string) error {
+	i, found := a.items[id]
+	if !found {
+		return fmt.Errorf("no data item %s", id)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.latest[i].value != value {
+		a.add(i, timestamp, value)
+	}
+	return nil
+}
+
+// add adds an observation to the buffer, displacing the oldest once it is full
+func (a *Agent) add(item int, timestamp time.Time, value string) {
+	o := observation{sequence: a.next, timestamp: timestamp, item: item, value: value}
+	a.next++
+	if index := int((o.sequence - 1) % uint64(a.config.BufferSize)); index == len(a.buffer) {
+		a.buffer = append(a.buffer, o)
+	} else {
+		a.buffer[index] = o
+	}
+	a.latest[item] = o
+}
+
+// firstSequence returns the sequence of the oldest observation held
+func (a *Agent) firstSequence() uint64 {
+	if size := uint64(a.config.BufferSize); a.next > size {
+		return a.next - size
+	}
+	return 1
+}
+
+// ServeHTTP answers a probe, current or sample request
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.writeError(w, http.StatusMethodNotAllowed, ErrorUnsupported, r.Method+" requests are not supported")
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) == 2 {
+		if path[0] != a.device.Name && path[0] != a.device.UUID {
+			a.writeError(w, http.StatusNotFound, ErrorNoDevice, "no device "+path[0])
+			return
+		}
+		path = path[1:]
+	}
+	if len(path) != 1 {
+		a.writeError(w, http.StatusNotFound, ErrorInvalidURI, "invalid path "+r.URL.Path)
+		return
+	}
+	query := r.URL.Query()
+	for _, v := range []string{"path", "at", "interval"} {
+		if _, found := query[v]; found {
+			a.writeError(w, http.StatusBadRequest, ErrorUnsupported, "the "+v+" parameter is not supported")
+			return
+		}
+	}
+	switch path[0] {
+	case "", "probe":
+		a.writeDocument(w, http.StatusOK, a.probe())
+	case "current":
+		a.writeDocument(w, http.StatusOK, a.current())
+	case "sample":
+		document, code, text := a.sample(query.Get("from"), query.Get("count"))
+		if code != "" {
+			a.writeError(w, http.StatusBadRequest, code, text)
+			return
+		}
+		a.writeDocument(w, http.StatusOK, document)
+	default:
+		a.writeError(w, http.StatusNotFound, ErrorInvalidURI, "invalid request "+path[0])
+	}
+}
+
+// header is the header of every document, those of streams giving their sequences and those
+// of devices the assets held (none)
+type header struct {
+	CreationTime    string `xml:"creationTime,attr"`
+	Sender          string `xml:"sender,attr"`
+	InstanceID      int64  `xml:"instanceId,attr"`
+	Version         string `xml:"version,attr"`
+	BufferSize      int    `xml:"bufferSize,attr"`
+	AssetBufferSize *int   `xml:"assetBufferSize,attr,omitempty"`
+	AssetCount      *int   `xml:"assetCount,attr,omitempty"`
+	NextSequence    uint64 `xml:"nextSequence,attr,omitempty"`
+	FirstSequence   uint64 `xml:"firstSequence,attr,omitempty"`
+	LastSequence    uint64 `xml:"lastSequence,attr,omitempty"`
+}
+
+func (a *Agent) header() header {
+	return header{CreationTime: time.Now().UTC().Format(creationLayout), Sender: a.config.Sender,
+		InstanceID: a.instanceID, Version: Version, BufferSize: a.config.BufferSize}
+}
+
+type devicesDocument struct {
+	XMLName xml.Name     `xml:"MTConnectDevices"`
+	URN     string       `xml:"xmlns,attr"`
+	XURN    string       `xml:"xmlns:x,attr,omitempty"`
+	Header  header       `xml:"Header"`
+	Devices []deviceNode `xml:"Devices>Device"`
+}
+
+type deviceNode struct {
+	ID          string          `xml:"id,attr"`
+	Name        string          `xml:"name,attr"`
+	UUID        string          `xml:"uuid,attr,omitempty"`
+	Description descriptionNode `xml:"Description"`
+	DataItems   []dataItemNode  `xml:"DataItems>DataItem"`
+}
+
+type descriptionNode struct {
+	Manufacturer string `xml:"manufacturer,attr,omitempty"`
+	SerialNumber string `xml:"serialNumber,attr,omitempty"`
+	Text         string `xml:",chardata"`
+}
+
+type dataItemNode struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"name,attr,omitempty"`
+	Category    string `xml:"category,attr"`
+	Type        string `xml:"type,attr"`
+	SubType     string `xml:"subType,attr,omitempty"`
+	Units       string `xml:"units,attr,omitempty"`
+	NativeUnits string `xml:"nativeUnits,attr,omitempty"`
+}
+
+// probe returns the document describing the device
+func (a *Agent) probe() devicesDocument {
+	var none int
+	d := a.device
+	document := devicesDocument{URN: devicesURN, XURN: a.config.ExtensionURN, Header: a.header()}
+	document.Header.AssetBufferSize, document.Header.AssetCount = &none, &none
+	node := deviceNode{ID: d.ID, Name: d.Name, UUID: d.UUID,
+		Description: descriptionNode{Manufacturer: d.Manufacturer, SerialNumber: d.SerialNumber, Text: d.Description}}
+	for _, v := range d.DataItems {
+		node.DataItems = append(node.DataItems, dataItemNode{ID: v.ID, Name: v.Name, Category: v.Category,
+			Type: v.Type, SubType: v.SubType, Units: v.Units, NativeUnits: v.NativeUnits})
+	}
+	document.Devices = []deviceNode{node}
+	return document
+}
+
+type streamsDocument struct {
+	XMLName xml.Name       `xml:"MTConnectStreams"`
+	URN     string         `xml:"xmlns,attr"`
+	XURN    string         `xml:"xmlns:x,attr,omitempty"`
+	Header  header         `xml:"Header"`
+	Streams []deviceStream `xml:"Streams>DeviceStream"`
+}
+
+type deviceStream struct {
+	Name       string          `xml:"name,attr"`
+	UUID       string          `xml:"uuid,attr,omitempty"`
+	Components componentStream `xml:"ComponentStream"`
+}
+
+type componentStream struct {
+	Component   string            `xml:"component,attr"`
+	Name        string            `xml:"name,attr"`
+	ComponentID string            `xml:"componentId,attr"`
+	Samples     []observationNode `xml:"Samples>Sample"`
+	Events      []observationNode `xml:"Events>Event"`
+	Conditions  []observationNode `xml:"Condition>Normal"`
+}
+
+// observationNode is an observation, its element named for the type of its data item or, of
+// conditions, for their level
+type observationNode struct {
+	XMLName    xml.Name
+	DataItemID string `xml:"dataItemId,attr"`
+	Timestamp  string `xml:"timestamp,attr"`
+	Sequence   uint64 `xml:"sequence,attr"`
+	Name       string `xml:"name,attr,omitempty"`
+	SubType    string `xml:"subType,attr,omitempty"`
+	Type       string `xml:"type,attr,omitempty"` // of conditions
+	Value      string `xml:",chardata"`
+}
+
+// streams returns the document of the passed observations, the caller holding the lock
+func (a *Agent) streams(observations []observation, next uint64) streamsDocument {
+	document := streamsDocument{URN: streamsURN, XURN: a.config.ExtensionURN, Header: a.header()}
+	document.Header.NextSequence, document.Header.FirstSequence, document.Header.LastSequence = next, a.firstSequence(), a.next-1
+	components := componentStream{Component: "Device", Name: a.device.Name, ComponentID: a.device.ID}
+	for _, o := range observations {
+		item := a.device.DataItems[o.item]
+		node := observationNode{DataItemID: item.ID, Timestamp: o.timestamp.UTC().Format(timestampLayout),
+			Sequence: o.sequence, Name: item.Name, SubType: item.SubType}
+		switch item.Category {
+		case Condition:
+			node.XMLName.Local, node.Type = elementName(o.value), item.Type
+			components.Conditions = append(components.Conditions, node)
+		case Sample:
+			node.XMLName.Local, node.Value = elementName(item.Type), o.value
+			components.Samples = append(components.Samples, node)
+		default:
+			node.XMLName.Local, node.Value = elementName(item.Type), o.value
+			components.Events = append(components.Events, node)
+		}
+	}
+	document.Streams = []deviceStream{{Name: a.device.Name, UUID: a.device.UUID, Components: components}}
+	return document
+}
+
+// current returns the document of the latest observation of each data item
+func (a *Agent) current() streamsDocument {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.streams(a.latest, a.next)
+}
+
+// sample returns the document of count observations (100 if empty) from the sequence from (the
+// first held if empty), or the code and text of the error of invalid parameters
+func (a *Agent) sample(from, count string) (streamsDocument, string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start, n := a.firstSequence(), defaultCount
+	if from != "" {
+		v, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			return streamsDocument{}, ErrorQuery, "from must be a positive integer"
+		}
+		if v < start || v > a.next {
+			return streamsDocument{}, ErrorOutOfRange, fmt.Sprintf("from must be between %d and %d", start, a.next)
+		}
+		start = v
+	}
+	if count != "" {
+		v, err := strconv.Atoi(count)
+		if err != nil || v < 1 {
+			return streamsDocument{}, ErrorQuery, "count must be a positive integer"
+		}
+		if v > a.config.BufferSize {
+			return streamsDocument{}, ErrorTooMany, fmt.Sprintf("count must not exceed %d", a.config.BufferSize)
+		}
+		n = v
+	}
+	var observations []observation
+	sequence := start
+	for ; sequence < a.next && len(observations) < n; sequence++ {
+		observations = append(observations, a.buffer[(sequence-1)%uint64(a.config.BufferSize)])
+	}
+	return a.streams(observations, sequence), "", ""
+}
+
+type errorDocument struct {
+	XMLName xml.Name    `xml:"MTConnectError"`
+	URN     string      `xml:"xmlns,attr"`
+	Header  header      `xml:"Header"`
+	Errors  []errorNode `xml:"Errors>Error"`
+}
+
+type errorNode struct {
+	Code string `xml:"errorCode,attr"`
+	Text string `xml:",chardata"`
+}
+
+func (a *Agent) writeError(w http.ResponseWriter, status int, code string, text string) {
+	a.writeDocument(w, status, errorDocument{URN: errorURN, Header: a.header(), Errors: []errorNode{{Code: code, Text: text}}})
+}
+
+func (a *Agent) writeDocument(w http.ResponseWriter, status int, document interface{}) {
+	b, err := xml.Marshal(document)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+// elementName returns the name of the element of an observation of the passed type or level,
+// e.g. SpindleSpeed of SPINDLE_SPEED and x:LineSpeed of x:LINE_SPEED
+func elementName(t string) string {
+	var prefix string
+	if i := strings.IndexByte(t, ':'); i >= 0 {
+		prefix, t = t[:i+1], t[i+1:]
+	}
+	words := strings.Split(strings.ToLower(t), "_")
+	for i, v := range words {
+		if v != "" {
+			words[i] = strings.ToUpper(v[:1]) + v[1:]
+		}
+	}
+	return prefix + strings.Join(words, "")
+}
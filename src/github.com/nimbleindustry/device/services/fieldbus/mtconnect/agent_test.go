@@ -0,0 +1,140 @@
+package mtconnect
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deviceFixture is a lathe with a sample, an event and a condition
+var deviceFixture = Device{ID: "m42", Name: "M42", UUID: "acme-m42", Manufacturer: "Acme", Description: "Lathe",
+	DataItems: []DataItem{
+		{ID: "avail", Category: Event, Type: "AVAILABILITY"},
+		{ID: "Sspeed", Name: "SpindleSpeed", Category: Sample, Type: "SPINDLE_SPEED", SubType: "ACTUAL", Units: "REVOLUTION/MINUTE"},
+		{ID: "exec", Name: "Execution", Category: Event, Type: "EXECUTION"},
+		{ID: "system", Category: Condition, Type: "SYSTEM"},
+		{ID: "speed", Name: "LineSpeed", Category: Sample, Type: "x:LINE_SPEED"},
+	}}
+
+// streams is the part of a streams or error document checked by the tests
+type streams struct {
+	Header struct {
+		NextSequence  uint64 `xml:"nextSequence,attr"`
+		FirstSequence uint64 `xml:"firstSequence,attr"`
+		LastSequence  uint64 `xml:"lastSequence,attr"`
+	}
+	Samples observations `xml:"Streams>DeviceStream>ComponentStream>Samples"`
+	Events  observations `xml:"Streams>DeviceStream>ComponentStream>Events"`
+	Errors  []struct {
+		Code string `xml:"errorCode,attr"`
+	} `xml:"Errors>Error"`
+}
+
+// observations are elements named for the types of their data items
+type observations struct {
+	Items []observed `xml:",any"`
+}
+
+type observed struct {
+	ID       string `xml:"dataItemId,attr"`
+	Sequence uint64 `xml:"sequence,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// get requests the passed path of the agent, returning the status and body of the response
+func get(t *testing.T, agent *Agent, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	agent.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.Nil(t, err)
+	return recorder.Code, string(body)
+}
+
+// getStreams requests the passed path of the agent, decoding the streams (or error) document
+func getStreams(t *testing.T, agent *Agent, path string, status int) streams {
+	code, body := get(t, agent, path)
+	assert.Equal(t, status, code, path)
+	var document streams
+	assert.Nil(t, xml.Unmarshal([]byte(body), &document), path)
+	return document
+}
+
+func TestAgentServesDocuments(t *testing.T) {
+	agent, err := NewAgent(deviceFixture, AgentConfig{Sender: "gateway", BufferSize: 8, ExtensionURN: "urn:example"})
+	assert.Nil(t, err)
+	stamp := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	code, body := get(t, agent, "/probe")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `<MTConnectDevices xmlns="urn:mtconnect.org:MTConnectDevices:1.3" xmlns:x="urn:example">`)
+	assert.Contains(t, body, `<Device id="m42" name="M42" uuid="acme-m42"><Description manufacturer="Acme">Lathe</Description>`)
+	assert.Contains(t, body, `<DataItem id="Sspeed" name="SpindleSpeed" category="SAMPLE" type="SPINDLE_SPEED" subType="ACTUAL" units="REVOLUTION/MINUTE"></DataItem>`)
+	assert.Contains(t, body, `assetBufferSize="0" assetCount="0"`)
+	_, same := get(t, agent, "/M42/probe")
+	assert.Equal(t, len(body), len(same))
+
+	// every data item is unavailable until observed, and unchanged values are not recorded
+	assert.Nil(t, agent.Observe("Sspeed", stamp, "1450.5"))
+	assert.Nil(t, agent.Observe("Sspeed", stamp.Add(time.Second), "1450.5"))
+	assert.Nil(t, agent.Observe("system", stamp, Fault))
+	assert.Nil(t, agent.Observe("speed", stamp, "12"))
+	assert.NotNil(t, agent.Observe("unknown", stamp, "1"))
+	code, body = get(t, agent, "/current")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `<SpindleSpeed dataItemId="Sspeed" timestamp="2024-05-01T10:00:00.000000Z" sequence="6" name="SpindleSpeed" subType="ACTUAL">1450.5</SpindleSpeed>`)
+	assert.Contains(t, body, `<Execution dataItemId="exec"`)
+	assert.Contains(t, body, `>UNAVAILABLE</Execution>`)
+	assert.Contains(t, body, `<Condition><Fault dataItemId="system" timestamp="2024-05-01T10:00:00.000000Z" sequence="7" type="SYSTEM"></Fault></Condition>`)
+	assert.Contains(t, body, `<x:LineSpeed dataItemId="speed"`)
+	document := getStreams(t, agent, "/current", http.StatusOK)
+	assert.Equal(t, uint64(9), document.Header.NextSequence)
+	assert.Equal(t, uint64(1), document.Header.FirstSequence)
+	assert.Equal(t, uint64(8), document.Header.LastSequence)
+
+	document = getStreams(t, agent, "/sample?from=6&count=2", http.StatusOK)
+	assert.Equal(t, []observed{{ID: "Sspeed", Sequence: 6, Value: "1450.5"}}, document.Samples.Items)
+	assert.Equal(t, uint64(8), document.Header.NextSequence)
+
+	// the buffer holds the latest observations, older ones being out of range
+	assert.Nil(t, agent.Observe("exec", stamp, "ACTIVE"))
+	assert.Nil(t, agent.Observe("exec", stamp, "READY"))
+	document = getStreams(t, agent, "/acme-m42/sample", http.StatusOK)
+	assert.Equal(t, uint64(3), document.Header.FirstSequence)
+	assert.Equal(t, uint64(11), document.Header.NextSequence)
+	assert.Len(t, document.Events.Items, 3)
+	assert.Equal(t, observed{ID: "exec", Sequence: 10, Value: "READY"}, document.Events.Items[2])
+	document = getStreams(t, agent, "/sample?from=11", http.StatusOK)
+	assert.Empty(t, document.Events.Items)
+	assert.Equal(t, uint64(11), document.Header.NextSequence)
+
+	for _, v := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/sample?from=2", http.StatusBadRequest, ErrorOutOfRange},
+		{"/sample?from=12", http.StatusBadRequest, ErrorOutOfRange},
+		{"/sample?count=9", http.StatusBadRequest, ErrorTooMany},
+		{"/sample?count=none", http.StatusBadRequest, ErrorQuery},
+		{"/current?path=//Axes", http.StatusBadRequest, ErrorUnsupported},
+		{"/M43/current", http.StatusNotFound, ErrorNoDevice},
+		{"/assets", http.StatusNotFound, ErrorInvalidURI},
+	} {
+		document := getStreams(t, agent, v.path, v.status)
+		if assert.Len(t, document.Errors, 1, v.path) {
+			assert.Equal(t, v.code, document.Errors[0].Code, v.path)
+		}
+	}
+
+	_, err = NewAgent(Device{ID: "m42", Name: "M42", DataItems: []DataItem{{ID: "a", Category: Event, Type: "PROGRAM"},
+		{ID: "a", Category: Event, Type: "EXECUTION"}}}, AgentConfig{})
+	assert.NotNil(t, err)
+	_, err = NewAgent(Device{ID: "m42", Name: "M42", DataItems: []DataItem{{ID: "a", Category: "ALARM", Type: "PROGRAM"}}}, AgentConfig{})
+	assert.NotNil(t, err)
+	assert.Equal(t, "PathFeedrateOverride", elementName("PATH_FEEDRATE_OVERRIDE"))
+}
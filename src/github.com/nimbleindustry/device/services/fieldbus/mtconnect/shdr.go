@@ -0,0 +1,185 @@
+// Package mtconnect implements the parts of MTConnect needed to gather the data of machine
+// tools and to publish it: SHDR, the pipe-delimited lines in which adapters send the
+// observations of a machine's data items, and an agent serving the probe, current and sample
+// documents of MTConnect 1.3 over HTTP.
+package mtconnect
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultAdapterPort is the tcp port on which adapters serve SHDR
+const DefaultAdapterPort = 7878
+
+// Categories of data items
+const (
+	Sample    = "SAMPLE"    // continuously varying values, such as a spindle speed
+	Event     = "EVENT"     // discrete values, such as the execution state or the program
+	Condition = "CONDITION" // the health of a component, by its level
+)
+
+// Unavailable is the value of a data item, or level of a condition, that is not known
+const Unavailable = "UNAVAILABLE"
+
+// Levels of conditions, in order of severity
+const (
+	Normal  = "NORMAL"
+	Warning = "WARNING"
+	Fault   = "FAULT"
+)
+
+// Message is the type of the events whose observations carry a native code as well as a text
+const Message = "MESSAGE"
+
+// PingCommand asks an adapter for heartbeats, which it answers with a PONG command giving
+// the interval, in milliseconds, within which it answers each further ping
+const PingCommand = "* PING"
+
+// Observation is the value of a data item sent by an adapter. The value of a condition is its
+// level, which applies to the condition of NativeCode or, if NativeCode is empty, to every
+// condition of the data item; the value of a MESSAGE event is its text.
+type Observation struct {
+	Timestamp      time.Time
+	Key            string
+	Value          string
+	NativeCode     string // of conditions and MESSAGE events
+	NativeSeverity string // of conditions
+	Qualifier      string // of conditions, e.g. HIGH or LOW
+	Text           string // of conditions
+}
+
+// Fields returns the number of fields that follow the key of a data item of the passed
+// category and type in SHDR: five of conditions, two of MESSAGE events and one of others
+func Fields(category, dataType string) int {
+	switch {
+	case category == Condition:
+		return 5
+	case category == Event && dataType == Message:
+		return 2
+	}
+	return 1
+}
+
+// timestampLayouts are those of SHDR timestamps, which are UTC if they give no zone
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+
+// ParseLine returns the observations of an SHDR line: a timestamp followed by the key and
+// fields of each data item, e.g. "2024-05-01T10:00:00.000Z|execution|ACTIVE|Xact|12.5".
+// Fields gives the number of fields following each key whose data item is not of a single
+// value (see Fields). Observations without a timestamp are given the passed time, that at
+// which the line was received. Should the line be malformed, the observations preceding the
+// fault are returned with the error.
+func ParseLine(line string, fields map[string]int, received time.Time) ([]Observation, error) {
+	parts := strings.Split(strings.TrimRight(line, "\r\n"), "|")
+	timestamp := received
+	if stamp := strings.TrimSpace(parts[0]); stamp != "" {
+		// a duration, of the observations of a period, may follow the time
+		if i := strings.IndexByte(stamp, '@'); i >= 0 {
+			stamp = stamp[:i]
+		}
+		var err error
+		for _, layout := range timestampLayouts {
+			if timestamp, err = time.Parse(layout, stamp); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", parts[0])
+		}
+	}
+	var observations []Observation
+	for parts = parts[1:]; len(parts) > 0; {
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return observations, errors.New("empty data item key")
+		}
+		if strings.HasPrefix(key, "@") {
+			// asset commands, which span the rest of the line, are not supported
+			return observations, nil
+		}
+		n, found := fields[key]
+		if !found {
+			n = 1
+		}
+		if len(parts) < 1+n {
+			return observations, fmt.Errorf("data item %s has %d of %d fields", key, len(parts)-1, n)
+		}
+		o := Observation{Timestamp: timestamp, Key: key, Value: strings.TrimSpace(parts[1])}
+		switch n {
+		case 2:
+			o.NativeCode, o.Value = strings.TrimSpace(parts[1]), strings.TrimSpace(parts[2])
+		case 5:
+			o.Value = strings.ToUpper(o.Value)
+			o.NativeCode, o.NativeSeverity = strings.TrimSpace(parts[2]), strings.TrimSpace(parts[3])
+			o.Qualifier, o.Text = strings.TrimSpace(parts[4]), strings.TrimSpace(parts[5])
+		}
+		observations = append(observations, o)
+		parts = parts[1+n:]
+	}
+	return observations, nil
+}
+
+// ParseCommand returns the name and value of a command line, such as "* PONG 10000" or
+// "* shdrVersion: 2", ok being false if the line is not a command
+func ParseCommand(line string) (name, value string, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "* ") {
+		return "", "", false
+	}
+	command := strings.TrimSpace(line[2:])
+	if i := strings.IndexAny(command, ": "); i >= 0 {
+		return command[:i], strings.TrimSpace(command[i+1:]), true
+	}
+	return command, "", true
+}
+
+// Conditions tracks the active conditions of a condition data item by their native codes,
+// from which its level is that of the most severe. Its zero value is unavailable.
+type Conditions struct {
+	active    map[string]Observation
+	available bool
+}
+
+// Apply applies the observation of a condition: a warning or fault activates the condition of
+// its native code, normal clears it (or every condition, if no code is given) and unavailable
+// clears every condition, the level becoming unknown
+func (c *Conditions) Apply(o Observation) error {
+	switch o.Value {
+	case Unavailable:
+		c.active, c.available = nil, false
+	case Normal:
+		if o.NativeCode == "" {
+			c.active = nil
+		} else {
+			delete(c.active, o.NativeCode)
+		}
+		c.available = true
+	case Warning, Fault:
+		if c.active == nil {
+			c.active = make(map[string]Observation)
+		}
+		c.active[o.NativeCode] = o
+		c.available = true
+	default:
+		return fmt.Errorf("unknown condition level %q", o.Value)
+	}
+	return nil
+}
+
+// Level returns the level of the most severe active condition, normal if none is active
+func (c *Conditions) Level() string {
+	if !c.available {
+		return Unavailable
+	}
+	level := Normal
+	for _, v := range c.active {
+		if v.Value == Fault {
+			return Fault
+		}
+		level = Warning
+	}
+	return level
+}
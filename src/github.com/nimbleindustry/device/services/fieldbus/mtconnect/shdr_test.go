@@ -0,0 +1,75 @@
+package mtconnect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	received := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	fields := map[string]int{"system": Fields(Condition, "SYSTEM"), "message": Fields(Event, Message)}
+
+	observations, err := ParseLine("2024-05-01T09:59:58.250Z|execution|ACTIVE|Sspeed| 1450.5 \r\n", fields, received)
+	assert.Nil(t, err)
+	stamp := time.Date(2024, 5, 1, 9, 59, 58, 250000000, time.UTC)
+	assert.Equal(t, []Observation{{Timestamp: stamp, Key: "execution", Value: "ACTIVE"},
+		{Timestamp: stamp, Key: "Sspeed", Value: "1450.5"}}, observations)
+
+	observations, err = ParseLine("|system|fault|E42|2|HIGH|Spindle overload|message|M7|Door open", fields, received)
+	assert.Nil(t, err)
+	assert.Equal(t, []Observation{
+		{Timestamp: received, Key: "system", Value: Fault, NativeCode: "E42", NativeSeverity: "2", Qualifier: "HIGH", Text: "Spindle overload"},
+		{Timestamp: received, Key: "message", Value: "Door open", NativeCode: "M7"}}, observations)
+
+	// timestamps without a zone are UTC, and durations are ignored
+	observations, err = ParseLine("2024-05-01T09:59:58.5@100.0|Xact|12", fields, received)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 9, 59, 58, 500000000, time.UTC), observations[0].Timestamp)
+
+	observations, err = ParseLine("2024-05-01T09:59:58Z", fields, received)
+	assert.Nil(t, err)
+	assert.Empty(t, observations)
+
+	observations, err = ParseLine("|mode|AUTOMATIC|system|NORMAL||", fields, received)
+	assert.NotNil(t, err)
+	assert.Len(t, observations, 1)
+	for _, line := range []string{"yesterday|mode|AUTOMATIC", "|mode|AUTOMATIC||", "|mode"} {
+		_, err := ParseLine(line, fields, received)
+		assert.NotNil(t, err, line)
+	}
+
+	name, value, ok := ParseCommand("* PONG 10000\n")
+	assert.True(t, ok)
+	assert.Equal(t, "PONG", name)
+	assert.Equal(t, "10000", value)
+	name, value, ok = ParseCommand("* shdrVersion: 2")
+	assert.True(t, ok)
+	assert.Equal(t, "shdrVersion", name)
+	assert.Equal(t, "2", value)
+	_, _, ok = ParseCommand("|mode|MANUAL")
+	assert.False(t, ok)
+}
+
+func TestConditions(t *testing.T) {
+	var c Conditions
+	assert.Equal(t, Unavailable, c.Level())
+	assert.Nil(t, c.Apply(Observation{Value: Normal}))
+	assert.Equal(t, Normal, c.Level())
+	assert.Nil(t, c.Apply(Observation{Value: Warning, NativeCode: "W1"}))
+	assert.Equal(t, Warning, c.Level())
+	assert.Nil(t, c.Apply(Observation{Value: Fault, NativeCode: "F1"}))
+	assert.Equal(t, Fault, c.Level())
+
+	// clearing the fault leaves the warning active
+	assert.Nil(t, c.Apply(Observation{Value: Normal, NativeCode: "F1"}))
+	assert.Equal(t, Warning, c.Level())
+	assert.Nil(t, c.Apply(Observation{Value: Normal}))
+	assert.Equal(t, Normal, c.Level())
+
+	assert.Nil(t, c.Apply(Observation{Value: Fault, NativeCode: "F1"}))
+	assert.Nil(t, c.Apply(Observation{Value: Unavailable}))
+	assert.Equal(t, Unavailable, c.Level())
+	assert.NotNil(t, c.Apply(Observation{Value: "BROKEN"}))
+}
@@ -0,0 +1,145 @@
+package fieldbus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/mtconnect"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mtconnectIntegrationFixture selects a sample, an event and a condition of an adapter
+var mtconnectIntegrationFixture = &common.MTConnectIntegration{PollInterval: "100ms", DataItems: []common.MTConnectDataItem{
+	{Key: "Sspeed", Category: mtconnect.Sample, Type: "SPINDLE_SPEED", Scaling: common.Scaling{Unit: "rpm"}},
+	{TagName: "Execution", Key: "exec", Category: mtconnect.Event, Type: "EXECUTION"},
+	{TagName: "System", Key: "system", Category: mtconnect.Condition, Type: "SYSTEM"},
+}}
+
+// acceptAdapter accepts a connection from the service, answering its ping with a heartbeat
+// of 10s before sending the passed lines
+func acceptAdapter(t *testing.T, listener net.Listener, lines ...string) chan net.Conn {
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ping, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || ping != mtconnect.PingCommand+"\n" {
+			t.Errorf("expected a ping, got %q (%v)", ping, err)
+		}
+		fmt.Fprint(conn, "* PONG 10000\n")
+		for _, v := range lines {
+			fmt.Fprint(conn, v+"\n")
+		}
+		conns <- conn
+	}()
+	return conns
+}
+
+// receiveMTConnectLines handles the next n lines received by the service, at the passed time
+func receiveMTConnectLines(t *testing.T, svc *MTConnectService, n int, now time.Time) {
+	for i := 0; i < n; i++ {
+		select {
+		case line := <-svc.lines:
+			svc.receive(line, now)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of %d lines received", i, n)
+		}
+	}
+}
+
+func TestMTConnectDataItemValidation(t *testing.T) {
+	record := common.ConnectionRecord{Type: define.MTConnect, Endpoint: "10.0.1.70"}
+	for _, items := range [][]common.MTConnectDataItem{
+		nil,
+		{{Category: mtconnect.Sample}},
+		{{Key: "Xact", Category: "ALARM"}},
+		{{Key: "Xact", Category: mtconnect.Sample}, {Key: "Xact", TagName: "X", Category: mtconnect.Sample}},
+		{{Key: "Xact", Category: mtconnect.Sample}, {Key: "Yact", TagName: "Xact", Category: mtconnect.Sample}},
+	} {
+		svc := NewMTConnectService(record, func(s string) { t.Log(s) }, 0)
+		svc.integration = &common.MTConnectIntegration{DataItems: items}
+		assert.NotNil(t, svc.initBusIntegration(), "%v", items)
+	}
+	svc := NewMTConnectService(record, func(s string) { t.Log(s) }, 0)
+	assert.Equal(t, "MTConnectService[10.0.1.70]", svc.Name)
+	assert.Equal(t, "10.0.1.70:7878", svc.address())
+	svc.integration = mtconnectIntegrationFixture
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Equal(t, 100*time.Millisecond, svc.interval)
+	assert.Equal(t, map[string]int{"system": 5}, svc.fields)
+}
+
+func TestMTConnectReportsObservations(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	svc := NewMTConnectService(common.ConnectionRecord{Type: define.MTConnect, Endpoint: "127.0.0.1", Port: port},
+		func(s string) { t.Log(s) }, 0)
+	svc.integration = mtconnectIntegrationFixture
+	assert.Nil(t, svc.initBusIntegration())
+	reports := watchOpsReports()
+
+	// the adapter sends every data item on connecting
+	conns := acceptAdapter(t, listener, "2024-05-01T10:00:00.000Z|Sspeed|1450.5|exec|ACTIVE|Xact|12.5",
+		"|system|FAULT|E1|2|HIGH|Spindle overload", "|system|WARNING|W1|||Low oil")
+	now := time.Now()
+	assert.Nil(t, svc.connect())
+	receiveMTConnectLines(t, svc, 4, now)
+	assert.Equal(t, 10*time.Second, svc.heartbeat)
+	svc.report()
+	report := nextOpsReport(t, reports, "System", nil)
+	assert.Equal(t, common.TagValue{Value: 1450.5, Unit: "rpm", Quality: define.QualityGood, Source: svc.Name}, report["Sspeed"])
+	assert.Equal(t, common.TagValue{Value: "ACTIVE", Quality: define.QualityGood, Source: svc.Name}, report["Execution"])
+	assert.Equal(t, common.TagValue{Value: mtconnect.Fault, Quality: define.QualityGood, Source: svc.Name}, report["System"])
+	assert.NotContains(t, report, "Xact")
+
+	// clearing the fault leaves the warning; unavailable and malformed values are bad
+	conn := <-conns
+	defer conn.Close()
+	fmt.Fprint(conn, "|system|NORMAL|E1|||\n|Sspeed|UNAVAILABLE|exec|READY\n")
+	receiveMTConnectLines(t, svc, 2, now)
+	svc.report()
+	report = nextOpsReport(t, reports, "System", nil)
+	assert.Equal(t, mtconnect.Warning, report["System"].Value)
+	assert.Equal(t, common.TagValue{Unit: "rpm", Quality: define.QualityBad, Error: "Sspeed is unavailable", Source: svc.Name}, report["Sspeed"])
+	fmt.Fprint(conn, "|Sspeed|fast\n")
+	receiveMTConnectLines(t, svc, 1, now)
+	svc.report()
+	report = nextOpsReport(t, reports, "Sspeed", nil)
+	assert.Equal(t, `Sspeed sample "fast" is not a number`, report["Sspeed"].Error)
+	assert.Equal(t, &common.FieldbusCounters{Requests: 3, Responses: 2, Errors: 1}, svc.diagnostics.Tags["Sspeed"])
+
+	// an adapter silent for two heartbeats is lost, its tags becoming stale
+	state := watchConnectionState(svc.Name)
+	svc.keepAlive(now.Add(5 * time.Second))
+	assert.NotNil(t, svc.conn)
+	svc.keepAlive(now.Add(25 * time.Second))
+	assert.Equal(t, define.ConnectionDisconnected, (<-state).State)
+	assert.Nil(t, svc.conn)
+	svc.report()
+	report = nextOpsReport(t, reports, "Execution", nil)
+	assert.Equal(t, common.TagValue{Value: "READY", Quality: define.QualityStale, Error: "no heartbeat received in 25s", Source: svc.Name}, report["Execution"])
+	assert.Equal(t, define.QualityStale, report["Sspeed"].Quality)
+	assert.Equal(t, 1450.5, report["Sspeed"].Value)
+
+	// the adapter is reconnected once the backoff allows, its conditions sent again
+	assert.True(t, svc.untilReconnect(time.Now()) > 0)
+	svc.backoff.next = time.Time{}
+	acceptAdapter(t, listener, "|system|NORMAL||||")
+	assert.Nil(t, svc.connect())
+	receiveMTConnectLines(t, svc, 2, now)
+	svc.report()
+	report = nextOpsReport(t, reports, "System", nil)
+	assert.Equal(t, mtconnect.Normal, report["System"].Value)
+	assert.Equal(t, 1, svc.diagnostics.Reconnects)
+	assert.Nil(t, svc.closeConnection())
+}
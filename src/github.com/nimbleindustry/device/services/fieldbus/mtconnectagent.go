@@ -0,0 +1,330 @@
+package fieldbus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/mtconnect"
+
+	"github.com/nimbleindustry/suture"
+)
+
+// mtconnectAvailabilityID is the id of the data item giving the availability of the device
+const mtconnectAvailabilityID = "avail"
+
+// mtconnectAgentReportQueue is the number of ops reports held while the agent answers a request,
+// fieldbus services polling at the same instant
+const mtconnectAgentReportQueue = 64
+
+// mtconnectUnits maps the symbols of common units to the units of MTConnect samples. Other units
+// are served as native units only.
+var mtconnectUnits = map[string]string{
+	"°C":   "CELSIUS",
+	"mm":   "MILLIMETER",
+	"mm/s": "MILLIMETER/SECOND",
+	"rpm":  "REVOLUTION/MINUTE",
+	"°":    "DEGREE",
+	"°/s":  "DEGREE/SECOND",
+	"%":    "PERCENT",
+	"s":    "SECOND",
+	"A":    "AMPERE",
+	"V":    "VOLT",
+	"W":    "WATT",
+	"N":    "NEWTON",
+	"Nm":   "NEWTON_METER",
+	"Pa":   "PASCAL",
+	"Hz":   "HERTZ",
+	"kg":   "KILOGRAM",
+	"l":    "LITER",
+}
+
+// MTConnectAgentService runs an embedded MTConnect agent, serving the asset to analytics
+// clients as probe, current and sample documents. The device is named by the asset's machine
+// id and its data items are every tag of the equipment config: those of the mtconnect section
+// keep their category and type, other tags being samples if they have a unit and events
+// otherwise, of an x: type named for the tag. The observations are the values reported by the
+// fieldbus services as they change, bad and stale values being unavailable.
+type MTConnectAgentService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop      chan bool
+	config    *common.MTConnectAgentConfig
+	asset     common.Asset
+	equipment common.Equipment
+	agent     *mtconnect.Agent
+	ids       map[string]string // tag names to the ids of their data items
+	listener  net.Listener
+	values    map[string]common.TagValue // the latest value of each tag, served again after a reload
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *MTConnectAgentService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	svc.reload()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	configs := common.BusChannel(define.ConnectivityConfigUpdated)
+	assets := common.BusChannel(define.AssetConfigUpdated)
+	equipment := common.BusChannel(define.EquipmentConfigUpdated)
+	reports := common.BufferedBusChannel(define.TopicOpsReport, mtconnectAgentReportQueue)
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.closeServer()
+			return
+		case <-configs:
+			svc.reload()
+		case <-assets:
+			svc.reload()
+		case <-equipment:
+			svc.reload()
+		case msg := <-reports:
+			svc.update(msg.(common.OpsReport), time.Now())
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *MTConnectAgentService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *MTConnectAgentService) State() int {
+	return svc.ServiceState
+}
+
+// reload (re)starts the agent if its configuration, or the asset or equipment config it
+// serves, has changed, stopping it if its configuration has been removed. A restarted agent
+// has a new instance id, from which clients know to probe it again.
+func (svc *MTConnectAgentService) reload() {
+	config := common.ConnectionConfig.MTConnectAgent
+	asset, equipment := common.AssetConfig, common.EquipmentConfig
+	if svc.agent != nil && reflect.DeepEqual(config, svc.config) && reflect.DeepEqual(asset, svc.asset) &&
+		reflect.DeepEqual(equipment, svc.equipment) {
+		return
+	}
+	svc.closeServer()
+	svc.config, svc.asset, svc.equipment = config, asset, equipment
+	if config == nil {
+		svc.LogFunc(fmt.Sprintf("%s idles, no MTConnect agent is configured", svc.Name))
+		return
+	}
+	if err := svc.start(*config, asset, equipment); err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to start MTConnect agent, %s", svc.Name, err))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s serves %d data items on %s", svc.Name, len(svc.ids), svc.listener.Addr()))
+}
+
+// start builds the device and begins serving its documents over HTTP
+func (svc *MTConnectAgentService) start(config common.MTConnectAgentConfig, asset common.Asset, equipment common.Equipment) error {
+	device, ids, err := mtconnectDevice(asset, equipment, common.ConnectionConfig.DeviceID)
+	if err != nil {
+		return err
+	}
+	sender, _ := os.Hostname()
+	if sender == "" {
+		sender = define.SystemName
+	}
+	agent, err := mtconnect.NewAgent(device, mtconnect.AgentConfig{Sender: sender, BufferSize: config.BufferSize,
+		ExtensionURN: "urn:" + define.SystemName})
+	if err != nil {
+		return err
+	}
+	port := config.Port
+	if port == 0 {
+		port = mtconnect.DefaultAgentPort
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Endpoint, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	// connections are closed after each response, so that closing the listener stops the agent
+	server := &http.Server{Handler: agent, ReadTimeout: time.Minute, WriteTimeout: time.Minute}
+	server.SetKeepAlivesEnabled(false)
+	go server.Serve(listener)
+	now := time.Now()
+	agent.Observe(mtconnectAvailabilityID, now, "AVAILABLE")
+	svc.agent, svc.ids, svc.listener = agent, ids, listener
+	svc.observe(svc.values, now)
+	return nil
+}
+
+func (svc *MTConnectAgentService) closeServer() {
+	if svc.listener != nil {
+		svc.listener.Close()
+		svc.listener, svc.agent, svc.ids = nil, nil, nil
+	}
+}
+
+// update stores the values of an ops report, observing them if the agent is running
+func (svc *MTConnectAgentService) update(report common.OpsReport, now time.Time) {
+	if svc.values == nil {
+		svc.values = make(map[string]common.TagValue)
+	}
+	for k, v := range report {
+		svc.values[k] = v
+	}
+	if svc.agent != nil {
+		svc.observe(report, now)
+	}
+}
+
+// observe records the reported values of the tags served, at the passed time
+func (svc *MTConnectAgentService) observe(report common.OpsReport, now time.Time) {
+	for k, v := range report {
+		if id, found := svc.ids[k]; found {
+			svc.agent.Observe(id, now, mtconnectValue(v))
+		}
+	}
+}
+
+// mtconnectValue converts a tag value to the value of an observation, the level of a condition
+// being its text. Bad and stale values are unavailable.
+func mtconnectValue(tag common.TagValue) string {
+	if tag.Value == nil || tag.Quality == define.QualityBad || tag.Quality == define.QualityStale {
+		return mtconnect.Unavailable
+	}
+	return fmt.Sprint(tag.Value)
+}
+
+// mtconnectDevice returns the device describing the asset, whose data items are its
+// availability and the tags of the equipment, along with the ids of the tags' data items
+func mtconnectDevice(asset common.Asset, equipment common.Equipment, deviceID string) (mtconnect.Device, map[string]string, error) {
+	tags, err := gatewayTags(equipment.MachineIntegrations)
+	if err != nil {
+		return mtconnect.Device{}, nil, err
+	}
+	name := asset.MachineID
+	if name == "" {
+		name = define.SystemName
+	}
+	device := mtconnect.Device{Name: name, UUID: name, Manufacturer: equipment.Entity, SerialNumber: asset.Serial,
+		Description: localizedText(equipment.Desc, opcuaServerDefaultLocale).Text}
+	if deviceID != "" {
+		device.UUID = deviceID + "." + name
+	}
+	taken := map[string]bool{mtconnectAvailabilityID: true}
+	device.ID = mtconnectID(name, taken)
+	device.DataItems = append(device.DataItems, mtconnect.DataItem{ID: mtconnectAvailabilityID,
+		Category: mtconnect.Event, Type: "AVAILABILITY"})
+	items := make(map[string]common.MTConnectDataItem)
+	if equipment.MachineIntegrations.MTConnect != nil {
+		for _, v := range equipment.MachineIntegrations.MTConnect.DataItems {
+			items[v.ReportedName()] = v
+		}
+	}
+	ids := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		item := mtconnect.DataItem{ID: mtconnectID(tag.name, taken), Name: tag.name, Category: mtconnect.Event,
+			Type: "x:" + mtconnectType(tag.name)}
+		if tag.unit != "" {
+			item.Category = mtconnect.Sample
+		}
+		if v, found := items[tag.name]; found {
+			item.Category = v.Category
+			if v.Type != "" {
+				item.Type = v.Type
+			}
+		}
+		if item.Category == mtconnect.Sample && tag.unit != "" {
+			if units, found := mtconnectUnits[tag.unit]; found {
+				item.Units = units
+			} else {
+				item.NativeUnits = tag.unit
+			}
+		}
+		device.DataItems = append(device.DataItems, item)
+		ids[tag.name] = item.ID
+	}
+	return device, ids, nil
+}
+
+// mtconnectID returns an XML id made of the passed name, its characters that may not appear in
+// ids replaced by underscores, which is not among those taken; a number is appended if needed
+func mtconnectID(name string, taken map[string]bool) string {
+	id := []rune(name)
+	for i, r := range id {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			id[i] = '_'
+		}
+	}
+	base := string(id)
+	if base == "" || !unicode.IsLetter(id[0]) && id[0] != '_' {
+		base = "_" + base
+	}
+	unique := base
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", base, i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// mtconnectType returns the type of the data item of a tag, its name in upper case with words
+// separated by underscores, e.g. LIQUID_TEMP of LiquidTemp and DRIVE1_SPEED of drive1.Speed, or
+// VALUE if it has neither letters nor digits
+func mtconnectType(name string) string {
+	var words []string
+	var word []rune
+	var previous rune
+	for _, r := range name {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			r = 0
+		case unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+			words, word = append(words, string(word)), nil
+		}
+		if r == 0 {
+			if len(word) > 0 {
+				words, word = append(words, string(word)), nil
+			}
+		} else {
+			word = append(word, unicode.ToUpper(r))
+		}
+		previous = r
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	if len(words) == 0 {
+		return "VALUE"
+	}
+	return strings.Join(words, "_")
+}
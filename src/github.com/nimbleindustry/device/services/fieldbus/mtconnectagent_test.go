@@ -0,0 +1,103 @@
+package fieldbus
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/mtconnect"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMTConnectDevice(t *testing.T) {
+	equipment := opcuaGatewayEquipmentFixture
+	equipment.Entity = "Acme Presses"
+	equipment.MachineIntegrations.MTConnect = mtconnectIntegrationFixture
+	device, ids, err := mtconnectDevice(common.Asset{MachineID: "M42", Serial: "SN-1"}, equipment, "gw1")
+	assert.Nil(t, err)
+	assert.Equal(t, "M42", device.ID)
+	assert.Equal(t, "gw1.M42", device.UUID)
+	assert.Equal(t, "Acme Presses", device.Manufacturer)
+	assert.Equal(t, "SN-1", device.SerialNumber)
+	assert.Equal(t, "Press", device.Description)
+	assert.Equal(t, mtconnect.DataItem{ID: "avail", Category: mtconnect.Event, Type: "AVAILABILITY"}, device.DataItems[0])
+
+	// tags with units are samples, others events, the data items of adapters keeping their types
+	items := make(map[string]mtconnect.DataItem)
+	for _, v := range device.DataItems {
+		items[v.Name] = v
+	}
+	assert.Len(t, items, 8)
+	assert.Equal(t, mtconnect.DataItem{ID: "LiquidTemp", Name: "LiquidTemp", Category: mtconnect.Sample,
+		Type: "x:LIQUID_TEMP", Units: "CELSIUS"}, items["LiquidTemp"])
+	assert.Equal(t, mtconnect.DataItem{ID: "drive1.Speed", Name: "drive1.Speed", Category: mtconnect.Sample,
+		Type: "x:DRIVE1_SPEED", Units: "REVOLUTION/MINUTE"}, items["drive1.Speed"])
+	assert.Equal(t, mtconnect.DataItem{ID: "Recipe", Name: "Recipe", Category: mtconnect.Event, Type: "x:RECIPE"}, items["Recipe"])
+	assert.Equal(t, mtconnect.DataItem{ID: "Sspeed", Name: "Sspeed", Category: mtconnect.Sample, Type: "SPINDLE_SPEED",
+		Units: "REVOLUTION/MINUTE"}, items["Sspeed"])
+	assert.Equal(t, mtconnect.DataItem{ID: "System", Name: "System", Category: mtconnect.Condition, Type: "SYSTEM"}, items["System"])
+	assert.Equal(t, "System", ids["System"])
+
+	taken := map[string]bool{"avail": true}
+	assert.Equal(t, "Zone_0_", mtconnectID("Zone[0]", taken))
+	assert.Equal(t, "Zone_0__2", mtconnectID("Zone(0)", taken))
+	assert.Equal(t, "_1st", mtconnectID("1st", taken))
+	assert.Equal(t, "avail_2", mtconnectID("avail", taken))
+	assert.Equal(t, "ZONE_0", mtconnectType("Zone[0]"))
+	assert.Equal(t, "VALUE", mtconnectType("%"))
+
+	assert.Equal(t, "12.5", mtconnectValue(common.TagValue{Value: 12.5, Quality: define.QualityGood}))
+	assert.Equal(t, "true", mtconnectValue(common.TagValue{Value: true, Quality: define.QualityUncertain}))
+	assert.Equal(t, mtconnect.Unavailable, mtconnectValue(common.TagValue{Value: 12.5, Quality: define.QualityStale}))
+	assert.Equal(t, mtconnect.Unavailable, mtconnectValue(common.TagValue{Quality: define.QualityBad}))
+}
+
+func TestMTConnectAgentServesTags(t *testing.T) {
+	svc := &MTConnectAgentService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = define.MTConnectAgentServiceName
+	// borrow a free port for the agent
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	config := common.MTConnectAgentConfig{BufferSize: 16}
+	config.Endpoint, config.Port = "127.0.0.1", probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	// values reported before the agent starts are served
+	svc.update(common.OpsReport{"drive1.Speed": {Value: 1450.0, Unit: "rpm", Quality: define.QualityGood}}, scheduleEpoch)
+	assert.Nil(t, svc.start(config, opcuaGatewayAssetFixture, opcuaGatewayEquipmentFixture))
+	defer svc.closeServer()
+	svc.update(common.OpsReport{"LiquidTemp": {Value: 71.5, Unit: "°C", Quality: define.QualityGood},
+		"Unknown": {Value: 1, Quality: define.QualityGood}}, scheduleEpoch)
+
+	get := func(path string) string {
+		response, err := http.Get("http://" + svc.listener.Addr().String() + path)
+		if !assert.Nil(t, err, path) {
+			return ""
+		}
+		defer response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode, path)
+		body, err := ioutil.ReadAll(response.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+	body := get("/probe")
+	assert.Contains(t, body, `<Device id="M42" name="M42" uuid=`)
+	assert.Contains(t, body, `<DataItem id="LiquidTemp" name="LiquidTemp" category="SAMPLE" type="x:LIQUID_TEMP" units="CELSIUS">`)
+	body = get("/M42/current")
+	assert.Contains(t, body, `<Availability dataItemId="avail"`)
+	assert.Contains(t, body, `>AVAILABLE</Availability>`)
+	assert.Contains(t, body, `>1450</x:Drive1Speed>`)
+	assert.Contains(t, body, `>71.5</x:LiquidTemp>`)
+	assert.Contains(t, body, `>UNAVAILABLE</x:Recipe>`)
+	assert.NotContains(t, body, "Unknown")
+
+	// the agent stops with its configuration
+	svc.closeServer()
+	_, err = http.Get("http://" + net.JoinHostPort(config.Endpoint, strconv.Itoa(config.Port)) + "/probe")
+	assert.NotNil(t, err)
+	assert.Nil(t, svc.agent)
+}
@@ -0,0 +1,469 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/opcua"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	opcuaDefaultPort = 4840
+	opcuaTimeout     = 10 * time.Second
+	opcuaUpdates     = 16 // notifications buffered between the subscriptions and the service
+)
+
+// OPCUAService provides access to the variables of an OPC UA server, as defined by the opcua
+// entries of the equipment config, over the binary protocol without message security. The
+// session with the server is held open; its variables are read once the session is
+// established and thereafter reported as they change by monitored items, sampled at the rate
+// of each entry's poll group. Sessions are anonymous unless the connection record has a
+// username. A lost connection is re-established with exponential backoff, the service exiting
+// (to be restarted by its supervisor) only after repeated failures.
+type OPCUAService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop       chan bool
+	connection common.ConnectionRecord
+	endpoint   string
+	entries    []common.OPCUAEntry
+	pollGroups []common.PollGroup
+	nodes      []opcua.NodeID  // the node of each entry, null for those selected by browse path
+	intervals  []time.Duration // the sampling interval of each entry
+
+	client     *opcua.Client
+	updates    chan []opcua.MonitoredItemNotification
+	lastValues map[string]common.TagValue // last value of each tag, for stale reporting
+	fieldbusMonitor
+}
+
+// NewOPCUAService returns a service for the OPC UA server of the passed connection record,
+// named for the record
+func NewOPCUAService(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *OPCUAService {
+	svc := &OPCUAService{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *OPCUAService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for opcua, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	reconnect := time.NewTimer(svc.untilReconnect(time.Now()))
+	defer reconnect.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		var lost <-chan struct{}
+		if svc.client != nil {
+			lost = svc.client.Done()
+		}
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case items := <-svc.updates:
+			svc.report(items)
+		case <-lost:
+			svc.lose(svc.client.Err())
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.endpoint)
+		case <-reconnect.C:
+			if err := svc.connect(); err != nil && svc.backoff.exhausted(fieldbusReconnectAttempts) {
+				// reconnecting in place has not worked, force supervisor recovery
+				svc.publishState(svc.Name, svc.endpoint, define.ConnectionFailed, err)
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+			resetTimer(reconnect, svc.untilReconnect(time.Now()))
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *OPCUAService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *OPCUAService) State() int {
+	return svc.ServiceState
+}
+
+func (svc *OPCUAService) clean() {
+	svc.closeConnection()
+}
+
+func (svc *OPCUAService) initConfigurations() error {
+	if common.ConnectionConfig.DeviceID == "" {
+		return errors.New("Connection config object not initialized")
+	}
+	if common.EquipmentConfig.Ref == "" {
+		return errors.New("Equipment config object not initialized")
+	}
+	svc.entries = common.EquipmentConfig.MachineIntegrations.OPCUAEntries
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
+	return nil
+}
+
+// initBusIntegration validates the entries, parsing their node ids and sampling intervals
+func (svc *OPCUAService) initBusIntegration() error {
+	if svc.connection.Type == "" {
+		return errors.New("No OPCUA connection records")
+	}
+	if len(svc.entries) == 0 {
+		return errors.New("No opcua entries")
+	}
+	svc.endpoint = opcuaEndpoint(svc.connection)
+	intervals, err := samplingIntervals(svc.entries, svc.pollGroups, modbusSampleFrequency)
+	if err != nil {
+		return err
+	}
+	svc.intervals = intervals
+	svc.nodes = make([]opcua.NodeID, len(svc.entries))
+	tags := make(map[string]bool, len(svc.entries))
+	for i, v := range svc.entries {
+		switch {
+		case v.TagName == "":
+			return fmt.Errorf("opcua entry %d has no tagName", i)
+		case tags[v.TagName]:
+			return fmt.Errorf("%s is defined more than once", v.TagName)
+		case v.NodeID != "":
+			if svc.nodes[i], err = opcua.ParseNodeID(v.NodeID); err != nil {
+				return fmt.Errorf("%s %s", v.TagName, err)
+			}
+		case strings.Trim(v.BrowsePath, "/") == "":
+			return fmt.Errorf("%s has neither nodeId nor browsePath", v.TagName)
+		}
+		tags[v.TagName] = true
+	}
+	svc.updates = make(chan []opcua.MonitoredItemNotification, opcuaUpdates)
+	svc.backoff = reconnectBackoff{min: fieldbusReconnectMinDelay, max: fieldbusReconnectMaxDelay}
+	return nil
+}
+
+// opcuaEndpoint returns the endpoint URL of a connection record, whose endpoint is either a
+// URL (opc.tcp://10.0.1.40:4840) or the host of the server
+func opcuaEndpoint(record common.ConnectionRecord) string {
+	if strings.HasPrefix(record.Endpoint, "opc.tcp://") {
+		return record.Endpoint
+	}
+	port := record.Port
+	if port == 0 {
+		port = opcuaDefaultPort
+	}
+	return "opc.tcp://" + net.JoinHostPort(record.Endpoint, strconv.Itoa(port))
+}
+
+// samplingIntervals returns the sampling interval of each entry: that of its poll group, its
+// own poll interval or, failing those, that of the default group which is defaultInterval
+// unless a group named "default" is defined
+func samplingIntervals(entries []common.OPCUAEntry, definitions []common.PollGroup, defaultInterval time.Duration) ([]time.Duration, error) {
+	named := map[string]time.Duration{defaultPollGroupName: defaultInterval}
+	for _, v := range definitions {
+		interval, err := parsePollInterval(v.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("poll group %s %s", v.Name, err)
+		}
+		named[v.Name] = interval
+	}
+	intervals := make([]time.Duration, len(entries))
+	for i, entry := range entries {
+		switch {
+		case entry.PollGroup != "":
+			var found bool
+			if intervals[i], found = named[entry.PollGroup]; !found {
+				return nil, fmt.Errorf("%s assigned to undefined poll group %s", entry.TagName, entry.PollGroup)
+			}
+		case entry.PollInterval != "":
+			interval, err := parsePollInterval(entry.PollInterval)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", entry.TagName, err)
+			}
+			intervals[i] = interval
+		default:
+			intervals[i] = named[defaultPollGroupName]
+		}
+	}
+	return intervals, nil
+}
+
+// untilReconnect returns how long until the connection may be (re-)established, an hour
+// while it is open
+func (svc *OPCUAService) untilReconnect(now time.Time) time.Duration {
+	if svc.client != nil {
+		return time.Hour
+	}
+	if wait := svc.backoff.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// connect establishes the session, reports the current value of every entry and subscribes to
+// their changes. A failure to connect is reported, and every tag reported stale.
+func (svc *OPCUAService) connect() error {
+	if svc.client != nil {
+		return nil
+	}
+	now := time.Now()
+	if !svc.backoff.ready(now) {
+		return fmt.Errorf("reconnect to %s deferred for %s", svc.endpoint, svc.backoff.next.Sub(now))
+	}
+	client, err := opcua.Dial(svc.endpoint, opcua.ClientConfig{Username: svc.connection.Username,
+		Password: svc.connection.Password, Timeout: opcuaTimeout, ApplicationName: common.ConnectionConfig.DeviceID})
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	if err == nil {
+		if err = svc.subscribe(client); err != nil {
+			client.Close()
+		}
+	}
+	if err != nil {
+		delay := svc.backoff.failed(now)
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to connect to OPC UA server %s, retrying in %s: %s", svc.Name, svc.endpoint, delay, err))
+		svc.publishState(svc.Name, svc.endpoint, define.ConnectionDisconnected, err)
+		sendOpsReport(svc.Name, svc.staleReport(err))
+		return err
+	}
+	svc.client = client
+	svc.backoff.succeeded()
+	svc.countConnect()
+	svc.LogFunc(fmt.Sprintf("%s establishes connection to OPC UA server %s", svc.Name, svc.endpoint))
+	svc.publishState(svc.Name, svc.endpoint, define.ConnectionConnected, nil)
+	return nil
+}
+
+// subscribe resolves the nodes of the entries, reads their values and monitors them, with a
+// subscription for each sampling interval. Entries whose nodes cannot be resolved, read or
+// monitored are reported bad; an error is returned only should the session fail.
+func (svc *OPCUAService) subscribe(client *opcua.Client) error {
+	report := make(common.OpsReport)
+	var nodes []opcua.NodeID
+	var handles []uint32
+	for i, v := range svc.entries {
+		node := svc.nodes[i]
+		if node.IsNull() {
+			var err error
+			node, err = client.ResolvePath(opcua.NewNumericNodeID(0, opcua.ObjectObjectsFolder),
+				strings.Split(strings.Trim(v.BrowsePath, "/"), "/"))
+			svc.count(v.TagName, err)
+			if err != nil {
+				if client.Err() != nil {
+					return err
+				}
+				svc.LogFunc(fmt.Sprintf("%s warns: unable to resolve %s browse path %s: %s", svc.Name, v.TagName, v.BrowsePath, err))
+				report[v.TagName] = svc.badValue(v, err)
+				continue
+			}
+		}
+		nodes = append(nodes, node)
+		handles = append(handles, uint32(i))
+	}
+	if len(nodes) > 0 {
+		values, err := client.Read(nodes)
+		for _, i := range handles {
+			svc.count(svc.entries[i].TagName, err)
+		}
+		if err != nil {
+			return err
+		}
+		for j, i := range handles {
+			report[svc.entries[i].TagName] = svc.tagValue(svc.entries[i], values[j])
+		}
+	}
+
+	// a subscription for each sampling interval, the shortest first
+	byInterval := make(map[time.Duration][]opcua.MonitoredItem)
+	var intervals []time.Duration
+	for j, i := range handles {
+		interval := svc.intervals[i]
+		if byInterval[interval] == nil {
+			intervals = append(intervals, interval)
+		}
+		byInterval[interval] = append(byInterval[interval],
+			opcua.MonitoredItem{NodeID: nodes[j], Handle: i, SamplingInterval: interval})
+	}
+	sort.Sort(durations(intervals))
+	for _, interval := range intervals {
+		subscription, err := client.Subscribe(interval)
+		countOutcome(&svc.diagnostics.FieldbusCounters, err)
+		if err != nil {
+			return err
+		}
+		items := byInterval[interval]
+		statuses, err := subscription.Monitor(items)
+		countOutcome(&svc.diagnostics.FieldbusCounters, err)
+		if err != nil {
+			return err
+		}
+		for k, status := range statuses {
+			if status.IsBad() {
+				entry := svc.entries[items[k].Handle]
+				svc.LogFunc(fmt.Sprintf("%s warns: unable to monitor %s: %s", svc.Name, entry.TagName, status))
+				report[entry.TagName] = svc.badValue(entry, status)
+			}
+		}
+		go svc.forward(client, subscription)
+	}
+	sendOpsReport(svc.Name, report)
+	return nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// forward passes the notifications of a subscription to the service until the connection is
+// lost or closed
+func (svc *OPCUAService) forward(client *opcua.Client, subscription *opcua.Subscription) {
+	for items := range subscription.Notifications {
+		select {
+		case svc.updates <- items:
+		case <-client.Done():
+			return
+		}
+	}
+}
+
+// report sends the values of the passed notifications on TopicOpsReport
+func (svc *OPCUAService) report(items []opcua.MonitoredItemNotification) {
+	report := make(common.OpsReport)
+	for _, v := range items {
+		if int(v.ClientHandle) >= len(svc.entries) {
+			continue
+		}
+		entry := svc.entries[v.ClientHandle]
+		report[entry.TagName] = svc.tagValue(entry, v.Value)
+	}
+	if len(report) > 0 {
+		sendOpsReport(svc.Name, report)
+	}
+}
+
+// lose reports the loss of the connection, and every tag stale; the connection is
+// re-established once the backoff allows
+func (svc *OPCUAService) lose(err error) {
+	svc.client = nil
+	svc.LogFunc(fmt.Sprintf("%s loses connection to OPC UA server %s: %s", svc.Name, svc.endpoint, err))
+	svc.publishState(svc.Name, svc.endpoint, define.ConnectionDisconnected, err)
+	sendOpsReport(svc.Name, svc.staleReport(err))
+}
+
+// tagValue converts the value of an entry's variable to engineering units. The quality
+// follows the variable's status, values that are not numbers or strings being reported as
+// text.
+func (svc *OPCUAService) tagValue(entry common.OPCUAEntry, value opcua.DataValue) common.TagValue {
+	if value.Status.IsBad() {
+		return svc.badValue(entry, value.Status)
+	}
+	var v interface{}
+	switch raw := value.Value.Value.(type) {
+	case opcua.LocalizedText:
+		v = raw.Text
+	case opcua.QualifiedName:
+		v = raw.Name
+	case time.Time:
+		v = raw
+	case fmt.Stringer:
+		v = raw.String()
+	default:
+		v = raw
+	}
+	tag := scaledValue(entry.TagName, entry.Scaling, v)
+	if value.Status.IsUncertain() && tag.Quality == define.QualityGood {
+		tag.Quality = define.QualityUncertain
+		tag.Error = fmt.Sprintf("%s status %s", entry.TagName, value.Status)
+	}
+	if svc.lastValues == nil {
+		svc.lastValues = make(map[string]common.TagValue)
+	}
+	if tag.Quality != define.QualityBad {
+		svc.lastValues[entry.TagName] = tag
+	}
+	return tag
+}
+
+// badValue reports an entry that could not be read
+func (svc *OPCUAService) badValue(entry common.OPCUAEntry, reason error) common.TagValue {
+	return common.TagValue{Unit: entry.Unit, Quality: define.QualityBad, Error: fmt.Sprintf("%s %s", entry.TagName, reason)}
+}
+
+// staleReport reports every entry as stale, carrying its last value forward, or bad if it has
+// none
+func (svc *OPCUAService) staleReport(reason error) common.OpsReport {
+	m := make(common.OpsReport, len(svc.entries))
+	for _, v := range svc.entries {
+		last, found := svc.lastValues[v.TagName]
+		if !found {
+			m[v.TagName] = common.TagValue{Unit: v.Unit, Quality: define.QualityBad, Error: reason.Error()}
+			continue
+		}
+		m[v.TagName] = common.TagValue{Value: last.Value, Unit: v.Unit, Quality: define.QualityStale, Error: reason.Error()}
+	}
+	return m
+}
+
+func (svc *OPCUAService) closeConnection() (err error) {
+	if svc.client != nil {
+		err = svc.client.Close()
+		svc.client = nil
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s reports error disconnecting from OPC UA server %s, %s", svc.Name, svc.endpoint, err))
+		} else {
+			svc.LogFunc(fmt.Sprintf("%s disconnects from OPC UA server %s", svc.Name, svc.endpoint))
+		}
+		svc.publishState(svc.Name, svc.endpoint, define.ConnectionDisconnected, nil)
+	}
+	return
+}
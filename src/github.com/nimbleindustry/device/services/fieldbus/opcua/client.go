@@ -0,0 +1,575 @@
+package opcua
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort           = "4840"
+	defaultTimeout        = 10 * time.Second
+	defaultSessionTimeout = time.Minute
+	channelLifetime       = time.Hour
+	publishKeepAliveCount = 10
+	publishLifetimeCount  = 3 * publishKeepAliveCount
+	notificationsBuffer   = 16
+)
+
+// ClientConfig holds the settings of a client session. The session is anonymous unless
+// Username is set.
+type ClientConfig struct {
+	Username        string
+	Password        string
+	Timeout         time.Duration // dial and request timeout, 10s if unset
+	SessionTimeout  time.Duration // the time the session outlives a lost connection, 1m if unset
+	ApplicationName string        // the name of the session's application
+}
+
+// Client is a session with an OPC UA server over the binary protocol (opc.tcp), without
+// message security (security policy None). Requests may be made concurrently, their responses
+// being dispatched by request id as they arrive. Once the connection is lost every request
+// fails, Done is closed and Err returns the reason.
+type Client struct {
+	endpoint string
+	config   ClientConfig
+	conn     *secureConn
+
+	mutex         sync.Mutex
+	requestID     uint32
+	pending       map[uint32]chan result
+	authToken     NodeID
+	subscriptions map[uint32]*Subscription
+	publishing    bool
+	done          chan struct{}
+	err           error
+}
+
+// result is the response to a request, or the reason it failed
+type result struct {
+	response interface{}
+	err      error
+}
+
+// Dial connects to the server at the passed endpoint URL (e.g. "opc.tcp://10.0.1.40:4840"),
+// opens a secure channel and creates and activates a session
+func Dial(endpoint string, config ClientConfig) (*Client, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.SessionTimeout <= 0 {
+		config.SessionTimeout = defaultSessionTimeout
+	}
+	address, err := endpointAddress(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	ack, err := hello(conn, endpoint, config.Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &Client{endpoint: endpoint, config: config, conn: newSecureConn(conn, config.Timeout, ack),
+		pending: make(map[uint32]chan result), subscriptions: make(map[uint32]*Subscription),
+		done: make(chan struct{})}
+	go c.receive()
+	if err := c.openChannel(SecurityTokenIssue); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	if err := c.createSession(); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// endpointAddress returns the host:port of an opc.tcp endpoint URL
+func endpointAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "opc.tcp" || u.Host == "" {
+		return "", fmt.Errorf("%s, %q is not an opc.tcp endpoint url", StatusBadTCPEndpointURLInvalid, endpoint)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return net.JoinHostPort(strings.Trim(u.Host, "[]"), defaultPort), nil
+	}
+	return u.Host, nil
+}
+
+// hello exchanges hello and acknowledge messages
+func hello(conn net.Conn, endpoint string, timeout time.Duration) (acknowledgeMessage, error) {
+	var ack acknowledgeMessage
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	body := Marshal(helloMessage{ProtocolVersion: protocolVersion, ReceiveBufferSize: bufferSize,
+		SendBufferSize: bufferSize, MaxMessageSize: maxMessageSize, EndpointURL: endpoint})
+	if err := writeChunk(conn, messageHello, chunkFinal, body); err != nil {
+		return ack, err
+	}
+	messageType, _, body, err := readChunk(conn, bufferSize)
+	if err != nil {
+		return ack, err
+	}
+	switch messageType {
+	case messageAcknowledge:
+		err = Unmarshal(body, &ack)
+		if err == nil && ack.ReceiveBufferSize < minBufferSize {
+			err = fmt.Errorf("opcua: server receive buffer of %d bytes is too small", ack.ReceiveBufferSize)
+		}
+		return ack, err
+	case messageError:
+		var m errorMessage
+		if err := Unmarshal(body, &m); err != nil {
+			return ack, err
+		}
+		return ack, m.err()
+	}
+	return ack, fmt.Errorf("%s, expected acknowledge, got %q", StatusBadTCPMessageTypeInvalid, messageType)
+}
+
+// openChannel opens the secure channel, or renews its token, scheduling the next renewal
+func (c *Client) openChannel(requestType SecurityTokenRequestType) error {
+	request := &OpenSecureChannelRequest{ClientProtocolVersion: protocolVersion, RequestType: requestType,
+		SecurityMode: MessageSecurityModeNone, RequestedLifetime: uint32(channelLifetime / time.Millisecond)}
+	response, err := c.call(messageOpen, request, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+	token := response.(*OpenSecureChannelResponse).SecurityToken
+	c.conn.setToken(token.ChannelID, token.TokenID)
+	// renew once three quarters of the token's lifetime has passed
+	lifetime := time.Duration(token.RevisedLifetime) * time.Millisecond
+	if lifetime <= 0 {
+		lifetime = channelLifetime
+	}
+	time.AfterFunc(lifetime*3/4, func() {
+		select {
+		case <-c.done:
+		default:
+			if err := c.openChannel(SecurityTokenRenew); err != nil {
+				c.fail(fmt.Errorf("opcua: renewing secure channel, %s", err))
+			}
+		}
+	})
+	return nil
+}
+
+// createSession creates and activates the session, with the user identity of the config
+func (c *Client) createSession() error {
+	name := c.config.ApplicationName
+	if name == "" {
+		name = "nimble-device"
+	}
+	response, err := c.call(messageService, &CreateSessionRequest{
+		ClientDescription: ApplicationDescription{ApplicationURI: "urn:" + name, ApplicationName: LocalizedText{Text: name},
+			ApplicationType: ApplicationTypeClient},
+		EndpointURL:             c.endpoint,
+		SessionName:             name,
+		ClientNonce:             make([]byte, 32),
+		RequestedSessionTimeout: float64(c.config.SessionTimeout / time.Millisecond),
+		MaxResponseMessageSize:  maxMessageSize,
+	}, c.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("opcua: creating session, %s", err)
+	}
+	session := response.(*CreateSessionResponse)
+	c.mutex.Lock()
+	c.authToken = session.AuthenticationToken
+	c.mutex.Unlock()
+
+	token, err := c.identityToken(session.ServerEndpoints)
+	if err != nil {
+		return err
+	}
+	if _, err := c.call(messageService, &ActivateSessionRequest{UserIdentityToken: token}, c.config.Timeout); err != nil {
+		return fmt.Errorf("opcua: activating session, %s", err)
+	}
+	return nil
+}
+
+// identityToken returns the user identity token of the config, using the policy of the server
+// endpoint without message security that accepts such tokens
+func (c *Client) identityToken(endpoints []EndpointDescription) (ExtensionObject, error) {
+	tokenType := UserTokenTypeAnonymous
+	if c.config.Username != "" {
+		tokenType = UserTokenTypeUserName
+	}
+	var policy *UserTokenPolicy
+	for _, endpoint := range endpoints {
+		if endpoint.SecurityMode != MessageSecurityModeNone {
+			continue
+		}
+		for i, v := range endpoint.UserIdentityTokens {
+			if v.TokenType == tokenType && policy == nil {
+				policy = &endpoint.UserIdentityTokens[i]
+			}
+		}
+	}
+	if policy == nil {
+		return ExtensionObject{}, fmt.Errorf("%s, the server accepts no %s identity without message security",
+			StatusBadIdentityTokenInvalid, map[UserTokenType]string{UserTokenTypeAnonymous: "anonymous", UserTokenTypeUserName: "username"}[tokenType])
+	}
+	if tokenType == UserTokenTypeAnonymous {
+		return NewExtensionObject(&AnonymousIdentityToken{PolicyID: policy.PolicyID}), nil
+	}
+	if policy.SecurityPolicyURI != "" && policy.SecurityPolicyURI != SecurityPolicyNone {
+		return ExtensionObject{}, fmt.Errorf("%s, the server requires the password to be encrypted with %s",
+			StatusBadIdentityTokenInvalid, policy.SecurityPolicyURI)
+	}
+	return NewExtensionObject(&UserNameIdentityToken{PolicyID: policy.PolicyID, UserName: c.config.Username,
+		Password: []byte(c.config.Password)}), nil
+}
+
+// call sends a request and waits up to timeout for its response. Service faults, and
+// responses with a bad service result, are returned as errors.
+func (c *Client) call(messageType string, request interface{}, timeout time.Duration) (interface{}, error) {
+	ch := make(chan result, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.requestID++
+	requestID := c.requestID
+	c.pending[requestID] = ch
+	*requestHeader(request) = RequestHeader{AuthenticationToken: c.authToken, Timestamp: time.Now(),
+		RequestHandle: requestID, TimeoutHint: uint32(timeout / time.Millisecond)}
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, requestID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.conn.writeMessage(messageType, requestID, encodeService(request)); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if fault, ok := r.response.(*ServiceFault); ok {
+			return nil, fault.ResponseHeader.ServiceResult
+		}
+		if header := responseHeader(r.response); header != nil && header.ServiceResult.IsBad() {
+			return nil, header.ServiceResult
+		}
+		return r.response, nil
+	case <-timer.C:
+		return nil, StatusBadTimeout
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// receive dispatches each response received to the request awaiting it, until the connection
+// fails
+func (c *Client) receive() {
+	for {
+		m, err := c.conn.readMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		r := result{err: m.Abort}
+		if m.Abort == nil {
+			r.response, r.err = decodeService(m.Body)
+		}
+		c.mutex.Lock()
+		ch := c.pending[m.RequestID]
+		c.mutex.Unlock()
+		if ch != nil {
+			ch <- r
+		}
+	}
+}
+
+// fail closes the connection for the passed reason, the first such reason being retained
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.conn.Close()
+}
+
+// Done is closed once the connection has been lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was lost or closed, nil while it is open
+func (c *Client) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Close closes the session, deleting its subscriptions, and the secure channel
+func (c *Client) Close() error {
+	if c.Err() != nil {
+		return nil
+	}
+	_, err := c.call(messageService, &CloseSessionRequest{DeleteSubscriptions: true}, c.config.Timeout)
+	c.mutex.Lock()
+	c.requestID++
+	requestID := c.requestID
+	c.mutex.Unlock()
+	c.conn.writeMessage(messageClose, requestID, encodeService(&CloseSecureChannelRequest{}))
+	c.fail(errClosed)
+	return err
+}
+
+// ReadAttributes reads an attribute of each of the passed nodes. The status of each result
+// is that of its read, a bad status leaving its value null.
+func (c *Client) ReadAttributes(nodes []NodeID, attribute AttributeID) ([]DataValue, error) {
+	request := &ReadRequest{TimestampsToReturn: TimestampsBoth}
+	for _, v := range nodes {
+		request.NodesToRead = append(request.NodesToRead, ReadValueID{NodeID: v, AttributeID: attribute})
+	}
+	response, err := c.call(messageService, request, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	results := response.(*ReadResponse).Results
+	if len(results) != len(nodes) {
+		return nil, fmt.Errorf("%s, %d results read for %d nodes", StatusBadUnexpectedError, len(results), len(nodes))
+	}
+	return results, nil
+}
+
+// Read reads the values of the passed nodes
+func (c *Client) Read(nodes []NodeID) ([]DataValue, error) {
+	return c.ReadAttributes(nodes, AttributeValue)
+}
+
+// Browse returns the references of the passed node in the passed direction, of referenceType
+// and its subtypes (every reference if null), following continuation points until every
+// reference has been returned
+func (c *Client) Browse(node NodeID, direction BrowseDirection, referenceType NodeID) ([]ReferenceDescription, error) {
+	response, err := c.call(messageService, &BrowseRequest{NodesToBrowse: []BrowseDescription{{NodeID: node,
+		BrowseDirection: direction, ReferenceTypeID: referenceType, IncludeSubtypes: true, ResultMask: browseResultAll}}},
+		c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	results := response.(*BrowseResponse).Results
+	var references []ReferenceDescription
+	for {
+		if len(results) != 1 {
+			return nil, fmt.Errorf("%s, %d browse results for one node", StatusBadUnexpectedError, len(results))
+		}
+		if results[0].StatusCode.IsBad() {
+			return nil, results[0].StatusCode
+		}
+		references = append(references, results[0].References...)
+		if len(results[0].ContinuationPoint) == 0 {
+			return references, nil
+		}
+		response, err := c.call(messageService, &BrowseNextRequest{ContinuationPoints: [][]byte{results[0].ContinuationPoint}},
+			c.config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		results = response.(*BrowseNextResponse).Results
+	}
+}
+
+// ResolvePath returns the node reached from start by following hierarchical references to the
+// nodes of the passed browse names, in turn. A name of the form "2:Speed" must also match the
+// namespace index of the browse name.
+func (c *Client) ResolvePath(start NodeID, names []string) (NodeID, error) {
+	node := start
+	for i, name := range names {
+		references, err := c.Browse(node, BrowseDirectionForward, NewNumericNodeID(0, ReferenceTypeHierarchicalReferences))
+		if err != nil {
+			return NodeID{}, err
+		}
+		found := false
+		for _, v := range references {
+			if matchBrowseName(v.BrowseName, name) && v.NodeID.ServerIndex == 0 && v.NodeID.NamespaceURI == "" {
+				node, found = v.NodeID.NodeID, true
+				break
+			}
+		}
+		if !found {
+			return NodeID{}, fmt.Errorf("%s, %s not found", StatusBadNodeIDUnknown, strings.Join(names[:i+1], "/"))
+		}
+	}
+	return node, nil
+}
+
+// matchBrowseName returns true if the browse name matches name, of the form "Speed" or
+// "2:Speed"
+func matchBrowseName(browseName QualifiedName, name string) bool {
+	if i := strings.Index(name, ":"); i > 0 {
+		if ns := name[:i]; strings.Trim(ns, "0123456789") == "" {
+			return fmt.Sprint(browseName.NamespaceIndex) == ns && browseName.Name == name[i+1:]
+		}
+	}
+	return browseName.Name == name
+}
+
+// MonitoredItem selects a node whose value is sampled by a subscription. Notifications of its
+// value carry Handle.
+type MonitoredItem struct {
+	NodeID           NodeID
+	Handle           uint32
+	SamplingInterval time.Duration // zero for the fastest rate of the server
+}
+
+// Subscription delivers the notifications of the values sampled by its monitored items, in
+// the order they were published, on Notifications. The channel is closed once the connection
+// is lost or closed.
+type Subscription struct {
+	ID            uint32
+	Interval      time.Duration // the revised publishing interval
+	Notifications <-chan []MonitoredItemNotification
+
+	client        *Client
+	notifications chan []MonitoredItemNotification
+	keepAlive     time.Duration // the longest time between publish responses
+}
+
+// Subscribe creates a subscription publishing at the passed interval
+func (c *Client) Subscribe(interval time.Duration) (*Subscription, error) {
+	response, err := c.call(messageService, &CreateSubscriptionRequest{
+		RequestedPublishingInterval: float64(interval / time.Millisecond),
+		RequestedLifetimeCount:      publishLifetimeCount,
+		RequestedMaxKeepAliveCount:  publishKeepAliveCount,
+		PublishingEnabled:           true,
+	}, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	created := response.(*CreateSubscriptionResponse)
+	s := &Subscription{ID: created.SubscriptionID, client: c,
+		Interval:      time.Duration(created.RevisedPublishingInterval * float64(time.Millisecond)),
+		notifications: make(chan []MonitoredItemNotification, notificationsBuffer)}
+	s.Notifications = s.notifications
+	keepAliveCount := created.RevisedMaxKeepAliveCount
+	if keepAliveCount == 0 {
+		keepAliveCount = 1
+	}
+	s.keepAlive = s.Interval * time.Duration(keepAliveCount)
+
+	c.mutex.Lock()
+	c.subscriptions[s.ID] = s
+	start := !c.publishing
+	c.publishing = true
+	c.mutex.Unlock()
+	if start {
+		go c.publish()
+	}
+	return s, nil
+}
+
+// Monitor creates monitored items reporting the values of the passed nodes, returning the
+// result of creating each
+func (s *Subscription) Monitor(items []MonitoredItem) ([]StatusCode, error) {
+	request := &CreateMonitoredItemsRequest{SubscriptionID: s.ID, TimestampsToReturn: TimestampsBoth}
+	for _, v := range items {
+		request.ItemsToCreate = append(request.ItemsToCreate, MonitoredItemCreateRequest{
+			ItemToMonitor:  ReadValueID{NodeID: v.NodeID, AttributeID: AttributeValue},
+			MonitoringMode: MonitoringModeReporting,
+			RequestedParameters: MonitoringParameters{ClientHandle: v.Handle,
+				SamplingInterval: float64(v.SamplingInterval / time.Millisecond), QueueSize: 1, DiscardOldest: true},
+		})
+	}
+	response, err := s.client.call(messageService, request, s.client.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	results := response.(*CreateMonitoredItemsResponse).Results
+	if len(results) != len(items) {
+		return nil, fmt.Errorf("%s, %d results for %d monitored items", StatusBadUnexpectedError, len(results), len(items))
+	}
+	statuses := make([]StatusCode, len(results))
+	for i, v := range results {
+		statuses[i] = v.StatusCode
+	}
+	return statuses, nil
+}
+
+var errKeepAliveLost = errors.New("opcua: no publish response within the subscription keep-alive period")
+
+// publish requests notification messages, delivering the data changes they carry to their
+// subscriptions, until the connection is lost. A server that does not respond within the
+// longest keep-alive period of the subscriptions is taken to have failed.
+func (c *Client) publish() {
+	var acknowledgements []SubscriptionAcknowledgement
+	defer func() {
+		c.mutex.Lock()
+		for id, s := range c.subscriptions {
+			close(s.notifications)
+			delete(c.subscriptions, id)
+		}
+		c.publishing = false
+		c.mutex.Unlock()
+	}()
+	for {
+		timeout := c.config.Timeout
+		c.mutex.Lock()
+		for _, s := range c.subscriptions {
+			if s.keepAlive+c.config.Timeout > timeout {
+				timeout = s.keepAlive + c.config.Timeout
+			}
+		}
+		c.mutex.Unlock()
+		response, err := c.call(messageService, &PublishRequest{SubscriptionAcknowledgements: acknowledgements}, timeout)
+		if err != nil {
+			switch {
+			case c.Err() != nil:
+			case err == StatusBadTimeout:
+				c.fail(errKeepAliveLost)
+			case err == StatusBadNoSubscription:
+				// the subscriptions were deleted, as when the session closes
+				return
+			default:
+				c.fail(fmt.Errorf("opcua: publishing, %s", err))
+			}
+			return
+		}
+		published := response.(*PublishResponse)
+		acknowledgements = nil
+		message := published.NotificationMessage
+		if len(message.NotificationData) == 0 {
+			// keep-alive
+			continue
+		}
+		acknowledgements = append(acknowledgements, SubscriptionAcknowledgement{published.SubscriptionID, message.SequenceNumber})
+		c.mutex.Lock()
+		s := c.subscriptions[published.SubscriptionID]
+		c.mutex.Unlock()
+		for _, data := range message.NotificationData {
+			switch n := data.Value.(type) {
+			case *DataChangeNotification:
+				if s != nil && len(n.MonitoredItems) > 0 {
+					select {
+					case s.notifications <- n.MonitoredItems:
+					case <-c.done:
+						return
+					}
+				}
+			case *StatusChangeNotification:
+				c.fail(fmt.Errorf("opcua: subscription %d status changed to %s", published.SubscriptionID, n.Status))
+				return
+			}
+		}
+	}
+}
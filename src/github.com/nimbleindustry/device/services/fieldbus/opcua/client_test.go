@@ -0,0 +1,169 @@
+package opcua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addressSpaceFixture returns an address space holding a line with a few variables, in
+// namespace 1
+func addressSpaceFixture() *AddressSpace {
+	space := NewAddressSpace()
+	ns := space.AddNamespace("urn:nimble:test")
+	line := NewStringNodeID(ns, "Line1")
+	space.AddNode(NewNumericNodeID(0, ObjectObjectsFolder), NewNumericNodeID(0, ReferenceTypeOrganizes), Node{ID: line,
+		Class: NodeClassObject, BrowseName: QualifiedName{ns, "Line1"}, TypeDefinition: NewNumericNodeID(0, ObjectTypeFolderType)})
+	for name, value := range map[string]interface{}{"Speed": float64(12.5), "Running": true, "Recipe": "A"} {
+		space.AddNode(line, NewNumericNodeID(0, ReferenceTypeHasComponent), Node{ID: NewStringNodeID(ns, "Line1."+name),
+			Class: NodeClassVariable, BrowseName: QualifiedName{ns, name}, Description: LocalizedText{Text: name + " of line 1"},
+			TypeDefinition: NewNumericNodeID(0, VariableTypeBaseDataVariableType), Value: DataValue{Value: Variant{value}}})
+	}
+	return space
+}
+
+func TestClientBrowseAndRead(t *testing.T) {
+	space := addressSpaceFixture()
+	server, err := Listen("127.0.0.1:0", space, ServerConfig{AllowAnonymous: true})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	client, err := Dial("opc.tcp://"+server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	references, err := client.Browse(NewNumericNodeID(0, ObjectObjectsFolder), BrowseDirectionForward,
+		NewNumericNodeID(0, ReferenceTypeHierarchicalReferences))
+	assert.Nil(t, err)
+	var names []string
+	for _, v := range references {
+		names = append(names, v.BrowseName.Name)
+	}
+	assert.Equal(t, []string{"Server", "Line1"}, names)
+
+	speed, err := client.ResolvePath(NewNumericNodeID(0, ObjectObjectsFolder), []string{"1:Line1", "Speed"})
+	assert.Nil(t, err)
+	assert.Equal(t, NewStringNodeID(1, "Line1.Speed"), speed)
+	_, err = client.ResolvePath(NewNumericNodeID(0, ObjectObjectsFolder), []string{"2:Line1"})
+	assert.NotNil(t, err, "expected the namespace of the browse name to be matched")
+
+	values, err := client.Read([]NodeID{speed, NewStringNodeID(1, "Line1.Running"), NewStringNodeID(1, "Missing")})
+	assert.Nil(t, err)
+	assert.Equal(t, 12.5, values[0].Value.Value)
+	assert.False(t, values[0].ServerTimestamp.IsZero())
+	assert.Equal(t, true, values[1].Value.Value)
+	assert.Equal(t, StatusBadNodeIDUnknown, values[2].Status)
+
+	attributes, err := client.ReadAttributes([]NodeID{speed}, AttributeDescription)
+	assert.Nil(t, err)
+	assert.Equal(t, LocalizedText{Text: "Speed of line 1"}, attributes[0].Value.Value)
+	attributes, err = client.ReadAttributes([]NodeID{speed}, AttributeDataType)
+	assert.Nil(t, err)
+	assert.Equal(t, NewNumericNodeID(0, TypeDouble), attributes[0].Value.Value)
+	attributes, err = client.ReadAttributes([]NodeID{NewNumericNodeID(0, variableNamespaceArray)}, AttributeValue)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://opcfoundation.org/UA/", "urn:nimble:test"}, attributes[0].Value.Value)
+}
+
+func TestClientLargeMessages(t *testing.T) {
+	space := addressSpaceFixture()
+	folder := NewStringNodeID(1, "Many")
+	space.AddNode(NewNumericNodeID(0, ObjectObjectsFolder), NewNumericNodeID(0, ReferenceTypeOrganizes),
+		Node{ID: folder, Class: NodeClassObject, BrowseName: QualifiedName{1, "Many"}})
+	var nodes []NodeID
+	for i := 0; i < 1500; i++ {
+		id := NewStringNodeID(1, fmt.Sprintf("Many.Tag%d", i))
+		space.AddNode(folder, NewNumericNodeID(0, ReferenceTypeHasComponent), Node{ID: id, Class: NodeClassVariable,
+			BrowseName: QualifiedName{1, fmt.Sprintf("Tag%d", i)}, Value: DataValue{Value: Variant{strings.Repeat("x", 100)}}})
+		nodes = append(nodes, id)
+	}
+	server, err := Listen("127.0.0.1:0", space, ServerConfig{AllowAnonymous: true})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	client, err := Dial("opc.tcp://"+server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	// the browse is continued past the references returned per node, and the read request and
+	// response span several chunks
+	references, err := client.Browse(folder, BrowseDirectionForward, NewNumericNodeID(0, ReferenceTypeHasComponent))
+	assert.Nil(t, err)
+	assert.Len(t, references, 1500)
+	values, err := client.Read(nodes)
+	assert.Nil(t, err)
+	assert.Len(t, values, 1500)
+	assert.Equal(t, strings.Repeat("x", 100), values[1499].Value.Value)
+}
+
+func TestClientIdentity(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", addressSpaceFixture(), ServerConfig{Users: map[string]string{"operator": "secret"}})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	endpoint := "opc.tcp://" + server.Addr().String()
+
+	_, err = Dial(endpoint, ClientConfig{Timeout: time.Second})
+	assert.NotNil(t, err, "expected an anonymous session to be refused")
+	_, err = Dial(endpoint, ClientConfig{Username: "operator", Password: "wrong", Timeout: time.Second})
+	assert.NotNil(t, err, "expected a wrong password to be refused")
+	assert.True(t, strings.Contains(err.Error(), "BadUserAccessDenied"), err.Error())
+	client, err := Dial(endpoint, ClientConfig{Username: "operator", Password: "secret", Timeout: time.Second})
+	assert.Nil(t, err)
+	assert.Nil(t, client.Close())
+	assert.Equal(t, errClosed, client.Err())
+	_, err = client.Read([]NodeID{NewStringNodeID(1, "Line1.Speed")})
+	assert.Equal(t, errClosed, err)
+
+	_, err = Dial("http://"+server.Addr().String(), ClientConfig{})
+	assert.NotNil(t, err, "expected an endpoint that is not opc.tcp to be refused")
+}
+
+func TestClientSubscription(t *testing.T) {
+	space := addressSpaceFixture()
+	server, err := Listen("127.0.0.1:0", space, ServerConfig{AllowAnonymous: true})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	client, err := Dial("opc.tcp://"+server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	subscription, err := client.Subscribe(50 * time.Millisecond)
+	assert.Nil(t, err)
+	statuses, err := subscription.Monitor([]MonitoredItem{{NodeID: NewStringNodeID(1, "Line1.Speed"), Handle: 1},
+		{NodeID: NewStringNodeID(1, "Missing"), Handle: 2}})
+	assert.Nil(t, err)
+	assert.Equal(t, []StatusCode{StatusGood, StatusBadNodeIDUnknown}, statuses)
+
+	next := func() []MonitoredItemNotification {
+		select {
+		case n := <-subscription.Notifications:
+			return n
+		case <-time.After(2 * time.Second):
+			t.Fatal("no notification received")
+		}
+		return nil
+	}
+	// the first notification holds the current value
+	n := next()
+	assert.Equal(t, uint32(1), n[0].ClientHandle)
+	assert.Equal(t, 12.5, n[0].Value.Value.Value)
+	space.SetValue(NewStringNodeID(1, "Line1.Speed"), DataValue{Value: Variant{13.0}})
+	n = next()
+	assert.Equal(t, 13.0, n[len(n)-1].Value.Value.Value)
+	space.SetValue(NewStringNodeID(1, "Line1.Speed"), DataValue{Status: StatusBadNoCommunication})
+	n = next()
+	assert.Equal(t, StatusBadNoCommunication, n[len(n)-1].Value.Status)
+
+	// losing the connection closes the subscription
+	server.Close()
+	select {
+	case _, ok := <-subscription.Notifications:
+		for ok {
+			_, ok = <-subscription.Notifications
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription not closed")
+	}
+	assert.NotNil(t, client.Err())
+}
@@ -0,0 +1,313 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	protocolVersion   = 0
+	bufferSize        = 65535    // the size of the chunks received, and the largest sent
+	minBufferSize     = 8192     // the smallest chunk size a peer may request
+	maxMessageSize    = 16 << 20 // the largest message received
+	messageHeaderSize = 8
+
+	// the sizes of the headers preceding the body of each chunk of a MSG or CLO message: the
+	// secure channel id, token id, sequence number and request id
+	symmetricHeaderSize = 16
+)
+
+// Message types, and chunk types
+const (
+	messageHello       = "HEL"
+	messageAcknowledge = "ACK"
+	messageError       = "ERR"
+	messageOpen        = "OPN"
+	messageClose       = "CLO"
+	messageService     = "MSG"
+
+	chunkFinal        = 'F'
+	chunkIntermediate = 'C'
+	chunkAbort        = 'A'
+)
+
+// helloMessage opens a connection, negotiating buffer and message sizes
+type helloMessage struct {
+	ProtocolVersion   uint32
+	ReceiveBufferSize uint32
+	SendBufferSize    uint32
+	MaxMessageSize    uint32
+	MaxChunkCount     uint32
+	EndpointURL       string
+}
+
+// acknowledgeMessage accepts a connection, returning the revised sizes
+type acknowledgeMessage struct {
+	ProtocolVersion   uint32
+	ReceiveBufferSize uint32
+	SendBufferSize    uint32
+	MaxMessageSize    uint32
+	MaxChunkCount     uint32
+}
+
+// errorMessage reports the error closing a connection, or aborting a message
+type errorMessage struct {
+	Error  StatusCode
+	Reason string
+}
+
+func (m errorMessage) err() error {
+	if m.Reason == "" {
+		return m.Error
+	}
+	return fmt.Errorf("%s, %s", m.Error, m.Reason)
+}
+
+// message is a message assembled from its chunks. Abort is set, in place of Body, for a
+// message aborted by its sender.
+type message struct {
+	Type      string
+	RequestID uint32
+	Body      []byte
+	Abort     error
+}
+
+// secureConn carries the messages of a secure channel, without message security (security
+// policy None), over a connection on which hello and acknowledge have been exchanged. Messages
+// larger than the peer's receive buffer are sent in several chunks.
+type secureConn struct {
+	conn    net.Conn
+	timeout time.Duration // write timeout
+
+	sendBufferSize uint32 // the largest chunk the peer receives
+	maxMessageSize uint32 // the largest message the peer receives, zero if unlimited
+
+	writeMutex sync.Mutex
+	channelID  uint32
+	tokenID    uint32
+	sequence   uint32
+
+	partial map[uint32][]byte // the chunks received so far of each message, by request id
+}
+
+func newSecureConn(conn net.Conn, timeout time.Duration, ack acknowledgeMessage) *secureConn {
+	// a peer's receive buffer is the largest chunk it accepts
+	sendBufferSize := ack.ReceiveBufferSize
+	if sendBufferSize > bufferSize || sendBufferSize == 0 {
+		sendBufferSize = bufferSize
+	}
+	return &secureConn{conn: conn, timeout: timeout, sendBufferSize: sendBufferSize,
+		maxMessageSize: ack.MaxMessageSize, partial: make(map[uint32][]byte)}
+}
+
+// writeChunk writes a single chunk
+func writeChunk(w io.Writer, messageType string, chunkType byte, body []byte) error {
+	b := make([]byte, messageHeaderSize, messageHeaderSize+len(body))
+	copy(b, messageType)
+	b[3] = chunkType
+	binary.LittleEndian.PutUint32(b[4:], uint32(messageHeaderSize+len(body)))
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+// readChunk reads a single chunk no larger than maxSize
+func readChunk(r io.Reader, maxSize uint32) (string, byte, []byte, error) {
+	header := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < messageHeaderSize || size > maxSize {
+		return "", 0, nil, fmt.Errorf("%s, chunk of %d bytes", StatusBadTCPMessageTooLarge, size)
+	}
+	body := make([]byte, size-messageHeaderSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", 0, nil, err
+	}
+	return string(header[:3]), header[3], body, nil
+}
+
+// securityHeader returns the security header of the chunks of a message of the passed type
+func (c *secureConn) securityHeader(messageType string) []byte {
+	e := &encoder{}
+	e.uint32(c.channelID)
+	if messageType == messageOpen {
+		e.string(SecurityPolicyNone)
+		e.bytes(nil) // sender certificate
+		e.bytes(nil) // receiver certificate thumbprint
+	} else {
+		e.uint32(c.tokenID)
+	}
+	return e.buf
+}
+
+// channel returns the secure channel id, zero until the channel has been opened
+func (c *secureConn) channel() uint32 {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.channelID
+}
+
+// setToken sets the secure channel id and the id of its current token
+func (c *secureConn) setToken(channelID uint32, tokenID uint32) {
+	c.writeMutex.Lock()
+	c.channelID, c.tokenID = channelID, tokenID
+	c.writeMutex.Unlock()
+}
+
+// writeMessage sends a message, in as many chunks as the peer's receive buffer requires
+func (c *secureConn) writeMessage(messageType string, requestID uint32, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.maxMessageSize > 0 && uint32(len(body)) > c.maxMessageSize {
+		return StatusBadRequestTooLarge
+	}
+	header := c.securityHeader(messageType)
+	space := int(c.sendBufferSize) - messageHeaderSize - len(header) - 8
+	if c.timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	for {
+		part, chunkType := body, byte(chunkFinal)
+		if len(part) > space {
+			part, chunkType = body[:space], chunkIntermediate
+		}
+		body = body[len(part):]
+		c.sequence++
+		e := &encoder{buf: append([]byte{}, header...)}
+		e.uint32(c.sequence)
+		e.uint32(requestID)
+		if err := writeChunk(c.conn, messageType, chunkType, append(e.buf, part...)); err != nil {
+			return err
+		}
+		if chunkType == chunkFinal {
+			return nil
+		}
+	}
+}
+
+// writeError sends an error message, which closes the connection
+func writeError(w io.Writer, status StatusCode, reason string) error {
+	return writeChunk(w, messageError, chunkFinal, Marshal(errorMessage{status, reason}))
+}
+
+// readMessage reads chunks until a message is complete
+func (c *secureConn) readMessage() (message, error) {
+	for {
+		messageType, chunkType, body, err := readChunk(c.conn, bufferSize)
+		if err != nil {
+			return message{}, err
+		}
+		d := &decoder{b: body}
+		switch messageType {
+		case messageError:
+			var m errorMessage
+			d.decode(&m)
+			if d.err != nil {
+				return message{}, d.err
+			}
+			return message{}, m.err()
+		case messageOpen:
+			d.uint32() // channel id
+			d.string() // security policy
+			d.bytes()  // sender certificate
+			d.bytes()  // receiver certificate thumbprint
+		case messageService, messageClose:
+			channelID := d.uint32()
+			d.uint32() // token id
+			if expected := c.channel(); d.err == nil && expected != 0 && channelID != expected {
+				return message{}, StatusBadSecureChannelIDInvalid
+			}
+		default:
+			return message{}, fmt.Errorf("%s, message type %q", StatusBadTCPMessageTypeInvalid, messageType)
+		}
+		d.uint32() // sequence number
+		requestID := d.uint32()
+		if d.err != nil {
+			return message{}, d.err
+		}
+		part := body[d.pos:]
+		switch chunkType {
+		case chunkIntermediate:
+			if len(c.partial[requestID])+len(part) > maxMessageSize {
+				return message{}, StatusBadTCPMessageTooLarge
+			}
+			c.partial[requestID] = append(c.partial[requestID], part...)
+		case chunkFinal:
+			body := append(c.partial[requestID], part...)
+			delete(c.partial, requestID)
+			return message{Type: messageType, RequestID: requestID, Body: body}, nil
+		case chunkAbort:
+			delete(c.partial, requestID)
+			var m errorMessage
+			if err := Unmarshal(part, &m); err != nil {
+				return message{}, err
+			}
+			return message{Type: messageType, RequestID: requestID, Abort: m.err()}, nil
+		default:
+			return message{}, fmt.Errorf("%s, chunk type %q", StatusBadTCPMessageTypeInvalid, chunkType)
+		}
+	}
+}
+
+// errUnsupportedService is returned when decoding a service whose encoding is not registered
+type errUnsupportedService struct {
+	typeID NodeID
+}
+
+func (e errUnsupportedService) Error() string {
+	return fmt.Sprintf("opcua: unsupported service %s", e.typeID)
+}
+
+// encodeService returns the message body of a registered service request or response
+func encodeService(v interface{}) []byte {
+	e := &encoder{}
+	NewNumericNodeID(0, encodingID(v)).encodeUA(e)
+	e.encode(v)
+	return e.buf
+}
+
+// decodeService decodes a message body, returning a pointer to the service request or
+// response it holds
+func decodeService(body []byte) (interface{}, error) {
+	d := &decoder{b: body}
+	var typeID NodeID
+	typeID.decodeUA(d)
+	if d.err != nil {
+		return nil, d.err
+	}
+	t, found := registry.types[typeID]
+	if !found {
+		return nil, errUnsupportedService{typeID}
+	}
+	v := reflect.New(t)
+	d.value(v.Elem())
+	if d.err != nil {
+		return nil, fmt.Errorf("opcua: decoding %s, %s", t.Name(), d.err)
+	}
+	return v.Interface(), nil
+}
+
+// requestHeader returns the header of a service request, which is its first field
+func requestHeader(request interface{}) *RequestHeader {
+	if header, ok := reflect.ValueOf(request).Elem().Field(0).Addr().Interface().(*RequestHeader); ok {
+		return header
+	}
+	return nil
+}
+
+// responseHeader returns the header of a service response, which is its first field
+func responseHeader(response interface{}) *ResponseHeader {
+	if header, ok := reflect.ValueOf(response).Elem().Field(0).Addr().Interface().(*ResponseHeader); ok {
+		return header
+	}
+	return nil
+}
+
+var errClosed = errors.New("opcua: connection closed")
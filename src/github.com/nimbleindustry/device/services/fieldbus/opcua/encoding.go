@@ -0,0 +1,374 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// maxArrayLength bounds the length of decoded strings and arrays, which would otherwise allow a
+// corrupt message to exhaust memory
+const maxArrayLength = 1 << 24
+
+var errShortMessage = errors.New("opcua: message too short")
+
+// epoch is the start of the DateTime scale: 100ns intervals since 1601-01-01 UTC
+var epoch = time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// epochOffset is the number of seconds from epoch to the unix epoch
+const epochOffset = 11644473600
+
+// uaEncoder is implemented by types whose binary encoding is not that of their fields in order
+type uaEncoder interface {
+	encodeUA(e *encoder)
+}
+
+// uaDecoder is implemented (by pointer) by the types that implement uaEncoder
+type uaDecoder interface {
+	decodeUA(d *decoder)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// encoder appends the OPC UA binary encoding of values to buf. Structs are encoded as their
+// fields in order, slices as arrays (an Int32 length, then the elements), []byte as ByteString,
+// string as String and time.Time as DateTime.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) boolean(v bool) {
+	if v {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.uint32(uint32(v))
+	e.uint32(uint32(v >> 32))
+}
+
+func (e *encoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+// string encodes a String, the empty string as null
+func (e *encoder) string(v string) {
+	if v == "" {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// bytes encodes a ByteString, nil as null
+func (e *encoder) bytes(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// dateTime encodes a DateTime, the zero time as zero
+func (e *encoder) dateTime(t time.Time) {
+	if t.IsZero() || t.Before(epoch) {
+		e.uint64(0)
+		return
+	}
+	e.uint64(uint64(t.Unix()+epochOffset)*1e7 + uint64(t.Nanosecond()/100))
+}
+
+// integer returns the value of an integer of any size or signedness, as its two's complement
+func integer(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	}
+	return v.Uint()
+}
+
+// encode appends the encoding of v
+func (e *encoder) encode(v interface{}) {
+	e.value(reflect.ValueOf(v))
+}
+
+func (e *encoder) value(v reflect.Value) {
+	if v.Type() != timeType {
+		if enc, ok := v.Interface().(uaEncoder); ok {
+			enc.encodeUA(e)
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		e.boolean(v.Bool())
+	case reflect.Int8, reflect.Uint8:
+		e.uint8(uint8(integer(v)))
+	case reflect.Int16, reflect.Uint16:
+		e.uint16(uint16(integer(v)))
+	case reflect.Int32, reflect.Uint32:
+		e.uint32(uint32(integer(v)))
+	case reflect.Int64, reflect.Uint64:
+		e.uint64(integer(v))
+	case reflect.Float32:
+		e.uint32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.float64(v.Float())
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.bytes(v.Bytes())
+			return
+		}
+		if v.IsNil() {
+			e.int32(-1)
+			return
+		}
+		e.int32(int32(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			e.value(v.Index(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			e.value(v.Index(i))
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			e.dateTime(v.Interface().(time.Time))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			e.value(v.Field(i))
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.value(reflect.Zero(v.Type().Elem()))
+			return
+		}
+		e.value(v.Elem())
+	default:
+		panic(fmt.Sprintf("opcua: cannot encode %s", v.Type()))
+	}
+}
+
+// decoder reads OPC UA binary encoded values from b. The first error encountered is retained
+// in err, after which every read returns zero values.
+type decoder struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b)-d.pos < n {
+		d.fail(errShortMessage)
+		return nil
+	}
+	b := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) boolean() bool {
+	return d.uint8() != 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	return int32(d.uint32())
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// length reads an array or string length, -1 denoting null
+func (d *decoder) length() int {
+	n := d.int32()
+	if n < -1 || n > maxArrayLength {
+		d.fail(fmt.Errorf("opcua: invalid length %d", n))
+		return -1
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.length()
+	if n <= 0 {
+		return ""
+	}
+	return string(d.next(n))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	if n < 0 {
+		return nil
+	}
+	return append([]byte{}, d.next(n)...)
+}
+
+func (d *decoder) dateTime() time.Time {
+	ticks := d.uint64()
+	if ticks == 0 || ticks >= math.MaxInt64 {
+		return time.Time{}
+	}
+	return time.Unix(int64(ticks/1e7)-epochOffset, int64(ticks%1e7)*100).UTC()
+}
+
+// decode decodes into the value pointed to by v
+func (d *decoder) decode(v interface{}) {
+	d.value(reflect.ValueOf(v).Elem())
+}
+
+func (d *decoder) value(v reflect.Value) {
+	if d.err != nil {
+		return
+	}
+	if v.Type() != timeType && v.CanAddr() {
+		if dec, ok := v.Addr().Interface().(uaDecoder); ok {
+			dec.decodeUA(d)
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(d.boolean())
+	case reflect.Int8:
+		v.SetInt(int64(int8(d.uint8())))
+	case reflect.Uint8:
+		v.SetUint(uint64(d.uint8()))
+	case reflect.Int16:
+		v.SetInt(int64(int16(d.uint16())))
+	case reflect.Uint16:
+		v.SetUint(uint64(d.uint16()))
+	case reflect.Int32:
+		v.SetInt(int64(d.int32()))
+	case reflect.Uint32:
+		v.SetUint(uint64(d.uint32()))
+	case reflect.Int64:
+		v.SetInt(int64(d.uint64()))
+	case reflect.Uint64:
+		v.SetUint(d.uint64())
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(d.uint32())))
+	case reflect.Float64:
+		v.SetFloat(d.float64())
+	case reflect.String:
+		v.SetString(d.string())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(d.bytes())
+			return
+		}
+		n := d.length()
+		if n < 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		// every element takes at least one byte, so a length beyond the rest of the message is
+		// forged and must fail before the slice is allocated
+		if n > len(d.b)-d.pos {
+			d.fail(errShortMessage)
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			d.value(s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			d.value(v.Index(i))
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			v.Set(reflect.ValueOf(d.dateTime()))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			d.value(v.Field(i))
+		}
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		d.value(p.Elem())
+		v.Set(p)
+	default:
+		panic(fmt.Sprintf("opcua: cannot decode %s", v.Type()))
+	}
+}
+
+// Marshal returns the binary encoding of v
+func Marshal(v interface{}) []byte {
+	e := &encoder{}
+	e.encode(v)
+	return e.buf
+}
+
+// Unmarshal decodes the binary encoding in b into the value pointed to by v
+func Unmarshal(b []byte, v interface{}) error {
+	d := &decoder{b: b}
+	d.decode(v)
+	return d.err
+}
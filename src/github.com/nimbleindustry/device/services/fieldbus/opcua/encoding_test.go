@@ -0,0 +1,140 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeID(t *testing.T) {
+	for s, expected := range map[string]NodeID{
+		"i=85":               NewNumericNodeID(0, 85),
+		"ns=2;i=1001":        NewNumericNodeID(2, 1001),
+		"ns=2;s=Line1.Speed": NewStringNodeID(2, "Line1.Speed"),
+		"ns=1;s=a;b":         NewStringNodeID(1, "a;b"),
+		"ns=1;b=AQID":        {Namespace: 1, IDType: IDOpaque, Identifier: "\x01\x02\x03"},
+		"ns=3;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63": {Namespace: 3, IDType: IDGUID,
+			Identifier: "\x91\x2B\x96\x72\x75\xFA\xE6\x4A\x8D\x28\xB4\x04\xDC\x7D\xAF\x63"},
+	} {
+		id, err := ParseNodeID(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, id, s)
+		assert.Equal(t, s, id.String())
+	}
+	for _, s := range []string{"", "85", "ns=2", "ns=x;i=1", "ns=70000;i=1", "i=x", "x=1", "g=1234", "b=!"} {
+		_, err := ParseNodeID(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestNodeIDEncoding(t *testing.T) {
+	// the shortest encoding that holds the id is used
+	assert.Equal(t, []byte{0x00, 85}, Marshal(NewNumericNodeID(0, 85)))
+	assert.Equal(t, []byte{0x01, 2, 0xE9, 0x03}, Marshal(NewNumericNodeID(2, 1001)))
+	assert.Equal(t, []byte{0x02, 2, 0, 0xA0, 0x86, 0x01, 0x00}, Marshal(NewNumericNodeID(2, 100000)))
+	assert.Equal(t, []byte{0x03, 1, 0, 2, 0, 0, 0, 'A', 'B'}, Marshal(NewStringNodeID(1, "AB")))
+	for _, v := range []NodeID{NewNumericNodeID(0, 85), NewNumericNodeID(300, 1), NewStringNodeID(2, "Speed"),
+		{Namespace: 1, IDType: IDOpaque, Identifier: "\x01\x02"}, {IDType: IDGUID, Identifier: string(make([]byte, 16))}} {
+		var decoded NodeID
+		assert.Nil(t, Unmarshal(Marshal(v), &decoded))
+		assert.Equal(t, v, decoded)
+	}
+	var decoded NodeID
+	assert.NotNil(t, Unmarshal([]byte{0x03, 1, 0, 10, 0, 0, 0, 'A'}, &decoded), "expected a short string to fail")
+}
+
+func TestDataValueEncoding(t *testing.T) {
+	timestamp := time.Date(2018, 3, 1, 12, 30, 15, 123456700, time.UTC)
+	for _, v := range []DataValue{
+		{},
+		{Value: Variant{true}},
+		{Value: Variant{float32(42.5)}, SourceTimestamp: timestamp, ServerTimestamp: timestamp},
+		{Value: Variant{int64(-7)}, Status: StatusUncertainInitialValue},
+		{Value: Variant{"running"}, ServerTimestamp: timestamp, ServerPicoseconds: 10},
+		{Value: Variant{[]float64{1, 2.5}}},
+		{Value: Variant{[]string{"a", ""}}},
+		{Value: Variant{[]byte{1, 2}}},
+		{Value: Variant{LocalizedText{Locale: "en", Text: "Speed"}}},
+		{Value: Variant{QualifiedName{2, "Speed"}}},
+		{Value: Variant{NewStringNodeID(2, "Speed")}},
+		{Value: Variant{timestamp}},
+		{Status: StatusBadNodeIDUnknown},
+	} {
+		var decoded DataValue
+		assert.Nil(t, Unmarshal(Marshal(v), &decoded))
+		assert.Equal(t, v, decoded)
+	}
+
+	// ints are encoded as Int64
+	var decoded DataValue
+	assert.Nil(t, Unmarshal(Marshal(DataValue{Value: Variant{7}}), &decoded))
+	assert.Equal(t, int64(7), decoded.Value.Value)
+
+	// multi-dimensional arrays are flattened
+	assert.Nil(t, Unmarshal([]byte{dataValueValue, TypeByte | variantArray | variantDimensions, 4, 0, 0, 0, 1, 2, 3, 4,
+		2, 0, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0}, &decoded))
+	assert.Equal(t, []uint8{1, 2, 3, 4}, decoded.Value.Value)
+}
+
+func TestExtensionObjectEncoding(t *testing.T) {
+	notification := &DataChangeNotification{MonitoredItems: []MonitoredItemNotification{
+		{ClientHandle: 3, Value: DataValue{Value: Variant{uint16(12)}}}}}
+	var decoded ExtensionObject
+	assert.Nil(t, Unmarshal(Marshal(NewExtensionObject(notification)), &decoded))
+	assert.Equal(t, NewNumericNodeID(0, 811), decoded.TypeID)
+	assert.Equal(t, notification, decoded.Value)
+
+	// structures that are not registered keep their encoded body
+	unknown := ExtensionObject{TypeID: NewNumericNodeID(2, 5001), Value: []byte{1, 2, 3}}
+	assert.Nil(t, Unmarshal(Marshal(unknown), &decoded))
+	assert.Equal(t, unknown, decoded)
+
+	assert.Nil(t, Unmarshal(Marshal(ExtensionObject{}), &decoded))
+	assert.Nil(t, decoded.Value)
+
+	units := &EUInformation{NamespaceURI: UnitsNamespaceURI, UnitID: CommonCodeUnitID("CEL"),
+		DisplayName: LocalizedText{Text: "°C"}, Description: LocalizedText{Text: "degree Celsius"}}
+	assert.Equal(t, int32(4408652), units.UnitID)
+	assert.Nil(t, Unmarshal(Marshal(NewExtensionObject(units)), &decoded))
+	assert.Equal(t, NewNumericNodeID(0, 889), decoded.TypeID)
+	assert.Equal(t, units, decoded.Value)
+}
+
+func TestServiceEncoding(t *testing.T) {
+	request := &ReadRequest{RequestHeader: RequestHeader{RequestHandle: 7, Timestamp: time.Unix(1500000000, 0).UTC()},
+		TimestampsToReturn: TimestampsBoth, NodesToRead: []ReadValueID{{NodeID: NewStringNodeID(2, "Speed"),
+			AttributeID: AttributeValue}}}
+	decoded, err := decodeService(encodeService(request))
+	assert.Nil(t, err)
+	assert.Equal(t, request, decoded)
+	assert.Equal(t, uint32(7), requestHeader(decoded).RequestHandle)
+
+	_, err = decodeService(append(Marshal(NewNumericNodeID(0, 9999)), 0))
+	assert.IsType(t, errUnsupportedService{}, err)
+	_, err = decodeService(encodeService(request)[:20])
+	assert.NotNil(t, err, "expected a truncated request to fail")
+
+	// a forged array length must fail before the array is allocated
+	forged := encodeService(&ReadRequest{})
+	binary.LittleEndian.PutUint32(forged[len(forged)-4:], maxArrayLength)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = decodeService(forged)
+	runtime.ReadMemStats(&after)
+	assert.Contains(t, fmt.Sprint(err), errShortMessage.Error())
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1<<20, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.True(t, StatusGood.IsGood())
+	assert.True(t, StatusUncertainInitialValue.IsUncertain())
+	assert.True(t, StatusBadTimeout.IsBad())
+	assert.False(t, StatusBadTimeout.IsUncertain())
+	assert.Equal(t, "opcua: BadNodeIdUnknown", StatusBadNodeIDUnknown.Error())
+	assert.Equal(t, "BadTimeout", (StatusBadTimeout | 0x0400).String())
+	assert.Equal(t, "0x80FF0000", StatusCode(0x80FF0000).String())
+}
@@ -0,0 +1,191 @@
+package opcua
+
+// Numeric ids of the standard (namespace 0) nodes used by the client and server
+const (
+	// data types, besides the built-in types
+	DataTypeBaseDataType  = 24
+	DataTypeNumber        = 26
+	DataTypeEUInformation = 887
+
+	// reference types
+	ReferenceTypeReferences             = 31
+	ReferenceTypeNonHierarchical        = 32
+	ReferenceTypeHierarchicalReferences = 33
+	ReferenceTypeHasChild               = 34
+	ReferenceTypeOrganizes              = 35
+	ReferenceTypeHasTypeDefinition      = 40
+	ReferenceTypeAggregates             = 44
+	ReferenceTypeHasSubtype             = 45
+	ReferenceTypeHasProperty            = 46
+	ReferenceTypeHasComponent           = 47
+
+	// object and variable types
+	ObjectTypeBaseObjectType         = 58
+	ObjectTypeFolderType             = 61
+	VariableTypeBaseDataVariableType = 63
+	VariableTypePropertyType         = 68
+
+	// objects
+	ObjectRootFolder    = 84
+	ObjectObjectsFolder = 85
+	ObjectTypesFolder   = 86
+	ObjectViewsFolder   = 87
+	ObjectServer        = 2253
+)
+
+// superTypes maps each standard reference type to its super type
+var superTypes = map[uint32]uint32{
+	ReferenceTypeNonHierarchical:        ReferenceTypeReferences,
+	ReferenceTypeHierarchicalReferences: ReferenceTypeReferences,
+	ReferenceTypeHasChild:               ReferenceTypeHierarchicalReferences,
+	ReferenceTypeOrganizes:              ReferenceTypeHierarchicalReferences,
+	ReferenceTypeHasTypeDefinition:      ReferenceTypeNonHierarchical,
+	ReferenceTypeAggregates:             ReferenceTypeHasChild,
+	ReferenceTypeHasSubtype:             ReferenceTypeHasChild,
+	ReferenceTypeHasProperty:            ReferenceTypeAggregates,
+	ReferenceTypeHasComponent:           ReferenceTypeAggregates,
+}
+
+// isReferenceSubtype returns true if the reference type t is (or, with subtypes set, derives
+// from) the reference type of
+func isReferenceSubtype(t NodeID, of NodeID, subtypes bool) bool {
+	if of.IsNull() || t == of {
+		return true
+	}
+	if !subtypes || t.Namespace != 0 || of.Namespace != 0 {
+		return false
+	}
+	for id, found := t.Numeric, true; found; id, found = superTypes[id] {
+		if id == of.Numeric {
+			return true
+		}
+	}
+	return false
+}
+
+// AttributeID identifies an attribute of a node
+type AttributeID uint32
+
+// Node attributes
+const (
+	AttributeNodeID          AttributeID = 1
+	AttributeNodeClass       AttributeID = 2
+	AttributeBrowseName      AttributeID = 3
+	AttributeDisplayName     AttributeID = 4
+	AttributeDescription     AttributeID = 5
+	AttributeWriteMask       AttributeID = 6
+	AttributeUserWriteMask   AttributeID = 7
+	AttributeEventNotifier   AttributeID = 12
+	AttributeValue           AttributeID = 13
+	AttributeDataType        AttributeID = 14
+	AttributeValueRank       AttributeID = 15
+	AttributeArrayDimensions AttributeID = 16
+	AttributeAccessLevel     AttributeID = 17
+	AttributeUserAccessLevel AttributeID = 18
+	AttributeHistorizing     AttributeID = 20
+)
+
+// NodeClass is the class of a node, a bit mask when filtering browse results
+type NodeClass uint32
+
+// Node classes
+const (
+	NodeClassUnspecified   NodeClass = 0
+	NodeClassObject        NodeClass = 1
+	NodeClassVariable      NodeClass = 2
+	NodeClassMethod        NodeClass = 4
+	NodeClassObjectType    NodeClass = 8
+	NodeClassVariableType  NodeClass = 16
+	NodeClassReferenceType NodeClass = 32
+	NodeClassDataType      NodeClass = 64
+	NodeClassView          NodeClass = 128
+)
+
+// BrowseDirection selects the references returned by browse
+type BrowseDirection uint32
+
+// Browse directions
+const (
+	BrowseDirectionForward BrowseDirection = 0
+	BrowseDirectionInverse BrowseDirection = 1
+	BrowseDirectionBoth    BrowseDirection = 2
+)
+
+// Browse result mask bits, selecting the fields of each ReferenceDescription returned
+const (
+	browseResultReferenceType  = 0x01
+	browseResultIsForward      = 0x02
+	browseResultNodeClass      = 0x04
+	browseResultBrowseName     = 0x08
+	browseResultDisplayName    = 0x10
+	browseResultTypeDefinition = 0x20
+	browseResultAll            = 0x3F
+)
+
+// TimestampsToReturn selects the timestamps returned with values
+type TimestampsToReturn uint32
+
+// Timestamps to return
+const (
+	TimestampsSource  TimestampsToReturn = 0
+	TimestampsServer  TimestampsToReturn = 1
+	TimestampsBoth    TimestampsToReturn = 2
+	TimestampsNeither TimestampsToReturn = 3
+)
+
+// MonitoringMode selects whether a monitored item samples and reports
+type MonitoringMode uint32
+
+// Monitoring modes
+const (
+	MonitoringModeDisabled  MonitoringMode = 0
+	MonitoringModeSampling  MonitoringMode = 1
+	MonitoringModeReporting MonitoringMode = 2
+)
+
+// MessageSecurityMode is the security applied to the messages of a secure channel
+type MessageSecurityMode uint32
+
+// Message security modes
+const (
+	MessageSecurityModeInvalid        MessageSecurityMode = 0
+	MessageSecurityModeNone           MessageSecurityMode = 1
+	MessageSecurityModeSign           MessageSecurityMode = 2
+	MessageSecurityModeSignAndEncrypt MessageSecurityMode = 3
+)
+
+// UserTokenType is the type of user identity accepted by a user token policy
+type UserTokenType uint32
+
+// User token types
+const (
+	UserTokenTypeAnonymous   UserTokenType = 0
+	UserTokenTypeUserName    UserTokenType = 1
+	UserTokenTypeCertificate UserTokenType = 2
+	UserTokenTypeIssuedToken UserTokenType = 3
+)
+
+// ApplicationType is the type of an OPC UA application
+type ApplicationType uint32
+
+// Application types
+const (
+	ApplicationTypeServer          ApplicationType = 0
+	ApplicationTypeClient          ApplicationType = 1
+	ApplicationTypeClientAndServer ApplicationType = 2
+)
+
+// SecurityTokenRequestType selects whether a secure channel is opened or its token renewed
+type SecurityTokenRequestType uint32
+
+// Security token request types
+const (
+	SecurityTokenIssue SecurityTokenRequestType = 0
+	SecurityTokenRenew SecurityTokenRequestType = 1
+)
+
+// Security policy and transport profile URIs
+const (
+	SecurityPolicyNone     = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	TransportProfileBinary = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+)
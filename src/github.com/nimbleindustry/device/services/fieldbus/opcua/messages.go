@@ -0,0 +1,483 @@
+package opcua
+
+import (
+	"reflect"
+	"time"
+)
+
+// Service request and response structures, in the field order of their binary encoding. Each
+// is registered with the numeric id of its binary encoding node, which precedes it in messages
+// and in extension objects.
+
+// RequestHeader is common to every service request
+type RequestHeader struct {
+	AuthenticationToken NodeID
+	Timestamp           time.Time
+	RequestHandle       uint32
+	ReturnDiagnostics   uint32
+	AuditEntryID        string
+	TimeoutHint         uint32
+	AdditionalHeader    ExtensionObject
+}
+
+// ResponseHeader is common to every service response
+type ResponseHeader struct {
+	Timestamp          time.Time
+	RequestHandle      uint32
+	ServiceResult      StatusCode
+	ServiceDiagnostics DiagnosticInfo
+	StringTable        []string
+	AdditionalHeader   ExtensionObject
+}
+
+// ServiceFault is returned in place of the response of a request that failed as a whole
+type ServiceFault struct {
+	ResponseHeader ResponseHeader
+}
+
+// ApplicationDescription describes a client or server application
+type ApplicationDescription struct {
+	ApplicationURI      string
+	ProductURI          string
+	ApplicationName     LocalizedText
+	ApplicationType     ApplicationType
+	GatewayServerURI    string
+	DiscoveryProfileURI string
+	DiscoveryURLs       []string
+}
+
+// UserTokenPolicy describes a user identity accepted by an endpoint
+type UserTokenPolicy struct {
+	PolicyID          string
+	TokenType         UserTokenType
+	IssuedTokenType   string
+	IssuerEndpointURL string
+	SecurityPolicyURI string
+}
+
+// EndpointDescription describes an endpoint of a server
+type EndpointDescription struct {
+	EndpointURL         string
+	Server              ApplicationDescription
+	ServerCertificate   []byte
+	SecurityMode        MessageSecurityMode
+	SecurityPolicyURI   string
+	UserIdentityTokens  []UserTokenPolicy
+	TransportProfileURI string
+	SecurityLevel       uint8
+}
+
+// SignatureData is a signature and the URI of its algorithm
+type SignatureData struct {
+	Algorithm string
+	Signature []byte
+}
+
+// SignedSoftwareCertificate is a software certificate and its signature
+type SignedSoftwareCertificate struct {
+	CertificateData []byte
+	Signature       []byte
+}
+
+// ChannelSecurityToken identifies the token of a secure channel
+type ChannelSecurityToken struct {
+	ChannelID       uint32
+	TokenID         uint32
+	CreatedAt       time.Time
+	RevisedLifetime uint32
+}
+
+// OpenSecureChannelRequest opens (or renews the token of) a secure channel
+type OpenSecureChannelRequest struct {
+	RequestHeader         RequestHeader
+	ClientProtocolVersion uint32
+	RequestType           SecurityTokenRequestType
+	SecurityMode          MessageSecurityMode
+	ClientNonce           []byte
+	RequestedLifetime     uint32
+}
+
+// OpenSecureChannelResponse returns the token of the secure channel
+type OpenSecureChannelResponse struct {
+	ResponseHeader        ResponseHeader
+	ServerProtocolVersion uint32
+	SecurityToken         ChannelSecurityToken
+	ServerNonce           []byte
+}
+
+// CloseSecureChannelRequest closes the secure channel, it has no response
+type CloseSecureChannelRequest struct {
+	RequestHeader RequestHeader
+}
+
+// GetEndpointsRequest returns the endpoints of a server
+type GetEndpointsRequest struct {
+	RequestHeader RequestHeader
+	EndpointURL   string
+	LocaleIDs     []string
+	ProfileURIs   []string
+}
+
+// GetEndpointsResponse returns the endpoints of a server
+type GetEndpointsResponse struct {
+	ResponseHeader ResponseHeader
+	Endpoints      []EndpointDescription
+}
+
+// CreateSessionRequest creates a session, which must then be activated
+type CreateSessionRequest struct {
+	RequestHeader           RequestHeader
+	ClientDescription       ApplicationDescription
+	ServerURI               string
+	EndpointURL             string
+	SessionName             string
+	ClientNonce             []byte
+	ClientCertificate       []byte
+	RequestedSessionTimeout float64
+	MaxResponseMessageSize  uint32
+}
+
+// CreateSessionResponse returns the session's authentication token and the server's endpoints
+type CreateSessionResponse struct {
+	ResponseHeader             ResponseHeader
+	SessionID                  NodeID
+	AuthenticationToken        NodeID
+	RevisedSessionTimeout      float64
+	ServerNonce                []byte
+	ServerCertificate          []byte
+	ServerEndpoints            []EndpointDescription
+	ServerSoftwareCertificates []SignedSoftwareCertificate
+	ServerSignature            SignatureData
+	MaxRequestMessageSize      uint32
+}
+
+// AnonymousIdentityToken identifies an anonymous user
+type AnonymousIdentityToken struct {
+	PolicyID string
+}
+
+// UserNameIdentityToken identifies a user by name and password
+type UserNameIdentityToken struct {
+	PolicyID            string
+	UserName            string
+	Password            []byte
+	EncryptionAlgorithm string
+}
+
+// ActivateSessionRequest activates a session with the user's identity
+type ActivateSessionRequest struct {
+	RequestHeader              RequestHeader
+	ClientSignature            SignatureData
+	ClientSoftwareCertificates []SignedSoftwareCertificate
+	LocaleIDs                  []string
+	UserIdentityToken          ExtensionObject
+	UserTokenSignature         SignatureData
+}
+
+// ActivateSessionResponse acknowledges the activation of a session
+type ActivateSessionResponse struct {
+	ResponseHeader  ResponseHeader
+	ServerNonce     []byte
+	Results         []StatusCode
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// CloseSessionRequest closes a session, and optionally its subscriptions
+type CloseSessionRequest struct {
+	RequestHeader       RequestHeader
+	DeleteSubscriptions bool
+}
+
+// CloseSessionResponse acknowledges the closing of a session
+type CloseSessionResponse struct {
+	ResponseHeader ResponseHeader
+}
+
+// ViewDescription selects the view browsed, the null view being the whole address space
+type ViewDescription struct {
+	ViewID      NodeID
+	Timestamp   time.Time
+	ViewVersion uint32
+}
+
+// BrowseDescription selects the references of a node returned by browse
+type BrowseDescription struct {
+	NodeID          NodeID
+	BrowseDirection BrowseDirection
+	ReferenceTypeID NodeID
+	IncludeSubtypes bool
+	NodeClassMask   uint32
+	ResultMask      uint32
+}
+
+// ReferenceDescription describes a reference and its target node
+type ReferenceDescription struct {
+	ReferenceTypeID NodeID
+	IsForward       bool
+	NodeID          ExpandedNodeID
+	BrowseName      QualifiedName
+	DisplayName     LocalizedText
+	NodeClass       NodeClass
+	TypeDefinition  ExpandedNodeID
+}
+
+// BrowseResult returns the references of a node, and a continuation point should there be
+// more than were requested
+type BrowseResult struct {
+	StatusCode        StatusCode
+	ContinuationPoint []byte
+	References        []ReferenceDescription
+}
+
+// BrowseRequest returns the references of nodes
+type BrowseRequest struct {
+	RequestHeader                 RequestHeader
+	View                          ViewDescription
+	RequestedMaxReferencesPerNode uint32
+	NodesToBrowse                 []BrowseDescription
+}
+
+// BrowseResponse returns the references of nodes
+type BrowseResponse struct {
+	ResponseHeader  ResponseHeader
+	Results         []BrowseResult
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// BrowseNextRequest continues (or releases) browses
+type BrowseNextRequest struct {
+	RequestHeader             RequestHeader
+	ReleaseContinuationPoints bool
+	ContinuationPoints        [][]byte
+}
+
+// BrowseNextResponse continues browses
+type BrowseNextResponse struct {
+	ResponseHeader  ResponseHeader
+	Results         []BrowseResult
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// ReadValueID selects an attribute of a node
+type ReadValueID struct {
+	NodeID       NodeID
+	AttributeID  AttributeID
+	IndexRange   string
+	DataEncoding QualifiedName
+}
+
+// ReadRequest reads attributes of nodes
+type ReadRequest struct {
+	RequestHeader      RequestHeader
+	MaxAge             float64
+	TimestampsToReturn TimestampsToReturn
+	NodesToRead        []ReadValueID
+}
+
+// ReadResponse returns the values of the attributes read
+type ReadResponse struct {
+	ResponseHeader  ResponseHeader
+	Results         []DataValue
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// CreateSubscriptionRequest creates a subscription
+type CreateSubscriptionRequest struct {
+	RequestHeader               RequestHeader
+	RequestedPublishingInterval float64
+	RequestedLifetimeCount      uint32
+	RequestedMaxKeepAliveCount  uint32
+	MaxNotificationsPerPublish  uint32
+	PublishingEnabled           bool
+	Priority                    uint8
+}
+
+// CreateSubscriptionResponse returns the subscription's id and revised settings
+type CreateSubscriptionResponse struct {
+	ResponseHeader            ResponseHeader
+	SubscriptionID            uint32
+	RevisedPublishingInterval float64
+	RevisedLifetimeCount      uint32
+	RevisedMaxKeepAliveCount  uint32
+}
+
+// DeleteSubscriptionsRequest deletes subscriptions
+type DeleteSubscriptionsRequest struct {
+	RequestHeader   RequestHeader
+	SubscriptionIDs []uint32
+}
+
+// DeleteSubscriptionsResponse returns the result of deleting each subscription
+type DeleteSubscriptionsResponse struct {
+	ResponseHeader  ResponseHeader
+	Results         []StatusCode
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// MonitoringParameters are the sampling settings of a monitored item
+type MonitoringParameters struct {
+	ClientHandle     uint32
+	SamplingInterval float64
+	Filter           ExtensionObject
+	QueueSize        uint32
+	DiscardOldest    bool
+}
+
+// MonitoredItemCreateRequest creates a monitored item
+type MonitoredItemCreateRequest struct {
+	ItemToMonitor       ReadValueID
+	MonitoringMode      MonitoringMode
+	RequestedParameters MonitoringParameters
+}
+
+// MonitoredItemCreateResult returns the monitored item's id and revised settings
+type MonitoredItemCreateResult struct {
+	StatusCode              StatusCode
+	MonitoredItemID         uint32
+	RevisedSamplingInterval float64
+	RevisedQueueSize        uint32
+	FilterResult            ExtensionObject
+}
+
+// CreateMonitoredItemsRequest adds monitored items to a subscription
+type CreateMonitoredItemsRequest struct {
+	RequestHeader      RequestHeader
+	SubscriptionID     uint32
+	TimestampsToReturn TimestampsToReturn
+	ItemsToCreate      []MonitoredItemCreateRequest
+}
+
+// CreateMonitoredItemsResponse returns the result of creating each monitored item
+type CreateMonitoredItemsResponse struct {
+	ResponseHeader  ResponseHeader
+	Results         []MonitoredItemCreateResult
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// SubscriptionAcknowledgement acknowledges the receipt of a notification message
+type SubscriptionAcknowledgement struct {
+	SubscriptionID uint32
+	SequenceNumber uint32
+}
+
+// PublishRequest requests the next notification message of any of the session's
+// subscriptions, acknowledging those received
+type PublishRequest struct {
+	RequestHeader                RequestHeader
+	SubscriptionAcknowledgements []SubscriptionAcknowledgement
+}
+
+// NotificationMessage carries the notifications of a subscription, none for a keep-alive
+type NotificationMessage struct {
+	SequenceNumber   uint32
+	PublishTime      time.Time
+	NotificationData []ExtensionObject
+}
+
+// PublishResponse returns a notification message
+type PublishResponse struct {
+	ResponseHeader           ResponseHeader
+	SubscriptionID           uint32
+	AvailableSequenceNumbers []uint32
+	MoreNotifications        bool
+	NotificationMessage      NotificationMessage
+	Results                  []StatusCode
+	DiagnosticInfos          []DiagnosticInfo
+}
+
+// MonitoredItemNotification is a value sampled by a monitored item
+type MonitoredItemNotification struct {
+	ClientHandle uint32
+	Value        DataValue
+}
+
+// DataChangeNotification carries the values sampled by a subscription's monitored items
+type DataChangeNotification struct {
+	MonitoredItems  []MonitoredItemNotification
+	DiagnosticInfos []DiagnosticInfo
+}
+
+// StatusChangeNotification reports a change of a subscription's status, such as its timeout
+type StatusChangeNotification struct {
+	Status         StatusCode
+	DiagnosticInfo DiagnosticInfo
+}
+
+// EUInformation describes the engineering units of an analog variable, as the value of its
+// EngineeringUnits property. UnitID is the UNECE common code of the unit, see CommonCodeUnitID,
+// or -1 if the unit has none.
+type EUInformation struct {
+	NamespaceURI string
+	UnitID       int32
+	DisplayName  LocalizedText
+	Description  LocalizedText
+}
+
+// UnitsNamespaceURI is the NamespaceURI of EUInformation holding UNECE units
+const UnitsNamespaceURI = "http://www.opcfoundation.org/UA/units/un/cefact"
+
+// CommonCodeUnitID returns the UnitID of the unit of the passed UNECE common code (e.g. "CEL"
+// for degree Celsius), its characters packed into an integer
+func CommonCodeUnitID(code string) int32 {
+	var id int32
+	for i := 0; i < len(code) && i < 4; i++ {
+		id = id<<8 | int32(code[i])
+	}
+	return id
+}
+
+// registry maps binary encoding ids to the structures encoded, and back
+var registry = struct {
+	types map[NodeID]reflect.Type
+	ids   map[reflect.Type]uint32
+}{map[NodeID]reflect.Type{}, map[reflect.Type]uint32{}}
+
+func register(id uint32, v interface{}) {
+	t := reflect.TypeOf(v)
+	registry.types[NewNumericNodeID(0, id)] = t
+	registry.ids[t] = id
+}
+
+// encodingID returns the binary encoding id of a registered structure or pointer to one, zero
+// if not registered
+func encodingID(v interface{}) uint32 {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return registry.ids[t]
+}
+
+func init() {
+	register(321, AnonymousIdentityToken{})
+	register(324, UserNameIdentityToken{})
+	register(397, ServiceFault{})
+	register(428, GetEndpointsRequest{})
+	register(431, GetEndpointsResponse{})
+	register(446, OpenSecureChannelRequest{})
+	register(449, OpenSecureChannelResponse{})
+	register(452, CloseSecureChannelRequest{})
+	register(461, CreateSessionRequest{})
+	register(464, CreateSessionResponse{})
+	register(467, ActivateSessionRequest{})
+	register(470, ActivateSessionResponse{})
+	register(473, CloseSessionRequest{})
+	register(476, CloseSessionResponse{})
+	register(527, BrowseRequest{})
+	register(530, BrowseResponse{})
+	register(533, BrowseNextRequest{})
+	register(536, BrowseNextResponse{})
+	register(631, ReadRequest{})
+	register(634, ReadResponse{})
+	register(751, CreateMonitoredItemsRequest{})
+	register(754, CreateMonitoredItemsResponse{})
+	register(787, CreateSubscriptionRequest{})
+	register(790, CreateSubscriptionResponse{})
+	register(811, DataChangeNotification{})
+	register(820, StatusChangeNotification{})
+	register(826, PublishRequest{})
+	register(829, PublishResponse{})
+	register(847, DeleteSubscriptionsRequest{})
+	register(850, DeleteSubscriptionsResponse{})
+	register(889, EUInformation{})
+}
@@ -0,0 +1,961 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	maxSessions                = 100
+	maxPublishRequests         = 10   // the publish requests a session may have queued
+	maxQueuedNotifications     = 1000 // the notifications a subscription holds, the oldest being discarded
+	minPublishingInterval      = 50 * time.Millisecond
+	accessLevelCurrentRead     = 0x01
+	valueRankScalar            = -1
+	valueRankOneDimension      = 1
+	anonymousPolicyID          = "anonymous"
+	userNamePolicyID           = "username"
+	defaultServerApplication   = "nimble-device"
+	continuationPointSize      = 8
+	maxContinuationPoints      = 10 // the continuation points a session may hold
+	defaultReferencesPerBrowse = 1000
+)
+
+// Node is a node of an address space. References are added as nodes are added to the address
+// space.
+type Node struct {
+	ID             NodeID
+	Class          NodeClass
+	BrowseName     QualifiedName
+	DisplayName    LocalizedText
+	Description    LocalizedText
+	TypeDefinition NodeID // the object or variable type, none if null
+	DataType       NodeID // the data type of a variable, that of its value if null
+	Value          DataValue
+
+	references []reference
+}
+
+// reference is a reference from a node to another
+type reference struct {
+	Type    NodeID
+	Target  NodeID
+	Forward bool
+}
+
+// AddressSpace is the set of nodes served, which may be changed while being served. Monitored
+// items are notified of each change of the value of their node.
+type AddressSpace struct {
+	mutex      sync.RWMutex
+	nodes      map[NodeID]*Node
+	namespaces []string
+	monitors   map[NodeID][]*monitoredItem
+}
+
+// NewAddressSpace returns an address space holding the standard Root, Objects, Types and Views
+// folders, and the Server object with its NamespaceArray
+func NewAddressSpace() *AddressSpace {
+	s := &AddressSpace{nodes: make(map[NodeID]*Node), namespaces: []string{"http://opcfoundation.org/UA/"},
+		monitors: make(map[NodeID][]*monitoredItem)}
+	folder := func(id uint32, name string) Node {
+		return Node{ID: NewNumericNodeID(0, id), Class: NodeClassObject, BrowseName: QualifiedName{Name: name},
+			DisplayName: LocalizedText{Text: name}, TypeDefinition: NewNumericNodeID(0, ObjectTypeFolderType)}
+	}
+	root := folder(ObjectRootFolder, "Root")
+	s.nodes[root.ID] = &root
+	organizes := NewNumericNodeID(0, ReferenceTypeOrganizes)
+	s.AddNode(root.ID, organizes, folder(ObjectObjectsFolder, "Objects"))
+	s.AddNode(root.ID, organizes, folder(ObjectTypesFolder, "Types"))
+	s.AddNode(root.ID, organizes, folder(ObjectViewsFolder, "Views"))
+	s.AddNode(NewNumericNodeID(0, ObjectObjectsFolder), organizes, Node{ID: NewNumericNodeID(0, ObjectServer),
+		Class: NodeClassObject, BrowseName: QualifiedName{Name: "Server"}, DisplayName: LocalizedText{Text: "Server"},
+		TypeDefinition: NewNumericNodeID(0, ObjectTypeBaseObjectType)})
+	s.AddNode(NewNumericNodeID(0, ObjectServer), NewNumericNodeID(0, ReferenceTypeHasProperty), Node{
+		ID: NewNumericNodeID(0, variableNamespaceArray), Class: NodeClassVariable,
+		BrowseName: QualifiedName{Name: "NamespaceArray"}, DisplayName: LocalizedText{Text: "NamespaceArray"},
+		TypeDefinition: NewNumericNodeID(0, VariableTypePropertyType),
+		Value:          DataValue{Value: Variant{s.namespaces}}})
+	return s
+}
+
+const variableNamespaceArray = 2255
+
+// AddNamespace adds the namespace of the passed URI, if not already present, returning its
+// index
+func (s *AddressSpace) AddNamespace(uri string) uint16 {
+	s.mutex.Lock()
+	for i, v := range s.namespaces {
+		if v == uri {
+			s.mutex.Unlock()
+			return uint16(i)
+		}
+	}
+	s.namespaces = append(s.namespaces, uri)
+	index := uint16(len(s.namespaces) - 1)
+	namespaces := append([]string{}, s.namespaces...)
+	s.mutex.Unlock()
+	s.SetValue(NewNumericNodeID(0, variableNamespaceArray), DataValue{Value: Variant{namespaces}})
+	return index
+}
+
+// AddNode adds a node, referenced by its parent with the passed (hierarchical) reference type,
+// and referencing its type definition
+func (s *AddressSpace) AddNode(parent NodeID, referenceType NodeID, node Node) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.nodes[node.ID]; found || node.ID.IsNull() {
+		return fmt.Errorf("%s, node %s already exists", StatusBadNodeIDInvalid, node.ID)
+	}
+	p, found := s.nodes[parent]
+	if !found {
+		return fmt.Errorf("%s, parent %s of node %s", StatusBadNodeIDUnknown, parent, node.ID)
+	}
+	n := node
+	n.references = nil
+	if n.DisplayName.Text == "" {
+		n.DisplayName.Text = n.BrowseName.Name
+	}
+	if n.Class == NodeClassVariable {
+		if n.DataType.IsNull() {
+			n.DataType = dataTypeOf(n.Value.Value)
+		}
+		if n.Value.ServerTimestamp.IsZero() {
+			n.Value.ServerTimestamp = time.Now()
+		}
+	}
+	p.references = append(p.references, reference{Type: referenceType, Target: n.ID, Forward: true})
+	n.references = append(n.references, reference{Type: referenceType, Target: parent, Forward: false})
+	if !n.TypeDefinition.IsNull() {
+		n.references = append(n.references, reference{Type: NewNumericNodeID(0, ReferenceTypeHasTypeDefinition),
+			Target: n.TypeDefinition, Forward: true})
+	}
+	s.nodes[n.ID] = &n
+	return nil
+}
+
+// SetValue sets the value of a variable, notifying its monitored items unless neither the
+// value nor its status has changed. Unset timestamps are set to the current time.
+func (s *AddressSpace) SetValue(id NodeID, value DataValue) error {
+	now := time.Now()
+	if value.SourceTimestamp.IsZero() {
+		value.SourceTimestamp = now
+	}
+	if value.ServerTimestamp.IsZero() {
+		value.ServerTimestamp = now
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, found := s.nodes[id]
+	if !found || n.Class != NodeClassVariable {
+		return fmt.Errorf("%s, no variable %s", StatusBadNodeIDUnknown, id)
+	}
+	if n.Value.Status == value.Status && reflect.DeepEqual(n.Value.Value, value.Value) {
+		return nil
+	}
+	n.Value = value
+	for _, item := range s.monitors[id] {
+		item.notify(value)
+	}
+	return nil
+}
+
+// Value returns the value of a variable
+func (s *AddressSpace) Value(id NodeID) (DataValue, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, found := s.nodes[id]
+	if !found || n.Class != NodeClassVariable {
+		return DataValue{}, fmt.Errorf("%s, no variable %s", StatusBadNodeIDUnknown, id)
+	}
+	return n.Value, nil
+}
+
+// read returns an attribute of a node, with the passed timestamps
+func (s *AddressSpace) read(id ReadValueID, timestamps TimestampsToReturn) DataValue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, found := s.nodes[id.NodeID]
+	if !found {
+		return DataValue{Status: StatusBadNodeIDUnknown}
+	}
+	if id.IndexRange != "" {
+		return DataValue{Status: StatusBadIndexRangeInvalid}
+	}
+	variable := n.Class == NodeClassVariable
+	var value interface{}
+	switch id.AttributeID {
+	case AttributeNodeID:
+		value = n.ID
+	case AttributeNodeClass:
+		value = int32(n.Class)
+	case AttributeBrowseName:
+		value = n.BrowseName
+	case AttributeDisplayName:
+		value = n.DisplayName
+	case AttributeDescription:
+		value = n.Description
+	case AttributeWriteMask, AttributeUserWriteMask:
+		value = uint32(0)
+	case AttributeEventNotifier:
+		if n.Class != NodeClassObject {
+			return DataValue{Status: StatusBadAttributeIDInvalid}
+		}
+		value = uint8(0)
+	case AttributeValue:
+		if !variable {
+			return DataValue{Status: StatusBadAttributeIDInvalid}
+		}
+		return withTimestamps(n.Value, timestamps)
+	case AttributeDataType:
+		value = n.DataType
+	case AttributeValueRank:
+		if n.Value.Value.IsArray() {
+			value = int32(valueRankOneDimension)
+		} else {
+			value = int32(valueRankScalar)
+		}
+	case AttributeAccessLevel, AttributeUserAccessLevel:
+		value = uint8(accessLevelCurrentRead)
+	case AttributeHistorizing:
+		value = false
+	default:
+		return DataValue{Status: StatusBadAttributeIDInvalid}
+	}
+	if !variable && (id.AttributeID == AttributeDataType || id.AttributeID == AttributeValueRank ||
+		id.AttributeID == AttributeAccessLevel || id.AttributeID == AttributeUserAccessLevel ||
+		id.AttributeID == AttributeHistorizing) {
+		return DataValue{Status: StatusBadAttributeIDInvalid}
+	}
+	return DataValue{Value: Variant{value}}
+}
+
+// withTimestamps returns a value with only the passed timestamps
+func withTimestamps(v DataValue, timestamps TimestampsToReturn) DataValue {
+	if timestamps == TimestampsServer || timestamps == TimestampsNeither {
+		v.SourceTimestamp, v.SourcePicoseconds = time.Time{}, 0
+	}
+	if timestamps == TimestampsSource || timestamps == TimestampsNeither {
+		v.ServerTimestamp, v.ServerPicoseconds = time.Time{}, 0
+	}
+	return v
+}
+
+// browse returns the references of a node selected by the passed description
+func (s *AddressSpace) browse(description BrowseDescription) ([]ReferenceDescription, StatusCode) {
+	if description.BrowseDirection > BrowseDirectionBoth {
+		return nil, StatusBadBrowseDirectionInvalid
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, found := s.nodes[description.NodeID]
+	if !found {
+		return nil, StatusBadNodeIDUnknown
+	}
+	var references []ReferenceDescription
+	for _, r := range n.references {
+		if description.BrowseDirection == BrowseDirectionForward && !r.Forward ||
+			description.BrowseDirection == BrowseDirectionInverse && r.Forward {
+			continue
+		}
+		if !isReferenceSubtype(r.Type, description.ReferenceTypeID, description.IncludeSubtypes) {
+			continue
+		}
+		rd := ReferenceDescription{ReferenceTypeID: r.Type, IsForward: r.Forward, NodeID: ExpandedNodeID{NodeID: r.Target}}
+		if target, found := s.nodes[r.Target]; found {
+			if description.NodeClassMask != 0 && uint32(target.Class)&description.NodeClassMask == 0 {
+				continue
+			}
+			rd.BrowseName, rd.DisplayName, rd.NodeClass = target.BrowseName, target.DisplayName, target.Class
+			rd.TypeDefinition = ExpandedNodeID{NodeID: target.TypeDefinition}
+		}
+		references = append(references, rd)
+	}
+	return references, StatusGood
+}
+
+// monitor registers a monitored item of a node, its first notification holding the node's
+// current value
+func (s *AddressSpace) monitor(item *monitoredItem) StatusCode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, found := s.nodes[item.node]
+	if !found {
+		return StatusBadNodeIDUnknown
+	}
+	if n.Class != NodeClassVariable {
+		return StatusBadAttributeIDInvalid
+	}
+	s.monitors[item.node] = append(s.monitors[item.node], item)
+	item.notify(n.Value)
+	return StatusGood
+}
+
+// unmonitor removes the monitored items of a subscription
+func (s *AddressSpace) unmonitor(sub *subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for node, items := range s.monitors {
+		kept := items[:0]
+		for _, v := range items {
+			if v.sub != sub {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.monitors, node)
+		} else {
+			s.monitors[node] = kept
+		}
+	}
+}
+
+// ServerConfig holds the settings of a server. Users maps the names of the users accepted to
+// their passwords.
+type ServerConfig struct {
+	EndpointURL     string // the endpoint URL advertised, opc.tcp:// and the listening address if unset
+	ApplicationName string
+	Users           map[string]string
+	AllowAnonymous  bool
+	Timeout         time.Duration // write timeout, 10s if unset
+}
+
+// Server serves an address space over the binary protocol (opc.tcp), without message
+// security (security policy None). It supports the GetEndpoints, session, Browse, BrowseNext
+// and Read services, and subscriptions with data change notifications; other services are
+// answered with BadServiceUnsupported. A session is closed when its connection is lost.
+type Server struct {
+	space    *AddressSpace
+	config   ServerConfig
+	listener net.Listener
+
+	mutex     sync.Mutex
+	conns     map[*serverConn]bool
+	sessions  map[NodeID]*session // by authentication token
+	nextID    uint32
+	closed    bool
+	waitGroup sync.WaitGroup
+}
+
+// Listen serves the address space on the passed TCP address (e.g. ":4840")
+func Listen(address string, space *AddressSpace, config ServerConfig) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config.EndpointURL == "" {
+		config.EndpointURL = "opc.tcp://" + listener.Addr().String()
+	}
+	if config.ApplicationName == "" {
+		config.ApplicationName = defaultServerApplication
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	s := &Server{space: space, config: config, listener: listener, conns: make(map[*serverConn]bool),
+		sessions: make(map[NodeID]*session)}
+	s.waitGroup.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops listening and closes every connection, and with them their sessions
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.raw.Close()
+	}
+	s.mutex.Unlock()
+	err := s.listener.Close()
+	s.waitGroup.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.waitGroup.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverConn{server: s, raw: conn}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[c] = true
+		s.waitGroup.Add(1)
+		s.mutex.Unlock()
+		go c.serve()
+	}
+}
+
+// id returns a new id, unique to the server
+func (s *Server) id() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+// endpoints returns the server's single endpoint, without message security
+func (s *Server) endpoints() []EndpointDescription {
+	endpoint := EndpointDescription{
+		EndpointURL: s.config.EndpointURL,
+		Server: ApplicationDescription{ApplicationURI: "urn:" + s.config.ApplicationName,
+			ApplicationName: LocalizedText{Text: s.config.ApplicationName}, ApplicationType: ApplicationTypeServer,
+			DiscoveryURLs: []string{s.config.EndpointURL}},
+		SecurityMode:        MessageSecurityModeNone,
+		SecurityPolicyURI:   SecurityPolicyNone,
+		TransportProfileURI: TransportProfileBinary,
+	}
+	if s.config.AllowAnonymous {
+		endpoint.UserIdentityTokens = append(endpoint.UserIdentityTokens,
+			UserTokenPolicy{PolicyID: anonymousPolicyID, TokenType: UserTokenTypeAnonymous})
+	}
+	if len(s.config.Users) > 0 {
+		endpoint.UserIdentityTokens = append(endpoint.UserIdentityTokens,
+			UserTokenPolicy{PolicyID: userNamePolicyID, TokenType: UserTokenTypeUserName, SecurityPolicyURI: SecurityPolicyNone})
+	}
+	return []EndpointDescription{endpoint}
+}
+
+// serverConn is a connection to a client, and the secure channel it carries
+type serverConn struct {
+	server *Server
+	raw    net.Conn
+	conn   *secureConn
+}
+
+// serve exchanges hello and acknowledge, then handles requests until the connection is lost
+// or closed
+func (c *serverConn) serve() {
+	defer func() {
+		c.raw.Close()
+		c.server.mutex.Lock()
+		delete(c.server.conns, c)
+		var closed []*session
+		for token, v := range c.server.sessions {
+			if v.conn == c {
+				closed = append(closed, v)
+				delete(c.server.sessions, token)
+			}
+		}
+		c.server.mutex.Unlock()
+		for _, v := range closed {
+			c.server.closeSession(v)
+		}
+		c.server.waitGroup.Done()
+	}()
+	if !c.hello() {
+		return
+	}
+	for {
+		m, err := c.conn.readMessage()
+		if err != nil || m.Abort != nil {
+			return
+		}
+		request, err := decodeService(m.Body)
+		if err != nil {
+			if _, ok := err.(errUnsupportedService); !ok {
+				writeError(c.raw, StatusBadDecodingError, err.Error())
+				return
+			}
+			c.respond(m.RequestID, 0, &ServiceFault{}, StatusBadServiceUnsupported)
+			continue
+		}
+		switch m.Type {
+		case messageOpen:
+			if !c.open(m.RequestID, request) {
+				return
+			}
+		case messageClose:
+			return
+		default:
+			if c.conn.channel() == 0 {
+				writeError(c.raw, StatusBadSecureChannelIDInvalid, "")
+				return
+			}
+			header := requestHeader(request)
+			if header == nil {
+				writeError(c.raw, StatusBadRequestHeaderInvalid, "")
+				return
+			}
+			response, status := c.handle(m.RequestID, header, request)
+			if response != nil || status.IsBad() {
+				if status.IsBad() {
+					response = &ServiceFault{}
+				}
+				c.respond(m.RequestID, header.RequestHandle, response, status)
+			}
+		}
+	}
+}
+
+// hello reads the hello message, and acknowledges it
+func (c *serverConn) hello() bool {
+	c.raw.SetReadDeadline(time.Now().Add(c.server.config.Timeout))
+	messageType, _, body, err := readChunk(c.raw, bufferSize)
+	c.raw.SetReadDeadline(time.Time{})
+	if err != nil {
+		return false
+	}
+	var hello helloMessage
+	if messageType != messageHello || Unmarshal(body, &hello) != nil {
+		writeError(c.raw, StatusBadTCPMessageTypeInvalid, "expected hello")
+		return false
+	}
+	if hello.ReceiveBufferSize < minBufferSize {
+		writeError(c.raw, StatusBadTCPInternalError, "receive buffer too small")
+		return false
+	}
+	ack := acknowledgeMessage{ProtocolVersion: protocolVersion, ReceiveBufferSize: bufferSize, SendBufferSize: bufferSize,
+		MaxMessageSize: maxMessageSize}
+	if hello.ReceiveBufferSize < ack.SendBufferSize {
+		ack.SendBufferSize = hello.ReceiveBufferSize
+	}
+	if err := writeChunk(c.raw, messageAcknowledge, chunkFinal, Marshal(ack)); err != nil {
+		return false
+	}
+	c.conn = newSecureConn(c.raw, c.server.config.Timeout,
+		acknowledgeMessage{ReceiveBufferSize: ack.SendBufferSize, MaxMessageSize: hello.MaxMessageSize})
+	return true
+}
+
+// open opens the secure channel, or renews its token
+func (c *serverConn) open(requestID uint32, request interface{}) bool {
+	open, ok := request.(*OpenSecureChannelRequest)
+	if !ok {
+		writeError(c.raw, StatusBadTCPMessageTypeInvalid, "expected open secure channel request")
+		return false
+	}
+	if open.SecurityMode != MessageSecurityModeNone {
+		writeError(c.raw, StatusBadSecurityPolicyRejected, "only security policy None is supported")
+		return false
+	}
+	channelID := c.conn.channel()
+	if open.RequestType == SecurityTokenIssue && channelID != 0 || open.RequestType == SecurityTokenRenew && channelID == 0 {
+		writeError(c.raw, StatusBadSecureChannelIDInvalid, "")
+		return false
+	}
+	if channelID == 0 {
+		channelID = c.server.id()
+	}
+	lifetime := open.RequestedLifetime
+	if lifetime == 0 || lifetime > uint32(channelLifetime/time.Millisecond) {
+		lifetime = uint32(channelLifetime / time.Millisecond)
+	}
+	token := ChannelSecurityToken{ChannelID: channelID, TokenID: c.server.id(), CreatedAt: time.Now(), RevisedLifetime: lifetime}
+	response := &OpenSecureChannelResponse{ResponseHeader: ResponseHeader{Timestamp: time.Now(),
+		RequestHandle: open.RequestHeader.RequestHandle}, ServerProtocolVersion: protocolVersion, SecurityToken: token}
+	c.conn.setToken(channelID, token.TokenID)
+	return c.conn.writeMessage(messageOpen, requestID, encodeService(response)) == nil
+}
+
+// respond sends the response to a request
+func (c *serverConn) respond(requestID uint32, requestHandle uint32, response interface{}, status StatusCode) {
+	if header := responseHeader(response); header != nil {
+		header.Timestamp, header.RequestHandle, header.ServiceResult = time.Now(), requestHandle, status
+	}
+	if err := c.conn.writeMessage(messageService, requestID, encodeService(response)); err != nil {
+		c.raw.Close()
+	}
+}
+
+// handle handles a service request, returning its response, or the status of the fault the
+// request is answered with. Publish requests are queued, their responses sent as notifications
+// become available, and return neither.
+func (c *serverConn) handle(requestID uint32, header *RequestHeader, request interface{}) (interface{}, StatusCode) {
+	s := c.server
+	switch r := request.(type) {
+	case *GetEndpointsRequest:
+		return &GetEndpointsResponse{Endpoints: s.endpoints()}, StatusGood
+	case *CreateSessionRequest:
+		return c.createSession(r)
+	}
+
+	s.mutex.Lock()
+	session := s.sessions[header.AuthenticationToken]
+	s.mutex.Unlock()
+	if session == nil || session.conn != c {
+		return nil, StatusBadSessionIDInvalid
+	}
+	switch r := request.(type) {
+	case *ActivateSessionRequest:
+		return c.activateSession(session, r)
+	case *CloseSessionRequest:
+		s.mutex.Lock()
+		delete(s.sessions, header.AuthenticationToken)
+		s.mutex.Unlock()
+		s.closeSession(session)
+		return &CloseSessionResponse{}, StatusGood
+	}
+	if !session.activated {
+		return nil, StatusBadSessionNotActivated
+	}
+	switch r := request.(type) {
+	case *BrowseRequest:
+		return session.browse(r)
+	case *BrowseNextRequest:
+		return session.browseNext(r)
+	case *ReadRequest:
+		if len(r.NodesToRead) == 0 {
+			return nil, StatusBadNothingToDo
+		}
+		if r.TimestampsToReturn > TimestampsNeither {
+			return nil, StatusBadTimestampsToReturnInvalid
+		}
+		response := &ReadResponse{Results: make([]DataValue, len(r.NodesToRead))}
+		for i, v := range r.NodesToRead {
+			response.Results[i] = s.space.read(v, r.TimestampsToReturn)
+		}
+		return response, StatusGood
+	case *CreateSubscriptionRequest:
+		return session.createSubscription(r)
+	case *CreateMonitoredItemsRequest:
+		return session.createMonitoredItems(r)
+	case *DeleteSubscriptionsRequest:
+		if len(r.SubscriptionIDs) == 0 {
+			return nil, StatusBadNothingToDo
+		}
+		response := &DeleteSubscriptionsResponse{}
+		for _, id := range r.SubscriptionIDs {
+			response.Results = append(response.Results, session.deleteSubscription(id))
+		}
+		return response, StatusGood
+	case *PublishRequest:
+		return session.publish(requestID, header.RequestHandle, r)
+	}
+	return nil, StatusBadServiceUnsupported
+}
+
+func (c *serverConn) createSession(r *CreateSessionRequest) (interface{}, StatusCode) {
+	s := c.server
+	timeout := r.RequestedSessionTimeout
+	if timeout <= 0 || timeout > float64(time.Hour/time.Millisecond) {
+		timeout = float64(defaultSessionTimeout / time.Millisecond)
+	}
+	session := &session{id: NewNumericNodeID(1, s.id()), token: NewNumericNodeID(1, s.id()), conn: c,
+		subscriptions: make(map[uint32]*subscription), continuations: make(map[string][]ReferenceDescription)}
+	s.mutex.Lock()
+	if len(s.sessions) >= maxSessions {
+		s.mutex.Unlock()
+		return nil, StatusBadTooManySessions
+	}
+	s.sessions[session.token] = session
+	s.mutex.Unlock()
+	return &CreateSessionResponse{SessionID: session.id, AuthenticationToken: session.token,
+		RevisedSessionTimeout: timeout, ServerNonce: make([]byte, 32), ServerEndpoints: s.endpoints(),
+		MaxRequestMessageSize: maxMessageSize}, StatusGood
+}
+
+func (c *serverConn) activateSession(session *session, r *ActivateSessionRequest) (interface{}, StatusCode) {
+	config := c.server.config
+	switch token := r.UserIdentityToken.Value.(type) {
+	case nil, *AnonymousIdentityToken:
+		if !config.AllowAnonymous {
+			return nil, StatusBadIdentityTokenRejected
+		}
+	case *UserNameIdentityToken:
+		if token.EncryptionAlgorithm != "" {
+			return nil, StatusBadIdentityTokenInvalid
+		}
+		if password, found := config.Users[token.UserName]; !found || password != string(token.Password) {
+			return nil, StatusBadUserAccessDenied
+		}
+	default:
+		return nil, StatusBadIdentityTokenInvalid
+	}
+	c.server.mutex.Lock()
+	session.activated = true
+	c.server.mutex.Unlock()
+	return &ActivateSessionResponse{ServerNonce: make([]byte, 32)}, StatusGood
+}
+
+// closeSession deletes the subscriptions of a session, answering its queued publish requests
+func (s *Server) closeSession(session *session) {
+	s.mutex.Lock()
+	ids := make([]uint32, 0, len(session.subscriptions))
+	for id := range session.subscriptions {
+		ids = append(ids, id)
+	}
+	s.mutex.Unlock()
+	for _, id := range ids {
+		session.deleteSubscription(id)
+	}
+}
+
+// session is a client session, bound to the connection that created it. Its fields, and
+// those of its subscriptions, are guarded by the server's mutex.
+type session struct {
+	id            NodeID
+	token         NodeID
+	conn          *serverConn
+	activated     bool
+	subscriptions map[uint32]*subscription
+	publishQueue  []publishRequest
+	continuations map[string][]ReferenceDescription // the references remaining of each browse
+}
+
+// publishRequest is a queued publish request
+type publishRequest struct {
+	requestID        uint32
+	requestHandle    uint32
+	acknowledgements int // the acknowledgements the request carries
+}
+
+func (session *session) browse(r *BrowseRequest) (interface{}, StatusCode) {
+	if len(r.NodesToBrowse) == 0 {
+		return nil, StatusBadNothingToDo
+	}
+	if !r.View.ViewID.IsNull() {
+		return nil, StatusBadNodeIDUnknown
+	}
+	response := &BrowseResponse{}
+	for _, v := range r.NodesToBrowse {
+		references, status := session.conn.server.space.browse(v)
+		result := BrowseResult{StatusCode: status}
+		if status.IsGood() {
+			result = session.page(references, r.RequestedMaxReferencesPerNode)
+		}
+		response.Results = append(response.Results, result)
+	}
+	return response, StatusGood
+}
+
+// page returns up to max references, and a continuation point for those remaining
+func (session *session) page(references []ReferenceDescription, max uint32) BrowseResult {
+	if max == 0 || max > defaultReferencesPerBrowse {
+		max = defaultReferencesPerBrowse
+	}
+	if uint32(len(references)) <= max {
+		return BrowseResult{References: references}
+	}
+	server := session.conn.server
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(session.continuations) >= maxContinuationPoints {
+		return BrowseResult{StatusCode: StatusBadNoContinuationPoints}
+	}
+	point := make([]byte, continuationPointSize)
+	server.nextID++
+	binary.LittleEndian.PutUint32(point, server.nextID)
+	session.continuations[string(point)] = references[max:]
+	return BrowseResult{References: references[:max], ContinuationPoint: point}
+}
+
+func (session *session) browseNext(r *BrowseNextRequest) (interface{}, StatusCode) {
+	if len(r.ContinuationPoints) == 0 {
+		return nil, StatusBadNothingToDo
+	}
+	server := session.conn.server
+	response := &BrowseNextResponse{}
+	for _, point := range r.ContinuationPoints {
+		server.mutex.Lock()
+		references, found := session.continuations[string(point)]
+		delete(session.continuations, string(point))
+		server.mutex.Unlock()
+		switch {
+		case !found:
+			response.Results = append(response.Results, BrowseResult{StatusCode: StatusBadContinuationPointInvalid})
+		case r.ReleaseContinuationPoints:
+			response.Results = append(response.Results, BrowseResult{})
+		default:
+			response.Results = append(response.Results, session.page(references, 0))
+		}
+	}
+	return response, StatusGood
+}
+
+// subscription publishes the notifications of its monitored items every interval, or a
+// keep-alive after keepAliveCount intervals without notifications
+type subscription struct {
+	id             uint32
+	session        *session
+	interval       time.Duration
+	keepAliveCount uint32
+	queue          []MonitoredItemNotification
+	sequence       uint32
+	idle           uint32 // the intervals since the last publish response
+	stop           chan struct{}
+}
+
+// monitoredItem reports the value of a node to its subscription
+type monitoredItem struct {
+	id         uint32
+	handle     uint32
+	node       NodeID
+	timestamps TimestampsToReturn
+	sub        *subscription
+}
+
+// notify queues a notification of the item's value, discarding the oldest should the queue
+// be full
+func (item *monitoredItem) notify(value DataValue) {
+	server := item.sub.session.conn.server
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	sub := item.sub
+	if len(sub.queue) >= maxQueuedNotifications {
+		sub.queue = sub.queue[1:]
+	}
+	sub.queue = append(sub.queue, MonitoredItemNotification{ClientHandle: item.handle, Value: withTimestamps(value, item.timestamps)})
+}
+
+func (session *session) createSubscription(r *CreateSubscriptionRequest) (interface{}, StatusCode) {
+	interval := time.Duration(r.RequestedPublishingInterval * float64(time.Millisecond))
+	if interval < minPublishingInterval {
+		interval = minPublishingInterval
+	}
+	keepAliveCount := r.RequestedMaxKeepAliveCount
+	if keepAliveCount == 0 {
+		keepAliveCount = publishKeepAliveCount
+	}
+	server := session.conn.server
+	sub := &subscription{id: server.id(), session: session, interval: interval, keepAliveCount: keepAliveCount,
+		stop: make(chan struct{})}
+	server.mutex.Lock()
+	session.subscriptions[sub.id] = sub
+	server.mutex.Unlock()
+	server.waitGroup.Add(1)
+	go sub.run()
+	return &CreateSubscriptionResponse{SubscriptionID: sub.id,
+		RevisedPublishingInterval: float64(interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      3 * keepAliveCount, RevisedMaxKeepAliveCount: keepAliveCount}, StatusGood
+}
+
+func (session *session) createMonitoredItems(r *CreateMonitoredItemsRequest) (interface{}, StatusCode) {
+	if len(r.ItemsToCreate) == 0 {
+		return nil, StatusBadNothingToDo
+	}
+	if r.TimestampsToReturn > TimestampsNeither {
+		return nil, StatusBadTimestampsToReturnInvalid
+	}
+	server := session.conn.server
+	server.mutex.Lock()
+	sub := session.subscriptions[r.SubscriptionID]
+	server.mutex.Unlock()
+	if sub == nil {
+		return nil, StatusBadSubscriptionIDInvalid
+	}
+	response := &CreateMonitoredItemsResponse{}
+	for _, v := range r.ItemsToCreate {
+		result := MonitoredItemCreateResult{RevisedSamplingInterval: float64(sub.interval) / float64(time.Millisecond),
+			RevisedQueueSize: 1}
+		switch {
+		case v.ItemToMonitor.AttributeID != AttributeValue:
+			result.StatusCode = StatusBadAttributeIDInvalid
+		case v.MonitoringMode != MonitoringModeReporting:
+			result.StatusCode = StatusBadMonitoringModeInvalid
+		default:
+			item := &monitoredItem{id: server.id(), handle: v.RequestedParameters.ClientHandle,
+				node: v.ItemToMonitor.NodeID, timestamps: r.TimestampsToReturn, sub: sub}
+			if result.StatusCode = server.space.monitor(item); result.StatusCode.IsGood() {
+				result.MonitoredItemID = item.id
+			}
+		}
+		response.Results = append(response.Results, result)
+	}
+	return response, StatusGood
+}
+
+// deleteSubscription deletes a subscription, answering the session's queued publish requests
+// should it have been the last
+func (session *session) deleteSubscription(id uint32) StatusCode {
+	server := session.conn.server
+	server.mutex.Lock()
+	sub := session.subscriptions[id]
+	delete(session.subscriptions, id)
+	var queue []publishRequest
+	if sub != nil && len(session.subscriptions) == 0 {
+		queue, session.publishQueue = session.publishQueue, nil
+	}
+	server.mutex.Unlock()
+	if sub == nil {
+		return StatusBadSubscriptionIDInvalid
+	}
+	close(sub.stop)
+	server.space.unmonitor(sub)
+	for _, v := range queue {
+		session.conn.respond(v.requestID, v.requestHandle, &ServiceFault{}, StatusBadNoSubscription)
+	}
+	return StatusGood
+}
+
+func (session *session) publish(requestID uint32, requestHandle uint32, r *PublishRequest) (interface{}, StatusCode) {
+	server := session.conn.server
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(session.subscriptions) == 0 {
+		return nil, StatusBadNoSubscription
+	}
+	if len(session.publishQueue) >= maxPublishRequests {
+		oldest := session.publishQueue[0]
+		session.publishQueue = session.publishQueue[1:]
+		go session.conn.respond(oldest.requestID, oldest.requestHandle, &ServiceFault{}, StatusBadTooManyPublishRequests)
+	}
+	// notification messages are not retained for republishing, so acknowledgements need only
+	// be answered
+	session.publishQueue = append(session.publishQueue,
+		publishRequest{requestID, requestHandle, len(r.SubscriptionAcknowledgements)})
+	return nil, StatusGood
+}
+
+// run publishes the subscription's notifications, or keep-alives, every interval until the
+// subscription is deleted
+func (sub *subscription) run() {
+	server := sub.session.conn.server
+	defer server.waitGroup.Done()
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-ticker.C:
+		}
+		if request, response := sub.next(); response != nil {
+			sub.session.conn.respond(request.requestID, request.requestHandle, response, StatusGood)
+		}
+	}
+}
+
+// next returns a queued publish request and the response to send it, should the
+// subscription have notifications or be due a keep-alive
+func (sub *subscription) next() (publishRequest, *PublishResponse) {
+	server := sub.session.conn.server
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	session := sub.session
+	sub.idle++
+	if len(session.publishQueue) == 0 || len(sub.queue) == 0 && sub.idle < sub.keepAliveCount {
+		return publishRequest{}, nil
+	}
+	request := session.publishQueue[0]
+	session.publishQueue = session.publishQueue[1:]
+	sub.idle = 0
+	response := &PublishResponse{SubscriptionID: sub.id, Results: make([]StatusCode, request.acknowledgements)}
+	response.NotificationMessage.PublishTime = time.Now()
+	if len(sub.queue) == 0 {
+		// a keep-alive carries the sequence number of the next notification message
+		response.NotificationMessage.SequenceNumber = sub.sequence + 1
+		return request, response
+	}
+	sub.sequence++
+	response.NotificationMessage.SequenceNumber = sub.sequence
+	response.NotificationMessage.NotificationData = []ExtensionObject{
+		NewExtensionObject(&DataChangeNotification{MonitoredItems: sub.queue})}
+	sub.queue = nil
+	return request, response
+}
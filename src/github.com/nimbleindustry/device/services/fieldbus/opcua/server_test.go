@@ -0,0 +1,43 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDropsForgedRequest(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", addressSpaceFixture(), ServerConfig{AllowAnonymous: true})
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	endpoint := "opc.tcp://" + server.Addr().String()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err, "unable to connect")
+	defer conn.Close()
+	ack, err := hello(conn, endpoint, time.Second)
+	assert.Nil(t, err)
+
+	// a read request claiming 2^24 nodes, sent before any secure channel is open
+	body := encodeService(&ReadRequest{})
+	binary.LittleEndian.PutUint32(body[len(body)-4:], maxArrayLength)
+	assert.Nil(t, newSecureConn(conn, time.Second, ack).writeMessage(messageService, 1, body))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	messageType, _, reply, err := readChunk(conn, bufferSize)
+	assert.Nil(t, err)
+	assert.Equal(t, messageError, messageType)
+	var m errorMessage
+	assert.Nil(t, Unmarshal(reply, &m))
+	assert.Equal(t, StatusBadDecodingError, m.Error)
+	_, _, _, err = readChunk(conn, bufferSize)
+	assert.Equal(t, io.EOF, err, "expected the connection to be dropped")
+
+	// the server goes on serving other clients
+	client, err := Dial(endpoint, ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	assert.Nil(t, client.Close())
+}
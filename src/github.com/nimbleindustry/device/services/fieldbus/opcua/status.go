@@ -0,0 +1,140 @@
+package opcua
+
+import "fmt"
+
+// StatusCode is the result of an operation. The top two bits give its severity: good,
+// uncertain or bad. A StatusCode is an error, for use where the operation was not good.
+type StatusCode uint32
+
+// Status codes used by the client and server
+const (
+	StatusGood                          StatusCode = 0x00000000
+	StatusUncertain                     StatusCode = 0x40000000
+	StatusUncertainLastUsableValue      StatusCode = 0x40900000
+	StatusUncertainInitialValue         StatusCode = 0x40920000
+	StatusBad                           StatusCode = 0x80000000
+	StatusBadUnexpectedError            StatusCode = 0x80010000
+	StatusBadInternalError              StatusCode = 0x80020000
+	StatusBadCommunicationError         StatusCode = 0x80050000
+	StatusBadEncodingError              StatusCode = 0x80060000
+	StatusBadDecodingError              StatusCode = 0x80070000
+	StatusBadTimeout                    StatusCode = 0x800A0000
+	StatusBadServiceUnsupported         StatusCode = 0x800B0000
+	StatusBadShutdown                   StatusCode = 0x800C0000
+	StatusBadServerHalted               StatusCode = 0x800E0000
+	StatusBadNothingToDo                StatusCode = 0x800F0000
+	StatusBadTooManyOperations          StatusCode = 0x80100000
+	StatusBadUserAccessDenied           StatusCode = 0x801F0000
+	StatusBadIdentityTokenInvalid       StatusCode = 0x80200000
+	StatusBadIdentityTokenRejected      StatusCode = 0x80210000
+	StatusBadSecureChannelIDInvalid     StatusCode = 0x80220000
+	StatusBadSessionIDInvalid           StatusCode = 0x80250000
+	StatusBadSessionClosed              StatusCode = 0x80260000
+	StatusBadSessionNotActivated        StatusCode = 0x80270000
+	StatusBadSubscriptionIDInvalid      StatusCode = 0x80280000
+	StatusBadRequestHeaderInvalid       StatusCode = 0x802A0000
+	StatusBadTimestampsToReturnInvalid  StatusCode = 0x802B0000
+	StatusBadNoCommunication            StatusCode = 0x80310000
+	StatusBadWaitingForInitialData      StatusCode = 0x80320000
+	StatusBadNodeIDInvalid              StatusCode = 0x80330000
+	StatusBadNodeIDUnknown              StatusCode = 0x80340000
+	StatusBadAttributeIDInvalid         StatusCode = 0x80350000
+	StatusBadIndexRangeInvalid          StatusCode = 0x80360000
+	StatusBadNotReadable                StatusCode = 0x803A0000
+	StatusBadMonitoringModeInvalid      StatusCode = 0x80410000
+	StatusBadContinuationPointInvalid   StatusCode = 0x804A0000
+	StatusBadNoContinuationPoints       StatusCode = 0x804B0000
+	StatusBadBrowseDirectionInvalid     StatusCode = 0x804D0000
+	StatusBadSecurityPolicyRejected     StatusCode = 0x80550000
+	StatusBadTooManySessions            StatusCode = 0x80560000
+	StatusBadTooManySubscriptions       StatusCode = 0x80770000
+	StatusBadTooManyPublishRequests     StatusCode = 0x80780000
+	StatusBadNoSubscription             StatusCode = 0x80790000
+	StatusBadTCPMessageTypeInvalid      StatusCode = 0x807E0000
+	StatusBadTCPMessageTooLarge         StatusCode = 0x80800000
+	StatusBadTCPInternalError           StatusCode = 0x80820000
+	StatusBadTCPEndpointURLInvalid      StatusCode = 0x80830000
+	StatusBadRequestTooLarge            StatusCode = 0x80B80000
+	StatusBadResponseTooLarge           StatusCode = 0x80B90000
+	StatusBadProtocolVersionUnsupported StatusCode = 0x80BE0000
+)
+
+var statusNames = map[StatusCode]string{
+	StatusGood:                          "Good",
+	StatusUncertain:                     "Uncertain",
+	StatusUncertainLastUsableValue:      "UncertainLastUsableValue",
+	StatusUncertainInitialValue:         "UncertainInitialValue",
+	StatusBad:                           "Bad",
+	StatusBadUnexpectedError:            "BadUnexpectedError",
+	StatusBadInternalError:              "BadInternalError",
+	StatusBadCommunicationError:         "BadCommunicationError",
+	StatusBadEncodingError:              "BadEncodingError",
+	StatusBadDecodingError:              "BadDecodingError",
+	StatusBadTimeout:                    "BadTimeout",
+	StatusBadServiceUnsupported:         "BadServiceUnsupported",
+	StatusBadShutdown:                   "BadShutdown",
+	StatusBadServerHalted:               "BadServerHalted",
+	StatusBadNothingToDo:                "BadNothingToDo",
+	StatusBadTooManyOperations:          "BadTooManyOperations",
+	StatusBadUserAccessDenied:           "BadUserAccessDenied",
+	StatusBadIdentityTokenInvalid:       "BadIdentityTokenInvalid",
+	StatusBadIdentityTokenRejected:      "BadIdentityTokenRejected",
+	StatusBadSecureChannelIDInvalid:     "BadSecureChannelIdInvalid",
+	StatusBadSessionIDInvalid:           "BadSessionIdInvalid",
+	StatusBadSessionClosed:              "BadSessionClosed",
+	StatusBadSessionNotActivated:        "BadSessionNotActivated",
+	StatusBadSubscriptionIDInvalid:      "BadSubscriptionIdInvalid",
+	StatusBadRequestHeaderInvalid:       "BadRequestHeaderInvalid",
+	StatusBadTimestampsToReturnInvalid:  "BadTimestampsToReturnInvalid",
+	StatusBadNoCommunication:            "BadNoCommunication",
+	StatusBadWaitingForInitialData:      "BadWaitingForInitialData",
+	StatusBadNodeIDInvalid:              "BadNodeIdInvalid",
+	StatusBadNodeIDUnknown:              "BadNodeIdUnknown",
+	StatusBadAttributeIDInvalid:         "BadAttributeIdInvalid",
+	StatusBadIndexRangeInvalid:          "BadIndexRangeInvalid",
+	StatusBadNotReadable:                "BadNotReadable",
+	StatusBadMonitoringModeInvalid:      "BadMonitoringModeInvalid",
+	StatusBadContinuationPointInvalid:   "BadContinuationPointInvalid",
+	StatusBadNoContinuationPoints:       "BadNoContinuationPoints",
+	StatusBadBrowseDirectionInvalid:     "BadBrowseDirectionInvalid",
+	StatusBadSecurityPolicyRejected:     "BadSecurityPolicyRejected",
+	StatusBadTooManySessions:            "BadTooManySessions",
+	StatusBadTooManySubscriptions:       "BadTooManySubscriptions",
+	StatusBadTooManyPublishRequests:     "BadTooManyPublishRequests",
+	StatusBadNoSubscription:             "BadNoSubscription",
+	StatusBadTCPMessageTypeInvalid:      "BadTcpMessageTypeInvalid",
+	StatusBadTCPMessageTooLarge:         "BadTcpMessageTooLarge",
+	StatusBadTCPInternalError:           "BadTcpInternalError",
+	StatusBadTCPEndpointURLInvalid:      "BadTcpEndpointUrlInvalid",
+	StatusBadRequestTooLarge:            "BadRequestTooLarge",
+	StatusBadResponseTooLarge:           "BadResponseTooLarge",
+	StatusBadProtocolVersionUnsupported: "BadProtocolVersionUnsupported",
+}
+
+// IsGood returns true if the status code's severity is good
+func (s StatusCode) IsGood() bool {
+	return s&0xC0000000 == 0
+}
+
+// IsUncertain returns true if the status code's severity is uncertain
+func (s StatusCode) IsUncertain() bool {
+	return s&0xC0000000 == 0x40000000
+}
+
+// IsBad returns true if the status code's severity is bad
+func (s StatusCode) IsBad() bool {
+	return s&0x80000000 != 0
+}
+
+// String returns the name of the status code, its hex value if not known. The low 16 bits,
+// which hold flags such as the overflow bit, do not affect the name.
+func (s StatusCode) String() string {
+	if name, found := statusNames[s&0xFFFF0000]; found {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", uint32(s))
+}
+
+func (s StatusCode) Error() string {
+	return "opcua: " + s.String()
+}
@@ -0,0 +1,498 @@
+package opcua
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeID identifier types
+const (
+	IDNumeric = iota
+	IDString
+	IDGUID
+	IDOpaque
+)
+
+// NodeID identifies a node of an address space. Identifier holds string identifiers and the
+// raw bytes of GUID (in their encoded byte order) and opaque identifiers, keeping NodeID
+// comparable so that it may be used as a map key.
+type NodeID struct {
+	Namespace  uint16
+	IDType     int
+	Numeric    uint32
+	Identifier string
+}
+
+// NewNumericNodeID returns the numeric node id of the passed namespace
+func NewNumericNodeID(namespace uint16, id uint32) NodeID {
+	return NodeID{Namespace: namespace, IDType: IDNumeric, Numeric: id}
+}
+
+// NewStringNodeID returns the string node id of the passed namespace
+func NewStringNodeID(namespace uint16, id string) NodeID {
+	return NodeID{Namespace: namespace, IDType: IDString, Identifier: id}
+}
+
+// ParseNodeID parses the text format of a node id, such as "i=85", "ns=2;s=Line1.Speed",
+// "ns=3;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63" or "ns=1;b=M/RbKBsRVkePCePcx24oRA=="
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	rest := s
+	if strings.HasPrefix(rest, "ns=") {
+		i := strings.Index(rest, ";")
+		if i < 0 {
+			return id, fmt.Errorf("node id %q has no identifier", s)
+		}
+		ns, err := strconv.ParseUint(rest[3:i], 10, 16)
+		if err != nil {
+			return id, fmt.Errorf("node id %q has invalid namespace", s)
+		}
+		id.Namespace = uint16(ns)
+		rest = rest[i+1:]
+	}
+	if len(rest) < 2 || rest[1] != '=' {
+		return id, fmt.Errorf("node id %q has no identifier", s)
+	}
+	value := rest[2:]
+	switch rest[0] {
+	case 'i':
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return id, fmt.Errorf("node id %q has invalid numeric identifier", s)
+		}
+		id.IDType, id.Numeric = IDNumeric, uint32(n)
+	case 's':
+		id.IDType, id.Identifier = IDString, value
+	case 'g':
+		guid, err := parseGUID(value)
+		if err != nil {
+			return id, fmt.Errorf("node id %q has invalid guid identifier", s)
+		}
+		id.IDType, id.Identifier = IDGUID, string(guid)
+	case 'b':
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return id, fmt.Errorf("node id %q has invalid opaque identifier", s)
+		}
+		id.IDType, id.Identifier = IDOpaque, string(b)
+	default:
+		return id, fmt.Errorf("node id %q has unknown identifier type %c", s, rest[0])
+	}
+	return id, nil
+}
+
+// String returns the text format of the node id, as parsed by ParseNodeID
+func (id NodeID) String() string {
+	var s string
+	switch id.IDType {
+	case IDString:
+		s = "s=" + id.Identifier
+	case IDGUID:
+		s = "g=" + formatGUID([]byte(id.Identifier))
+	case IDOpaque:
+		s = "b=" + base64.StdEncoding.EncodeToString([]byte(id.Identifier))
+	default:
+		s = "i=" + strconv.FormatUint(uint64(id.Numeric), 10)
+	}
+	if id.Namespace != 0 {
+		return fmt.Sprintf("ns=%d;%s", id.Namespace, s)
+	}
+	return s
+}
+
+// IsNull returns true for the null node id, i=0
+func (id NodeID) IsNull() bool {
+	return id == NodeID{}
+}
+
+// NodeID encoding masks, and the flags of an ExpandedNodeId
+const (
+	nodeIDTwoByte     = 0x00
+	nodeIDFourByte    = 0x01
+	nodeIDNumeric     = 0x02
+	nodeIDString      = 0x03
+	nodeIDGUID        = 0x04
+	nodeIDByteString  = 0x05
+	nodeIDServerIndex = 0x40
+	nodeIDURI         = 0x80
+)
+
+func (id NodeID) encodeUA(e *encoder) {
+	id.encodeFlags(e, 0)
+}
+
+func (id NodeID) encodeFlags(e *encoder, flags byte) {
+	switch id.IDType {
+	case IDString:
+		e.uint8(nodeIDString | flags)
+		e.uint16(id.Namespace)
+		e.string(id.Identifier)
+	case IDGUID:
+		e.uint8(nodeIDGUID | flags)
+		e.uint16(id.Namespace)
+		guid := make([]byte, 16)
+		copy(guid, id.Identifier)
+		e.buf = append(e.buf, guid...)
+	case IDOpaque:
+		e.uint8(nodeIDByteString | flags)
+		e.uint16(id.Namespace)
+		e.bytes([]byte(id.Identifier))
+	default:
+		switch {
+		case id.Namespace == 0 && id.Numeric <= 0xFF:
+			e.uint8(nodeIDTwoByte | flags)
+			e.uint8(uint8(id.Numeric))
+		case id.Namespace <= 0xFF && id.Numeric <= 0xFFFF:
+			e.uint8(nodeIDFourByte | flags)
+			e.uint8(uint8(id.Namespace))
+			e.uint16(uint16(id.Numeric))
+		default:
+			e.uint8(nodeIDNumeric | flags)
+			e.uint16(id.Namespace)
+			e.uint32(id.Numeric)
+		}
+	}
+}
+
+func (id *NodeID) decodeUA(d *decoder) {
+	id.decodeFlags(d)
+}
+
+// decodeFlags decodes the node id, returning the ExpandedNodeId flags of its encoding byte
+func (id *NodeID) decodeFlags(d *decoder) byte {
+	mask := d.uint8()
+	*id = NodeID{}
+	switch mask & 0x3F {
+	case nodeIDTwoByte:
+		id.Numeric = uint32(d.uint8())
+	case nodeIDFourByte:
+		id.Namespace = uint16(d.uint8())
+		id.Numeric = uint32(d.uint16())
+	case nodeIDNumeric:
+		id.Namespace = d.uint16()
+		id.Numeric = d.uint32()
+	case nodeIDString:
+		id.Namespace = d.uint16()
+		id.IDType, id.Identifier = IDString, d.string()
+	case nodeIDGUID:
+		id.Namespace = d.uint16()
+		id.IDType, id.Identifier = IDGUID, string(d.next(16))
+	case nodeIDByteString:
+		id.Namespace = d.uint16()
+		id.IDType, id.Identifier = IDOpaque, string(d.bytes())
+	default:
+		d.fail(fmt.Errorf("opcua: invalid node id encoding 0x%02x", mask))
+	}
+	return mask & (nodeIDServerIndex | nodeIDURI)
+}
+
+// parseGUID converts the text format of a GUID to its encoded bytes: the first three groups
+// are little-endian, the last two in order
+func parseGUID(s string) ([]byte, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 ||
+		len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return nil, fmt.Errorf("invalid guid %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return nil, err
+	}
+	reverse := func(b []byte) {
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	reverse(b[0:4])
+	reverse(b[4:6])
+	reverse(b[6:8])
+	return b, nil
+}
+
+func formatGUID(b []byte) string {
+	if len(b) != 16 {
+		return hex.EncodeToString(b)
+	}
+	return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b),
+		binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:]))
+}
+
+// ExpandedNodeID is a node id that may refer to another server or namespace by URI
+type ExpandedNodeID struct {
+	NodeID
+	NamespaceURI string
+	ServerIndex  uint32
+}
+
+func (id ExpandedNodeID) encodeUA(e *encoder) {
+	var flags byte
+	if id.NamespaceURI != "" {
+		flags |= nodeIDURI
+	}
+	if id.ServerIndex != 0 {
+		flags |= nodeIDServerIndex
+	}
+	id.NodeID.encodeFlags(e, flags)
+	if id.NamespaceURI != "" {
+		e.string(id.NamespaceURI)
+	}
+	if id.ServerIndex != 0 {
+		e.uint32(id.ServerIndex)
+	}
+}
+
+func (id *ExpandedNodeID) decodeUA(d *decoder) {
+	flags := id.NodeID.decodeFlags(d)
+	id.NamespaceURI, id.ServerIndex = "", 0
+	if flags&nodeIDURI != 0 {
+		id.NamespaceURI = d.string()
+	}
+	if flags&nodeIDServerIndex != 0 {
+		id.ServerIndex = d.uint32()
+	}
+}
+
+// QualifiedName is a name qualified by the index of its namespace, such as a browse name
+type QualifiedName struct {
+	NamespaceIndex uint16
+	Name           string
+}
+
+// LocalizedText is text in the language of Locale (e.g. "en-US"), unspecified if empty
+type LocalizedText struct {
+	Locale string
+	Text   string
+}
+
+func (t LocalizedText) encodeUA(e *encoder) {
+	var mask byte
+	if t.Locale != "" {
+		mask |= 0x01
+	}
+	if t.Text != "" {
+		mask |= 0x02
+	}
+	e.uint8(mask)
+	if t.Locale != "" {
+		e.string(t.Locale)
+	}
+	if t.Text != "" {
+		e.string(t.Text)
+	}
+}
+
+func (t *LocalizedText) decodeUA(d *decoder) {
+	mask := d.uint8()
+	*t = LocalizedText{}
+	if mask&0x01 != 0 {
+		t.Locale = d.string()
+	}
+	if mask&0x02 != 0 {
+		t.Text = d.string()
+	}
+}
+
+// DataValue is the value of a node's attribute along with its status and timestamps
+type DataValue struct {
+	Value             Variant
+	Status            StatusCode
+	SourceTimestamp   time.Time
+	ServerTimestamp   time.Time
+	SourcePicoseconds uint16
+	ServerPicoseconds uint16
+}
+
+// DataValue encoding masks
+const (
+	dataValueValue             = 0x01
+	dataValueStatus            = 0x02
+	dataValueSourceTimestamp   = 0x04
+	dataValueServerTimestamp   = 0x08
+	dataValueSourcePicoseconds = 0x10
+	dataValueServerPicoseconds = 0x20
+)
+
+func (v DataValue) encodeUA(e *encoder) {
+	var mask byte
+	if v.Value.Value != nil {
+		mask |= dataValueValue
+	}
+	if v.Status != StatusGood {
+		mask |= dataValueStatus
+	}
+	if !v.SourceTimestamp.IsZero() {
+		mask |= dataValueSourceTimestamp
+	}
+	if !v.ServerTimestamp.IsZero() {
+		mask |= dataValueServerTimestamp
+	}
+	if v.SourcePicoseconds != 0 {
+		mask |= dataValueSourcePicoseconds
+	}
+	if v.ServerPicoseconds != 0 {
+		mask |= dataValueServerPicoseconds
+	}
+	e.uint8(mask)
+	if mask&dataValueValue != 0 {
+		v.Value.encodeUA(e)
+	}
+	if mask&dataValueStatus != 0 {
+		e.uint32(uint32(v.Status))
+	}
+	if mask&dataValueSourceTimestamp != 0 {
+		e.dateTime(v.SourceTimestamp)
+	}
+	if mask&dataValueSourcePicoseconds != 0 {
+		e.uint16(v.SourcePicoseconds)
+	}
+	if mask&dataValueServerTimestamp != 0 {
+		e.dateTime(v.ServerTimestamp)
+	}
+	if mask&dataValueServerPicoseconds != 0 {
+		e.uint16(v.ServerPicoseconds)
+	}
+}
+
+func (v *DataValue) decodeUA(d *decoder) {
+	mask := d.uint8()
+	*v = DataValue{}
+	if mask&dataValueValue != 0 {
+		v.Value.decodeUA(d)
+	}
+	if mask&dataValueStatus != 0 {
+		v.Status = StatusCode(d.uint32())
+	}
+	if mask&dataValueSourceTimestamp != 0 {
+		v.SourceTimestamp = d.dateTime()
+	}
+	if mask&dataValueSourcePicoseconds != 0 {
+		v.SourcePicoseconds = d.uint16()
+	}
+	if mask&dataValueServerTimestamp != 0 {
+		v.ServerTimestamp = d.dateTime()
+	}
+	if mask&dataValueServerPicoseconds != 0 {
+		v.ServerPicoseconds = d.uint16()
+	}
+}
+
+// ExtensionObject holds a structure encoded in its binary encoding. Value is a pointer to one
+// of the registered structures (such as *DataChangeNotification) or, for structures that are
+// not registered, the encoded body as []byte; nil encodes an empty object.
+type ExtensionObject struct {
+	TypeID NodeID // the id of the structure's binary encoding
+	Value  interface{}
+}
+
+// NewExtensionObject returns an extension object holding a registered structure
+func NewExtensionObject(value interface{}) ExtensionObject {
+	return ExtensionObject{TypeID: NewNumericNodeID(0, encodingID(value)), Value: value}
+}
+
+func (o ExtensionObject) encodeUA(e *encoder) {
+	if o.Value == nil {
+		o.TypeID.encodeUA(e)
+		e.uint8(0)
+		return
+	}
+	typeID := o.TypeID
+	if id := encodingID(o.Value); id != 0 {
+		typeID = NewNumericNodeID(0, id)
+	}
+	typeID.encodeUA(e)
+	e.uint8(1)
+	body, ok := o.Value.([]byte)
+	if !ok {
+		body = Marshal(o.Value)
+	}
+	e.bytes(body)
+}
+
+func (o *ExtensionObject) decodeUA(d *decoder) {
+	*o = ExtensionObject{}
+	o.TypeID.decodeUA(d)
+	switch encoding := d.uint8(); encoding {
+	case 0:
+	case 1, 2:
+		body := d.bytes()
+		if d.err != nil {
+			return
+		}
+		t, found := registry.types[o.TypeID]
+		if !found || encoding != 1 {
+			o.Value = body
+			return
+		}
+		value := reflect.New(t)
+		if err := Unmarshal(body, value.Interface()); err != nil {
+			d.fail(fmt.Errorf("opcua: decoding %s, %s", t.Name(), err))
+			return
+		}
+		o.Value = value.Interface()
+	default:
+		d.fail(fmt.Errorf("opcua: invalid extension object encoding 0x%02x", encoding))
+	}
+}
+
+// DiagnosticInfo carries vendor specific diagnostics of a status code
+type DiagnosticInfo struct {
+	SymbolicID          int32
+	NamespaceURI        int32
+	LocalizedText       int32
+	Locale              int32
+	AdditionalInfo      string
+	InnerStatusCode     StatusCode
+	InnerDiagnosticInfo *DiagnosticInfo
+}
+
+func (i DiagnosticInfo) encodeUA(e *encoder) {
+	// only the additional info and inner status code, which carry no string table indexes,
+	// are sent
+	var mask byte
+	if i.AdditionalInfo != "" {
+		mask |= 0x10
+	}
+	if i.InnerStatusCode != StatusGood {
+		mask |= 0x20
+	}
+	e.uint8(mask)
+	if i.AdditionalInfo != "" {
+		e.string(i.AdditionalInfo)
+	}
+	if i.InnerStatusCode != StatusGood {
+		e.uint32(uint32(i.InnerStatusCode))
+	}
+}
+
+func (i *DiagnosticInfo) decodeUA(d *decoder) {
+	*i = DiagnosticInfo{}
+	mask := d.uint8()
+	if mask&0x01 != 0 {
+		i.SymbolicID = d.int32()
+	}
+	if mask&0x02 != 0 {
+		i.NamespaceURI = d.int32()
+	}
+	if mask&0x08 != 0 {
+		i.Locale = d.int32()
+	}
+	if mask&0x04 != 0 {
+		i.LocalizedText = d.int32()
+	}
+	if mask&0x10 != 0 {
+		i.AdditionalInfo = d.string()
+	}
+	if mask&0x20 != 0 {
+		i.InnerStatusCode = StatusCode(d.uint32())
+	}
+	if mask&0x40 != 0 {
+		i.InnerDiagnosticInfo = &DiagnosticInfo{}
+		i.InnerDiagnosticInfo.decodeUA(d)
+	}
+}
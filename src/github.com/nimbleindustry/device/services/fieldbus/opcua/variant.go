@@ -0,0 +1,203 @@
+package opcua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Built-in type ids, as used by Variant encoding and as the numeric node ids of the data types
+const (
+	TypeBoolean         = 1
+	TypeSByte           = 2
+	TypeByte            = 3
+	TypeInt16           = 4
+	TypeUInt16          = 5
+	TypeInt32           = 6
+	TypeUInt32          = 7
+	TypeInt64           = 8
+	TypeUInt64          = 9
+	TypeFloat           = 10
+	TypeDouble          = 11
+	TypeString          = 12
+	TypeDateTime        = 13
+	TypeGUID            = 14
+	TypeByteString      = 15
+	TypeXMLElement      = 16
+	TypeNodeID          = 17
+	TypeExpandedNodeID  = 18
+	TypeStatusCode      = 19
+	TypeQualifiedName   = 20
+	TypeLocalizedText   = 21
+	TypeExtensionObject = 22
+	TypeDataValue       = 23
+	TypeVariant         = 24
+	TypeDiagnosticInfo  = 25
+)
+
+// Variant encoding masks
+const (
+	variantArray      = 0x80
+	variantDimensions = 0x40
+)
+
+// variantTypes maps the Go types held by a Variant to their built-in type ids
+var variantTypes = map[reflect.Type]byte{
+	reflect.TypeOf(false):             TypeBoolean,
+	reflect.TypeOf(int8(0)):           TypeSByte,
+	reflect.TypeOf(uint8(0)):          TypeByte,
+	reflect.TypeOf(int16(0)):          TypeInt16,
+	reflect.TypeOf(uint16(0)):         TypeUInt16,
+	reflect.TypeOf(int32(0)):          TypeInt32,
+	reflect.TypeOf(uint32(0)):         TypeUInt32,
+	reflect.TypeOf(int64(0)):          TypeInt64,
+	reflect.TypeOf(uint64(0)):         TypeUInt64,
+	reflect.TypeOf(float32(0)):        TypeFloat,
+	reflect.TypeOf(float64(0)):        TypeDouble,
+	reflect.TypeOf(""):                TypeString,
+	timeType:                          TypeDateTime,
+	reflect.TypeOf([]byte{}):          TypeByteString,
+	reflect.TypeOf(NodeID{}):          TypeNodeID,
+	reflect.TypeOf(ExpandedNodeID{}):  TypeExpandedNodeID,
+	reflect.TypeOf(StatusCode(0)):     TypeStatusCode,
+	reflect.TypeOf(QualifiedName{}):   TypeQualifiedName,
+	reflect.TypeOf(LocalizedText{}):   TypeLocalizedText,
+	reflect.TypeOf(ExtensionObject{}): TypeExtensionObject,
+	reflect.TypeOf(DataValue{}):       TypeDataValue,
+	reflect.TypeOf(Variant{}):         TypeVariant,
+	reflect.TypeOf(GUID{}):            TypeGUID,
+	reflect.TypeOf(XMLElement("")):    TypeXMLElement,
+	reflect.TypeOf(DiagnosticInfo{}):  TypeDiagnosticInfo,
+}
+
+// variantGoTypes maps built-in type ids to the Go types decoded from a Variant
+var variantGoTypes = map[byte]reflect.Type{}
+
+func init() {
+	for k, v := range variantTypes {
+		variantGoTypes[v] = k
+	}
+}
+
+// GUID is a globally unique identifier, in its encoded byte order
+type GUID [16]byte
+
+// String returns the text format of the GUID
+func (g GUID) String() string {
+	return formatGUID(g[:])
+}
+
+// XMLElement is an XML fragment
+type XMLElement string
+
+// Variant holds a value of one of the built-in types, or a one-dimensional array (slice) of
+// them: bool, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64,
+// string, time.Time, GUID, []byte, XMLElement, NodeID, ExpandedNodeID, StatusCode,
+// QualifiedName, LocalizedText, ExtensionObject, DataValue, Variant or DiagnosticInfo.
+// Multi-dimensional arrays are decoded flattened. A nil Value is the null variant. Values of
+// type int are encoded as Int64.
+type Variant struct {
+	Value interface{}
+}
+
+// TypeID returns the built-in type id of the variant's value (or its elements), zero if null
+// or not encodable
+func (v Variant) TypeID() byte {
+	if v.Value == nil {
+		return 0
+	}
+	t := reflect.TypeOf(v.Value)
+	if t.Kind() == reflect.Int {
+		return TypeInt64
+	}
+	if id, found := variantTypes[t]; found {
+		return id
+	}
+	if t.Kind() == reflect.Slice {
+		if t.Elem().Kind() == reflect.Int {
+			return TypeInt64
+		}
+		return variantTypes[t.Elem()]
+	}
+	return 0
+}
+
+// IsArray returns true if the variant holds an array
+func (v Variant) IsArray() bool {
+	if v.Value == nil {
+		return false
+	}
+	t := reflect.TypeOf(v.Value)
+	return t.Kind() == reflect.Slice && t != reflect.TypeOf([]byte{})
+}
+
+func (v Variant) encodeUA(e *encoder) {
+	typeID := v.TypeID()
+	if typeID == 0 {
+		if v.Value != nil {
+			panic(fmt.Sprintf("opcua: cannot encode %T in a variant", v.Value))
+		}
+		e.uint8(0)
+		return
+	}
+	value := reflect.ValueOf(v.Value)
+	if !v.IsArray() {
+		e.uint8(typeID)
+		if value.Kind() == reflect.Int {
+			e.uint64(uint64(value.Int()))
+			return
+		}
+		e.value(value)
+		return
+	}
+	e.uint8(typeID | variantArray)
+	e.int32(int32(value.Len()))
+	for i := 0; i < value.Len(); i++ {
+		if element := value.Index(i); element.Kind() == reflect.Int {
+			e.uint64(uint64(element.Int()))
+		} else {
+			e.value(element)
+		}
+	}
+}
+
+func (v *Variant) decodeUA(d *decoder) {
+	*v = Variant{}
+	mask := d.uint8()
+	if mask == 0 || d.err != nil {
+		return
+	}
+	typeID := mask &^ (variantArray | variantDimensions)
+	t, found := variantGoTypes[typeID]
+	if !found {
+		d.fail(fmt.Errorf("opcua: unsupported variant type %d", typeID))
+		return
+	}
+	if mask&variantArray == 0 {
+		value := reflect.New(t).Elem()
+		d.value(value)
+		v.Value = value.Interface()
+		return
+	}
+	n := d.length()
+	if n < 0 {
+		n = 0
+	}
+	array := reflect.MakeSlice(reflect.SliceOf(t), n, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		d.value(array.Index(i))
+	}
+	if mask&variantDimensions != 0 {
+		var dimensions []int32
+		d.value(reflect.ValueOf(&dimensions).Elem())
+	}
+	v.Value = array.Interface()
+}
+
+// dataTypeOf returns the node id of the data type of a variant's value, that of BaseDataType
+// if null
+func dataTypeOf(v Variant) NodeID {
+	if id := v.TypeID(); id != 0 {
+		return NewNumericNodeID(0, uint32(id))
+	}
+	return NewNumericNodeID(0, DataTypeBaseDataType)
+}
@@ -0,0 +1,140 @@
+package fieldbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/opcua"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reportUpdates passes the notifications of the service's subscriptions, as work reporting
+// them, to nextOpsReport until the returned function is called
+func reportUpdates(svc *OPCUAService) (chan func(), func()) {
+	work := make(chan func())
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case items := <-svc.updates:
+				select {
+				case work <- func() { svc.report(items) }:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return work, func() { close(done) }
+}
+
+func TestOPCUAEndpoint(t *testing.T) {
+	assert.Equal(t, "opc.tcp://10.0.1.40:4840", opcuaEndpoint(common.ConnectionRecord{Endpoint: "10.0.1.40"}))
+	assert.Equal(t, "opc.tcp://plc:48010", opcuaEndpoint(common.ConnectionRecord{Endpoint: "plc", Port: 48010}))
+	assert.Equal(t, "opc.tcp://plc:4840/UA/Server", opcuaEndpoint(common.ConnectionRecord{Endpoint: "opc.tcp://plc:4840/UA/Server"}))
+}
+
+func TestOPCUAEntryValidation(t *testing.T) {
+	svc := &OPCUAService{connection: common.ConnectionRecord{Type: define.OPCUA, Endpoint: "plc"}}
+	for _, entries := range [][]common.OPCUAEntry{
+		nil,
+		{{NodeID: "i=85"}},
+		{{TagName: "Speed"}},
+		{{TagName: "Speed", NodeID: "ns=2"}},
+		{{TagName: "Speed", NodeID: "i=85"}, {TagName: "Speed", NodeID: "i=86"}},
+		{{TagName: "Speed", NodeID: "i=85", PollGroup: "fast"}},
+		{{TagName: "Speed", NodeID: "i=85", PollInterval: "soon"}},
+	} {
+		svc.entries = entries
+		assert.NotNil(t, svc.initBusIntegration(), entries)
+	}
+
+	intervals, err := samplingIntervals([]common.OPCUAEntry{{PollGroup: "fast"}, {PollInterval: "2s"}, {}},
+		[]common.PollGroup{{Name: "fast", Interval: "250ms"}, {Name: "default", Interval: "10s"}}, modbusSampleFrequency)
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{250 * time.Millisecond, 2 * time.Second, 10 * time.Second}, intervals)
+}
+
+func TestOPCUAReportsValuesAndChanges(t *testing.T) {
+	server, space := newStandinOPCUAServer(t, opcua.ServerConfig{AllowAnonymous: true})
+	defer server.Close()
+	svc := newTestOPCUAService(t, server, "", "")
+	reports := watchOpsReports()
+	updates, stop := reportUpdates(svc)
+	defer stop()
+	states := watchConnectionState(svc.Name)
+	assert.Nil(t, svc.connect())
+	defer svc.closeConnection()
+	assert.Equal(t, define.ConnectionConnected, (<-states).State)
+
+	// the initial read reports every tag, that whose browse path cannot be resolved as bad
+	report := nextOpsReport(t, reports, "LineCount", updates)
+	assert.Equal(t, common.TagValue{Value: 120.0, Unit: "m/min", Quality: define.QualityGood, Source: svc.Name}, report["LineSpeed"])
+	assert.Equal(t, "Running", report["LineState"].Value)
+	assert.Equal(t, define.QualityBad, report["LineCount"].Quality)
+	assert.NotEmpty(t, report["LineCount"].Error)
+
+	// changes are reported by the subscriptions
+	space.SetValue(opcua.NewStringNodeID(1, "Line1.Speed"), opcua.DataValue{Value: opcua.Variant{Value: int32(1500)}})
+	for {
+		report = nextOpsReport(t, reports, "LineSpeed", updates)
+		if report["LineSpeed"].Value == 150.0 {
+			break
+		}
+	}
+	space.SetValue(opcua.NewStringNodeID(1, "Line1.Speed"), opcua.DataValue{Value: opcua.Variant{Value: int32(1500)},
+		Status: opcua.StatusUncertainInitialValue})
+	report = nextOpsReport(t, reports, "LineSpeed", updates)
+	assert.Equal(t, define.QualityUncertain, report["LineSpeed"].Quality)
+	space.SetValue(opcua.NewStringNodeID(1, "Line1.Speed"), opcua.DataValue{Status: opcua.StatusBadNoCommunication})
+	report = nextOpsReport(t, reports, "LineSpeed", updates)
+	assert.Equal(t, define.QualityBad, report["LineSpeed"].Quality)
+	assert.Equal(t, 1, svc.diagnostics.Tags["LineCount"].Requests)
+}
+
+func TestOPCUAReconnectsAfterConnectionLoss(t *testing.T) {
+	server, _ := newStandinOPCUAServer(t, opcua.ServerConfig{Users: map[string]string{"operator": "secret"}})
+	svc := newTestOPCUAService(t, server, "operator", "secret")
+	reports := watchOpsReports()
+	updates, stop := reportUpdates(svc)
+	defer stop()
+	assert.Nil(t, svc.connect())
+	nextOpsReport(t, reports, "LineSpeed", updates)
+
+	// losing the connection reports the tags last read as stale
+	address := server.Addr().String()
+	server.Close()
+	select {
+	case <-svc.client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection loss not detected")
+	}
+	states := watchConnectionState(svc.Name)
+	svc.lose(svc.client.Err())
+	assert.Equal(t, define.ConnectionDisconnected, (<-states).State)
+	report := nextOpsReport(t, reports, "LineSpeed", updates)
+	assert.Equal(t, define.QualityStale, report["LineSpeed"].Quality)
+	assert.Equal(t, 120.0, report["LineSpeed"].Value)
+	assert.Equal(t, define.QualityBad, report["LineCount"].Quality)
+	assert.Equal(t, time.Duration(0), svc.untilReconnect(time.Now()))
+
+	// failed attempts back off
+	assert.NotNil(t, svc.connect())
+	assert.Equal(t, 1, svc.backoff.failures)
+	assert.True(t, svc.untilReconnect(time.Now()) > 0)
+
+	// a wrong password is refused
+	restarted, err := opcua.Listen(address, opcua.NewAddressSpace(), opcua.ServerConfig{Users: map[string]string{"operator": "other"}})
+	assert.Nil(t, err, "unable to listen")
+	defer restarted.Close()
+	svc.backoff.next = time.Time{}
+	err = svc.connect()
+	assert.NotNil(t, err)
+	assert.Nil(t, svc.client)
+	assert.Equal(t, 2, svc.backoff.failures)
+}
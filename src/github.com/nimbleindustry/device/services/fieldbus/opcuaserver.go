@@ -0,0 +1,421 @@
+package fieldbus
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/opcua"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	opcuaServerDefaultPort   = 4840
+	opcuaServerDefaultLocale = "en"
+	opcuaServerReportQueue   = 64
+)
+
+// opcuaUnits maps the symbols of common units to their UNECE common codes, which identify the
+// engineering units served. Other units are served by symbol only.
+var opcuaUnits = map[string]string{
+	"°C":    "CEL",
+	"°F":    "FAH",
+	"K":     "KEL",
+	"bar":   "BAR",
+	"mbar":  "MBR",
+	"Pa":    "PAL",
+	"kPa":   "KPA",
+	"psi":   "PS",
+	"%":     "P1",
+	"mm":    "MMT",
+	"m":     "MTR",
+	"m/s":   "MTS",
+	"m/min": "2X",
+	"km/h":  "KMH",
+	"ms":    "C26",
+	"s":     "SEC",
+	"min":   "MIN",
+	"h":     "HUR",
+	"g":     "GRM",
+	"kg":    "KGM",
+	"l":     "LTR",
+	"l/min": "L2",
+	"m³/h":  "MQH",
+	"mA":    "4K",
+	"A":     "AMP",
+	"V":     "VLT",
+	"W":     "WTT",
+	"kW":    "KWT",
+	"kWh":   "KWH",
+	"Hz":    "HTZ",
+	"rpm":   "RPM",
+	"N":     "NEU",
+	"Nm":    "NU",
+}
+
+// OPCUAServerService runs an embedded OPC UA server exposing the gateway to MES and SCADA
+// clients that browse rather than poll. The address space mirrors the asset config, with a
+// folder per level of the hierarchy (entity, location, line and work center) leading to the
+// machine, whose variables are every tag of the equipment config. The variables' values are
+// the latest reported by the fieldbus services.
+type OPCUAServerService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop      chan bool
+	config    *common.OPCUAServerConfig
+	asset     common.Asset
+	equipment common.Equipment
+	gateway   *opcuaGateway
+	server    *opcua.Server
+	values    map[string]common.TagValue // the latest value of each tag, served again after a reload
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *OPCUAServerService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	svc.reload()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	configs := common.BusChannel(define.ConnectivityConfigUpdated)
+	assets := common.BusChannel(define.AssetConfigUpdated)
+	equipment := common.BusChannel(define.EquipmentConfigUpdated)
+	// reports are held while a client is answered, fieldbus services polling at the same instant
+	reports := common.BufferedBusChannel(define.TopicOpsReport, opcuaServerReportQueue)
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.closeServer()
+			return
+		case <-configs:
+			svc.reload()
+		case <-assets:
+			svc.reload()
+		case <-equipment:
+			svc.reload()
+		case msg := <-reports:
+			svc.update(msg.(common.OpsReport))
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *OPCUAServerService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *OPCUAServerService) State() int {
+	return svc.ServiceState
+}
+
+// reload (re)starts the server if its configuration, or the asset or equipment config it
+// exposes, has changed, stopping it if its configuration has been removed. Clients must
+// reconnect to a restarted server.
+func (svc *OPCUAServerService) reload() {
+	config := common.ConnectionConfig.OPCUAServer
+	asset, equipment := common.AssetConfig, common.EquipmentConfig
+	if svc.server != nil && reflect.DeepEqual(config, svc.config) && reflect.DeepEqual(asset, svc.asset) &&
+		reflect.DeepEqual(equipment, svc.equipment) {
+		return
+	}
+	svc.closeServer()
+	svc.config, svc.asset, svc.equipment = config, asset, equipment
+	if config == nil {
+		svc.LogFunc(fmt.Sprintf("%s idles, no OPC UA server is configured", svc.Name))
+		return
+	}
+	if err := svc.start(*config, asset, equipment); err != nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: unable to start OPC UA server, %s", svc.Name, err))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s serves %d tags on %s", svc.Name, len(svc.gateway.variables), svc.server.Addr()))
+}
+
+// start builds the address space and begins listening for OPC UA clients
+func (svc *OPCUAServerService) start(config common.OPCUAServerConfig, asset common.Asset, equipment common.Equipment) error {
+	locale := config.Locale
+	if locale == "" {
+		locale = opcuaServerDefaultLocale
+	}
+	deviceID := common.ConnectionConfig.DeviceID
+	namespace := "urn:" + define.SystemName
+	if deviceID != "" {
+		namespace += ":" + deviceID
+	}
+	gateway, err := newOPCUAGateway(asset, equipment, namespace, locale)
+	if err != nil {
+		return err
+	}
+	port := config.Port
+	if port == 0 {
+		port = opcuaServerDefaultPort
+	}
+	serverConfig := opcua.ServerConfig{ApplicationName: define.SystemName, AllowAnonymous: config.Username == ""}
+	if deviceID != "" {
+		serverConfig.ApplicationName = deviceID
+	}
+	if config.Username != "" {
+		serverConfig.Users = map[string]string{config.Username: config.Password}
+	}
+	server, err := opcua.Listen(net.JoinHostPort(config.Endpoint, strconv.Itoa(port)), gateway.space, serverConfig)
+	if err != nil {
+		return err
+	}
+	gateway.update(svc.values)
+	svc.gateway, svc.server = gateway, server
+	return nil
+}
+
+func (svc *OPCUAServerService) closeServer() {
+	if svc.server != nil {
+		svc.server.Close()
+		svc.server, svc.gateway = nil, nil
+	}
+}
+
+// update stores the values of an ops report, serving them if the server is running
+func (svc *OPCUAServerService) update(report common.OpsReport) {
+	if svc.values == nil {
+		svc.values = make(map[string]common.TagValue)
+	}
+	for k, v := range report {
+		svc.values[k] = v
+	}
+	if svc.gateway != nil {
+		svc.gateway.update(report)
+	}
+}
+
+// opcuaGateway is the address space served by the OPCUAServerService. Its nodes are identified
+// by string ids in the gateway's namespace, being the path of browse names from the Objects
+// folder, e.g. "ns=1;s=Acme/Detroit/Line1/Press/M42/Speed".
+type opcuaGateway struct {
+	space     *opcua.AddressSpace
+	namespace uint16
+	variables map[string]opcua.NodeID // tag names to their variables
+}
+
+// gatewayTag is a tag exposed by the gateway
+type gatewayTag struct {
+	name string
+	unit string
+	desc common.MLMap
+}
+
+// gatewayTags returns every tag of the equipment config, those of the modbus devices, the
+// elements of EtherNet/IP arrays, the CAN signals and the MTConnect data items named as they
+// are reported. A tag defined more than once is returned once.
+func gatewayTags(integration common.MachineIntegration) ([]gatewayTag, error) {
+	entries, err := common.ExpandModbusDevices(integration.ModbusEntries, integration.ModbusDevices)
+	if err != nil {
+		return nil, err
+	}
+	var tags []gatewayTag
+	for _, v := range entries {
+		tags = append(tags, gatewayTag{name: v.RegisterName, unit: v.Unit, desc: v.Desc})
+	}
+	for _, v := range integration.OPCUAEntries {
+		tags = append(tags, gatewayTag{name: v.TagName, unit: v.Unit, desc: v.Desc})
+	}
+	for _, device := range integration.Serial {
+		for _, v := range device.Fields {
+			tags = append(tags, gatewayTag{name: v.TagName, unit: v.Unit, desc: v.Desc})
+		}
+	}
+	for _, v := range integration.EtherNetIPEntries {
+		for _, name := range v.ElementNames() {
+			tags = append(tags, gatewayTag{name: name, unit: v.Unit, desc: v.Desc})
+		}
+	}
+	for _, v := range integration.S7Entries {
+		tags = append(tags, gatewayTag{name: v.TagName, unit: v.Unit, desc: v.Desc})
+	}
+	if integration.CAN != nil {
+		database, err := loadCANDatabase(integration.CAN.DBCFile)
+		if err != nil {
+			return nil, err
+		}
+		signals, err := canTags(integration.CAN, database)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range signals {
+			tags = append(tags, gatewayTag{name: v.name, unit: v.signal.Unit, desc: v.desc})
+		}
+	}
+	if integration.MTConnect != nil {
+		for _, v := range integration.MTConnect.DataItems {
+			tags = append(tags, gatewayTag{name: v.ReportedName(), unit: v.Unit, desc: v.Desc})
+		}
+	}
+	names := make(map[string]bool, len(tags))
+	unique := tags[:0]
+	for _, v := range tags {
+		if v.name != "" && !names[v.name] {
+			names[v.name] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique, nil
+}
+
+// newOPCUAGateway builds the address space exposing the asset and the tags of its equipment,
+// in the namespace of the passed URI, with descriptions in the passed locale. Each variable
+// is bad (waiting for initial data) until its tag is first reported.
+func newOPCUAGateway(asset common.Asset, equipment common.Equipment, namespaceURI string, locale string) (*opcuaGateway, error) {
+	tags, err := gatewayTags(equipment.MachineIntegrations)
+	if err != nil {
+		return nil, err
+	}
+	g := &opcuaGateway{space: opcua.NewAddressSpace(), variables: make(map[string]opcua.NodeID, len(tags))}
+	g.namespace = g.space.AddNamespace(namespaceURI)
+
+	parent, path := opcua.NewNumericNodeID(0, opcua.ObjectObjectsFolder), ""
+	for _, name := range []string{asset.Entity, asset.Location, asset.Line, asset.WorkCenter} {
+		if name == "" {
+			continue
+		}
+		folder := g.node(path, name, opcua.NodeClassObject, opcua.ObjectTypeFolderType)
+		if err := g.add(parent, opcua.ReferenceTypeOrganizes, folder); err != nil {
+			return nil, err
+		}
+		parent, path = folder.ID, folder.ID.Identifier
+	}
+	name := asset.MachineID
+	if name == "" {
+		name = define.SystemName
+	}
+	machine := g.node(path, name, opcua.NodeClassObject, opcua.ObjectTypeBaseObjectType)
+	machine.Description = localizedText(equipment.Desc, locale)
+	if err := g.add(parent, opcua.ReferenceTypeOrganizes, machine); err != nil {
+		return nil, err
+	}
+	path = machine.ID.Identifier
+
+	for _, tag := range tags {
+		variable := g.node(path, tag.name, opcua.NodeClassVariable, opcua.VariableTypeBaseDataVariableType)
+		variable.Description = localizedText(tag.desc, locale)
+		variable.DataType = opcua.NewNumericNodeID(0, opcua.DataTypeBaseDataType)
+		variable.Value = opcua.DataValue{Status: opcua.StatusBadWaitingForInitialData}
+		if err := g.add(machine.ID, opcua.ReferenceTypeHasComponent, variable); err != nil {
+			return nil, err
+		}
+		if tag.unit != "" {
+			units := g.node(variable.ID.Identifier, "EngineeringUnits", opcua.NodeClassVariable,
+				opcua.VariableTypePropertyType)
+			units.BrowseName.NamespaceIndex = 0
+			units.DataType = opcua.NewNumericNodeID(0, opcua.DataTypeEUInformation)
+			units.Value = opcua.DataValue{Value: opcua.Variant{Value: opcua.NewExtensionObject(engineeringUnits(tag.unit))}}
+			if err := g.add(variable.ID, opcua.ReferenceTypeHasProperty, units); err != nil {
+				return nil, err
+			}
+		}
+		g.variables[tag.name] = variable.ID
+	}
+	return g, nil
+}
+
+// node returns a node of the gateway's namespace named name, below the node of the passed path
+func (g *opcuaGateway) node(path string, name string, class opcua.NodeClass, typeDefinition uint32) opcua.Node {
+	if path != "" {
+		path += "/"
+	}
+	return opcua.Node{ID: opcua.NewStringNodeID(g.namespace, path+name), Class: class,
+		BrowseName:     opcua.QualifiedName{NamespaceIndex: g.namespace, Name: name},
+		TypeDefinition: opcua.NewNumericNodeID(0, typeDefinition)}
+}
+
+func (g *opcuaGateway) add(parent opcua.NodeID, referenceType uint32, node opcua.Node) error {
+	return g.space.AddNode(parent, opcua.NewNumericNodeID(0, referenceType), node)
+}
+
+// update sets the values of the reported tags, ignoring those that are not exposed
+func (g *opcuaGateway) update(report common.OpsReport) {
+	for k, v := range report {
+		if id, found := g.variables[k]; found {
+			g.space.SetValue(id, opcuaDataValue(v))
+		}
+	}
+}
+
+// opcuaDataValue converts a tag value to a data value, its quality to the status; stale values
+// are served as the last usable value. Values of types that cannot be encoded become strings.
+func opcuaDataValue(tag common.TagValue) opcua.DataValue {
+	value := opcua.DataValue{Value: opcua.Variant{Value: tag.Value}}
+	if tag.Value != nil && value.Value.TypeID() == 0 {
+		value.Value.Value = fmt.Sprint(tag.Value)
+	}
+	switch tag.Quality {
+	case define.QualityGood:
+		value.Status = opcua.StatusGood
+	case define.QualityUncertain:
+		value.Status = opcua.StatusUncertain
+	case define.QualityStale:
+		value.Status = opcua.StatusUncertainLastUsableValue
+	default:
+		value.Status = opcua.StatusBad
+	}
+	return value
+}
+
+// engineeringUnits returns the EUInformation of a unit symbol, identified by its UNECE code if
+// it is a common unit
+func engineeringUnits(unit string) *opcua.EUInformation {
+	units := &opcua.EUInformation{NamespaceURI: opcua.UnitsNamespaceURI, UnitID: -1,
+		DisplayName: opcua.LocalizedText{Text: unit}, Description: opcua.LocalizedText{Text: unit}}
+	if code, found := opcuaUnits[unit]; found {
+		units.UnitID = opcua.CommonCodeUnitID(code)
+	}
+	return units
+}
+
+// localizedText returns the text of a multilingual description in the passed locale, falling
+// back to English and then to the first locale in alphabetical order
+func localizedText(desc common.MLMap, locale string) opcua.LocalizedText {
+	for _, v := range []string{locale, opcuaServerDefaultLocale} {
+		if text, found := desc[v]; found {
+			return opcua.LocalizedText{Locale: v, Text: text}
+		}
+	}
+	locales := make([]string, 0, len(desc))
+	for k := range desc {
+		locales = append(locales, k)
+	}
+	if len(locales) == 0 {
+		return opcua.LocalizedText{}
+	}
+	sort.Strings(locales)
+	return opcua.LocalizedText{Locale: locales[0], Text: desc[locales[0]]}
+}
@@ -0,0 +1,131 @@
+package fieldbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/opcua"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var opcuaGatewayAssetFixture = common.Asset{MachineID: "M42", Entity: "Acme", Location: "Detroit", Line: "Line1"}
+
+// opcuaGatewayEquipmentFixture defines modbus tags, including those of two drives, and an OPC UA tag
+var opcuaGatewayEquipmentFixture = common.Equipment{
+	Desc: common.MLMap{"en": "Press", "de": "Presse"},
+	MachineIntegrations: common.MachineIntegration{
+		ModbusDevices: []common.ModbusDevice{{Name: "drive1", UnitID: 1, TagGroup: "drive"},
+			{Name: "drive2", UnitID: 2, TagGroup: "drive"}},
+		ModbusEntries: []common.ModbusEntry{
+			{RegisterName: "Speed", Functions: []int{4}, TagGroup: "drive", Scaling: common.Scaling{Unit: "rpm"}},
+			{RegisterName: "LiquidTemp", Functions: []int{4}, Address: 2, Scaling: common.Scaling{Unit: "°C"},
+				Desc: common.MLMap{"en": "Liquid temperature", "de": "Flüssigkeitstemperatur"}},
+		},
+		OPCUAEntries: []common.OPCUAEntry{
+			{TagName: "Recipe", NodeID: "ns=2;s=Recipe", Desc: common.MLMap{"fr": "Recette", "es": "Receta"}},
+			{TagName: "LiquidTemp", NodeID: "ns=2;s=Temp"},
+		},
+	},
+}
+
+func TestOPCUAGatewayTags(t *testing.T) {
+	tags, err := gatewayTags(opcuaGatewayEquipmentFixture.MachineIntegrations)
+	assert.Nil(t, err)
+	var names []string
+	for _, v := range tags {
+		names = append(names, v.name)
+	}
+	assert.Equal(t, []string{"LiquidTemp", "drive1.Speed", "drive2.Speed", "Recipe"}, names)
+	assert.Equal(t, "rpm", tags[1].unit)
+
+	assert.Equal(t, opcua.LocalizedText{Locale: "de", Text: "Presse"}, localizedText(opcuaGatewayEquipmentFixture.Desc, "de"))
+	assert.Equal(t, opcua.LocalizedText{Locale: "en", Text: "Press"}, localizedText(opcuaGatewayEquipmentFixture.Desc, "it"))
+	assert.Equal(t, opcua.LocalizedText{Locale: "es", Text: "Receta"}, localizedText(common.MLMap{"fr": "Recette", "es": "Receta"}, "en"))
+	assert.Equal(t, opcua.LocalizedText{}, localizedText(nil, "en"))
+
+	assert.Equal(t, opcua.DataValue{Value: opcua.Variant{Value: 12.5}}, opcuaDataValue(common.TagValue{Value: 12.5, Quality: define.QualityGood}))
+	assert.Equal(t, opcua.DataValue{Value: opcua.Variant{Value: 12.5}, Status: opcua.StatusUncertainLastUsableValue},
+		opcuaDataValue(common.TagValue{Value: 12.5, Quality: define.QualityStale}))
+	assert.Equal(t, opcua.DataValue{Status: opcua.StatusBad}, opcuaDataValue(common.TagValue{Quality: define.QualityBad}))
+	assert.Equal(t, opcua.DataValue{Value: opcua.Variant{Value: "[1 true]"}, Status: opcua.StatusUncertain},
+		opcuaDataValue(common.TagValue{Value: []interface{}{1, true}, Quality: define.QualityUncertain}))
+
+	assert.Equal(t, opcua.CommonCodeUnitID("CEL"), engineeringUnits("°C").UnitID)
+	assert.Equal(t, int32(-1), engineeringUnits("widgets").UnitID)
+}
+
+func TestOPCUAServerServesTags(t *testing.T) {
+	svc := &OPCUAServerService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = define.OPCUAServerServiceName
+	// borrow a free port for the server
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	config := common.OPCUAServerConfig{Locale: "de"}
+	config.Endpoint, config.Port = "127.0.0.1", probe.Addr().(*net.TCPAddr).Port
+	config.Username, config.Password = "mes", "secret"
+	probe.Close()
+	// values reported before the server starts are served
+	svc.update(common.OpsReport{"drive1.Speed": {Value: 1450.0, Unit: "rpm", Quality: define.QualityGood}})
+	assert.Nil(t, svc.start(config, opcuaGatewayAssetFixture, opcuaGatewayEquipmentFixture))
+	defer svc.closeServer()
+
+	endpoint := "opc.tcp://" + svc.server.Addr().String()
+	_, err = opcua.Dial(endpoint, opcua.ClientConfig{Timeout: time.Second})
+	assert.NotNil(t, err, "expected an anonymous session to be refused")
+	client, err := opcua.Dial(endpoint, opcua.ClientConfig{Username: "mes", Password: "secret", Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	// the asset hierarchy leads to the machine, skipping the levels that are not configured
+	objects := opcua.NewNumericNodeID(0, opcua.ObjectObjectsFolder)
+	machine, err := client.ResolvePath(objects, []string{"1:Acme", "1:Detroit", "1:Line1", "1:M42"})
+	assert.Nil(t, err)
+	assert.Equal(t, opcua.NewStringNodeID(1, "Acme/Detroit/Line1/M42"), machine)
+	attributes, err := client.ReadAttributes([]opcua.NodeID{machine}, opcua.AttributeDescription)
+	assert.Nil(t, err)
+	assert.Equal(t, opcua.LocalizedText{Locale: "de", Text: "Presse"}, attributes[0].Value.Value)
+	references, err := client.Browse(machine, opcua.BrowseDirectionForward, opcua.NewNumericNodeID(0, opcua.ReferenceTypeHasComponent))
+	assert.Nil(t, err)
+	assert.Len(t, references, 4)
+
+	temp, err := client.ResolvePath(machine, []string{"1:LiquidTemp"})
+	assert.Nil(t, err)
+	attributes, err = client.ReadAttributes([]opcua.NodeID{temp}, opcua.AttributeDescription)
+	assert.Nil(t, err)
+	assert.Equal(t, opcua.LocalizedText{Locale: "de", Text: "Flüssigkeitstemperatur"}, attributes[0].Value.Value)
+	units, err := client.ResolvePath(temp, []string{"EngineeringUnits"})
+	assert.Nil(t, err)
+	values, err := client.Read([]opcua.NodeID{units})
+	assert.Nil(t, err)
+	assert.Equal(t, &opcua.EUInformation{NamespaceURI: opcua.UnitsNamespaceURI, UnitID: opcua.CommonCodeUnitID("CEL"),
+		DisplayName: opcua.LocalizedText{Text: "°C"}, Description: opcua.LocalizedText{Text: "°C"}},
+		values[0].Value.Value.(opcua.ExtensionObject).Value)
+
+	speed := opcua.NewStringNodeID(1, "Acme/Detroit/Line1/M42/drive1.Speed")
+	values, err = client.Read([]opcua.NodeID{speed, temp})
+	assert.Nil(t, err)
+	assert.Equal(t, 1450.0, values[0].Value.Value)
+	assert.Equal(t, opcua.StatusBadWaitingForInitialData, values[1].Status)
+
+	// reported values update the variables and are notified to monitored items
+	subscription, err := client.Subscribe(50 * time.Millisecond)
+	assert.Nil(t, err)
+	_, err = subscription.Monitor([]opcua.MonitoredItem{{NodeID: temp, Handle: 1}})
+	assert.Nil(t, err)
+	svc.update(common.OpsReport{"LiquidTemp": {Value: 71.5, Unit: "°C", Quality: define.QualityGood},
+		"Unknown": {Value: 1, Quality: define.QualityGood}})
+	deadline := time.After(2 * time.Second)
+	for done := false; !done; {
+		select {
+		case notifications := <-subscription.Notifications:
+			last := notifications[len(notifications)-1].Value
+			done = last.Status == opcua.StatusGood && last.Value.Value == 71.5
+		case <-deadline:
+			t.Fatal("no notification of the reported value")
+		}
+	}
+}
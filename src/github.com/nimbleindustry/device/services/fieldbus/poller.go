@@ -0,0 +1,217 @@
+package fieldbus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+)
+
+// pollDriver is the protocol over which a poller reads and writes the tags of a device,
+// implemented by the service polling it
+type pollDriver interface {
+	dial(address string) (pollConnection, error)              // connects to the device
+	read(members []int) (common.OpsReport, error)             // reads the entries of the passed indexes
+	tagsOf(i int) (names []string, unit string)               // the tags reported for the entry of the index
+	exchangeTag(cmd common.WriteCommand) (interface{}, error) // writes the command's value, returning any value read back
+}
+
+// pollConnection is the connection to a device
+type pollConnection interface {
+	Err() error // the error that failed the connection, nil while it is open
+	Close() error
+}
+
+// poller polls the tags of a device, such as a PLC or modbus slave, in poll groups over a
+// connection held open between polls and re-established with exponential backoff once lost.
+// Its driver speaks the device's protocol.
+type poller struct {
+	name    string // of the service polling the device
+	device  string // what the device is, for logging, e.g. S7 PLC
+	logFunc func(string)
+	driver  pollDriver
+
+	address    string
+	schedule   *pollSchedule
+	conn       pollConnection
+	lastValues map[string]common.TagValue // last value of each tag, for stale reporting
+	fieldbusMonitor
+}
+
+// setup readies the poller to poll on behalf of the named service, restarting its backoff
+func (p *poller) setup(name string, device string, logFunc func(string), driver pollDriver) {
+	p.name, p.device, p.logFunc, p.driver = name, device, logFunc, driver
+	p.backoff = reconnectBackoff{min: fieldbusReconnectMinDelay, max: fieldbusReconnectMaxDelay}
+}
+
+// poll reads every poll group that is now due, connecting first if need be. An error is
+// returned only once reconnecting has failed too often to continue.
+func (p *poller) poll() error {
+	if len(p.schedule.due(time.Now())) == 0 {
+		return nil
+	}
+	if err := p.connect(); err != nil {
+		p.skipDueGroups(err)
+		if p.backoff.exhausted(fieldbusReconnectAttempts) {
+			p.publishState(p.name, p.address, define.ConnectionFailed, err)
+			return err
+		}
+		return nil
+	}
+	if err := p.pollDueGroups(); err != nil {
+		p.logFunc(fmt.Sprintf("%s warns: error reading tags: %s", p.name, err))
+		p.checkConnection(err)
+	}
+	return nil
+}
+
+// connect establishes the connection if it is not already, honoring the reconnect backoff
+func (p *poller) connect() error {
+	if p.conn != nil {
+		return nil
+	}
+	now := time.Now()
+	if !p.backoff.ready(now) {
+		return fmt.Errorf("reconnect to %s deferred for %s", p.address, p.backoff.next.Sub(now))
+	}
+	conn, err := p.driver.dial(p.address)
+	if err != nil {
+		delay := p.backoff.failed(now)
+		p.logFunc(fmt.Sprintf("%s warns: unable to connect to %s %s, retrying in %s: %s", p.name, p.device, p.address, delay, err))
+		p.publishState(p.name, p.address, define.ConnectionDisconnected, err)
+		return err
+	}
+	p.conn = conn
+	p.backoff.succeeded()
+	p.countConnect()
+	p.logFunc(fmt.Sprintf("%s establishes connection to %s %s", p.name, p.device, p.address))
+	p.publishState(p.name, p.address, define.ConnectionConnected, nil)
+	return nil
+}
+
+// checkConnection reports the loss of the connection should the passed error have failed it
+func (p *poller) checkConnection(err error) {
+	if p.conn == nil || p.conn.Err() == nil {
+		return
+	}
+	p.conn = nil
+	p.logFunc(fmt.Sprintf("%s loses connection to %s %s: %s", p.name, p.device, p.address, err))
+	p.publishState(p.name, p.address, define.ConnectionDisconnected, err)
+}
+
+// pollDueGroups reads every poll group that is now due and sends its values on TopicOpsReport.
+// Groups that overran their interval are logged and reported on TopicPollOverrun. Should
+// communication with the device fail the tags not read, and the remaining groups, are
+// reported stale, and the error returned.
+func (p *poller) pollDueGroups() error {
+	var failure error
+	for _, group := range p.schedule.due(time.Now()) {
+		if failure != nil {
+			sendOpsReport(p.name, p.staleReport(group.members, failure))
+			p.schedule.skip(group, time.Now())
+			continue
+		}
+		m, err := p.driver.read(group.members)
+		if err != nil {
+			failure = err
+			stale := p.staleReport(group.members, err)
+			for name, v := range m {
+				stale[name] = v
+			}
+			m = stale
+		}
+		sendOpsReport(p.name, m)
+		if overrun := p.schedule.complete(group, time.Now()); overrun != nil {
+			overrun.Service = p.name
+			p.logFunc(fmt.Sprintf("%s warns: poll group %s overran its %s interval by %s, %d cycle(s) missed",
+				p.name, group.name, group.interval, overrun.Elapsed-group.interval, overrun.Missed))
+			common.SendBusMessage(define.TopicPollOverrun, overrun)
+		}
+	}
+	return failure
+}
+
+// skipDueGroups reschedules every poll group that is now due without reading it, reporting
+// the group's tags as stale for the passed reason
+func (p *poller) skipDueGroups(reason error) {
+	now := time.Now()
+	for _, group := range p.schedule.due(now) {
+		sendOpsReport(p.name, p.staleReport(group.members, reason))
+		p.schedule.skip(group, now)
+	}
+}
+
+// tagValue converts a value read to engineering units, remembering it for stale reporting
+func (p *poller) tagValue(name string, scaling common.Scaling, value interface{}) common.TagValue {
+	tag := scaledValue(name, scaling, value)
+	if p.lastValues == nil {
+		p.lastValues = make(map[string]common.TagValue)
+	}
+	if tag.Quality != define.QualityBad {
+		p.lastValues[name] = tag
+	}
+	return tag
+}
+
+// staleReport reports the tags of the entries of the passed indexes as stale, carrying their
+// last values forward, or bad if they have none
+func (p *poller) staleReport(members []int, reason error) common.OpsReport {
+	m := make(common.OpsReport)
+	for _, i := range members {
+		names, unit := p.driver.tagsOf(i)
+		for _, name := range names {
+			last, found := p.lastValues[name]
+			if !found {
+				m[name] = common.TagValue{Unit: unit, Quality: define.QualityBad, Error: reason.Error()}
+				continue
+			}
+			m[name] = common.TagValue{Value: last.Value, Unit: unit, Quality: define.QualityStale, Error: reason.Error()}
+		}
+	}
+	return m
+}
+
+// write executes a write command and acknowledges it on TopicWriteAck
+func (p *poller) write(cmd common.WriteCommand) {
+	ack := p.executeWrite(cmd)
+	if ack.Success {
+		p.logFunc(fmt.Sprintf("%s writes %v to %s", p.name, cmd.Value, cmd.Tag))
+	} else {
+		p.logFunc(fmt.Sprintf("%s warns: write of %v to %s failed, %s", p.name, cmd.Value, cmd.Tag, ack.Error))
+	}
+	common.SendBusMessage(define.TopicWriteAck, ack)
+}
+
+// executeWrite performs the write command and returns the acknowledgement to be sent on
+// TopicWriteAck
+func (p *poller) executeWrite(cmd common.WriteCommand) *common.WriteAck {
+	ack := &common.WriteAck{ID: cmd.ID, Service: p.name, Tag: cmd.Tag, Success: true}
+	err := p.connect()
+	if err == nil {
+		if ack.Value, err = p.driver.exchangeTag(cmd); err != nil {
+			p.checkConnection(err)
+		}
+	}
+	if err != nil {
+		ack.Success = false
+		ack.Error = err.Error()
+	}
+	ack.Timestamp = time.Now()
+	return ack
+}
+
+// closeConnection closes the connection, if open
+func (p *poller) closeConnection() (err error) {
+	if p.conn != nil {
+		err = p.conn.Close()
+		p.conn = nil
+		if err != nil {
+			p.logFunc(fmt.Sprintf("%s reports error disconnecting from %s %s, %s", p.name, p.device, p.address, err))
+		} else {
+			p.logFunc(fmt.Sprintf("%s disconnects from %s %s", p.name, p.device, p.address))
+		}
+		p.publishState(p.name, p.address, define.ConnectionDisconnected, nil)
+	}
+	return
+}
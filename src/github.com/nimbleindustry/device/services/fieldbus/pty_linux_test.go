@@ -0,0 +1,70 @@
+package fieldbus
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// openPty allocates a pseudo-terminal pair, returning the master side and the path of the
+// slave side. The slave path can be opened as if it were a serial port.
+func openPty() (master *os.File, slavePath string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return
+	}
+	var ptyNumber uint32
+	if err = ptyIoctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNumber))); err != nil {
+		master.Close()
+		return
+	}
+	var unlock int32
+	if err = ptyIoctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return
+	}
+	slavePath = fmt.Sprintf("/dev/pts/%d", ptyNumber)
+	return
+}
+
+func ptyIoctl(fd, request, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// piecemealWriter writes each frame in pieces of a few bytes, pausing between them, as a slave
+// on a slow line or behind a buffering converter delivers its responses
+type piecemealWriter struct {
+	w io.Writer
+}
+
+func (p piecemealWriter) Write(b []byte) (int, error) {
+	for n := 0; n < len(b); n += 5 {
+		if n > 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		end := n + 5
+		if end > len(b) {
+			end = len(b)
+		}
+		if _, err := p.w.Write(b[n:end]); err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
+
+// servePiecemeal serves the slave on the master side of a pseudo-terminal, writing its
+// responses piecemeal
+func servePiecemeal(master *os.File, slave ModbusHandler) {
+	ServeModbusRTU(struct {
+		io.Reader
+		io.Writer
+	}{master, piecemealWriter{master}}, slave)
+}
@@ -0,0 +1,87 @@
+package fieldbus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagValueQuality(t *testing.T) {
+	max := 100.0
+	entry := common.ModbusEntry{RegisterName: "Level", Scaling: common.Scaling{Multiplier: 0.1, Max: &max, Unit: "%"}}
+	value := tagValue(entry, int16(500))
+	assert.Equal(t, define.QualityGood, value.Quality)
+	assert.Empty(t, value.Error)
+
+	value = tagValue(entry, int16(1200))
+	assert.Equal(t, define.QualityUncertain, value.Quality, "expected clamped value to be uncertain")
+	assert.Equal(t, 100.0, value.Value)
+	assert.NotEmpty(t, value.Error)
+
+	value = tagValue(common.ModbusEntry{RegisterName: "Flow", DataType: common.DataTypeFloat32}, float32(math.NaN()))
+	assert.Equal(t, define.QualityBad, value.Quality, "expected NaN to be bad")
+	assert.Nil(t, value.Value)
+}
+
+func TestPartialReadIsolatesBadAddress(t *testing.T) {
+	slave := newStandinSlave(1)
+	slave.holdingRegisters[0] = 7
+	slave.inputRegisters[1] = 9
+	svc := &GenericModbusService{client: modbusClient(slave)}
+	svc.connection.MaxReadGap = 200
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "SystemRun", Functions: []int{3}, Address: 0},
+		{RegisterName: "Missing", Functions: []int{3}, Address: 100},
+		{RegisterName: "LiquidTemp", Functions: []int{4}, Address: 1},
+	}
+	assert.Nil(t, svc.initBusIntegration())
+
+	m, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err, "expected device exceptions not to fail the poll")
+	assert.Equal(t, 3, len(m))
+	assert.Equal(t, common.TagValue{Value: int16(7), Quality: define.QualityGood}, m["SystemRun"])
+	assert.Equal(t, common.TagValue{Value: int16(9), Quality: define.QualityGood}, m["LiquidTemp"])
+	assert.Equal(t, define.QualityBad, m["Missing"].Quality)
+	assert.Nil(t, m["Missing"].Value)
+	assert.Contains(t, m["Missing"].Error, "Error reading holding registers 100-100")
+	// the coalesced block, then each of its entries, then the input register
+	assert.Equal(t, 4, slave.Requests())
+}
+
+func TestStaleValuesAfterCommunicationFailure(t *testing.T) {
+	slave := newStandinSlave(1)
+	slave.inputRegisters[0] = 215
+	server, err := listenStandin(slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	assert.Nil(t, svc.connect())
+	reports := watchOpsReports()
+	svc.schedule.groups[0].next = time.Now()
+	assert.Nil(t, svc.pollDueGroups())
+	m := nextOpsReport(t, reports, "LiquidTemp", nil)
+	assert.Equal(t, define.QualityGood, m["LiquidTemp"].Quality)
+
+	waitForAccepts(server, 1)
+	server.DropConnections()
+	svc.schedule.groups[0].next = time.Now()
+	err = svc.pollDueGroups()
+	assert.NotNil(t, err, "expected communication failure to be returned")
+	m = nextOpsReport(t, reports, "LiquidTemp", nil)
+	assert.Equal(t, 2, len(m), "expected every tag to be reported")
+	assert.Equal(t, define.QualityStale, m["SystemRun"].Quality)
+	assert.Equal(t, define.QualityStale, m["LiquidTemp"].Quality)
+	assert.Equal(t, int16(215), m["LiquidTemp"].Value, "expected last value to be carried forward")
+	assert.NotEmpty(t, m["LiquidTemp"].Error)
+
+	delete(svc.lastValues, "SystemRun")
+	never := svc.staleReport(svc.schedule.groups[0].members, err)["SystemRun"]
+	assert.Equal(t, define.QualityBad, never.Quality, "expected tag without a last value to be bad")
+}
@@ -0,0 +1,101 @@
+package fieldbus
+
+import (
+	"sort"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+)
+
+// Protocol limits on the quantity of a single read request
+const (
+	modbusMaxReadBits      = 2000
+	modbusMaxReadRegisters = 125
+)
+
+// readBlock is a single modbus read request that covers one or more ModbusEntry's
+type readBlock struct {
+	function int
+	unitID   int // zero for the connection's unit ID
+	address  int
+	quantity int
+	entries  []common.ModbusEntry
+}
+
+// offset returns the position of the supplied entry within the block, in bits or registers
+func (block readBlock) offset(entry common.ModbusEntry) int {
+	return entry.Address - block.address
+}
+
+// maxReadQuantity returns the largest quantity a single request of the passed function may read
+func maxReadQuantity(function int) int {
+	switch function {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		return modbusMaxReadBits
+	}
+	return modbusMaxReadRegisters
+}
+
+// entryQuantity returns the number of bits or registers the entry occupies when read with the
+// passed function
+func entryQuantity(function int, entry common.ModbusEntry) int {
+	switch function {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		return 1
+	case modbus.FuncCodeReadFIFOQueue:
+		// the FIFO pointer address
+		return 1
+	}
+	return entry.RegisterCount()
+}
+
+type entriesByAddress []common.ModbusEntry
+
+func (e entriesByAddress) Len() int           { return len(e) }
+func (e entriesByAddress) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesByAddress) Less(i, j int) bool { return e[i].Address < e[j].Address }
+
+// planReads groups the supplied entries, all read with the passed function, into as few block
+// reads as possible. Entries are merged into a block when the unused addresses between them
+// do not exceed maxGap and the block stays within the protocol's quantity limit. FIFO queues
+// and file records are not tables, each of their entries is read on its own.
+func planReads(function int, entries []common.ModbusEntry, maxGap int) (blocks []readBlock) {
+	if len(entries) == 0 {
+		return
+	}
+	if function == modbus.FuncCodeReadFIFOQueue || function == modbusFuncCodeReadFileRecord {
+		for _, entry := range entries {
+			blocks = append(blocks, readBlock{function: function, address: entry.Address,
+				quantity: entryQuantity(function, entry), entries: []common.ModbusEntry{entry}})
+		}
+		return
+	}
+	if maxGap < 0 {
+		maxGap = 0
+	}
+	sorted := make([]common.ModbusEntry, len(entries))
+	copy(sorted, entries)
+	sort.Stable(entriesByAddress(sorted))
+
+	limit := maxReadQuantity(function)
+	var block *readBlock
+	for _, entry := range sorted {
+		end := entry.Address + entryQuantity(function, entry)
+		if block != nil {
+			blockEnd := block.address + block.quantity
+			if entry.Address-blockEnd <= maxGap && end-block.address <= limit {
+				if end > blockEnd {
+					block.quantity = end - block.address
+				}
+				block.entries = append(block.entries, entry)
+				continue
+			}
+			blocks = append(blocks, *block)
+		}
+		block = &readBlock{function: function, address: entry.Address, quantity: end - entry.Address,
+			entries: []common.ModbusEntry{entry}}
+	}
+	blocks = append(blocks, *block)
+	return
+}
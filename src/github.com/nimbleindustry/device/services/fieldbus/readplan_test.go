@@ -0,0 +1,90 @@
+package fieldbus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func entriesAt(addresses ...int) (entries []common.ModbusEntry) {
+	for _, address := range addresses {
+		entries = append(entries, common.ModbusEntry{RegisterName: fmt.Sprintf("R%d", address), Address: address})
+	}
+	return
+}
+
+func TestPlanReadsContiguous(t *testing.T) {
+	blocks := planReads(modbus.FuncCodeReadHoldingRegisters, entriesAt(3, 1, 2, 0), 0)
+	assert.Equal(t, 1, len(blocks), "expected contiguous registers to coalesce into one block")
+	assert.Equal(t, 0, blocks[0].address)
+	assert.Equal(t, 4, blocks[0].quantity)
+	assert.Equal(t, 4, len(blocks[0].entries))
+	assert.Equal(t, 2, blocks[0].offset(blocks[0].entries[2]))
+}
+
+func TestPlanReadsGapTolerance(t *testing.T) {
+	entries := entriesAt(0, 1, 5, 20)
+	blocks := planReads(modbus.FuncCodeReadInputRegisters, entries, 0)
+	assert.Equal(t, 3, len(blocks), "expected gaps to split blocks when no tolerance is configured")
+
+	blocks = planReads(modbus.FuncCodeReadInputRegisters, entries, 3)
+	assert.Equal(t, 2, len(blocks), "expected a gap of 3 to be bridged")
+	assert.Equal(t, 0, blocks[0].address)
+	assert.Equal(t, 6, blocks[0].quantity)
+	assert.Equal(t, 20, blocks[1].address)
+	assert.Equal(t, 1, blocks[1].quantity)
+}
+
+func TestPlanReadsProtocolLimits(t *testing.T) {
+	var addresses []int
+	for i := 0; i < 300; i++ {
+		addresses = append(addresses, i)
+	}
+	blocks := planReads(modbus.FuncCodeReadHoldingRegisters, entriesAt(addresses...), 0)
+	assert.Equal(t, 3, len(blocks), "expected 300 registers to need 3 requests")
+	assert.Equal(t, 125, blocks[0].quantity)
+	assert.Equal(t, 125, blocks[1].address)
+	assert.Equal(t, 50, blocks[2].quantity)
+
+	blocks = planReads(modbus.FuncCodeReadCoils, entriesAt(addresses...), 0)
+	assert.Equal(t, 1, len(blocks), "expected 300 coils to fit in a single request")
+
+	blocks = planReads(modbus.FuncCodeReadCoils, entriesAt(0, 1999, 2000), 2000)
+	assert.Equal(t, 2, len(blocks), "expected coil block to be capped at 2000 bits")
+	assert.Equal(t, 2000, blocks[0].quantity)
+}
+
+func TestPlanReadsDuplicateAddresses(t *testing.T) {
+	entries := []common.ModbusEntry{{RegisterName: "A", Address: 4}, {RegisterName: "B", Address: 4}}
+	blocks := planReads(modbus.FuncCodeReadCoils, entries, 0)
+	assert.Equal(t, 1, len(blocks))
+	assert.Equal(t, 1, blocks[0].quantity)
+	assert.Equal(t, 2, len(blocks[0].entries))
+}
+
+func TestBitAndRegisterExtraction(t *testing.T) {
+	bits := []byte{0x05, 0x80}
+	for offset, expected := range map[int]byte{0: 1, 1: 0, 2: 1, 15: 1} {
+		bit, err := bitAt(bits, offset)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, bit, "bit %d", offset)
+	}
+	registers := []byte{0x00, 0x01, 0xFF, 0xF6}
+	b, err := registersAt(registers, 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int16(-10), BytesToInt16(b))
+
+	// short responses are rejected rather than sliced
+	if _, err = bitAt(bits, 16); assert.NotNil(t, err) {
+		assert.Equal(t, "response of 2 bytes holds no bit 16", err.Error())
+	}
+	if _, err = registersAt(registers, 1, 2); assert.NotNil(t, err) {
+		assert.Equal(t, "response of 4 bytes holds no registers 1-2", err.Error())
+	}
+	_, err = registersAt(registers[:3], 1, 1)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,281 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/s7"
+
+	"github.com/nimbleindustry/suture"
+)
+
+const s7Timeout = 5 * time.Second
+
+// S7Service provides access to the data blocks, bit memory, inputs and outputs of a Siemens
+// S7-300, S7-400, S7-1200 or S7-1500 PLC, as defined by the s7 entries of the equipment config,
+// using S7comm over ISO-on-TCP. The values of each poll group are read together, in as few
+// jobs as the negotiated PDU size allows. The connection record's endpoint is the host of the
+// PLC, the port defaulting to 102, and its rack and slot locate the CPU. The connection is held
+// open between polls; when it is lost it is re-established with exponential backoff, the
+// service exiting (to be restarted by its supervisor) only after repeated failures.
+type S7Service struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop       chan bool
+	connection common.ConnectionRecord
+	entries    []common.S7Entry
+	pollGroups []common.PollGroup
+	addresses  []s7.Address // the parsed address of each entry
+	poller
+}
+
+// NewS7Service returns a service for the PLC of the passed connection record, named for the
+// record
+func NewS7Service(record common.ConnectionRecord, logFunc func(string), startDelay time.Duration) *S7Service {
+	svc := &S7Service{LogFunc: logFunc, StartDelay: startDelay}
+	svc.Name = connectionKey(record)
+	svc.connection = record
+	return svc
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *S7Service) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	configErr := svc.initConfigurations()
+	fieldBusErr := svc.initBusIntegration()
+	if fieldBusErr != nil && configErr == nil {
+		svc.LogFunc(fmt.Sprintf("%s warns: %s", svc.Name, fieldBusErr))
+	}
+	if configErr != nil || fieldBusErr != nil {
+		// configurations not set for s7, we should wait for config update messages
+		svc.LogFunc(fmt.Sprintf("%s exits awaiting configuration updates", svc.Name))
+		return
+	}
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	writes := writeRoutes.register(svc.Name, svc.writableTags())
+	defer writeRoutes.unregister(svc.Name, writes)
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.clean()
+			return
+		case cmd := <-writes:
+			svc.write(cmd)
+		case <-diagnostics.C:
+			svc.publishDiagnostics(svc.Name, svc.address)
+		case <-time.After(svc.schedule.untilNext(time.Now())):
+			// read the values of each poll group that is due
+			if err := svc.poll(); err != nil {
+				// reconnecting in place has not worked, force supervisor recovery
+				svc.LogFunc(fmt.Sprintf("%s exits after %d failed connection attempts: %s", svc.Name, svc.backoff.failures, err))
+				svc.ServiceState = suture.ServiceNotRunning
+				return
+			}
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *S7Service) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *S7Service) State() int {
+	return svc.ServiceState
+}
+
+func (svc *S7Service) clean() {
+	svc.closeConnection()
+}
+
+func (svc *S7Service) initConfigurations() error {
+	if common.ConnectionConfig.DeviceID == "" {
+		return errors.New("Connection config object not initialized")
+	}
+	if common.EquipmentConfig.Ref == "" {
+		return errors.New("Equipment config object not initialized")
+	}
+	svc.entries = common.EquipmentConfig.MachineIntegrations.S7Entries
+	svc.pollGroups = common.EquipmentConfig.MachineIntegrations.PollGroups
+	return nil
+}
+
+// initBusIntegration validates the entries, parsing their addresses and assigning them to
+// poll groups
+func (svc *S7Service) initBusIntegration() error {
+	if svc.connection.Type == "" {
+		return errors.New("No S7 connection records")
+	}
+	if len(svc.entries) == 0 {
+		return errors.New("No s7 entries")
+	}
+	port := svc.connection.Port
+	if port == 0 {
+		port = s7.DefaultPort
+	}
+	svc.address = net.JoinHostPort(svc.connection.Endpoint, strconv.Itoa(port))
+	svc.addresses = make([]s7.Address, len(svc.entries))
+	scheduled := make([]scheduledTag, len(svc.entries))
+	names := make(map[string]bool, len(svc.entries))
+	for i, v := range svc.entries {
+		if v.TagName == "" {
+			return fmt.Errorf("s7 entry %d has no tagName", i)
+		}
+		if names[v.TagName] {
+			return fmt.Errorf("%s is defined more than once", v.TagName)
+		}
+		names[v.TagName] = true
+		address, err := s7.ParseAddress(v.Address, v.DataType)
+		if err != nil {
+			return fmt.Errorf("%s %s", v.TagName, err)
+		}
+		svc.addresses[i] = address
+		scheduled[i] = scheduledTag{name: v.TagName, pollGroup: v.PollGroup, pollInterval: v.PollInterval}
+	}
+	schedule, err := newTagSchedule(scheduled, svc.pollGroups, modbusSampleFrequency, time.Now())
+	if err != nil {
+		return err
+	}
+	svc.schedule = schedule
+	svc.setup(svc.Name, "S7 PLC", svc.LogFunc, svc)
+	return nil
+}
+
+// dial connects to the PLC at the passed address
+func (svc *S7Service) dial(address string) (pollConnection, error) {
+	client, err := s7.Dial(address, s7.ClientConfig{Timeout: s7Timeout, Rack: svc.connection.Rack, Slot: svc.connection.Slot})
+	if err != nil {
+		return nil, err
+	}
+	svc.LogFunc(fmt.Sprintf("%s negotiates PDU size %d with S7 PLC %s", svc.Name, client.PDUSize(), address))
+	return client, nil
+}
+
+// read reads the entries of the passed indexes. Every entry appears in the returned report,
+// those the PLC could not read with a bad quality. An error is returned only if communication
+// with the PLC failed.
+func (svc *S7Service) read(members []int) (common.OpsReport, error) {
+	addresses := make([]s7.Address, len(members))
+	for j, i := range members {
+		addresses[j] = svc.addresses[i]
+	}
+	start := time.Now()
+	results, err := svc.conn.(*s7.Client).Read(addresses)
+	svc.diagnostics.Latency.Add(time.Since(start))
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	if err != nil {
+		for _, i := range members {
+			svc.count(svc.entries[i].TagName, err)
+		}
+		return nil, err
+	}
+	m := make(common.OpsReport)
+	for j, i := range members {
+		entry := svc.entries[i]
+		svc.count(entry.TagName, results[j].Err)
+		if results[j].Err != nil {
+			m[entry.TagName] = common.TagValue{Unit: entry.Unit, Quality: define.QualityBad,
+				Error: fmt.Sprintf("%s %s", entry.Address, results[j].Err)}
+			continue
+		}
+		m[entry.TagName] = svc.tagValue(entry.TagName, entry.Scaling, results[j].Value)
+	}
+	return m, nil
+}
+
+// tagsOf returns the tag reported for the entry of the passed index, and its unit
+func (svc *S7Service) tagsOf(i int) ([]string, string) {
+	return []string{svc.entries[i].TagName}, svc.entries[i].Unit
+}
+
+// writableTags returns the names of the service's writable tags
+func (svc *S7Service) writableTags() []string {
+	var tags []string
+	for _, v := range svc.entries {
+		if v.Writable {
+			tags = append(tags, v.TagName)
+		}
+	}
+	return tags
+}
+
+// exchangeTag writes the command's value, nothing being read back
+func (svc *S7Service) exchangeTag(cmd common.WriteCommand) (interface{}, error) {
+	return nil, svc.writeTag(cmd)
+}
+
+// writeTag writes the command's value, converted from engineering units, to the entry's
+// address
+func (svc *S7Service) writeTag(cmd common.WriteCommand) error {
+	i := -1
+	for j, v := range svc.entries {
+		if v.TagName == cmd.Tag {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("%s is not a configured tag", cmd.Tag)
+	}
+	entry, address := svc.entries[i], svc.addresses[i]
+	if !entry.Writable {
+		return fmt.Errorf("%s is not writable", cmd.Tag)
+	}
+	value := cmd.Value
+	if entry.IsScaled() {
+		f, err := toFloat64(value)
+		if err != nil {
+			return fmt.Errorf("%s expects a number, got %v", cmd.Tag, value)
+		}
+		raw := entry.Raw(f)
+		if address.Type != s7.REAL {
+			raw = math.Floor(raw + 0.5)
+		}
+		value = raw
+	}
+	start := time.Now()
+	err := svc.conn.(*s7.Client).Write(address, value)
+	svc.diagnostics.Latency.Add(time.Since(start))
+	countOutcome(&svc.diagnostics.FieldbusCounters, err)
+	svc.count(entry.TagName, err)
+	if err != nil {
+		return fmt.Errorf("Error writing %s, %s", entry.Address, err)
+	}
+	return nil
+}
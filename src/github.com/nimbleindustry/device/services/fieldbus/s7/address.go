@@ -0,0 +1,302 @@
+package s7
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Area is a memory area of the CPU, as coded by S7comm
+type Area byte
+
+// Memory areas
+const (
+	AreaI  Area = 0x81 // process image of the inputs
+	AreaQ  Area = 0x82 // process image of the outputs
+	AreaM  Area = 0x83 // bit memory (flags)
+	AreaDB Area = 0x84 // data blocks
+)
+
+func (a Area) String() string {
+	switch a {
+	case AreaI:
+		return "I"
+	case AreaQ:
+		return "Q"
+	case AreaM:
+		return "M"
+	case AreaDB:
+		return "DB"
+	}
+	return fmt.Sprintf("area 0x%02X", byte(a))
+}
+
+// DataType is the type of the value at an address
+type DataType byte
+
+// Data types, each of the size of one of the address widths: bit, byte, word or double word
+const (
+	BOOL DataType = iota + 1
+	BYTE
+	SINT
+	USINT
+	WORD
+	INT
+	UINT
+	DWORD
+	DINT
+	UDINT
+	REAL
+)
+
+var typeNames = map[DataType]string{
+	BOOL: "BOOL", BYTE: "BYTE", SINT: "SINT", USINT: "USINT", WORD: "WORD", INT: "INT",
+	UINT: "UINT", DWORD: "DWORD", DINT: "DINT", UDINT: "UDINT", REAL: "REAL",
+}
+
+func (t DataType) String() string {
+	if name, found := typeNames[t]; found {
+		return name
+	}
+	return fmt.Sprintf("type %d", byte(t))
+}
+
+// Size returns the size in bytes of a value of the type, 0 for BOOL which is a single bit
+func (t DataType) Size() int {
+	switch t {
+	case BYTE, SINT, USINT:
+		return 1
+	case WORD, INT, UINT:
+		return 2
+	case DWORD, DINT, UDINT, REAL:
+		return 4
+	}
+	return 0
+}
+
+// ParseDataType returns the type of the passed name, e.g. "REAL", in any case
+func ParseDataType(name string) (DataType, error) {
+	for t, v := range typeNames {
+		if strings.EqualFold(v, name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown data type %q", name)
+}
+
+// Address locates a value in a memory area of the CPU: the bit or the first byte of the
+// value, whose type gives its size
+type Address struct {
+	Area  Area
+	DB    int // the number of the data block, of AreaDB
+	Start int // the offset in bytes
+	Bit   int // the bit of the byte, of BOOL values
+	Type  DataType
+}
+
+var addressPattern = regexp.MustCompile(`^(?:DB(\d+)\.DB([XBWD])|([IEQAM])([XBWD]?))(\d+)(?:\.(\d+))?$`)
+
+// widthTypes are the types of each address width, the first being that assumed if none is
+// given
+var widthTypes = map[string][]DataType{
+	"X": {BOOL},
+	"B": {BYTE, SINT, USINT},
+	"W": {WORD, INT, UINT},
+	"D": {DWORD, DINT, UDINT, REAL},
+}
+
+// ParseAddress parses an address in the notation of STEP 7: a bit (DB10.DBX4.1, M0.1), byte
+// (DB10.DBB4, MB2), word (DB10.DBW4, IW0) or double word (DB10.DBD4, QD8) of a data block,
+// of the bit memory (M) or of the inputs (I, or E) or outputs (Q, or A). The value at the
+// address is of the passed type, which must be of the address's width; if the type is empty
+// the value is a BOOL, BYTE, WORD or DWORD.
+func ParseAddress(address string, dataType string) (Address, error) {
+	m := addressPattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(address)))
+	if m == nil {
+		return Address{}, fmt.Errorf("invalid address %q", address)
+	}
+	var a Address
+	width := m[2]
+	if m[1] != "" {
+		a.Area = AreaDB
+		db, err := strconv.Atoi(m[1])
+		if err != nil || db < 1 || db > 0xFFFF {
+			return Address{}, fmt.Errorf("invalid data block in address %q", address)
+		}
+		a.DB = db
+	} else {
+		switch m[3] {
+		case "I", "E":
+			a.Area = AreaI
+		case "Q", "A":
+			a.Area = AreaQ
+		default:
+			a.Area = AreaM
+		}
+		if width = m[4]; width == "" {
+			width = "X"
+		}
+	}
+	start, err := strconv.Atoi(m[5])
+	if err != nil || start > 0xFFFF {
+		return Address{}, fmt.Errorf("invalid offset in address %q", address)
+	}
+	a.Start = start
+	if (width == "X") != (m[6] != "") {
+		return Address{}, fmt.Errorf("address %q must give a bit if, and only if, it addresses one", address)
+	}
+	if m[6] != "" {
+		if a.Bit, err = strconv.Atoi(m[6]); err != nil || a.Bit > 7 {
+			return Address{}, fmt.Errorf("invalid bit in address %q", address)
+		}
+	}
+	a.Type = widthTypes[width][0]
+	if dataType != "" {
+		t, err := ParseDataType(dataType)
+		if err != nil {
+			return Address{}, err
+		}
+		for _, v := range widthTypes[width] {
+			if v == t {
+				a.Type = t
+			}
+		}
+		if a.Type != t {
+			return Address{}, fmt.Errorf("%s cannot be read from address %q of its width", t, address)
+		}
+	}
+	return a, nil
+}
+
+func (a Address) String() string {
+	var prefix string
+	if a.Area == AreaDB {
+		prefix = fmt.Sprintf("DB%d.DB", a.DB)
+	} else {
+		prefix = a.Area.String()
+	}
+	switch a.Type.Size() {
+	case 0:
+		return fmt.Sprintf("%sX%d.%d", prefix, a.Start, a.Bit)
+	case 1:
+		return fmt.Sprintf("%sB%d", prefix, a.Start)
+	case 2:
+		return fmt.Sprintf("%sW%d", prefix, a.Start)
+	}
+	return fmt.Sprintf("%sD%d", prefix, a.Start)
+}
+
+// Decode returns the value of the type held by the passed bytes, a single byte of 0 or 1 for
+// BOOL. Integers are returned as the Go type of their size and signedness, REAL as float32.
+func Decode(t DataType, data []byte) (interface{}, error) {
+	size := t.Size()
+	if size == 0 {
+		size = 1
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("%d bytes of %s data, expected %d", len(data), t, size)
+	}
+	switch t {
+	case BOOL:
+		return data[0] != 0, nil
+	case SINT:
+		return int8(data[0]), nil
+	case BYTE, USINT:
+		return data[0], nil
+	case INT:
+		return int16(binary.BigEndian.Uint16(data)), nil
+	case WORD, UINT:
+		return binary.BigEndian.Uint16(data), nil
+	case DINT:
+		return int32(binary.BigEndian.Uint32(data)), nil
+	case DWORD, UDINT:
+		return binary.BigEndian.Uint32(data), nil
+	case REAL:
+		return math.Float32frombits(binary.BigEndian.Uint32(data)), nil
+	}
+	return nil, fmt.Errorf("%s cannot be decoded", t)
+}
+
+// Encode returns the bytes of the passed value as the type, a single byte of 0 or 1 for BOOL.
+// Integer types accept any Go number (or bool) that is a whole number within their range,
+// REAL any number.
+func Encode(t DataType, value interface{}) ([]byte, error) {
+	f, err := toFloat64(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s expects a number, got %v", t, value)
+	}
+	var lo, hi float64
+	switch t {
+	case REAL:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(f)))
+		return b, nil
+	case BOOL:
+		if f != 0 && f != 1 {
+			return nil, fmt.Errorf("BOOL expects a boolean (or 0/1), got %v", value)
+		}
+		return []byte{byte(f)}, nil
+	case SINT:
+		lo, hi = math.MinInt8, math.MaxInt8
+	case BYTE, USINT:
+		hi = math.MaxUint8
+	case INT:
+		lo, hi = math.MinInt16, math.MaxInt16
+	case WORD, UINT:
+		hi = math.MaxUint16
+	case DINT:
+		lo, hi = math.MinInt32, math.MaxInt32
+	case DWORD, UDINT:
+		hi = math.MaxUint32
+	default:
+		return nil, fmt.Errorf("%s cannot be encoded", t)
+	}
+	if f != math.Trunc(f) || f < lo || f > hi {
+		return nil, fmt.Errorf("%v is not a %s value", value, t)
+	}
+	raw := uint32(int64(f))
+	b := make([]byte, t.Size())
+	for i := range b {
+		b[i] = byte(raw >> uint(8*(len(b)-1-i)))
+	}
+	return b, nil
+}
+
+// toFloat64 converts a Go number or bool to a float64
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
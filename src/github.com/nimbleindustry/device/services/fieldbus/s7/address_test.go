@@ -0,0 +1,77 @@
+package s7
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddress(t *testing.T) {
+	for _, v := range []struct {
+		address  string
+		dataType string
+		expected Address
+		name     string
+	}{
+		{"DB10.DBD4", "REAL", Address{Area: AreaDB, DB: 10, Start: 4, Type: REAL}, "DB10.DBD4"},
+		{"db10.dbx4.7", "", Address{Area: AreaDB, DB: 10, Start: 4, Bit: 7, Type: BOOL}, "DB10.DBX4.7"},
+		{"DB1.DBW0", "int", Address{Area: AreaDB, DB: 1, Type: INT}, "DB1.DBW0"},
+		{"DB65535.DBB65535", "", Address{Area: AreaDB, DB: 65535, Start: 65535, Type: BYTE}, "DB65535.DBB65535"},
+		{"M0.1", "", Address{Area: AreaM, Bit: 1, Type: BOOL}, "MX0.1"},
+		{"MW10", "", Address{Area: AreaM, Start: 10, Type: WORD}, "MW10"},
+		{"MD20", "DINT", Address{Area: AreaM, Start: 20, Type: DINT}, "MD20"},
+		{"IB3", "SINT", Address{Area: AreaI, Start: 3, Type: SINT}, "IB3"},
+		{"E1.0", "", Address{Area: AreaI, Start: 1, Type: BOOL}, "IX1.0"},
+		{"QX2.5", "BOOL", Address{Area: AreaQ, Start: 2, Bit: 5, Type: BOOL}, "QX2.5"},
+		{"AW4", "UINT", Address{Area: AreaQ, Start: 4, Type: UINT}, "QW4"},
+	} {
+		a, err := ParseAddress(v.address, v.dataType)
+		assert.Nil(t, err, v.address)
+		assert.Equal(t, v.expected, a, v.address)
+		assert.Equal(t, v.name, a.String())
+	}
+	for _, v := range [][2]string{
+		{"", ""}, {"DB10", ""}, {"DB0.DBW0", ""}, {"DB65536.DBW0", ""}, {"DB10.DBX4", ""},
+		{"DB10.DBW4.1", ""}, {"M0.8", ""}, {"MW65536", ""}, {"T5", ""}, {"M0", ""},
+		{"DB10.DBW4", "REAL"}, {"MD4", "INT"}, {"M0.0", "BYTE"}, {"MW0", "STRING"},
+	} {
+		_, err := ParseAddress(v[0], v[1])
+		assert.NotNil(t, err, "%v", v)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, v := range []struct {
+		dataType DataType
+		value    interface{}
+		data     []byte
+		decoded  interface{}
+	}{
+		{BOOL, true, []byte{1}, true},
+		{BYTE, 0xAB, []byte{0xAB}, uint8(0xAB)},
+		{SINT, -2, []byte{0xFE}, int8(-2)},
+		{INT, -300, []byte{0xFE, 0xD4}, int16(-300)},
+		{WORD, 0xBEEF, []byte{0xBE, 0xEF}, uint16(0xBEEF)},
+		{DINT, int32(-70000), []byte{0xFF, 0xFE, 0xEE, 0x90}, int32(-70000)},
+		{UDINT, 4000000000.0, []byte{0xEE, 0x6B, 0x28, 0x00}, uint32(4000000000)},
+		{REAL, 12.5, []byte{0x41, 0x48, 0x00, 0x00}, float32(12.5)},
+	} {
+		data, err := Encode(v.dataType, v.value)
+		assert.Nil(t, err, "%s", v.dataType)
+		assert.Equal(t, v.data, data, "%s", v.dataType)
+		decoded, err := Decode(v.dataType, data)
+		assert.Nil(t, err)
+		assert.Equal(t, v.decoded, decoded)
+	}
+	for _, v := range []struct {
+		dataType DataType
+		value    interface{}
+	}{
+		{BOOL, 2}, {BYTE, 256}, {SINT, -129}, {INT, 1.5}, {UINT, -1}, {DINT, "1"}, {UDINT, 1 << 32},
+	} {
+		_, err := Encode(v.dataType, v.value)
+		assert.NotNil(t, err, "%s %v", v.dataType, v.value)
+	}
+	_, err := Decode(INT, []byte{1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,228 @@
+package s7
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// ErrClosed is returned by the requests of a client that has been closed
+var ErrClosed = errors.New("client closed")
+
+// ClientConfig configures a client's connection
+type ClientConfig struct {
+	Timeout time.Duration // of connecting and of each job, 10 seconds if zero
+	Rack    int           // the rack of the CPU
+	Slot    int           // the slot of the CPU: 2 for an S7-300, 0 or 1 for an S7-1200 or S7-1500
+}
+
+// ReadResult is the outcome of reading an address: its value, or the error (typically an
+// *ItemError or *JobError) that prevented it being read
+type ReadResult struct {
+	Value interface{}
+	Err   error
+}
+
+// Client is a connection to an S7 CPU, over which values are read and written. A client is
+// not safe for concurrent use. Should the connection fail every later job returns the error
+// that failed it.
+type Client struct {
+	conn      net.Conn
+	config    ClientConfig
+	pduSize   int
+	reference uint16
+	err       error
+}
+
+// Dial connects to the CPU at the passed address (host:port), establishing the ISO-on-TCP
+// connection and negotiating the PDU size
+func Dial(address string, config ClientConfig) (*Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Rack < 0 || config.Rack > 7 || config.Slot < 0 || config.Slot > 31 {
+		return nil, fmt.Errorf("invalid rack %d and slot %d", config.Rack, config.Slot)
+	}
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, config: config}
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	err = writeTPKT(conn, encodeConnect(cotpConnectionRequest, 0, 1, localTSAP, remoteTSAP(config.Rack, config.Slot)))
+	if err == nil {
+		var tpdu []byte
+		if tpdu, err = readTPKT(conn); err == nil {
+			_, _, _, err = decodeConnect(cotpConnectionConfirm, tpdu)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to rack %d slot %d, %s", config.Rack, config.Slot, err)
+	}
+	reply, err := c.exchange(setupParams(defaultPDUSize), nil)
+	if err == nil {
+		err = reply.err()
+	}
+	if err == nil && (len(reply.params) != 8 || reply.params[0] != functionSetup) {
+		err = errors.New("invalid setup communication parameters")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to setup communication, %s", err)
+	}
+	c.pduSize = int(reply.params[6])<<8 | int(reply.params[7])
+	if c.pduSize < minPDUSize || c.pduSize > defaultPDUSize {
+		conn.Close()
+		return nil, fmt.Errorf("invalid PDU size %d", c.pduSize)
+	}
+	return c, nil
+}
+
+// PDUSize returns the PDU size negotiated with the CPU
+func (c *Client) PDUSize() int {
+	return c.pduSize
+}
+
+// Err returns the error that failed the connection, nil while it is open
+func (c *Client) Err() error {
+	if c.err == ErrClosed {
+		return nil
+	}
+	return c.err
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	if c.err != nil {
+		return nil
+	}
+	c.err = ErrClosed
+	return c.conn.Close()
+}
+
+// Read reads the values at the passed addresses, packing as many into each job as the PDU
+// size allows. A result is returned for every address; an error is returned only if
+// communication with the CPU failed.
+func (c *Client) Read(addresses []Address) ([]ReadResult, error) {
+	results := make([]ReadResult, len(addresses))
+	for start := 0; start < len(addresses); {
+		end := start + 1
+		replySize := replyHeaderSize + 2 + dataItemSize(addressItem(addresses[start]).count)
+		for ; end < len(addresses) && end-start < maxItems; end++ {
+			replySize += dataItemSize(addressItem(addresses[end]).count)
+			if jobHeaderSize+2+itemSize*(end+1-start) > c.pduSize || replySize > c.pduSize {
+				break
+			}
+		}
+		if err := c.read(addresses[start:end], results[start:end]); err != nil {
+			return nil, err
+		}
+		start = end
+	}
+	return results, nil
+}
+
+// read reads the passed addresses in a single job, setting their results
+func (c *Client) read(addresses []Address, results []ReadResult) error {
+	items := make([]item, len(addresses))
+	for i, v := range addresses {
+		items[i] = addressItem(v)
+	}
+	reply, err := c.exchange(itemParams(functionRead, items), nil)
+	if err != nil {
+		return err
+	}
+	if err := reply.err(); err != nil {
+		// the job itself was rejected, and with it every item
+		for i := range results {
+			results[i].Err = err
+		}
+		return nil
+	}
+	if len(reply.params) != 2 || reply.params[0] != functionRead || int(reply.params[1]) != len(items) {
+		return c.fail(errors.New("invalid read reply parameters"))
+	}
+	data, err := decodeDataItems(reply.data, len(items))
+	if err != nil {
+		return c.fail(err)
+	}
+	for i, v := range data {
+		if v.code != ReturnSuccess {
+			results[i].Err = &ItemError{Code: v.code}
+			continue
+		}
+		results[i].Value, results[i].Err = Decode(addresses[i].Type, v.data)
+	}
+	return nil
+}
+
+// Write writes the passed value, as the type of the address, to the address
+func (c *Client) Write(a Address, value interface{}) error {
+	data, err := Encode(a.Type, value)
+	if err != nil {
+		return err
+	}
+	v := dataItem{transport: dataByte, data: data}
+	if a.Type == BOOL {
+		v.transport = dataBit
+	}
+	reply, err := c.exchange(itemParams(functionWrite, []item{addressItem(a)}), encodeDataItems([]dataItem{v}))
+	if err != nil {
+		return err
+	}
+	if err := reply.err(); err != nil {
+		return err
+	}
+	if len(reply.params) != 2 || reply.params[0] != functionWrite || len(reply.data) != 1 {
+		return c.fail(errors.New("invalid write reply"))
+	}
+	if reply.data[0] != ReturnSuccess {
+		return &ItemError{Code: reply.data[0]}
+	}
+	return nil
+}
+
+// exchange sends a job of the passed parameters and data and returns its acknowledgement,
+// failing the connection should either not succeed
+func (c *Client) exchange(params, data []byte) (pdu, error) {
+	if c.err != nil {
+		return pdu{}, c.err
+	}
+	c.reference++
+	job := pdu{rosctr: rosctrJob, reference: c.reference, params: params, data: data}
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if err := writeTPKT(c.conn, encodeData(job.encode())); err != nil {
+		return pdu{}, c.fail(err)
+	}
+	tpdu, err := readTPKT(c.conn)
+	if err != nil {
+		return pdu{}, c.fail(err)
+	}
+	b, err := decodeData(tpdu)
+	if err != nil {
+		return pdu{}, c.fail(err)
+	}
+	reply, err := decodePDU(b)
+	switch {
+	case err != nil:
+	case reply.rosctr != rosctrAckData && reply.rosctr != rosctrAck:
+		err = fmt.Errorf("reply of type %d, expected an acknowledgement", reply.rosctr)
+	case reply.reference != job.reference:
+		err = fmt.Errorf("reply to job %d, expected %d", reply.reference, job.reference)
+	}
+	if err != nil {
+		return pdu{}, c.fail(err)
+	}
+	return reply, nil
+}
+
+// fail closes the connection, following which every job returns the passed error
+func (c *Client) fail(err error) error {
+	c.err = err
+	c.conn.Close()
+	return err
+}
@@ -0,0 +1,113 @@
+package s7
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serverFixture returns the stand-in server listening on a local port
+func serverFixture(t *testing.T) *Server {
+	server, err := ListenStandin("127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	return server
+}
+
+func parseAddresses(t *testing.T, addresses ...string) []Address {
+	parsed := make([]Address, len(addresses))
+	for i, v := range addresses {
+		var err error
+		parsed[i], err = ParseAddress(v, "")
+		assert.Nil(t, err, v)
+	}
+	return parsed
+}
+
+func TestClientReadsAddresses(t *testing.T) {
+	server := serverFixture(t)
+	defer server.Close()
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second, Slot: 2})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+	assert.Equal(t, defaultPDUSize, client.PDUSize())
+
+	addresses := parseAddresses(t, "DB10.DBD4", "DB10.DBW8", "DB10.DBX10.3", "DB10.DBX10.2", "MW2", "M0.1",
+		"ID4", "QB1", "DB11.DBW0", "DB10.DBW400")
+	addresses[0].Type, addresses[1].Type, addresses[6].Type = REAL, INT, DINT
+	results, err := client.Read(addresses)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.Requests(), "expected the reads to share a job")
+	for i, v := range []interface{}{float32(12.5), int16(-42), true, false, uint16(1450), true, int32(100000), uint8(0x81)} {
+		assert.Nil(t, results[i].Err)
+		assert.Equal(t, v, results[i].Value)
+	}
+	assert.Equal(t, &ItemError{Code: ReturnObjectDoesNotExist}, results[8].Err)
+	assert.Equal(t, &ItemError{Code: ReturnAddressOutOfRange}, results[9].Err)
+	assert.Equal(t, "return code 0x05 (address out of range)", results[9].Err.Error())
+
+	// the items of a job are limited, further items being read by further jobs
+	addresses = make([]Address, 45)
+	for i := range addresses {
+		addresses[i] = Address{Area: AreaDB, DB: 10, Start: 4 * i, Type: DINT}
+	}
+	results, err = client.Read(addresses)
+	assert.Nil(t, err)
+	assert.Len(t, results, 45)
+	assert.Equal(t, 4, server.Requests())
+	assert.Equal(t, int32(0x41480000), results[1].Value)
+}
+
+func TestClientWritesAddresses(t *testing.T) {
+	server := serverFixture(t)
+	defer server.Close()
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	for _, v := range []struct {
+		address  string
+		dataType string
+		value    interface{}
+	}{
+		{"DB10.DBD4", "REAL", 99.25},
+		{"DB10.DBX10.3", "", false},
+		{"DB10.DBX10.4", "", true},
+		{"QW6", "INT", -7},
+	} {
+		a, _ := ParseAddress(v.address, v.dataType)
+		assert.Nil(t, client.Write(a, v.value), v.address)
+		value, err := server.Get(a)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(v.value), fmt.Sprint(value), v.address)
+	}
+	// the other bits of a byte are unaffected by writing one
+	value, _ := server.Get(Address{Area: AreaDB, DB: 10, Start: 10, Type: BYTE})
+	assert.Equal(t, uint8(0x10), value)
+
+	a, _ := ParseAddress("DB12.DBW0", "")
+	assert.Equal(t, &ItemError{Code: ReturnObjectDoesNotExist}, client.Write(a, 1))
+	a, _ = ParseAddress("MB0", "")
+	assert.NotNil(t, client.Write(a, 300))
+	assert.Nil(t, client.Err())
+}
+
+func TestClientConnectionFailure(t *testing.T) {
+	server := serverFixture(t)
+	client, err := Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.Nil(t, err, "unable to connect")
+	defer client.Close()
+
+	server.Close()
+	_, err = client.Read(parseAddresses(t, "MW2"))
+	assert.NotNil(t, err)
+	assert.Equal(t, err, client.Err())
+	_, err = client.Read(parseAddresses(t, "MW2"))
+	assert.Equal(t, client.Err(), err, "expected later jobs to fail as the connection did")
+
+	_, err = Dial(server.Addr().String(), ClientConfig{Timeout: time.Second})
+	assert.NotNil(t, err)
+	_, err = Dial(server.Addr().String(), ClientConfig{Slot: 32})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,134 @@
+// Package s7 implements the parts of S7comm needed to read and write the memory areas of
+// Siemens S7-300, S7-400, S7-1200 and S7-1500 PLCs: ISO-on-TCP (RFC 1006) with its COTP
+// connection, and the S7comm setup, read and write jobs carried over it.
+package s7
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultPort is the tcp port of ISO-on-TCP
+const DefaultPort = 102
+
+// COTP TPDU codes
+const (
+	cotpConnectionRequest = 0xE0
+	cotpConnectionConfirm = 0xD0
+	cotpData              = 0xF0
+)
+
+// COTP parameter codes of connection requests
+const (
+	cotpTPDUSize    = 0xC0
+	cotpCallingTSAP = 0xC1
+	cotpCalledTSAP  = 0xC2
+)
+
+const (
+	tpktVersion    = 3
+	tpktHeaderSize = 4
+	// the size of the COTP data TPDU header preceding each S7comm PDU
+	cotpDataHeaderSize = 3
+	// TPDU size code for 1024 byte TPDUs, ample for the PDUs negotiated
+	tpduSize1024 = 0x0A
+	// last data unit flag of data TPDUs
+	cotpEOT = 0x80
+)
+
+// localTSAP is the TSAP this end of the connection presents, that of a PG
+const localTSAP = 0x0100
+
+// remoteTSAP returns the TSAP of the CPU in the passed rack and slot, reached as a PG
+func remoteTSAP(rack, slot int) uint16 {
+	return uint16(0x0100 | rack<<5 | slot)
+}
+
+// writeTPKT writes the passed TPDU, preceded by its TPKT header
+func writeTPKT(w io.Writer, tpdu []byte) error {
+	b := make([]byte, tpktHeaderSize, tpktHeaderSize+len(tpdu))
+	b[0] = tpktVersion
+	binary.BigEndian.PutUint16(b[2:], uint16(tpktHeaderSize+len(tpdu)))
+	_, err := w.Write(append(b, tpdu...))
+	return err
+}
+
+// readTPKT reads a single TPKT, returning the TPDU it carries
+func readTPKT(r io.Reader) ([]byte, error) {
+	b := make([]byte, tpktHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != tpktVersion {
+		return nil, fmt.Errorf("TPKT version %d, expected %d", b[0], tpktVersion)
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < tpktHeaderSize+2 {
+		return nil, fmt.Errorf("TPKT length %d too short", length)
+	}
+	tpdu := make([]byte, length-tpktHeaderSize)
+	if _, err := io.ReadFull(r, tpdu); err != nil {
+		return nil, err
+	}
+	return tpdu, nil
+}
+
+// encodeConnect returns a COTP connection request (or, with cotpConnectionConfirm, the
+// confirm answering it) between the passed TSAPs
+func encodeConnect(code byte, destination, source uint16, calling, called uint16) []byte {
+	b := []byte{0, code, byte(destination >> 8), byte(destination), byte(source >> 8), byte(source), 0,
+		cotpTPDUSize, 1, tpduSize1024,
+		cotpCallingTSAP, 2, byte(calling >> 8), byte(calling),
+		cotpCalledTSAP, 2, byte(called >> 8), byte(called)}
+	b[0] = byte(len(b) - 1)
+	return b
+}
+
+// decodeConnect returns the source reference and TSAPs of a COTP connection request or
+// confirm
+func decodeConnect(code byte, tpdu []byte) (source, calling, called uint16, err error) {
+	if len(tpdu) < 7 || int(tpdu[0]) != len(tpdu)-1 {
+		return 0, 0, 0, errors.New("COTP connection TPDU truncated")
+	}
+	if tpdu[1] != code {
+		return 0, 0, 0, fmt.Errorf("COTP TPDU 0x%02X, expected 0x%02X", tpdu[1], code)
+	}
+	source = binary.BigEndian.Uint16(tpdu[4:])
+	for params := tpdu[7:]; len(params) > 0; {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return 0, 0, 0, errors.New("COTP parameter truncated")
+		}
+		value := params[2 : 2+params[1]]
+		if len(value) == 2 {
+			switch params[0] {
+			case cotpCallingTSAP:
+				calling = binary.BigEndian.Uint16(value)
+			case cotpCalledTSAP:
+				called = binary.BigEndian.Uint16(value)
+			}
+		}
+		params = params[2+params[1]:]
+	}
+	return source, calling, called, nil
+}
+
+// encodeData returns the data TPDU carrying the passed S7comm PDU
+func encodeData(pdu []byte) []byte {
+	return append([]byte{2, cotpData, cotpEOT}, pdu...)
+}
+
+// decodeData returns the S7comm PDU carried by a data TPDU
+func decodeData(tpdu []byte) ([]byte, error) {
+	if len(tpdu) < cotpDataHeaderSize || int(tpdu[0]) >= len(tpdu) {
+		return nil, errors.New("COTP data TPDU truncated")
+	}
+	if tpdu[1] != cotpData {
+		return nil, fmt.Errorf("COTP TPDU 0x%02X, expected data", tpdu[1])
+	}
+	if tpdu[2]&cotpEOT == 0 {
+		return nil, errors.New("COTP data TPDU is not the last of its unit")
+	}
+	return tpdu[1+int(tpdu[0]):], nil
+}
@@ -0,0 +1,288 @@
+package s7
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const protocolID = 0x32
+
+// ROSCTR, the message types of S7comm
+const (
+	rosctrJob     = 0x01
+	rosctrAck     = 0x02
+	rosctrAckData = 0x03
+)
+
+// Functions of jobs
+const (
+	functionSetup = 0xF0
+	functionRead  = 0x04
+	functionWrite = 0x05
+)
+
+// Return codes of the items of read and write replies
+const (
+	ReturnHardwareFault      = 0x01
+	ReturnAccessDenied       = 0x03
+	ReturnAddressOutOfRange  = 0x05
+	ReturnTypeNotSupported   = 0x06
+	ReturnTypeInconsistent   = 0x07
+	ReturnObjectDoesNotExist = 0x0A
+	ReturnSuccess            = 0xFF
+)
+
+// Error classes of acknowledgements, of jobs the CPU rejected
+const (
+	errorClassResources      = 0x83
+	errorClassServiceProcess = 0x84
+	errorClassSupplies       = 0x85
+)
+
+// Transport sizes of request items, and of the data items of replies and writes
+const (
+	transportBit  = 0x01
+	transportByte = 0x02
+	dataBit       = 0x03
+	dataByte      = 0x04 // whose length is given in bits
+)
+
+const (
+	jobHeaderSize   = 10
+	replyHeaderSize = 12
+	itemSize        = 12
+	dataItemHeader  = 4
+	// the PDU size proposed when connecting, that of most CPUs
+	defaultPDUSize = 480
+	// the smallest PDU size of any CPU
+	minPDUSize = 240
+	// the items of a read or write job, limited by the CPUs
+	maxItems = 20
+)
+
+var returnText = map[byte]string{
+	ReturnHardwareFault:      "hardware fault",
+	ReturnAccessDenied:       "accessing the object not allowed",
+	ReturnAddressOutOfRange:  "address out of range",
+	ReturnTypeNotSupported:   "data type not supported",
+	ReturnTypeInconsistent:   "data type inconsistent",
+	ReturnObjectDoesNotExist: "object does not exist",
+}
+
+var errorClassText = map[byte]string{
+	0x81:                     "application relationship",
+	0x82:                     "object definition",
+	errorClassResources:      "no resources available",
+	errorClassServiceProcess: "error on service processing",
+	errorClassSupplies:       "error on supplies",
+	0x87:                     "access error",
+}
+
+// ItemError is the return code of an item the CPU could not read or write
+type ItemError struct {
+	Code byte
+}
+
+func (e *ItemError) Error() string {
+	text, found := returnText[e.Code]
+	if !found {
+		text = "unknown"
+	}
+	return fmt.Sprintf("return code 0x%02X (%s)", e.Code, text)
+}
+
+// ExceptionCode returns the return code, by which fieldbus diagnostics count the item
+func (e *ItemError) ExceptionCode() int {
+	return int(e.Code)
+}
+
+// JobError is the error class and code with which the CPU rejected a job
+type JobError struct {
+	Class byte
+	Code  byte
+}
+
+func (e *JobError) Error() string {
+	text, found := errorClassText[e.Class]
+	if !found {
+		text = "unknown"
+	}
+	return fmt.Sprintf("error class 0x%02X (%s), code 0x%02X", e.Class, text, e.Code)
+}
+
+// ExceptionCode returns the error class and code, by which fieldbus diagnostics count the job,
+// e.g. 0x8500
+func (e *JobError) ExceptionCode() int {
+	return int(e.Class)<<8 | int(e.Code)
+}
+
+// pdu is an S7comm PDU, the parameters and data of a job or of its acknowledgement
+type pdu struct {
+	rosctr     byte
+	reference  uint16
+	params     []byte
+	data       []byte
+	errorClass byte // of acknowledgements
+	errorCode  byte
+}
+
+func (p pdu) encode() []byte {
+	size := jobHeaderSize
+	if p.rosctr == rosctrAck || p.rosctr == rosctrAckData {
+		size = replyHeaderSize
+	}
+	b := make([]byte, size, size+len(p.params)+len(p.data))
+	b[0], b[1] = protocolID, p.rosctr
+	binary.BigEndian.PutUint16(b[4:], p.reference)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(p.params)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(p.data)))
+	if size == replyHeaderSize {
+		b[10], b[11] = p.errorClass, p.errorCode
+	}
+	return append(append(b, p.params...), p.data...)
+}
+
+func decodePDU(b []byte) (pdu, error) {
+	if len(b) < jobHeaderSize || b[0] != protocolID {
+		return pdu{}, errors.New("not an S7comm PDU")
+	}
+	p := pdu{rosctr: b[1], reference: binary.BigEndian.Uint16(b[4:])}
+	size := jobHeaderSize
+	if p.rosctr == rosctrAck || p.rosctr == rosctrAckData {
+		if len(b) < replyHeaderSize {
+			return pdu{}, errors.New("S7comm header truncated")
+		}
+		p.errorClass, p.errorCode = b[10], b[11]
+		size = replyHeaderSize
+	}
+	params, data := int(binary.BigEndian.Uint16(b[6:])), int(binary.BigEndian.Uint16(b[8:]))
+	if len(b) != size+params+data {
+		return pdu{}, fmt.Errorf("S7comm PDU of %d bytes, header gives %d", len(b), size+params+data)
+	}
+	p.params, p.data = b[size:size+params], b[size+params:]
+	return p, nil
+}
+
+// err returns the error of an acknowledgement, nil if the job succeeded
+func (p pdu) err() error {
+	if p.errorClass == 0 && p.errorCode == 0 {
+		return nil
+	}
+	return &JobError{Class: p.errorClass, Code: p.errorCode}
+}
+
+// setupParams returns the parameters of the setup communication job and its acknowledgement,
+// proposing or confirming the PDU size
+func setupParams(pduSize int) []byte {
+	b := []byte{functionSetup, 0, 0, 1, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(b[6:], uint16(pduSize))
+	return b
+}
+
+// item is the address of a read or write request item: a run of bytes, or a single bit
+type item struct {
+	area      Area
+	db        int
+	offset    int // in bits
+	transport byte
+	count     int // of bytes, or 1 of a bit
+}
+
+// addressItem returns the request item of the value at the passed address
+func addressItem(a Address) item {
+	if a.Type == BOOL {
+		return item{area: a.Area, db: a.DB, offset: a.Start*8 + a.Bit, transport: transportBit, count: 1}
+	}
+	return item{area: a.Area, db: a.DB, offset: a.Start * 8, transport: transportByte, count: a.Type.Size()}
+}
+
+func (i item) encode() []byte {
+	return []byte{0x12, 0x0A, 0x10, i.transport, byte(i.count >> 8), byte(i.count), byte(i.db >> 8), byte(i.db),
+		byte(i.area), byte(i.offset >> 16), byte(i.offset >> 8), byte(i.offset)}
+}
+
+// itemParams returns the parameters of a read or write job of the passed items
+func itemParams(function byte, items []item) []byte {
+	b := make([]byte, 2, 2+itemSize*len(items))
+	b[0], b[1] = function, byte(len(items))
+	for _, v := range items {
+		b = append(b, v.encode()...)
+	}
+	return b
+}
+
+// decodeItems returns the items of the parameters of a read or write job
+func decodeItems(params []byte) ([]item, error) {
+	if len(params) < 2 || len(params) != 2+itemSize*int(params[1]) {
+		return nil, errors.New("item parameters truncated")
+	}
+	items := make([]item, params[1])
+	for i := range items {
+		b := params[2+itemSize*i:]
+		if b[0] != 0x12 || b[1] != 0x0A || b[2] != 0x10 {
+			return nil, fmt.Errorf("item %d is not an S7ANY address", i)
+		}
+		items[i] = item{area: Area(b[8]), db: int(binary.BigEndian.Uint16(b[6:])),
+			offset: int(b[9])<<16 | int(b[10])<<8 | int(b[11]), transport: b[3], count: int(binary.BigEndian.Uint16(b[4:]))}
+	}
+	return items, nil
+}
+
+// dataItem is the data of an item of a read reply or write job, or the return code of an item
+// that could not be read
+type dataItem struct {
+	code      byte
+	transport byte
+	data      []byte
+}
+
+// dataItemSize returns the size of a data item of the passed length within a reply or job,
+// including the padding that follows all but the last
+func dataItemSize(length int) int {
+	return dataItemHeader + length + length%2
+}
+
+// encodeDataItems returns the data of a read reply or write job
+func encodeDataItems(items []dataItem) []byte {
+	var b []byte
+	for i, v := range items {
+		length := len(v.data)
+		if v.transport == dataByte {
+			length *= 8
+		}
+		b = append(b, v.code, v.transport, byte(length>>8), byte(length))
+		b = append(b, v.data...)
+		if len(v.data)%2 == 1 && i < len(items)-1 {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+// decodeDataItems returns the passed number of data items of a read reply or write job
+func decodeDataItems(b []byte, count int) ([]dataItem, error) {
+	items := make([]dataItem, count)
+	for i := range items {
+		if len(b) < dataItemHeader {
+			return nil, fmt.Errorf("data item %d truncated", i)
+		}
+		v := dataItem{code: b[0], transport: b[1]}
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		switch v.transport {
+		case dataByte, 0x05: // lengths in bits, of bytes and of integers
+			length = (length + 7) / 8
+		}
+		b = b[dataItemHeader:]
+		if len(b) < length {
+			return nil, fmt.Errorf("data item %d truncated", i)
+		}
+		v.data = b[:length]
+		b = b[length:]
+		if length%2 == 1 && i < count-1 && len(b) > 0 {
+			b = b[1:]
+		}
+		items[i] = v
+	}
+	return items, nil
+}
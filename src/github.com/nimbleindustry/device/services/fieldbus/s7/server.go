@@ -0,0 +1,313 @@
+package s7
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// areaSize is the size of the inputs, outputs and bit memory of the server
+const areaSize = 1024
+
+// Server answers the read and write jobs of an S7 CPU from memory areas held in memory,
+// standing in for a CPU when testing and commissioning integrations. Its inputs, outputs and
+// bit memory are of 1024 bytes each; its data blocks are those added. Connections are
+// accepted whatever the rack and slot they are addressed to.
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	areas    map[Area][]byte
+	dbs      map[int][]byte
+	conns    map[net.Conn]bool
+	requests int
+	closed   bool
+}
+
+// Listen returns a server accepting connections on the passed address, e.g. ":102"
+func Listen(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, dbs: make(map[int][]byte), conns: make(map[net.Conn]bool),
+		areas: map[Area][]byte{AreaI: make([]byte, areaSize), AreaQ: make([]byte, areaSize), AreaM: make([]byte, areaSize)}}
+	go s.accept()
+	return s, nil
+}
+
+// ListenStandin returns a server accepting connections on the passed address that holds the
+// values of a demonstration line: a data block DB10 of 400 bytes holding DBD4 (REAL), DBW8
+// (INT) and DBX10.3, and MW2, M0.1, ID4 (DINT) and QB1
+func ListenStandin(address string) (*Server, error) {
+	s, err := Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	s.AddDB(10, 400)
+	for _, v := range []struct {
+		address  string
+		dataType string
+		value    interface{}
+	}{
+		{"DB10.DBD4", "REAL", 12.5},
+		{"DB10.DBW8", "INT", -42},
+		{"DB10.DBX10.3", "", true},
+		{"MW2", "", 1450},
+		{"M0.1", "", true},
+		{"ID4", "DINT", 100000},
+		{"QB1", "", 0x81},
+	} {
+		a, err := ParseAddress(v.address, v.dataType)
+		if err == nil {
+			err = s.Set(a, v.value)
+		}
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s %s", v.address, err)
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the address on which the server accepts connections
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// AddDB creates or replaces a data block of the passed number and size, its bytes zero
+func (s *Server) AddDB(number int, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbs[number] = make([]byte, size)
+}
+
+// Set writes a value, as the type of the address, to the address
+func (s *Server) Set(a Address, value interface{}) error {
+	data, err := Encode(a.Type, value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code := s.write(addressItem(a), data); code != ReturnSuccess {
+		return &ItemError{Code: code}
+	}
+	return nil
+}
+
+// Get returns the value at an address
+func (s *Server) Get(a Address) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, code := s.read(addressItem(a))
+	if code != ReturnSuccess {
+		return nil, &ItemError{Code: code}
+	}
+	return Decode(a.Type, data)
+}
+
+// Requests returns the number of read and write jobs answered
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// DropConnections closes the connection of every client
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Close stops accepting connections and closes those of every client
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.DropConnections()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve confirms the connection of a client, then answers its jobs until it disconnects
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	tpdu, err := readTPKT(conn)
+	if err != nil {
+		return
+	}
+	reference, calling, called, err := decodeConnect(cotpConnectionRequest, tpdu)
+	if err != nil || writeTPKT(conn, encodeConnect(cotpConnectionConfirm, reference, 1, calling, called)) != nil {
+		return
+	}
+	pduSize := 0
+	for {
+		tpdu, err := readTPKT(conn)
+		if err != nil {
+			return
+		}
+		b, err := decodeData(tpdu)
+		if err != nil {
+			return
+		}
+		job, err := decodePDU(b)
+		if err != nil || job.rosctr != rosctrJob || len(job.params) == 0 {
+			return
+		}
+		reply := pdu{rosctr: rosctrAckData, reference: job.reference}
+		switch {
+		case job.params[0] == functionSetup && len(job.params) == 8:
+			if pduSize = int(job.params[6])<<8 | int(job.params[7]); pduSize > defaultPDUSize {
+				pduSize = defaultPDUSize
+			}
+			reply.params = setupParams(pduSize)
+		case pduSize == 0:
+			// jobs before the communication is setup are refused
+			reply.errorClass, reply.errorCode = errorClassServiceProcess, 0x01
+		default:
+			s.mu.Lock()
+			s.requests++
+			reply = s.handle(job, pduSize)
+			s.mu.Unlock()
+		}
+		if writeTPKT(conn, encodeData(reply.encode())) != nil {
+			return
+		}
+	}
+}
+
+// handle answers a read or write job with a reply of at most pduSize bytes
+func (s *Server) handle(job pdu, pduSize int) pdu {
+	reply := pdu{rosctr: rosctrAckData, reference: job.reference}
+	items, err := decodeItems(job.params)
+	if err != nil || len(items) == 0 || len(items) > maxItems {
+		reply.errorClass, reply.errorCode = errorClassServiceProcess, 0x04
+		return reply
+	}
+	switch job.params[0] {
+	case functionRead:
+		data := make([]dataItem, len(items))
+		size := replyHeaderSize + 2
+		for i, v := range items {
+			data[i].data, data[i].code = s.read(v)
+			if data[i].code == ReturnSuccess {
+				data[i].transport = dataByte
+				if v.transport == transportBit {
+					data[i].transport = dataBit
+				}
+			}
+			size += dataItemSize(len(data[i].data))
+		}
+		if size > pduSize {
+			reply.errorClass, reply.errorCode = errorClassSupplies, 0x00
+			return reply
+		}
+		reply.params, reply.data = []byte{functionRead, byte(len(items))}, encodeDataItems(data)
+	case functionWrite:
+		data, err := decodeDataItems(job.data, len(items))
+		if err != nil {
+			reply.errorClass, reply.errorCode = errorClassServiceProcess, 0x04
+			return reply
+		}
+		reply.params, reply.data = []byte{functionWrite, byte(len(items))}, make([]byte, len(items))
+		for i, v := range items {
+			if len(data[i].data) != v.count {
+				reply.data[i] = ReturnTypeInconsistent
+				continue
+			}
+			reply.data[i] = s.write(v, data[i].data)
+		}
+	default:
+		reply.errorClass, reply.errorCode = errorClassServiceProcess, 0x01
+	}
+	return reply
+}
+
+// memory returns the bytes of the item's area and the offset of the item within them, or the
+// return code of an item that cannot be accessed
+func (s *Server) memory(v item) ([]byte, int, byte) {
+	b, found := s.areas[v.area]
+	if v.area == AreaDB {
+		b, found = s.dbs[v.db]
+	}
+	if !found {
+		return nil, 0, ReturnObjectDoesNotExist
+	}
+	switch v.transport {
+	case transportBit:
+		if v.count != 1 {
+			return nil, 0, ReturnTypeInconsistent
+		}
+		if v.offset/8 >= len(b) {
+			return nil, 0, ReturnAddressOutOfRange
+		}
+	case transportByte:
+		if v.offset%8 != 0 {
+			return nil, 0, ReturnAddressOutOfRange
+		}
+		if v.offset/8+v.count > len(b) {
+			return nil, 0, ReturnAddressOutOfRange
+		}
+	default:
+		return nil, 0, ReturnTypeNotSupported
+	}
+	return b, v.offset / 8, ReturnSuccess
+}
+
+// read returns the data of an item, a single byte of 0 or 1 for a bit
+func (s *Server) read(v item) ([]byte, byte) {
+	b, offset, code := s.memory(v)
+	if code != ReturnSuccess {
+		return nil, code
+	}
+	if v.transport == transportBit {
+		return []byte{b[offset] >> uint(v.offset%8) & 1}, ReturnSuccess
+	}
+	return append([]byte(nil), b[offset:offset+v.count]...), ReturnSuccess
+}
+
+// write writes the data of an item, a single byte of 0 or 1 for a bit
+func (s *Server) write(v item, data []byte) byte {
+	b, offset, code := s.memory(v)
+	if code != ReturnSuccess {
+		return code
+	}
+	if v.transport == transportBit {
+		mask := byte(1) << uint(v.offset%8)
+		b[offset] &^= mask
+		if data[0] != 0 {
+			b[offset] |= mask
+		}
+		return ReturnSuccess
+	}
+	copy(b[offset:], data)
+	return ReturnSuccess
+}
@@ -0,0 +1,109 @@
+package fieldbus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus/s7"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS7EntryValidation(t *testing.T) {
+	svc := &S7Service{connection: common.ConnectionRecord{Type: define.S7, Endpoint: "plc"}}
+	for _, entries := range [][]common.S7Entry{
+		nil,
+		{{Address: "MW0"}},
+		{{TagName: "Speed"}},
+		{{TagName: "Speed", Address: "DB10.DBW4", DataType: "REAL"}},
+		{{TagName: "Speed", Address: "MW0"}, {TagName: "Speed", Address: "MW2"}},
+		{{TagName: "Speed", Address: "MW0", PollGroup: "fast"}},
+	} {
+		svc.entries = entries
+		assert.NotNil(t, svc.initBusIntegration(), "%v", entries)
+	}
+	svc.entries = []common.S7Entry{{TagName: "Speed", Address: "MW0"}}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Equal(t, "plc:102", svc.address)
+	assert.Equal(t, "S7Service[plc:102]", connectionKey(common.ConnectionRecord{Type: define.S7, Endpoint: "plc", Port: 102}))
+}
+
+func TestS7ReadsAndWritesValues(t *testing.T) {
+	svc, server := newTestS7Service(t)
+	defer server.Close()
+	states := watchConnectionState(svc.Name)
+	assert.Nil(t, svc.connect())
+	defer svc.closeConnection()
+	assert.Equal(t, define.ConnectionConnected, (<-states).State)
+
+	// the values of the default group are read together
+	report, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.Requests())
+	assert.Equal(t, common.TagValue{Value: float32(12.5), Unit: "m/min", Quality: define.QualityGood}, report["LineSpeed"])
+	assert.InDelta(t, -4.2, report["Motor1Speed"].Value, 1e-9)
+	assert.Equal(t, true, report["Running"].Value)
+	assert.Equal(t, int32(100000), report["Batch"].Value)
+
+	// a data block the PLC does not have is reported bad, and counted
+	report, err = svc.read(svc.schedule.groups[1].members)
+	assert.Nil(t, err)
+	assert.Equal(t, define.QualityBad, report["Missing"].Quality)
+	assert.True(t, strings.Contains(report["Missing"].Error, "object does not exist"), report["Missing"].Error)
+	assert.Equal(t, map[int]int{s7.ReturnObjectDoesNotExist: 1}, svc.diagnostics.Tags["Missing"].Exceptions)
+
+	// writes are converted from engineering units to the type of the address
+	ack := svc.executeWrite(common.WriteCommand{ID: "1", Tag: "Motor1Speed", Value: 150.04})
+	assert.True(t, ack.Success, ack.Error)
+	a, _ := s7.ParseAddress("DB10.DBW8", "INT")
+	value, _ := server.Get(a)
+	assert.Equal(t, int16(1500), value)
+	ack = svc.executeWrite(common.WriteCommand{ID: "2", Tag: "Running", Value: false})
+	assert.True(t, ack.Success, ack.Error)
+	a, _ = s7.ParseAddress("DB10.DBX10.3", "")
+	value, _ = server.Get(a)
+	assert.Equal(t, false, value)
+	for _, cmd := range []common.WriteCommand{
+		{Tag: "LineSpeed", Value: 100},
+		{Tag: "Running", Value: 2},
+		{Tag: "Unknown", Value: 1},
+	} {
+		ack = svc.executeWrite(cmd)
+		assert.False(t, ack.Success, cmd.Tag)
+	}
+	assert.Equal(t, []string{"Motor1Speed", "Running"}, svc.writableTags())
+}
+
+func TestS7ReconnectsAfterConnectionLoss(t *testing.T) {
+	svc, server := newTestS7Service(t)
+	assert.Nil(t, svc.connect())
+	_, err := svc.read(svc.schedule.groups[0].members)
+	assert.Nil(t, err)
+
+	// losing the connection reports the values last read as stale
+	server.DropConnections()
+	states := watchConnectionState(svc.Name)
+	reports := watchOpsReports()
+	svc.schedule.groups[0].next = time.Now()
+	err = svc.pollDueGroups()
+	assert.NotNil(t, err)
+	report := nextOpsReport(t, reports, "LineSpeed", nil)
+	assert.Equal(t, define.QualityStale, report["LineSpeed"].Quality)
+	assert.Equal(t, float32(12.5), report["LineSpeed"].Value)
+	svc.checkConnection(err)
+	assert.Equal(t, define.ConnectionDisconnected, (<-states).State)
+	assert.Nil(t, svc.conn)
+
+	// the connection is re-established, and failed attempts back off
+	assert.Nil(t, svc.connect())
+	assert.Equal(t, 1, svc.diagnostics.Reconnects)
+	svc.closeConnection()
+	server.Close()
+	assert.NotNil(t, svc.connect())
+	assert.Equal(t, 1, svc.backoff.failures)
+	err = svc.connect()
+	assert.True(t, strings.Contains(err.Error(), "deferred"), err.Error())
+}
@@ -0,0 +1,207 @@
+package fieldbus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+)
+
+const defaultPollGroupName = "default"
+
+// pollGroup is a set of tags read together at a fixed interval
+type pollGroup struct {
+	name     string
+	interval time.Duration
+	members  []int     // the indexes of the group's tags among those scheduled
+	next     time.Time // the wall-clock boundary at which the group is next due
+}
+
+// pollSchedule runs each poll group on its own cadence, aligned to wall-clock boundaries
+// (a 5s group runs at :00, :05, :10...). Groups are run one after another by the owning
+// service, so a slow group can delay others; any group that does not complete before its
+// next boundary is reported as an overrun.
+type pollSchedule struct {
+	groups []*pollGroup
+}
+
+// newPollSchedule assigns the passed entries to poll groups. Entries naming a pollGroup join
+// that group, entries with a pollInterval join an unnamed group of that interval, and all
+// other entries join the default group which runs at defaultInterval unless a group named
+// "default" is defined.
+func newPollSchedule(entries []common.ModbusEntry, definitions []common.PollGroup, defaultInterval time.Duration, now time.Time) (*pollSchedule, error) {
+	tags := make([]scheduledTag, len(entries))
+	for i, v := range entries {
+		tags[i] = scheduledTag{name: v.RegisterName, pollGroup: v.PollGroup, pollInterval: v.PollInterval}
+	}
+	return newTagSchedule(tags, definitions, defaultInterval, now)
+}
+
+// scheduledTag is the poll group assignment of a tag
+type scheduledTag struct {
+	name         string
+	pollGroup    string
+	pollInterval string
+}
+
+// newTagSchedule assigns the passed tags to poll groups as newPollSchedule does modbus
+// entries, each group's members being the indexes of its tags
+func newTagSchedule(tags []scheduledTag, definitions []common.PollGroup, defaultInterval time.Duration, now time.Time) (*pollSchedule, error) {
+	named := make(map[string]*pollGroup, len(definitions)+1)
+	named[defaultPollGroupName] = &pollGroup{name: defaultPollGroupName, interval: defaultInterval}
+	for _, v := range definitions {
+		interval, err := parsePollInterval(v.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("poll group %s %s", v.Name, err)
+		}
+		named[v.Name] = &pollGroup{name: v.Name, interval: interval}
+	}
+	byInterval := make(map[time.Duration]*pollGroup)
+	for i, tag := range tags {
+		var group *pollGroup
+		switch {
+		case tag.pollGroup != "":
+			var found bool
+			if group, found = named[tag.pollGroup]; !found {
+				return nil, fmt.Errorf("%s assigned to undefined poll group %s", tag.name, tag.pollGroup)
+			}
+		case tag.pollInterval != "":
+			interval, err := parsePollInterval(tag.pollInterval)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", tag.name, err)
+			}
+			if group = byInterval[interval]; group == nil {
+				group = &pollGroup{name: "@" + interval.String(), interval: interval}
+				byInterval[interval] = group
+			}
+		default:
+			group = named[defaultPollGroupName]
+		}
+		group.members = append(group.members, i)
+	}
+
+	schedule := &pollSchedule{}
+	for _, group := range named {
+		schedule.add(group, now)
+	}
+	for _, group := range byInterval {
+		schedule.add(group, now)
+	}
+	sort.Sort(pollGroupsByInterval(schedule.groups))
+	return schedule, nil
+}
+
+func parsePollInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("has invalid interval %q", s)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("has non-positive interval %q", s)
+	}
+	return interval, nil
+}
+
+func (schedule *pollSchedule) add(group *pollGroup, now time.Time) {
+	if len(group.members) == 0 {
+		return
+	}
+	group.next = nextBoundary(now, group.interval)
+	schedule.groups = append(schedule.groups, group)
+}
+
+// nextBoundary returns the first multiple of interval (since the zero time) after t
+func nextBoundary(t time.Time, interval time.Duration) time.Time {
+	return t.Truncate(interval).Add(interval)
+}
+
+// untilNext returns how long until the earliest group is due
+func (schedule *pollSchedule) untilNext(now time.Time) time.Duration {
+	if len(schedule.groups) == 0 {
+		return modbusSampleFrequency
+	}
+	next := schedule.groups[0].next
+	for _, group := range schedule.groups[1:] {
+		if group.next.Before(next) {
+			next = group.next
+		}
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// due returns the groups due at or before now, fastest group first
+func (schedule *pollSchedule) due(now time.Time) (groups []*pollGroup) {
+	for _, group := range schedule.groups {
+		if !group.next.After(now) {
+			groups = append(groups, group)
+		}
+	}
+	return
+}
+
+// complete reschedules a group whose cycle finished at the passed time. If the cycle ran past
+// the group's next boundary an overrun is returned describing the boundaries that were missed.
+func (schedule *pollSchedule) complete(group *pollGroup, finished time.Time) (overrun *common.PollOverrun) {
+	scheduled := group.next
+	elapsed := finished.Sub(scheduled)
+	if elapsed >= group.interval {
+		overrun = &common.PollOverrun{
+			Timestamp: finished,
+			Group:     group.name,
+			Interval:  group.interval,
+			Elapsed:   elapsed,
+			Missed:    int(elapsed / group.interval),
+		}
+	}
+	group.next = nextBoundary(finished, group.interval)
+	return
+}
+
+// skip reschedules a group that could not be read at all, without reporting an overrun
+func (schedule *pollSchedule) skip(group *pollGroup, now time.Time) {
+	group.next = nextBoundary(now, group.interval)
+}
+
+type pollGroupsByInterval []*pollGroup
+
+func (g pollGroupsByInterval) Len() int      { return len(g) }
+func (g pollGroupsByInterval) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g pollGroupsByInterval) Less(i, j int) bool {
+	if g[i].interval == g[j].interval {
+		return g[i].name < g[j].name
+	}
+	return g[i].interval < g[j].interval
+}
+
+// sectionInterval returns the interval of a section of the equipment config, such as the can
+// section: that of its poll group, its own poll interval or, failing those, that of the
+// default group which is defaultInterval unless a group named "default" is defined
+func sectionInterval(section string, pollGroup string, pollInterval string, definitions []common.PollGroup, defaultInterval time.Duration) (time.Duration, error) {
+	switch {
+	case pollGroup == "" && pollInterval != "":
+		interval, err := parsePollInterval(pollInterval)
+		if err != nil {
+			return 0, fmt.Errorf("%s %s", section, err)
+		}
+		return interval, nil
+	case pollGroup == "":
+		pollGroup = defaultPollGroupName
+	}
+	for _, v := range definitions {
+		if v.Name == pollGroup {
+			interval, err := parsePollInterval(v.Interval)
+			if err != nil {
+				return 0, fmt.Errorf("poll group %s %s", v.Name, err)
+			}
+			return interval, nil
+		}
+	}
+	if pollGroup == defaultPollGroupName {
+		return defaultInterval, nil
+	}
+	return 0, fmt.Errorf("%s assigned to undefined poll group %s", section, pollGroup)
+}
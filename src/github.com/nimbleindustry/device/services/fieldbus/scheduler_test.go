@@ -0,0 +1,120 @@
+package fieldbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var scheduleEpoch = time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func scheduleEntries() []common.ModbusEntry {
+	return []common.ModbusEntry{
+		{RegisterName: "LiquidTemp", PollGroup: "fast"},
+		{RegisterName: "Pressure", PollGroup: "fast"},
+		{RegisterName: "Recipe", PollGroup: "slow"},
+		{RegisterName: "Flow", PollInterval: "500ms"},
+		{RegisterName: "TankFull"},
+	}
+}
+
+func TestPollScheduleGroups(t *testing.T) {
+	definitions := []common.PollGroup{{Name: "fast", Interval: "250ms"}, {Name: "slow", Interval: "5m"}, {Name: "unused", Interval: "1s"}}
+	now := scheduleEpoch.Add(1100 * time.Millisecond)
+	schedule, err := newPollSchedule(scheduleEntries(), definitions, 5*time.Second, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(schedule.groups), "expected groups without entries to be dropped")
+
+	names := []string{}
+	for _, group := range schedule.groups {
+		names = append(names, group.name)
+	}
+	assert.Equal(t, []string{"fast", "@500ms", "default", "slow"}, names, "expected groups ordered fastest first")
+	assert.Equal(t, []int{0, 1}, schedule.groups[0].members)
+	assert.Equal(t, []int{4}, schedule.groups[2].members, "expected TankFull in the default group")
+
+	// first runs are aligned to wall-clock boundaries
+	assert.Equal(t, scheduleEpoch.Add(1250*time.Millisecond), schedule.groups[0].next)
+	assert.Equal(t, scheduleEpoch.Add(1500*time.Millisecond), schedule.groups[1].next)
+	assert.Equal(t, scheduleEpoch.Add(5*time.Second), schedule.groups[2].next)
+	assert.Equal(t, scheduleEpoch.Add(5*time.Minute), schedule.groups[3].next)
+	assert.Equal(t, 150*time.Millisecond, schedule.untilNext(now))
+}
+
+func TestPollScheduleDefaultOverride(t *testing.T) {
+	definitions := []common.PollGroup{{Name: "default", Interval: "1m"}}
+	schedule, err := newPollSchedule([]common.ModbusEntry{{RegisterName: "TankFull"}}, definitions, 5*time.Second, scheduleEpoch)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(schedule.groups))
+	assert.Equal(t, time.Minute, schedule.groups[0].interval)
+}
+
+func TestPollScheduleErrors(t *testing.T) {
+	_, err := newPollSchedule([]common.ModbusEntry{{RegisterName: "A", PollGroup: "missing"}}, nil, 5*time.Second, scheduleEpoch)
+	assert.NotNil(t, err, "expected undefined poll group to be rejected")
+	_, err = newPollSchedule([]common.ModbusEntry{{RegisterName: "A", PollInterval: "often"}}, nil, 5*time.Second, scheduleEpoch)
+	assert.NotNil(t, err, "expected invalid interval to be rejected")
+	_, err = newPollSchedule(nil, []common.PollGroup{{Name: "fast", Interval: "-1s"}}, 5*time.Second, scheduleEpoch)
+	assert.NotNil(t, err, "expected negative interval to be rejected")
+}
+
+func TestPollScheduleDueAndOverrun(t *testing.T) {
+	definitions := []common.PollGroup{{Name: "fast", Interval: "250ms"}, {Name: "slow", Interval: "5m"}}
+	schedule, err := newPollSchedule(scheduleEntries(), definitions, 5*time.Second, scheduleEpoch)
+	assert.Nil(t, err)
+
+	due := schedule.due(scheduleEpoch.Add(100 * time.Millisecond))
+	assert.Empty(t, due)
+	due = schedule.due(scheduleEpoch.Add(250 * time.Millisecond))
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "fast", due[0].name)
+
+	// a cycle that finishes within its period is rescheduled on the next boundary
+	overrun := schedule.complete(due[0], scheduleEpoch.Add(300*time.Millisecond))
+	assert.Nil(t, overrun)
+	assert.Equal(t, scheduleEpoch.Add(500*time.Millisecond), due[0].next)
+
+	// both fast groups are due at 500ms, the fast one overruns past two boundaries
+	due = schedule.due(scheduleEpoch.Add(500 * time.Millisecond))
+	assert.Equal(t, 2, len(due))
+	overrun = schedule.complete(due[0], scheduleEpoch.Add(1100*time.Millisecond))
+	assert.NotNil(t, overrun, "expected overrun")
+	assert.Equal(t, "fast", overrun.Group)
+	assert.Equal(t, 250*time.Millisecond, overrun.Interval)
+	assert.Equal(t, 600*time.Millisecond, overrun.Elapsed)
+	assert.Equal(t, 2, overrun.Missed)
+	assert.Equal(t, scheduleEpoch.Add(1250*time.Millisecond), due[0].next)
+}
+
+func TestPollDueGroupsReportsOverruns(t *testing.T) {
+	slave := newStandinSlave(1)
+	slave.inputRegisters[0] = 42
+	server, err := listenStandin(slave)
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	svc.machineIntegrations = []common.ModbusEntry{{RegisterName: "LiquidTemp", Functions: []int{4}, PollInterval: "10ms"}}
+	assert.Nil(t, svc.initBusIntegration())
+	assert.Nil(t, svc.connect())
+	// pretend the group was due long ago
+	svc.schedule.groups[0].next = time.Now().Add(-time.Second)
+
+	overruns := common.BufferedBusChannel(define.TopicPollOverrun, 1)
+	reports := watchOpsReports()
+
+	var logged []string
+	svc.logFunc = func(s string) { logged = append(logged, s) }
+	assert.Nil(t, svc.pollDueGroups())
+	report := nextOpsReport(t, reports, "LiquidTemp", nil)
+	assert.Equal(t, int16(42), report["LiquidTemp"].Value)
+	overrun := (<-overruns).(*common.PollOverrun)
+	assert.Equal(t, svc.Name, overrun.Service)
+	assert.True(t, overrun.Missed >= 99, "expected roughly 100 missed cycles")
+	assert.Equal(t, 1, len(logged))
+	assert.True(t, svc.schedule.groups[0].next.After(time.Now()), "expected group rescheduled in the future")
+}
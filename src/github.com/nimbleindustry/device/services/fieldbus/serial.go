@@ -0,0 +1,450 @@
+package fieldbus
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/serial"
+	"github.com/nimbleindustry/suture"
+)
+
+const (
+	serialDefaultBaudrate = 9600
+	serialDefaultDataBits = 8
+	serialDefaultParity   = "N"
+	serialDefaultStopBits = 1
+	serialDefaultTimeout  = time.Second            // the time a polled device has to respond
+	serialReadTimeout     = 250 * time.Millisecond // the longest a read blocks, bounding the time to close
+	serialReadSize        = 256
+)
+
+// SerialService reads the devices of the equipment config's serial section, each on its own
+// serial port: scales, barcode readers and legacy controllers emitting ASCII or binary
+// records. Each record is split from the bytes received by the device's framing, checked
+// against its checksum, and the fields extracted from it reported on TopicOpsReport. Devices
+// with a command are polled, the others read as they emit records. A port that cannot be
+// opened, or fails, is reopened with exponential backoff.
+type SerialService struct {
+	common.Service
+
+	StartDelay time.Duration // Duration to delay prior to starting the service
+	LogFunc    func(string)  // Destination for logging
+
+	stop       chan bool
+	configs    []common.SerialIntegration
+	pollGroups []common.PollGroup
+	readers    []*serialReader
+}
+
+// Serve is called by this service's supervisor—it should not be called directly.
+// Exiting or panicing from this function will force the supervisor to attempt to restart.
+func (svc *SerialService) Serve() {
+	svc.ServiceState = suture.ServiceNotRunning
+
+	// timeout, if spec'd, can be used ease initialization and avoid race conditions
+	if svc.StartDelay > 0 {
+		svc.LogFunc(fmt.Sprintf("%s delays start for %s", svc.Name, svc.StartDelay))
+		time.Sleep(svc.StartDelay)
+	}
+
+	// if services that this service depends on were specified, wait for them to start
+	if !svc.WaitForServices() {
+		svc.LogFunc(fmt.Sprintf("%s exits as one or more dependent services not found", svc.Name))
+		return
+	}
+
+	// this channel used to interrupt for/select loop
+	svc.stop = make(chan bool)
+
+	svc.reload()
+	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
+	configs := common.BusChannel(define.EquipmentConfigUpdated)
+	for {
+		// important to set the state here for dependent services
+		svc.ServiceState = suture.ServiceNormal
+		select {
+		case <-svc.stop:
+			svc.ServiceState = suture.ServiceNotRunning
+			// Clean up resources here, know that Serve will get called again
+			svc.closeReaders()
+			return
+		case <-configs:
+			svc.reload()
+		}
+	}
+}
+
+// Stop is called by a supervisor to signal that the service should be stopped. Every
+// effort should be made to clean up resources and put the service in a state in which
+// it could be restarted.
+func (svc *SerialService) Stop() {
+	svc.LogFunc(fmt.Sprintf("%s stops as directed by supervisor", svc.Name))
+	svc.stop <- true
+}
+
+// State returns the state of service
+func (svc *SerialService) State() int {
+	return svc.ServiceState
+}
+
+// reload (re)starts the readers if their configuration has changed. Devices whose
+// configuration is invalid are not read.
+func (svc *SerialService) reload() {
+	integration := common.EquipmentConfig.MachineIntegrations
+	if reflect.DeepEqual(integration.Serial, svc.configs) && reflect.DeepEqual(integration.PollGroups, svc.pollGroups) {
+		return
+	}
+	svc.closeReaders()
+	svc.configs, svc.pollGroups = integration.Serial, integration.PollGroups
+	if len(svc.configs) == 0 {
+		svc.LogFunc(fmt.Sprintf("%s idles, no serial device is configured", svc.Name))
+		return
+	}
+	tags := make(map[string]string)
+	for _, config := range svc.configs {
+		reader, err := newSerialReader(config, svc.pollGroups, svc.LogFunc)
+		if err == nil {
+			for _, v := range reader.fields {
+				if other, found := tags[v.TagName]; found {
+					err = fmt.Errorf("%s is also defined by %s", v.TagName, other)
+					break
+				}
+			}
+		}
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s warns: unable to read serial port %s, %s", svc.Name, config.Endpoint, err))
+			continue
+		}
+		for _, v := range reader.fields {
+			tags[v.TagName] = reader.name
+		}
+		svc.readers = append(svc.readers, reader)
+		go reader.run()
+	}
+}
+
+func (svc *SerialService) closeReaders() {
+	for _, reader := range svc.readers {
+		reader.close()
+	}
+	svc.readers = nil
+}
+
+// serialReader reads the records of the device on a serial port, reporting their fields
+type serialReader struct {
+	name     string // that of the service, qualified by the port, e.g. SerialService[/dev/ttyUSB0]
+	config   common.SerialIntegration
+	fields   []serialField
+	command  []byte        // sent to poll the device, nil if it is not polled
+	interval time.Duration // between polls
+	timeout  time.Duration // for a response to a poll, or between records of a device not polled
+	logFunc  func(string)
+	open     func(config common.SerialIntegration) (io.ReadWriteCloser, error)
+
+	stop       chan struct{}
+	done       chan struct{}
+	lastValues map[string]common.TagValue // last value of each tag, for stale reporting
+	fieldbusMonitor
+}
+
+// newSerialReader validates the configuration of a device, returning its reader
+func newSerialReader(config common.SerialIntegration, pollGroups []common.PollGroup, logFunc func(string)) (*serialReader, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("serial device has no endpoint")
+	}
+	r := &serialReader{config: config, logFunc: logFunc, open: openSerialPort}
+	r.name = fmt.Sprintf("%s[%s]", define.SerialServiceName, config.Endpoint)
+	if config.Name != "" {
+		r.name = fmt.Sprintf("%s[%s]", define.SerialServiceName, config.Name)
+	}
+	if _, err := newSerialFramer(config.Framing); err != nil {
+		return nil, err
+	}
+	if err := validateChecksum(config.Checksum); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.fields, err = newSerialFields(config.Fields); err != nil {
+		return nil, err
+	}
+	if len(r.fields) == 0 {
+		return nil, errors.New("serial device has no fields")
+	}
+	if config.Timeout != "" {
+		if r.timeout, err = parsePollInterval(config.Timeout); err != nil {
+			return nil, fmt.Errorf("timeout %s", err)
+		}
+	}
+	switch {
+	case config.CommandHex != "":
+		if r.command, err = hex.DecodeString(config.CommandHex); err != nil {
+			return nil, fmt.Errorf("commandHex %q is not hexadecimal", config.CommandHex)
+		}
+	case config.Command != "":
+		r.command = []byte(config.Command)
+	}
+	if r.command != nil {
+		section := "serial device " + config.Endpoint
+		if r.interval, err = sectionInterval(section, config.PollGroup, config.PollInterval, pollGroups, modbusSampleFrequency); err != nil {
+			return nil, err
+		}
+		if r.timeout == 0 {
+			r.timeout = serialDefaultTimeout
+		}
+	}
+	r.backoff = reconnectBackoff{min: fieldbusReconnectMinDelay, max: fieldbusReconnectMaxDelay}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	return r, nil
+}
+
+// openSerialPort opens the port of a device with its settings, reads timing out so as not to
+// block indefinitely
+func openSerialPort(config common.SerialIntegration) (io.ReadWriteCloser, error) {
+	c := &serial.Config{Address: config.Endpoint, BaudRate: config.Baudrate, DataBits: config.DataBits,
+		StopBits: config.StopBits, Parity: config.Parity, Timeout: serialReadTimeout}
+	if c.BaudRate == 0 {
+		c.BaudRate = serialDefaultBaudrate
+	}
+	if c.DataBits == 0 {
+		c.DataBits = serialDefaultDataBits
+	}
+	if c.StopBits == 0 {
+		c.StopBits = serialDefaultStopBits
+	}
+	if c.Parity == "" {
+		c.Parity = serialDefaultParity
+	}
+	return serial.Open(c)
+}
+
+// run opens the port and reads the device until the reader is closed, reopening the port
+// with backoff should it fail
+func (r *serialReader) run() {
+	defer close(r.done)
+	diagnostics := time.NewTicker(common.DiagnosticsInterval)
+	defer diagnostics.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-diagnostics.C:
+			r.publishDiagnostics(r.name, r.config.Endpoint)
+		case <-time.After(r.untilReconnect(time.Now())):
+			port := r.connect()
+			if port == nil {
+				continue
+			}
+			err := r.serve(port, diagnostics.C)
+			port.Close()
+			if err == nil {
+				r.logFunc(fmt.Sprintf("%s closes serial port %s", r.name, r.config.Endpoint))
+				r.publishState(r.name, r.config.Endpoint, define.ConnectionDisconnected, nil)
+				return
+			}
+			r.lose(err)
+		}
+	}
+}
+
+// close stops the reader, waiting for it to close its port
+func (r *serialReader) close() {
+	close(r.stop)
+	<-r.done
+}
+
+// untilReconnect returns how long until the port may be reopened
+func (r *serialReader) untilReconnect(now time.Time) time.Duration {
+	if wait := r.backoff.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// connect opens the port, returning nil if it cannot be opened, in which case the failure is
+// reported and every tag reported stale
+func (r *serialReader) connect() io.ReadWriteCloser {
+	port, err := r.open(r.config)
+	if err != nil {
+		countOutcome(&r.diagnostics.FieldbusCounters, err)
+		delay := r.backoff.failed(time.Now())
+		r.logFunc(fmt.Sprintf("%s warns: unable to open serial port %s, retrying in %s: %s", r.name, r.config.Endpoint, delay, err))
+		r.publishState(r.name, r.config.Endpoint, define.ConnectionDisconnected, err)
+		sendOpsReport(r.name, r.staleReport(err))
+		return nil
+	}
+	r.backoff.succeeded()
+	r.countConnect()
+	r.logFunc(fmt.Sprintf("%s opens serial port %s", r.name, r.config.Endpoint))
+	r.publishState(r.name, r.config.Endpoint, define.ConnectionConnected, nil)
+	return port
+}
+
+// serve reads the records of the device from an open port, polling it if it has a command,
+// until the reader is closed (returning nil) or the port fails
+func (r *serialReader) serve(port io.ReadWriter, diagnostics <-chan time.Time) error {
+	framer, _ := newSerialFramer(r.config.Framing)
+	chunks := make(chan []byte)
+	failed := make(chan error, 1)
+	closed := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		readChunks(port, chunks, failed, closed)
+		close(exited)
+	}()
+	// the port is closed once it is no longer being read
+	defer func() {
+		close(closed)
+		<-exited
+	}()
+
+	// timeout fires should a polled device not respond, or a device emitting records fall silent
+	var poll, timeout <-chan time.Time
+	if r.command != nil {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		poll = ticker.C
+		if err := r.poll(port, framer); err != nil {
+			return err
+		}
+	}
+	if r.timeout > 0 {
+		timeout = time.After(r.timeout)
+	}
+	for {
+		select {
+		case <-r.stop:
+			return nil
+		case err := <-failed:
+			return err
+		case <-diagnostics:
+			r.publishDiagnostics(r.name, r.config.Endpoint)
+		case <-poll:
+			// a device still to respond to the last poll is not polled again
+			if timeout == nil {
+				if err := r.poll(port, framer); err != nil {
+					return err
+				}
+				timeout = time.After(r.timeout)
+			}
+		case <-timeout:
+			countOutcome(&r.diagnostics.FieldbusCounters, serial.ErrTimeout)
+			sendOpsReport(r.name, r.staleReport(fmt.Errorf("no record received in %s", r.timeout)))
+			timeout = nil
+		case b := <-chunks:
+			framer.write(b)
+			for {
+				record, err := framer.next()
+				if err != nil {
+					countOutcome(&r.diagnostics.FieldbusCounters, err)
+					continue
+				}
+				if record == nil {
+					break
+				}
+				if r.report(record) {
+					timeout = nil
+					if r.command == nil && r.timeout > 0 {
+						timeout = time.After(r.timeout)
+					}
+				}
+			}
+		}
+	}
+}
+
+// poll sends the device its command, discarding any partial record
+func (r *serialReader) poll(port io.Writer, framer *serialFramer) error {
+	framer.reset()
+	_, err := port.Write(r.command)
+	return err
+}
+
+// readChunks passes the bytes read from a port to the reader until the port fails, which is
+// passed on failed, or the reader is done with the port
+func readChunks(port io.Reader, chunks chan<- []byte, failed chan<- error, closed <-chan struct{}) {
+	for {
+		b := make([]byte, serialReadSize)
+		n, err := port.Read(b)
+		if err != nil && err != serial.ErrTimeout {
+			failed <- err
+			return
+		}
+		if n > 0 {
+			select {
+			case chunks <- b[:n]:
+			case <-closed:
+				return
+			}
+			continue
+		}
+		select {
+		case <-closed:
+			return
+		default:
+		}
+	}
+}
+
+// report sends the fields of a record on TopicOpsReport, returning false if the record fails
+// its checksum
+func (r *serialReader) report(record []byte) bool {
+	data, err := verifyChecksum(r.config.Checksum, record)
+	countOutcome(&r.diagnostics.FieldbusCounters, err)
+	if err != nil {
+		return false
+	}
+	report := make(common.OpsReport)
+	for _, v := range r.fields {
+		value, found := v.extract(data)
+		if !found {
+			continue
+		}
+		if value.Quality == define.QualityBad {
+			r.count(v.TagName, errors.New(value.Error))
+		} else {
+			r.count(v.TagName, nil)
+			if r.lastValues == nil {
+				r.lastValues = make(map[string]common.TagValue)
+			}
+			r.lastValues[v.TagName] = value
+		}
+		report[v.TagName] = value
+	}
+	if len(report) > 0 {
+		sendOpsReport(r.name, report)
+	}
+	return true
+}
+
+// lose reports the failure of the port, and every tag stale; the port is reopened once the
+// backoff allows
+func (r *serialReader) lose(err error) {
+	countOutcome(&r.diagnostics.FieldbusCounters, err)
+	r.backoff.failed(time.Now())
+	r.logFunc(fmt.Sprintf("%s loses serial port %s: %s", r.name, r.config.Endpoint, err))
+	r.publishState(r.name, r.config.Endpoint, define.ConnectionDisconnected, err)
+	sendOpsReport(r.name, r.staleReport(err))
+}
+
+// staleReport reports every field as stale, carrying its last value forward, or bad if it has
+// none
+func (r *serialReader) staleReport(reason error) common.OpsReport {
+	m := make(common.OpsReport, len(r.fields))
+	for _, v := range r.fields {
+		last, found := r.lastValues[v.TagName]
+		if !found {
+			m[v.TagName] = v.badValue(reason)
+			continue
+		}
+		m[v.TagName] = common.TagValue{Value: last.Value, Unit: v.Unit, Quality: define.QualityStale, Error: reason.Error()}
+	}
+	return m
+}
@@ -0,0 +1,133 @@
+package fieldbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serialEquipmentFixture is a scale emitting its weight as ASCII lines, and a controller
+// polled for a length prefixed binary record ending with a CRC
+const serialEquipmentFixture = `{
+	"ref": "serial",
+	"machineIntegration": {
+		"serial": [
+			{
+				"endpoint": "%s", "baudRate": 115200,
+				"framing": {"type": "delimiter"},
+				"fields": [
+					{"tagName": "Weight", "pattern": "([-+]?\\d+\\.\\d+)\\s*kg", "unit": "kg"},
+					{"tagName": "Stable", "pattern": "^(ST|US)", "dataType": "string"}
+				]
+			},
+			{
+				"endpoint": "%s", "baudRate": 115200,
+				"framing": {"type": "lengthPrefixed"},
+				"checksum": {"type": "crc16"},
+				"commandHex": "0152", "pollInterval": "50ms", "timeout": "100ms",
+				"fields": [
+					{"tagName": "Count", "offset": 0, "dataType": "uint16"},
+					{"tagName": "Temperature", "offset": 2, "dataType": "int16", "multiplier": 0.1, "unit": "°C"}
+				]
+			}
+		]
+	}
+}`
+
+// openSerialPty returns the master side of a pseudo-terminal and the path of its slave side,
+// held open so the master does not see a hangup while the service reopens it
+func openSerialPty(t *testing.T) (*os.File, string, func()) {
+	master, slavePath, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	keepAlive, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	assert.Nil(t, err, "unable to open pty slave")
+	return master, slavePath, func() {
+		keepAlive.Close()
+		master.Close()
+	}
+}
+
+func TestSerialServiceReadsDevices(t *testing.T) {
+	scale, scalePath, closeScale := openSerialPty(t)
+	defer closeScale()
+	controller, controllerPath, closeController := openSerialPty(t)
+	defer closeController()
+
+	common.EquipmentConfig = common.Equipment{}
+	err := json.Unmarshal([]byte(fmt.Sprintf(serialEquipmentFixture, scalePath, controllerPath)), &common.EquipmentConfig)
+	assert.Nil(t, err, "unmarshall failed")
+	reports := watchOpsReports()
+
+	// the scale emits its weight until told to stop
+	stopScale := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stopScale:
+				return
+			case <-time.After(20 * time.Millisecond):
+				scale.Write([]byte("ST,GS,+0012.34 kg\r\n"))
+			}
+		}
+	}()
+	defer close(stopScale)
+
+	// the controller answers each poll with its count and temperature, until the tenth
+	polls := make(chan []byte, 16)
+	go func() {
+		b := make([]byte, 16)
+		for n := 0; n < 10; n++ {
+			count, err := controller.Read(b)
+			if err != nil {
+				return
+			}
+			polls <- append([]byte(nil), b[:count]...)
+			data := []byte{0x00, byte(n), 0xFF, 0x0A}
+			controller.Write(append(append([]byte{byte(len(data) + 2)}, data...), computeChecksum(common.SerialChecksumCRC16, data)...))
+		}
+	}()
+
+	svc := &SerialService{LogFunc: func(s string) { t.Log(s) }}
+	svc.Name = define.SerialServiceName
+	served := make(chan bool)
+	go func() {
+		svc.Serve()
+		close(served)
+	}()
+	// the readers close their ports before those of the pseudo-terminals are closed
+	defer func() {
+		svc.Stop()
+		<-served
+	}()
+
+	report := nextOpsReport(t, reports, "Weight", nil)
+	source := define.SerialServiceName + "[" + scalePath + "]"
+	assert.Equal(t, common.TagValue{Value: 12.34, Unit: "kg", Quality: define.QualityGood, Source: source}, report["Weight"])
+	assert.Equal(t, common.TagValue{Value: "ST", Quality: define.QualityGood, Source: source}, report["Stable"])
+
+	report = nextOpsReport(t, reports, "Temperature", nil)
+	assert.Equal(t, define.QualityGood, report["Count"].Quality)
+	assert.InDelta(t, -24.6, report["Temperature"].Value, 1e-9)
+	assert.Equal(t, []byte{0x01, 0x52}, <-polls)
+
+	// a controller that stops answering is reported stale
+	for {
+		report = nextOpsReport(t, reports, "Count", nil)
+		if report["Count"].Quality != define.QualityGood {
+			break
+		}
+	}
+	assert.Equal(t, define.QualityStale, report["Count"].Quality)
+	assert.Equal(t, uint16(9), report["Count"].Value)
+	assert.True(t, strings.Contains(report["Count"].Error, "no record received"), report["Count"].Error)
+}
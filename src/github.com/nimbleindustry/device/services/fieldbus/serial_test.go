@@ -0,0 +1,147 @@
+package fieldbus
+
+import (
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// framedRecords returns the records framed from the passed chunks of bytes, and the number of
+// framing errors
+func framedRecords(t *testing.T, framing common.SerialFraming, chunks ...string) ([]string, int) {
+	framer, err := newSerialFramer(framing)
+	assert.Nil(t, err)
+	var records []string
+	var errs int
+	for _, chunk := range chunks {
+		framer.write([]byte(chunk))
+		for {
+			record, err := framer.next()
+			if err != nil {
+				errs++
+				continue
+			}
+			if record == nil {
+				break
+			}
+			records = append(records, string(record))
+		}
+	}
+	return records, errs
+}
+
+func TestSerialFraming(t *testing.T) {
+	records, errs := framedRecords(t, common.SerialFraming{Type: common.SerialFramingDelimiter},
+		"ST,GS,+12.3", "4 kg\r\n\r\nUS,GS", ",+12.35 kg\r\n")
+	assert.Equal(t, []string{"ST,GS,+12.34 kg", "US,GS,+12.35 kg"}, records)
+	assert.Equal(t, 0, errs)
+
+	records, errs = framedRecords(t, common.SerialFraming{Type: common.SerialFramingDelimiter, Delimiter: ";", MaxLength: 4},
+		"ab;toolong", "x;cd;")
+	assert.Equal(t, []string{"ab", "cd"}, records)
+	assert.Equal(t, 1, errs)
+
+	records, _ = framedRecords(t, common.SerialFraming{Type: common.SerialFramingFixed, Length: 3}, "abcd", "efghi")
+	assert.Equal(t, []string{"abc", "def", "ghi"}, records)
+
+	records, _ = framedRecords(t, common.SerialFraming{Type: common.SerialFramingSTXETX},
+		"noise\x02one\x03\x02tw", "o\x03\x03\x02three\x03")
+	assert.Equal(t, []string{"one", "two", "three"}, records)
+
+	records, _ = framedRecords(t, common.SerialFraming{Type: common.SerialFramingLengthPrefixed}, "\x03abc\x00\x02d", "e")
+	assert.Equal(t, []string{"abc", "", "de"}, records)
+	records, errs = framedRecords(t, common.SerialFraming{Type: common.SerialFramingLengthPrefixed, LengthBytes: 2,
+		LengthAdjust: -2, MaxLength: 8}, "\x00\x05abc\x00\xFFxyz", "\x00\x04de")
+	assert.Equal(t, []string{"abc", "de"}, records)
+	assert.Equal(t, 1, errs)
+
+	for _, framing := range []common.SerialFraming{
+		{},
+		{Type: "slip"},
+		{Type: common.SerialFramingFixed},
+		{Type: common.SerialFramingLengthPrefixed, LengthBytes: 4},
+		{Type: common.SerialFramingDelimiter, MaxLength: -1},
+	} {
+		_, err := newSerialFramer(framing)
+		assert.NotNil(t, err, "%v", framing)
+	}
+}
+
+func TestSerialChecksums(t *testing.T) {
+	data := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}
+	for _, v := range []struct {
+		checksumType string
+		expected     []byte
+	}{
+		{common.SerialChecksumSum8, []byte{0x0E}},
+		{common.SerialChecksumXOR8, []byte{0x08}},
+		{common.SerialChecksumLRC, []byte{0xF2}},
+		{common.SerialChecksumCRC16, []byte{0xC5, 0xCD}},
+	} {
+		assert.Equal(t, v.expected, computeChecksum(v.checksumType, data), v.checksumType)
+	}
+
+	record, err := verifyChecksum(&common.SerialChecksum{Type: common.SerialChecksumXOR8, Hex: true, Start: 1},
+		[]byte("$GPS,1*73"))
+	assert.Nil(t, err)
+	assert.Equal(t, "$GPS,1*", string(record))
+	_, err = verifyChecksum(&common.SerialChecksum{Type: common.SerialChecksumXOR8, Hex: true, Start: 1}, []byte("$GPS,2*73"))
+	assert.NotNil(t, err)
+	assert.IsType(t, &checksumError{}, err)
+	_, err = verifyChecksum(&common.SerialChecksum{Type: common.SerialChecksumCRC16}, []byte{0x01})
+	assert.NotNil(t, err)
+	assert.NotNil(t, validateChecksum(&common.SerialChecksum{Type: "md5"}))
+}
+
+func TestSerialFieldExtraction(t *testing.T) {
+	fields, err := newSerialFields([]common.SerialField{
+		{TagName: "Weight", Pattern: `([-+]?\d+\.\d+)\s*kg`, Scaling: common.Scaling{Unit: "kg"}},
+		{TagName: "Stable", Pattern: `^ST`, DataType: common.DataTypeString},
+		{TagName: "Gross", Offset: 3, Length: 2, DataType: common.DataTypeString},
+		{TagName: "Count", Offset: 0, DataType: common.DataTypeUint16},
+		{TagName: "Temperature", Offset: 2, DataType: common.DataTypeInt16, LittleEndian: true,
+			Scaling: common.Scaling{Multiplier: 0.1, Unit: "°C"}},
+	})
+	assert.Nil(t, err)
+
+	values := make(map[string]common.TagValue)
+	for _, v := range fields[:3] {
+		if value, found := v.extract([]byte("ST,GS,+0012.34 kg")); found {
+			values[v.TagName] = value
+		}
+	}
+	assert.Equal(t, map[string]common.TagValue{
+		"Weight": {Value: 12.34, Unit: "kg", Quality: define.QualityGood},
+		"Stable": {Value: "ST", Quality: define.QualityGood},
+		"Gross":  {Value: "GS", Quality: define.QualityGood},
+	}, values)
+	_, found := fields[1].extract([]byte("US,GS,+0012.34 kg"))
+	assert.False(t, found, "expected a record not matching the pattern to omit the field")
+	value, _ := fields[3].extract([]byte{0x01, 0x02, 0x0A, 0xFF})
+	assert.Equal(t, uint16(258), value.Value)
+	value, _ = fields[4].extract([]byte{0x01, 0x02, 0x0A, 0xFF})
+	assert.InDelta(t, -24.6, value.Value, 1e-9)
+	value, _ = fields[4].extract([]byte{0x01, 0x02, 0x0A})
+	assert.Equal(t, define.QualityBad, value.Quality)
+
+	number, _ := newSerialFields([]common.SerialField{{TagName: "Level", Offset: 2}})
+	value, _ = number[0].extract([]byte("L= 42.5 "))
+	assert.Equal(t, 42.5, value.Value)
+	value, _ = number[0].extract([]byte("L=??"))
+	assert.Equal(t, define.QualityBad, value.Quality)
+
+	for _, definitions := range [][]common.SerialField{
+		{{Pattern: "x"}},
+		{{TagName: "A"}, {TagName: "A"}},
+		{{TagName: "A", Pattern: "("}},
+		{{TagName: "A", Pattern: "x", DataType: common.DataTypeFloat32}},
+		{{TagName: "A", DataType: common.DataTypeBits}},
+		{{TagName: "A", Offset: -1}},
+	} {
+		_, err := newSerialFields(definitions)
+		assert.NotNil(t, err, "%v", definitions)
+	}
+}
@@ -0,0 +1,173 @@
+package fieldbus
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/serial"
+)
+
+// serialLine is an open serial port shared by every service addressing slaves on it: the
+// ModbusRTUService polling the line and the ModbusBridgeService forwarding tcp requests to
+// it. Send serializes transactions, so that the requests of one service never collide with
+// those of another on the bus.
+//
+// The line reads responses itself, framed by readRTUFrame, rather than through the
+// transporter supplied with goburrow/modbus: that transporter sizes a response from a table
+// of function codes, and reads 4 bytes of any other, leaving the rest of the response to
+// corrupt the next transaction.
+type serialLine struct {
+	endpoint string
+	port     serial.Port
+	timeout  time.Duration // for a slave to answer
+	mutex    sync.Mutex    // held for the duration of a transaction
+	err      error         // that failed the port, guarded by mutex
+	users    int           // guarded by serialLines
+}
+
+// serialLines are the open serial lines, keyed by endpoint
+var serialLines = struct {
+	sync.Mutex
+	open map[string]*serialLine
+}{open: make(map[string]*serialLine)}
+
+// openSerialLine returns the serial line of the record's endpoint, opening its port with the
+// record's settings unless another service already has. Each successful call must be paired
+// with a call to release.
+func openSerialLine(record common.ConnectionRecord) (*serialLine, error) {
+	serialLines.Lock()
+	defer serialLines.Unlock()
+	if line, found := serialLines.open[record.Endpoint]; found {
+		line.users++
+		return line, nil
+	}
+	// the port times out reads after the silence between frames, which lets Send drop stale
+	// input without waiting on a slave
+	config := newRTUClientHandler(record).Config
+	line := &serialLine{endpoint: record.Endpoint, timeout: config.Timeout, users: 1}
+	config.Timeout = rtuFrameSilence(config.BaudRate)
+	port, err := serial.Open(&config)
+	if err != nil {
+		return nil, err
+	}
+	line.port = port
+	serialLines.open[record.Endpoint] = line
+	return line, nil
+}
+
+// rtuFrameSilence returns the silence of 3.5 characters that separates rtu frames, fixed at
+// 1750µs above 19200 baud
+func rtuFrameSilence(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(35000000/baudRate) * time.Microsecond
+}
+
+// Send writes the request ADU and reads the response ADU, waiting for any transaction in
+// progress on the line to complete. Input left over from an earlier transaction, such as the
+// late answer of a slave that timed out, is dropped first. Should reading or writing the port
+// fail, other than by a slave not answering in time, the port is closed and the line fails;
+// the services using it open the port anew.
+func (line *serialLine) Send(aduRequest []byte) ([]byte, error) {
+	line.mutex.Lock()
+	defer line.mutex.Unlock()
+	if line.err != nil {
+		return nil, line.err
+	}
+	r := &lineReader{port: line.port}
+	if err := r.drain(); err != nil {
+		return nil, line.fail(err)
+	}
+	if _, err := line.port.Write(aduRequest); err != nil {
+		return nil, line.fail(err)
+	}
+	r.deadline = time.Now().Add(line.timeout)
+	aduResponse, err := readRTUFrame(r)
+	if r.err != nil {
+		return nil, line.fail(r.err)
+	}
+	return aduResponse, err
+}
+
+// fail closes the port and fails the line with err, returning err. The mutex must be held.
+func (line *serialLine) fail(err error) error {
+	line.err = err
+	serialLines.Lock()
+	if serialLines.open[line.endpoint] == line {
+		delete(serialLines.open, line.endpoint)
+	}
+	serialLines.Unlock()
+	line.port.Close()
+	return err
+}
+
+// Err returns the error that failed the serial port, nil while it is open. Slaves not
+// answering do not fail the port.
+func (line *serialLine) Err() error {
+	line.mutex.Lock()
+	defer line.mutex.Unlock()
+	return line.err
+}
+
+// Close releases the line, as release does
+func (line *serialLine) Close() error {
+	return line.release()
+}
+
+// release closes the serial port once every service that opened the line has released it
+func (line *serialLine) release() error {
+	serialLines.Lock()
+	defer serialLines.Unlock()
+	if line.users--; line.users > 0 {
+		return nil
+	}
+	if serialLines.open[line.endpoint] == line {
+		delete(serialLines.open, line.endpoint)
+	}
+	return line.port.Close()
+}
+
+// lineReader reads a response from a port whose reads time out after the silence between
+// frames, retrying until the deadline passes. Errors of the port itself, rather than of a
+// slave not answering in time, are kept in err.
+type lineReader struct {
+	port     serial.Port
+	deadline time.Time
+	err      error
+}
+
+func (r *lineReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.port.Read(b)
+		switch {
+		case err == serial.ErrTimeout:
+			if time.Now().Before(r.deadline) {
+				continue
+			}
+		case err != nil:
+			r.err = err
+		case n == 0:
+			// a hung up terminal reads nothing, rather than blocking
+			r.err = io.EOF
+			err = r.err
+		}
+		return n, err
+	}
+}
+
+// drain drops any input until the line has been silent for the time separating frames
+func (r *lineReader) drain() error {
+	var b [modbusRTUMaxLength]byte
+	for {
+		if _, err := r.Read(b[:]); err != nil {
+			if err == serial.ErrTimeout {
+				return nil
+			}
+			return err
+		}
+	}
+}
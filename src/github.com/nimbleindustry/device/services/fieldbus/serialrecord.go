@@ -0,0 +1,365 @@
+package fieldbus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+)
+
+const (
+	serialDefaultDelimiter = "\r\n"
+	serialDefaultMaxLength = 1024
+	serialSTX              = 0x02
+	serialETX              = 0x03
+)
+
+// serialFramer splits the bytes received from a serial port into records
+type serialFramer struct {
+	framing   common.SerialFraming
+	delimiter []byte
+	maxLength int
+	buffer    []byte
+	skipping  bool // the rest of an overlong delimited record is being discarded
+}
+
+// newSerialFramer returns a framer for the passed framing, which it validates
+func newSerialFramer(framing common.SerialFraming) (*serialFramer, error) {
+	f := &serialFramer{framing: framing, maxLength: framing.MaxLength}
+	if f.maxLength == 0 {
+		f.maxLength = serialDefaultMaxLength
+	}
+	switch framing.Type {
+	case common.SerialFramingDelimiter:
+		f.delimiter = []byte(framing.Delimiter)
+		if len(f.delimiter) == 0 {
+			f.delimiter = []byte(serialDefaultDelimiter)
+		}
+	case common.SerialFramingFixed:
+		if framing.Length < 1 {
+			return nil, fmt.Errorf("fixed framing has invalid length %d", framing.Length)
+		}
+		f.maxLength = framing.Length
+	case common.SerialFramingSTXETX:
+	case common.SerialFramingLengthPrefixed:
+		if framing.LengthBytes == 0 {
+			f.framing.LengthBytes = 1
+		}
+		if f.framing.LengthBytes != 1 && f.framing.LengthBytes != 2 {
+			return nil, fmt.Errorf("length prefix of %d bytes, expected 1 or 2", framing.LengthBytes)
+		}
+	case "":
+		return nil, errors.New("has no framing type")
+	default:
+		return nil, fmt.Errorf("has unknown framing type %s", framing.Type)
+	}
+	if f.maxLength < 1 {
+		return nil, fmt.Errorf("has invalid maximum record length %d", framing.MaxLength)
+	}
+	return f, nil
+}
+
+// write adds the bytes received to those awaiting framing
+func (f *serialFramer) write(b []byte) {
+	f.buffer = append(f.buffer, b...)
+}
+
+// reset discards the bytes of any partial record
+func (f *serialFramer) reset() {
+	f.buffer = f.buffer[:0]
+}
+
+// next returns the next complete record received, nil if there is none. Bytes that cannot
+// start a record are discarded, as are records longer than the maximum length, which are
+// reported as an error.
+func (f *serialFramer) next() ([]byte, error) {
+	for {
+		var start, end, length int
+		switch f.framing.Type {
+		case common.SerialFramingDelimiter:
+			end = bytes.Index(f.buffer, f.delimiter)
+			if end < 0 {
+				return nil, f.overflow(len(f.buffer) - len(f.delimiter) + 1)
+			}
+			length = end + len(f.delimiter)
+			if f.skipping {
+				f.consume(length)
+				f.skipping = false
+				continue
+			}
+		case common.SerialFramingFixed:
+			if len(f.buffer) < f.framing.Length {
+				return nil, nil
+			}
+			end, length = f.framing.Length, f.framing.Length
+		case common.SerialFramingSTXETX:
+			if i := bytes.IndexByte(f.buffer, serialSTX); i != 0 {
+				if i < 0 {
+					i = len(f.buffer)
+				}
+				f.consume(i)
+			}
+			end = bytes.IndexByte(f.buffer, serialETX)
+			if end < 0 {
+				return nil, f.overflow(len(f.buffer) - 1)
+			}
+			start, length = 1, end+1
+		case common.SerialFramingLengthPrefixed:
+			start = f.framing.LengthBytes
+			if len(f.buffer) < start {
+				return nil, nil
+			}
+			n := int(f.buffer[0])
+			if start == 2 {
+				n = int(f.buffer[0])<<8 | int(f.buffer[1])
+			}
+			n += f.framing.LengthAdjust
+			if n < 0 || n > f.maxLength {
+				f.reset()
+				return nil, fmt.Errorf("record length %d out of range", n)
+			}
+			if len(f.buffer) < start+n {
+				return nil, nil
+			}
+			end, length = start+n, start+n
+		}
+		record := make([]byte, end-start)
+		copy(record, f.buffer[start:end])
+		f.consume(length)
+		if len(record) > f.maxLength {
+			return nil, fmt.Errorf("record of %d bytes exceeds %d", len(record), f.maxLength)
+		}
+		// blank lines are not records
+		if len(record) > 0 || f.framing.Type != common.SerialFramingDelimiter {
+			return record, nil
+		}
+	}
+}
+
+// overflow discards the bytes of a partial record once it exceeds the maximum length, along
+// with those of the record still to be received
+func (f *serialFramer) overflow(length int) error {
+	if f.skipping {
+		f.reset()
+		return nil
+	}
+	if length <= f.maxLength {
+		return nil
+	}
+	f.reset()
+	f.skipping = f.framing.Type == common.SerialFramingDelimiter
+	return fmt.Errorf("record exceeds %d bytes", f.maxLength)
+}
+
+func (f *serialFramer) consume(n int) {
+	f.buffer = f.buffer[:copy(f.buffer, f.buffer[n:])]
+}
+
+// validateChecksum checks that a checksum definition can be computed
+func validateChecksum(c *common.SerialChecksum) error {
+	if c == nil {
+		return nil
+	}
+	if checksumSize(c.Type) == 0 {
+		return fmt.Errorf("has unknown checksum type %s", c.Type)
+	}
+	if c.Start < 0 {
+		return fmt.Errorf("checksum has invalid start %d", c.Start)
+	}
+	return nil
+}
+
+// checksumSize returns the size in bytes of a binary checksum, 0 if the type is unknown
+func checksumSize(checksumType string) int {
+	switch checksumType {
+	case common.SerialChecksumSum8, common.SerialChecksumXOR8, common.SerialChecksumLRC:
+		return 1
+	case common.SerialChecksumCRC16:
+		return 2
+	}
+	return 0
+}
+
+// computeChecksum returns the binary checksum of the passed bytes
+func computeChecksum(checksumType string, b []byte) []byte {
+	var sum, xor byte
+	for _, v := range b {
+		sum += v
+		xor ^= v
+	}
+	switch checksumType {
+	case common.SerialChecksumSum8:
+		return []byte{sum}
+	case common.SerialChecksumXOR8:
+		return []byte{xor}
+	case common.SerialChecksumLRC:
+		return []byte{-sum}
+	}
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return []byte{byte(crc), byte(crc >> 8)}
+}
+
+// verifyChecksum checks the checksum ending a record, returning the record without it
+func verifyChecksum(c *common.SerialChecksum, record []byte) ([]byte, error) {
+	if c == nil {
+		return record, nil
+	}
+	size := checksumSize(c.Type)
+	if c.Hex {
+		size *= 2
+	}
+	if len(record) < c.Start+size {
+		return nil, fmt.Errorf("record of %d bytes too short for its checksum", len(record))
+	}
+	data, received := record[:len(record)-size], record[len(record)-size:]
+	expected := computeChecksum(c.Type, data[c.Start:])
+	if c.Hex {
+		text := strings.ToUpper(hex.EncodeToString(expected))
+		if !strings.EqualFold(text, string(received)) {
+			return nil, &checksumError{what: "record checksum", received: string(received), expected: text}
+		}
+	} else if !bytes.Equal(expected, received) {
+		return nil, &checksumError{what: "record checksum", received: fmt.Sprintf("%X", received),
+			expected: fmt.Sprintf("%X", expected)}
+	}
+	return data, nil
+}
+
+// serialField is a field definition, with its pattern compiled
+type serialField struct {
+	common.SerialField
+	pattern *regexp.Regexp
+}
+
+// newSerialFields validates the field definitions, compiling their patterns
+func newSerialFields(definitions []common.SerialField) ([]serialField, error) {
+	fields := make([]serialField, len(definitions))
+	names := make(map[string]bool, len(definitions))
+	for i, v := range definitions {
+		switch {
+		case v.TagName == "":
+			return nil, fmt.Errorf("serial field %d has no tagName", i)
+		case names[v.TagName]:
+			return nil, fmt.Errorf("%s is defined more than once", v.TagName)
+		case v.Offset < 0 || v.Length < 0:
+			return nil, fmt.Errorf("%s has invalid offset %d or length %d", v.TagName, v.Offset, v.Length)
+		}
+		names[v.TagName] = true
+		fields[i].SerialField = v
+		switch v.DataType {
+		case "", common.DataTypeString:
+		case common.DataTypeInt16, common.DataTypeUint16, common.DataTypeInt32, common.DataTypeUint32,
+			common.DataTypeFloat32, common.DataTypeFloat64:
+			if v.Pattern != "" {
+				return nil, fmt.Errorf("%s of binary type %s must be extracted by offset", v.TagName, v.DataType)
+			}
+		default:
+			return nil, fmt.Errorf("%s has unknown data type %s", v.TagName, v.DataType)
+		}
+		if v.Pattern != "" {
+			pattern, err := regexp.Compile(v.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s has invalid pattern, %s", v.TagName, err)
+			}
+			fields[i].pattern = pattern
+		}
+	}
+	return fields, nil
+}
+
+// binarySize returns the size in bytes of the field's binary data type, 0 for text
+func (f serialField) binarySize() int {
+	switch f.DataType {
+	case common.DataTypeInt16, common.DataTypeUint16:
+		return 2
+	case common.DataTypeInt32, common.DataTypeUint32, common.DataTypeFloat32:
+		return 4
+	case common.DataTypeFloat64:
+		return 8
+	}
+	return 0
+}
+
+// extract returns the field's value in a record, found being false if the record does not
+// match the field's pattern
+func (f serialField) extract(record []byte) (value common.TagValue, found bool) {
+	if f.pattern != nil {
+		m := f.pattern.FindSubmatch(record)
+		if m == nil {
+			return common.TagValue{}, false
+		}
+		text := m[0]
+		if len(m) > 1 {
+			text = m[1]
+		}
+		return f.textValue(text), true
+	}
+	length := f.Length
+	if size := f.binarySize(); size > 0 {
+		length = size
+	} else if length == 0 {
+		length = len(record) - f.Offset
+	}
+	if length < 0 || f.Offset+length > len(record) {
+		return f.badValue(fmt.Errorf("%s at offset %d beyond record of %d bytes", f.TagName, f.Offset, len(record))), true
+	}
+	b := append([]byte(nil), record[f.Offset:f.Offset+length]...)
+	if f.binarySize() == 0 {
+		return f.textValue(b), true
+	}
+	if f.LittleEndian {
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	var v interface{}
+	switch f.DataType {
+	case common.DataTypeInt16:
+		v = BytesToInt16(b)
+	case common.DataTypeUint16:
+		v = BytesToUint16(b)
+	case common.DataTypeInt32:
+		v = BytesToInt32(b)
+	case common.DataTypeUint32:
+		v = BytesToUint32(b)
+	case common.DataTypeFloat32:
+		v = BytesToFloat32(b)
+	case common.DataTypeFloat64:
+		v = BytesToFloat64(b)
+	}
+	return scaledValue(f.TagName, f.Scaling, v), true
+}
+
+// textValue converts the text of a field to a string, or else a number
+func (f serialField) textValue(b []byte) common.TagValue {
+	text := strings.TrimSpace(string(b))
+	if f.DataType == common.DataTypeString {
+		return common.TagValue{Value: text, Unit: f.Unit, Quality: define.QualityGood}
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return f.badValue(fmt.Errorf("%s %q is not a number", f.TagName, text))
+	}
+	return scaledValue(f.TagName, f.Scaling, v)
+}
+
+// badValue reports a field that could not be extracted
+func (f serialField) badValue(reason error) common.TagValue {
+	return common.TagValue{Unit: f.Unit, Quality: define.QualityBad, Error: reason.Error()}
+}
@@ -0,0 +1,153 @@
+package fieldbus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/modbus"
+)
+
+// serverMap lays tag values out on the tables of a ModbusSlave according to a modbus server
+// register map. Each entry occupies the table read by its read function: one bit of the coil
+// or discrete input table, or RegisterCount registers of the holding or input register table
+// encoded per the entry's data type and (reversed) scaling. Updates and client writes arrive
+// on different goroutines and are serialized by the map's mutex.
+type serverMap struct {
+	slave   *ModbusSlave
+	entries []common.ModbusEntry
+
+	mutex sync.Mutex
+	bits  map[string]bool // last known state of register bit entries, see written
+}
+
+// serverWritable returns true if the entry accepts writes from modbus clients
+func serverWritable(entry common.ModbusEntry) bool {
+	table, _ := EntryTable(entry)
+	switch table {
+	case modbus.FuncCodeReadCoils:
+		return hasFunction(entry, modbus.FuncCodeWriteSingleCoil) || hasFunction(entry, modbus.FuncCodeWriteMultipleCoils)
+	case modbus.FuncCodeReadHoldingRegisters:
+		return hasFunction(entry, modbus.FuncCodeWriteSingleRegister) || hasFunction(entry, modbus.FuncCodeWriteMultipleRegisters)
+	}
+	return false
+}
+
+// newServerMap validates the register map and returns a serverMap whose slave answers the
+// passed unit ID, its tables sized to fit the map. Entries may not overlap, with the
+// exception of bit entries sharing a register.
+func newServerMap(entries []common.ModbusEntry, unitID int) (*serverMap, error) {
+	if unitID < 0 || unitID > common.ModbusMaxUnitID {
+		return nil, fmt.Errorf("invalid unit ID %d", unitID)
+	}
+	owners := make(map[int]map[int]common.ModbusEntry)
+	for _, v := range entries {
+		if v.RegisterName == "" {
+			return nil, fmt.Errorf("register map entry at address %d has no registerName", v.Address)
+		}
+		if err := validateModbusEntry(v); err != nil {
+			return nil, err
+		}
+		table, err := EntryTable(v)
+		if err != nil {
+			return nil, err
+		}
+		span := entryQuantity(table, v)
+		if v.Address < 0 || v.Address+span > 0x10000 {
+			return nil, fmt.Errorf("%s address %d out of range", v.RegisterName, v.Address)
+		}
+		if owners[table] == nil {
+			owners[table] = make(map[int]common.ModbusEntry)
+		}
+		for a := v.Address; a < v.Address+span; a++ {
+			owner, taken := owners[table][a]
+			if taken && !(owner.DataType == common.DataTypeBit && v.DataType == common.DataTypeBit) {
+				return nil, fmt.Errorf("%s overlaps %s at %s %d", v.RegisterName, owner.RegisterName, functionName(table), a)
+			}
+			owners[table][a] = v
+		}
+	}
+	slave, err := NewModbusSlaveFor(byte(unitID), entries)
+	if err != nil {
+		return nil, err
+	}
+	m := &serverMap{slave: slave, entries: entries, bits: make(map[string]bool)}
+	slave.Writable = m.writable
+	return m, nil
+}
+
+// update stores the report's values for the entries it names. Values that are missing, of
+// bad quality or from a source other than the entry's leave the entry's registers unchanged.
+// An error is returned for each value that cannot be encoded.
+func (m *serverMap) update(report common.OpsReport) (errs []error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, v := range m.entries {
+		tag, found := report[v.RegisterName]
+		if !found || tag.Value == nil || tag.Quality == define.QualityBad || (v.Source != "" && tag.Source != v.Source) {
+			continue
+		}
+		if err := m.slave.Store(v, tag.Value); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if v.DataType == common.DataTypeBit {
+			m.bits[v.RegisterName], _ = coilValue(v, tag.Value)
+		}
+	}
+	return
+}
+
+// writable permits a client write only if every address written belongs to a writable entry
+// and no entry is written in part
+func (m *serverMap) writable(table int, address int, quantity int) bool {
+	covered := make([]bool, quantity)
+	for _, v := range m.entries {
+		t, _ := EntryTable(v)
+		span := entryQuantity(t, v)
+		if t != table || v.Address >= address+quantity || v.Address+span <= address {
+			continue
+		}
+		if !serverWritable(v) || v.Address < address || v.Address+span > address+quantity {
+			return false
+		}
+		for a := v.Address; a < v.Address+span; a++ {
+			covered[a-address] = true
+		}
+	}
+	for _, v := range covered {
+		if !v {
+			return false
+		}
+	}
+	return true
+}
+
+// written decodes the entries affected by a client write into write commands for their
+// source tags. Bit entries sharing a written register are only included if their bit changed.
+func (m *serverMap) written(table int, address int, quantity int) (commands []common.WriteCommand, errs []error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, v := range m.entries {
+		t, _ := EntryTable(v)
+		if t != table || v.Address >= address+quantity || v.Address+entryQuantity(t, v) <= address {
+			continue
+		}
+		value, err := m.slave.Load(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if v.DataType == common.DataTypeBit {
+			on := value.(bool)
+			if last, found := m.bits[v.RegisterName]; found && last == on {
+				continue
+			}
+			m.bits[v.RegisterName] = on
+		}
+		commands = append(commands, common.WriteCommand{Service: v.Source, Tag: v.RegisterName, Value: value})
+	}
+	return
+}
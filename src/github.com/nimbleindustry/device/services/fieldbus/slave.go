@@ -0,0 +1,658 @@
+package fieldbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// modbusExceptionGatewayTargetFailed is returned for requests addressed to another unit ID
+	modbusExceptionGatewayTargetFailed = 0x0B
+	// modbusRTUMaxRequest is the length of a read/write multiple registers request carrying
+	// 255 bytes, the longest request answered
+	modbusRTUMaxRequest = 13 + 255
+)
+
+// ModbusHandler answers modbus request PDUs, returning the response PDU's function code (with
+// the exception bit set for an exception response) and data
+type ModbusHandler interface {
+	Handle(unitID byte, function byte, data []byte) (byte, []byte)
+}
+
+// slaveFunctions are the function codes answered by a ModbusSlave
+var slaveFunctions = map[byte]bool{
+	modbus.FuncCodeReadCoils:                  true,
+	modbus.FuncCodeReadDiscreteInputs:         true,
+	modbus.FuncCodeReadHoldingRegisters:       true,
+	modbus.FuncCodeReadInputRegisters:         true,
+	modbus.FuncCodeWriteSingleCoil:            true,
+	modbus.FuncCodeWriteSingleRegister:        true,
+	modbus.FuncCodeWriteMultipleCoils:         true,
+	modbus.FuncCodeWriteMultipleRegisters:     true,
+	modbus.FuncCodeMaskWriteRegister:          true,
+	modbus.FuncCodeReadWriteMultipleRegisters: true,
+	modbus.FuncCodeReadFIFOQueue:              true,
+	modbusFuncCodeReadFileRecord:              true,
+	modbusFuncCodeWriteFileRecord:             true,
+}
+
+// ModbusSlave is an in-memory modbus slave (server). It answers read and write requests from
+// its four data tables, which are identified by the function code used to read them
+// (FuncCodeReadCoils, FuncCodeReadDiscreteInputs, FuncCodeReadHoldingRegisters and
+// FuncCodeReadInputRegisters), its FIFO queues (keyed by FIFO pointer address) and its files
+// (keyed by file number). It also answers read device identification requests (43/14) once
+// its Identification is set.
+type ModbusSlave struct {
+	Identification DeviceIdentification
+
+	// Writable, when set, is consulted before each write request is applied. Returning false
+	// rejects the request with an illegal data address exception.
+	Writable func(table int, address int, quantity int) bool
+	// Written, when set, is called after each write request has been applied
+	Written func(table int, address int, quantity int)
+
+	mutex            sync.Mutex
+	unitID           byte
+	coils            []bool
+	discreteInputs   []bool
+	holdingRegisters []uint16
+	inputRegisters   []uint16
+	fifos            map[int][]uint16
+	files            map[int][]uint16
+	requests         int
+}
+
+// NewModbusSlave returns a slave answering the passed unit ID (zero answers any unit ID) with
+// tables of the passed sizes, in bits/registers
+func NewModbusSlave(unitID byte, coils, discreteInputs, holdingRegisters, inputRegisters int) *ModbusSlave {
+	return &ModbusSlave{
+		unitID:           unitID,
+		coils:            make([]bool, coils),
+		discreteInputs:   make([]bool, discreteInputs),
+		holdingRegisters: make([]uint16, holdingRegisters),
+		inputRegisters:   make([]uint16, inputRegisters),
+		fifos:            make(map[int][]uint16),
+		files:            make(map[int][]uint16),
+	}
+}
+
+// NewModbusSlaveFor returns a slave answering the passed unit ID with tables sized to hold
+// the passed entries
+func NewModbusSlaveFor(unitID byte, entries []common.ModbusEntry) (*ModbusSlave, error) {
+	sizes := make(map[int]int)
+	for _, v := range entries {
+		table, err := EntryTable(v)
+		if err != nil {
+			return nil, err
+		}
+		if end := v.Address + entryQuantity(table, v); end > sizes[table] {
+			sizes[table] = end
+		}
+	}
+	return NewModbusSlave(unitID, sizes[modbus.FuncCodeReadCoils], sizes[modbus.FuncCodeReadDiscreteInputs],
+		sizes[modbus.FuncCodeReadHoldingRegisters], sizes[modbus.FuncCodeReadInputRegisters]), nil
+}
+
+// EntryTable returns the slave table holding an entry, identified by the first read function
+// code of the entry
+func EntryTable(entry common.ModbusEntry) (int, error) {
+	for _, v := range entry.Functions {
+		switch v {
+		case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs,
+			modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%s declares no read function", entry.RegisterName)
+}
+
+func (s *ModbusSlave) bitTable(table int) []bool {
+	if table == modbus.FuncCodeReadDiscreteInputs {
+		return s.discreteInputs
+	}
+	return s.coils
+}
+
+func (s *ModbusSlave) registerTable(table int) []uint16 {
+	if table == modbus.FuncCodeReadInputRegisters {
+		return s.inputRegisters
+	}
+	return s.holdingRegisters
+}
+
+// SetBits stores bits in the coil or discrete input table, ignoring any beyond its end
+func (s *ModbusSlave) SetBits(table int, address int, bits []bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.bitTable(table)
+	for i, v := range bits {
+		if address+i >= 0 && address+i < len(t) {
+			t[address+i] = v
+		}
+	}
+}
+
+// Bits returns a copy of quantity bits of the coil or discrete input table
+func (s *ModbusSlave) Bits(table int, address int, quantity int) []bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bits := make([]bool, quantity)
+	if t := s.bitTable(table); address >= 0 && address < len(t) {
+		copy(bits, t[address:])
+	}
+	return bits
+}
+
+// SetRegisters stores raw (big-endian) register bytes in the holding or input register table,
+// ignoring any beyond its end
+func (s *ModbusSlave) SetRegisters(table int, address int, b []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setRegisters(table, address, b)
+}
+
+func (s *ModbusSlave) setRegisters(table int, address int, b []byte) {
+	t := s.registerTable(table)
+	for i := 0; 2*i+1 < len(b); i++ {
+		if address+i >= 0 && address+i < len(t) {
+			t[address+i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+	}
+}
+
+// Registers returns the raw (big-endian) bytes of count registers of the holding or input
+// register table
+func (s *ModbusSlave) Registers(table int, address int, count int) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.registers(table, address, count)
+}
+
+func (s *ModbusSlave) registers(table int, address int, count int) []byte {
+	b := make([]byte, 2*count)
+	t := s.registerTable(table)
+	for i := 0; i < count && address+i < len(t); i++ {
+		if address+i >= 0 {
+			binary.BigEndian.PutUint16(b[2*i:], t[address+i])
+		}
+	}
+	return b
+}
+
+// SetFIFO sets the contents of the FIFO queue read at the passed FIFO pointer address. Reads
+// leave the queue as it is.
+func (s *ModbusSlave) SetFIFO(address int, values []uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fifos[address] = append([]uint16{}, values...)
+}
+
+// SetFile sets the records (registers) of the passed file number
+func (s *ModbusSlave) SetFile(file int, records []uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[file] = append([]uint16{}, records...)
+}
+
+// File returns a copy of the records of the passed file number
+func (s *ModbusSlave) File(file int) []uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]uint16{}, s.files[file]...)
+}
+
+// Requests returns the number of requests addressed to the slave so far
+func (s *ModbusSlave) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// Store encodes a value in engineering units into the entry's bit or registers, within the
+// table read by the entry's read function. Register entries are encoded per the entry's data
+// type and (reversed) scaling; single bit entries accept a boolean or 0/1.
+func (s *ModbusSlave) Store(entry common.ModbusEntry, value interface{}) error {
+	table, err := EntryTable(entry)
+	if err != nil {
+		return err
+	}
+	switch {
+	case table == modbus.FuncCodeReadCoils || table == modbus.FuncCodeReadDiscreteInputs:
+		on, err := coilValue(entry, value)
+		if err != nil {
+			return err
+		}
+		s.SetBits(table, entry.Address, []bool{on})
+	case entry.DataType == common.DataTypeBit:
+		on, err := coilValue(entry, value)
+		if err != nil {
+			return err
+		}
+		// the register's other bits are left untouched
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		b := orderRegisters(entry, s.registers(table, entry.Address, entry.RegisterCount()))
+		setRegisterBit(b, entry.BitIndex, on)
+		s.setRegisters(table, entry.Address, orderRegisters(entry, b))
+	default:
+		b, err := EncodeValue(entry, value)
+		if err != nil {
+			return err
+		}
+		s.SetRegisters(table, entry.Address, b)
+	}
+	return nil
+}
+
+// Load decodes the entry's bit or registers into a value in engineering units, the inverse
+// of Store
+func (s *ModbusSlave) Load(entry common.ModbusEntry) (interface{}, error) {
+	table, err := EntryTable(entry)
+	if err != nil {
+		return nil, err
+	}
+	if table == modbus.FuncCodeReadCoils || table == modbus.FuncCodeReadDiscreteInputs {
+		return s.Bits(table, entry.Address, 1)[0], nil
+	}
+	return DecodeValue(entry, s.Registers(table, entry.Address, entry.RegisterCount()))
+}
+
+// setRegisterBit sets the bit at the passed index within register bytes, bit 0 being the
+// least significant bit of the first register (see RegisterBitAt)
+func setRegisterBit(b []byte, index int, on bool) {
+	register := index / 16
+	offset := uint(index % 16)
+	i := 2*register + 1 - int(offset/8)
+	if on {
+		b[i] |= 1 << (offset % 8)
+	} else {
+		b[i] &^= 1 << (offset % 8)
+	}
+}
+
+// Handle answers a single request PDU addressed to the passed unit ID, returning the
+// response PDU's function code and data. Unit IDs 0 and 255, used by modbus tcp clients
+// that do not address a particular unit, are always answered.
+func (s *ModbusSlave) Handle(unitID byte, function byte, data []byte) (byte, []byte) {
+	if s.unitID != 0 && unitID != s.unitID && unitID != 0 && unitID != 0xFF {
+		return function | 0x80, []byte{modbusExceptionGatewayTargetFailed}
+	}
+	s.mutex.Lock()
+	s.requests++
+	s.mutex.Unlock()
+	if function == modbusFuncCodeEncapsulatedInterface {
+		return s.Identification.identify(data)
+	}
+	if !slaveFunctions[function] {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalFunction}
+	}
+	switch function {
+	case modbus.FuncCodeReadFIFOQueue:
+		return s.readFIFOQueue(function, data)
+	case modbusFuncCodeReadFileRecord, modbusFuncCodeWriteFileRecord:
+		return s.fileRecord(function, data)
+	}
+	if len(data) < 4 {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	address := int(binary.BigEndian.Uint16(data))
+	quantity := int(binary.BigEndian.Uint16(data[2:]))
+	switch function {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		return s.readBits(function, address, quantity)
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+		return s.readRegisters(function, address, quantity)
+	case modbus.FuncCodeWriteSingleCoil:
+		if quantity != 0xFF00 && quantity != 0x0000 {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		return s.write(function, modbus.FuncCodeReadCoils, address, 1, data[:4], func() {
+			s.coils[address] = quantity == 0xFF00
+		})
+	case modbus.FuncCodeWriteSingleRegister:
+		return s.write(function, modbus.FuncCodeReadHoldingRegisters, address, 1, data[:4], func() {
+			s.holdingRegisters[address] = uint16(quantity)
+		})
+	case modbus.FuncCodeWriteMultipleCoils:
+		if quantity < 1 || quantity > 1968 || len(data) < 5+(quantity+7)/8 {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		return s.write(function, modbus.FuncCodeReadCoils, address, quantity, data[:4], func() {
+			for i := 0; i < quantity; i++ {
+				s.coils[address+i] = data[5+i/8]&(1<<uint(i%8)) != 0
+			}
+		})
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if quantity < 1 || quantity > 123 || len(data) < 5+2*quantity {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		return s.write(function, modbus.FuncCodeReadHoldingRegisters, address, quantity, data[:4], func() {
+			for i := 0; i < quantity; i++ {
+				s.holdingRegisters[address+i] = binary.BigEndian.Uint16(data[5+2*i:])
+			}
+		})
+	case modbus.FuncCodeMaskWriteRegister:
+		if len(data) < 6 {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		andMask, orMask := uint16(quantity), binary.BigEndian.Uint16(data[4:])
+		return s.write(function, modbus.FuncCodeReadHoldingRegisters, address, 1, data[:6], func() {
+			s.holdingRegisters[address] = s.holdingRegisters[address]&andMask | orMask&^andMask
+		})
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		if len(data) < 9 {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		writeAddress := int(binary.BigEndian.Uint16(data[4:]))
+		writeQuantity := int(binary.BigEndian.Uint16(data[6:]))
+		if quantity < 1 || quantity > modbusMaxReadRegisters || writeQuantity < 1 || writeQuantity > 121 ||
+			len(data) < 9+2*writeQuantity {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		if address+quantity > len(s.holdingRegisters) {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+		}
+		// the write is performed before the read
+		if f, exception := s.write(function, modbus.FuncCodeReadHoldingRegisters, writeAddress, writeQuantity, nil, func() {
+			for i := 0; i < writeQuantity; i++ {
+				s.holdingRegisters[writeAddress+i] = binary.BigEndian.Uint16(data[9+2*i:])
+			}
+		}); f != function {
+			return f, exception
+		}
+		return s.readRegisters(function, address, quantity)
+	}
+	return function | 0x80, []byte{modbus.ExceptionCodeIllegalFunction}
+}
+
+func (s *ModbusSlave) readBits(function byte, address int, quantity int) (byte, []byte) {
+	if quantity < 1 || quantity > modbusMaxReadBits {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	table := s.bitTable(int(function))
+	if address+quantity > len(table) {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+	}
+	b := make([]byte, (quantity+7)/8)
+	for i := 0; i < quantity; i++ {
+		if table[address+i] {
+			b[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return function, append([]byte{byte(len(b))}, b...)
+}
+
+func (s *ModbusSlave) readRegisters(function byte, address int, quantity int) (byte, []byte) {
+	if quantity < 1 || quantity > modbusMaxReadRegisters {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	table := s.registerTable(int(function))
+	if address+quantity > len(table) {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+	}
+	b := make([]byte, 2*quantity)
+	for i := 0; i < quantity; i++ {
+		binary.BigEndian.PutUint16(b[2*i:], table[address+i])
+	}
+	return function, append([]byte{byte(len(b))}, b...)
+}
+
+// readFIFOQueue answers a read FIFO queue request, leaving the queue as it was
+func (s *ModbusSlave) readFIFOQueue(function byte, data []byte) (byte, []byte) {
+	if len(data) < 2 {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fifo, found := s.fifos[int(binary.BigEndian.Uint16(data))]
+	if !found {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+	}
+	if len(fifo) > modbusMaxFIFOCount {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	response := make([]byte, 4+2*len(fifo))
+	binary.BigEndian.PutUint16(response, uint16(2+2*len(fifo)))
+	binary.BigEndian.PutUint16(response[2:], uint16(len(fifo)))
+	for i, v := range fifo {
+		binary.BigEndian.PutUint16(response[4+2*i:], v)
+	}
+	return function, response
+}
+
+// fileRecord answers a read or write file record request of a single sub-request
+func (s *ModbusSlave) fileRecord(function byte, data []byte) (byte, []byte) {
+	if len(data) < 8 || int(data[0]) != len(data)-1 || data[1] != fileRecordReferenceType {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, found := s.files[int(binary.BigEndian.Uint16(data[2:]))]
+	record := int(binary.BigEndian.Uint16(data[4:]))
+	length := int(binary.BigEndian.Uint16(data[6:]))
+	if !found || record+length > len(file) {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+	}
+	if function == modbusFuncCodeWriteFileRecord {
+		if len(data) != 8+2*length {
+			return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataValue}
+		}
+		for i := 0; i < length; i++ {
+			file[record+i] = binary.BigEndian.Uint16(data[8+2*i:])
+		}
+		return function, append([]byte{}, data...)
+	}
+	response := []byte{byte(2 + 2*length), byte(1 + 2*length), fileRecordReferenceType}
+	for i := 0; i < length; i++ {
+		response = append(response, Uint16ToBytes(file[record+i])...)
+	}
+	return function, response
+}
+
+// write checks and applies a write request to the passed table, echoing the request's
+// address and value/quantity as the response
+func (s *ModbusSlave) write(function byte, table int, address int, quantity int, echo []byte, apply func()) (byte, []byte) {
+	size := len(s.coils)
+	if table == modbus.FuncCodeReadHoldingRegisters {
+		size = len(s.holdingRegisters)
+	}
+	if address+quantity > size || (s.Writable != nil && !s.Writable(table, address, quantity)) {
+		return function | 0x80, []byte{modbus.ExceptionCodeIllegalDataAddress}
+	}
+	s.mutex.Lock()
+	apply()
+	s.mutex.Unlock()
+	if s.Written != nil {
+		s.Written(table, address, quantity)
+	}
+	return function, append([]byte{}, echo...)
+}
+
+// ModbusTCPServer serves a ModbusHandler, typically a ModbusSlave, to modbus tcp clients
+type ModbusTCPServer struct {
+	handler  ModbusHandler
+	listener net.Listener
+
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	accepted int
+}
+
+// ListenModbusTCP starts serving the passed handler on the passed address, e.g. ":502"
+func ListenModbusTCP(address string, handler ModbusHandler) (*ModbusTCPServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &ModbusTCPServer{handler: handler, listener: listener, conns: make(map[net.Conn]bool)}
+	go server.accept()
+	return server, nil
+}
+
+// Addr returns the address on which the server listens
+func (server *ModbusTCPServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Accepted returns the number of client connections accepted so far
+func (server *ModbusTCPServer) Accepted() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.accepted
+}
+
+// DropConnections closes every client connection, as a device reboot would. The server
+// continues to accept new connections.
+func (server *ModbusTCPServer) DropConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server, closing any client connections
+func (server *ModbusTCPServer) Close() error {
+	err := server.listener.Close()
+	server.DropConnections()
+	return err
+}
+
+func (server *ModbusTCPServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mutex.Lock()
+		server.conns[conn] = true
+		server.accepted++
+		server.mutex.Unlock()
+		go server.serve(conn)
+	}
+}
+
+// serve answers MBAP framed requests until the connection is closed or a malformed frame
+// is received
+func (server *ModbusTCPServer) serve(conn net.Conn) {
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+		conn.Close()
+	}()
+	var frame [modbusTCPMaxLength]byte
+	for {
+		if _, err := io.ReadFull(conn, frame[:modbusTCPHeaderSize]); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(frame[4:]))
+		if binary.BigEndian.Uint16(frame[2:]) != 0 || length < 2 || length > modbusTCPMaxLength-modbusTCPHeaderSize+1 {
+			return
+		}
+		pdu := frame[modbusTCPHeaderSize : modbusTCPHeaderSize+length-1]
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		function, data := server.handler.Handle(frame[6], pdu[0], pdu[1:])
+		response := make([]byte, modbusTCPHeaderSize+1, modbusTCPHeaderSize+1+len(data))
+		copy(response, frame[:modbusTCPHeaderSize])
+		binary.BigEndian.PutUint16(response[4:], uint16(2+len(data)))
+		response[modbusTCPHeaderSize] = function
+		if _, err := conn.Write(append(response, data...)); err != nil {
+			return
+		}
+	}
+}
+
+// ServeModbusRTU answers RTU framed requests read from the port (typically a serial port)
+// until reading or writing the port fails. Frames with a bad checksum and broadcasts go
+// unanswered, as do requests the handler rejects as addressed to another unit: on a serial
+// line only the addressed slave responds.
+func ServeModbusRTU(port io.ReadWriter, handler ModbusHandler) error {
+	var frame [modbusRTUMaxRequest]byte
+	for {
+		length, err := readRTURequest(port, frame[:])
+		if err != nil {
+			return err
+		}
+		if rtuChecksum(frame[:length-2]) != binary.LittleEndian.Uint16(frame[length-2:]) || frame[0] == 0 {
+			continue
+		}
+		function, data := handler.Handle(frame[0], frame[1], frame[2:length-2])
+		if function&0x80 != 0 && len(data) == 1 && data[0] == modbusExceptionGatewayTargetFailed {
+			continue
+		}
+		response := append([]byte{frame[0], function}, data...)
+		checksum := make([]byte, 2)
+		binary.LittleEndian.PutUint16(checksum, rtuChecksum(response))
+		if _, err := port.Write(append(response, checksum...)); err != nil {
+			return err
+		}
+	}
+}
+
+// readRTURequest reads an RTU request frame into frame, returning its length. The length is
+// fixed by the function code, or for the requests carrying a byte count (the write multiple,
+// read/write multiple and file record requests) taken from that count.
+func readRTURequest(port io.Reader, frame []byte) (int, error) {
+	if _, err := io.ReadFull(port, frame[:2]); err != nil {
+		return 0, err
+	}
+	length, count := 8, 0
+	switch frame[1] {
+	case modbus.FuncCodeReadFIFOQueue:
+		length = 6
+	case modbusFuncCodeEncapsulatedInterface:
+		length = 7
+	case modbus.FuncCodeMaskWriteRegister:
+		length = 10
+	case modbusFuncCodeReadFileRecord, modbusFuncCodeWriteFileRecord:
+		count = 2
+	case modbus.FuncCodeWriteMultipleCoils, modbus.FuncCodeWriteMultipleRegisters:
+		count = 6
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		count = 10
+	}
+	if count > 0 {
+		if _, err := io.ReadFull(port, frame[2:count+1]); err != nil {
+			return 0, err
+		}
+		length = count + 3 + int(frame[count])
+		if _, err := io.ReadFull(port, frame[count+1:length]); err != nil {
+			return 0, err
+		}
+		return length, nil
+	}
+	if _, err := io.ReadFull(port, frame[2:length]); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// rtuChecksum computes the modbus CRC-16 of the supplied frame
+func rtuChecksum(frame []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range frame {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
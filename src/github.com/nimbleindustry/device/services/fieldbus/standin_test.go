@@ -0,0 +1,140 @@
+package fieldbus
+
+import (
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// newStandinSlave returns a modbus slave, answering the passed unit ID, used in place of a
+// real PLC. Each of its tables holds 64 bits/registers.
+func newStandinSlave(unitID byte) *ModbusSlave {
+	return NewModbusSlave(unitID, 64, 64, 64, 64)
+}
+
+// standinHandler is a modbus.ClientHandler that passes requests directly to a ModbusSlave,
+// allowing a real modbus.Client to be exercised without any transport
+type standinHandler struct {
+	slave *ModbusSlave
+}
+
+func (h *standinHandler) Encode(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	return append([]byte{pdu.FunctionCode}, pdu.Data...), nil
+}
+
+func (h *standinHandler) Decode(adu []byte) (*modbus.ProtocolDataUnit, error) {
+	return &modbus.ProtocolDataUnit{FunctionCode: adu[0], Data: adu[1:]}, nil
+}
+
+func (h *standinHandler) Verify(aduRequest []byte, aduResponse []byte) error {
+	return nil
+}
+
+func (h *standinHandler) Send(aduRequest []byte) ([]byte, error) {
+	// unit ID 0 is answered by every slave
+	function, data := h.slave.Handle(0, aduRequest[0], aduRequest[1:])
+	return append([]byte{function}, data...), nil
+}
+
+// modbusClient returns a client wired directly to the passed slave
+func modbusClient(slave *ModbusSlave) *pduClient {
+	handler := &standinHandler{slave}
+	return newPDUClient(handler, handler)
+}
+
+// newStandinService returns a modbus service whose requests are passed directly to the slave,
+// its connection being open from the outset
+func newStandinService(slave *ModbusSlave) *GenericModbusService {
+	svc := &GenericModbusService{client: modbusClient(slave)}
+	svc.setup("standin", "modbus slave", func(string) {}, standinDriver{svc})
+	svc.conn = standinConnection{}
+	return svc
+}
+
+// standinDriver polls a service wired directly to its slave, there being nothing to dial
+type standinDriver struct {
+	*GenericModbusService
+}
+
+func (d standinDriver) dial(address string) (pollConnection, error) {
+	return standinConnection{}, nil
+}
+
+// standinConnection is the connection of a service wired directly to its slave, never failing
+type standinConnection struct{}
+
+func (standinConnection) Err() error   { return nil }
+func (standinConnection) Close() error { return nil }
+
+// standinUnits routes requests to the slave of their unit ID, as a tcp to rtu gateway does
+type standinUnits map[byte]*ModbusSlave
+
+func (units standinUnits) Handle(unitID byte, function byte, data []byte) (byte, []byte) {
+	slave, found := units[unitID]
+	if !found {
+		return function | 0x80, []byte{modbusExceptionGatewayTargetFailed}
+	}
+	return slave.Handle(unitID, function, data)
+}
+
+// listenStandin serves the passed slaves over modbus tcp on a loopback port
+func listenStandin(slaves ...*ModbusSlave) (*ModbusTCPServer, error) {
+	units := make(standinUnits)
+	for _, slave := range slaves {
+		units[slave.unitID] = slave
+	}
+	return ListenModbusTCP("127.0.0.1:0", units)
+}
+
+// waitForAccepts waits up to a second for the server to have accepted count connections
+func waitForAccepts(server *ModbusTCPServer, count int) int {
+	deadline := time.Now().Add(time.Second)
+	for server.Accepted() < count && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return server.Accepted()
+}
+
+const modbusEquipmentFixture = `{
+  "ref": "http://machineconfig.com/nimbleindustry.com/test-equipment-a-1.json",
+  "entity": "nimbleindustry.com",
+  "machineIntegration": {
+    "modbus": [
+      {
+        "registerName": "TankFull",
+        "functions": [2],
+        "address": 0,
+        "class": "state",
+        "desc": {"en": "Tank full"}
+      },
+      {
+        "registerName": "TankEmpty",
+        "functions": [2],
+        "address": 1,
+        "class": "state",
+        "desc": {"en": "Tank empty"}
+      },
+      {
+        "registerName": "CommandPump",
+        "functions": [1, 5],
+        "address": 0,
+        "class": "control",
+        "desc": {"en": "Command pump"}
+      },
+      {
+        "registerName": "SystemRun",
+        "functions": [3, 6],
+        "address": 0,
+        "class": "control",
+        "desc": {"en": "System run control"}
+      },
+      {
+        "registerName": "LiquidTemp",
+        "functions": [4],
+        "address": 0,
+        "class": "telemetry",
+        "desc": {"en": "Liquid Temp"}
+      }
+    ]
+  }
+}`
@@ -0,0 +1,222 @@
+package fieldbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	modbusTCPHeaderSize = 7
+	modbusTCPMaxLength  = 260
+	modbusRTUMaxLength  = 256
+
+	// the serial line functions, which a bridge forwards like any other
+	modbusFuncCodeReadExceptionStatus = 0x07
+	modbusFuncCodeDiagnostics         = 0x08
+	modbusFuncCodeCommEventCounter    = 0x0B
+	modbusFuncCodeCommEventLog        = 0x0C
+	modbusFuncCodeReportServerID      = 0x11
+)
+
+var errNotConnected = errors.New("not connected")
+
+// tcpTransporter is a modbus.Transporter that holds a long-lived connection to a modbus tcp
+// slave. Unlike the transporter supplied with goburrow/modbus it never dials on its own: the
+// owning service connects (and reconnects) explicitly, which allows connection state to be
+// tracked. TCP keepalive is enabled on the connection, and any I/O error closes it.
+//
+// Responses are read by its readFrame function: MBAP framed over tcp by default, raw rtu
+// frames for serial device servers tunneling rtu over tcp, or whole datagrams for modbus udp,
+// in which case the "connection" is a connected udp socket.
+type tcpTransporter struct {
+	network     string // "tcp" or "udp", tcp if unset
+	address     string
+	timeout     time.Duration                   // dial, read and write timeout
+	keepAlive   time.Duration                   // TCP keepalive period, zero disables keepalive
+	idleTimeout time.Duration                   // period of inactivity after which the connection may be closed, zero never
+	readFrame   func(io.Reader) ([]byte, error) // reads a response ADU, readMBAPFrame if unset
+
+	conn         net.Conn
+	lastActivity time.Time
+}
+
+// connect dials the slave, a no-op if the connection is already established
+func (t *tcpTransporter) connect() error {
+	if t.conn != nil {
+		return nil
+	}
+	dialer := net.Dialer{Timeout: t.timeout, KeepAlive: t.keepAlive}
+	network := t.network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := dialer.Dial(network, t.address)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.lastActivity = time.Now()
+	return nil
+}
+
+func (t *tcpTransporter) connected() bool {
+	return t.conn != nil
+}
+
+func (t *tcpTransporter) close() (err error) {
+	if t.conn != nil {
+		err = t.conn.Close()
+		t.conn = nil
+	}
+	return
+}
+
+// Err returns errNotConnected once a failed exchange has closed the connection, nil while it
+// is open
+func (t *tcpTransporter) Err() error {
+	if t.conn == nil {
+		return errNotConnected
+	}
+	return nil
+}
+
+// Close closes the connection
+func (t *tcpTransporter) Close() error {
+	return t.close()
+}
+
+// idleAt returns the time at which the connection becomes idle, or the zero time if the
+// connection is not established or has no idle timeout
+func (t *tcpTransporter) idleAt() time.Time {
+	if t.conn == nil || t.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return t.lastActivity.Add(t.idleTimeout)
+}
+
+// Send writes the request ADU and reads the response ADU
+func (t *tcpTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	if t.conn == nil {
+		return nil, errNotConnected
+	}
+	defer func() {
+		// the stream can no longer be trusted after a failed exchange
+		if err != nil {
+			t.close()
+		}
+	}()
+	t.lastActivity = time.Now()
+	if err = t.conn.SetDeadline(t.lastActivity.Add(t.timeout)); err != nil {
+		return
+	}
+	if _, err = t.conn.Write(aduRequest); err != nil {
+		return
+	}
+	readFrame := t.readFrame
+	if readFrame == nil {
+		readFrame = readMBAPFrame
+	}
+	if aduResponse, err = readFrame(t.conn); err != nil {
+		return
+	}
+	t.lastActivity = time.Now()
+	return aduResponse, nil
+}
+
+// readMBAPFrame reads an MBAP framed response from a stream
+func readMBAPFrame(r io.Reader) ([]byte, error) {
+	var data [modbusTCPMaxLength]byte
+	if _, err := io.ReadFull(r, data[:modbusTCPHeaderSize]); err != nil {
+		return nil, err
+	}
+	// the length field counts the unit id, which is part of the header
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length <= 1 || length > modbusTCPMaxLength-modbusTCPHeaderSize+1 {
+		return nil, fmt.Errorf("modbus: invalid length %d in response header", length)
+	}
+	length += modbusTCPHeaderSize - 1
+	if _, err := io.ReadFull(r, data[modbusTCPHeaderSize:length]); err != nil {
+		return nil, err
+	}
+	return data[:length], nil
+}
+
+// readDatagram reads an MBAP framed response carried by a single datagram
+func readDatagram(r io.Reader) ([]byte, error) {
+	var data [modbusTCPMaxLength]byte
+	n, err := r.Read(data[:])
+	if err != nil {
+		return nil, err
+	}
+	if n < modbusTCPHeaderSize+1 || int(binary.BigEndian.Uint16(data[4:]))+modbusTCPHeaderSize-1 != n {
+		return nil, fmt.Errorf("modbus: malformed datagram of %d bytes", n)
+	}
+	return data[:n], nil
+}
+
+// readRTUFrame reads an rtu response frame from a stream. Rtu frames carry no length, which
+// is instead implied by the response's function code and byte count.
+func readRTUFrame(r io.Reader) ([]byte, error) {
+	var data [modbusRTUMaxLength]byte
+	length := 3
+	more := func(n int) error {
+		if length+n > len(data) {
+			return fmt.Errorf("modbus: rtu response exceeds %d bytes", len(data))
+		}
+		_, err := io.ReadFull(r, data[length:length+n])
+		length += n
+		return err
+	}
+	if _, err := io.ReadFull(r, data[:length]); err != nil {
+		return nil, err
+	}
+	var err error
+	switch function := data[1]; {
+	case function&0x80 != 0 || function == modbusFuncCodeReadExceptionStatus:
+		// exception code or status, then checksum
+		err = more(2)
+	case function == modbus.FuncCodeReadCoils || function == modbus.FuncCodeReadDiscreteInputs ||
+		function == modbus.FuncCodeReadHoldingRegisters || function == modbus.FuncCodeReadInputRegisters ||
+		function == modbus.FuncCodeReadWriteMultipleRegisters ||
+		function == modbusFuncCodeReadFileRecord || function == modbusFuncCodeWriteFileRecord ||
+		function == modbusFuncCodeCommEventLog || function == modbusFuncCodeReportServerID:
+		// byte count, data, then checksum
+		err = more(int(data[2]) + 2)
+	case function == modbus.FuncCodeWriteSingleCoil || function == modbus.FuncCodeWriteSingleRegister ||
+		function == modbus.FuncCodeWriteMultipleCoils || function == modbus.FuncCodeWriteMultipleRegisters ||
+		function == modbusFuncCodeDiagnostics || function == modbusFuncCodeCommEventCounter:
+		err = more(5)
+	case function == modbus.FuncCodeMaskWriteRegister:
+		err = more(7)
+	case function == modbus.FuncCodeReadFIFOQueue:
+		// two byte count
+		if err = more(1); err == nil {
+			err = more(int(binary.BigEndian.Uint16(data[2:])) + 2)
+		}
+	case function == modbusFuncCodeEncapsulatedInterface:
+		// read device identification: header, then each object's id, length and value
+		if err = more(5); err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(data[7]) && err == nil; i++ {
+			if err = more(2); err == nil {
+				err = more(int(data[length-1]))
+			}
+		}
+		if err == nil {
+			err = more(2)
+		}
+	default:
+		return nil, fmt.Errorf("modbus: unexpected function %d in rtu response", function)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data[:length], nil
+}
@@ -0,0 +1,213 @@
+package fieldbus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+)
+
+// hasFunction returns true if the entry's functions include the passed function code
+func hasFunction(entry common.ModbusEntry, function int) bool {
+	for _, v := range entry.Functions {
+		if v == function {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFunction returns the function code used to write the entry. Single coil/register
+// writes are preferred where the entry permits them, and mask writes for bit entries.
+func writeFunction(entry common.ModbusEntry) (int, error) {
+	switch {
+	case hasFunction(entry, modbus.FuncCodeWriteSingleCoil):
+		return modbus.FuncCodeWriteSingleCoil, nil
+	case hasFunction(entry, modbus.FuncCodeWriteMultipleCoils):
+		return modbus.FuncCodeWriteMultipleCoils, nil
+	case hasFunction(entry, modbus.FuncCodeMaskWriteRegister):
+		return modbus.FuncCodeMaskWriteRegister, nil
+	case hasFunction(entry, modbus.FuncCodeWriteSingleRegister) && entry.RegisterCount() == 1:
+		return modbus.FuncCodeWriteSingleRegister, nil
+	case hasFunction(entry, modbus.FuncCodeWriteMultipleRegisters):
+		return modbus.FuncCodeWriteMultipleRegisters, nil
+	case hasFunction(entry, modbus.FuncCodeReadWriteMultipleRegisters):
+		return modbus.FuncCodeReadWriteMultipleRegisters, nil
+	case hasFunction(entry, modbusFuncCodeWriteFileRecord):
+		return modbusFuncCodeWriteFileRecord, nil
+	case hasFunction(entry, modbus.FuncCodeWriteSingleRegister):
+		return 0, fmt.Errorf("%s occupies %d registers and requires function %d to be written",
+			entry.RegisterName, entry.RegisterCount(), modbus.FuncCodeWriteMultipleRegisters)
+	}
+	return 0, fmt.Errorf("%s is not writable", entry.RegisterName)
+}
+
+// findWritableEntry returns the service's entry for the named tag provided that it declares
+// a write function
+func (svc *GenericModbusService) findWritableEntry(tag string) (common.ModbusEntry, int, error) {
+	for _, v := range svc.machineIntegrations {
+		if v.RegisterName == tag {
+			function, err := writeFunction(v)
+			return v, function, err
+		}
+	}
+	return common.ModbusEntry{}, 0, fmt.Errorf("%s is not a configured tag", tag)
+}
+
+// coilValue converts a command value to a coil state. Booleans and the numbers 0 and 1 are
+// accepted.
+func coilValue(entry common.ModbusEntry, value interface{}) (bool, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	f, err := toFloat64(value)
+	if err != nil || (f != 0 && f != 1) {
+		return false, fmt.Errorf("%s expects a boolean (or 0/1) value, got %v", entry.RegisterName, value)
+	}
+	return f == 1, nil
+}
+
+// rawValue converts a command value in engineering units to the raw value written to the
+// device, rounding to the nearest integer for integer data types
+func rawValue(entry common.ModbusEntry, value interface{}) interface{} {
+	if !entry.IsScaled() {
+		return value
+	}
+	f, err := toFloat64(value)
+	if err != nil {
+		return value
+	}
+	raw := entry.Raw(f)
+	switch entry.DataType {
+	case common.DataTypeFloat32, common.DataTypeFloat64:
+		return raw
+	}
+	return math.Floor(raw + 0.5)
+}
+
+// exchangeTag writes the command's value to the named tag using the entry's write function,
+// returning the value read back in the same transaction by read/write multiple registers, nil
+// for every other write function
+func (svc *GenericModbusService) exchangeTag(cmd common.WriteCommand) (interface{}, error) {
+	if svc.client == nil {
+		return nil, errors.New("client nil")
+	}
+	entry, function, err := svc.findWritableEntry(cmd.Tag)
+	if err != nil {
+		return nil, err
+	}
+	client, err := svc.clientFor(entry.UnitID)
+	if err != nil {
+		return nil, err
+	}
+	address := uint16(entry.Address)
+	entries := []common.ModbusEntry{entry}
+	switch function {
+	case modbus.FuncCodeWriteSingleCoil, modbus.FuncCodeWriteMultipleCoils:
+		on, err := coilValue(entry, cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		if function == modbus.FuncCodeWriteSingleCoil {
+			state := uint16(0x0000)
+			if on {
+				state = 0xFF00
+			}
+			err = svc.request(entries, func() error {
+				_, err := client.WriteSingleCoil(address, state)
+				return err
+			})
+		} else {
+			state := []byte{0}
+			if on {
+				state[0] = 1
+			}
+			err = svc.request(entries, func() error {
+				_, err := client.WriteMultipleCoils(address, 1, state)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error writing coil %d%s, %s", entry.Address, unitSuffix(entry.UnitID), err)
+		}
+	case modbus.FuncCodeMaskWriteRegister:
+		on, err := coilValue(entry, cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		register, andMask, orMask := maskWriteBit(entry, on)
+		err = svc.request(entries, func() error {
+			_, err := client.MaskWriteRegister(register, andMask, orMask)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error writing bit %d of holding registers %d-%d%s, %s", entry.BitIndex, entry.Address, entry.Address+entry.RegisterCount()-1, unitSuffix(entry.UnitID), err)
+		}
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		b, err := EncodeValue(entry, cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		count := uint16(entry.RegisterCount())
+		err = svc.request(entries, func() error {
+			var err error
+			b, err = client.ReadWriteMultipleRegisters(address, count, uint16(entryWriteAddress(entry)), count, b)
+			return err
+		})
+		if err != nil {
+			last := int(count) - 1
+			return nil, fmt.Errorf("Error writing holding registers %d-%d and reading %d-%d%s, %s", entryWriteAddress(entry),
+				entryWriteAddress(entry)+last, entry.Address, entry.Address+last, unitSuffix(entry.UnitID), err)
+		}
+		decoded, err := DecodeRegisters(entry, b)
+		if err != nil {
+			return nil, err
+		}
+		return tagValue(entry, decoded).Value, nil
+	case modbusFuncCodeWriteFileRecord:
+		b, err := EncodeValue(entry, cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		err = svc.request(entries, func() error {
+			return client.writeFileRecord(uint16(entry.File), address, b)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error writing file %d records %d-%d%s, %s", entry.File, entry.Address, entry.Address+entry.RegisterCount()-1, unitSuffix(entry.UnitID), err)
+		}
+	default:
+		b, err := EncodeValue(entry, cmd.Value)
+		if err != nil {
+			return nil, err
+		}
+		if function == modbus.FuncCodeWriteSingleRegister {
+			err = svc.request(entries, func() error {
+				_, err := client.WriteSingleRegister(address, BytesToUint16(b))
+				return err
+			})
+		} else {
+			err = svc.request(entries, func() error {
+				_, err := client.WriteMultipleRegisters(address, uint16(entry.RegisterCount()), b)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error writing holding registers %d-%d%s, %s", entry.Address, entry.Address+entry.RegisterCount()-1, unitSuffix(entry.UnitID), err)
+		}
+	}
+	return nil, nil
+}
+
+// writableTags returns the names of the service's tags that declare a write function
+func (svc *GenericModbusService) writableTags() []string {
+	var tags []string
+	for _, v := range svc.machineIntegrations {
+		if _, err := writeFunction(v); err == nil {
+			tags = append(tags, v.RegisterName)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,101 @@
+package fieldbus
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nimbleindustry/device/common"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFunction(t *testing.T) {
+	tests := []struct {
+		entry    common.ModbusEntry
+		function int
+		ok       bool
+	}{
+		{common.ModbusEntry{Functions: []int{1, 5}}, 5, true},
+		{common.ModbusEntry{Functions: []int{1, 15}}, 15, true},
+		{common.ModbusEntry{Functions: []int{3, 6}}, 6, true},
+		{common.ModbusEntry{Functions: []int{3, 6, 16}}, 6, true},
+		{common.ModbusEntry{Functions: []int{3, 6, 16}, DataType: common.DataTypeFloat32}, 16, true},
+		{common.ModbusEntry{Functions: []int{3, 6}, DataType: common.DataTypeInt32}, 0, false},
+		{common.ModbusEntry{Functions: []int{3}}, 0, false},
+		{common.ModbusEntry{Functions: []int{2}}, 0, false},
+	}
+	for i, test := range tests {
+		function, err := writeFunction(test.entry)
+		assert.Equal(t, test.ok, err == nil, "unexpected result for test %d, %v", i, err)
+		assert.Equal(t, test.function, function, "unexpected function for test %d", i)
+	}
+}
+
+func TestWriteTags(t *testing.T) {
+	slave := newStandinSlave(1)
+	svc := newStandinService(slave)
+	common.EquipmentConfig = common.Equipment{}
+	err := json.Unmarshal([]byte(modbusEquipmentFixture), &common.EquipmentConfig)
+	assert.Nil(t, err, "unmarshall failed")
+	svc.machineIntegrations = append(common.EquipmentConfig.MachineIntegrations.ModbusEntries,
+		common.ModbusEntry{RegisterName: "Setpoint", Functions: []int{3, 16}, Address: 10,
+			DataType: common.DataTypeFloat32, WordSwap: true},
+		common.ModbusEntry{RegisterName: "TargetTemp", Functions: []int{3, 6}, Address: 12,
+			Scaling: common.Scaling{Multiplier: 0.1, Unit: "°C"}},
+		common.ModbusEntry{RegisterName: "Valve", Functions: []int{1, 15}, Address: 3},
+	)
+
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "CommandPump", Value: true}).Error)
+	assert.True(t, slave.coils[0])
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "CommandPump", Value: 0.0}).Error)
+	assert.False(t, slave.coils[0])
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Valve", Value: 1}).Error)
+	assert.True(t, slave.coils[3])
+
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "SystemRun", Value: -2.0}).Error)
+	assert.Equal(t, uint16(0xFFFE), slave.holdingRegisters[0])
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "TargetTemp", Value: 21.7}).Error)
+	assert.Equal(t, uint16(217), slave.holdingRegisters[12], "expected engineering value converted to raw")
+
+	assert.Empty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Setpoint", Value: 1.5}).Error)
+	m := make(common.OpsReport)
+	assert.Nil(t, svc.readTags(m, modbus.FuncCodeReadHoldingRegisters, svc.machineIntegrations[5:6]))
+	assert.Equal(t, float32(1.5), m["Setpoint"].Value, "expected written value to read back")
+
+	// rejected writes
+	requests := slave.Requests()
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "LiquidTemp", Value: 1}).Error, "expected input register to be read-only")
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "TankFull", Value: true}).Error, "expected discrete input to be read-only")
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "Unknown", Value: 1}).Error)
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "CommandPump", Value: 2}).Error)
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "SystemRun", Value: "run"}).Error)
+	assert.NotEmpty(t, routeWrite(svc, svc.name, common.WriteCommand{Tag: "SystemRun", Value: 70000}).Error)
+	assert.Equal(t, requests, slave.Requests(), "expected rejected writes not to reach the device")
+}
+
+func TestExecuteWriteAcknowledges(t *testing.T) {
+	server, err := listenStandin(newStandinSlave(1))
+	assert.Nil(t, err, "unable to listen")
+	defer server.Close()
+	svc := newTestTCPService(t, server, "")
+	defer svc.closeConnection()
+	svc.machineIntegrations = []common.ModbusEntry{
+		{RegisterName: "SystemRun", Functions: []int{3, 6}, Address: 0},
+		{RegisterName: "Missing", Functions: []int{3, 6}, Address: 100},
+		{RegisterName: "Level", Functions: []int{3}, Address: 101},
+	}
+	assert.Equal(t, []string{"SystemRun", "Missing"}, svc.writableTags())
+
+	ack := svc.executeWrite(common.WriteCommand{ID: "42", Tag: "SystemRun", Value: 1})
+	assert.Equal(t, "42", ack.ID)
+	assert.Equal(t, svc.Name, ack.Service)
+	assert.True(t, ack.Success)
+	assert.Empty(t, ack.Error)
+	assert.False(t, ack.Timestamp.IsZero())
+
+	ack = svc.executeWrite(common.WriteCommand{ID: "43", Tag: "Missing", Value: 1})
+	assert.False(t, ack.Success)
+	assert.Contains(t, ack.Error, "Error writing holding registers 100-100")
+	assert.True(t, svc.transport.connected(), "expected an exception to leave the connection open")
+}
@@ -0,0 +1,106 @@
+package fieldbus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+)
+
+// fieldbusWriteQueue is the number of write commands held for a fieldbus service while it polls
+const fieldbusWriteQueue = 16
+
+// writeRouter delivers the write commands received on TopicWriteCommand to the fieldbus
+// services that write tags. Each command goes to the one service it names or, failing that,
+// to the one service configured with its tag; commands that no service, or several, could
+// execute are acknowledged as failed. Commands are queued until the service is free to
+// execute them, such as between polls.
+type writeRouter struct {
+	mutex   sync.Mutex
+	writers map[string]*tagWriter
+}
+
+// tagWriter is a service registered with the router
+type tagWriter struct {
+	tags  map[string]bool
+	queue chan common.WriteCommand
+}
+
+// writeRoutes routes the commands of every fieldbus service
+var writeRoutes = &writeRouter{writers: make(map[string]*tagWriter)}
+
+// register adds the named service as the writer of the passed tags, returning the queue from
+// which it is to execute its commands
+func (r *writeRouter) register(name string, tags []string) chan common.WriteCommand {
+	writer := &tagWriter{tags: make(map[string]bool, len(tags)), queue: make(chan common.WriteCommand, fieldbusWriteQueue)}
+	for _, v := range tags {
+		writer.tags[v] = true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writers[name] = writer
+	return writer.queue
+}
+
+// unregister removes the named service, should the passed queue still be its own, failing the
+// commands queued that it will not execute
+func (r *writeRouter) unregister(name string, queue chan common.WriteCommand) {
+	r.mutex.Lock()
+	if writer, found := r.writers[name]; found && writer.queue == queue {
+		delete(r.writers, name)
+	}
+	r.mutex.Unlock()
+	for {
+		select {
+		case cmd := <-queue:
+			common.SendBusMessage(define.TopicWriteAck, failedWrite(cmd, name, fmt.Errorf("%s stopped", name)))
+		default:
+			return
+		}
+	}
+}
+
+// route queues the command for the service that executes it, returning the acknowledgement
+// of its failure if there is no such service or its queue is full
+func (r *writeRouter) route(cmd common.WriteCommand) *common.WriteAck {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := cmd.Service
+	if name == "" {
+		var names []string
+		for k, v := range r.writers {
+			if v.tags[cmd.Tag] {
+				names = append(names, k)
+			}
+		}
+		switch len(names) {
+		case 0:
+			return failedWrite(cmd, "", fmt.Errorf("no fieldbus service writes %s", cmd.Tag))
+		case 1:
+			name = names[0]
+		default:
+			sort.Strings(names)
+			return failedWrite(cmd, "", fmt.Errorf("%s is written by %s, the command must name one service",
+				cmd.Tag, strings.Join(names, " and ")))
+		}
+	}
+	writer, found := r.writers[name]
+	if !found {
+		return failedWrite(cmd, name, fmt.Errorf("no fieldbus service %s writes tags", name))
+	}
+	select {
+	case writer.queue <- cmd:
+		return nil
+	default:
+		return failedWrite(cmd, name, fmt.Errorf("%d writes are already queued for %s", cap(writer.queue), name))
+	}
+}
+
+// failedWrite returns the acknowledgement of a command that could not be executed
+func failedWrite(cmd common.WriteCommand, service string, err error) *common.WriteAck {
+	return &common.WriteAck{Timestamp: time.Now(), ID: cmd.ID, Service: service, Tag: cmd.Tag, Error: err.Error()}
+}
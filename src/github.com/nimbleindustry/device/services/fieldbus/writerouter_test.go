@@ -0,0 +1,68 @@
+package fieldbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRouter(t *testing.T) {
+	router := &writeRouter{writers: make(map[string]*tagWriter)}
+	plc1 := router.register("plc1", []string{"SystemRun", "CommandPump"})
+	plc2 := router.register("plc2", []string{"SystemRun"})
+
+	// commands go to the one service writing their tag, or to the service they name
+	assert.Nil(t, router.route(common.WriteCommand{ID: "1", Tag: "CommandPump", Value: true}))
+	assert.Equal(t, "1", (<-plc1).ID)
+	assert.Nil(t, router.route(common.WriteCommand{ID: "2", Service: "plc2", Tag: "SystemRun", Value: 1}))
+	assert.Equal(t, "2", (<-plc2).ID)
+
+	// commands no service, or several, could execute fail
+	ack := router.route(common.WriteCommand{ID: "3", Tag: "SystemRun", Value: 1})
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, "3", ack.ID)
+		assert.False(t, ack.Success)
+		assert.Equal(t, "SystemRun is written by plc1 and plc2, the command must name one service", ack.Error)
+	}
+	ack = router.route(common.WriteCommand{ID: "4", Tag: "Unknown", Value: 1})
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, "no fieldbus service writes Unknown", ack.Error)
+	}
+	ack = router.route(common.WriteCommand{ID: "5", Service: "drive", Tag: "SystemRun", Value: 1})
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, "drive", ack.Service)
+		assert.Equal(t, "no fieldbus service drive writes tags", ack.Error)
+	}
+
+	// commands are held while the service is busy, up to the size of its queue
+	for i := 0; i < fieldbusWriteQueue; i++ {
+		assert.Nil(t, router.route(common.WriteCommand{Tag: "CommandPump", Value: true}))
+	}
+	ack = router.route(common.WriteCommand{ID: "6", Tag: "CommandPump", Value: true})
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, "16 writes are already queued for plc1", ack.Error)
+	}
+
+	// the commands queued for a service that stops are failed
+	acks := common.BufferedBusChannel(define.TopicWriteAck, fieldbusWriteQueue)
+	router.unregister("plc1", plc1)
+	for i := 0; i < fieldbusWriteQueue; i++ {
+		select {
+		case msg := <-acks:
+			assert.Equal(t, "plc1 stopped", msg.(*common.WriteAck).Error)
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d queued writes failed", i, fieldbusWriteQueue)
+		}
+	}
+	assert.Nil(t, router.route(common.WriteCommand{Tag: "SystemRun", Value: 1}), "expected plc2 to be the only writer")
+
+	// a service restarted under the same name is not unregistered by its previous instance
+	restarted := router.register("plc2", []string{"SystemRun"})
+	router.unregister("plc2", plc2)
+	assert.Nil(t, router.route(common.WriteCommand{ID: "7", Tag: "SystemRun", Value: 1}))
+	assert.Equal(t, "7", (<-restarted).ID)
+}
@@ -12,6 +12,13 @@ import (
 	"github.com/nimbleindustry/suture"
 )
 
+// integrationsAckQueue is the number of write acknowledgements held while integrations are busy
+const integrationsAckQueue = 16
+
+// integrationsReportQueue is the number of ops reports, and of changes, held while
+// integrations are busy, fieldbus services polling at the same instant
+const integrationsReportQueue = 64
+
 // IntegrationsService is responsible for maintaining connections
 // to one or more integrated service implementations as found in the
 // /integrations folder and defined in connections.json
@@ -53,6 +60,15 @@ func (svc *IntegrationsService) Serve() {
 
 	// break the for loop below every 1 minute to send the state of this Device
 	timeout := time.Duration(1 * time.Minute)
+	assets := common.BusChannel(define.AssetConfigUpdated)
+	configs := common.BusChannel(define.ConnectivityConfigUpdated)
+	equipment := common.BusChannel(define.EquipmentConfigUpdated)
+	states := common.BusChannel(define.TopicStateReport)
+	// reports and changes are held while data is being sent, so that none is lost
+	reports := common.BufferedBusChannel(define.TopicOpsReport, integrationsReportQueue)
+	changes := common.BufferedBusChannel(define.TopicOpsChanges, integrationsReportQueue)
+	// acknowledgements are held while data is being sent, so that none goes unanswered
+	acks := common.BufferedBusChannel(define.TopicWriteAck, integrationsAckQueue)
 	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
 	for {
 		// important to set the state here for dependent services
@@ -63,25 +79,29 @@ func (svc *IntegrationsService) Serve() {
 			// Clean up resources here, know that Serve will get called again
 			svc.clean()
 			return
-		case <-common.BusChannel(define.AssetConfigUpdated):
+		case <-assets:
 			svc.LogFunc(fmt.Sprintf("%s advises that the asset config file was updated, no action taken", svc.Name))
-		case <-common.BusChannel(define.ConnectivityConfigUpdated):
+		case <-configs:
 			svc.LogFunc(fmt.Sprintf("%s advises that the connections config file was updated, reloading integratations", svc.Name))
 			svc.loadIntegrations()
-		case <-common.BusChannel(define.EquipmentConfigUpdated):
+		case <-equipment:
 			svc.LogFunc(fmt.Sprintf("%s advises that the equipment config file was updated, no action taken", svc.Name))
-		case msg := <-common.BusChannel(define.TopicStateReport):
+		case msg := <-states:
 			for _, v := range svc.stateIntegrations {
 				err := v.SendState(msg.(*common.SystemState))
 				if err != nil {
 					svc.LogFunc(fmt.Sprintf("%s warns: error sending state data to %s, %s", svc.Name, v.Record().Endpoint, err))
 				}
 			}
-		case msg := <-common.BusChannel(define.TopicOpsReport):
+		case msg := <-reports:
+			svc.sendData(msg.(common.OpsReport), false)
+		case msg := <-changes:
+			svc.sendData(msg.(common.OpsReport), true)
+		case msg := <-acks:
 			for _, v := range svc.opsIntegrations {
-				err := v.SendData(msg.(map[string]interface{}))
+				err := v.SendAck(msg.(*common.WriteAck))
 				if err != nil {
-					svc.LogFunc(fmt.Sprintf("%s warns: error sending ops data to %s, %s", svc.Name, v.Record().Endpoint, err))
+					svc.LogFunc(fmt.Sprintf("%s warns: error sending write acknowledgement to %s, %s", svc.Name, v.Record().Endpoint, err))
 				}
 			}
 		case <-time.After(timeout):
@@ -103,6 +123,20 @@ func (svc *IntegrationsService) State() int {
 	return svc.ServiceState
 }
 
+// sendData sends an ops report to the ops integrations that report by exception, for a report
+// of changes, or to the others, for a full report
+func (svc *IntegrationsService) sendData(report common.OpsReport, changes bool) {
+	for _, v := range svc.opsIntegrations {
+		if v.Record().ReportByException != changes {
+			continue
+		}
+		err := v.SendData(report)
+		if err != nil {
+			svc.LogFunc(fmt.Sprintf("%s warns: error sending ops data to %s, %s", svc.Name, v.Record().Endpoint, err))
+		}
+	}
+}
+
 func (svc *IntegrationsService) clean() {
 	for _, v := range svc.opsIntegrations {
 		v.Close()
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/nimbleindustry/device/common"
@@ -12,11 +13,16 @@ import (
 	"github.com/nimbleindustry/suture"
 )
 
+// stateDiagnosticsQueue is the number of diagnostics held while the state is being reported,
+// fieldbus services publishing them at the same instant
+const stateDiagnosticsQueue = 64
+
 // StateService is responsible for reporting the status of the Nimble (field) Device
 // to one or more integrated service implementations (/integrations). Three explicit
 // data points are reported: percentage of (RAM) consumed, percentage of disk consumed,
 // and the load factor for the last minute. Implicitly, the existence of this record
 // at a particular time interval indicates the Device was running at that moment.
+// The latest diagnostics counters published by each fieldbus service are included.
 type StateService struct {
 	common.Service
 
@@ -24,6 +30,7 @@ type StateService struct {
 	LogFunc    func(string)  // Destination for logging
 
 	integrations []integrations.Integration
+	diagnostics  map[string]*common.FieldbusDiagnostics // latest diagnostics of each fieldbus service
 	stop         chan bool
 }
 
@@ -44,13 +51,15 @@ func (svc *StateService) Serve() {
 		return
 	}
 
-	common.SendBusMessage(define.TopicStateReport, common.GetSystemState())
+	common.SendBusMessage(define.TopicStateReport, svc.systemState())
 
 	// this channel used to interrupt for/select loop
 	svc.stop = make(chan bool)
 
-	// break the for loop below every 1 minute to send the state of this Device
-	timeout := time.Duration(1 * time.Minute)
+	diagnostics := common.BufferedBusChannel(define.TopicDiagnostics, stateDiagnosticsQueue)
+	// tick every 1 minute to send the state of this Device
+	ticker := time.NewTicker(time.Duration(1 * time.Minute))
+	defer ticker.Stop()
 	svc.LogFunc(fmt.Sprintf("%s begins running normally", svc.Name))
 	for {
 		// important to set the state here for dependent services
@@ -60,10 +69,37 @@ func (svc *StateService) Serve() {
 			svc.ServiceState = suture.ServiceNotRunning
 			// Clean up resources here, know that Serve will get called again
 			return
-		case <-time.After(timeout):
-			common.SendBusMessage(define.TopicStateReport, common.GetSystemState())
+		case msg := <-diagnostics:
+			if d, ok := msg.(*common.FieldbusDiagnostics); ok {
+				if svc.diagnostics == nil {
+					svc.diagnostics = make(map[string]*common.FieldbusDiagnostics)
+				}
+				svc.diagnostics[d.Service] = d
+			}
+		case <-ticker.C:
+			common.SendBusMessage(define.TopicStateReport, svc.systemState())
+		}
+	}
+}
+
+// systemState returns the state of this Device, including the latest diagnostics of each
+// fieldbus service. Diagnostics not refreshed for two intervals, those of services no longer
+// running, are dropped.
+func (svc *StateService) systemState() *common.SystemState {
+	state := common.GetSystemState()
+	var names []string
+	for k, v := range svc.diagnostics {
+		if state.Timestamp.Sub(v.Timestamp) > 2*common.DiagnosticsInterval {
+			delete(svc.diagnostics, k)
+			continue
 		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		state.Fieldbus = append(state.Fieldbus, svc.diagnostics[v])
 	}
+	return state
 }
 
 // Stop is called by a supervisor to signal that the service should be stopped. Every
@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Value patterns
+const (
+	PatternConstant   = "constant"
+	PatternRamp       = "ramp"
+	PatternSine       = "sine"
+	PatternRandomWalk = "randomWalk"
+	PatternStep       = "step"
+)
+
+const defaultPatternPeriod = time.Minute
+
+// Pattern scripts the value of a simulated tag, in engineering units, over time:
+//
+//	constant   holds Value
+//	ramp       rises linearly from Min to Max over each Period, then restarts at Min
+//	sine       oscillates between Min and Max with the passed Period
+//	randomWalk starts at Value (or midway between Min and Max) and moves by up to Step
+//	           each time it is sampled, staying within Min and Max
+//	step       holds each of Values for a Period in turn, then repeats
+//
+// Tags without a pattern keep whatever value was last written to them.
+type Pattern struct {
+	Type   string        `json:"type"`
+	Value  interface{}   `json:"value,omitempty"`
+	Min    float64       `json:"min,omitempty"`
+	Max    float64       `json:"max,omitempty"`
+	Period string        `json:"period,omitempty"`
+	Step   float64       `json:"step,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+// generator produces the successive values of a pattern
+type generator struct {
+	pattern Pattern
+	period  time.Duration
+	walk    float64
+	random  *rand.Rand
+}
+
+func newGenerator(pattern Pattern, random *rand.Rand) (*generator, error) {
+	g := &generator{pattern: pattern, period: defaultPatternPeriod, random: random}
+	if pattern.Period != "" {
+		period, err := time.ParseDuration(pattern.Period)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("has invalid period %q", pattern.Period)
+		}
+		g.period = period
+	}
+	switch pattern.Type {
+	case PatternConstant, "":
+	case PatternRamp, PatternSine:
+		if pattern.Max < pattern.Min {
+			return nil, fmt.Errorf("%s pattern has max %v below min %v", pattern.Type, pattern.Max, pattern.Min)
+		}
+	case PatternRandomWalk:
+		if pattern.Max < pattern.Min {
+			return nil, fmt.Errorf("%s pattern has max %v below min %v", pattern.Type, pattern.Max, pattern.Min)
+		}
+		g.walk = (pattern.Min + pattern.Max) / 2
+		if f, ok := pattern.Value.(float64); ok {
+			g.walk = f
+		}
+	case PatternStep:
+		if len(pattern.Values) == 0 {
+			return nil, fmt.Errorf("%s pattern has no values", pattern.Type)
+		}
+	default:
+		return nil, fmt.Errorf("has unknown pattern type %s", pattern.Type)
+	}
+	return g, nil
+}
+
+// value returns the pattern's value at the passed time since the simulation started
+func (g *generator) value(elapsed time.Duration) interface{} {
+	p := g.pattern
+	cycle := float64(elapsed%g.period) / float64(g.period)
+	switch p.Type {
+	case PatternRamp:
+		return p.Min + (p.Max-p.Min)*cycle
+	case PatternSine:
+		return (p.Min+p.Max)/2 + (p.Max-p.Min)/2*math.Sin(2*math.Pi*cycle)
+	case PatternRandomWalk:
+		g.walk += p.Step * (2*g.random.Float64() - 1)
+		g.walk = math.Max(p.Min, math.Min(p.Max, g.walk))
+		return g.walk
+	case PatternStep:
+		return p.Values[int(elapsed/g.period)%len(p.Values)]
+	}
+	return p.Value
+}
@@ -0,0 +1,109 @@
+package simulator
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+
+	"github.com/goburrow/serial"
+)
+
+// Run implements the `device simulate` mode: it simulates the modbus slaves of an equipment
+// config file until interrupted. The passed arguments follow the simulate keyword, e.g.
+//
+//	device simulate -listen :5020 -script conf/simulation.json
+//	device simulate -serial /dev/ttyUSB1 -baud 9600 conf/equipment.json
+func Run(args []string, logFunc func(string)) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	listen := flags.String("listen", ":5020", "Address on which to serve modbus tcp, empty to disable")
+	scriptPath := flags.String("script", "", "Simulation script (json) of tag patterns and faults")
+	serialPort := flags.String("serial", "", "Serial port on which to serve modbus rtu")
+	baudRate := flags.Int("baud", 19200, "Serial port baud rate")
+	parity := flags.String("parity", "E", "Serial port parity: N, E or O")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	equipmentPath := define.EquipmentConfigPath
+	if flags.NArg() > 0 {
+		equipmentPath = flags.Arg(0)
+	}
+
+	var equipment common.Equipment
+	if err := loadJSON(equipmentPath, &equipment); err != nil {
+		return fmt.Errorf("Error loading equipment file %s, %s", equipmentPath, err)
+	}
+	var script Script
+	if *scriptPath != "" {
+		if err := loadJSON(*scriptPath, &script); err != nil {
+			return fmt.Errorf("Error loading script file %s, %s", *scriptPath, err)
+		}
+	}
+	var disconnectEvery time.Duration
+	if script.DisconnectEvery != "" {
+		var err error
+		if disconnectEvery, err = time.ParseDuration(script.DisconnectEvery); err != nil || disconnectEvery <= 0 {
+			return fmt.Errorf("invalid disconnectEvery %q", script.DisconnectEvery)
+		}
+	}
+	sim, err := New(equipment, script)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+
+	if *listen != "" {
+		server, err := sim.ListenTCP(*listen)
+		if err != nil {
+			return err
+		}
+		logFunc(fmt.Sprintf("simulator serves modbus tcp on %s", server.Addr()))
+	}
+	if *serialPort != "" {
+		// without a timeout reads block until the master sends a request
+		port, err := serial.Open(&serial.Config{Address: *serialPort, BaudRate: *baudRate, DataBits: 8,
+			StopBits: 1, Parity: *parity})
+		if err != nil {
+			return err
+		}
+		defer port.Close()
+		logFunc(fmt.Sprintf("simulator serves modbus rtu on %s", *serialPort))
+		go func() {
+			logFunc(fmt.Sprintf("simulator stops serving modbus rtu, %s", sim.ServeRTU(port)))
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	var disconnects <-chan time.Time
+	if disconnectEvery > 0 {
+		ticker := time.NewTicker(disconnectEvery)
+		defer ticker.Stop()
+		disconnects = ticker.C
+	}
+	for {
+		select {
+		case sig := <-sigs:
+			logFunc(fmt.Sprintf("simulator stops on %s", sig))
+			return nil
+		case <-disconnects:
+			logFunc("simulator drops tcp connections")
+			sim.Disconnect()
+		}
+	}
+}
+
+func loadJSON(path string, object interface{}) error {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(source, object)
+}
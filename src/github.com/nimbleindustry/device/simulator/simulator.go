@@ -0,0 +1,275 @@
+// Package simulator stands up simulated modbus slaves from an equipment description, so that
+// the fieldbus services can be exercised without a real PLC, both from go test and from the
+// `device simulate` mode. Tag values follow scripted patterns, and exceptions, latency and
+// dropped connections can be injected.
+package simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/services/fieldbus"
+
+	"github.com/goburrow/modbus"
+)
+
+// modbusExceptionGatewayTargetFailed is returned for unit IDs that are not simulated
+const modbusExceptionGatewayTargetFailed = 0x0B
+
+// Script describes the behaviour of a simulation. Patterns and exceptions are keyed by tag
+// (registerName, or <device>.<registerName> for the tags of modbus devices).
+type Script struct {
+	Tags            map[string]Pattern `json:"tags"`
+	Exceptions      map[string]byte    `json:"exceptions,omitempty"`      // exception code returned for requests touching the tag
+	Latency         string             `json:"latency,omitempty"`         // delay before each response
+	DisconnectEvery string             `json:"disconnectEvery,omitempty"` // period at which tcp clients are disconnected
+	Identification  map[string]string  `json:"identification,omitempty"`  // device identification objects, e.g. vendorName
+}
+
+// Simulator simulates the modbus slaves of an equipment description: one per unit ID used by
+// its modbus devices, plus one answering every other unit ID for the entries read from the
+// connection's own unit ID. Pattern values are sampled as each request is answered.
+type Simulator struct {
+	mutex      sync.Mutex
+	slaves     map[byte]*fieldbus.ModbusSlave
+	entries    []common.ModbusEntry
+	generators map[string]*generator
+	exceptions map[string]byte
+	latency    time.Duration
+	started    time.Time
+	servers    []*fieldbus.ModbusTCPServer
+}
+
+// New returns a simulator for the modbus entries of the passed equipment, scripted as
+// described by the passed script
+func New(equipment common.Equipment, script Script) (*Simulator, error) {
+	integration := equipment.MachineIntegrations
+	entries, err := common.ExpandModbusDevices(integration.ModbusEntries, integration.ModbusDevices)
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulator{
+		slaves:     make(map[byte]*fieldbus.ModbusSlave),
+		entries:    entries,
+		generators: make(map[string]*generator),
+		exceptions: make(map[string]byte),
+		started:    time.Now(),
+	}
+	byUnit := make(map[int][]common.ModbusEntry)
+	names := make(map[string]bool, len(entries))
+	for _, v := range entries {
+		byUnit[v.UnitID] = append(byUnit[v.UnitID], v)
+		names[v.RegisterName] = true
+	}
+	for unitID, v := range byUnit {
+		if sim.slaves[byte(unitID)], err = fieldbus.NewModbusSlaveFor(0, v); err != nil {
+			return nil, err
+		}
+	}
+	if len(script.Identification) > 0 {
+		id, err := fieldbus.ParseDeviceIdentification(script.Identification)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range sim.slaves {
+			v.Identification = id
+		}
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for tag, pattern := range script.Tags {
+		if !names[tag] {
+			return nil, fmt.Errorf("pattern for %s, which is not a modbus tag", tag)
+		}
+		if sim.generators[tag], err = newGenerator(pattern, random); err != nil {
+			return nil, fmt.Errorf("%s %s", tag, err)
+		}
+	}
+	for tag, code := range script.Exceptions {
+		sim.SetException(tag, code)
+	}
+	if script.Latency != "" {
+		if sim.latency, err = time.ParseDuration(script.Latency); err != nil {
+			return nil, fmt.Errorf("invalid latency %q", script.Latency)
+		}
+	}
+	sim.sample()
+	return sim, nil
+}
+
+// SetException makes requests touching the tag fail with the passed exception code, zero
+// clearing the exception
+func (sim *Simulator) SetException(tag string, code byte) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	if code == 0 {
+		delete(sim.exceptions, tag)
+	} else {
+		sim.exceptions[tag] = code
+	}
+}
+
+// SetLatency delays each response by the passed duration
+func (sim *Simulator) SetLatency(latency time.Duration) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	sim.latency = latency
+}
+
+// Set stores a value, in engineering units, in the tag's registers. Tags with a pattern are
+// overwritten when next sampled.
+func (sim *Simulator) Set(tag string, value interface{}) error {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	for _, v := range sim.entries {
+		if v.RegisterName == tag {
+			return sim.slaves[byte(v.UnitID)].Store(v, sampleValue(v, value))
+		}
+	}
+	return fmt.Errorf("%s is not a modbus tag", tag)
+}
+
+// Get returns the value, in engineering units, of the tag's registers
+func (sim *Simulator) Get(tag string) (interface{}, error) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	for _, v := range sim.entries {
+		if v.RegisterName == tag {
+			return sim.slaves[byte(v.UnitID)].Load(v)
+		}
+	}
+	return nil, fmt.Errorf("%s is not a modbus tag", tag)
+}
+
+// sample stores the current value of every pattern, with the simulator's mutex held
+func (sim *Simulator) sample() {
+	elapsed := time.Since(sim.started)
+	for _, v := range sim.entries {
+		if g, found := sim.generators[v.RegisterName]; found {
+			// values that do not fit the entry are left for the script's author to notice
+			sim.slaves[byte(v.UnitID)].Store(v, sampleValue(v, g.value(elapsed)))
+		}
+	}
+}
+
+// sampleValue adapts a numeric pattern value to the entry: bits are on from 0.5, and values
+// of unscaled integer registers are rounded
+func sampleValue(entry common.ModbusEntry, value interface{}) interface{} {
+	f, ok := value.(float64)
+	if !ok {
+		return value
+	}
+	table, _ := fieldbus.EntryTable(entry)
+	switch {
+	case table == modbus.FuncCodeReadCoils || table == modbus.FuncCodeReadDiscreteInputs ||
+		entry.DataType == common.DataTypeBit:
+		return f >= 0.5
+	case entry.DataType == common.DataTypeFloat32 || entry.DataType == common.DataTypeFloat64 || entry.IsScaled():
+		return f
+	}
+	return math.Floor(f + 0.5)
+}
+
+// Handle answers a request PDU for the passed unit ID, implementing fieldbus.ModbusHandler
+func (sim *Simulator) Handle(unitID byte, function byte, data []byte) (byte, []byte) {
+	sim.mutex.Lock()
+	latency := sim.latency
+	// units that are not simulated are answered by the slave of the connection's unit ID
+	if _, simulated := sim.slaves[unitID]; !simulated {
+		unitID = 0
+	}
+	slave, found := sim.slaves[unitID]
+	code := sim.exception(unitID, function, data)
+	if found && code == 0 {
+		sim.sample()
+	}
+	sim.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if !found {
+		return function | 0x80, []byte{modbusExceptionGatewayTargetFailed}
+	}
+	if code != 0 {
+		return function | 0x80, []byte{code}
+	}
+	return slave.Handle(unitID, function, data)
+}
+
+// exception returns the injected exception code for a request to the slave simulating the
+// passed unit ID, or zero
+func (sim *Simulator) exception(unitID byte, function byte, data []byte) byte {
+	if len(sim.exceptions) == 0 || len(data) < 4 {
+		return 0
+	}
+	table := int(function)
+	switch function {
+	case modbus.FuncCodeWriteSingleCoil, modbus.FuncCodeWriteMultipleCoils:
+		table = modbus.FuncCodeReadCoils
+	case modbus.FuncCodeWriteSingleRegister, modbus.FuncCodeWriteMultipleRegisters:
+		table = modbus.FuncCodeReadHoldingRegisters
+	}
+	address := int(binary.BigEndian.Uint16(data))
+	quantity := int(binary.BigEndian.Uint16(data[2:]))
+	if function == modbus.FuncCodeWriteSingleCoil || function == modbus.FuncCodeWriteSingleRegister {
+		quantity = 1
+	}
+	for _, v := range sim.entries {
+		code, found := sim.exceptions[v.RegisterName]
+		if !found || byte(v.UnitID) != unitID {
+			continue
+		}
+		t, _ := fieldbus.EntryTable(v)
+		span := v.RegisterCount()
+		if t == modbus.FuncCodeReadCoils || t == modbus.FuncCodeReadDiscreteInputs {
+			span = 1
+		}
+		if t == table && v.Address < address+quantity && v.Address+span > address {
+			return code
+		}
+	}
+	return 0
+}
+
+// ListenTCP serves the simulated slaves to modbus tcp clients on the passed address
+func (sim *Simulator) ListenTCP(address string) (*fieldbus.ModbusTCPServer, error) {
+	server, err := fieldbus.ListenModbusTCP(address, sim)
+	if err != nil {
+		return nil, err
+	}
+	sim.mutex.Lock()
+	sim.servers = append(sim.servers, server)
+	sim.mutex.Unlock()
+	return server, nil
+}
+
+// ServeRTU serves the simulated slaves to a modbus rtu master on the passed port until
+// reading or writing the port fails
+func (sim *Simulator) ServeRTU(port io.ReadWriter) error {
+	return fieldbus.ServeModbusRTU(port, sim)
+}
+
+// Disconnect drops every tcp client connection, as a device reboot would
+func (sim *Simulator) Disconnect() {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	for _, v := range sim.servers {
+		v.DropConnections()
+	}
+}
+
+// Close stops every tcp server
+func (sim *Simulator) Close() {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	for _, v := range sim.servers {
+		v.Close()
+	}
+	sim.servers = nil
+}
@@ -0,0 +1,209 @@
+package simulator
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbleindustry/device/common"
+	"github.com/nimbleindustry/device/define"
+	"github.com/nimbleindustry/device/services/fieldbus"
+
+	"github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+const simulatedEquipmentFixture = `{
+  "ref": "http://machineconfig.com/nimbleindustry.com/simulated-equipment-1.json",
+  "entity": "nimbleindustry.com",
+  "machineIntegration": {
+    "pollGroups": [{"name": "default", "interval": "50ms"}],
+    "modbusDevices": [{"name": "drive1", "unitId": 2, "tagGroup": "drive"}],
+    "modbus": [
+      {"registerName": "Running", "functions": [1, 5], "address": 0},
+      {"registerName": "Pressure", "functions": [3], "address": 0, "multiplier": 0.1, "unit": "bar"},
+      {"registerName": "Level", "functions": [3], "address": 1},
+      {"registerName": "Temperature", "functions": [4], "address": 0, "dataType": "float32"},
+      {"registerName": "Speed", "functions": [4], "address": 0, "tagGroup": "drive"}
+    ]
+  }
+}`
+
+func simulatedEquipment(t *testing.T) common.Equipment {
+	var equipment common.Equipment
+	assert.Nil(t, json.Unmarshal([]byte(simulatedEquipmentFixture), &equipment), "unmarshall failed")
+	return equipment
+}
+
+func TestPatterns(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	ramp, err := newGenerator(Pattern{Type: PatternRamp, Min: 10, Max: 20, Period: "10s"}, random)
+	assert.Nil(t, err)
+	assert.Equal(t, 10.0, ramp.value(0))
+	assert.Equal(t, 15.0, ramp.value(5*time.Second))
+	assert.Equal(t, 12.0, ramp.value(12*time.Second), "expected ramp to restart each period")
+
+	sine, err := newGenerator(Pattern{Type: PatternSine, Min: -1, Max: 1, Period: "4s"}, random)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, sine.value(0))
+	assert.Equal(t, 1.0, sine.value(time.Second))
+
+	step, err := newGenerator(Pattern{Type: PatternStep, Values: []interface{}{1.0, true, "idle"}, Period: "1s"}, random)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, step.value(500*time.Millisecond))
+	assert.Equal(t, true, step.value(1500*time.Millisecond))
+	assert.Equal(t, "idle", step.value(2500*time.Millisecond))
+	assert.Equal(t, 1.0, step.value(3500*time.Millisecond))
+
+	walk, err := newGenerator(Pattern{Type: PatternRandomWalk, Min: 0, Max: 1, Step: 0.5}, random)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		v := walk.value(0).(float64)
+		assert.True(t, v >= 0 && v <= 1, "expected random walk to stay within bounds, got %v", v)
+	}
+
+	constant, err := newGenerator(Pattern{Value: 7.5}, random)
+	assert.Nil(t, err)
+	assert.Equal(t, 7.5, constant.value(time.Hour))
+
+	_, err = newGenerator(Pattern{Type: "square"}, random)
+	assert.NotNil(t, err)
+	_, err = newGenerator(Pattern{Type: PatternStep}, random)
+	assert.NotNil(t, err)
+	_, err = newGenerator(Pattern{Type: PatternRamp, Period: "often"}, random)
+	assert.NotNil(t, err)
+}
+
+func TestSimulatorScript(t *testing.T) {
+	equipment := simulatedEquipment(t)
+	_, err := New(equipment, Script{Tags: map[string]Pattern{"Unknown": {Value: 1.0}}})
+	assert.NotNil(t, err, "expected pattern for unknown tag to be rejected")
+
+	sim, err := New(equipment, Script{Tags: map[string]Pattern{
+		"Pressure":     {Value: 12.5},
+		"Level":        {Type: PatternRamp, Min: 0, Max: 100, Period: "1h"},
+		"Running":      {Value: 1.0},
+		"drive1.Speed": {Value: 1450.0},
+	}})
+	assert.Nil(t, err)
+	v, err := sim.Get("Pressure")
+	assert.Nil(t, err)
+	assert.Equal(t, 12.5, v)
+	v, _ = sim.Get("Level")
+	assert.Equal(t, int16(0), v, "expected ramp to be rounded for an integer register")
+	v, _ = sim.Get("Running")
+	assert.Equal(t, true, v)
+	v, _ = sim.Get("drive1.Speed")
+	assert.Equal(t, int16(1450), v)
+
+	assert.Nil(t, sim.Set("Temperature", 21.5))
+	v, _ = sim.Get("Temperature")
+	assert.Equal(t, float32(21.5), v)
+}
+
+func TestSimulatorServesRTU(t *testing.T) {
+	sim, err := New(simulatedEquipment(t), Script{Tags: map[string]Pattern{"drive1.Speed": {Value: 1450.0}}})
+	assert.Nil(t, err)
+	master, slave := net.Pipe()
+	defer master.Close()
+	go sim.ServeRTU(slave)
+
+	handler := modbus.NewRTUClientHandler("")
+	handler.SlaveId = 2
+	client := modbus.NewClient2(handler, pipeTransporter{master})
+	b, err := client.ReadInputRegisters(0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0xAA}, b)
+	handler.SlaveId = 1
+	_, err = client.WriteMultipleCoils(0, 1, []byte{1})
+	assert.Nil(t, err)
+	v, _ := sim.Get("Running")
+	assert.Equal(t, true, v)
+}
+
+// pipeTransporter exchanges rtu frames over a net.Pipe, on which each response arrives in a
+// single read
+type pipeTransporter struct {
+	conn net.Conn
+}
+
+func (p pipeTransporter) Send(aduRequest []byte) ([]byte, error) {
+	p.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := p.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 256)
+	n, err := p.conn.Read(response)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+// nextReport waits for an ops report satisfying the passed condition
+func nextReport(t *testing.T, reports chan interface{}, condition func(common.OpsReport) bool) common.OpsReport {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-reports:
+			if report := msg.(common.OpsReport); condition(report) {
+				return report
+			}
+		case <-timeout:
+			t.Error("expected ops report not received")
+			return common.OpsReport{}
+		}
+	}
+}
+
+func quality(tag string, q string) func(common.OpsReport) bool {
+	return func(report common.OpsReport) bool {
+		return report[tag].Quality == q
+	}
+}
+
+func TestModbusTCPServiceAgainstSimulator(t *testing.T) {
+	common.ConnectionConfig = common.Connections{DeviceID: "simulated-device"}
+	common.EquipmentConfig = simulatedEquipment(t)
+	sim, err := New(common.EquipmentConfig, Script{Tags: map[string]Pattern{
+		"Pressure":     {Value: 12.5},
+		"Temperature":  {Type: PatternSine, Min: 20, Max: 30, Period: "10s"},
+		"drive1.Speed": {Value: 1450.0},
+	}})
+	assert.Nil(t, err)
+	server, err := sim.ListenTCP("127.0.0.1:0")
+	assert.Nil(t, err, "unable to listen")
+	defer sim.Close()
+
+	address := server.Addr().(*net.TCPAddr)
+	record := common.ConnectionRecord{Type: define.ModbusTCP, Endpoint: address.IP.String(), Port: address.Port}
+	svc := fieldbus.NewModbusTCPService(record, func(s string) { t.Log(s) }, 0)
+	reports := common.BusChannel(define.TopicOpsReport)
+	done := make(chan bool)
+	go func() {
+		svc.Serve()
+		done <- true
+	}()
+
+	report := nextReport(t, reports, quality("Pressure", define.QualityGood))
+	assert.Equal(t, 12.5, report["Pressure"].Value)
+	assert.Equal(t, "bar", report["Pressure"].Unit)
+	assert.Equal(t, int16(1450), report["drive1.Speed"].Value)
+	temperature, _ := report["Temperature"].Value.(float32)
+	assert.True(t, temperature >= 20 && temperature <= 30, "expected sine within bounds, got %v", temperature)
+
+	sim.SetException("Pressure", modbus.ExceptionCodeIllegalDataAddress)
+	report = nextReport(t, reports, quality("Pressure", define.QualityBad))
+	assert.Equal(t, define.QualityGood, report["Level"].Quality, "expected exception to be isolated to its tag")
+	sim.SetException("Pressure", 0)
+	nextReport(t, reports, quality("Pressure", define.QualityGood))
+
+	sim.Disconnect()
+	nextReport(t, reports, quality("Pressure", define.QualityStale))
+	nextReport(t, reports, quality("Pressure", define.QualityGood))
+	svc.Stop()
+	<-done
+}